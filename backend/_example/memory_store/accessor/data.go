@@ -39,6 +39,7 @@ type metaUser struct {
 	Verified     bool
 	Blocked      bool
 	BlockedUntil time.Time
+	Shadowed     bool
 	Details      engine.UserDetailEntry
 }
 
@@ -86,6 +87,24 @@ func (m *MemData) Find(req engine.FindRequest) (comments []store.Comment, err er
 
 	switch {
 
+	case req.Locator.SiteID != "" && req.Query != "": // full-text search for site, or for post if url set
+		visible := engine.SearchFilter(req, func(flag engine.Flag, userID string) bool {
+			return m.checkFlag(engine.FlagRequest{Locator: store.Locator{SiteID: req.Locator.SiteID}, UserID: userID, Flag: flag})
+		})
+		comments = m.match(m.posts[req.Locator.SiteID], func(c store.Comment) bool {
+			return (req.Locator.URL == "" || c.Locator.URL == req.Locator.URL) && engine.MatchSearch(c, req.Query) && visible(c)
+		})
+
+	case req.Locator.SiteID != "" && req.Pending: // comments awaiting approval for site, or for post if url set
+		comments = m.match(m.posts[req.Locator.SiteID], func(c store.Comment) bool {
+			return (req.Locator.URL == "" || c.Locator.URL == req.Locator.URL) && c.Pending && !c.Deleted
+		})
+
+	case req.Locator.SiteID != "" && req.Reported: // reported comments for site, or for post if url set
+		comments = m.match(m.posts[req.Locator.SiteID], func(c store.Comment) bool {
+			return (req.Locator.URL == "" || c.Locator.URL == req.Locator.URL) && len(c.Reports) > 0 && !c.Deleted
+		})
+
 	case req.Locator.SiteID != "" && req.Locator.URL != "": // find comments for site and url
 		comments = m.match(m.posts[req.Locator.SiteID], func(c store.Comment) bool {
 			return c.Locator == req.Locator && (req.Since.IsZero() || c.Timestamp.After(req.Since))
@@ -151,7 +170,7 @@ func (m *MemData) Count(req engine.FindRequest) (count int, err error) {
 	switch {
 	case req.Locator.URL != "": // comment's count for post
 		comments := m.match(m.posts[req.Locator.SiteID], func(c store.Comment) bool {
-			return c.Locator == req.Locator && !c.Deleted
+			return c.Locator == req.Locator && !c.Deleted && !c.Pending && !m.shadowed(c)
 		})
 		return len(comments), nil
 	case req.UserID != "":
@@ -179,7 +198,7 @@ func (m *MemData) Info(req engine.InfoRequest) (res []store.PostInfo, err error)
 		}
 		info := store.PostInfo{
 			URL:      req.Locator.URL,
-			Count:    len(comments),
+			Count:    len(m.match(comments, func(c store.Comment) bool { return !m.shadowed(c) })),
 			ReadOnly: false,
 			FirstTS:  comments[0].Timestamp.UTC(),
 			LastTS:   comments[len(comments)-1].Timestamp.UTC(),
@@ -209,7 +228,9 @@ func (m *MemData) Info(req engine.InfoRequest) (res []store.PostInfo, err error)
 			if info, ok = infoAll[c.Locator]; !ok {
 				info = store.PostInfo{URL: c.Locator.URL, FirstTS: c.Timestamp.UTC()}
 			}
-			info.Count++
+			if !m.shadowed(c) {
+				info.Count++
+			}
 			info.LastTS = c.Timestamp.UTC()
 			infoAll[c.Locator] = info
 		}
@@ -266,6 +287,14 @@ func (m *MemData) ListFlags(req engine.FlagRequest) (res []any, err error) {
 		}
 		return res, nil
 
+	case engine.Shadowed:
+		for _, u := range m.metaUsers {
+			if u.SiteID == req.Locator.SiteID && u.Shadowed {
+				res = append(res, u.UserID)
+			}
+		}
+		return res, nil
+
 	case engine.Blocked:
 		log.Printf("[INFO] metaUsers: %+v", m.metaUsers)
 		for _, u := range m.metaUsers {
@@ -284,7 +313,7 @@ func (m *MemData) ListFlags(req engine.FlagRequest) (res []any, err error) {
 // and all site's details listing under the same function (and not to extend engine interface by two separate functions).
 func (m *MemData) UserDetail(req engine.UserDetailRequest) ([]engine.UserDetailEntry, error) {
 	switch req.Detail {
-	case engine.UserEmail, engine.UserTelegram:
+	case engine.UserEmail, engine.UserTelegram, engine.UserEmailDigest, engine.UserMatrix, engine.UserWebPush:
 		if req.UserID == "" {
 			return nil, fmt.Errorf("userid cannot be empty in request for single detail")
 		}
@@ -365,6 +394,11 @@ func (m *MemData) Close() error {
 	return nil
 }
 
+// shadowed checks if comment made by shadow-banned user, such comments not counted for posts
+func (m *MemData) shadowed(c store.Comment) bool {
+	return m.checkFlag(engine.FlagRequest{Flag: engine.Shadowed, Locator: c.Locator, UserID: c.User.ID})
+}
+
 func (m *MemData) checkFlag(req engine.FlagRequest) (val bool) {
 	switch req.Flag {
 	case engine.Blocked:
@@ -381,6 +415,13 @@ func (m *MemData) checkFlag(req engine.FlagRequest) (val bool) {
 			}
 			return meta.Verified
 		}
+	case engine.Shadowed:
+		if meta, ok := m.metaUsers[req.UserID]; ok {
+			if meta.SiteID != req.Locator.SiteID {
+				return false
+			}
+			return meta.Shadowed
+		}
 	case engine.ReadOnly:
 		if meta, ok := m.metaPosts[req.Locator]; ok {
 			return meta.ReadOnly
@@ -419,6 +460,11 @@ func (m *MemData) setFlag(req engine.FlagRequest) (res bool, err error) {
 		}
 		m.metaUsers[req.UserID] = meta
 
+	case engine.Shadowed:
+		meta := m.metaUsers[req.UserID]
+		meta.UserID, meta.SiteID, meta.Shadowed = req.UserID, req.Locator.SiteID, status
+		m.metaUsers[req.UserID] = meta
+
 	case engine.ReadOnly:
 		info, ok := m.metaPosts[req.Locator]
 		if !ok {
@@ -446,6 +492,12 @@ func (m *MemData) getUserDetail(req engine.UserDetailRequest) []engine.UserDetai
 			return []engine.UserDetailEntry{{UserID: req.UserID, Email: meta.Details.Email}}
 		case engine.UserTelegram:
 			return []engine.UserDetailEntry{{UserID: req.UserID, Telegram: meta.Details.Telegram}}
+		case engine.UserEmailDigest:
+			return []engine.UserDetailEntry{{UserID: req.UserID, EmailDigest: meta.Details.EmailDigest}}
+		case engine.UserMatrix:
+			return []engine.UserDetailEntry{{UserID: req.UserID, Matrix: meta.Details.Matrix}}
+		case engine.UserWebPush:
+			return []engine.UserDetailEntry{{UserID: req.UserID, WebPush: meta.Details.WebPush}}
 		}
 	}
 
@@ -480,6 +532,18 @@ func (m *MemData) setUserDetail(req engine.UserDetailRequest) []engine.UserDetai
 		entry.Details.Telegram = req.Update
 		m.metaUsers[req.UserID] = entry
 		return []engine.UserDetailEntry{{UserID: req.UserID, Telegram: req.Update}}
+	case engine.UserEmailDigest:
+		entry.Details.EmailDigest = req.Update
+		m.metaUsers[req.UserID] = entry
+		return []engine.UserDetailEntry{{UserID: req.UserID, EmailDigest: req.Update}}
+	case engine.UserMatrix:
+		entry.Details.Matrix = req.Update
+		m.metaUsers[req.UserID] = entry
+		return []engine.UserDetailEntry{{UserID: req.UserID, Matrix: req.Update}}
+	case engine.UserWebPush:
+		entry.Details.WebPush = req.Update
+		m.metaUsers[req.UserID] = entry
+		return []engine.UserDetailEntry{{UserID: req.UserID, WebPush: req.Update}}
 	}
 
 	return []engine.UserDetailEntry{}
@@ -518,6 +582,12 @@ func (m *MemData) deleteUserDetail(locator store.Locator, userID string, userDet
 		entry.Details.Email = ""
 	case engine.UserTelegram:
 		entry.Details.Telegram = ""
+	case engine.UserEmailDigest:
+		entry.Details.EmailDigest = ""
+	case engine.UserMatrix:
+		entry.Details.Matrix = ""
+	case engine.UserWebPush:
+		entry.Details.WebPush = ""
 	case engine.AllUserDetails:
 		entry.Details = engine.UserDetailEntry{UserID: userID}
 	}
@@ -550,8 +620,11 @@ func (m *MemData) updateComment(comment store.Comment) error {
 		c.Orig = comment.Orig
 		c.Score = comment.Score
 		c.Votes = comment.Votes
+		c.Reports = comment.Reports
 		c.Pin = comment.Pin
 		c.Deleted = comment.Deleted
+		c.Pending = comment.Pending
+		c.Spam = comment.Spam
 		c.User = comment.User
 		comments[i] = c
 		m.posts[comment.Locator.SiteID] = comments
@@ -138,6 +138,81 @@ func TestMemData_FindLast(t *testing.T) {
 	assert.Equal(t, 0, len(res))
 }
 
+func TestMemData_Search(t *testing.T) {
+	b := prepMem(t)
+	req := engine.FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: "text2", Sort: "-time"}
+	res, err := b.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-2", res[0].ID)
+
+	req.Query = "user some"
+	res, err = b.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "id-2", res[0].ID)
+
+	req.Query = "radio-t.com"
+	res, err = b.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-1", res[0].ID)
+
+	req.Query = "nothing"
+	res, err = b.Find(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestMemData_Pending(t *testing.T) {
+	b := prepMem(t)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	_, err := b.Create(store.Comment{ID: "id-3", Text: "pending text", Pending: true, Locator: loc,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 24, 0, time.UTC), User: store.User{ID: "user2"}})
+	require.NoError(t, err)
+
+	req := engine.FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Pending: true}
+	res, err := b.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-3", res[0].ID)
+
+	c, err := b.Count(engine.FindRequest{Locator: loc})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, c, "pending comment not counted")
+
+	res[0].Pending = false
+	require.NoError(t, b.Update(res[0]))
+	res, err = b.Find(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res), "approved comment not pending")
+	c, err = b.Count(engine.FindRequest{Locator: loc})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, c)
+}
+
+func TestMemData_Reported(t *testing.T) {
+	b := prepMem(t)
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	comment, err := b.Get(engine.GetRequest{Locator: loc, CommentID: "id-2"})
+	require.NoError(t, err)
+	comment.Reports = map[string]store.Report{"user2": {Reason: store.ReportSpam}}
+	require.NoError(t, b.Update(comment))
+
+	req := engine.FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Reported: true, Sort: "-reports"}
+	res, err := b.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-2", res[0].ID)
+	assert.Equal(t, store.ReportSpam, res[0].Reports["user2"].Reason)
+
+	res[0].Reports = nil
+	require.NoError(t, b.Update(res[0]))
+	res, err = b.Find(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res), "reports dismissed")
+}
+
 func TestMemData_FindLastSince(t *testing.T) {
 	b := prepMem(t)
 	ts := time.Date(2017, 12, 20, 15, 18, 21, 0, time.Local)
@@ -521,6 +596,36 @@ func TestMemData_FlagListVerified(t *testing.T) {
 	assert.Equal(t, 0, len(ids))
 }
 
+func TestMemData_FlagShadowed(t *testing.T) {
+	b := prepMem(t)
+	setFlag := func(flag engine.Flag, user string, status engine.FlagStatus) {
+		req := engine.FlagRequest{Flag: flag, Locator: store.Locator{SiteID: "radio-t"}, UserID: user, Update: status}
+		_, err := b.Flag(req)
+		require.NoError(t, err)
+	}
+	isShadowed := func(site, user string) bool {
+		v, err := b.Flag(engine.FlagRequest{Flag: engine.Shadowed, Locator: store.Locator{SiteID: site}, UserID: user})
+		require.NoError(t, err)
+		return v
+	}
+
+	setFlag(engine.Verified, "u1", engine.FlagTrue)
+	setFlag(engine.Shadowed, "u1", engine.FlagTrue)
+	setFlag(engine.Shadowed, "u2", engine.FlagTrue)
+	setFlag(engine.Shadowed, "u2", engine.FlagFalse)
+	assert.True(t, isShadowed("radio-t", "u1"))
+	assert.False(t, isShadowed("radio-t", "u2"))
+	assert.False(t, isShadowed("radio-t-bad", "u1"), "nothing shadowed on wrong site")
+
+	v, err := b.Flag(engine.FlagRequest{Flag: engine.Verified, Locator: store.Locator{SiteID: "radio-t"}, UserID: "u1"})
+	require.NoError(t, err)
+	assert.True(t, v, "other flags kept")
+
+	ids, err := b.ListFlags(engine.FlagRequest{Flag: engine.Shadowed, Locator: store.Locator{SiteID: "radio-t"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"u1"}, ids)
+}
+
 func TestMemData_FlagListBlocked(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		b := prepMem(t)
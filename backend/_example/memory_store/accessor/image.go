@@ -9,6 +9,7 @@ package accessor
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -81,6 +82,28 @@ func (m *MemImage) Delete(id string) error {
 	return nil
 }
 
+// List returns images of the user, all images if userID is empty
+func (m *MemImage) List(userID string) ([]image.Meta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := []image.Meta{}
+	add := func(images map[string][]byte, staging bool) {
+		for id, img := range images {
+			if userID != "" && !strings.HasPrefix(id, userID+"/") {
+				continue
+			}
+			if _, committed := m.images[id]; staging && committed {
+				continue
+			}
+			// insert time is unknown for committed images after cleanup
+			res = append(res, image.Meta{ID: id, Size: int64(len(img)), Created: m.insertTime[id], Staging: staging})
+		}
+	}
+	add(m.images, false)
+	add(m.imagesStaging, true)
+	return res, nil
+}
+
 // Commit moves image from staging to permanent
 func (m *MemImage) Commit(id string) error {
 	m.mu.RLock()
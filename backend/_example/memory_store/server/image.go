@@ -78,3 +78,12 @@ func (s *RPC) imgInfoHndl(id uint64, _ json.RawMessage) (rr jrpc.Response) {
 	info, err := s.img.Info()
 	return jrpc.EncodeResponse(id, info, err)
 }
+
+func (s *RPC) imgListHndl(id uint64, params json.RawMessage) (rr jrpc.Response) {
+	var userID string
+	if err := json.Unmarshal(params, &userID); err != nil {
+		return jrpc.Response{Error: err.Error()}
+	}
+	images, err := s.img.List(userID)
+	return jrpc.EncodeResponse(id, images, err)
+}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/go-pkgz/jrpc"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/remark42/backend/app/store/image"
 )
@@ -167,3 +168,30 @@ func TestRPC_imgInfoHndl(t *testing.T) {
 	_, err = ri.Load("test_img")
 	assert.EqualError(t, err, "image test_img not found")
 }
+
+func TestRPC_imgListHndl(t *testing.T) {
+	port, teardown := prepTestStore(t)
+	defer teardown()
+	api := fmt.Sprintf("http://localhost:%d/test", port)
+
+	ri := image.RPC{Client: jrpc.Client{API: api, Client: http.Client{Timeout: 1 * time.Second}}}
+
+	images, err := ri.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+
+	assert.NoError(t, ri.Save("user1/img1", gopherPNGBytes()))
+	assert.NoError(t, ri.Save("user2/img1", gopherPNGBytes()))
+	assert.NoError(t, ri.Commit("user1/img1"))
+
+	images, err = ri.List("user1")
+	assert.NoError(t, err)
+	require.Len(t, images, 1)
+	assert.Equal(t, "user1/img1", images[0].ID)
+	assert.Equal(t, int64(len(gopherPNGBytes())), images[0].Size)
+	assert.False(t, images[0].Staging)
+
+	images, err = ri.List("")
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+}
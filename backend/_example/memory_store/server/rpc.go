@@ -64,5 +64,6 @@ func (s *RPC) addHandlers() {
 		"commit":              s.imgCommitHndl,
 		"cleanup":             s.imgCleanupHndl,
 		"info":                s.imgInfoHndl,
+		"list":                s.imgListHndl,
 	})
 }
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/service"
+)
+
+// Checker is a trivial rule-based spam checker, a placeholder for a real scoring service
+type Checker struct {
+	BadWords []string // comments with any of these words rejected
+	MaxLinks int      // comments with more links held for moderation, 0 - unlimited
+}
+
+// Check returns verdict for the comment
+func (c *Checker) Check(comment store.Comment) service.SpamCheckResult {
+	text := strings.ToLower(comment.Text)
+	for _, w := range c.BadWords {
+		if strings.Contains(text, strings.ToLower(w)) {
+			return service.SpamCheckResult{Verdict: service.SpamVerdictReject, Reason: fmt.Sprintf("contains %q", w)}
+		}
+	}
+
+	if links := strings.Count(text, "<a "); c.MaxLinks > 0 && links > c.MaxLinks {
+		return service.SpamCheckResult{Verdict: service.SpamVerdictHold, Reason: fmt.Sprintf("%d links", links)}
+	}
+	return service.SpamCheckResult{Verdict: service.SpamVerdictAccept}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/go-pkgz/jrpc"
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// RPC handler wraps spam checker and implements handlers for remote spam check
+// Note: this file can be used as-is in any custom jrpc plugin with own Checker
+type RPC struct {
+	*jrpc.Server
+	checker *Checker
+}
+
+// NewRPC makes RPC instance and register handlers
+func NewRPC(c *Checker, r *jrpc.Server) *RPC {
+	res := &RPC{checker: c, Server: r}
+	res.Group("spam", jrpc.HandlersGroup{
+		"check": res.checkHndl,
+	})
+	return res
+}
+
+// check comment and return verdict
+func (s *RPC) checkHndl(id uint64, params json.RawMessage) (rr jrpc.Response) {
+	comment := store.Comment{}
+	if err := json.Unmarshal(params, &comment); err != nil {
+		return jrpc.Response{Error: err.Error()}
+	}
+	res := s.checker.Check(comment)
+	log.Printf("[DEBUG] comment %s from %s, %s %s", comment.ID, comment.User.ID, res.Verdict, res.Reason)
+	return jrpc.EncodeResponse(id, res, nil)
+}
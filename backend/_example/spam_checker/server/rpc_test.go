@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/jrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/service"
+)
+
+func TestRPC_checkHndl(t *testing.T) {
+	port := chooseUnusedPort(t)
+	s := NewRPC(&Checker{BadWords: []string{"Casino"}, MaxLinks: 1}, jrpc.NewServer("/test"))
+	go func() {
+		_ = s.Run(port)
+	}()
+	waitForHTTPServerStart(t, port)
+	defer func() {
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		require.NoError(t, s.Shutdown())
+	}()
+
+	c := service.SpamRPC{Client: jrpc.Client{API: fmt.Sprintf("http://localhost:%d/test", port), Client: http.Client{Timeout: time.Second}}}
+
+	res, err := c.Check(store.Comment{Text: `<p>nice <a href="https://example.com">post</a></p>`})
+	require.NoError(t, err)
+	assert.Equal(t, service.SpamCheckResult{Verdict: service.SpamVerdictAccept}, res)
+
+	res, err = c.Check(store.Comment{Text: `<p>best casino here</p>`})
+	require.NoError(t, err)
+	assert.Equal(t, service.SpamCheckResult{Verdict: service.SpamVerdictReject, Reason: `contains "Casino"`}, res)
+
+	res, err = c.Check(store.Comment{Text: `<p><a href="https://example.com/1">one</a> <a href="https://example.com/2">two</a></p>`})
+	require.NoError(t, err)
+	assert.Equal(t, service.SpamCheckResult{Verdict: service.SpamVerdictHold, Reason: "2 links"}, res)
+}
+
+// chooseUnusedPort asks the kernel for a free port from the ephemeral range
+func chooseUnusedPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", ":0")
+	require.NoError(t, err, "no free port available")
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+	return port
+}
+
+// waitForHTTPServerStart blocks until the server on port answers
+func waitForHTTPServerStart(t *testing.T, port int) {
+	t.Helper()
+	client := http.Client{Timeout: time.Second}
+	defer client.CloseIdleConnections()
+	require.Eventually(t, func() bool {
+		resp, err := client.Get(fmt.Sprintf("http://localhost:%d", port))
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return true
+	}, 30*time.Second, 10*time.Millisecond, "http server on port %d didn't start", port)
+}
@@ -11,6 +11,7 @@ import (
 	log "github.com/go-pkgz/lgr"
 
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/service"
 )
 
 // CleanupCommand set of flags and command for cleanup
@@ -22,8 +23,13 @@ type CleanupCommand struct {
 	BadUsers []string `short:"u" long:"buser" description:"bad user(s)"`
 	SetTitle bool     `long:"title" description:"title mode, will not remove comments, but reset titles to page's title'"`
 
+	SpamPath      string  `long:"spam-path" env:"SPAM_PATH" default:"./var/spam" description:"spam classifier models location"`
+	SpamThreshold float64 `long:"spam-threshold" env:"SPAM_THRESHOLD" default:"0.9" description:"spam probability threshold"`
+
 	SupportCmdOpts
 	CommonOpts
+
+	classifier *service.SpamClassifier
 }
 
 var (
@@ -35,6 +41,7 @@ var (
 // This command uses provided flags to detect and remove junk comments
 func (cc *CleanupCommand) Execute(_ []string) error {
 	log.Printf("[INFO] cleanup for site %s", cc.Site)
+	cc.classifier = service.NewSpamClassifier(cc.SpamPath, cc.SpamThreshold)
 
 	posts, err := cc.postsInRange(cc.From, cc.To)
 	if err != nil {
@@ -232,7 +239,8 @@ func (cc *CleanupCommand) setTitle(c store.Comment) error { //nolint:dupl // not
 	return nil
 }
 
-// isSpam calculates spam's probability as a score
+// isSpam calculates spam's probability as a score. Bad words, bad users, links and zero score add up to it,
+// the same as spam probability of the classifier trained by the server, so neither decides alone
 func (cc *CleanupCommand) isSpam(comment store.Comment) (isSpam bool, spamScore float64) {
 	badWord := func(txt string) float64 {
 		res := 0.0
@@ -283,6 +291,11 @@ func (cc *CleanupCommand) isSpam(comment store.Comment) (isSpam bool, spamScore
 		score += 10
 	}
 
+	if cc.classifier != nil { // up to 50, untrained classifier adds nothing
+		_, prob := cc.classifier.Classify(comment)
+		score += 50 * prob
+	}
+
 	score = math.Max(score, 0)
 	score = math.Min(score, 100)
 
@@ -14,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/service"
 )
 
 type cleanedComments struct {
@@ -56,6 +57,40 @@ func TestCleanup_IsSpam(t *testing.T) {
 	}
 }
 
+func TestCleanup_IsSpamClassifier(t *testing.T) {
+	cc := CleanupCommand{BadWords: []string{"bad1"}, classifier: service.NewSpamClassifier("", 0.9)}
+	spamText := `buy pills <a href="http://pills.example.com">here</a>`
+
+	r, score := cc.isSpam(store.Comment{Text: spamText, Score: 1})
+	assert.False(t, r)
+	assert.InDelta(t, 10, score, 0.01, "untrained classifier adds nothing")
+
+	for range 5 {
+		require.NoError(t, cc.classifier.Train(store.Comment{Text: spamText}, true))
+		require.NoError(t, cc.classifier.Train(store.Comment{Text: "nice episode, thanks"}, false))
+	}
+
+	tbl := []struct {
+		text   string
+		score  int
+		isSpam bool
+		name   string
+	}{
+		{"thanks for the nice episode", 0, false, "classified ham, 0score"},
+		{"thanks for the nice episode bad1", 0, false, "classified ham, 1badword 0score"},
+		{`cheap pills <a href="http://pills.example.com/x">buy</a>`, 1, true, "classified spam, link"},
+		{"cheap pills", 1, false, "classified spam alone"},
+		{"cheap pills", 0, true, "classified spam, 0score"},
+	}
+
+	for n, tt := range tbl {
+		t.Run(fmt.Sprintf("check-%d-%s", n, tt.name), func(t *testing.T) {
+			r, score := cc.isSpam(store.Comment{Text: tt.text, Score: tt.score})
+			assert.Equal(t, tt.isSpam, r, "score %.2f", score)
+		})
+	}
+}
+
 func TestCleanup_postsInRange(t *testing.T) {
 	r := http.NewServeMux()
 	cleanupRoutes(t, r, nil)
@@ -115,7 +150,7 @@ func TestCleanup_ExecuteSpam(t *testing.T) {
 	cmd.SetCommon(CommonOpts{RemarkURL: ts.URL, SharedSecret: "123456"})
 	p := flags.NewParser(&cmd, flags.Default)
 	_, err := p.ParseArgs([]string{"--site=remark", "--bword=bad1", "--bword=bad2", "--buser=bu_",
-		"--from=20181217", "--to=20181218", "--admin-passwd=secret"})
+		"--from=20181217", "--to=20181218", "--admin-passwd=secret", "--spam-path=" + t.TempDir()})
 	require.NoError(t, err)
 	err = cmd.Execute(nil)
 	assert.NoError(t, err)
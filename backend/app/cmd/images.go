@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/go-pkgz/jrpc"
+	log "github.com/go-pkgz/lgr"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/store/image"
+)
+
+// ImagesCommand set of flags and command for pictures migration
+// it copies all committed and staged pictures from src.type to dst.type store, keeping ids and staging state.
+// Should be used on changing of --image.type, as new store doesn't see pictures of the old one.
+type ImagesCommand struct {
+	ImageSrc ImageGroup `group:"src" namespace:"src"`
+	ImageDst ImageGroup `group:"dst" namespace:"dst"`
+	Verify   bool       `long:"verify" description:"load every migrated picture back from dst and compare with src"`
+
+	migrator ImagesMigrator
+	CommonOpts
+}
+
+// ImagesMigrator defines interface for pictures migration
+type ImagesMigrator interface {
+	Migrate(dst, src image.Store, verify bool) (int, error)
+}
+
+type imagesMigrator struct{}
+
+// Migrate from one image store to another
+func (m imagesMigrator) Migrate(dst, src image.Store, verify bool) (int, error) {
+	return image.Migrate(dst, src, verify)
+}
+
+// Execute runs with ImagesCommand parameters, entry point for "images" command
+func (ic *ImagesCommand) Execute(_ []string) error {
+	log.Printf("[INFO] migrate pictures from %s to %s", ic.ImageSrc.Type, ic.ImageDst.Type)
+
+	if ic.ImageSrc.Type == "bolt" && ic.ImageDst.Type == "bolt" && path.Clean(ic.ImageSrc.Bolt.File) == path.Clean(ic.ImageDst.Bolt.File) {
+		return fmt.Errorf("src and dst pictures stores are the same bolt file %s", ic.ImageSrc.Bolt.File)
+	}
+
+	src, err := ic.makeImageStore(ic.ImageSrc)
+	if err != nil {
+		return fmt.Errorf("can't make pictures store for %s: %w", ic.ImageSrc.Type, err)
+	}
+	defer ic.closeImageStore(src, ic.ImageSrc.Type)
+
+	dst, err := ic.makeImageStore(ic.ImageDst)
+	if err != nil {
+		return fmt.Errorf("can't make pictures store for %s: %w", ic.ImageDst.Type, err)
+	}
+	defer ic.closeImageStore(dst, ic.ImageDst.Type)
+
+	if ic.migrator == nil {
+		ic.migrator = imagesMigrator{}
+	}
+
+	count, err := ic.migrator.Migrate(dst, src, ic.Verify)
+	if err != nil {
+		return fmt.Errorf("migrated pictures = %d: %w", count, err)
+	}
+
+	log.Printf("[INFO] completed, migrated pictures = %d", count)
+	return nil
+}
+
+func (ic *ImagesCommand) makeImageStore(gr ImageGroup) (image.Store, error) {
+	log.Printf("[DEBUG] make pictures store, type=%s", gr.Type)
+	switch gr.Type {
+	case "fs":
+		if err := makeDirs(gr.FS.Path, gr.FS.Staging); err != nil {
+			return nil, fmt.Errorf("failed to create pictures store: %w", err)
+		}
+		return &image.FileSystem{Location: gr.FS.Path, Staging: gr.FS.Staging, Partitions: gr.FS.Partitions}, nil
+	case "bolt":
+		if err := makeDirs(path.Dir(gr.Bolt.File)); err != nil {
+			return nil, fmt.Errorf("failed to create pictures store: %w", err)
+		}
+		return image.NewBoltStorage(gr.Bolt.File, bolt.Options{})
+	case "s3":
+		return image.NewS3Storage(image.S3Params{
+			Endpoint:      gr.S3.Endpoint,
+			Region:        gr.S3.Region,
+			Bucket:        gr.S3.Bucket,
+			AccessKey:     gr.S3.AccessKey,
+			SecretKey:     gr.S3.SecretKey,
+			Prefix:        gr.S3.Path,
+			StagingPrefix: gr.S3.Staging,
+			VirtualHost:   gr.S3.VirtualHost,
+			Timeout:       gr.S3.Timeout,
+		})
+	case "rpc":
+		return &image.RPC{Client: jrpc.Client{
+			API:        gr.RPC.API,
+			Client:     http.Client{Timeout: gr.RPC.TimeOut},
+			AuthUser:   gr.RPC.AuthUser,
+			AuthPasswd: gr.RPC.AuthPassword,
+		}}, nil
+	}
+	return nil, fmt.Errorf("unsupported pictures store type %s", gr.Type)
+}
+
+// closeImageStore closes stores holding resources, like bolt file
+func (ic *ImagesCommand) closeImageStore(st image.Store, storeType string) {
+	c, ok := st.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(); err != nil {
+		log.Printf("[WARN] failed to close pictures store %s, %v", storeType, err)
+	}
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/store/image"
+)
+
+func TestImages_Execute(t *testing.T) {
+	dir := t.TempDir()
+	src := &image.FileSystem{Location: filepath.Join(dir, "pictures"), Staging: filepath.Join(dir, "pictures.staging"), Partitions: 10}
+	require.NoError(t, src.Save("user1/pic1.png", []byte("pic1")))
+	require.NoError(t, src.Commit("user1/pic1.png"))
+	require.NoError(t, src.Save("user2/pic2.png", []byte("pic2")))
+
+	// from fs to bolt
+	cmd := ImagesCommand{}
+	cmd.SetCommon(CommonOpts{RemarkURL: "", SharedSecret: "123456"})
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--src.type=fs", "--src.fs.path=" + src.Location, "--src.fs.staging=" + src.Staging,
+		"--src.fs.partitions=10", "--dst.type=bolt", "--dst.bolt.file=" + filepath.Join(dir, "pictures.db"), "--verify"})
+	require.NoError(t, err)
+	require.NoError(t, cmd.Execute(nil))
+
+	dst, err := image.NewBoltStorage(filepath.Join(dir, "pictures.db"), bolt.Options{})
+	require.NoError(t, err)
+	list, err := dst.List("")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "user1/pic1.png", list[0].ID)
+	assert.False(t, list[0].Staging)
+	assert.Equal(t, "user2/pic2.png", list[1].ID)
+	assert.True(t, list[1].Staging)
+	require.NoError(t, dst.Close())
+
+	// same bolt file
+	cmd = ImagesCommand{}
+	p = flags.NewParser(&cmd, flags.Default)
+	_, err = p.ParseArgs([]string{"--src.type=bolt", "--src.bolt.file=" + filepath.Join(dir, "pictures.db"),
+		"--dst.type=bolt", "--dst.bolt.file=" + filepath.Join(dir, "pictures.db")})
+	require.NoError(t, err)
+	assert.EqualError(t, cmd.Execute(nil), "src and dst pictures stores are the same bolt file "+filepath.Join(dir, "pictures.db"))
+}
+
+func TestImages_ExecuteFailed(t *testing.T) {
+	dir := t.TempDir()
+	mock := &imagesMigratorMock{retCount: 5, retError: errors.New("failed blah")}
+	cmd := ImagesCommand{migrator: mock}
+	cmd.SetCommon(CommonOpts{RemarkURL: "", SharedSecret: "123456"})
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--src.type=bolt", "--src.bolt.file=" + filepath.Join(dir, "src.db"),
+		"--dst.type=fs", "--dst.fs.path=" + filepath.Join(dir, "pictures"), "--dst.fs.staging=" + filepath.Join(dir, "staging")})
+	require.NoError(t, err)
+	assert.EqualError(t, cmd.Execute(nil), "migrated pictures = 5: failed blah")
+	assert.Equal(t, 1, mock.called)
+	_, err = os.Stat(filepath.Join(dir, "pictures"))
+	assert.NoError(t, err, "dst location created")
+
+	// unsupported store type
+	cmd = ImagesCommand{ImageSrc: ImageGroup{Type: "bad"}, migrator: mock}
+	assert.EqualError(t, cmd.Execute(nil), "can't make pictures store for bad: unsupported pictures store type bad")
+	assert.Equal(t, 1, mock.called)
+}
+
+type imagesMigratorMock struct {
+	called   int
+	retError error
+	retCount int
+}
+
+func (m *imagesMigratorMock) Migrate(_, _ image.Store, _ bool) (int, error) {
+	m.called++
+	return m.retCount, m.retError
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha1" //nolint:gosec // used only for stable ID hashing, not for security
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -15,6 +16,7 @@ import (
 	"regexp"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,8 +24,12 @@ import (
 	"github.com/go-pkgz/lcw/v2/eventbus"
 	log "github.com/go-pkgz/lgr"
 	ntf "github.com/go-pkgz/notify"
+	R "github.com/go-pkgz/rest"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/kyokomi/emoji/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/oauth2"
 
@@ -35,6 +41,7 @@ import (
 	cache "github.com/go-pkgz/lcw/v2"
 
 	"github.com/umputun/remark42/backend/app/migrator"
+	"github.com/umputun/remark42/backend/app/moderation"
 	"github.com/umputun/remark42/backend/app/notify"
 	"github.com/umputun/remark42/backend/app/providers"
 	"github.com/umputun/remark42/backend/app/rest/api"
@@ -42,9 +49,14 @@ import (
 	"github.com/umputun/remark42/backend/app/safehttp"
 	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/store/admin"
+	"github.com/umputun/remark42/backend/app/store/audit"
+	"github.com/umputun/remark42/backend/app/store/emailreply"
 	"github.com/umputun/remark42/backend/app/store/engine"
 	"github.com/umputun/remark42/backend/app/store/image"
 	"github.com/umputun/remark42/backend/app/store/service"
+	"github.com/umputun/remark42/backend/app/store/settings"
+	"github.com/umputun/remark42/backend/app/store/subscription"
+	"github.com/umputun/remark42/backend/app/stream"
 	"github.com/umputun/remark42/backend/app/templates"
 )
 
@@ -63,6 +75,9 @@ type ServerCommand struct {
 	Image      ImageGroup      `group:"image" namespace:"image" env-namespace:"IMAGE"`
 	SSL        SSLGroup        `group:"ssl" namespace:"ssl" env-namespace:"SSL"`
 	ImageProxy ImageProxyGroup `group:"image-proxy" namespace:"image-proxy" env-namespace:"IMAGE_PROXY"`
+	PreMod     PreModGroup     `group:"pre-moderation" namespace:"pre-moderation" env-namespace:"PRE_MODERATION"`
+	Spam       SpamGroup       `group:"spam" namespace:"spam" env-namespace:"SPAM"`
+	Metrics    MetricsGroup    `group:"metrics" namespace:"metrics" env-namespace:"METRICS"`
 
 	Sites                      []string      `long:"site" env:"SITE" default:"remark" description:"site names" env-delim:","`
 	AnonymousVote              bool          `long:"anon-vote" env:"ANON_VOTE" description:"enable anonymous votes (works only with VOTES_IP enabled)"`
@@ -73,6 +88,10 @@ type ServerCommand struct {
 	MinCommentSize             int           `long:"min-comment" env:"MIN_COMMENT_SIZE" default:"0" description:"min comment size"`
 	MaxCommentSize             int           `long:"max-comment" env:"MAX_COMMENT_SIZE" default:"2048" description:"max comment size"`
 	MaxVotes                   int           `long:"max-votes" env:"MAX_VOTES" default:"-1" description:"maximum number of votes per comment"`
+	ReportThreshold            int           `long:"report-threshold" env:"REPORT_THRESHOLD" default:"0" description:"hide comment after this number of user reports, 0 - never"`
+	SiteSettings               string        `long:"site-settings" env:"SITE_SETTINGS" default:"./var/site-settings.json" description:"per-site settings file"`
+	AuditLog                   string        `long:"audit-log" env:"AUDIT_LOG" default:"./var/audit.log" description:"audit log file of moderation actions"`
+	MaxStreamClients           int           `long:"max-stream-clients" env:"MAX_STREAM_CLIENTS" default:"500" description:"maximum number of concurrent live stream clients"`
 	RestrictVoteIP             bool          `long:"votes-ip" env:"VOTES_IP" description:"restrict votes from the same ip"`
 	DurationVoteIP             time.Duration `long:"votes-ip-time" env:"VOTES_IP_TIME" default:"5m" description:"same ip vote duration"`
 	LowScore                   int           `long:"low-score" env:"LOW_SCORE" default:"-5" description:"low score threshold"`
@@ -145,6 +164,28 @@ type ImageProxyGroup struct {
 	CacheExternal bool `long:"cache-external" env:"CACHE_EXTERNAL" description:"enable caching for external images"`
 }
 
+// PreModGroup defines options group for pre-moderation of new comments
+type PreModGroup struct {
+	Sites      []string `long:"site" env:"SITE" description:"sites with all new comments awaiting admin approval" env-delim:","`
+	Unverified bool     `long:"unverified" env:"UNVERIFIED" description:"new comments of unverified users awaiting admin approval"`
+}
+
+// SpamGroup defines options group for spam classifier and remote spam checker
+type SpamGroup struct {
+	Enabled   bool     `long:"enabled" env:"ENABLED" description:"enable spam classifier for new comments"`
+	Path      string   `long:"path" env:"PATH" default:"./var/spam" description:"spam classifier models location"`
+	Threshold float64  `long:"threshold" env:"THRESHOLD" default:"0.9" description:"spam probability threshold"`
+	Action    string   `long:"action" env:"ACTION" choice:"reject" choice:"queue" choice:"tag" default:"tag" description:"action for spam comments"` //nolint
+	RPC       RPCGroup `group:"rpc" namespace:"rpc" env-namespace:"RPC"`
+}
+
+// MetricsGroup defines options group for prometheus metrics
+type MetricsGroup struct {
+	Enabled bool   `long:"enabled" env:"ENABLED" description:"enable prometheus metrics on /metrics"`
+	Listen  string `long:"listen" env:"LISTEN" default:"127.0.0.1:9100" description:"separate address for metrics, main server port if empty"`
+	Passwd  string `long:"passwd" env:"PASSWD" description:"basic auth password for metrics user, required on the main server port"`
+}
+
 // AppleGroup defines options for Apple auth params
 type AppleGroup struct {
 	CID                string `long:"cid" env:"CID" description:"Apple client ID (App ID or Services ID)"`
@@ -183,17 +224,21 @@ type CustomAuthGroup struct {
 
 // StoreGroup defines options group for store params
 type StoreGroup struct {
-	Type string `long:"type" env:"TYPE" description:"type of storage" choice:"bolt" choice:"rpc" default:"bolt"` // nolint
+	Type string `long:"type" env:"TYPE" description:"type of storage" choice:"bolt" choice:"sqlite" choice:"rpc" default:"bolt"` // nolint
 	Bolt struct {
 		Path    string        `long:"path" env:"PATH" default:"./var" description:"parent directory for the bolt files"`
 		Timeout time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"bolt timeout"`
 	} `group:"bolt" namespace:"bolt" env-namespace:"BOLT"`
+	SQLite struct {
+		File    string        `long:"file" env:"FILE" default:"./var/remark.sqlite" description:"sqlite database file, shared by all sites"`
+		Timeout time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"sqlite busy timeout"`
+	} `group:"sqlite" namespace:"sqlite" env-namespace:"SQLITE"`
 	RPC RPCGroup `group:"rpc" namespace:"rpc" env-namespace:"RPC"`
 }
 
 // ImageGroup defines options group for store pictures
 type ImageGroup struct {
-	Type string `long:"type" env:"TYPE" description:"type of storage" choice:"fs" choice:"bolt" choice:"rpc" default:"fs"` // nolint
+	Type string `long:"type" env:"TYPE" description:"type of storage" choice:"fs" choice:"bolt" choice:"s3" choice:"rpc" default:"fs"` // nolint
 	FS   struct {
 		Path       string `long:"path" env:"PATH" default:"./var/pictures" description:"images location"`
 		Staging    string `long:"staging" env:"STAGING" default:"./var/pictures.staging" description:"staging location"`
@@ -202,10 +247,26 @@ type ImageGroup struct {
 	Bolt struct {
 		File string `long:"file" env:"FILE" default:"./var/pictures.db" description:"images bolt file location"`
 	} `group:"bolt" namespace:"bolt" env-namespace:"BOLT"`
-	MaxSize      int      `long:"max-size" env:"MAX_SIZE" default:"5000000" description:"max size of image file"`
-	ResizeWidth  int      `long:"resize-width" env:"RESIZE_WIDTH" default:"2400" description:"width of a resized image"`
-	ResizeHeight int      `long:"resize-height" env:"RESIZE_HEIGHT" default:"900" description:"height of a resized image"`
-	RPC          RPCGroup `group:"rpc" namespace:"rpc" env-namespace:"RPC"`
+	S3 struct {
+		Endpoint    string        `long:"endpoint" env:"ENDPOINT" description:"S3 API endpoint, AWS endpoint of the region if not set"`
+		Region      string        `long:"region" env:"REGION" default:"us-east-1" description:"region of the bucket"`
+		Bucket      string        `long:"bucket" env:"BUCKET" description:"bucket name"`
+		AccessKey   string        `long:"access-key" env:"ACCESS_KEY" description:"access key ID"`
+		SecretKey   string        `long:"secret-key" env:"SECRET_KEY" description:"secret access key"`
+		Path        string        `long:"path" env:"PATH" default:"pictures" description:"images prefix in the bucket"`
+		Staging     string        `long:"staging" env:"STAGING" default:"pictures.staging" description:"staging images prefix in the bucket"`
+		VirtualHost bool          `long:"virtual-host" env:"VIRTUAL_HOST" description:"use virtual-hosted style bucket.endpoint addressing"`
+		Timeout     time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"S3 timeout"`
+	} `group:"s3" namespace:"s3" env-namespace:"S3"`
+	MaxSize        int      `long:"max-size" env:"MAX_SIZE" default:"5000000" description:"max size of image file"`
+	ResizeWidth    int      `long:"resize-width" env:"RESIZE_WIDTH" default:"2400" description:"width of a resized image"`
+	ResizeHeight   int      `long:"resize-height" env:"RESIZE_HEIGHT" default:"900" description:"height of a resized image"`
+	Variants       []int    `long:"variants" env:"VARIANTS" description:"widths of responsive image variants, i.e. 320,640,1280" env-delim:","`
+	VariantFormat  string   `long:"variant-format" env:"VARIANT_FORMAT" description:"format of image variants, no webp encoder" choice:"auto" choice:"png" choice:"jpeg" default:"auto"` // nolint
+	VariantQuality int      `long:"variant-quality" env:"VARIANT_QUALITY" default:"85" description:"quality of jpeg image variants, 1-100"`
+	Hashes         string   `long:"hashes" env:"HASHES" default:"./var/pictures-hashes.db" description:"file with hashes of uploaded images for duplicates detection and bans, both disabled if empty"`
+	UserQuota      int64    `long:"user-quota" env:"USER_QUOTA" default:"0" description:"max total size of images uploaded by a user, in bytes, unlimited if 0"`
+	RPC            RPCGroup `group:"rpc" namespace:"rpc" env-namespace:"RPC"`
 }
 
 // AvatarGroup defines options group for avatar params
@@ -265,30 +326,61 @@ type SMTPGroup struct {
 // NotifyGroup defines options for notification
 type NotifyGroup struct {
 	Type      []string `long:"type" env:"TYPE" description:"[deprecated, use user and admin types instead] types of notifications" choice:"none" choice:"telegram" choice:"email" choice:"slack" default:"none" env-delim:","` //nolint
-	Users     []string `long:"users" env:"USERS" description:"types of user notifications" choice:"none" choice:"email" choice:"telegram" default:"none" env-delim:","`                                                        //nolint
-	Admins    []string `long:"admins" env:"ADMINS" description:"types of admin notifications" choice:"none" choice:"telegram" choice:"email" choice:"slack" choice:"webhook" default:"none" env-delim:","`                     //nolint
+	Users     []string `long:"users" env:"USERS" description:"types of user notifications" choice:"none" choice:"email" choice:"telegram" choice:"matrix" choice:"webpush" default:"none" env-delim:","`                       //nolint
+	Admins    []string `long:"admins" env:"ADMINS" description:"types of admin notifications" choice:"none" choice:"telegram" choice:"email" choice:"slack" choice:"webhook" choice:"matrix" default:"none" env-delim:","`     //nolint
 	QueueSize int      `long:"queue" env:"QUEUE" description:"size of notification queue" default:"100"`
 	Telegram  struct {
-		Channel string        `long:"chan" env:"CHAN" description:"the ID of telegram channel for admin notifications"`
-		API     string        `long:"api" env:"API" default:"https://api.telegram.org/bot" description:"[deprecated, not used] telegram api prefix"`
-		Token   string        `long:"token" env:"TOKEN" description:"[deprecated, use --telegram.token] telegram token"`
-		Timeout time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"[deprecated, use --telegram.timeout] telegram timeout"`
+		Channel    string        `long:"chan" env:"CHAN" description:"the ID of telegram channel for admin notifications"`
+		AdminChats []string      `long:"admin-chats" env:"ADMIN_CHATS" description:"IDs of telegram users and group chats allowed to moderate with the bot" env-delim:","`
+		API        string        `long:"api" env:"API" default:"https://api.telegram.org/bot" description:"[deprecated, not used] telegram api prefix"`
+		Token      string        `long:"token" env:"TOKEN" description:"[deprecated, use --telegram.token] telegram token"`
+		Timeout    time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"[deprecated, use --telegram.timeout] telegram timeout"`
 	} `group:"telegram" namespace:"telegram" env-namespace:"TELEGRAM"`
 	Email struct {
 		From                string `long:"from_address" env:"FROM" description:"from email address"`
 		VerificationSubject string `long:"verification_subj" env:"VERIFICATION_SUBJ" description:"verification message subject"`
 		AdminNotifications  bool   `long:"notify_admin" env:"ADMIN" description:"[deprecated, use --notify.admins=email] notify admin on new comments via ADMIN_SHARED_EMAIL"`
+		Reply               struct {
+			Address string `long:"address" env:"ADDRESS" description:"address for replies by email, i.e. reply@example.com, replies by email disabled if empty"`
+			Listen  string `long:"listen" env:"LISTEN" default:":2525" description:"listen address of smtp server receiving replies by email"`
+			Tokens  string `long:"tokens" env:"TOKENS" default:"./var/email-replies.db" description:"file with tokens of reply addresses"`
+		} `group:"reply" namespace:"reply" env-namespace:"REPLY"`
 	} `group:"email" namespace:"email" env-namespace:"EMAIL"`
 	Slack struct {
-		Token   string `long:"token" env:"TOKEN" description:"slack token"`
-		Channel string `long:"chan" env:"CHAN" description:"slack channel for admin notifications"`
+		Token         string `long:"token" env:"TOKEN" description:"slack token"`
+		Channel       string `long:"chan" env:"CHAN" description:"slack channel for admin notifications"`
+		SigningSecret string `long:"signing-secret" env:"SIGNING_SECRET" description:"slack app signing secret, enables moderation buttons in slack notifications"`
 	} `group:"slack" namespace:"slack" env-namespace:"SLACK"`
+	Matrix struct {
+		Server  string        `long:"server" env:"SERVER" description:"matrix homeserver URL, i.e. https://matrix.org"`
+		Token   string        `long:"token" env:"TOKEN" description:"access token of matrix bot user"`
+		Room    string        `long:"room" env:"ROOM" description:"matrix room id or alias for admin notifications"`
+		Timeout time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"matrix timeout"`
+	} `group:"matrix" namespace:"matrix" env-namespace:"MATRIX"`
+	WebPush struct {
+		VAPIDKey string        `long:"vapid-key" env:"VAPID_KEY" description:"base64url encoded private key of VAPID key pair"`
+		Subject  string        `long:"subject" env:"SUBJECT" description:"contact of the site owner for push services, mailto: or https: URL"`
+		TTL      time.Duration `long:"ttl" env:"TTL" default:"24h" description:"time push service keeps notification for offline browser"`
+		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"web push timeout"`
+	} `group:"webpush" namespace:"webpush" env-namespace:"WEBPUSH"`
 	Webhook struct {
 		URL      string        `long:"url" env:"URL" description:"webhook URL for admin notifications"`
 		Template string        `long:"template" env:"TEMPLATE" description:"webhook payload template (Go text/template); falls back to {\"text\": {{.Text | escapeJSONString}}} when empty"`
 		Headers  []string      `long:"headers" description:"webhook headers in format --notify.webhook.headers=Header1:Value1,Value2,... [$NOTIFY_WEBHOOK_HEADERS]"` // env NOTIFY_WEBHOOK_HEADERS split in code below to allow , inside ""
 		Timeout  time.Duration `long:"timeout" env:"TIMEOUT" description:"webhook timeout" default:"5s"`
+		JSON     bool          `long:"json" env:"JSON" description:"send structured json payload of the event instead of template"`
+		Secret   string        `long:"secret" env:"SECRET" description:"secret to sign webhook payload with HMAC-SHA256, for all webhooks"`
+		Events   []string      `long:"events" env:"EVENTS" description:"events sent to webhook URL" choice:"create" choice:"edit" choice:"delete" choice:"vote" choice:"block" choice:"pin" choice:"readonly" default:"create" env-delim:","` //nolint
+		Sites    []string      `long:"sites" env:"SITES" description:"sites with events sent to webhook URL, all if not set" env-delim:","`
+		Hooks    []string      `long:"hook" env:"HOOKS" description:"additional webhook with json payload in format url[;events=create,edit][;sites=site1,site2]" env-delim:" "`
 	} `group:"webhook" namespace:"webhook" env-namespace:"WEBHOOK"`
+	Outbox struct {
+		Path     string        `long:"path" env:"PATH" default:"./var/notify-outbox.db" description:"notification outbox file, keeps deliveries until sent; in-memory queue if empty"`
+		Attempts int           `long:"attempts" env:"ATTEMPTS" default:"10" description:"max send attempts before delivery moved to dead letters"`
+		Delay    time.Duration `long:"delay" env:"DELAY" default:"30s" description:"delay before the first retry, doubled for each next one"`
+		MaxDelay time.Duration `long:"max-delay" env:"MAX_DELAY" default:"1h" description:"max delay between retries"`
+	} `group:"outbox" namespace:"outbox" env-namespace:"OUTBOX"`
+	Subscriptions string `long:"subscriptions" env:"SUBSCRIPTIONS" default:"./var/subscriptions.db" description:"file with users subscriptions to posts, subscriptions disabled if empty"`
 }
 
 // SSLGroup defines options group for server ssl params
@@ -319,9 +411,26 @@ type AdminRPCGroup struct {
 type LoadingCache interface {
 	Get(key cache.Key, fn func() ([]byte, error)) (data []byte, err error) // load from cache if found or put to cache and return
 	Flush(req cache.FlusherRequest)                                        // evict matched records
+	Stat() cache.CacheStat                                                 // cache stats
 	Close() error
 }
 
+// serverCache is the loading cache of the last made server app, its hit ratio reported by cacheHitRatio
+var serverCache atomic.Pointer[LoadingCache]
+
+var cacheHitRatio = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "remark42_cache_hit_ratio", Help: "hit ratio of loading cache"}, func() float64 {
+	c := serverCache.Load()
+	if c == nil {
+		return 0
+	}
+	stat := (*c).Stat()
+	if stat.Hits+stat.Misses == 0 {
+		return 0
+	}
+	return float64(stat.Hits) / float64(stat.Hits+stat.Misses)
+})
+
 // serverApp holds all active objects
 type serverApp struct {
 	*ServerCommand
@@ -332,8 +441,10 @@ type serverApp struct {
 	dataService   *service.DataStore
 	avatarStore   avatar.Store
 	notifyService *notify.Service
+	emailNotify   *notify.Email // email notifications destination, sends collected digests
 	imageService  *image.Service
 	authenticator *auth.Service
+	streamHub     *stream.Hub
 	terminated    chan struct{}
 
 	authRefreshCache *authRefreshCache // stored only to close it properly on shutdown
@@ -598,6 +709,11 @@ func (s *ServerCommand) newServerApp(ctx context.Context) (*serverApp, error) {
 	}
 	log.Printf("[INFO] root url=%s", s.RemarkURL)
 
+	emailRepliesEnabled := s.Notify.Email.Reply.Address != "" && contains("email", s.Notify.Users)
+	if emailRepliesEnabled && !strings.Contains(s.Notify.Email.Reply.Address, "@") {
+		return nil, fmt.Errorf("invalid email reply address %q", s.Notify.Email.Reply.Address)
+	}
+
 	// parse trusted proxies up front so a bad CIDR fails before any resource is allocated
 	trustedProxies, err := api.ParseTrustedProxies(s.TrustedProxies)
 	if err != nil {
@@ -626,6 +742,28 @@ func (s *ServerCommand) newServerApp(ctx context.Context) (*serverApp, error) {
 	}
 	log.Printf("[DEBUG] image service for url=%s, EditDuration=%v", imageService.ImageAPI, imageService.EditDuration)
 
+	siteSettings, err := settings.NewStore(s.SiteSettings, settings.Settings{
+		MaxCommentSize:  s.MaxCommentSize,
+		MinCommentSize:  s.MinCommentSize,
+		EditDuration:    settings.Duration(s.EditDuration),
+		LowScore:        s.LowScore,
+		CriticalScore:   s.CriticalScore,
+		PositiveScore:   s.PositiveScore,
+		ReadOnlyAge:     s.ReadOnlyAge,
+		RestrictedWords: s.RestrictedWords,
+		AnonVote:        s.AnonymousVote,
+		SubscribersOnly: s.SubscribersOnly,
+		MaxVotes:        s.MaxVotes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to make site settings store: %w", err)
+	}
+
+	auditLog, err := audit.NewStore(s.AuditLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make audit log: %w", err)
+	}
+
 	dataService := &service.DataStore{
 		Engine:                 storeEngine,
 		EditDuration:           s.EditDuration,
@@ -637,54 +775,165 @@ func (s *ServerCommand) newServerApp(ctx context.Context) (*serverApp, error) {
 		PositiveScore:          s.PositiveScore,
 		ImageService:           imageService,
 		TitleExtractor:         service.NewTitleExtractor(http.Client{Timeout: time.Second * 5, Transport: safehttp.Transport()}, s.getAllowedDomains()),
-		RestrictedWordsMatcher: service.NewRestrictedWordsMatcher(service.StaticRestrictedWordsLister{Words: s.RestrictedWords}),
+		RestrictedWordsMatcher: service.NewRestrictedWordsMatcher(siteSettings),
+		SiteSettings:           siteSettings,
 	}
 	dataService.RestrictSameIPVotes.Enabled = s.RestrictVoteIP
 	dataService.RestrictSameIPVotes.Duration = s.DurationVoteIP
+	dataService.PreModeration.Sites = s.PreMod.Sites
+	dataService.PreModeration.Unverified = s.PreMod.Unverified
+	dataService.ReportThreshold = s.ReportThreshold
+	if s.Notify.Subscriptions != "" {
+		if err = makeDirs(path.Dir(s.Notify.Subscriptions)); err != nil {
+			_ = dataService.Close()
+			return nil, fmt.Errorf("failed to create subscriptions directory: %w", err)
+		}
+		if dataService.Subscriptions, err = subscription.NewStore(s.Notify.Subscriptions, bolt.Options{Timeout: s.Store.Bolt.Timeout}); err != nil {
+			_ = dataService.Close()
+			return nil, fmt.Errorf("failed to make subscriptions store: %w", err)
+		}
+	}
+	if s.Spam.Enabled {
+		dataService.SpamClassifier = service.NewSpamClassifier(s.Spam.Path, s.Spam.Threshold)
+		dataService.SpamAction = service.SpamAction(s.Spam.Action)
+	}
+	if s.Spam.RPC.API != "" {
+		log.Printf("[INFO] remote spam checker %s", s.Spam.RPC.API)
+		dataService.SpamChecker = &service.SpamRPC{Client: jrpc.Client{
+			API:        s.Spam.RPC.API,
+			Client:     http.Client{Timeout: s.Spam.RPC.TimeOut},
+			AuthUser:   s.Spam.RPC.AuthUser,
+			AuthPasswd: s.Spam.RPC.AuthPassword,
+		}}
+	}
 
 	loadingCache, err := s.makeCache()
 	if err != nil {
 		_ = dataService.Close()
 		return nil, fmt.Errorf("failed to make cache: %w", err)
 	}
+	serverCache.Store(&loadingCache)
+
+	streamHub, err := s.makeStreamHub()
+	if err != nil {
+		_ = dataService.Close()
+		return nil, fmt.Errorf("failed to make stream hub: %w", err)
+	}
+	dataService.EventPublisher = streamHub
 
 	avatarStore, err := s.makeAvatarStore()
 	if err != nil {
 		_ = dataService.Close()
+		_ = streamHub.Close()
 		return nil, fmt.Errorf("failed to make avatar store: %w", err)
 	}
 	authRefreshCache := newAuthRefreshCache()
 	authenticator := s.getAuthenticator(dataService, avatarStore, adminStore, authRefreshCache)
 
+	// moderation actions of admin api and telegram bot, notifier set once notify service with the bot is made
+	moderator := &moderation.Service{Store: dataService, AuditLog: auditLog,
+		ReadOnlyAge: func(siteID string) int { return siteSettings.Get(siteID).ReadOnlyAge }}
+
 	telegramAuth := s.makeTelegramAuth(authenticator) // telegram auth requires TelegramAPI listener which is constructed below
-	telegramService := s.startTelegramAuthAndNotify(ctx, telegramAuth)
+	telegramService := s.startTelegramAuthAndNotify(ctx, telegramAuth, notify.TelegramModeratorParams{
+		AdminChats: s.Notify.Telegram.AdminChats,
+		Sites:      s.Sites,
+		Store:      dataService,
+		Moderator:  moderator,
+		Cache:      loadingCache,
+	})
 
 	err = s.addAuthProviders(authenticator)
 	if err != nil {
 		_ = dataService.Close()
 		_ = authRefreshCache.Close()
+		_ = streamHub.Close()
 		return nil, fmt.Errorf("failed to make authenticator: %w", err)
 	}
 
-	exporter := &migrator.Native{DataStore: dataService}
+	exporter := &migrator.Native{DataStore: dataService, AuditLog: auditLog}
 
 	migr := &api.Migrator{
 		Cache:             loadingCache,
-		NativeImporter:    &migrator.Native{DataStore: dataService},
+		NativeImporter:    &migrator.Native{DataStore: dataService, AuditLog: auditLog},
 		DisqusImporter:    &migrator.Disqus{DataStore: dataService},
 		WordPressImporter: &migrator.WordPress{DataStore: dataService, DisableFancyTextFormatting: s.DisableFancyTextFormatting},
 		CommentoImporter:  &migrator.Commento{DataStore: dataService},
-		NativeExporter:    &migrator.Native{DataStore: dataService},
+		NativeExporter:    &migrator.Native{DataStore: dataService, AuditLog: auditLog},
 		URLMapperMaker:    migrator.NewURLMapper,
 		KeyStore:          adminStore,
+		AuditLog:          auditLog,
 	}
 
-	notifyDestinations, err := s.makeNotifyDestinations(authenticator)
+	sslConfig, err := s.makeSSLConfig()
+	if err != nil {
+		_ = dataService.Close()
+		_ = authRefreshCache.Close()
+		_ = streamHub.Close()
+		return nil, fmt.Errorf("failed to make config of ssl server params: %w", err)
+	}
+
+	var devAuth *provider.DevAuthServer
+	if s.Auth.Dev {
+		da, errDevAuth := authenticator.DevAuth()
+		if errDevAuth != nil {
+			_ = dataService.Close()
+			_ = authRefreshCache.Close()
+			_ = streamHub.Close()
+			return nil, fmt.Errorf("can't make dev oauth2 server: %w", errDevAuth)
+		}
+		devAuth = da
+	}
+
+	// image hashes and email reply tokens stores opened after all the steps which could fail,
+	// so they are never left open on failure
+	if s.Image.Hashes != "" {
+		if err = makeDirs(path.Dir(s.Image.Hashes)); err == nil {
+			imageService.Hashes, err = image.NewHashStore(s.Image.Hashes, bolt.Options{Timeout: s.Store.Bolt.Timeout})
+		}
+		if err != nil {
+			_ = dataService.Close()
+			_ = authRefreshCache.Close()
+			_ = streamHub.Close()
+			return nil, fmt.Errorf("failed to make image hashes store: %w", err)
+		}
+	}
+	var emailReplies *emailreply.Store
+	if emailRepliesEnabled {
+		if err = makeDirs(path.Dir(s.Notify.Email.Reply.Tokens)); err == nil {
+			emailReplies, err = emailreply.NewStore(s.Notify.Email.Reply.Tokens, 0, bolt.Options{Timeout: s.Store.Bolt.Timeout})
+		}
+		if err != nil {
+			_ = dataService.Close()
+			_ = authRefreshCache.Close()
+			_ = streamHub.Close()
+			if imageService.Hashes != nil {
+				_ = imageService.Hashes.Close()
+			}
+			return nil, fmt.Errorf("failed to make email reply tokens store: %w", err)
+		}
+	}
+
+	notifyDestinations, err := s.makeNotifyDestinations(authenticator, emailReplies)
 	if err != nil {
 		log.Printf("[WARN] failed to prepare notify destinations, %s", err)
 	}
 
 	notifyService := s.makeNotifyService(dataService, notifyDestinations, telegramService)
+	moderator.SetNotifier(notifyService)
+	var emailNotify *notify.Email
+	var matrixNotify *notify.Matrix
+	var webPushNotify *notify.WebPush
+	for _, d := range notifyDestinations {
+		switch dest := d.(type) {
+		case *notify.Email:
+			emailNotify = dest
+		case *notify.Matrix:
+			matrixNotify = dest
+		case *notify.WebPush:
+			webPushNotify = dest
+		}
+	}
 
 	imgProxy := &proxy.Image{
 		HTTP2HTTPS:    s.ImageProxy.HTTP2HTTPS,
@@ -698,12 +947,10 @@ func (s *ServerCommand) newServerApp(ctx context.Context) (*serverApp, error) {
 		emojiFmt = func(text string) string { return emoji.Sprint(text) }
 	}
 	commentFormatter := store.NewCommentFormatter(imgProxy, emojiFmt)
-
-	sslConfig, err := s.makeSSLConfig()
-	if err != nil {
-		_ = dataService.Close()
-		_ = authRefreshCache.Close()
-		return nil, fmt.Errorf("failed to make config of ssl server params: %w", err)
+	commentFormatter.ImageVariants = store.ImageVariants{
+		ImageAPI: s.RemarkURL + "/api/v1/picture/",
+		Widths:   s.Image.Variants,
+		MaxWidth: s.Image.ResizeWidth,
 	}
 
 	srv := &api.Rest{
@@ -725,6 +972,12 @@ func (s *ServerCommand) newServerApp(ctx context.Context) (*serverApp, error) {
 		SSLConfig:                  sslConfig,
 		UpdateLimiter:              s.UpdateLimit,
 		ImageService:               imageService,
+		StreamHub:                  streamHub,
+		SiteSettings:               siteSettings,
+		AuditLog:                   auditLog,
+		Moderator:                  moderator,
+		Sites:                      s.Sites,
+		EmailReplies:               emailReplies,
 		EmailNotifications:         contains("email", s.Notify.Users),
 		TelegramNotifications:      contains("telegram", s.Notify.Users) && telegramService != nil,
 		EmojiEnabled:               s.EnableEmoji,
@@ -740,16 +993,20 @@ func (s *ServerCommand) newServerApp(ctx context.Context) (*serverApp, error) {
 	}
 
 	srv.ScoreThresholds.Low, srv.ScoreThresholds.Critical = s.LowScore, s.CriticalScore
-
-	var devAuth *provider.DevAuthServer
-	if s.Auth.Dev {
-		da, errDevAuth := authenticator.DevAuth()
-		if errDevAuth != nil {
-			_ = dataService.Close()
-			_ = authRefreshCache.Close()
-			return nil, fmt.Errorf("can't make dev oauth2 server: %w", errDevAuth)
+	if s.Metrics.Enabled && s.Metrics.Listen == "" {
+		if s.Metrics.Passwd == "" {
+			log.Printf("[WARN] metrics on the main server port require metrics.passwd, disabled")
 		}
-		devAuth = da
+		srv.MetricsPasswd = s.Metrics.Passwd
+	}
+	if contains("slack", s.Notify.Admins) {
+		srv.SlackSigningSecret = s.Notify.Slack.SigningSecret // moderation buttons are sent with slack notifications only
+	}
+	if matrixNotify != nil && matrixNotify.UserNotifications {
+		srv.MatrixService, srv.MatrixNotifications = matrixNotify, true
+	}
+	if webPushNotify != nil {
+		srv.WebPushPublicKey = webPushNotify.PublicKey()
 	}
 
 	return &serverApp{
@@ -761,8 +1018,10 @@ func (s *ServerCommand) newServerApp(ctx context.Context) (*serverApp, error) {
 		dataService:      dataService,
 		avatarStore:      avatarStore,
 		notifyService:    notifyService,
+		emailNotify:      emailNotify,
 		imageService:     imageService,
 		authenticator:    authenticator,
+		streamHub:        streamHub,
 		terminated:       make(chan struct{}),
 		authRefreshCache: authRefreshCache,
 	}, nil
@@ -855,6 +1114,9 @@ func (a *serverApp) run(ctx context.Context) error {
 		// shutdown on context cancellation
 		<-ctx.Done()
 		log.Print("[INFO] shutdown initiated")
+		if e := a.streamHub.Close(); e != nil { // closes active streams, otherwise they block http server shutdown
+			log.Printf("[WARN] failed to close stream hub, %s", e)
+		}
 		a.restSrv.Shutdown()
 	}()
 
@@ -870,6 +1132,19 @@ func (a *serverApp) run(ctx context.Context) error {
 
 	go a.imageService.Cleanup(ctx) // pictures cleanup for staging images
 
+	if a.emailNotify != nil {
+		go a.emailNotify.SendDigests(ctx) // hourly and daily email digests
+	}
+
+	if a.restSrv.EmailReplies != nil {
+		go a.runEmailReplies(ctx)                         // smtp server receiving replies to email notifications
+		go a.restSrv.EmailReplies.Cleanup(ctx, time.Hour) // removal of expired reply tokens
+	}
+
+	if a.Metrics.Enabled && a.Metrics.Listen != "" {
+		go a.runMetrics(ctx) // metrics on separate address
+	}
+
 	a.restSrv.Run(a.Address, a.Port)
 
 	// shutdown procedures after HTTP server is stopped
@@ -889,10 +1164,20 @@ func (a *serverApp) run(ctx context.Context) error {
 		log.Printf("[WARN] failed to close auth authRefreshCache, %s", e)
 	}
 	a.notifyService.Close()
+	if a.restSrv.EmailReplies != nil {
+		if e := a.restSrv.EmailReplies.Close(); e != nil {
+			log.Printf("[WARN] failed to close email reply tokens store, %s", e)
+		}
+	}
 	// call potentially infinite loop with cancellation after a minute as a safeguard
 	minuteCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 	a.imageService.Close(minuteCtx)
+	if a.imageService.Hashes != nil {
+		if e := a.imageService.Hashes.Close(); e != nil {
+			log.Printf("[WARN] failed to close image hashes store, %s", e)
+		}
+	}
 
 	close(a.terminated)
 	return nil
@@ -903,6 +1188,47 @@ func (a *serverApp) Wait() {
 	<-a.terminated
 }
 
+// runEmailReplies starts smtp server receiving replies to email notifications, blocking until ctx canceled
+func (a *serverApp) runEmailReplies(ctx context.Context) {
+	srv := notify.EmailReplyServer{
+		Address:      a.Notify.Email.Reply.Listen,
+		ReplyAddress: a.Notify.Email.Reply.Address,
+		Handler:      a.restSrv.CreateEmailReply,
+	}
+	if err := srv.Run(ctx); err != nil {
+		log.Printf("[WARN] email replies server terminated, %s", err)
+	}
+}
+
+// runMetrics starts http server with prometheus metrics on separate address, blocking until ctx canceled.
+// basic auth is applied if metrics password set
+func (a *serverApp) runMetrics(ctx context.Context) {
+	var handler http.Handler = promhttp.Handler()
+	if a.Metrics.Passwd != "" {
+		handler = R.BasicAuthWithUserPasswd("metrics", a.Metrics.Passwd)(handler)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", handler)
+	srv := &http.Server{
+		Addr:              a.Metrics.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("[WARN] metrics server shutdown error, %s", err)
+		}
+	}()
+	log.Printf("[INFO] start metrics server on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("[WARN] metrics server terminated, %s", err)
+	}
+}
+
 // activateBackup runs background backups for each site
 func (a *serverApp) activateBackup(ctx context.Context) {
 	for _, siteID := range a.Sites {
@@ -931,6 +1257,11 @@ func (s *ServerCommand) makeDataStore() (result engine.Interface, err error) {
 			sites = append(sites, engine.BoltSite{SiteID: site, FileName: fmt.Sprintf("%s/%s.db", s.Store.Bolt.Path, site)})
 		}
 		result, err = engine.NewBoltDB(bolt.Options{Timeout: s.Store.Bolt.Timeout}, sites...)
+	case "sqlite":
+		if err = makeDirs(path.Dir(s.Store.SQLite.File)); err != nil {
+			return nil, fmt.Errorf("failed to create sqlite store: %w", err)
+		}
+		result, err = engine.NewSQLite(s.Store.SQLite.File, s.Store.SQLite.Timeout, s.Sites...)
 	case "rpc":
 		r := &engine.RPC{Client: jrpc.Client{
 			API:        s.Store.RPC.API,
@@ -976,6 +1307,12 @@ func (s *ServerCommand) makePicturesStore() (*image.Service, error) {
 		MaxSize:      s.Image.MaxSize,
 		MaxHeight:    s.Image.ResizeHeight,
 		MaxWidth:     s.Image.ResizeWidth,
+
+		Variants:       s.Image.Variants,
+		VariantFormat:  s.Image.VariantFormat,
+		VariantQuality: s.Image.VariantQuality,
+
+		UserQuota: s.Image.UserQuota,
 	}
 	switch s.Image.Type {
 	case "bolt":
@@ -984,6 +1321,22 @@ func (s *ServerCommand) makePicturesStore() (*image.Service, error) {
 			return nil, err
 		}
 		return image.NewService(boltImageStore, imageServiceParams), nil
+	case "s3":
+		s3ImageStore, err := image.NewS3Storage(image.S3Params{
+			Endpoint:      s.Image.S3.Endpoint,
+			Region:        s.Image.S3.Region,
+			Bucket:        s.Image.S3.Bucket,
+			AccessKey:     s.Image.S3.AccessKey,
+			SecretKey:     s.Image.S3.SecretKey,
+			Prefix:        s.Image.S3.Path,
+			StagingPrefix: s.Image.S3.Staging,
+			VirtualHost:   s.Image.S3.VirtualHost,
+			Timeout:       s.Image.S3.Timeout,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pictures store: %w", err)
+		}
+		return image.NewService(s3ImageStore, imageServiceParams), nil
 	case "fs":
 		if err := makeDirs(s.Image.FS.Path); err != nil {
 			return nil, fmt.Errorf("failed to create pictures store: %w", err)
@@ -1060,6 +1413,19 @@ func (s *ServerCommand) makeCache() (LoadingCache, error) {
 	return nil, fmt.Errorf("unsupported cache type %s", s.Cache.Type)
 }
 
+// makeStreamHub creates hub for live comments stream. With redis_pub_sub cache events shared between instances
+// via separate redis channel, so clients connected to any instance get all events
+func (s *ServerCommand) makeStreamHub() (*stream.Hub, error) {
+	if s.Cache.Type != "redis_pub_sub" {
+		return stream.NewHub(nil, s.MaxStreamClients)
+	}
+	redisPubSub, err := eventbus.NewRedisPubSub(s.Cache.RedisAddr, "remark42-stream")
+	if err != nil {
+		return nil, fmt.Errorf("stream redis PubSub initialisation: %w", err)
+	}
+	return stream.NewHub(redisPubSub, s.MaxStreamClients)
+}
+
 //nolint:gocyclo // simple code but many if checks
 func (s *ServerCommand) addAuthProviders(authenticator *auth.Service) error {
 	providersCount := 0
@@ -1255,15 +1621,32 @@ func (s *ServerCommand) makeNotifyService(dataStore *service.DataStore, destinat
 		destinations = append(destinations, telegram)
 	}
 
-	if len(destinations) > 0 {
-		log.Printf("[INFO] make notify, for users: %s, for admins: %s", s.Notify.Users, s.Notify.Admins)
+	if len(destinations) == 0 {
+		return notify.NopService
+	}
+	log.Printf("[INFO] make notify, for users: %s, for admins: %s", s.Notify.Users, s.Notify.Admins)
+	if s.Notify.Outbox.Path == "" {
 		return notify.NewService(dataStore, s.Notify.QueueSize, destinations...)
 	}
-	return notify.NopService
+	outbox, err := s.makeNotifyOutbox()
+	if err != nil {
+		log.Printf("[WARN] failed to make notification outbox, fallback to in-memory queue, %v", err)
+		return notify.NewService(dataStore, s.Notify.QueueSize, destinations...)
+	}
+	return notify.NewServiceWithOutbox(dataStore, outbox, destinations...)
+}
+
+// makeNotifyOutbox makes persistent outbox of notification deliveries
+func (s *ServerCommand) makeNotifyOutbox() (*notify.Outbox, error) {
+	if err := makeDirs(path.Dir(s.Notify.Outbox.Path)); err != nil {
+		return nil, fmt.Errorf("failed to create notification outbox directory: %w", err)
+	}
+	params := notify.OutboxParams{Attempts: s.Notify.Outbox.Attempts, Delay: s.Notify.Outbox.Delay, MaxDelay: s.Notify.Outbox.MaxDelay}
+	return notify.NewOutbox(s.Notify.Outbox.Path, bolt.Options{Timeout: s.Store.Bolt.Timeout}, params)
 }
 
 // constructs list of notify destinations except for telegram, returns empty list in case of error
-func (s *ServerCommand) makeNotifyDestinations(authenticator *auth.Service) ([]notify.Destination, error) {
+func (s *ServerCommand) makeNotifyDestinations(authenticator *auth.Service, emailReplies *emailreply.Store) ([]notify.Destination, error) {
 	destinations := make([]notify.Destination, 0)
 
 	if contains("webhook", s.Notify.Admins) {
@@ -1277,7 +1660,24 @@ func (s *ServerCommand) makeNotifyDestinations(authenticator *auth.Service) ([]n
 			Template: s.Notify.Webhook.Template,
 			Headers:  webhookHeaders,
 			Timeout:  time.Second * 5,
+			JSON:     s.Notify.Webhook.JSON,
+			Secret:   s.Notify.Webhook.Secret,
+			Events:   webhookEvents(s.Notify.Webhook.Events),
+			Sites:    s.Notify.Webhook.Sites,
+		}
+		webhook, err := notify.NewWebhook(whParams)
+		if err != nil {
+			return destinations, fmt.Errorf("failed to create webhook notification destination: %w", err)
+		}
+		destinations = append(destinations, webhook)
+	}
+
+	for _, hook := range s.Notify.Webhook.Hooks {
+		whParams, err := parseWebhookHook(hook)
+		if err != nil {
+			return destinations, fmt.Errorf("failed to parse webhook %q: %w", hook, err)
 		}
+		whParams.Timeout, whParams.Secret = s.Notify.Webhook.Timeout, s.Notify.Webhook.Secret
 		webhook, err := notify.NewWebhook(whParams)
 		if err != nil {
 			return destinations, fmt.Errorf("failed to create webhook notification destination: %w", err)
@@ -1287,9 +1687,43 @@ func (s *ServerCommand) makeNotifyDestinations(authenticator *auth.Service) ([]n
 
 	if contains("slack", s.Notify.Admins) {
 		slack := notify.NewSlack(s.Notify.Slack.Token, s.Notify.Slack.Channel)
+		slack.Moderation = s.Notify.Slack.SigningSecret != ""
 		destinations = append(destinations, slack)
 	}
 
+	if contains("matrix", s.Notify.Users) || contains("matrix", s.Notify.Admins) {
+		matrixParams := notify.MatrixParams{
+			Server:            s.Notify.Matrix.Server,
+			Token:             s.Notify.Matrix.Token,
+			Timeout:           s.Notify.Matrix.Timeout,
+			UserNotifications: contains("matrix", s.Notify.Users),
+		}
+		if contains("matrix", s.Notify.Admins) {
+			if s.Notify.Matrix.Room == "" {
+				return destinations, fmt.Errorf("--notify.matrix.room must be set for admin notifications to work")
+			}
+			matrixParams.AdminRoomID = s.Notify.Matrix.Room
+		}
+		matrix, err := notify.NewMatrix(matrixParams)
+		if err != nil {
+			return destinations, fmt.Errorf("failed to create matrix notification destination: %w", err)
+		}
+		destinations = append(destinations, matrix)
+	}
+
+	if contains("webpush", s.Notify.Users) {
+		webPush, err := notify.NewWebPush(notify.WebPushParams{
+			VAPIDPrivateKey: s.Notify.WebPush.VAPIDKey,
+			Subject:         s.Notify.WebPush.Subject,
+			TTL:             s.Notify.WebPush.TTL,
+			Timeout:         s.Notify.WebPush.Timeout,
+		})
+		if err != nil {
+			return destinations, fmt.Errorf("failed to create web push notification destination: %w", err)
+		}
+		destinations = append(destinations, webPush)
+	}
+
 	// with logic below admin notifications enable notifications for users on the backend even if they
 	// are not enabled explicitly, however they won't be visible to the users in the frontend
 	// because api.Rest.EmailNotifications would be set to false.
@@ -1321,6 +1755,12 @@ func (s *ServerCommand) makeNotifyDestinations(authenticator *auth.Service) ([]n
 		if contains("email", s.Notify.Admins) {
 			emailParams.AdminEmails = s.Admin.Shared.Email
 		}
+		if emailReplies != nil {
+			emailParams.ReplyAddress = s.Notify.Email.Reply.Address
+			emailParams.ReplyTokenFn = func(siteID, url, parentID, userID string) (string, error) {
+				return emailReplies.Add(emailreply.Target{SiteID: siteID, URL: url, ParentID: parentID, UserID: userID})
+			}
+		}
 		smtpParams := ntf.SMTPParams{
 			Host:               s.SMTP.Host,
 			Port:               s.SMTP.Port,
@@ -1345,6 +1785,37 @@ func (s *ServerCommand) makeNotifyDestinations(authenticator *auth.Service) ([]n
 	return destinations, nil
 }
 
+// parseWebhookHook parses webhook in format url[;events=create,edit][;sites=site1,site2] to params with json payload
+func parseWebhookHook(hook string) (notify.WebhookParams, error) {
+	elems := strings.Split(hook, ";")
+	res := notify.WebhookParams{URL: strings.TrimSpace(elems[0]), JSON: true}
+	for _, elem := range elems[1:] {
+		key, value, ok := strings.Cut(strings.TrimSpace(elem), "=")
+		if !ok {
+			return notify.WebhookParams{}, fmt.Errorf("bad option %q, should be key=value", elem)
+		}
+		values := strings.Split(value, ",")
+		switch key {
+		case "events":
+			res.Events = webhookEvents(values)
+		case "sites":
+			res.Sites = values
+		default:
+			return notify.WebhookParams{}, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return res, nil
+}
+
+// webhookEvents converts event names to notify.Event
+func webhookEvents(events []string) []notify.Event {
+	res := make([]notify.Event, 0, len(events))
+	for _, e := range events {
+		res = append(res, notify.Event(strings.TrimSpace(e)))
+	}
+	return res
+}
+
 // constructs Telegram notify service
 func (s *ServerCommand) makeTelegramNotify() (*notify.Telegram, error) {
 	if contains("telegram", s.Notify.Admins) && s.Notify.Telegram.Channel == "" {
@@ -1353,6 +1824,7 @@ func (s *ServerCommand) makeTelegramNotify() (*notify.Telegram, error) {
 	telegramParams := notify.TelegramParams{
 		AdminChannelID:    s.Notify.Telegram.Channel,
 		UserNotifications: contains("telegram", s.Notify.Users),
+		Moderation:        s.telegramModeration(),
 		Token:             s.Telegram.Token,
 		Timeout:           s.Telegram.Timeout,
 		SuccessMsg:        "✅ You have successfully subscribed for notifications, check the web!",
@@ -1483,7 +1955,8 @@ func (s *ServerCommand) parseSameSite(ss string) http.SameSite {
 
 // startTelegramAuthAndNotify initializes telegram notify and auth Telegram Bot listen loop.
 // Does nothing if telegram auth and notifications are disabled.
-func (s *ServerCommand) startTelegramAuthAndNotify(ctx context.Context, telegramAuth providers.TGUpdatesReceiver) (tg *notify.Telegram) {
+func (s *ServerCommand) startTelegramAuthAndNotify(ctx context.Context, telegramAuth providers.TGUpdatesReceiver,
+	moderation notify.TelegramModeratorParams) (tg *notify.Telegram) {
 	if !contains("telegram", s.Notify.Users) && !contains("telegram", s.Notify.Admins) && !s.Auth.Telegram {
 		return nil
 	}
@@ -1498,12 +1971,21 @@ func (s *ServerCommand) startTelegramAuthAndNotify(ctx context.Context, telegram
 	if telegramAuth != nil {
 		telegramReceivers = append(telegramReceivers, telegramAuth)
 	}
-	// start bot messages receiver for both notify and auth services
+	if s.telegramModeration() {
+		telegramReceivers = append(telegramReceivers, notify.NewTelegramModerator(tg, moderation))
+	}
+	// start bot messages receiver for notify, auth and moderation services
 	go providers.DispatchTelegramUpdates(ctx, tg, telegramReceivers, time.Second*5)
 
 	return tg
 }
 
+// telegramModeration checks if moderation with telegram bot is enabled, it requires admin notifications
+// sent to telegram and chats allowed to moderate
+func (s *ServerCommand) telegramModeration() bool {
+	return contains("telegram", s.Notify.Admins) && len(s.Notify.Telegram.AdminChats) > 0
+}
+
 // splitAtCommas split s at commas, ignoring commas in strings.
 // Eliminate leading and trailing dbl quotes in each element only if both presented
 // based on https://stackoverflow.com/a/59318708
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -16,12 +18,19 @@ import (
 
 	"github.com/go-pkgz/auth/v2/provider"
 	"github.com/go-pkgz/auth/v2/token"
+	cache "github.com/go-pkgz/lcw/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jessevdk/go-flags"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/goleak"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/emailreply"
 )
 
 const (
@@ -48,6 +57,7 @@ func TestServerApp(t *testing.T) {
 		o.Port = port
 		return o
 	})
+	assert.NotNil(t, app.imageService.Hashes, "image hashes store enabled by default")
 
 	go func() { _ = app.run(ctx) }()
 	waitForHTTPServerStart(t, port)
@@ -268,6 +278,7 @@ func TestServerApp_WithSSL(t *testing.T) {
 	defer os.Remove("/tmp/ava-test.db")
 
 	// create app
+	setTempPaths(t, &opts)
 	app, err := opts.newServerApp(context.Background())
 	require.NoError(t, err)
 
@@ -309,6 +320,62 @@ func TestServerApp_WithSSL(t *testing.T) {
 	app.Wait()
 }
 
+func TestServerApp_CacheHitRatio(t *testing.T) {
+	port := chooseUnusedPort(t)
+	app, ctx, cancel := prepServerApp(t, func(o ServerCommand) ServerCommand {
+		o.Port = port
+		return o
+	})
+
+	go func() { _ = app.run(ctx) }()
+	waitForHTTPServerStart(t, port)
+
+	// gauge registered once reports the cache of the last made app, one miss and one hit
+	key := cache.NewKey("remark").ID("hit-ratio")
+	for range 2 {
+		_, err := app.restSrv.Cache.Get(key, func() ([]byte, error) { return []byte("data"), nil })
+		require.NoError(t, err)
+	}
+	assert.InDelta(t, 0.5, testutil.ToFloat64(cacheHitRatio), 0.01)
+
+	cancel()
+	app.Wait()
+}
+
+func TestServerApp_WithSQLite(t *testing.T) {
+	port := chooseUnusedPort(t)
+	dbFile := filepath.Join(t.TempDir(), "sub", "remark.sqlite")
+	app, ctx, cancel := prepServerApp(t, func(o ServerCommand) ServerCommand {
+		o.Port = port
+		o.Store.Type = "sqlite"
+		o.Store.SQLite.File = dbFile
+		o.Store.SQLite.Timeout = time.Second
+		return o
+	})
+
+	go func() { _ = app.run(ctx) }()
+	waitForHTTPServerStart(t, port)
+
+	client := http.Client{Timeout: 10 * time.Second}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/api/v1/comment?site=remark", port),
+		strings.NewReader(`{"text": "test 123", "locator":{"url": "https://radio-t.com/blah1", "site": "remark"}}`))
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "password")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	count, err := app.dataService.Count(store.Locator{SiteID: "remark", URL: "https://radio-t.com/blah1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.FileExists(t, dbFile)
+
+	cancel()
+	app.Wait()
+}
+
 func TestServerApp_WithRemote(t *testing.T) {
 	opts := ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
@@ -325,6 +392,7 @@ func TestServerApp_WithRemote(t *testing.T) {
 	opts.BackupLocation, opts.Image.FS.Path = "/tmp", "/tmp"
 
 	// create app
+	setTempPaths(t, &opts)
 	app, err := opts.newServerApp(context.Background())
 	require.NoError(t, err)
 
@@ -350,12 +418,15 @@ func TestServerApp_WithRemote(t *testing.T) {
 func TestServerApp_Failed(t *testing.T) {
 	opts := ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
+	tmp := t.TempDir()
+	avatars := "--avatar.fs.path=" + filepath.Join(tmp, "avatars")
 
 	p := flags.NewParser(&opts, flags.Default)
 
 	// RO bolt location
-	_, err := p.ParseArgs([]string{"--backup=/tmp", "--store.bolt.path=/dev/null", "--image.fs.path=/tmp"})
+	_, err := p.ParseArgs([]string{"--backup=/tmp", "--store.bolt.path=/dev/null", "--image.fs.path=/tmp", avatars})
 	assert.NoError(t, err)
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err, "failed to make data store engine: failed to create bolt store: can't make directory /dev/null: mkdir /dev/null: not a directory")
 	t.Log(err)
@@ -363,10 +434,10 @@ func TestServerApp_Failed(t *testing.T) {
 	// RO backup location
 	opts = ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
-
-	_, err = p.ParseArgs([]string{"--store.bolt.path=/tmp", "--backup=/dev/null/not-writable"})
+	p = flags.NewParser(&opts, flags.Default)
+	_, err = p.ParseArgs([]string{"--store.bolt.path=" + tmp, "--backup=/dev/null/not-writable", "--image.fs.path=/tmp", avatars})
 	assert.NoError(t, err)
-	defer os.Remove("/tmp/remark.db")
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err, "failed to create backup store: can't make directory /dev/null/not-writable: mkdir /dev/null: not a directory")
 	t.Log(err)
@@ -374,9 +445,10 @@ func TestServerApp_Failed(t *testing.T) {
 	// invalid url
 	opts = ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "demo.remark42.com", SharedSecret: "123456"})
-
-	_, err = p.ParseArgs([]string{"--backup=/tmp", "----store.bolt.path=/tmp"})
+	p = flags.NewParser(&opts, flags.Default)
+	_, err = p.ParseArgs([]string{"--backup=/tmp", "--store.bolt.path=" + tmp})
 	assert.NoError(t, err)
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err, "invalid remark42 url demo.remark42.com")
 	t.Log(err)
@@ -387,18 +459,30 @@ func TestServerApp_Failed(t *testing.T) {
 	p = flags.NewParser(&opts, flags.Default)
 	_, err = p.ParseArgs([]string{"--backup=/tmp", "--trusted-proxy=nonsense"})
 	assert.NoError(t, err)
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err, `invalid --trusted-proxy: invalid trusted proxy "nonsense"`)
 	t.Log(err)
 
-	// wrong store type
+	// invalid email reply address fails fast, before any resource is created
 	opts = ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
+	p = flags.NewParser(&opts, flags.Default)
+	_, err = p.ParseArgs([]string{"--backup=/tmp", "--notify.users=email", "--notify.email.reply.address=reply.example.com"})
+	assert.NoError(t, err)
+	setTempPaths(t, &opts)
+	_, err = opts.newServerApp(context.Background())
+	assert.EqualError(t, err, `invalid email reply address "reply.example.com"`)
 
-	_, err = p.ParseArgs([]string{"--backup=/tmp", "--store.type=blah"})
+	// wrong store type
+	opts = ServerCommand{}
+	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
+	p = flags.NewParser(&opts, flags.Default)
+	_, err = p.ParseArgs([]string{"--backup=/tmp", "--image.fs.path=/tmp", avatars, "--store.type=blah"})
 	assert.Error(t, err, "blah is invalid type")
 
 	opts.Store.Type = "blah"
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err, "failed to make data store engine: unsupported store type blah")
 	t.Log(err)
@@ -407,8 +491,9 @@ func TestServerApp_Failed(t *testing.T) {
 	opts = ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
 	p = flags.NewParser(&opts, flags.Default)
-	_, err = p.ParseArgs([]string{"--store.bolt.path=/tmp", "--cache.type=redis_pub_sub", "--cache.redis_addr=wrong_address"})
+	_, err = p.ParseArgs([]string{"--store.bolt.path=" + tmp, "--backup=/tmp", "--image.fs.path=/tmp", avatars, "--cache.type=redis_pub_sub", "--cache.redis_addr=wrong_address"})
 	assert.NoError(t, err)
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err,
 		"failed to make cache: cache backend initialization, redis PubSub initialisation: "+
@@ -420,9 +505,10 @@ func TestServerApp_Failed(t *testing.T) {
 	opts = ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
 	p = flags.NewParser(&opts, flags.Default)
-	_, err = p.ParseArgs([]string{"--auth.apple.cid=123", "--auth.apple.tid=123",
+	_, err = p.ParseArgs([]string{"--store.bolt.path=" + tmp, "--backup=/tmp", "--image.fs.path=/tmp", avatars, "--auth.apple.cid=123", "--auth.apple.tid=123",
 		"--auth.apple.kid=123", "--auth.apple.private-key-filepath=testdata/apple-bad.p8"})
 	assert.NoError(t, err)
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err,
 		"failed to make authenticator: an AppleProvider creating failed: "+
@@ -433,8 +519,9 @@ func TestServerApp_Failed(t *testing.T) {
 	opts = ServerCommand{}
 	opts.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
 	p = flags.NewParser(&opts, flags.Default)
-	_, err = p.ParseArgs([]string{"--store.bolt.path=/tmp", "--backup=/tmp", "--image.fs.path=/tmp", "--auth.custom.name=oidc", "--auth.custom.cid=123"})
+	_, err = p.ParseArgs([]string{"--store.bolt.path=" + tmp, "--backup=/tmp", "--image.fs.path=/tmp", avatars, "--auth.custom.name=oidc", "--auth.custom.cid=123"})
 	assert.NoError(t, err)
+	setTempPaths(t, &opts)
 	_, err = opts.newServerApp(context.Background())
 	assert.EqualError(t, err,
 		"failed to make authenticator: custom oauth provider configuration is incomplete, missing: "+
@@ -489,6 +576,7 @@ func TestServerApp_InvalidCustomOAuthProviderName(t *testing.T) {
 		"--store.bolt.path=/tmp",
 		"--backup=/tmp",
 		"--image.fs.path=/tmp",
+		"--avatar.fs.path=" + filepath.Join(t.TempDir(), "avatars"),
 		"--auth.custom.cid=123",
 		"--auth.custom.csec=456",
 		"--auth.custom.auth-url=https://example.com/oauth2/authorize",
@@ -503,6 +591,7 @@ func TestServerApp_InvalidCustomOAuthProviderName(t *testing.T) {
 		_, err := p.ParseArgs(append(baseArgs, "--auth.custom.name=twitter"))
 		require.NoError(t, err)
 
+		setTempPaths(t, &opts)
 		_, err = opts.newServerApp(context.Background())
 		assert.EqualError(t, err, `failed to make authenticator: custom oauth provider name "twitter" is reserved`)
 	})
@@ -514,6 +603,7 @@ func TestServerApp_InvalidCustomOAuthProviderName(t *testing.T) {
 		_, err := p.ParseArgs(append(baseArgs, "--auth.custom.name=bad name"))
 		require.NoError(t, err)
 
+		setTempPaths(t, &opts)
 		_, err = opts.newServerApp(context.Background())
 		assert.EqualError(t, err, `failed to make authenticator: custom oauth provider name "bad name" is invalid, expected pattern "^[a-z0-9][a-z0-9_-]*$"`)
 	})
@@ -543,6 +633,51 @@ func TestServerApp_Shutdown(t *testing.T) {
 	app.Wait()
 }
 
+func TestServerApp_ShutdownWithStream(t *testing.T) {
+	port := chooseUnusedPort(t)
+	app, ctx, cancel := prepServerApp(t, func(o ServerCommand) ServerCommand {
+		o.Port = port
+		return o
+	})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- app.run(ctx) }()
+	defer cancel()
+	waitForHTTPServerStart(t, port)
+
+	// open stream, it is long-lived and should not block shutdown
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/v1/stream?site=remark", port))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 1, app.streamHub.Subscribers())
+
+	// comment created via api delivered to the stream
+	client := http.Client{Timeout: 10 * time.Second}
+	defer client.CloseIdleConnections()
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/api/v1/comment?site=remark", port),
+		strings.NewReader(`{"text": "test 123", "locator":{"url": "https://radio-t.com/blah1", "site": "remark"}}`))
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "password")
+	cresp, err := client.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, cresp.Body.Close())
+	require.Equal(t, http.StatusCreated, cresp.StatusCode)
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: create\n", line)
+
+	cancel()
+	select {
+	case err := <-errCh:
+		assert.NoError(t, err)
+	case <-time.After(serverStopTimeout):
+		t.Fatal("server app did not stop after context cancel")
+	}
+	app.Wait()
+}
+
 // TestServerApp_ClaimsUpd covers the hook the authenticator runs on every token mint, refresh
 // included: it stamps admin, blocked and email onto the claims and blocks impersonation of a
 // restricted name. Calling the updater directly keeps it independent of when a token expires.
@@ -651,6 +786,7 @@ func TestServerApp_MainSignal(t *testing.T) {
 		sigErr <- killErr
 	}()
 
+	setTempPaths(t, &s)
 	err = s.Execute(args)
 	assert.NoError(t, err, "execute should be without errors")
 	require.NoError(t, <-sigErr, "SIGTERM not delivered")
@@ -804,6 +940,27 @@ func TestServerApp_DeprecatedArgsCollisions(t *testing.T) {
 	assert.Empty(t, []DeprecatedFlag{}, deprecatedFlagsCollisions)
 }
 
+func TestServerCommand_makeNotifyService(t *testing.T) {
+	cmd := ServerCommand{}
+	cmd.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "123456"})
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--notify.outbox.path=" + filepath.Join(t.TempDir(), "var", "outbox.db")})
+	require.NoError(t, err)
+
+	assert.Equal(t, notify.NopService, cmd.makeNotifyService(nil, nil, nil), "no destinations")
+
+	svc := cmd.makeNotifyService(nil, []notify.Destination{&notify.MockDest{}}, nil)
+	_, _, err = svc.Deliveries("remark")
+	require.NoError(t, err, "outbox enabled")
+	svc.Close()
+
+	cmd.Notify.Outbox.Path = ""
+	svc = cmd.makeNotifyService(nil, []notify.Destination{&notify.MockDest{}}, nil)
+	_, _, err = svc.Deliveries("remark")
+	require.ErrorIs(t, err, notify.ErrNoOutbox, "in-memory queue")
+	svc.Close()
+}
+
 func Test_ACMEEmail(t *testing.T) {
 	cmd := ServerCommand{}
 	cmd.SetCommon(CommonOpts{RemarkURL: "https://remark.com:443", SharedSecret: "123456"})
@@ -975,6 +1132,24 @@ func TestServerAuthHooks(t *testing.T) {
 	client.CloseIdleConnections()
 }
 
+func TestServerCommand_makePicturesStoreS3(t *testing.T) {
+	cmd := ServerCommand{}
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--image.type=s3", "--image.s3.endpoint=http://minio:9000", "--image.s3.bucket=remark42",
+		"--image.s3.access-key=key"})
+	require.NoError(t, err)
+	assert.Equal(t, "pictures", cmd.Image.S3.Path)
+	assert.Equal(t, "pictures.staging", cmd.Image.S3.Staging)
+
+	_, err = cmd.makePicturesStore()
+	assert.EqualError(t, err, "failed to create pictures store: s3 bucket, access key and secret key are required")
+
+	cmd.Image.S3.SecretKey = "secret"
+	svc, err := cmd.makePicturesStore()
+	require.NoError(t, err)
+	assert.NotNil(t, svc)
+}
+
 func TestServerCommand_parseSameSite(t *testing.T) {
 	tbl := []struct {
 		inp string
@@ -1018,6 +1193,164 @@ func Test_splitAtCommas(t *testing.T) {
 	}
 }
 
+func Test_parseWebhookHook(t *testing.T) {
+	tbl := []struct {
+		inp string
+		res notify.WebhookParams
+		err string
+	}{
+		{"https://example.com/hook", notify.WebhookParams{URL: "https://example.com/hook", JSON: true}, ""},
+		{"https://example.com/hook;events=create,edit;sites=s1,s2", notify.WebhookParams{URL: "https://example.com/hook", JSON: true,
+			Events: []notify.Event{notify.EventCreate, notify.EventEdit}, Sites: []string{"s1", "s2"}}, ""},
+		{"https://example.com/hook; events=block", notify.WebhookParams{URL: "https://example.com/hook", JSON: true,
+			Events: []notify.Event{notify.EventBlock}}, ""},
+		{"https://example.com/hook;events", notify.WebhookParams{}, `bad option "events", should be key=value`},
+		{"https://example.com/hook;secret=123", notify.WebhookParams{}, `unknown option "secret"`},
+	}
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			res, err := parseWebhookHook(tt.inp)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestServerCommand_makeNotifyDestinationsWebhooks(t *testing.T) {
+	cmd := ServerCommand{}
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--notify.admins=webhook", "--notify.webhook.url=https://example.com/admin",
+		"--notify.webhook.events=create", "--notify.webhook.events=block", "--notify.webhook.secret=123",
+		"--notify.webhook.hook=https://example.com/hook1", "--notify.webhook.hook=https://example.com/hook2;events=edit;sites=remark"})
+	require.NoError(t, err)
+
+	destinations, err := cmd.makeNotifyDestinations(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, destinations, 3)
+	assert.Equal(t, "webhook notification with timeout 5s to https://example.com/admin", destinations[0].String())
+	assert.Equal(t, "webhook notification with timeout 5s to https://example.com/hook2", destinations[2].String())
+	edit := notify.Request{Event: notify.EventEdit, Comment: store.Comment{Locator: store.Locator{SiteID: "remark"}}}
+	block := notify.Request{Event: notify.EventBlock, Comment: store.Comment{Locator: store.Locator{SiteID: "remark"}}}
+	assert.True(t, destinations[0].(*notify.Webhook).Accepts(block))
+	assert.False(t, destinations[0].(*notify.Webhook).Accepts(edit))
+	assert.True(t, destinations[1].(*notify.Webhook).Accepts(notify.Request{}), "new comments by default")
+	assert.True(t, destinations[2].(*notify.Webhook).Accepts(edit))
+
+	cmd.Notify.Webhook.Hooks = []string{"https://example.com/hook;events=bad"}
+	_, err = cmd.makeNotifyDestinations(nil, nil)
+	assert.EqualError(t, err, `failed to create webhook notification destination: unknown webhook event "bad"`)
+}
+
+func TestServerCommand_makeNotifyDestinationsSlack(t *testing.T) {
+	cmd := ServerCommand{}
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--notify.admins=slack", "--notify.slack.chan=moderation"})
+	require.NoError(t, err)
+
+	destinations, err := cmd.makeNotifyDestinations(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	assert.False(t, destinations[0].(*notify.Slack).Moderation)
+
+	cmd.Notify.Slack.SigningSecret = "123"
+	destinations, err = cmd.makeNotifyDestinations(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	assert.True(t, destinations[0].(*notify.Slack).Moderation, "buttons added with signing secret set")
+}
+
+func TestServerCommand_makeNotifyDestinationsMatrix(t *testing.T) {
+	cmd := ServerCommand{}
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--notify.admins=matrix", "--notify.matrix.server=https://matrix.example.com",
+		"--notify.matrix.token=tkn"})
+	require.NoError(t, err)
+
+	_, err = cmd.makeNotifyDestinations(nil, nil)
+	assert.EqualError(t, err, "--notify.matrix.room must be set for admin notifications to work")
+
+	cmd.Notify.Matrix.Room = "#admins:example.com"
+	destinations, err := cmd.makeNotifyDestinations(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	matrix := destinations[0].(*notify.Matrix)
+	assert.Equal(t, "#admins:example.com", matrix.AdminRoomID)
+	assert.False(t, matrix.UserNotifications)
+
+	cmd.Notify.Admins, cmd.Notify.Users = nil, []string{"matrix"}
+	destinations, err = cmd.makeNotifyDestinations(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	matrix = destinations[0].(*notify.Matrix)
+	assert.Empty(t, matrix.AdminRoomID, "admin room used for admin notifications only")
+	assert.True(t, matrix.UserNotifications)
+
+	cmd.Notify.Matrix.Token = ""
+	_, err = cmd.makeNotifyDestinations(nil, nil)
+	assert.EqualError(t, err, "failed to create matrix notification destination: matrix server and access token are required")
+}
+
+func TestServerCommand_makeNotifyDestinationsWebPush(t *testing.T) {
+	cmd := ServerCommand{}
+	p := flags.NewParser(&cmd, flags.Default)
+	// application server private key of the example from RFC 8291
+	_, err := p.ParseArgs([]string{"--notify.users=webpush", "--notify.webpush.vapid-key=yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"})
+	require.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, cmd.Notify.WebPush.TTL)
+
+	_, err = cmd.makeNotifyDestinations(nil, nil)
+	assert.EqualError(t, err, "failed to create web push notification destination: web push subject is required")
+
+	cmd.Notify.WebPush.Subject = "mailto:admin@example.com"
+	destinations, err := cmd.makeNotifyDestinations(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	webPush := destinations[0].(*notify.WebPush)
+	assert.Equal(t, "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8", webPush.PublicKey())
+}
+
+func TestServerCommand_makeNotifyDestinationsEmailReplies(t *testing.T) {
+	cmd := ServerCommand{}
+	p := flags.NewParser(&cmd, flags.Default)
+	_, err := p.ParseArgs([]string{"--notify.users=email", "--notify.email.reply.address=reply@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, ":2525", cmd.Notify.Email.Reply.Listen)
+
+	destinations, err := cmd.makeNotifyDestinations(nil, nil)
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	assert.Nil(t, destinations[0].(*notify.Email).ReplyTokenFn, "no tokens store")
+
+	replies, err := emailreply.NewStore(filepath.Join(t.TempDir(), "replies.db"), 0, bolt.Options{})
+	require.NoError(t, err)
+	defer replies.Close()
+	destinations, err = cmd.makeNotifyDestinations(nil, replies)
+	require.NoError(t, err)
+	require.Len(t, destinations, 1)
+	email := destinations[0].(*notify.Email)
+	assert.Equal(t, "reply@example.com", email.ReplyAddress)
+	token, err := email.ReplyTokenFn("remark", "https://example.com/post1", "c1", "u1")
+	require.NoError(t, err)
+	target, err := replies.Get(token)
+	require.NoError(t, err)
+	assert.Equal(t, "c1", target.ParentID)
+}
+
+func TestServerCommand_telegramModeration(t *testing.T) {
+	cmd := ServerCommand{}
+	assert.False(t, cmd.telegramModeration())
+	cmd.Notify.Telegram.AdminChats = []string{"123"}
+	assert.False(t, cmd.telegramModeration(), "admin notifications not sent to telegram")
+	cmd.Notify.Admins = []string{"email", "telegram"}
+	assert.True(t, cmd.telegramModeration())
+	cmd.Notify.Telegram.AdminChats = nil
+	assert.False(t, cmd.telegramModeration(), "no admin chats")
+}
+
 func Test_getAllowedDomains(t *testing.T) {
 	tbl := []struct {
 		s              ServerCommand
@@ -1143,6 +1476,17 @@ func waitForServerPort(port int, timeout time.Duration) bool {
 	return false
 }
 
+// setTempPaths points files of the server's own stores to the test temp dir, so tests don't leave them in ./var
+func setTempPaths(t *testing.T, cmd *ServerCommand) {
+	dir := t.TempDir()
+	cmd.Notify.Subscriptions = filepath.Join(dir, "subscriptions.db")
+	cmd.Notify.Outbox.Path = filepath.Join(dir, "notify-outbox.db")
+	cmd.Notify.Email.Reply.Tokens = filepath.Join(dir, "email-replies.db")
+	cmd.Image.Hashes = filepath.Join(dir, "pictures-hashes.db")
+	cmd.AuditLog = filepath.Join(dir, "audit.log")
+	cmd.SiteSettings = filepath.Join(dir, "site-settings.json")
+}
+
 func prepServerApp(t *testing.T, fn func(o ServerCommand) ServerCommand) (*serverApp, context.Context, context.CancelFunc) {
 	cmd := ServerCommand{}
 	cmd.SetCommon(CommonOpts{RemarkURL: "https://demo.remark42.com", SharedSecret: "secret"})
@@ -1152,6 +1496,7 @@ func prepServerApp(t *testing.T, fn func(o ServerCommand) ServerCommand) (*serve
 	_, err := p.ParseArgs([]string{"--admin-passwd=password", "--site=remark"})
 	require.NoError(t, err)
 	cmd.Avatar.FS.Path, cmd.Avatar.Type, cmd.BackupLocation, cmd.Image.FS.Path = "/tmp/remark42_test", "fs", "/tmp/remark42_test", "/tmp/remark42_test"
+	setTempPaths(t, &cmd)
 	cmd.Store.Bolt.Timeout = 10 * time.Second
 	cmd.Auth.Apple.CID, cmd.Auth.Apple.KID, cmd.Auth.Apple.TID = "cid", "kid", "tid"
 	cmd.Auth.Apple.PrivateKeyFilePath = "testdata/apple.p8"
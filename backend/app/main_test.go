@@ -26,7 +26,9 @@ func Test_Main(t *testing.T) {
 
 	port := chooseUnusedPort(t)
 	os.Args = []string{"test", "server", "--secret=123456", "--store.bolt.path=" + dir, "--backup=/tmp",
-		"--avatar.fs.path=" + dir, "--port=" + strconv.Itoa(port), "--url=https://demo.remark42.com", "--dbg", "--notify.type=none"}
+		"--avatar.fs.path=" + dir, "--port=" + strconv.Itoa(port), "--url=https://demo.remark42.com", "--dbg", "--notify.type=none",
+		"--image.fs.path=" + dir + "/pictures", "--image.hashes=" + dir + "/pictures-hashes.db", "--notify.subscriptions=" + dir + "/subscriptions.db",
+		"--audit-log=" + dir + "/audit.log", "--site-settings=" + dir + "/site-settings.json", "--notify.outbox.path=" + dir + "/notify-outbox.db"}
 
 	done := make(chan struct{})
 	go func() {
@@ -78,7 +80,9 @@ func TestMain_WithWebhook(t *testing.T) {
 	port := chooseUnusedPort(t)
 	os.Args = []string{"test", "server", "--secret=123456", "--store.bolt.path=" + dir, "--backup=/tmp",
 		"--avatar.fs.path=" + dir, "--port=" + strconv.Itoa(port), "--url=https://demo.remark42.com", "--dbg",
-		"--admin-passwd=password", "--site=remark", "--notify.admins=webhook"}
+		"--admin-passwd=password", "--site=remark", "--notify.admins=webhook", "--notify.outbox.path=" + dir + "/notify-outbox.db",
+		"--notify.subscriptions=" + dir + "/subscriptions.db", "--image.fs.path=" + dir + "/pictures", "--image.hashes=" + dir + "/pictures-hashes.db",
+		"--audit-log=" + dir + "/audit.log", "--site-settings=" + dir + "/site-settings.json"}
 
 	err = os.Setenv("NOTIFY_WEBHOOK_URL", ts.URL)
 	assert.NoError(t, err)
@@ -13,6 +13,7 @@ import (
 	"github.com/go-pkgz/syncs"
 
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/audit"
 	"github.com/umputun/remark42/backend/app/store/service"
 )
 
@@ -21,9 +22,10 @@ const defaultConcurrent = 8
 
 // Native implements exporter and importer for internal store format
 // {"version": 1, comments:[{...}\n,{}], meta: {meta}}
-// each comments starts from the new line
+// each comments starts from the new line. Audit log, if set, included in meta
 type Native struct {
 	DataStore  Store
+	AuditLog   *audit.Store
 	Concurrent int
 }
 
@@ -31,6 +33,7 @@ type meta struct {
 	Version int                    `json:"version"`
 	Users   []service.UserMetaData `json:"users"`
 	Posts   []service.PostMetaData `json:"posts"`
+	Audit   []audit.Record         `json:"audit,omitempty"`
 }
 
 // Export all comments to writer as json strings. Each comment is one string, separated by "\n"
@@ -72,13 +75,18 @@ func (n *Native) Export(w io.Writer, siteID string) (size int, err error) {
 	return commentsCount, nil
 }
 
-// exportMeta appends user and post metas to exported stream
+// exportMeta appends user and post metas and audit records to exported stream
 func (n *Native) exportMeta(siteID string, w io.Writer) (err error) {
 	m := meta{Version: nativeVersion}
 	m.Users, m.Posts, err = n.DataStore.Metas(siteID)
 	if err != nil {
 		return fmt.Errorf("can't get meta: %w", err)
 	}
+	if n.AuditLog != nil {
+		if m.Audit, err = n.AuditLog.Find(audit.FindRequest{SiteID: siteID}); err != nil {
+			return fmt.Errorf("can't get audit records: %w", err)
+		}
+	}
 
 	if err = json.NewEncoder(w).Encode(m); err != nil {
 		return fmt.Errorf("can't encode meta: %w", err)
@@ -188,7 +196,17 @@ func (n *Native) Import(reader io.Reader, siteID string) (size int, err error) {
 	}
 	log.Printf("[INFO] imported %d comments from %d records", comments, total)
 
-	err = n.DataStore.SetMetas(siteID, m.Users, m.Posts)
+	if err = n.DataStore.SetMetas(siteID, m.Users, m.Posts); err != nil {
+		return int(comments), err
+	}
 
-	return int(comments), err
+	// audit records merged with the existing ones, as the log of actions made after backup should be kept
+	if n.AuditLog != nil && len(m.Audit) > 0 {
+		recs, e := n.AuditLog.Import(siteID, m.Audit)
+		if e != nil {
+			return int(comments), fmt.Errorf("failed to import audit records: %w", e)
+		}
+		log.Printf("[INFO] imported %d audit records", recs)
+	}
+	return int(comments), nil
 }
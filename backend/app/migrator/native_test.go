@@ -16,6 +16,7 @@ import (
 
 	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/store/admin"
+	"github.com/umputun/remark42/backend/app/store/audit"
 	"github.com/umputun/remark42/backend/app/store/engine"
 	"github.com/umputun/remark42/backend/app/store/service"
 )
@@ -101,6 +102,58 @@ func TestNative_Import(t *testing.T) {
 	assert.Equal(t, false, b.IsVerified("radio-t", "user2"))
 }
 
+func TestNative_ExportImportAudit(t *testing.T) {
+	b, teardown := prep(t) // write 2 comments
+	defer teardown()
+	b.AdminStore = admin.NewStaticStore("12345", nil, []string{}, "")
+
+	auditLog, err := audit.NewStore("")
+	require.NoError(t, err)
+	require.NoError(t, auditLog.Add(audit.Record{SiteID: "radio-t", Action: audit.ActionBlock,
+		Actor: audit.Actor{ID: "admin1", Name: "Admin One"}, Target: "user2", After: json.RawMessage(`{"blocked":true}`)}))
+	require.NoError(t, auditLog.Add(audit.Record{SiteID: "other", Action: audit.ActionPin, Target: "c1"}))
+
+	buf := &bytes.Buffer{}
+	size, err := (&Native{DataStore: b, AuditLog: auditLog}).Export(buf, "radio-t")
+	require.NoError(t, err)
+	assert.Equal(t, 2, size)
+	exported := buf.String()
+
+	m := meta{}
+	require.NoError(t, json.NewDecoder(strings.NewReader(exported)).Decode(&m))
+	require.Len(t, m.Audit, 1, "only records of exported site")
+	assert.Equal(t, audit.ActionBlock, m.Audit[0].Action)
+	assert.Equal(t, "admin1", m.Audit[0].Actor.ID)
+
+	// import to the fresh audit log, i.e. restore on another instance
+	restored, err := audit.NewStore("")
+	require.NoError(t, err)
+	size, err = (&Native{DataStore: b, AuditLog: restored}).Import(strings.NewReader(exported), "radio-t")
+	require.NoError(t, err)
+	assert.Equal(t, 2, size)
+	recs, err := restored.Find(audit.FindRequest{SiteID: "radio-t"})
+	require.NoError(t, err)
+	assert.Equal(t, m.Audit, recs)
+
+	// import to the same log keeps records, without duplicates
+	require.NoError(t, auditLog.Add(audit.Record{SiteID: "radio-t", Action: audit.ActionImport, Target: "native"}))
+	_, err = (&Native{DataStore: b, AuditLog: auditLog}).Import(strings.NewReader(exported), "radio-t")
+	require.NoError(t, err)
+	recs, err = auditLog.Find(audit.FindRequest{SiteID: "radio-t"})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, audit.ActionImport, recs[0].Action)
+	assert.Equal(t, audit.ActionBlock, recs[1].Action)
+
+	// backups without audit accepted
+	buf.Reset()
+	_, err = (&Native{DataStore: b}).Export(buf, "radio-t")
+	require.NoError(t, err)
+	assert.NotContains(t, buf.String(), `"audit"`)
+	_, err = (&Native{DataStore: b, AuditLog: restored}).Import(buf, "radio-t")
+	require.NoError(t, err)
+}
+
 func TestNative_ImportWithMapper(t *testing.T) {
 	b, teardown := prep(t) // write 2 comments
 	defer teardown()
@@ -0,0 +1,214 @@
+// Package moderation makes moderation actions shared by admin api and moderation with bots of notifications.
+// Each action is recorded to the audit log with state of the target before and after the change,
+// and submits notification of the event, the same way for all of them.
+package moderation
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/audit"
+)
+
+// Store defines data operations used for moderation, implemented by service.DataStore
+type Store interface {
+	Get(locator store.Locator, commentID string, user store.User) (store.Comment, error)
+	Info(locator store.Locator, readonlyAge int) (store.PostInfo, error)
+	Delete(locator store.Locator, commentID string, mode store.DeleteMode) error
+	DeleteUser(siteID, userID string, mode store.DeleteMode) error
+	UserCount(siteID, userID string, user store.User) (int, error)
+	IsBlocked(siteID, userID string) bool
+	SetBlock(siteID, userID string, status bool, ttl time.Duration) error
+	IsShadowBanned(siteID, userID string) bool
+	SetShadowBan(siteID, userID string, status bool) error
+	IsVerified(siteID, userID string) bool
+	SetVerified(siteID, userID string, status bool) error
+	SetReadOnly(locator store.Locator, status bool) error
+	SetPin(locator store.Locator, commentID string, status bool) error
+}
+
+// Notifier submits notifications of moderation events, implemented by notify.Service
+type Notifier interface {
+	Submit(req notify.Request)
+}
+
+// Service makes moderation actions on behalf of the actor. Doesn't flush caches, it's up to the caller.
+type Service struct {
+	Store       Store
+	AuditLog    *audit.Store            // optional, log of moderation actions
+	ReadOnlyAge func(siteID string) int // optional, age of posts turned to read-only, for post state in audit log
+
+	mu       sync.RWMutex
+	notifier Notifier
+}
+
+// UserState is a snapshot of user's moderation state, recorded to audit log
+type UserState struct {
+	Blocked  bool `json:"blocked"`
+	Shadow   bool `json:"shadow"`
+	Verified bool `json:"verified"`
+	Comments int  `json:"comments"`
+}
+
+// SetNotifier sets notifier of moderation events, events are not submitted without it.
+// Separate from the construction as notify service with bot destination is made after the moderation of the bot.
+func (s *Service) SetNotifier(n Notifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifier = n
+}
+
+// DeleteComment soft-deletes the comment
+func (s *Service) DeleteComment(actor store.User, locator store.Locator, commentID string) error {
+	before := s.CommentState(actor, locator, commentID)
+	if err := s.Store.Delete(locator, commentID, store.SoftDelete); err != nil {
+		return err
+	}
+	AddAudit(s.AuditLog, actor, audit.Record{SiteID: locator.SiteID, Action: audit.ActionDeleteComment, Target: commentID, URL: locator.URL},
+		before, s.CommentState(actor, locator, commentID))
+	s.submitEvent(actor, notify.EventDelete, locator, commentID)
+	return nil
+}
+
+// SetBlock blocks or unblocks the user, zero ttl blocks permanently and deletes all user's comments.
+// Both block and unblock lift shadow ban, as block modes are exclusive.
+func (s *Service) SetBlock(actor store.User, siteID, userID string, status bool, ttl time.Duration) error {
+	before := s.UserState(siteID, userID)
+	if err := s.Store.SetBlock(siteID, userID, status, ttl); err != nil {
+		return err
+	}
+	if err := s.Store.SetShadowBan(siteID, userID, false); err != nil {
+		return fmt.Errorf("can't reset shadow ban: %w", err)
+	}
+	if status && ttl == 0 {
+		if err := s.Store.DeleteUser(siteID, userID, store.SoftDelete); err != nil {
+			log.Printf("[WARN] can't delete comments for blocked user %s on site %s, %v", userID, siteID, err)
+		}
+	}
+	AddAudit(s.AuditLog, actor, audit.Record{SiteID: siteID, Action: audit.ActionBlock, Target: userID},
+		before, s.UserState(siteID, userID))
+	s.submit(notify.Request{Event: notify.EventBlock, Comment: store.Comment{Locator: store.Locator{SiteID: siteID}},
+		User: store.User{ID: userID, Blocked: status}})
+	return nil
+}
+
+// SetVerified sets or resets verified status of the user
+func (s *Service) SetVerified(actor store.User, siteID, userID string, status bool) error {
+	before := s.UserState(siteID, userID)
+	if err := s.Store.SetVerified(siteID, userID, status); err != nil {
+		return err
+	}
+	AddAudit(s.AuditLog, actor, audit.Record{SiteID: siteID, Action: audit.ActionVerify, Target: userID},
+		before, s.UserState(siteID, userID))
+	return nil
+}
+
+// SetReadOnly sets or resets read-only status of the post
+func (s *Service) SetReadOnly(actor store.User, locator store.Locator, status bool) error {
+	before := s.PostState(locator)
+	if err := s.Store.SetReadOnly(locator, status); err != nil {
+		return err
+	}
+	AddAudit(s.AuditLog, actor, audit.Record{SiteID: locator.SiteID, Action: audit.ActionReadOnly, Target: locator.URL},
+		before, s.PostState(locator))
+	s.submit(notify.Request{Event: notify.EventReadOnly, Comment: store.Comment{Locator: locator}, ReadOnly: status})
+	return nil
+}
+
+// SetPin pins or unpins the comment
+func (s *Service) SetPin(actor store.User, locator store.Locator, commentID string, status bool) error {
+	before := s.CommentState(actor, locator, commentID)
+	if err := s.Store.SetPin(locator, commentID, status); err != nil {
+		return err
+	}
+	AddAudit(s.AuditLog, actor, audit.Record{SiteID: locator.SiteID, Action: audit.ActionPin, Target: commentID, URL: locator.URL},
+		before, s.CommentState(actor, locator, commentID))
+	s.submitEvent(actor, notify.EventPin, locator, commentID)
+	return nil
+}
+
+// UserState returns moderation state of the user for audit log
+func (s *Service) UserState(siteID, userID string) UserState {
+	count, err := s.Store.UserCount(siteID, userID, store.User{Admin: true})
+	if err != nil {
+		log.Printf("[DEBUG] can't count comments of user %s on site %s, %v", userID, siteID, err)
+	}
+	return UserState{
+		Blocked:  s.Store.IsBlocked(siteID, userID),
+		Shadow:   s.Store.IsShadowBanned(siteID, userID),
+		Verified: s.Store.IsVerified(siteID, userID),
+		Comments: count,
+	}
+}
+
+// CommentState returns comment as seen by the actor for audit log, nil if comment can't be read
+func (s *Service) CommentState(actor store.User, locator store.Locator, commentID string) any {
+	comment, err := s.Store.Get(locator, commentID, actor)
+	if err != nil {
+		return nil
+	}
+	return comment
+}
+
+// PostState returns post info for audit log, nil if post can't be read
+func (s *Service) PostState(locator store.Locator) any {
+	readOnlyAge := 0
+	if s.ReadOnlyAge != nil {
+		readOnlyAge = s.ReadOnlyAge(locator.SiteID)
+	}
+	info, err := s.Store.Info(locator, readOnlyAge)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
+// AddAudit records moderation action made by the actor to the audit log, does nothing without audit log.
+// before and after are the states of the target, nil if missing. Failure logged only, as the action already made
+func AddAudit(auditLog *audit.Store, actor store.User, rec audit.Record, before, after any) {
+	if auditLog == nil {
+		return
+	}
+	rec.Actor = audit.Actor{ID: actor.ID, Name: actor.Name}
+
+	snapshot := func(v any) json.RawMessage {
+		if v == nil {
+			return nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil || string(data) == "null" {
+			return nil
+		}
+		return data
+	}
+	rec.Before, rec.After = snapshot(before), snapshot(after)
+
+	if err := auditLog.Add(rec); err != nil {
+		log.Printf("[WARN] can't add audit record %s of %s on site %s, %v", rec.Action, rec.Target, rec.SiteID, err)
+	}
+}
+
+// submitEvent submits notification of the event made with the comment, in the state after the change
+func (s *Service) submitEvent(actor store.User, event notify.Event, locator store.Locator, commentID string) {
+	comment, err := s.Store.Get(locator, commentID, actor)
+	if err != nil {
+		log.Printf("[WARN] can't read comment %s for %s notification, %v", commentID, event, err)
+		return
+	}
+	s.submit(notify.Request{Event: event, Comment: comment})
+}
+
+func (s *Service) submit(req notify.Request) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.notifier == nil {
+		return
+	}
+	s.notifier.Submit(req)
+}
@@ -0,0 +1,155 @@
+package moderation
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/admin"
+	"github.com/umputun/remark42/backend/app/store/audit"
+	"github.com/umputun/remark42/backend/app/store/engine"
+	"github.com/umputun/remark42/backend/app/store/service"
+)
+
+var actor = store.User{ID: "telegram_100", Name: "moder", Admin: true}
+
+func TestService_Comment(t *testing.T) {
+	s, ds, n := prepService(t)
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post1"}
+	id, err := ds.Create(store.Comment{Text: "some text", Locator: locator, User: store.User{ID: "user1", Name: "user1"}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetPin(actor, locator, id, true))
+	require.NoError(t, s.DeleteComment(actor, locator, id))
+	c, err := ds.Get(locator, id, actor)
+	require.NoError(t, err)
+	assert.True(t, c.Deleted)
+	assert.Error(t, s.DeleteComment(actor, locator, "bad-id"))
+
+	recs, err := s.AuditLog.Find(audit.FindRequest{SiteID: "remark"})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, audit.ActionDeleteComment, recs[0].Action)
+	assert.Equal(t, audit.Actor{ID: "telegram_100", Name: "moder"}, recs[0].Actor)
+	var before, after store.Comment
+	require.NoError(t, json.Unmarshal(recs[0].Before, &before))
+	require.NoError(t, json.Unmarshal(recs[0].After, &after))
+	assert.False(t, before.Deleted)
+	assert.True(t, after.Deleted)
+	assert.Equal(t, audit.ActionPin, recs[1].Action)
+
+	reqs := n.get()
+	require.Len(t, reqs, 2)
+	assert.Equal(t, notify.EventPin, reqs[0].Event)
+	assert.Equal(t, notify.EventDelete, reqs[1].Event)
+	assert.Equal(t, id, reqs[1].Comment.ID)
+}
+
+func TestService_User(t *testing.T) {
+	s, ds, n := prepService(t)
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post1"}
+	id, err := ds.Create(store.Comment{Text: "some text", Locator: locator, User: store.User{ID: "user1", Name: "user1"}})
+	require.NoError(t, err)
+
+	require.NoError(t, ds.SetShadowBan("remark", "user1", true))
+	require.NoError(t, s.SetVerified(actor, "remark", "user1", true))
+	assert.Equal(t, UserState{Shadow: true, Verified: true, Comments: 1}, s.UserState("remark", "user1"))
+
+	require.NoError(t, s.SetBlock(actor, "remark", "user1", true, time.Hour))
+	assert.Equal(t, UserState{Blocked: true, Verified: true, Comments: 1}, s.UserState("remark", "user1"), "shadow ban lifted")
+	c, err := ds.Get(locator, id, actor)
+	require.NoError(t, err)
+	assert.False(t, c.Deleted)
+	require.NoError(t, s.SetBlock(actor, "remark", "user1", true, 0))
+	c, err = ds.Get(locator, id, actor)
+	require.NoError(t, err)
+	assert.True(t, c.Deleted, "comments of permanently blocked user deleted")
+
+	recs, err := s.AuditLog.Find(audit.FindRequest{SiteID: "remark"})
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	assert.Equal(t, audit.ActionBlock, recs[0].Action)
+	assert.JSONEq(t, `{"blocked": true, "shadow": false, "verified": true, "comments": 1}`, string(recs[0].Before))
+	assert.JSONEq(t, `{"blocked": false, "shadow": true, "verified": true, "comments": 1}`, string(recs[1].Before))
+	assert.Equal(t, audit.ActionVerify, recs[2].Action)
+
+	reqs := n.get()
+	require.Len(t, reqs, 2, "verification doesn't notify")
+	assert.Equal(t, notify.EventBlock, reqs[1].Event)
+	assert.Equal(t, store.User{ID: "user1", Blocked: true}, reqs[1].User)
+}
+
+func TestService_SetReadOnly(t *testing.T) {
+	s, ds, n := prepService(t)
+	s.ReadOnlyAge = func(string) int { return 0 }
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post1"}
+	_, err := ds.Create(store.Comment{Text: "some text", Locator: locator, User: store.User{ID: "user1", Name: "user1"}})
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetReadOnly(actor, locator, true))
+	assert.True(t, ds.IsReadOnly(locator))
+
+	recs, err := s.AuditLog.Find(audit.FindRequest{SiteID: "remark"})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, locator.URL, recs[0].Target)
+	var before, after store.PostInfo
+	require.NoError(t, json.Unmarshal(recs[0].Before, &before))
+	require.NoError(t, json.Unmarshal(recs[0].After, &after))
+	assert.False(t, before.ReadOnly)
+	assert.True(t, after.ReadOnly)
+
+	reqs := n.get()
+	require.Len(t, reqs, 1)
+	assert.Equal(t, notify.EventReadOnly, reqs[0].Event)
+	assert.True(t, reqs[0].ReadOnly)
+}
+
+func TestService_NoNotifierNoAuditLog(t *testing.T) {
+	_, ds, _ := prepService(t)
+	s := &Service{Store: ds}
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post1"}
+	id, err := ds.Create(store.Comment{Text: "some text", Locator: locator, User: store.User{ID: "user1", Name: "user1"}})
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteComment(actor, locator, id))
+	require.NoError(t, s.SetReadOnly(actor, locator, true))
+}
+
+func prepService(t *testing.T) (*Service, *service.DataStore, *mockNotifier) {
+	b, err := engine.NewBoltDB(bolt.Options{}, engine.BoltSite{FileName: filepath.Join(t.TempDir(), "test.db"), SiteID: "remark"})
+	require.NoError(t, err)
+	ds := &service.DataStore{Engine: b, AdminStore: admin.NewStaticStore("secret", []string{"remark"}, nil, ""), MaxCommentSize: 1000}
+	t.Cleanup(func() { _ = ds.Close() })
+	auditLog, err := audit.NewStore("")
+	require.NoError(t, err)
+
+	n := &mockNotifier{}
+	s := &Service{Store: ds, AuditLog: auditLog}
+	s.SetNotifier(n)
+	return s, ds, n
+}
+
+type mockNotifier struct {
+	mu   sync.Mutex
+	reqs []notify.Request
+}
+
+func (m *mockNotifier) Submit(req notify.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reqs = append(m.reqs, req)
+}
+
+func (m *mockNotifier) get() []notify.Request {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]notify.Request{}, m.reqs...)
+}
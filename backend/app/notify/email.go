@@ -3,10 +3,13 @@ package notify
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"html/template"
+	"net/mail"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -22,12 +25,18 @@ type EmailParams struct {
 	From                     string   // from email address
 	AdminEmails              []string // administrator emails to send copy of comment notification to
 	MsgTemplatePath          string   // path to request message template
+	DigestTemplatePath       string   // path to digest message template
 	VerificationSubject      string   // verification message sub
 	VerificationTemplatePath string   // path to verification template
 	SubscribeURL             string   // full subscribe handler URL
 	UnsubscribeURL           string   // full unsubscribe handler URL
 
 	TokenGenFn func(userID, email, site string) (string, error) // unsubscribe token generation function
+
+	// address for replies by email, i.e. "reply@example.com". User notifications sent from "reply+<token>@example.com",
+	// with the name of From, and replies to it are posted as comments by EmailReplyServer. Disabled if empty.
+	ReplyAddress string
+	ReplyTokenFn func(siteID, url, parentID, userID string) (string, error) // reply address token generation function
 }
 
 // Email implements notify.Destination for email
@@ -37,6 +46,57 @@ type Email struct {
 	EmailParams
 	msgTmpl    *template.Template // parsed request message template
 	verifyTmpl *template.Template // parsed verification message template
+	digestTmpl *template.Template // parsed digest message template
+
+	digestsMu   sync.Mutex
+	digests     map[string]*Digest // replies collected in memory for digest recipients, by site and email
+	digestStore DigestStore        // persistent store of digests, replaces in-memory digests if set
+}
+
+// Email digest periods, kept as engine.UserEmailDigest user detail. Empty period means immediate notifications.
+const (
+	EmailDigestHourly = "hourly"
+	EmailDigestDaily  = "daily"
+)
+
+var digestPeriods = map[string]time.Duration{EmailDigestHourly: time.Hour, EmailDigestDaily: 24 * time.Hour}
+
+// Digest collects replies to a single recipient, sent in one message a period after the first reply
+type Digest struct {
+	SiteID          string    `json:"site"`
+	Email           string    `json:"email"`
+	Period          string    `json:"period"`
+	UnsubscribeLink string    `json:"unsubscribe_link"`
+	Created         time.Time `json:"created"`
+	Replies         []Request `json:"replies"`
+}
+
+// DigestStore keeps digests until they are due, so collected replies survive restart
+type DigestStore interface {
+	// AddToDigest adds replies of the digest to the one collected for the recipient, or keeps it as the new one
+	AddToDigest(d Digest) error
+}
+
+// due returns time the digest should be sent at
+func (d Digest) due() time.Time {
+	return d.Created.Add(digestPeriods[d.Period])
+}
+
+// digestTmplData store data for digest message template execution
+type digestTmplData struct {
+	Count           int
+	Since           time.Time
+	Posts           []digestPost
+	Period          string
+	Email           string
+	UnsubscribeLink string
+}
+
+// digestPost is a post with replies in digest, replies use the same data as single reply message
+type digestPost struct {
+	PostTitle string
+	PostLink  string
+	Replies   []msgTmplData
 }
 
 // msgTmplData store data for message from request template execution
@@ -55,6 +115,8 @@ type msgTmplData struct {
 	Email             string
 	UnsubscribeLink   string
 	ForAdmin          bool
+	PostSubscriber    bool // recipient subscribed to the post, not the author of parent comment
+	ReplyByEmail      bool // replying to the message posts the reply to the comment
 }
 
 // emailCommentPolicy sanitizes comment HTML for inclusion in notification emails.
@@ -94,7 +156,9 @@ const (
 	defaultVerificationSubject           = "Email verification"
 	defaultEmailTimeout                  = 10 * time.Second
 	defaultEmailTemplatePath             = "email_reply.html.tmpl"
+	defaultEmailDigestTemplatePath       = "email_digest.html.tmpl"
 	defaultEmailVerificationTemplatePath = "email_confirmation_subscription.html.tmpl"
+	digestCheckInterval                  = time.Minute
 )
 
 // NewEmail makes new Email object, returns error in case of e.MsgTemplate or e.VerificationTemplate parsing error
@@ -124,7 +188,7 @@ func NewEmail(emailParams EmailParams, smtpParams ntf.SMTPParams) (*Email, error
 
 func (e *Email) setTemplates() error {
 	var err error
-	var msgTmplFile, verifyTmplFile []byte
+	var msgTmplFile, verifyTmplFile, digestTmplFile []byte
 
 	if e.VerificationTemplatePath == "" {
 		e.VerificationTemplatePath = defaultEmailVerificationTemplatePath
@@ -134,24 +198,35 @@ func (e *Email) setTemplates() error {
 		e.MsgTemplatePath = defaultEmailTemplatePath
 	}
 
+	if e.DigestTemplatePath == "" {
+		e.DigestTemplatePath = defaultEmailDigestTemplatePath
+	}
+
 	if msgTmplFile, err = templates.Read(e.MsgTemplatePath); err != nil {
 		return fmt.Errorf("can't read message template: %w", err)
 	}
 	if verifyTmplFile, err = templates.Read(e.VerificationTemplatePath); err != nil {
 		return fmt.Errorf("can't read verification template: %w", err)
 	}
+	if digestTmplFile, err = templates.Read(e.DigestTemplatePath); err != nil {
+		return fmt.Errorf("can't read digest template: %w", err)
+	}
 	if e.msgTmpl, err = template.New("msgTmpl").Parse(string(msgTmplFile)); err != nil {
 		return fmt.Errorf("can't parse message template: %w", err)
 	}
 	if e.verifyTmpl, err = template.New("verifyTmpl").Parse(string(verifyTmplFile)); err != nil {
 		return fmt.Errorf("can't parse verification template: %w", err)
 	}
+	if e.digestTmpl, err = template.New("digestTmpl").Parse(string(digestTmplFile)); err != nil {
+		return fmt.Errorf("can't parse digest template: %w", err)
+	}
 
 	return nil
 }
 
 // Send email about comment reply to Request.Emails and Email.AdminEmails
-// if they're set.
+// if they're set. Replies to recipients with digest period in Request.EmailDigests
+// are collected and sent later by SendDigests.
 // Thread safe
 func (e *Email) Send(ctx context.Context, req Request) error {
 	select {
@@ -160,23 +235,29 @@ func (e *Email) Send(ctx context.Context, req Request) error {
 	default:
 	}
 
-	var errs []error
-
-	for _, email := range req.Emails {
-		err := e.buildAndSendMessage(ctx, req, email, false)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("problem sending user email notification to %q: %w", email, err))
-		}
-	}
-
+	// admin emails are prefixed, as the same address can get both user and admin notification
+	recipients := slices.Clone(req.Emails)
 	for _, email := range e.AdminEmails {
-		err := e.buildAndSendMessage(ctx, req, email, true)
-		if err != nil {
-			errs = append(errs, fmt.Errorf("problem sending admin email notification to %q: %w", email, err))
-		}
+		recipients = append(recipients, adminRecipient+email)
 	}
-
-	return errors.Join(errs...)
+	return sendAll(req, recipients, func(recipient string) error {
+		if email, ok := strings.CutPrefix(recipient, adminRecipient); ok {
+			if err := e.buildAndSendMessage(ctx, req, email, true); err != nil {
+				return fmt.Errorf("problem sending admin email notification to %q: %w", email, err)
+			}
+			return nil
+		}
+		if _, ok := digestPeriods[req.EmailDigests[recipient]]; ok {
+			if err := e.addToDigest(req, recipient, req.EmailDigests[recipient]); err != nil {
+				return fmt.Errorf("problem adding email notification to %q digest: %w", recipient, err)
+			}
+			return nil
+		}
+		if err := e.buildAndSendMessage(ctx, req, recipient, false); err != nil {
+			return fmt.Errorf("problem sending user email notification to %q: %w", recipient, err)
+		}
+		return nil
+	})
 }
 
 func (e *Email) buildAndSendMessage(ctx context.Context, req Request, email string, forAdmin bool) error {
@@ -185,15 +266,23 @@ func (e *Email) buildAndSendMessage(ctx context.Context, req Request, email stri
 	if err != nil {
 		return err
 	}
+	return e.sendMessage(ctx, email, msg)
+}
 
+// sendMessage sends comment or digest message to email, with a few retries
+func (e *Email) sendMessage(ctx context.Context, email string, msg commentMessage) error {
 	return repeater.NewFixed(5, time.Millisecond*250).Do(
 		ctx,
 		func() error {
+			from := e.From
+			if msg.from != "" {
+				from = msg.from
+			}
 			return e.Email.Send(
 				ctx,
 				fmt.Sprintf("mailto:%s?from=%s&unsubscribeLink=%s&subject=%s",
 					email,
-					url.QueryEscape(e.From),
+					url.QueryEscape(from),
 					url.QueryEscape(msg.unsubscribeLink),
 					url.QueryEscape(msg.subject),
 				),
@@ -256,11 +345,16 @@ type commentMessage struct {
 	subject         string
 	body            string
 	unsubscribeLink string
+	from            string // sender address of the message, EmailParams.From if empty
 }
 
 // buildMessageFromRequest generates email message based on Request using e.MsgTemplate
 func (e *Email) buildMessageFromRequest(req Request, email string, forAdmin bool) (commentMessage, error) {
 	subject := "New reply to your comment"
+	_, postSubscriber := req.PostEmails[email]
+	if postSubscriber {
+		subject = "New comment"
+	}
 	if forAdmin {
 		subject = "New comment to your site"
 	}
@@ -268,17 +362,81 @@ func (e *Email) buildMessageFromRequest(req Request, email string, forAdmin bool
 		subject += fmt.Sprintf(" for %q", req.Comment.PostTitle)
 	}
 
-	token, err := e.TokenGenFn(req.parent.User.ID, email, req.Comment.Locator.SiteID)
+	unsubscribeLink, from := "", ""
+	if !forAdmin {
+		link, err := e.unsubscribeLink(req, email, true)
+		if err != nil {
+			return commentMessage{}, err
+		}
+		unsubscribeLink = link
+		if from, err = e.replyFrom(req, email); err != nil {
+			return commentMessage{}, err
+		}
+	}
+
+	tmplData := e.replyTmplData(req, email, unsubscribeLink, forAdmin)
+	tmplData.ReplyByEmail = from != ""
+	msg := bytes.Buffer{}
+	if err := e.msgTmpl.Execute(&msg, tmplData); err != nil {
+		return commentMessage{}, fmt.Errorf("error executing template to build comment reply message: %w", err)
+	}
+	return commentMessage{
+		subject:         subject,
+		body:            msg.String(),
+		unsubscribeLink: unsubscribeLink,
+		from:            from,
+	}, nil
+}
+
+// replyFrom makes sender address of the message to the user with token of reply to the comment of request,
+// empty if replies by email disabled
+func (e *Email) replyFrom(req Request, email string) (string, error) {
+	if e.ReplyAddress == "" || e.ReplyTokenFn == nil {
+		return "", nil
+	}
+	userID, postSubscriber := req.PostEmails[email]
+	if !postSubscriber {
+		userID = req.parent.User.ID
+	}
+	token, err := e.ReplyTokenFn(req.Comment.Locator.SiteID, req.Comment.Locator.URL, req.Comment.ID, userID)
 	if err != nil {
-		return commentMessage{}, fmt.Errorf("error creating token for unsubscribe link: %w", err)
+		return "", fmt.Errorf("error creating token for reply address: %w", err)
 	}
-	unsubscribeLink := e.UnsubscribeURL + "?site=" + req.Comment.Locator.SiteID + "&tkn=" + token
-	if forAdmin {
-		unsubscribeLink = ""
+	from := mail.Address{Address: EmailReplyAddress(e.ReplyAddress, token)}
+	if addr, err := mail.ParseAddress(e.From); err == nil {
+		from.Name = addr.Name
 	}
+	return from.String(), nil
+}
 
+// EmailReplyAddress makes reply address with the token, "reply@example.com" becomes "reply+<token>@example.com"
+func EmailReplyAddress(replyAddress, token string) string {
+	local, domain, _ := strings.Cut(replyAddress, "@")
+	return local + "+" + token + "@" + domain
+}
+
+// unsubscribeLink makes link to unsubscribe email from notifications, also used for one-click List-Unsubscribe header.
+// For subscriber of the post and postOnly set, the link unsubscribes from the post only.
+func (e *Email) unsubscribeLink(req Request, email string, postOnly bool) (string, error) {
+	userID, postSubscriber := req.PostEmails[email]
+	if !postSubscriber {
+		userID = req.parent.User.ID
+	}
+	token, err := e.TokenGenFn(userID, email, req.Comment.Locator.SiteID)
+	if err != nil {
+		return "", fmt.Errorf("error creating token for unsubscribe link: %w", err)
+	}
+	link := e.UnsubscribeURL + "?site=" + req.Comment.Locator.SiteID + "&tkn=" + token
+	if postSubscriber && postOnly {
+		link += "&url=" + url.QueryEscape(req.Comment.Locator.URL)
+	}
+	return link, nil
+}
+
+// replyTmplData makes template data of the reply for single reply message and digest
+func (e *Email) replyTmplData(req Request, email, unsubscribeLink string, forAdmin bool) msgTmplData {
 	commentURLPrefix := req.Comment.Locator.URL + uiNav
-	msg := bytes.Buffer{}
+	_, postSubscriber := req.PostEmails[email]
 	tmplData := msgTmplData{
 		UserName:        req.Comment.User.Name,
 		UserPicture:     req.Comment.User.Picture,
@@ -289,6 +447,7 @@ func (e *Email) buildMessageFromRequest(req Request, email string, forAdmin bool
 		Email:           email,
 		UnsubscribeLink: unsubscribeLink,
 		ForAdmin:        forAdmin,
+		PostSubscriber:  postSubscriber && !forAdmin,
 	}
 	// in case of message to admin, parent message might be empty
 	if req.Comment.ParentID != "" {
@@ -298,13 +457,142 @@ func (e *Email) buildMessageFromRequest(req Request, email string, forAdmin bool
 		tmplData.ParentCommentLink = commentURLPrefix + req.parent.ID
 		tmplData.ParentCommentDate = req.parent.Timestamp
 	}
-	err = e.msgTmpl.Execute(&msg, tmplData)
+	return tmplData
+}
+
+// addToDigest collects reply to the digest of the recipient, the digest is created by the first reply
+func (e *Email) addToDigest(req Request, email, period string) error {
+	link, err := e.unsubscribeLink(req, email, false)
 	if err != nil {
-		return commentMessage{}, fmt.Errorf("error executing template to build comment reply message: %w", err)
+		return err
 	}
-	return commentMessage{
-		subject:         subject,
-		body:            msg.String(),
-		unsubscribeLink: unsubscribeLink,
-	}, err
+	digest := Digest{SiteID: req.Comment.Locator.SiteID, Email: email, Period: period, UnsubscribeLink: link,
+		Created: time.Now(), Replies: []Request{req}}
+	if err = e.addDigest(digest); err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] comment id %s added to %s digest for %s", req.Comment.ID, period, email)
+	return nil
+}
+
+// addDigest adds digest with the reply to the persistent store if set, or to the one collected in memory
+func (e *Email) addDigest(digest Digest) error {
+	e.digestsMu.Lock()
+	defer e.digestsMu.Unlock()
+	if e.digestStore != nil {
+		return e.digestStore.AddToDigest(digest)
+	}
+	if e.digests == nil {
+		e.digests = map[string]*Digest{}
+	}
+	key := digest.SiteID + "::" + digest.Email
+	d, ok := e.digests[key]
+	if !ok {
+		e.digests[key] = &digest
+		return nil
+	}
+	d.UnsubscribeLink = digest.UnsubscribeLink
+	d.Replies = append(d.Replies, digest.Replies...)
+	return nil
+}
+
+// UseDigestStore makes email keep digests in the persistent store instead of memory.
+// Such digests are sent with SendDigest by the owner of the store, i.e. by notification service with outbox.
+func (e *Email) UseDigestStore(ds DigestStore) {
+	e.digestsMu.Lock()
+	defer e.digestsMu.Unlock()
+	e.digestStore = ds
+}
+
+// SendDigest sends digest message to its recipient
+func (e *Email) SendDigest(ctx context.Context, d Digest) error {
+	log.Printf("[DEBUG] send %s digest via %s, %d replies", d.Period, e, len(d.Replies))
+	msg, err := e.buildDigestMessage(d)
+	if err != nil {
+		return err
+	}
+	if err = e.sendMessage(ctx, d.Email, msg); err != nil {
+		return fmt.Errorf("problem sending %s digest to %q: %w", d.Period, d.Email, err)
+	}
+	return nil
+}
+
+// SendDigests sends digests collected in memory when they are due, checking every minute until ctx canceled.
+// All remaining digests are sent on cancellation, so collected replies are not lost on shutdown.
+// Does nothing for digests kept in the persistent store. Should run in goroutine.
+func (e *Email) SendDigests(ctx context.Context) {
+	e.digestsMu.Lock()
+	persistent := e.digestStore != nil
+	e.digestsMu.Unlock()
+	if persistent {
+		return
+	}
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			e.sendDigests(flushCtx, time.Now(), true)
+			cancel()
+			return
+		case now := <-ticker.C:
+			e.sendDigests(ctx, now, false)
+		}
+	}
+}
+
+// sendDigests sends digests due at the given time, or all of them if force set
+func (e *Email) sendDigests(ctx context.Context, now time.Time, force bool) {
+	var due []Digest
+	e.digestsMu.Lock()
+	for key, d := range e.digests {
+		if force || !d.due().After(now) {
+			due = append(due, *d)
+			delete(e.digests, key)
+		}
+	}
+	e.digestsMu.Unlock()
+
+	for _, d := range due {
+		if err := e.SendDigest(ctx, d); err != nil {
+			sendErrCounter.WithLabelValues(destinationName(e)).Inc()
+			log.Printf("[WARN] %v", err)
+		}
+	}
+}
+
+// buildDigestMessage generates digest email message with replies grouped by post using e.digestTmpl
+func (e *Email) buildDigestMessage(d Digest) (commentMessage, error) {
+	tmplData := digestTmplData{
+		Count:           len(d.Replies),
+		Since:           d.Created,
+		Period:          d.Period,
+		Email:           d.Email,
+		UnsubscribeLink: d.UnsubscribeLink,
+	}
+	posts := map[string]int{} // post url to index in tmplData.Posts
+	for _, req := range d.Replies {
+		idx, ok := posts[req.Comment.Locator.URL]
+		if !ok {
+			idx = len(tmplData.Posts)
+			posts[req.Comment.Locator.URL] = idx
+			tmplData.Posts = append(tmplData.Posts, digestPost{PostTitle: req.Comment.PostTitle, PostLink: req.Comment.Locator.URL})
+		}
+		tmplData.Posts[idx].Replies = append(tmplData.Posts[idx].Replies, e.replyTmplData(req, d.Email, d.UnsubscribeLink, false))
+	}
+
+	subject := fmt.Sprintf("%d new replies to your comments", len(d.Replies))
+	if len(d.Replies) == 1 {
+		subject = "New reply to your comment"
+	}
+	if len(tmplData.Posts) == 1 && tmplData.Posts[0].PostTitle != "" {
+		subject += fmt.Sprintf(" for %q", tmplData.Posts[0].PostTitle)
+	}
+
+	msg := bytes.Buffer{}
+	if err := e.digestTmpl.Execute(&msg, tmplData); err != nil {
+		return commentMessage{}, fmt.Errorf("error executing template to build digest message: %w", err)
+	}
+	return commentMessage{subject: subject, body: msg.String(), unsubscribeLink: d.UnsubscribeLink}, nil
 }
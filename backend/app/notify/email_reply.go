@@ -0,0 +1,346 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// EmailReply is a reply to email notification received by EmailReplyServer
+type EmailReply struct {
+	Token string // token of the reply address
+	From  string // email address of the sender
+	Text  string // text of the reply, without quoted message and signature
+}
+
+// EmailReplyServer receives replies to email notifications over SMTP, from MX of the reply address domain.
+// Only messages to the reply addresses with token, as made by EmailReplyAddress, accepted. Each reply passed
+// to Handler, with error of the Handler returned to the sending server, to bounce the message to the sender.
+type EmailReplyServer struct {
+	Address      string // listen address, i.e. ":2525"
+	ReplyAddress string // address for replies, the same as EmailParams.ReplyAddress
+	Handler      func(ctx context.Context, reply EmailReply) error
+	MaxSize      int64         // max size of the message, 1MB if not set
+	Timeout      time.Duration // timeout of the whole smtp session, 5 minutes if not set
+}
+
+const (
+	emailReplyMaxSize = 1024 * 1024
+	emailReplyTimeout = 5 * time.Minute
+)
+
+// Run listens on Address and serves smtp sessions until ctx canceled
+func (s *EmailReplyServer) Run(ctx context.Context) error {
+	lst, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return fmt.Errorf("can't listen on %s: %w", s.Address, err)
+	}
+	log.Printf("[INFO] activate email replies smtp server on %s for %s", lst.Addr(), s.ReplyAddress)
+	return s.Serve(ctx, lst)
+}
+
+// Serve serves smtp sessions of the listener until ctx canceled, the listener closed on return
+func (s *EmailReplyServer) Serve(ctx context.Context, lst net.Listener) error {
+	if s.MaxSize <= 0 {
+		s.MaxSize = emailReplyMaxSize
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = emailReplyTimeout
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = lst.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := lst.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("can't accept smtp connection: %w", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.session(ctx, conn)
+		}()
+	}
+}
+
+// session talks the minimal subset of SMTP needed to receive messages from another mail server
+func (s *EmailReplyServer) session(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	tp := textproto.NewConn(conn)
+	// respond sends reply with the code, multiline if more than one line given
+	respond := func(code int, lines ...string) {
+		for i, l := range lines {
+			sep := " "
+			if i < len(lines)-1 {
+				sep = "-"
+			}
+			if err := tp.PrintfLine("%d%s%s", code, sep, l); err != nil {
+				log.Printf("[DEBUG] can't respond to smtp client %s, %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "remark42"
+	}
+	respond(220, hostname+" ESMTP remark42")
+	var mailFrom bool // transaction started by MAIL command, sender might be empty for bounces
+	var tokens []string
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "HELO":
+			respond(250, hostname)
+		case "EHLO":
+			respond(250, hostname, "8BITMIME", fmt.Sprintf("SIZE %d", s.MaxSize))
+		case "MAIL":
+			if _, ok := smtpPath(arg, "FROM:"); !ok {
+				respond(501, "5.5.4 syntax: MAIL FROM:<address>")
+				continue
+			}
+			mailFrom, tokens = true, nil
+			respond(250, "2.1.0 ok")
+		case "RCPT":
+			if !mailFrom {
+				respond(503, "5.5.1 MAIL first")
+				continue
+			}
+			addr, ok := smtpPath(arg, "TO:")
+			if !ok {
+				respond(501, "5.5.4 syntax: RCPT TO:<address>")
+				continue
+			}
+			token, ok := s.replyToken(addr)
+			if !ok {
+				respond(550, "5.1.1 unknown recipient")
+				continue
+			}
+			tokens = append(tokens, token)
+			respond(250, "2.1.5 ok")
+		case "DATA":
+			if len(tokens) == 0 {
+				respond(503, "5.5.1 RCPT first")
+				continue
+			}
+			respond(354, "end data with <CR><LF>.<CR><LF>")
+			code, msg := s.receive(ctx, tp.DotReader(), tokens)
+			respond(code, msg)
+			mailFrom, tokens = false, nil
+		case "RSET":
+			mailFrom, tokens = false, nil
+			respond(250, "2.0.0 ok")
+		case "NOOP":
+			respond(250, "2.0.0 ok")
+		case "QUIT":
+			respond(221, "2.0.0 bye")
+			return
+		default:
+			respond(502, "5.5.2 command not implemented")
+		}
+	}
+}
+
+// receive reads the message and passes reply to Handler for each token, returns code and text of the smtp response
+func (s *EmailReplyServer) receive(ctx context.Context, r io.Reader, tokens []string) (code int, msg string) {
+	data, err := io.ReadAll(io.LimitReader(r, s.MaxSize+1))
+	if err != nil {
+		return 451, "4.3.0 can't read message"
+	}
+	if int64(len(data)) > s.MaxSize {
+		_, _ = io.Copy(io.Discard, r) // the rest of the message should be read before the response
+		return 552, "5.3.4 message too big"
+	}
+
+	m, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return 554, "5.6.0 can't parse message"
+	}
+	from, err := mail.ParseAddress(m.Header.Get("From"))
+	if err != nil {
+		return 554, "5.6.0 can't parse sender address"
+	}
+	// auto-replies, like vacation notices, accepted and dropped, rejection could make a loop of bounces
+	if auto := m.Header.Get("Auto-Submitted"); auto != "" && !strings.EqualFold(auto, "no") {
+		log.Printf("[INFO] auto-submitted email reply from %s dropped", from.Address)
+		return 250, "2.0.0 auto-reply dropped"
+	}
+	text, err := emailReplyText(m.Header, m.Body)
+	if err != nil {
+		log.Printf("[WARN] can't get text of the email reply from %s, %v", from.Address, err)
+		return 554, "5.6.0 " + smtpText(err.Error())
+	}
+
+	for _, token := range tokens {
+		if err = s.Handler(ctx, EmailReply{Token: token, From: from.Address, Text: text}); err != nil {
+			log.Printf("[WARN] email reply from %s rejected, %v", from.Address, err)
+			return 550, "5.7.1 reply rejected: " + smtpText(err.Error())
+		}
+	}
+	return 250, "2.0.0 reply accepted"
+}
+
+// replyToken returns token of the reply address made by EmailReplyAddress, false for any other address
+func (s *EmailReplyServer) replyToken(addr string) (string, bool) {
+	local, domain, _ := strings.Cut(s.ReplyAddress, "@")
+	addrLocal, addrDomain, ok := strings.Cut(addr, "@")
+	if !ok || !strings.EqualFold(addrDomain, domain) {
+		return "", false
+	}
+	prefix, token, ok := strings.Cut(addrLocal, "+")
+	if !ok || !strings.EqualFold(prefix, local) || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// smtpPath extracts address from "FROM:<address> [params]" argument of MAIL and RCPT commands
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	path, _, _ := strings.Cut(strings.TrimSpace(arg[len(prefix):]), " ")
+	if !strings.HasPrefix(path, "<") || !strings.HasSuffix(path, ">") {
+		return "", false
+	}
+	return path[1 : len(path)-1], true
+}
+
+// smtpText makes text safe to be sent in the smtp response line
+func smtpText(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// emailReplyText returns text of the reply from the body of the message with given headers, the plain text part
+// of multipart message, without quoted message and signature
+func emailReplyText(header mail.Header, body io.Reader) (string, error) {
+	text, err := emailPlainText(textproto.MIMEHeader(header), body)
+	if err != nil {
+		return "", err
+	}
+	if text = stripEmailQuote(text); text == "" {
+		return "", errors.New("empty reply")
+	}
+	return text, nil
+}
+
+// emailPlainText returns decoded text/plain content of the message part, looking into nested multipart parts
+func emailPlainText(header textproto.MIMEHeader, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain" // default content type of the message
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, e := mr.NextPart()
+			if errors.Is(e, io.EOF) {
+				return "", errors.New("no plain text in the message")
+			}
+			if e != nil {
+				return "", fmt.Errorf("can't read multipart message: %w", e)
+			}
+			if text, e := emailPlainText(part.Header, part); e == nil {
+				return text, nil
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", errors.New("no plain text in the message")
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineSkipper{r: body})
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("can't read message text: %w", err)
+	}
+	return string(data), nil
+}
+
+// stripEmailQuote removes the quoted message, with the attribution line before it, and the signature from the reply
+func stripEmailQuote(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	res := make([]string, 0, len(lines))
+	for _, l := range lines {
+		trimmed := strings.TrimSpace(l)
+		if strings.HasPrefix(trimmed, ">") || trimmed == "--" || strings.HasPrefix(trimmed, "-----Original Message") ||
+			strings.HasPrefix(trimmed, "________________") {
+			break
+		}
+		res = append(res, strings.TrimRight(l, " \t"))
+	}
+
+	last := func() string {
+		for len(res) > 0 && res[len(res)-1] == "" {
+			res = res[:len(res)-1]
+		}
+		if len(res) == 0 {
+			return ""
+		}
+		return strings.TrimSpace(res[len(res)-1])
+	}
+	// attribution line "On <date>, <name> wrote:" might be wrapped by the client
+	if l := last(); strings.HasSuffix(l, "wrote:") {
+		res = res[:len(res)-1]
+		if !strings.HasPrefix(l, "On ") && strings.HasPrefix(last(), "On ") {
+			res = res[:len(res)-1]
+		}
+	}
+	last()
+	return strings.TrimSpace(strings.Join(res, "\n"))
+}
+
+// newlineSkipper drops line breaks of base64 encoded content
+type newlineSkipper struct {
+	r io.Reader
+}
+
+func (n *newlineSkipper) Read(p []byte) (int, error) {
+	for {
+		cnt, err := n.r.Read(p)
+		res := p[:0]
+		for _, b := range p[:cnt] {
+			if b != '\r' && b != '\n' {
+				res = append(res, b)
+			}
+		}
+		if len(res) > 0 || err != nil {
+			return len(res), err
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmailReplyServer(t *testing.T) {
+	var mu sync.Mutex
+	var replies []EmailReply
+	srv := &EmailReplyServer{ReplyAddress: "reply@example.com", MaxSize: 2000, Handler: func(_ context.Context, reply EmailReply) error {
+		if reply.Token == "bad" {
+			return errors.New("unknown reply address\r\nsecond line")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		replies = append(replies, reply)
+		return nil
+	}}
+	addr := startEmailReplyServer(t, srv)
+
+	msg := "From: User <user@example.org>\r\nTo: reply+token1@example.com\r\nSubject: Re: New reply\r\n\r\n" +
+		"my answer\r\n\r\nOn Mon, 1 Jan 2024 at 10:00, Remark42 <reply+token1@example.com> wrote:\r\n> original\r\n"
+	require.NoError(t, smtp.SendMail(addr, nil, "user@example.org", []string{"Reply+Token1@Example.com"}, []byte(msg)))
+
+	err := smtp.SendMail(addr, nil, "user@example.org", []string{"other@example.com"}, []byte(msg))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `550 "5.1.1 unknown recipient"`)
+	err = smtp.SendMail(addr, nil, "user@example.org", []string{"reply+token1@other.com"}, []byte(msg))
+	require.Error(t, err, "other domain")
+
+	err = smtp.SendMail(addr, nil, "user@example.org", []string{"reply+bad@example.com"}, []byte(msg))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `550 "5.7.1 reply rejected: unknown reply address  second line"`)
+
+	err = smtp.SendMail(addr, nil, "user@example.org", []string{"reply+token2@example.com"},
+		[]byte("From: user@example.org\r\n\r\n"+strings.Repeat("long line of text\r\n", 200)))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `552 "5.3.4 message too big"`)
+
+	err = smtp.SendMail(addr, nil, "user@example.org", []string{"reply+token2@example.com"},
+		[]byte("From: user@example.org\r\n\r\n> quote only\r\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `554 "5.6.0 empty reply"`)
+
+	require.NoError(t, smtp.SendMail(addr, nil, "", []string{"reply+token2@example.com"},
+		[]byte("From: user@example.org\r\nAuto-Submitted: auto-replied\r\n\r\nI'm on vacation\r\n")), "auto-reply dropped")
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []EmailReply{{Token: "Token1", From: "user@example.org", Text: "my answer"}}, replies)
+}
+
+func TestEmailReplyServer_Commands(t *testing.T) {
+	srv := &EmailReplyServer{ReplyAddress: "reply@example.com", Handler: func(context.Context, EmailReply) error { return nil }}
+	addr := startEmailReplyServer(t, srv)
+
+	client, err := smtp.Dial(addr)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Hello("localhost"))
+	ok, size := client.Extension("SIZE")
+	assert.True(t, ok)
+	assert.Equal(t, "1048576", size)
+	assert.EqualError(t, client.Rcpt("reply+token@example.com"), `503 "5.5.1 MAIL first"`)
+	require.NoError(t, client.Noop())
+	_, err = client.Data()
+	assert.EqualError(t, err, `503 "5.5.1 RCPT first"`)
+	require.NoError(t, client.Mail("user@example.org"))
+	require.NoError(t, client.Rcpt("reply+token@example.com"))
+	require.NoError(t, client.Reset())
+	assert.EqualError(t, client.Rcpt("reply+token@example.com"), `503 "5.5.1 MAIL first"`, "transaction reset")
+	require.NoError(t, client.Quit())
+}
+
+func TestEmailReplyText(t *testing.T) {
+	tbl := []struct {
+		name, msg, text string
+	}{
+		{"plain", "Content-Type: text/plain\r\n\r\nline 1\r\nline 2  \r\n\r\n-- \r\nsignature\r\n", "line 1\nline 2"},
+		{"no content type", "\r\nreply\r\n\r\n> quote\r\nmore reply", "reply"},
+		{"wrapped attribution", "\r\nreply\r\n\r\nOn Mon, 1 Jan 2024 at 10:00, Remark42 <reply+token1@example.com>\r\nwrote:\r\n\r\n> quote", "reply"},
+		{"outlook", "\r\nreply\r\n\r\n-----Original Message-----\r\nFrom: remark42", "reply"},
+		{"quoted-printable", "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+			"=D0=BF=D1=80=D0=B8=D0=B2=D0=B5=D1=82 very long line which is soft=\r\n wrapped", "привет very long line which is soft wrapped"},
+		{"multipart", "Content-Type: multipart/alternative; boundary=\"b1\"\r\n\r\n" +
+			"--b1\r\nContent-Type: text/html\r\n\r\n<p>html reply</p>\r\n" +
+			"--b1\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\ncGxhaW4gcmVwbHkK\r\nPiBxdW90ZQ==\r\n--b1--\r\n",
+			"plain reply"},
+		{"nested multipart", "Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n" +
+			"--b1\r\nContent-Type: multipart/alternative; boundary=\"b2\"\r\n\r\n" +
+			"--b2\r\nContent-Type: text/plain\r\n\r\nnested reply\r\n--b2--\r\n" +
+			"--b1\r\nContent-Type: image/png\r\n\r\nxxx\r\n--b1--\r\n", "nested reply"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := mail.ReadMessage(strings.NewReader(tt.msg))
+			require.NoError(t, err)
+			text, err := emailReplyText(m.Header, m.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.text, text)
+		})
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader("Content-Type: text/html\r\n\r\n<p>html reply</p>"))
+	require.NoError(t, err)
+	_, err = emailReplyText(m.Header, m.Body)
+	assert.EqualError(t, err, "no plain text in the message")
+}
+
+func startEmailReplyServer(t *testing.T, srv *EmailReplyServer) string {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, srv.Serve(ctx, lst))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("email reply server not stopped")
+		}
+	})
+	return lst.Addr().String()
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"testing"
+	"time"
 
 	ntf "github.com/go-pkgz/notify"
 	"github.com/stretchr/testify/assert"
@@ -85,6 +86,15 @@ func Test_initTemplatesErr(t *testing.T) {
 				MsgTemplatePath:          "testdata/bad.html.tmpl",
 			},
 		},
+		{
+			name:    "with error on read digest template",
+			errText: "can't parse digest template: template: digestTmpl",
+			emailParams: EmailParams{
+				VerificationTemplatePath: "testdata/verification.html.tmpl",
+				MsgTemplatePath:          "testdata/msg.html.tmpl",
+				DigestTemplatePath:       "testdata/bad.html.tmpl",
+			},
+		},
 	}
 
 	for _, d := range testSet {
@@ -194,6 +204,116 @@ admin@example.org
 `, msg.body)
 	assert.Equal(t, `New comment to your site for "test_title"`, msg.subject)
 	assert.Empty(t, msg.unsubscribeLink)
+
+	// subscriber of the post gets the link to unsubscribe from the post, with own user id in the token
+	email.TokenGenFn = func(userID, email, site string) (string, error) { return userID + "-" + email + "-" + site, nil }
+	req = Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, PostTitle: "test_title",
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post?id=1"}},
+		Emails:     []string{"sub@example.org"},
+		PostEmails: map[string]string{"sub@example.org": "sub_user"},
+	}
+	msg, err = email.buildMessageFromRequest(req, req.Emails[0], false)
+	assert.NoError(t, err)
+	assert.Equal(t, `New comment for "test_title"`, msg.subject)
+	assert.Equal(t, "https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=sub_user-sub@example.org-remark"+
+		"&url=https%3A%2F%2Fexample.com%2Fpost%3Fid%3D1", msg.unsubscribeLink)
+}
+
+func TestEmail_Digest(t *testing.T) {
+	email, err := NewEmail(EmailParams{
+		From:                     "from@example.org",
+		VerificationTemplatePath: "testdata/verification.html.tmpl",
+		MsgTemplatePath:          "testdata/msg.html.tmpl",
+		DigestTemplatePath:       "testdata/digest.html.tmpl",
+		UnsubscribeURL:           "https://remark42.com/api/v1/email/unsubscribe",
+		TokenGenFn:               TokenGenFn,
+	}, ntf.SMTPParams{})
+	require.NoError(t, err)
+
+	parent := store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}}
+	reply := func(id, url, title string) Request {
+		return Request{
+			Comment: store.Comment{ID: id, ParentID: "1", User: store.User{ID: "1", Name: "user_" + id}, Text: "text " + id,
+				PostTitle: title, Locator: store.Locator{SiteID: "remark", URL: url}},
+			parent:       parent,
+			Emails:       []string{"digest@example.org"},
+			EmailDigests: map[string]string{"digest@example.org": EmailDigestHourly},
+		}
+	}
+	require.NoError(t, email.Send(context.Background(), reply("c1", "https://example.com/post1", "post 1")), "collected, not sent")
+	require.NoError(t, email.Send(context.Background(), reply("c2", "https://example.com/post2", "post 2")))
+	require.NoError(t, email.Send(context.Background(), reply("c3", "https://example.com/post1", "post 1")))
+	require.Len(t, email.digests, 1, "single digest for the recipient")
+
+	d := email.digests["remark::digest@example.org"]
+	require.NotNil(t, d)
+	msg, err := email.buildDigestMessage(*d)
+	require.NoError(t, err)
+	assert.Equal(t, "3 new replies to your comments", msg.subject)
+	assert.Equal(t, "https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token", msg.unsubscribeLink)
+	assert.Equal(t, `3 new replies, hourly
+Post: post 1 https://example.com/post1
+	user_c1 to parent_user: text c1 https://example.com/post1#remark42__comment-c1
+	user_c3 to parent_user: text c3 https://example.com/post1#remark42__comment-c3
+Post: post 2 https://example.com/post2
+	user_c2 to parent_user: text c2 https://example.com/post2#remark42__comment-c2
+digest@example.org
+Unsubscribe link: https://remark42.com/api/v1/email/unsubscribe?site=remark&amp;tkn=token
+`, msg.body, "replies grouped by post")
+
+	email.sendDigests(context.Background(), time.Now().Add(59*time.Minute), false)
+	assert.Len(t, email.digests, 1, "digest not due yet")
+	email.sendDigests(context.Background(), time.Now().Add(time.Hour), false)
+	assert.Empty(t, email.digests, "due digest sent, failed as smtp is not available")
+
+	// remaining digests sent on cancellation
+	require.NoError(t, email.Send(context.Background(), reply("c4", "https://example.com/post1", "post 1")))
+	d = email.digests["remark::digest@example.org"]
+	require.NotNil(t, d)
+	msg, err = email.buildDigestMessage(*d)
+	require.NoError(t, err)
+	assert.Equal(t, `New reply to your comment for "post 1"`, msg.subject)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	email.SendDigests(ctx)
+	assert.Empty(t, email.digests)
+
+	// unknown period means immediate notification
+	req := reply("c5", "https://example.com/post1", "post 1")
+	req.EmailDigests = map[string]string{"digest@example.org": "weekly"}
+	assert.Contains(t, email.Send(context.Background(), req).Error(), "problem sending user email notification to \"digest@example.org\"")
+	assert.Empty(t, email.digests)
+
+	req.parent.User.ID = "error"
+	req.EmailDigests = map[string]string{"digest@example.org": EmailDigestDaily}
+	assert.EqualError(t, email.Send(context.Background(), req), "problem adding email notification to \"digest@example.org\" digest: "+
+		"error creating token for unsubscribe link: token generation error")
+
+	// with digest store replies are passed to it and not kept in memory
+	ds := &digestStoreMock{}
+	email.UseDigestStore(ds)
+	require.NoError(t, email.Send(context.Background(), reply("c6", "https://example.com/post1", "post 1")))
+	assert.Empty(t, email.digests)
+	require.Len(t, ds.digests, 1)
+	assert.Equal(t, "remark", ds.digests[0].SiteID)
+	assert.Equal(t, "digest@example.org", ds.digests[0].Email)
+	assert.Equal(t, EmailDigestHourly, ds.digests[0].Period)
+	assert.Equal(t, "https://remark42.com/api/v1/email/unsubscribe?site=remark&tkn=token", ds.digests[0].UnsubscribeLink)
+	require.Len(t, ds.digests[0].Replies, 1)
+	assert.Equal(t, "c6", ds.digests[0].Replies[0].Comment.ID)
+	err = email.SendDigest(context.Background(), ds.digests[0])
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "problem sending hourly digest to \"digest@example.org\"")
+}
+
+type digestStoreMock struct {
+	digests []Digest
+}
+
+func (m *digestStoreMock) AddToDigest(d Digest) error {
+	m.digests = append(m.digests, d)
+	return nil
 }
 
 func TestEmail_CommentTextSanitizedForEmail(t *testing.T) {
@@ -287,6 +407,43 @@ Sent to test@example.org
 `)
 }
 
+func TestEmail_ReplyAddress(t *testing.T) {
+	email, err := NewEmail(EmailParams{From: "Remark42 <from@example.org>", MsgTemplatePath: "testdata/msg.html.tmpl",
+		TokenGenFn: TokenGenFn}, ntf.SMTPParams{})
+	require.NoError(t, err)
+	req := Request{
+		Comment: store.Comment{ID: "999", User: store.User{ID: "1", Name: "test_user"}, ParentID: "1",
+			Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post1"}},
+		parent:     store.Comment{ID: "1", User: store.User{ID: "999", Name: "parent_user"}},
+		Emails:     []string{"test@example.org", "sub@example.org"},
+		PostEmails: map[string]string{"sub@example.org": "sub_user"},
+	}
+	msg, err := email.buildMessageFromRequest(req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Empty(t, msg.from, "replies by email disabled")
+
+	email.ReplyAddress = "reply@example.com"
+	email.ReplyTokenFn = func(siteID, url, parentID, userID string) (string, error) {
+		if userID == "bad" {
+			return "", fmt.Errorf("token generation error")
+		}
+		return siteID + "-" + parentID + "-" + userID, nil
+	}
+	msg, err = email.buildMessageFromRequest(req, "test@example.org", false)
+	require.NoError(t, err)
+	assert.Equal(t, `"Remark42" <reply+remark-999-999@example.com>`, msg.from, "reply to the comment by its parent author")
+	msg, err = email.buildMessageFromRequest(req, "sub@example.org", false)
+	require.NoError(t, err)
+	assert.Equal(t, `"Remark42" <reply+remark-999-sub_user@example.com>`, msg.from, "reply by post subscriber")
+	msg, err = email.buildMessageFromRequest(req, "admin@example.org", true)
+	require.NoError(t, err)
+	assert.Empty(t, msg.from, "no replies by email for admin")
+
+	req.parent.User.ID = "bad"
+	_, err = email.buildMessageFromRequest(req, "test@example.org", false)
+	assert.EqualError(t, err, "error creating token for reply address: token generation error")
+}
+
 func TokenGenFn(user, _, _ string) (string, error) {
 	if user == "error" {
 		return "", fmt.Errorf("token generation error")
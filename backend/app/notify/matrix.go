@@ -0,0 +1,343 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// MatrixParams contain settings for matrix notifications
+type MatrixParams struct {
+	Server            string        // homeserver URL, i.e. https://matrix.org
+	Token             string        // access token of the bot user
+	AdminRoomID       string        // room id or alias for admin notifications, i.e. !roomid:matrix.org or #room:matrix.org
+	Timeout           time.Duration // http client timeout
+	UserNotifications bool          // flag which enables user notifications
+}
+
+// Matrix implements notify.Destination for matrix, using client-server API with access token of the bot user.
+// Admin notifications posted to the admin room, user notifications to the direct room of the bot with the user,
+// created on the first message and marked as direct in account data of the bot.
+type Matrix struct {
+	MatrixParams
+
+	client http.Client
+
+	rooms struct { // room id by user id for direct rooms and by alias for aliases
+		sync.Mutex
+		data map[string]string
+	}
+	requests struct { // pending matrix id verification requests by token
+		sync.Mutex
+		data map[string]matrixRequest
+	}
+}
+
+// matrixRequest is a request to set matrix id of the user, confirmed by the token sent to this matrix id
+type matrixRequest struct {
+	user, site, address string
+	expires             time.Time
+}
+
+// matrixMessage is the content of m.room.message event with html body
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+const matrixAPIPrefix = "/_matrix/client/v3"
+
+// NewMatrix makes matrix notifications destination
+func NewMatrix(params MatrixParams) (*Matrix, error) {
+	if params.Server == "" || params.Token == "" {
+		return nil, errors.New("matrix server and access token are required")
+	}
+	if params.AdminRoomID == "" && !params.UserNotifications {
+		return nil, errors.New("matrix admin room is required without user notifications")
+	}
+	if params.Timeout == 0 {
+		params.Timeout = time.Second * 5
+	}
+	params.Server = strings.TrimSuffix(params.Server, "/")
+
+	res := &Matrix{MatrixParams: params, client: http.Client{Timeout: params.Timeout}}
+	res.rooms.data = map[string]string{}
+	res.requests.data = map[string]matrixRequest{}
+	log.Printf("[DEBUG] create new matrix notifier for %s", res.Server)
+	return res, nil
+}
+
+// Send to matrix admin room and to direct rooms of users
+func (m *Matrix) Send(ctx context.Context, req Request) error {
+	log.Printf("[DEBUG] send matrix notification for comment ID %s", req.Comment.ID)
+	msg := m.buildMessage(req)
+
+	var recipients []string
+	if m.AdminRoomID != "" {
+		recipients = append(recipients, adminRecipient+m.AdminRoomID)
+	}
+	if m.UserNotifications {
+		recipients = append(recipients, req.MatrixIDs...)
+	}
+	return sendAll(req, recipients, func(recipient string) error {
+		if room, ok := strings.CutPrefix(recipient, adminRecipient); ok {
+			if err := m.sendToRoom(ctx, room, msg); err != nil {
+				return fmt.Errorf("problem sending admin matrix notification about comment ID %s to %s: %w", req.Comment.ID, room, err)
+			}
+			return nil
+		}
+		if err := m.sendToUser(ctx, recipient, msg); err != nil {
+			return fmt.Errorf("problem sending user matrix notification about comment ID %s to %q: %w", req.Comment.ID, recipient, err)
+		}
+		return nil
+	})
+}
+
+// SendVerification sends verification token to VerificationRequest.Matrix if it's set
+func (m *Matrix) SendVerification(ctx context.Context, req VerificationRequest) error {
+	if req.Matrix == "" {
+		// this means we can't send this request via Matrix
+		return nil
+	}
+	log.Printf("[DEBUG] send verification via %s, user %s", m, req.User)
+	text := fmt.Sprintf("Confirmation for %s on site %s, enter the token to finish the subscription: %s", req.User, req.SiteID, req.Token)
+	msg := matrixMessage{MsgType: "m.notice", Body: text, Format: "org.matrix.custom.html",
+		FormattedBody: fmt.Sprintf("Confirmation for <b>%s</b> on site <b>%s</b>, enter the token to finish the subscription:<br><code>%s</code>",
+			html.EscapeString(req.User), html.EscapeString(req.SiteID), html.EscapeString(req.Token))}
+	if err := m.sendToUser(ctx, req.Matrix, msg); err != nil {
+		return fmt.Errorf("problem sending matrix verification to %q: %w", req.Matrix, err)
+	}
+	return nil
+}
+
+// AddToken adds token of the request to set matrix id of the user, sent to this matrix id with SendVerification
+func (m *Matrix) AddToken(token, user, site, address string, expires time.Time) {
+	m.requests.Lock()
+	defer m.requests.Unlock()
+	for tkn, r := range m.requests.data { // clean expired requests
+		if time.Now().After(r.expires) {
+			delete(m.requests.data, tkn)
+		}
+	}
+	m.requests.data[token] = matrixRequest{user: user, site: site, address: address, expires: expires}
+}
+
+// CheckToken verifies the token received by the user, returns matrix id and site of the request
+func (m *Matrix) CheckToken(token, user string) (address, site string, err error) {
+	// lookup and consumption are a single transaction, so the one-time token can't be used twice
+	m.requests.Lock()
+	defer m.requests.Unlock()
+
+	r, ok := m.requests.data[token]
+	if !ok {
+		return "", "", errors.New("request is not found")
+	}
+	if time.Now().After(r.expires) {
+		delete(m.requests.data, token)
+		return "", "", errors.New("request expired")
+	}
+	if r.user != user {
+		return "", "", errors.New("user does not match original requester")
+	}
+	delete(m.requests.data, token)
+	return r.address, r.site, nil
+}
+
+func (m *Matrix) String() string {
+	result := "matrix notifications destination for " + m.Server
+	if m.AdminRoomID != "" {
+		result += " with admin notifications to " + m.AdminRoomID
+	}
+	if m.UserNotifications {
+		result += " with user notifications enabled"
+	}
+	return result
+}
+
+// buildMessage generates message for generic notification about new comment, html formatted with plain text fallback
+func (m *Matrix) buildMessage(req Request) matrixMessage {
+	commentURLPrefix := req.Comment.Locator.URL + uiNav
+
+	body := req.Comment.User.Name
+	msg := fmt.Sprintf(`<a href=%q>%s</a>`, commentURLPrefix+req.Comment.ID, html.EscapeString(req.Comment.User.Name))
+	if req.Comment.ParentID != "" {
+		body += " → " + req.parent.User.Name
+		msg += fmt.Sprintf(` → <a href=%q>%s</a>`, commentURLPrefix+req.parent.ID, html.EscapeString(req.parent.User.Name))
+	}
+
+	orig := []rune(req.Comment.Orig)
+	if len(orig) > commentTextLengthLimit {
+		orig = append(orig[:commentTextLengthLimit], []rune("...")...)
+	}
+	body += "\n\n" + string(orig) + "\n\n" + commentURLPrefix + req.Comment.ID
+	msg += "<br><br>" + pruneHTML(req.Comment.Text, commentTextLengthLimit)
+
+	if req.Comment.ParentID != "" {
+		msg += fmt.Sprintf("<blockquote>%s</blockquote>", pruneHTML(req.parent.Text, commentTextLengthLimit))
+	}
+
+	if req.Comment.PostTitle != "" {
+		msg += fmt.Sprintf(`<br>↦  <a href=%q>%s</a>`, req.Comment.Locator.URL, html.EscapeString(req.Comment.PostTitle))
+	}
+
+	return matrixMessage{MsgType: "m.notice", Body: body, Format: "org.matrix.custom.html", FormattedBody: msg}
+}
+
+// sendToRoom sends message to the room with given id or alias
+func (m *Matrix) sendToRoom(ctx context.Context, room string, msg matrixMessage) error {
+	roomID, err := m.roomID(ctx, room)
+	if err != nil {
+		return err
+	}
+	// transaction id is made from the room and message, so the homeserver doesn't post the message again
+	// on retry of delivery which was sent by the previous attempt, but failed for other recipient or without response
+	h := sha256.New()
+	for _, s := range []string{roomID, msg.MsgType, msg.Body, msg.FormattedBody} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	txnID := "remark42-" + hex.EncodeToString(h.Sum(nil)[:16])
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(roomID), url.PathEscape(txnID))
+	return m.request(ctx, http.MethodPut, path, msg, nil)
+}
+
+// sendToUser sends message to the direct room of the bot with the user
+func (m *Matrix) sendToUser(ctx context.Context, userID string, msg matrixMessage) error {
+	roomID, err := m.directRoom(ctx, userID)
+	if err != nil {
+		return err
+	}
+	return m.sendToRoom(ctx, roomID, msg)
+}
+
+// roomID returns room id for room alias, resolved once, and the room itself for room id
+func (m *Matrix) roomID(ctx context.Context, room string) (string, error) {
+	if !strings.HasPrefix(room, "#") {
+		return room, nil
+	}
+	m.rooms.Lock()
+	defer m.rooms.Unlock()
+	if id, ok := m.rooms.data[room]; ok {
+		return id, nil
+	}
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := m.request(ctx, http.MethodGet, "/directory/room/"+url.PathEscape(room), nil, &resp); err != nil {
+		return "", fmt.Errorf("can't resolve room alias %s: %w", room, err)
+	}
+	m.rooms.data[room] = resp.RoomID
+	return resp.RoomID, nil
+}
+
+// directRoom returns id of the direct room with the user, from m.direct account data of the bot.
+// Room is created, with the user invited, and added to m.direct if not found.
+func (m *Matrix) directRoom(ctx context.Context, userID string) (string, error) {
+	m.rooms.Lock()
+	defer m.rooms.Unlock()
+	if id, ok := m.rooms.data[userID]; ok {
+		return id, nil
+	}
+
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := m.request(ctx, http.MethodGet, "/account/whoami", nil, &whoami); err != nil {
+		return "", fmt.Errorf("can't get matrix bot user: %w", err)
+	}
+	directPath := fmt.Sprintf("/user/%s/account_data/m.direct", url.PathEscape(whoami.UserID))
+	direct := map[string][]string{}
+	var apiErr *matrixError
+	if err := m.request(ctx, http.MethodGet, directPath, nil, &direct); err != nil &&
+		(!errors.As(err, &apiErr) || apiErr.Code != "M_NOT_FOUND") {
+		return "", fmt.Errorf("can't get direct rooms: %w", err)
+	}
+	if rooms := direct[userID]; len(rooms) > 0 {
+		m.rooms.data[userID] = rooms[len(rooms)-1]
+		return rooms[len(rooms)-1], nil
+	}
+
+	createReq := struct {
+		Preset   string   `json:"preset"`
+		IsDirect bool     `json:"is_direct"`
+		Invite   []string `json:"invite"`
+	}{Preset: "trusted_private_chat", IsDirect: true, Invite: []string{userID}}
+	var created struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := m.request(ctx, http.MethodPost, "/createRoom", createReq, &created); err != nil {
+		return "", fmt.Errorf("can't create direct room: %w", err)
+	}
+	direct[userID] = append(direct[userID], created.RoomID)
+	if err := m.request(ctx, http.MethodPut, directPath, direct, nil); err != nil {
+		// the room is usable anyway, it will be created again after restart
+		log.Printf("[WARN] can't mark matrix room %s as direct with %s, %v", created.RoomID, userID, err)
+	}
+	m.rooms.data[userID] = created.RoomID
+	return created.RoomID, nil
+}
+
+// matrixError is the error response of the matrix API
+type matrixError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("matrix API error %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// request makes request to matrix client-server API with json body, decoding json response into the result
+func (m *Matrix) request(ctx context.Context, method, path string, body, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("can't marshal request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, m.Server+matrixAPIPrefix+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("can't make request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+m.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := matrixError{Status: resp.StatusCode}
+		if err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&apiErr); err != nil {
+			apiErr.Message = "unexpected response"
+		}
+		return &apiErr
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("can't decode response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestMatrix_New(t *testing.T) {
+	_, err := NewMatrix(MatrixParams{Server: "https://matrix.example.com"})
+	assert.EqualError(t, err, "matrix server and access token are required")
+	_, err = NewMatrix(MatrixParams{Server: "https://matrix.example.com", Token: "tkn"})
+	assert.EqualError(t, err, "matrix admin room is required without user notifications")
+
+	m, err := NewMatrix(MatrixParams{Server: "https://matrix.example.com/", Token: "tkn", AdminRoomID: "#admin:example.com",
+		UserNotifications: true})
+	require.NoError(t, err)
+	assert.Equal(t, "https://matrix.example.com", m.Server)
+	assert.Equal(t, 5*time.Second, m.client.Timeout)
+	assert.Equal(t, "matrix notifications destination for https://matrix.example.com with admin notifications to "+
+		"#admin:example.com with user notifications enabled", m.String())
+}
+
+func TestMatrix_Send(t *testing.T) {
+	ts, sent := mockMatrixServer(t)
+	m, err := NewMatrix(MatrixParams{Server: ts.URL, Token: "tkn", AdminRoomID: "#admin:example.com", UserNotifications: true})
+	require.NoError(t, err)
+
+	c := store.Comment{ID: "999", ParentID: "1", Text: "<p>some <b>text</b></p>", Orig: "some **text**", PostTitle: "[test title]",
+		Locator: store.Locator{URL: "http://example.org/"}, User: store.User{Name: "from"}}
+	cp := store.Comment{ID: "1", Text: "<p>parent & text</p>", User: store.User{Name: "<to>"}}
+	req := Request{Comment: c, parent: cp, MatrixIDs: []string{"@known:example.com", "@new:example.com"}}
+	require.NoError(t, m.Send(context.Background(), req))
+	require.NoError(t, m.Send(context.Background(), req), "rooms are cached")
+
+	msgs := sent()
+	require.Len(t, msgs, 6)
+	assert.Equal(t, "!admin:example.com", msgs[0].room)
+	assert.Equal(t, "!known:example.com", msgs[1].room, "existing direct room used")
+	assert.Equal(t, "!created:example.com", msgs[2].room, "direct room created")
+	assert.Equal(t, []string{"!admin:example.com", "!known:example.com", "!created:example.com"},
+		[]string{msgs[3].room, msgs[4].room, msgs[5].room})
+	assert.Equal(t, msgs[0].txn, msgs[3].txn, "the same transaction for the same message to the room")
+	assert.NotEqual(t, msgs[0].txn, msgs[1].txn)
+	assert.Equal(t, matrixMessage{MsgType: "m.notice", Format: "org.matrix.custom.html",
+		Body: "from → <to>\n\nsome **text**\n\nhttp://example.org/#remark42__comment-999",
+		FormattedBody: `<a href="http://example.org/#remark42__comment-999">from</a> → ` +
+			`<a href="http://example.org/#remark42__comment-1">&lt;to&gt;</a><br><br><p>some <b>text</b></p>` +
+			`<blockquote><p>parent &amp; text</p></blockquote><br>↦  <a href="http://example.org/">[test title]</a>`}, msgs[0].msg)
+
+	err = m.Send(context.Background(), Request{Comment: c, parent: cp, MatrixIDs: []string{"@bad:example.com"}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `problem sending user matrix notification about comment ID 999 to "@bad:example.com": `+
+		"can't create direct room: matrix API error 403 M_FORBIDDEN: can't invite")
+	var partialErr *PartialError
+	require.ErrorAs(t, err, &partialErr)
+	assert.Equal(t, []string{"admin:#admin:example.com"}, partialErr.Sent)
+	require.Len(t, sent(), 7)
+	err = m.Send(context.Background(), Request{Comment: c, parent: cp, MatrixIDs: []string{"@bad:example.com"}, Sent: partialErr.Sent})
+	require.Error(t, err)
+	assert.Len(t, sent(), 7, "admin room not notified again")
+
+	m.UserNotifications = false
+	require.NoError(t, m.Send(context.Background(), Request{Comment: c, parent: cp, MatrixIDs: []string{"@bad:example.com"}}))
+	m.AdminRoomID = "#unknown:example.com"
+	err = m.Send(context.Background(), Request{Comment: c, parent: cp})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "can't resolve room alias #unknown:example.com: matrix API error 404 M_NOT_FOUND: room alias not found")
+}
+
+func TestMatrix_Verification(t *testing.T) {
+	ts, sent := mockMatrixServer(t)
+	m, err := NewMatrix(MatrixParams{Server: ts.URL, Token: "tkn", UserNotifications: true})
+	require.NoError(t, err)
+
+	require.NoError(t, m.SendVerification(context.Background(), VerificationRequest{SiteID: "remark", User: "user1", Email: "u@example.com"}),
+		"not a matrix verification")
+	require.NoError(t, m.SendVerification(context.Background(), VerificationRequest{SiteID: "remark", User: "user1",
+		Matrix: "@known:example.com", Token: "secret"}))
+	msgs := sent()
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "!known:example.com", msgs[0].room)
+	assert.Equal(t, "Confirmation for user1 on site remark, enter the token to finish the subscription: secret", msgs[0].msg.Body)
+
+	m.AddToken("secret", "u1", "remark", "@known:example.com", time.Now().Add(time.Minute))
+	m.AddToken("expired", "u1", "remark", "@known:example.com", time.Now().Add(-time.Minute))
+	_, _, err = m.CheckToken("expired", "u1")
+	assert.EqualError(t, err, "request expired")
+	_, _, err = m.CheckToken("secret", "u2")
+	assert.EqualError(t, err, "user does not match original requester")
+	address, site, err := m.CheckToken("secret", "u1")
+	require.NoError(t, err)
+	assert.Equal(t, "@known:example.com", address)
+	assert.Equal(t, "remark", site)
+	_, _, err = m.CheckToken("secret", "u1")
+	assert.EqualError(t, err, "request is not found", "token can't be used twice")
+}
+
+type matrixSent struct {
+	room string
+	txn  string
+	msg  matrixMessage
+}
+
+// mockMatrixServer emulates matrix API with admin room alias, bot with direct room for @known:example.com
+// and user @bad:example.com which can't be invited
+func mockMatrixServer(t *testing.T) (ts *httptest.Server, sent func() []matrixSent) {
+	var mu sync.Mutex
+	var msgs []matrixSent
+	direct := map[string][]string{"@known:example.com": {"!old:example.com", "!known:example.com"}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /_matrix/client/v3/directory/room/{alias}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("alias") != "#admin:example.com" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND","error":"room alias not found"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"room_id":"!admin:example.com"}`))
+	})
+	mux.HandleFunc("GET /_matrix/client/v3/account/whoami", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"user_id":"@bot:example.com"}`))
+	})
+	mux.HandleFunc("/_matrix/client/v3/user/@bot:example.com/account_data/m.direct", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPut {
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&direct))
+		}
+		_ = json.NewEncoder(w).Encode(direct)
+	})
+	mux.HandleFunc("POST /_matrix/client/v3/createRoom", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			IsDirect bool     `json:"is_direct"`
+			Invite   []string `json:"invite"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.True(t, req.IsDirect)
+		if req.Invite[0] == "@bad:example.com" {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"can't invite"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"room_id":"!created:example.com"}`))
+	})
+	mux.HandleFunc("PUT /_matrix/client/v3/rooms/{room}/send/m.room.message/{txn}", func(w http.ResponseWriter, r *http.Request) {
+		assert.NotEmpty(t, r.PathValue("txn"))
+		var msg matrixMessage
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		mu.Lock()
+		msgs = append(msgs, matrixSent{room: r.PathValue("room"), txn: r.PathValue("txn"), msg: msg})
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"event_id":"$event"}`))
+	})
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tkn" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []matrixSent {
+		mu.Lock()
+		defer mu.Unlock()
+		return msgs
+	}
+}
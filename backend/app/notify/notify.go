@@ -3,13 +3,20 @@ package notify
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/subscription"
 )
 
 // Service delivers notifications to multiple destinations
@@ -18,6 +25,11 @@ type Service struct {
 	destinations      []Destination
 	queue             chan Request
 	verificationQueue chan VerificationRequest
+	outbox            *Outbox
+	destinationKeys   []string      // names of destinations in the outbox, same order as destinations
+	digestKey         string        // name of destination sending digests collected in the outbox, "email" if none
+	outboxWake        chan struct{} // wakes up outbox sender on submit and replay
+	outboxDone        chan struct{} // closed on termination of outbox sender
 
 	closed atomic.Uint32 // non-zero means closed. uses uint instead of bool for atomic
 	ctx    context.Context
@@ -31,22 +43,89 @@ type Destination interface {
 	SendVerification(context.Context, VerificationRequest) error
 }
 
+// digestSender is implemented by destinations collecting replies into digests, like email
+type digestSender interface {
+	UseDigestStore(ds DigestStore)
+	SendDigest(ctx context.Context, d Digest) error
+}
+
 // Store defines the minimal interface accessing stored comments used by notifier
 type Store interface {
 	Get(locator store.Locator, id string, user store.User) (store.Comment, error)
 	GetUserEmail(siteID, userID string) (string, error)
 	GetUserTelegram(siteID, userID string) (string, error)
+	GetUserEmailDigest(siteID, userID string) (string, error)
+	GetUserMatrix(siteID, userID string) (string, error)
+	GetUserWebPush(siteID, userID string) (string, error)
+	PostSubscriptions(locator store.Locator) ([]subscription.Subscription, error)
 }
 
-// used for email and telegram retrieval from user details
+// used for email, telegram, matrix and web push retrieval from user details
 type getUserDetail func(string, string) (string, error)
 
+// Event is a type of the change notification is made for
+type Event string
+
+// enum of all events
+const (
+	EventCreate   Event = "create"
+	EventEdit     Event = "edit"
+	EventDelete   Event = "delete"
+	EventVote     Event = "vote"
+	EventBlock    Event = "block"
+	EventPin      Event = "pin"
+	EventReadOnly Event = "readonly"
+)
+
+// Events lists all supported events
+var Events = []Event{EventCreate, EventEdit, EventDelete, EventVote, EventBlock, EventPin, EventReadOnly}
+
+// eventDestination is implemented by destinations interested in events other than new comment,
+// the rest of destinations get new comments only
+type eventDestination interface {
+	Accepts(req Request) bool
+}
+
+// keyedDestination is implemented by destinations which can be configured more than once, i.e. webhooks.
+// Key identifies the destination in the outbox, so it should depend on the destination config only
+type keyedDestination interface {
+	Key() string
+}
+
+// PartialError is returned by Send of destination which notified some of the request recipients only.
+// Outbox retries such delivery for the rest of recipients, adding the notified ones to Request.Sent
+type PartialError struct {
+	Sent []string // recipients notified successfully, i.e. email addresses
+	Err  error
+}
+
+func (e *PartialError) Error() string { return e.Err.Error() }
+
+func (e *PartialError) Unwrap() error { return e.Err }
+
 // Request notification for a Comment
 type Request struct {
-	Comment   store.Comment
-	parent    store.Comment
-	Emails    []string
-	Telegrams []string
+	Event        Event // type of the event, new comment if empty
+	Comment      store.Comment
+	parent       store.Comment
+	Emails       []string
+	EmailDigests map[string]string // digest period by email, for Emails recipients preferring digest
+	PostEmails   map[string]string // user id by email, for Emails recipients subscribed to the post
+	Telegrams    []string
+	MatrixIDs    []string
+	WebPushes    []string   // web push subscriptions of users, json list per user
+	User         store.User // user blocked or unblocked, for EventBlock
+	Vote         int        // +1 or -1, for EventVote
+	ReadOnly     bool       // read-only status of the post in Comment.Locator, for EventReadOnly
+	Sent         []string   // recipients notified by previous attempts of the delivery, skipped by destination
+}
+
+// event returns type of the event of request, EventCreate for empty one
+func (r Request) event() Event {
+	if r.Event == "" {
+		return EventCreate
+	}
+	return r.Event
 }
 
 // VerificationRequest notification for user
@@ -54,12 +133,22 @@ type VerificationRequest struct {
 	SiteID string
 	User   string
 	Email  string // if set, send email only
+	Matrix string // if set, send matrix message only
 	Token  string
 }
 
 const defaultQueueSize = 100
 const uiNav = "#remark42__comment-"
 
+// adminRecipient is the prefix of admin recipients of destination in Request.Sent, i.e. "admin:admin@example.com"
+const adminRecipient = "admin:"
+
+// outboxMaxWait is the max wait of outbox sender between checks of due deliveries
+const outboxMaxWait = time.Minute
+
+// ErrNoOutbox returned by Deliveries and Replay of the service without outbox
+var ErrNoOutbox = errors.New("notification outbox disabled")
+
 // NewService makes notification service routing comments to all destinations.
 func NewService(dataService Store, size int, destinations ...Destination) *Service {
 	if size <= 0 {
@@ -81,21 +170,65 @@ func NewService(dataService Store, size int, destinations ...Destination) *Servi
 	return &res
 }
 
+// NewServiceWithOutbox makes notification service routing comments to all destinations via persistent outbox.
+// Requests are kept in the outbox until sent, failed sends retried according to the outbox params.
+// Service owns the outbox and closes it on Close.
+func NewServiceWithOutbox(dataService Store, outbox *Outbox, destinations ...Destination) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+	res := Service{
+		dataService:     dataService,
+		destinations:    destinations,
+		outbox:          outbox,
+		destinationKeys: destinationKeys(destinations),
+		outboxWake:      make(chan struct{}, 1),
+		outboxDone:      make(chan struct{}),
+		digestKey:       "email", // digests left from previous run without email go to dead letters
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+	for i, dest := range destinations {
+		if ds, ok := dest.(digestSender); ok {
+			ds.UseDigestStore(outbox)
+			res.digestKey = res.destinationKeys[i]
+			break
+		}
+	}
+	go res.doOutbox()
+	log.Printf("[INFO] create notifier service with outbox, attempts=%d, delay=%v, destinations=%d",
+		outbox.Attempts, outbox.Delay, len(destinations))
+	return &res
+}
+
 // Submit Request to internal channel if not busy, drop if can't send
 func (s *Service) Submit(req Request) {
 	if len(s.destinations) == 0 || s.closed.Load() != 0 {
 		return
 	}
-	if s.dataService != nil && req.Comment.ParentID != "" {
-		if p, err := s.dataService.Get(req.Comment.Locator, req.Comment.ParentID, store.User{}); err == nil {
-			req.parent = p
-			req.Emails = s.getNotificationTargets(req, p, s.dataService.GetUserEmail)
-			req.Telegrams = s.getNotificationTargets(req, p, s.dataService.GetUserTelegram)
+	if s.dataService != nil && req.event() == EventCreate {
+		digests := map[string]string{}
+		if req.Comment.ParentID != "" {
+			if p, err := s.dataService.Get(req.Comment.Locator, req.Comment.ParentID, store.User{}); err == nil {
+				req.parent = p
+				req.Emails = s.getNotificationTargets(req, p, s.emailWithDigest(digests))
+				req.Telegrams = s.getNotificationTargets(req, p, s.dataService.GetUserTelegram)
+				req.MatrixIDs = s.getNotificationTargets(req, p, s.dataService.GetUserMatrix)
+				req.WebPushes = s.getNotificationTargets(req, p, s.dataService.GetUserWebPush)
+			}
+		}
+		s.addPostSubscribers(&req, digests)
+		if len(digests) > 0 {
+			req.EmailDigests = digests
 		}
 	}
+	if s.outbox != nil {
+		s.addDeliveries("notification", Delivery{SiteID: req.Comment.Locator.SiteID, Request: &req})
+		return
+	}
 	select {
 	case s.queue <- req:
+		queueSize.WithLabelValues("notification").Set(float64(len(s.queue)))
 	default:
+		droppedCounter.WithLabelValues("notification").Inc()
 		log.Printf("[WARN] can't send notification to queue, %+v", req.Comment)
 	}
 }
@@ -128,20 +261,113 @@ func (s *Service) getNotificationTargets(
 	return deduplicateStrings(result)
 }
 
+// addPostSubscribers adds subscribers of the post to the request targets, except for the comment author
+// and ones already notified as authors of parent comments
+func (s *Service) addPostSubscribers(req *Request, digests map[string]string) {
+	subs, err := s.dataService.PostSubscriptions(req.Comment.Locator)
+	if err != nil {
+		log.Printf("[WARN] can't read subscriptions to %s, %v", req.Comment.Locator.URL, err)
+		return
+	}
+	for _, sub := range subs {
+		if sub.UserID == req.Comment.User.ID {
+			continue
+		}
+		if sub.Email != "" && !slices.Contains(req.Emails, sub.Email) {
+			if req.PostEmails == nil {
+				req.PostEmails = map[string]string{}
+			}
+			req.Emails = append(req.Emails, sub.Email)
+			req.PostEmails[sub.Email] = sub.UserID
+			if period := s.emailDigest(req.Comment.Locator.SiteID, sub.UserID); period != "" {
+				digests[sub.Email] = period
+			}
+		}
+		if sub.Telegram != "" && !slices.Contains(req.Telegrams, sub.Telegram) {
+			req.Telegrams = append(req.Telegrams, sub.Telegram)
+		}
+	}
+}
+
+// emailWithDigest returns getUserDetail for emails, which also records digest period of users preferring digest
+func (s *Service) emailWithDigest(digests map[string]string) getUserDetail {
+	return func(siteID, userID string) (string, error) {
+		email, err := s.dataService.GetUserEmail(siteID, userID)
+		if err != nil || email == "" {
+			return email, err
+		}
+		if period := s.emailDigest(siteID, userID); period != "" {
+			digests[email] = period
+		}
+		return email, nil
+	}
+}
+
+// emailDigest returns email digest period of the user, empty for immediate notifications
+func (s *Service) emailDigest(siteID, userID string) string {
+	period, err := s.dataService.GetUserEmailDigest(siteID, userID)
+	if err != nil {
+		log.Printf("[WARN] can't read email digest for %s, %v", userID, err)
+	}
+	return period
+}
+
 // SubmitVerification to internal channel if not busy, drop if can't send
 func (s *Service) SubmitVerification(req VerificationRequest) {
 	if len(s.destinations) == 0 || s.closed.Load() != 0 {
 		return
 	}
+	if s.outbox != nil {
+		s.addDeliveries("verification", Delivery{SiteID: req.SiteID, Verification: &req})
+		return
+	}
 	select {
 	case s.verificationQueue <- req:
+		queueSize.WithLabelValues("verification").Set(float64(len(s.verificationQueue)))
 	default:
+		droppedCounter.WithLabelValues("verification").Inc()
 		log.Printf("[WARN] can't send verification to queue, %s for %s", req.User, req.Email)
 	}
 }
 
+// Deliveries returns retrying deliveries and dead letters of the site from the outbox
+func (s *Service) Deliveries(siteID string) (retrying, dead []Delivery, err error) {
+	if s.outbox == nil {
+		return nil, nil, ErrNoOutbox
+	}
+	return s.outbox.List(siteID)
+}
+
+// Replay sends dead letters and retrying deliveries of the site from the outbox again, all of them for empty id.
+// Returns number of replayed deliveries.
+func (s *Service) Replay(siteID, id string) (int, error) {
+	if s.outbox == nil {
+		return 0, ErrNoOutbox
+	}
+	count, err := s.outbox.Replay(siteID, id)
+	if err != nil {
+		return 0, fmt.Errorf("can't replay deliveries: %w", err)
+	}
+	if count > 0 {
+		s.wakeOutbox()
+	}
+	return count, nil
+}
+
 // Close queue channel and wait for completion
 func (s *Service) Close() {
+	if s.outbox != nil {
+		if !s.closed.CompareAndSwap(0, 1) {
+			return // already closed
+		}
+		log.Print("[DEBUG] close notifier")
+		s.cancel()
+		<-s.outboxDone
+		if err := s.outbox.Close(); err != nil {
+			log.Printf("[WARN] failed to close notification outbox, %v", err)
+		}
+		return
+	}
 	if s.queue != nil {
 		// don't panic in case service is already closed
 		select {
@@ -167,10 +393,15 @@ func (s *Service) do() {
 			if !ok {
 				return
 			}
-			wg.Add(len(s.destinations))
+			queueSize.WithLabelValues("notification").Set(float64(len(s.queue)))
 			for _, dest := range s.destinations {
+				if !accepts(dest, c) {
+					continue
+				}
+				wg.Add(1)
 				go func(d Destination) {
 					if err := d.Send(s.ctx, c); err != nil {
+						sendErrCounter.WithLabelValues(destinationName(d)).Inc()
 						log.Printf("[WARN] failed to send to %s, %s", d, err)
 					}
 					wg.Done()
@@ -181,10 +412,12 @@ func (s *Service) do() {
 			if !ok {
 				return
 			}
+			queueSize.WithLabelValues("verification").Set(float64(len(s.verificationQueue)))
 			wg.Add(len(s.destinations))
 			for _, dest := range s.destinations {
 				go func(d Destination) {
 					if err := d.SendVerification(s.ctx, v); err != nil {
+						sendErrCounter.WithLabelValues(destinationName(d)).Inc()
 						log.Printf("[WARN] failed to send to %s, %s", d, err)
 					}
 					wg.Done()
@@ -197,9 +430,216 @@ func (s *Service) do() {
 	}
 }
 
+// addDeliveries puts the delivery to the outbox for each destination accepting it and wakes up outbox sender
+func (s *Service) addDeliveries(kind string, delivery Delivery) {
+	deliveries := make([]Delivery, 0, len(s.destinationKeys))
+	for i, key := range s.destinationKeys {
+		if delivery.Request != nil && !accepts(s.destinations[i], *delivery.Request) {
+			continue
+		}
+		d := delivery
+		d.Destination = key
+		deliveries = append(deliveries, d)
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	if err := s.outbox.Add(deliveries...); err != nil {
+		droppedCounter.WithLabelValues(kind).Inc()
+		log.Printf("[WARN] can't add %s to outbox, %v", kind, err)
+		return
+	}
+	s.wakeOutbox()
+}
+
+func (s *Service) wakeOutbox() {
+	select {
+	case s.outboxWake <- struct{}{}:
+	default: // already woken up
+	}
+}
+
+// doOutbox sends due deliveries from the outbox, waking up on submit, on the time of the next retry and on close
+func (s *Service) doOutbox() {
+	defer close(s.outboxDone)
+	defer log.Print("[WARN] terminated notifier")
+	destinations := make(map[string]Destination, len(s.destinations))
+	for i, key := range s.destinationKeys {
+		destinations[key] = s.destinations[i]
+	}
+	for {
+		s.sendDue(destinations)
+
+		wait := outboxMaxWait
+		next, ok, err := s.outbox.Next()
+		if err != nil {
+			log.Printf("[WARN] can't get next delivery from outbox, %v", err)
+		}
+		if ok {
+			wait = max(min(time.Until(next), wait), 10*time.Millisecond)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		case <-s.outboxWake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// sendDue sends due deliveries from the outbox, in parallel for destinations and in order of submit for each of them
+func (s *Service) sendDue(destinations map[string]Destination) {
+	if _, err := s.outbox.ScheduleDigests(time.Now(), s.digestKey); err != nil {
+		log.Printf("[WARN] can't schedule digests in outbox, %v", err)
+	}
+	due, err := s.outbox.Due(time.Now())
+	if err != nil {
+		log.Printf("[WARN] can't get due deliveries from outbox, %v", err)
+		return
+	}
+	byDestination := map[string][]Delivery{}
+	for _, d := range due {
+		byDestination[d.Destination] = append(byDestination[d.Destination], d)
+	}
+	var wg sync.WaitGroup
+	for key, deliveries := range byDestination {
+		wg.Go(func() {
+			for _, d := range deliveries {
+				if s.ctx.Err() != nil {
+					return
+				}
+				s.deliver(destinations[key], d)
+			}
+		})
+	}
+	wg.Wait()
+
+	pending, dead := s.outbox.Stat()
+	queueSize.WithLabelValues("outbox").Set(float64(pending))
+	deadLetters.Set(float64(dead))
+}
+
+// deliver sends the delivery to destination and removes it from the outbox, records failed attempt on error
+func (s *Service) deliver(dest Destination, d Delivery) {
+	var err error
+	switch {
+	case dest == nil:
+		err = fmt.Errorf("destination %s not configured", d.Destination)
+	case d.Verification != nil:
+		err = dest.SendVerification(s.ctx, *d.Verification)
+	case d.Request != nil:
+		err = dest.Send(s.ctx, *d.Request)
+	case d.Digest != nil:
+		ds, ok := dest.(digestSender)
+		if !ok {
+			err = fmt.Errorf("destination %s can't send digests", d.Destination)
+			break
+		}
+		err = ds.SendDigest(s.ctx, *d.Digest)
+	}
+	if err == nil {
+		if e := s.outbox.Done(d.ID); e != nil {
+			log.Printf("[WARN] can't remove delivery %s from outbox, %v", d.ID, e)
+		}
+		return
+	}
+	if s.ctx.Err() != nil {
+		return // interrupted by close, kept in the outbox to be sent after restart
+	}
+
+	var partialErr *PartialError
+	if errors.As(err, &partialErr) && d.Request != nil {
+		req := *d.Request
+		req.Sent = append(slices.Clone(req.Sent), partialErr.Sent...)
+		d.Request = &req
+	}
+	sendErrCounter.WithLabelValues(d.Destination).Inc()
+	log.Printf("[WARN] failed to send %s to %s, attempt %d, %s", d.ID, d.Destination, d.Attempts+1, err)
+	dead, e := s.outbox.Failed(d, err)
+	if e != nil {
+		log.Printf("[WARN] can't record failed delivery %s, %v", d.ID, e)
+		return
+	}
+	if dead {
+		log.Printf("[WARN] delivery %s to %s moved to dead letters after %d attempts", d.ID, d.Destination, d.Attempts+1)
+	}
+}
+
 // NopService is do-nothing notifier, without destinations
 var NopService = &Service{}
 
+var (
+	queueSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "remark42_notify_queue_size", Help: "requests waiting in notify queue"}, []string{"queue"})
+	droppedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "remark42_notify_dropped_total", Help: "requests dropped as notify queue is full"}, []string{"queue"})
+	sendErrCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "remark42_notify_send_errors_total", Help: "failed sends by destination"}, []string{"destination"})
+	deadLetters = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "remark42_notify_dead_letters", Help: "deliveries in notification outbox dead letters"})
+)
+
+// accepts checks if destination accepts the request, only new comments for destinations not implementing eventDestination
+func accepts(d Destination, req Request) bool {
+	if ed, ok := d.(eventDestination); ok {
+		return ed.Accepts(req)
+	}
+	return req.event() == EventCreate
+}
+
+// destinationName returns short name of destination type, i.e. "email" for *Email, used as metrics label
+func destinationName(d Destination) string {
+	name := fmt.Sprintf("%T", d)
+	return strings.ToLower(name[strings.LastIndex(name, ".")+1:])
+}
+
+// destinationKeys returns names of destinations used to keep their deliveries in the outbox, i.e. "email",
+// or Key of keyedDestination, i.e. "webhook-<url hash>". Keys don't depend on order of destinations,
+// only destinations with the same key get number suffix, i.e. "webhook-<url hash>-2"
+func destinationKeys(destinations []Destination) []string {
+	res := make([]string, len(destinations))
+	seen := map[string]int{}
+	for i, d := range destinations {
+		key := destinationName(d)
+		if kd, ok := d.(keyedDestination); ok {
+			key = kd.Key()
+		}
+		seen[key]++
+		res[i] = key
+		if seen[key] > 1 {
+			res[i] = fmt.Sprintf("%s-%d", key, seen[key])
+		}
+	}
+	return res
+}
+
+// sendAll calls send for each of recipients not notified by previous attempts of the request, listed in Request.Sent.
+// Returns *PartialError with notified recipients if some of sends failed
+func sendAll(req Request, recipients []string, send func(recipient string) error) error {
+	var errs []error
+	var sent []string
+	for _, r := range recipients {
+		if slices.Contains(req.Sent, r) {
+			continue
+		}
+		if err := send(r); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent = append(sent, r)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(sent) == 0 {
+		return errors.Join(errs...)
+	}
+	return &PartialError{Sent: sent, Err: errors.Join(errs...)}
+}
+
 // deduplicateStrings returns provided slice of strings will all duplicates removed.
 // Resulting slice is not sorted.
 func deduplicateStrings(source []string) []string {
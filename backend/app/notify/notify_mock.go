@@ -16,6 +16,7 @@ type MockDest struct {
 	closed           bool
 	lock             sync.Mutex
 	block            chan struct{} // if non-nil, Send/SendVerification wait on it before recording, letting tests pin the consumer
+	err              error         // if non-nil, returned by Send without recording
 }
 
 // Send mock
@@ -30,6 +31,9 @@ func (m *MockDest) Send(ctx context.Context, r Request) error {
 		m.closed = true
 		return nil
 	}
+	if m.err != nil {
+		return m.err
+	}
 	m.data = append(m.data, r)
 	log.Printf("sent %s -> %d", r.Comment.ID, m.id)
 	return nil
@@ -1,14 +1,20 @@
 package notify
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"testing"
 	"testing/synctest"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/subscription"
 )
 
 func TestService_NoDestinations(t *testing.T) {
@@ -54,6 +60,7 @@ func TestService_WithDrops(t *testing.T) {
 		d1, d2 := &MockDest{id: 1, block: gate}, &MockDest{id: 2, block: gate}
 		s := NewService(nil, 1, d1, d2)
 		assert.NotNil(t, s)
+		dropped := testutil.ToFloat64(droppedCounter.WithLabelValues("notification"))
 
 		s.Submit(Request{Comment: store.Comment{ID: "100"}}) // consumed, consumer blocks in Send on the gate
 		synctest.Wait()
@@ -71,6 +78,8 @@ func TestService_WithDrops(t *testing.T) {
 		require.Len(t, d2.Get(), 2, "one comment of three dropped from d2, got: %v", d2.Get())
 		assert.Equal(t, "100", d1.Get()[0].Comment.ID)
 		assert.Equal(t, "101", d1.Get()[1].Comment.ID)
+		assert.InDelta(t, dropped+1, testutil.ToFloat64(droppedCounter.WithLabelValues("notification")), 0.001, "drop counted")
+		assert.InDelta(t, 0, testutil.ToFloat64(queueSize.WithLabelValues("notification")), 0.001, "queue drained")
 	})
 }
 
@@ -112,6 +121,269 @@ func TestService_SubmitVerificationWithDrops(t *testing.T) {
 	})
 }
 
+func TestService_SendErrors(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		d1, d2 := &MockDest{id: 1, err: fmt.Errorf("send failed")}, &MockDest{id: 2}
+		s := NewService(nil, 1, d1, d2)
+		failed := testutil.ToFloat64(sendErrCounter.WithLabelValues("mockdest"))
+
+		s.Submit(Request{Comment: store.Comment{ID: "100"}})
+		synctest.Wait()
+		s.Submit(Request{Comment: store.Comment{ID: "101"}})
+		synctest.Wait()
+		s.Close()
+
+		assert.Empty(t, d1.Get())
+		assert.Len(t, d2.Get(), 2)
+		assert.InDelta(t, failed+2, testutil.ToFloat64(sendErrCounter.WithLabelValues("mockdest")), 0.001, "failed sends counted")
+		assert.Equal(t, "mockdest", destinationName(d1))
+	})
+}
+
+func TestService_WithOutbox(t *testing.T) {
+	o := prepOutbox(t, OutboxParams{Attempts: 2, Delay: 10 * time.Millisecond})
+	d1, d2 := &MockDest{id: 1, err: fmt.Errorf("send failed")}, &MockDest{id: 2}
+	s := NewServiceWithOutbox(nil, o, d1, d2)
+	defer s.Close()
+
+	s.Submit(Request{Comment: store.Comment{ID: "100", Locator: store.Locator{SiteID: "site1"}}})
+	s.SubmitVerification(VerificationRequest{SiteID: "site1", User: "user1"})
+	require.Eventually(t, func() bool { return len(d2.Get()) == 1 && len(d2.GetVerify()) == 1 },
+		time.Second, 10*time.Millisecond, "sent to d2")
+	assert.Equal(t, "100", d2.Get()[0].Comment.ID)
+
+	require.Eventually(t, func() bool {
+		_, dead, err := s.Deliveries("site1")
+		return err == nil && len(dead) == 1
+	}, time.Second, 10*time.Millisecond, "failed delivery to d1 moved to dead letters")
+	retrying, dead, err := s.Deliveries("site1")
+	require.NoError(t, err)
+	assert.Empty(t, retrying)
+	assert.Equal(t, "mockdest", dead[0].Destination)
+	assert.Equal(t, 2, dead[0].Attempts)
+	assert.Equal(t, "send failed", dead[0].LastError)
+	assert.Equal(t, "100", dead[0].Request.Comment.ID)
+	assert.Len(t, d1.GetVerify(), 1, "verification sent to d1, MockDest fails Send only")
+
+	d1.lock.Lock()
+	d1.err = nil
+	d1.lock.Unlock()
+	count, err := s.Replay("site1", dead[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	require.Eventually(t, func() bool { return len(d1.Get()) == 1 }, time.Second, 10*time.Millisecond, "replayed to d1")
+	assert.Len(t, d2.Get(), 1, "not sent to d2 again")
+	_, dead, err = s.Deliveries("site1")
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+
+	s.Close()
+	// second call should not result in panic, and it's safe to send after close
+	s.Close()
+	s.Submit(Request{Comment: store.Comment{ID: "101"}})
+}
+
+func TestService_Events(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		d1, d2 := &MockDest{id: 1}, &eventDest{MockDest: &MockDest{id: 2}, events: []Event{EventCreate, EventEdit}}
+		s := NewService(&mockStore{data: map[string]store.Comment{}}, 10, d1, d2)
+		s.Submit(Request{Comment: store.Comment{ID: "100"}})
+		s.Submit(Request{Event: EventEdit, Comment: store.Comment{ID: "100"}})
+		s.Submit(Request{Event: EventVote, Comment: store.Comment{ID: "100"}, Vote: 1})
+		synctest.Wait()
+		s.Close()
+
+		require.Len(t, d1.Get(), 1, "only new comment sent to destination without events")
+		assert.Equal(t, Event(""), d1.Get()[0].Event)
+		require.Len(t, d2.Get(), 2, "vote not accepted")
+		assert.Equal(t, EventEdit, d2.Get()[1].Event)
+	})
+
+	// with outbox, deliveries made only for destinations accepting the event
+	o := prepOutbox(t, OutboxParams{})
+	d1, d2 := &MockDest{id: 1, block: make(chan struct{})}, &eventDest{MockDest: &MockDest{id: 2, block: make(chan struct{})},
+		events: []Event{EventBlock}}
+	s := NewServiceWithOutbox(nil, o, d1, d2)
+	defer s.Close()
+	s.Submit(Request{Event: EventBlock, Comment: store.Comment{Locator: store.Locator{SiteID: "site1"}}, User: store.User{ID: "u1", Blocked: true}})
+	s.Submit(Request{Event: EventPin, Comment: store.Comment{ID: "100", Locator: store.Locator{SiteID: "site1"}}})
+	pending, _ := o.Stat()
+	assert.Equal(t, 1, pending)
+	close(d2.block)
+	require.Eventually(t, func() bool { return len(d2.Get()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, store.User{ID: "u1", Blocked: true}, d2.Get()[0].User, "event details kept in the outbox")
+	close(d1.block)
+	assert.Empty(t, d1.Get())
+}
+
+// eventDest is a destination mock accepting events
+type eventDest struct {
+	*MockDest
+	events []Event
+}
+
+func (d *eventDest) Accepts(req Request) bool { return slices.Contains(d.events, req.event()) }
+
+func TestService_WithOutboxRestart(t *testing.T) {
+	o := prepOutbox(t, OutboxParams{Attempts: 1})
+	// deliveries left by the previous run
+	require.NoError(t, o.Add(Delivery{SiteID: "site1", Destination: "mockdest", Request: &Request{Comment: store.Comment{ID: "100"}}},
+		Delivery{SiteID: "site1", Destination: "removed", Request: &Request{Comment: store.Comment{ID: "100"}}}))
+
+	d1 := &MockDest{id: 1}
+	s := NewServiceWithOutbox(nil, o, d1)
+	require.Eventually(t, func() bool { return len(d1.Get()) == 1 }, time.Second, 10*time.Millisecond, "sent after restart")
+	assert.Equal(t, "100", d1.Get()[0].Comment.ID)
+	require.Eventually(t, func() bool {
+		pending, dead := o.Stat()
+		return pending == 0 && dead == 1
+	}, time.Second, 10*time.Millisecond)
+	_, dead, err := s.Deliveries("site1")
+	require.NoError(t, err)
+	assert.Equal(t, "destination removed not configured", dead[0].LastError)
+	s.Close()
+}
+
+func TestService_NoOutbox(t *testing.T) {
+	s := NewService(nil, 1, &MockDest{id: 1})
+	defer s.Close()
+	_, _, err := s.Deliveries("site1")
+	assert.ErrorIs(t, err, ErrNoOutbox)
+	_, err = s.Replay("site1", "")
+	assert.ErrorIs(t, err, ErrNoOutbox)
+}
+
+func TestService_destinationKeys(t *testing.T) {
+	wh1, wh2 := &Webhook{url: "https://example.com/1"}, &Webhook{url: "https://example.com/2"}
+	keys := destinationKeys([]Destination{&MockDest{}, wh1, &MockDest{}, wh2})
+	assert.Equal(t, "mockdest", keys[0])
+	assert.Equal(t, "mockdest-2", keys[2])
+	assert.Equal(t, "webhook-"+keys[1][len("webhook-"):], keys[1])
+	assert.NotEqual(t, keys[1], keys[3])
+	assert.Equal(t, []string{keys[3], keys[1]}, destinationKeys([]Destination{wh2, wh1}), "keys don't depend on order")
+}
+
+func TestService_OutboxPartialRetry(t *testing.T) {
+	o := prepOutbox(t, OutboxParams{Attempts: 3, Delay: 10 * time.Millisecond})
+	d := &recipientsDest{MockDest: &MockDest{id: 1}, failed: map[string]bool{"b@example.com": true}}
+	s := NewServiceWithOutbox(nil, o, d)
+	defer s.Close()
+
+	s.Submit(Request{Comment: store.Comment{ID: "100", Locator: store.Locator{SiteID: "site1"}},
+		Emails: []string{"a@example.com", "b@example.com", "c@example.com"}})
+	require.Eventually(t, func() bool {
+		retrying, _, err := s.Deliveries("site1")
+		return err == nil && len(retrying) == 1
+	}, time.Second, 10*time.Millisecond)
+	retrying, _, err := s.Deliveries("site1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a@example.com", "c@example.com"}, retrying[0].Request.Sent, "notified recipients kept")
+	assert.Equal(t, "failed b@example.com", retrying[0].LastError)
+
+	d.lock.Lock()
+	d.failed = nil
+	d.lock.Unlock()
+	require.Eventually(t, func() bool {
+		pending, dead := o.Stat()
+		return pending == 0 && dead == 0
+	}, time.Second, 10*time.Millisecond)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	assert.Equal(t, []string{"a@example.com", "c@example.com", "b@example.com"}, d.sent, "retried for failed recipient only")
+}
+
+func TestService_OutboxDigests(t *testing.T) {
+	o := prepOutbox(t, OutboxParams{Attempts: 3, Delay: 10 * time.Millisecond})
+	d := &digestDest{MockDest: &MockDest{id: 1}, failures: 1}
+	s := NewServiceWithOutbox(nil, o, d)
+	defer s.Close()
+	require.NotNil(t, d.store, "outbox used as digest store")
+
+	s.Submit(Request{Comment: store.Comment{ID: "100", Locator: store.Locator{SiteID: "site1"}}})
+	require.Eventually(t, func() bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return len(d.digests) == 1
+	}, time.Second, 10*time.Millisecond, "due digest sent after failed attempt")
+	d.lock.Lock()
+	assert.Equal(t, "100", d.digests[0].Replies[0].Comment.ID)
+	assert.Equal(t, 0, d.failures)
+	d.lock.Unlock()
+	require.Eventually(t, func() bool {
+		pending, dead := o.Stat()
+		return pending == 0 && dead == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// digestDest is a destination mock collecting each request into digest already due, failing to send first ones
+type digestDest struct {
+	*MockDest
+	store    DigestStore
+	failures int
+	digests  []Digest
+}
+
+func (d *digestDest) Send(_ context.Context, req Request) error {
+	return d.store.AddToDigest(Digest{SiteID: req.Comment.Locator.SiteID, Email: "a@example.com",
+		Period: EmailDigestHourly, Created: time.Now().Add(-time.Hour), Replies: []Request{req}})
+}
+
+func (d *digestDest) UseDigestStore(ds DigestStore) { d.store = ds }
+
+func (d *digestDest) SendDigest(_ context.Context, dg Digest) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.failures > 0 {
+		d.failures--
+		return errors.New("smtp down")
+	}
+	d.digests = append(d.digests, dg)
+	return nil
+}
+
+// recipientsDest is a destination mock notifying request emails, failing for ones in failed
+type recipientsDest struct {
+	*MockDest
+	failed map[string]bool
+	sent   []string
+}
+
+func (d *recipientsDest) Send(_ context.Context, req Request) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return sendAll(req, req.Emails, func(email string) error {
+		if d.failed[email] {
+			return fmt.Errorf("failed %s", email)
+		}
+		d.sent = append(d.sent, email)
+		return nil
+	})
+}
+
+func TestSendAll(t *testing.T) {
+	var called []string
+	send := func(r string) error {
+		called = append(called, r)
+		if r == "bad" {
+			return fmt.Errorf("failed %s", r)
+		}
+		return nil
+	}
+	require.NoError(t, sendAll(Request{Sent: []string{"bad"}}, []string{"a", "bad", "b"}, send))
+	assert.Equal(t, []string{"a", "b"}, called, "already notified skipped")
+
+	called = nil
+	err := sendAll(Request{}, []string{"a", "bad", "b"}, send)
+	var partialErr *PartialError
+	require.ErrorAs(t, err, &partialErr)
+	assert.Equal(t, []string{"a", "b"}, partialErr.Sent)
+	assert.EqualError(t, err, "failed bad")
+
+	err = sendAll(Request{Sent: []string{"a"}}, []string{"a", "bad"}, send)
+	require.EqualError(t, err, "failed bad")
+	assert.False(t, errors.As(err, &partialErr), "nothing notified")
+}
+
 func TestService_Many(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		d1, d2 := &MockDest{id: 1}, &MockDest{id: 2}
@@ -202,6 +474,7 @@ func TestService_EmailRetrieval(t *testing.T) {
 		assert.Equal(t, "p1", destRes[2].parent.ID)
 		assert.Equal(t, "u1", destRes[2].parent.User.ID)
 		assert.ElementsMatch(t, []string{"u1@example.com"}, destRes[2].Emails)
+		assert.ElementsMatch(t, []string{"u1@example.com"}, destRes[2].MatrixIDs, "mock matrix id is email")
 
 		// reply to the last comment by another user, should trigger email retrieval error
 		s.Submit(Request{Comment: dataStore.data["p4"]})
@@ -218,6 +491,69 @@ func TestService_EmailRetrieval(t *testing.T) {
 	})
 }
 
+func TestService_EmailDigests(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		dest := &MockDest{id: 1}
+		dataStore := &mockStore{data: map[string]store.Comment{}, userDetails: map[string]string{},
+			emailDigests: map[string]string{"u1": EmailDigestDaily}}
+
+		dataStore.data["p1"] = store.Comment{ID: "p1", User: store.User{ID: "u1"}}
+		dataStore.data["p2"] = store.Comment{ID: "p2", ParentID: "p1", User: store.User{ID: "u2"}}
+		dataStore.data["p3"] = store.Comment{ID: "p3", ParentID: "p2", User: store.User{ID: "u3"}}
+		dataStore.userDetails["u1"] = "u1@example.com"
+		dataStore.userDetails["u2"] = "u2@example.com"
+
+		s := NewService(dataStore, 1, dest)
+		s.Submit(Request{Comment: dataStore.data["p3"]})
+		synctest.Wait()
+		s.Close()
+
+		destRes := dest.Get()
+		require.Equal(t, 1, len(destRes))
+		assert.ElementsMatch(t, []string{"u1@example.com", "u2@example.com"}, destRes[0].Emails)
+		assert.Equal(t, map[string]string{"u1@example.com": EmailDigestDaily}, destRes[0].EmailDigests, "only u1 prefers digest")
+	})
+}
+
+func TestService_PostSubscribers(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		dest := &MockDest{id: 1}
+		dataStore := &mockStore{data: map[string]store.Comment{}, userDetails: map[string]string{},
+			emailDigests: map[string]string{"u4": EmailDigestHourly}}
+		dataStore.subs = []subscription.Subscription{
+			{SiteID: "site1", URL: "http://example.com/p1", UserID: "u1", Email: "u1@example.com"},
+			{SiteID: "site1", URL: "http://example.com/p1", UserID: "u2", Email: "u2@example.com", Telegram: "tg2"},
+			{SiteID: "site1", URL: "http://example.com/p1", UserID: "u3", Telegram: "tg3"},
+			{SiteID: "site1", URL: "http://example.com/p1", UserID: "u4", Email: "u4@example.com"},
+		}
+		locator := store.Locator{SiteID: "site1", URL: "http://example.com/p1"}
+		dataStore.data["p1"] = store.Comment{ID: "p1", Locator: locator, User: store.User{ID: "u1"}}
+		dataStore.data["p2"] = store.Comment{ID: "p2", ParentID: "p1", Locator: locator, User: store.User{ID: "u3"}}
+		dataStore.userDetails["u1"] = "u1@example.com"
+
+		s := NewService(dataStore, 1, dest)
+		// root comment of u1, subscribers except the author notified
+		s.Submit(Request{Comment: dataStore.data["p1"]})
+		synctest.Wait()
+		// reply of u3 to u1, u1 notified once
+		s.Submit(Request{Comment: dataStore.data["p2"]})
+		synctest.Wait()
+		s.Close()
+
+		destRes := dest.Get()
+		require.Equal(t, 2, len(destRes))
+		assert.Equal(t, []string{"u2@example.com", "u4@example.com"}, destRes[0].Emails)
+		assert.Equal(t, []string{"tg2", "tg3"}, destRes[0].Telegrams)
+		assert.Equal(t, map[string]string{"u2@example.com": "u2", "u4@example.com": "u4"}, destRes[0].PostEmails)
+		assert.Equal(t, map[string]string{"u4@example.com": EmailDigestHourly}, destRes[0].EmailDigests)
+
+		assert.Equal(t, []string{"u1@example.com", "u2@example.com", "u4@example.com"}, destRes[1].Emails)
+		assert.Equal(t, []string{"u1@example.com", "tg2"}, destRes[1].Telegrams, "u3 is the author, mock telegram is email")
+		assert.Equal(t, map[string]string{"u2@example.com": "u2", "u4@example.com": "u4"}, destRes[1].PostEmails,
+			"u1 notified as the parent comment author")
+	})
+}
+
 func TestService_Recursive(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		dest := &MockDest{id: 1}
@@ -266,6 +602,7 @@ func TestService_Recursive(t *testing.T) {
 		assert.Equal(t, "p2", destRes[2].parent.ID)
 		assert.Equal(t, "u2", destRes[2].parent.User.ID)
 		assert.ElementsMatch(t, []string{"u1@example.com"}, destRes[2].Emails)
+		assert.ElementsMatch(t, []string{"u1@example.com"}, destRes[2].MatrixIDs, "mock matrix id is email")
 
 		// reply to the third comment from u1 (author of the first comment), only u3 should be notified
 		s.Submit(Request{Comment: dataStore.data["p4"]})
@@ -301,8 +638,10 @@ func TestService_Nop(t *testing.T) {
 }
 
 type mockStore struct {
-	data        map[string]store.Comment
-	userDetails map[string]string
+	data         map[string]store.Comment
+	userDetails  map[string]string
+	emailDigests map[string]string
+	subs         []subscription.Subscription
 }
 
 func (m mockStore) getUserDetail(userID string) (string, error) {
@@ -328,3 +667,24 @@ func (m mockStore) GetUserEmail(_, userID string) (string, error) {
 func (m mockStore) GetUserTelegram(_, userID string) (string, error) {
 	return m.getUserDetail(userID)
 }
+
+func (m mockStore) GetUserMatrix(_, userID string) (string, error) {
+	return m.getUserDetail(userID)
+}
+
+func (m mockStore) GetUserWebPush(_, userID string) (string, error) {
+	return m.getUserDetail(userID)
+}
+
+func (m mockStore) GetUserEmailDigest(_, userID string) (string, error) {
+	return m.emailDigests[userID], nil
+}
+
+func (m mockStore) PostSubscriptions(locator store.Locator) (res []subscription.Subscription, err error) {
+	for _, sub := range m.subs {
+		if sub.SiteID == locator.SiteID && sub.URL == locator.URL {
+			res = append(res, sub)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,362 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/rs/xid"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// Outbox keeps deliveries in bolt file until they are sent, so they survive restart of the app.
+// Each submitted request makes a delivery per destination. Failed delivery is retried with exponential backoff
+// and moved to dead letters after OutboxParams.Attempts failures. Thread safe.
+// Uses 2 buckets, "pending" for deliveries waiting to be sent and "dead" for dead letters,
+// key is Delivery.ID, sortable by creation time, and value is Delivery.
+// Email digests are collected in "digests" bucket, by site and email, and become deliveries when due.
+type Outbox struct {
+	OutboxParams
+	db *bolt.DB
+}
+
+// OutboxParams defines retry policy of Outbox
+type OutboxParams struct {
+	Attempts int           // max send attempts, delivery moved to dead letters after this number of failures
+	Delay    time.Duration // delay before the first retry, doubled for each next one
+	MaxDelay time.Duration // max delay between retries
+}
+
+// Delivery is a notification or verification request to a single destination
+type Delivery struct {
+	ID           string               `json:"id"`
+	SiteID       string               `json:"site"`
+	Destination  string               `json:"destination"`
+	Request      *Request             `json:"request,omitempty"`
+	Verification *VerificationRequest `json:"verification,omitempty"`
+	Digest       *Digest              `json:"digest,omitempty"`
+	Attempts     int                  `json:"attempts"`
+	LastError    string               `json:"last_error,omitempty"`
+	Created      time.Time            `json:"created"`
+	NextTry      time.Time            `json:"next_try"`
+}
+
+// requestJSON is Request with parent comment, used to keep Request in the outbox
+type requestJSON struct {
+	Event        Event             `json:"event,omitempty"`
+	Comment      store.Comment     `json:"comment"`
+	Parent       store.Comment     `json:"parent"`
+	Emails       []string          `json:"emails,omitempty"`
+	EmailDigests map[string]string `json:"email_digests,omitempty"`
+	PostEmails   map[string]string `json:"post_emails,omitempty"`
+	Telegrams    []string          `json:"telegrams,omitempty"`
+	MatrixIDs    []string          `json:"matrix_ids,omitempty"`
+	WebPushes    []string          `json:"web_pushes,omitempty"`
+	User         store.User        `json:"user,omitzero"`
+	Vote         int               `json:"vote,omitempty"`
+	ReadOnly     bool              `json:"read_only,omitempty"`
+	Sent         []string          `json:"sent,omitempty"`
+}
+
+const (
+	pendingBucketName = "pending"
+	deadBucketName    = "dead"
+	digestsBucketName = "digests"
+)
+
+// NewOutbox makes outbox in bolt file, with default retry params for unset ones
+func NewOutbox(fileName string, options bolt.Options, params OutboxParams) (*Outbox, error) {
+	if params.Attempts <= 0 {
+		params.Attempts = 10
+	}
+	if params.Delay <= 0 {
+		params.Delay = 30 * time.Second
+	}
+	if params.MaxDelay < params.Delay {
+		params.MaxDelay = max(time.Hour, params.Delay)
+	}
+
+	db, err := bolt.Open(fileName, 0o600, &options) //nolint:gocritic //octalLiteral is OK as FileMode
+	if err != nil {
+		return nil, fmt.Errorf("failed to make boltdb for %s: %w", fileName, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bktName := range []string{pendingBucketName, deadBucketName, digestsBucketName} {
+			if _, e := tx.CreateBucketIfNotExists([]byte(bktName)); e != nil {
+				return fmt.Errorf("failed to create top level bucket %s: %w", bktName, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize boltdb db %q buckets: %w", fileName, err)
+	}
+	return &Outbox{OutboxParams: params, db: db}, nil
+}
+
+// Add puts deliveries to pending, to be sent immediately
+func (o *Outbox) Add(deliveries ...Delivery) error {
+	now := time.Now()
+	return o.db.Update(func(tx *bolt.Tx) error {
+		for _, d := range deliveries {
+			d.ID, d.Created, d.NextTry = xid.New().String(), now, now
+			if err := put(tx.Bucket([]byte(pendingBucketName)), d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Due returns pending deliveries with NextTry not after the given time, the oldest first
+func (o *Outbox) Due(now time.Time) (res []Delivery, err error) {
+	err = o.db.View(func(tx *bolt.Tx) error {
+		return forEach(tx.Bucket([]byte(pendingBucketName)), func(d Delivery) {
+			if !d.NextTry.After(now) {
+				res = append(res, d)
+			}
+		})
+	})
+	return res, err
+}
+
+// Next returns the earliest NextTry of pending deliveries and due time of digests, false if there are none
+func (o *Outbox) Next() (next time.Time, ok bool, err error) {
+	earliest := func(t time.Time) {
+		if !ok || t.Before(next) {
+			next, ok = t, true
+		}
+	}
+	err = o.db.View(func(tx *bolt.Tx) error {
+		if e := forEach(tx.Bucket([]byte(pendingBucketName)), func(d Delivery) { earliest(d.NextTry) }); e != nil {
+			return e
+		}
+		return forEachDigest(tx.Bucket([]byte(digestsBucketName)), func(_ []byte, d Digest) { earliest(d.due()) })
+	})
+	return next, ok, err
+}
+
+// AddToDigest adds replies of the digest to the one collected for the site and email, or keeps it as the new one.
+// Implements DigestStore.
+func (o *Outbox) AddToDigest(d Digest) error {
+	key := []byte(d.SiteID + "::" + d.Email)
+	return o.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(digestsBucketName))
+		if data := bkt.Get(key); data != nil {
+			var cur Digest
+			if err := json.Unmarshal(data, &cur); err != nil {
+				return fmt.Errorf("can't unmarshal digest %s: %w", string(key), err)
+			}
+			cur.UnsubscribeLink = d.UnsubscribeLink
+			cur.Replies = append(cur.Replies, d.Replies...)
+			d = cur
+		}
+		data, err := json.Marshal(d)
+		if err != nil {
+			return fmt.Errorf("can't marshal digest %s: %w", string(key), err)
+		}
+		if err = bkt.Put(key, data); err != nil {
+			return fmt.Errorf("can't put digest %s: %w", string(key), err)
+		}
+		return nil
+	})
+}
+
+// ScheduleDigests moves digests due at the given time to pending deliveries for the destination.
+// Returns number of scheduled digests.
+func (o *Outbox) ScheduleDigests(now time.Time, destination string) (count int, err error) {
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(digestsBucketName))
+		var keys [][]byte
+		var due []Digest
+		if e := forEachDigest(bkt, func(k []byte, d Digest) {
+			if !d.due().After(now) {
+				keys, due = append(keys, k), append(due, d)
+			}
+		}); e != nil {
+			return e
+		}
+		for i, d := range due {
+			if e := bkt.Delete(keys[i]); e != nil {
+				return fmt.Errorf("can't delete digest %s: %w", string(keys[i]), e)
+			}
+			delivery := Delivery{ID: xid.New().String(), SiteID: d.SiteID, Destination: destination, Digest: &d,
+				Created: now, NextTry: now}
+			if e := put(tx.Bucket([]byte(pendingBucketName)), delivery); e != nil {
+				return e
+			}
+		}
+		count = len(due)
+		return nil
+	})
+	return count, err
+}
+
+// Done removes sent delivery from pending
+func (o *Outbox) Done(id string) error {
+	return o.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(pendingBucketName)).Delete([]byte(id))
+	})
+}
+
+// Failed records failed attempt of delivery and schedules the next one with exponential backoff.
+// Returns true if delivery moved to dead letters as it has no attempts left.
+func (o *Outbox) Failed(d Delivery, sendErr error) (dead bool, err error) {
+	d.Attempts++
+	d.LastError = sendErr.Error()
+	dead = d.Attempts >= o.Attempts
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		pending := tx.Bucket([]byte(pendingBucketName))
+		if pending.Get([]byte(d.ID)) == nil {
+			return fmt.Errorf("delivery %s not pending", d.ID)
+		}
+		if !dead {
+			d.NextTry = time.Now().Add(o.backoff(d.Attempts))
+			return put(pending, d)
+		}
+		if e := pending.Delete([]byte(d.ID)); e != nil {
+			return fmt.Errorf("can't delete delivery %s: %w", d.ID, e)
+		}
+		return put(tx.Bucket([]byte(deadBucketName)), d)
+	})
+	return dead, err
+}
+
+// List returns pending deliveries with failed attempts and dead letters of the site, the oldest first
+func (o *Outbox) List(siteID string) (retrying, dead []Delivery, err error) {
+	err = o.db.View(func(tx *bolt.Tx) error {
+		err := forEach(tx.Bucket([]byte(pendingBucketName)), func(d Delivery) {
+			if d.SiteID == siteID && d.Attempts > 0 {
+				retrying = append(retrying, d)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return forEach(tx.Bucket([]byte(deadBucketName)), func(d Delivery) {
+			if d.SiteID == siteID {
+				dead = append(dead, d)
+			}
+		})
+	})
+	return retrying, dead, err
+}
+
+// Replay moves dead letters of the site back to pending, with attempts reset, and makes retrying deliveries
+// of the site due immediately. Replays all of them for empty id. Returns number of replayed deliveries.
+func (o *Outbox) Replay(siteID, id string) (count int, err error) {
+	now := time.Now()
+	err = o.db.Update(func(tx *bolt.Tx) error {
+		pending, deadBkt := tx.Bucket([]byte(pendingBucketName)), tx.Bucket([]byte(deadBucketName))
+		var dead, retrying []Delivery
+		match := func(d Delivery) bool { return d.SiteID == siteID && (id == "" || d.ID == id) }
+		if e := forEach(deadBkt, func(d Delivery) {
+			if match(d) {
+				dead = append(dead, d)
+			}
+		}); e != nil {
+			return e
+		}
+		if e := forEach(pending, func(d Delivery) {
+			if match(d) && d.Attempts > 0 {
+				retrying = append(retrying, d)
+			}
+		}); e != nil {
+			return e
+		}
+		for i := range dead {
+			if e := deadBkt.Delete([]byte(dead[i].ID)); e != nil {
+				return fmt.Errorf("can't delete dead letter %s: %w", dead[i].ID, e)
+			}
+			dead[i].Attempts = 0
+		}
+		for _, d := range append(dead, retrying...) {
+			d.NextTry = now
+			if e := put(pending, d); e != nil {
+				return e
+			}
+		}
+		count = len(dead) + len(retrying)
+		return nil
+	})
+	return count, err
+}
+
+// Stat returns number of pending deliveries and dead letters
+func (o *Outbox) Stat() (pending, dead int) {
+	_ = o.db.View(func(tx *bolt.Tx) error {
+		pending = tx.Bucket([]byte(pendingBucketName)).Stats().KeyN
+		dead = tx.Bucket([]byte(deadBucketName)).Stats().KeyN
+		return nil
+	})
+	return pending, dead
+}
+
+// Close bolt file
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// backoff returns delay before the next attempt, Delay doubled for each failed attempt after the first one
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.Delay
+	for i := 1; i < attempts && delay < o.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, o.MaxDelay)
+}
+
+// MarshalJSON keeps parent comment of the request, used by destinations to render replies
+func (r Request) MarshalJSON() ([]byte, error) {
+	return json.Marshal(requestJSON{Event: r.Event, Comment: r.Comment, Parent: r.parent, Emails: r.Emails, EmailDigests: r.EmailDigests,
+		PostEmails: r.PostEmails, Telegrams: r.Telegrams, MatrixIDs: r.MatrixIDs, WebPushes: r.WebPushes,
+		User: r.User, Vote: r.Vote, ReadOnly: r.ReadOnly, Sent: r.Sent})
+}
+
+// UnmarshalJSON restores request with parent comment
+func (r *Request) UnmarshalJSON(data []byte) error {
+	var rj requestJSON
+	if err := json.Unmarshal(data, &rj); err != nil {
+		return err
+	}
+	*r = Request{Event: rj.Event, Comment: rj.Comment, parent: rj.Parent, Emails: rj.Emails, EmailDigests: rj.EmailDigests,
+		PostEmails: rj.PostEmails, Telegrams: rj.Telegrams, MatrixIDs: rj.MatrixIDs, WebPushes: rj.WebPushes,
+		User: rj.User, Vote: rj.Vote, ReadOnly: rj.ReadOnly, Sent: rj.Sent}
+	return nil
+}
+
+func put(bkt *bolt.Bucket, d Delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("can't marshal delivery %s: %w", d.ID, err)
+	}
+	if err = bkt.Put([]byte(d.ID), data); err != nil {
+		return fmt.Errorf("can't put delivery %s: %w", d.ID, err)
+	}
+	return nil
+}
+
+func forEachDigest(bkt *bolt.Bucket, fn func(k []byte, d Digest)) error {
+	return bkt.ForEach(func(k, v []byte) error {
+		var d Digest
+		if err := json.Unmarshal(v, &d); err != nil {
+			return fmt.Errorf("can't unmarshal digest %s: %w", string(k), err)
+		}
+		fn(k, d)
+		return nil
+	})
+}
+
+func forEach(bkt *bolt.Bucket, fn func(d Delivery)) error {
+	return bkt.ForEach(func(k, v []byte) error {
+		var d Delivery
+		if err := json.Unmarshal(v, &d); err != nil {
+			return fmt.Errorf("can't unmarshal delivery %s: %w", string(k), err)
+		}
+		fn(d)
+		return nil
+	})
+}
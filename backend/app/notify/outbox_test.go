@@ -0,0 +1,213 @@
+package notify
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestOutbox_Retries(t *testing.T) {
+	o := prepOutbox(t, OutboxParams{Attempts: 3, Delay: time.Minute, MaxDelay: 3 * time.Minute})
+
+	req := Request{Comment: store.Comment{ID: "c1", Locator: store.Locator{SiteID: "site1"}},
+		parent: store.Comment{ID: "p1", Text: "parent"}, Emails: []string{"a@example.com"},
+		EmailDigests: map[string]string{"a@example.com": EmailDigestDaily}}
+	require.NoError(t, o.Add(
+		Delivery{SiteID: "site1", Destination: "email", Request: &req},
+		Delivery{SiteID: "site1", Destination: "slack", Request: &req},
+	))
+
+	due, err := o.Due(time.Now())
+	require.NoError(t, err)
+	require.Len(t, due, 2)
+	assert.Equal(t, "email", due[0].Destination, "oldest first")
+	assert.NotEmpty(t, due[0].ID)
+	assert.Equal(t, "p1", due[0].Request.parent.ID, "parent kept")
+	assert.Equal(t, []string{"a@example.com"}, due[0].Request.Emails)
+	assert.Equal(t, map[string]string{"a@example.com": EmailDigestDaily}, due[0].Request.EmailDigests)
+
+	require.NoError(t, o.Done(due[1].ID))
+	dead, err := o.Failed(due[0], errors.New("smtp down"))
+	require.NoError(t, err)
+	assert.False(t, dead)
+
+	due, err = o.Due(time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, due, "retry scheduled in a minute")
+	next, ok, err := o.Next()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), next, time.Second)
+
+	due, err = o.Due(time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, 1, due[0].Attempts)
+	assert.Equal(t, "smtp down", due[0].LastError)
+	dead, err = o.Failed(due[0], errors.New("smtp down"))
+	require.NoError(t, err)
+	assert.False(t, dead)
+	next, _, err = o.Next()
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), next, time.Second, "delay doubled")
+
+	due, err = o.Due(time.Now().Add(2 * time.Minute))
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	dead, err = o.Failed(due[0], errors.New("smtp still down"))
+	require.NoError(t, err)
+	assert.True(t, dead, "no attempts left")
+	_, ok, err = o.Next()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	_, err = o.Failed(due[0], errors.New("smtp still down"))
+	assert.EqualError(t, err, "delivery "+due[0].ID+" not pending")
+
+	pending, deadCount := o.Stat()
+	assert.Equal(t, 0, pending)
+	assert.Equal(t, 1, deadCount)
+}
+
+func TestOutbox_ListReplay(t *testing.T) {
+	o := prepOutbox(t, OutboxParams{Attempts: 1, Delay: time.Minute})
+	assert.Equal(t, time.Hour, o.MaxDelay, "default max delay")
+
+	req := Request{Comment: store.Comment{ID: "c1", Locator: store.Locator{SiteID: "site1"}}}
+	require.NoError(t, o.Add(Delivery{SiteID: "site1", Destination: "email", Request: &req},
+		Delivery{SiteID: "site1", Destination: "email", Verification: &VerificationRequest{SiteID: "site1", User: "u1"}},
+		Delivery{SiteID: "site2", Destination: "email", Request: &req}))
+	due, err := o.Due(time.Now())
+	require.NoError(t, err)
+	require.Len(t, due, 3)
+	for _, d := range due[1:] {
+		_, err = o.Failed(d, errors.New("failed"))
+		require.NoError(t, err)
+	}
+	o.Attempts = 2
+	_, err = o.Failed(due[0], errors.New("failed"))
+	require.NoError(t, err)
+
+	retrying, dead, err := o.List("site1")
+	require.NoError(t, err)
+	require.Len(t, retrying, 1)
+	assert.Equal(t, due[0].ID, retrying[0].ID)
+	require.Len(t, dead, 1)
+	assert.Equal(t, "u1", dead[0].Verification.User)
+
+	count, err := o.Replay("site1", dead[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+	retrying, dead, err = o.List("site1")
+	require.NoError(t, err)
+	assert.Len(t, retrying, 1)
+	assert.Empty(t, dead)
+	due, err = o.Due(time.Now())
+	require.NoError(t, err)
+	require.Len(t, due, 1, "replayed delivery due")
+	assert.Equal(t, 0, due[0].Attempts, "attempts reset")
+
+	count, err = o.Replay("site1", "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "retrying delivery made due")
+	due, err = o.Due(time.Now())
+	require.NoError(t, err)
+	assert.Len(t, due, 2)
+
+	count, err = o.Replay("site3", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	_, dead, err = o.List("site2")
+	require.NoError(t, err)
+	assert.Len(t, dead, 1, "other site not replayed")
+}
+
+func TestOutbox_Digests(t *testing.T) {
+	o := prepOutbox(t, OutboxParams{Attempts: 3, Delay: time.Minute})
+
+	created := time.Now().Add(-30 * time.Minute)
+	reply := func(id string) Request {
+		return Request{Comment: store.Comment{ID: id, Locator: store.Locator{SiteID: "site1"}},
+			parent: store.Comment{ID: "p1"}}
+	}
+	require.NoError(t, o.AddToDigest(Digest{SiteID: "site1", Email: "a@example.com", Period: EmailDigestHourly,
+		UnsubscribeLink: "link1", Created: created, Replies: []Request{reply("c1")}}))
+	require.NoError(t, o.AddToDigest(Digest{SiteID: "site1", Email: "a@example.com", Period: EmailDigestHourly,
+		UnsubscribeLink: "link2", Created: time.Now(), Replies: []Request{reply("c2")}}))
+	require.NoError(t, o.AddToDigest(Digest{SiteID: "site2", Email: "a@example.com", Period: EmailDigestDaily,
+		UnsubscribeLink: "link3", Created: created, Replies: []Request{reply("c3")}}))
+
+	next, ok, err := o.Next()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.WithinDuration(t, created.Add(time.Hour), next, time.Second, "earliest digest due")
+
+	count, err := o.ScheduleDigests(time.Now(), "email")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count, "nothing due yet")
+
+	count, err = o.ScheduleDigests(created.Add(time.Hour), "email")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "hourly digest due")
+	due, err := o.Due(created.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, "email", due[0].Destination)
+	assert.Equal(t, "site1", due[0].SiteID)
+	require.NotNil(t, due[0].Digest)
+	assert.Equal(t, "link2", due[0].Digest.UnsubscribeLink, "latest unsubscribe link")
+	assert.WithinDuration(t, created, due[0].Digest.Created, time.Second, "creation time of the first reply kept")
+	require.Len(t, due[0].Digest.Replies, 2)
+	assert.Equal(t, "c1", due[0].Digest.Replies[0].Comment.ID)
+	assert.Equal(t, "c2", due[0].Digest.Replies[1].Comment.ID)
+	assert.Equal(t, "p1", due[0].Digest.Replies[1].parent.ID)
+
+	// failed digest delivery retried as any other one
+	dead, err := o.Failed(due[0], errors.New("smtp down"))
+	require.NoError(t, err)
+	assert.False(t, dead)
+	due, err = o.Due(created.Add(time.Hour + time.Minute))
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	require.NotNil(t, due[0].Digest)
+	assert.Equal(t, 1, due[0].Attempts)
+
+	count, err = o.ScheduleDigests(created.Add(24*time.Hour), "email")
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "daily digest due")
+	count, err = o.ScheduleDigests(created.Add(48*time.Hour), "email")
+	require.NoError(t, err)
+	assert.Equal(t, 0, count, "digests moved to deliveries")
+}
+
+func TestOutbox_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "outbox.db")
+	o, err := NewOutbox(file, bolt.Options{}, OutboxParams{})
+	require.NoError(t, err)
+	assert.Equal(t, 10, o.Attempts)
+	assert.Equal(t, 30*time.Second, o.Delay)
+	req := Request{Comment: store.Comment{ID: "c1"}}
+	require.NoError(t, o.Add(Delivery{SiteID: "site1", Destination: "email", Request: &req}))
+	require.NoError(t, o.Close())
+
+	o, err = NewOutbox(file, bolt.Options{}, OutboxParams{})
+	require.NoError(t, err)
+	defer o.Close()
+	due, err := o.Due(time.Now())
+	require.NoError(t, err)
+	require.Len(t, due, 1)
+	assert.Equal(t, "c1", due[0].Request.Comment.ID)
+}
+
+func prepOutbox(t *testing.T, params OutboxParams) *Outbox {
+	o, err := NewOutbox(filepath.Join(t.TempDir(), "outbox.db"), bolt.Options{}, params)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = o.Close() })
+	return o
+}
@@ -2,28 +2,55 @@ package notify
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
+	"strings"
 
 	log "github.com/go-pkgz/lgr"
 	ntf "github.com/go-pkgz/notify"
+	"github.com/slack-go/slack"
 )
 
+// SlackModerationBlockID is the block id of the moderation buttons in slack message
+const SlackModerationBlockID = "remark42_moderation"
+
+// enum of moderation actions, used as action id of the buttons
+const (
+	SlackActionDelete  = "delete"
+	SlackActionBlock1d = "block_1d"
+	SlackActionBlock   = "block"
+	SlackActionPin     = "pin"
+)
+
+// SlackAction is the value of moderation button, identifies the comment and its author
+type SlackAction struct {
+	SiteID    string `json:"site"`
+	URL       string `json:"url"`
+	CommentID string `json:"id"`
+	UserID    string `json:"user"`
+}
+
 // Slack implements notify.Destination for Slack
 type Slack struct {
 	*ntf.Slack
 
+	// Moderation adds "Delete", "Block user" and "Pin" buttons to messages.
+	// Slack app should have interactivity enabled with request URL pointing to /api/v1/slack/interaction
+	Moderation bool
+
+	client      *slack.Client // used for messages with moderation buttons
 	channelName string
 }
 
 // NewSlack makes Slack bot for notifications
-func NewSlack(token, channelName string) *Slack {
+func NewSlack(token, channelName string, opts ...slack.Option) *Slack {
 	log.Printf("[DEBUG] create new slack notifier for chan %s", channelName)
 	if channelName == "" {
 		channelName = "general"
 	}
 
-	return &Slack{Slack: ntf.NewSlack(token), channelName: channelName}
+	return &Slack{Slack: ntf.NewSlack(token, opts...), client: slack.New(token, opts...), channelName: channelName}
 }
 
 // Send to Slack channel
@@ -40,6 +67,10 @@ func (s *Slack) Send(ctx context.Context, req Request) error {
 		title = "↦ " + req.Comment.PostTitle
 	}
 
+	if s.Moderation {
+		return s.sendWithButtons(ctx, req, "New comment from "+user, title)
+	}
+
 	destination := fmt.Sprintf(
 		"slack:%s?title=%s&attachmentText=%s&titleLink=%s",
 		s.channelName,
@@ -59,3 +90,45 @@ func (s *Slack) SendVerification(_ context.Context, _ VerificationRequest) error
 func (s *Slack) String() string {
 	return s.Slack.String() + " for channel " + s.channelName + ""
 }
+
+// sendWithButtons posts message with the comment and moderation buttons to the channel
+func (s *Slack) sendWithButtons(ctx context.Context, req Request, text, title string) error {
+	value, err := json.Marshal(SlackAction{SiteID: req.Comment.Locator.SiteID, URL: req.Comment.Locator.URL,
+		CommentID: req.Comment.ID, UserID: req.Comment.User.ID})
+	if err != nil {
+		return fmt.Errorf("can't marshal slack action: %w", err)
+	}
+
+	orig := []rune(req.Comment.Orig)
+	if len(orig) > 2500 { // section text is limited to 3000 characters
+		orig = append(orig[:2500], []rune("...")...)
+	}
+	link := req.Comment.Locator.URL + uiNav + req.Comment.ID
+	section := fmt.Sprintf("*%s*\n<%s|%s>\n%s", slackEscape(text), slackEscape(link), slackEscape(title),
+		slackEscape(string(orig)))
+
+	button := func(actionID, label string) *slack.ButtonBlockElement {
+		return slack.NewButtonBlockElement(actionID, string(value), slack.NewTextBlockObject(slack.PlainTextType, label, false, false))
+	}
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, section, false, false), nil, nil),
+		slack.NewActionBlock(SlackModerationBlockID,
+			button(SlackActionDelete, "Delete").WithStyle(slack.StyleDanger),
+			button(SlackActionBlock1d, "Block user (1d)"),
+			button(SlackActionBlock, "Block user (permanent)").WithStyle(slack.StyleDanger),
+			button(SlackActionPin, "Pin"),
+		),
+	}
+
+	// text is used as a fallback for notifications
+	_, _, err = s.client.PostMessageContext(ctx, s.channelName, slack.MsgOptionText(text, false), slack.MsgOptionBlocks(blocks...))
+	if err != nil {
+		return fmt.Errorf("can't post slack message to %s: %w", s.channelName, err)
+	}
+	return nil
+}
+
+// slackEscape escapes control characters of slack mrkdwn
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
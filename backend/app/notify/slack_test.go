@@ -2,9 +2,15 @@ package notify
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
+	"github.com/slack-go/slack"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/umputun/remark42/backend/app/store"
 )
@@ -38,3 +44,47 @@ func TestSlack_SendVerification(t *testing.T) {
 	ts := NewSlack("", "")
 	assert.NoError(t, ts.SendVerification(context.Background(), VerificationRequest{}))
 }
+
+func TestSlack_SendWithButtons(t *testing.T) {
+	var form url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/chat.postMessage", r.URL.Path)
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		_, _ = w.Write([]byte(`{"ok": true, "channel": "C123", "ts": "1234.5678"}`))
+	}))
+	defer ts.Close()
+
+	sl := NewSlack("token", "test-channel", slack.OptionAPIURL(ts.URL+"/"))
+	sl.Moderation = true
+
+	c := store.Comment{PostTitle: "test title", Orig: "some **text** & <more>", ParentID: "1", ID: "999",
+		Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post1"}}
+	c.User.Name, c.User.ID = "from", "u1"
+	cp := store.Comment{Text: "some parent text"}
+	cp.User.Name = "to"
+
+	require.NoError(t, sl.Send(context.Background(), Request{Comment: c, parent: cp}))
+	assert.Equal(t, "test-channel", form.Get("channel"))
+	assert.Equal(t, "New comment from from → to", form.Get("text"))
+
+	var blocks slack.Blocks
+	require.NoError(t, json.Unmarshal([]byte(form.Get("blocks")), &blocks))
+	require.Len(t, blocks.BlockSet, 2)
+	section := blocks.BlockSet[0].(*slack.SectionBlock)
+	assert.Equal(t, "*New comment from from → to*\n<https://example.com/post1#remark42__comment-999|↦ test title>\nsome **text** &amp; &lt;more&gt;",
+		section.Text.Text)
+
+	actions := blocks.BlockSet[1].(*slack.ActionBlock)
+	assert.Equal(t, SlackModerationBlockID, actions.BlockID)
+	require.Len(t, actions.Elements.ElementSet, 4)
+	ids := []string{}
+	for _, e := range actions.Elements.ElementSet {
+		btn := e.(*slack.ButtonBlockElement)
+		ids = append(ids, btn.ActionID)
+		var act SlackAction
+		require.NoError(t, json.Unmarshal([]byte(btn.Value), &act))
+		assert.Equal(t, SlackAction{SiteID: "remark", URL: "https://example.com/post1", CommentID: "999", UserID: "u1"}, act)
+	}
+	assert.Equal(t, []string{SlackActionDelete, SlackActionBlock1d, SlackActionBlock, SlackActionPin}, ids)
+}
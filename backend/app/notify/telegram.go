@@ -2,8 +2,8 @@ package notify
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
@@ -18,6 +18,7 @@ type TelegramParams struct {
 	Token                string        // token for telegram bot API interactions
 	Timeout              time.Duration // http client timeout
 	UserNotifications    bool          // flag which enables user notifications
+	Moderation           bool          // flag which adds moderation buttons to admin notifications
 	ErrorMsg, SuccessMsg string        // messages for successful and unsuccessful subscription requests to bot
 }
 
@@ -27,6 +28,7 @@ type Telegram struct {
 
 	AdminChannelID    string // unique identifier for the target chat or username of the target channel (in the format @channelusername)
 	UserNotifications bool   // flag which enables user notifications
+	Moderation        bool   // flag which adds moderation buttons to admin notifications, handled by TelegramModerator
 }
 
 // NewTelegram makes telegram bot for notifications
@@ -41,40 +43,42 @@ func NewTelegram(params TelegramParams) (*Telegram, error) {
 		return nil, err
 	}
 
-	return &Telegram{Telegram: client, AdminChannelID: params.AdminChannelID, UserNotifications: params.UserNotifications}, nil
+	return &Telegram{Telegram: client, AdminChannelID: params.AdminChannelID, UserNotifications: params.UserNotifications,
+		Moderation: params.Moderation}, nil
 }
 
 // Send to telegram recipients
 func (t *Telegram) Send(ctx context.Context, req Request) error {
 	log.Printf("[DEBUG] send telegram notification for comment ID %s", req.Comment.ID)
-	var errs []error
-
 	msg := t.buildMessage(req)
 
+	var recipients []string
 	if t.AdminChannelID != "" {
-		err := t.Telegram.Send(ctx, fmt.Sprintf("telegram:%s?parseMode=HTML", t.AdminChannelID), msg)
-		if err != nil {
-			errs = append(errs,
-				fmt.Errorf("problem sending admin telegram notification about comment ID %s to %s: %w",
-					req.Comment.ID, t.AdminChannelID, err,
-				),
-			)
-		}
+		recipients = append(recipients, adminRecipient+t.AdminChannelID)
 	}
-
 	if t.UserNotifications {
-		for _, user := range req.Telegrams {
-			err := t.Telegram.Send(ctx, fmt.Sprintf("telegram:%s?parseMode=HTML", user), msg)
+		recipients = append(recipients, req.Telegrams...)
+	}
+	return sendAll(req, recipients, func(recipient string) error {
+		if channel, ok := strings.CutPrefix(recipient, adminRecipient); ok {
+			var err error
+			if t.Moderation {
+				err = sendTelegramMessage(ctx, t.Telegram, channel, msg, telegramModerationKeyboard(req.Comment.ID))
+			} else {
+				err = t.Telegram.Send(ctx, fmt.Sprintf("telegram:%s?parseMode=HTML", channel), msg)
+			}
 			if err != nil {
-				errs = append(errs,
-					fmt.Errorf("problem sending user telegram notification about comment ID %s to %q: %w",
-						req.Comment.ID, user, err,
-					),
-				)
+				return fmt.Errorf("problem sending admin telegram notification about comment ID %s to %s: %w",
+					req.Comment.ID, channel, err)
 			}
+			return nil
 		}
-	}
-	return errors.Join(errs...)
+		if err := t.Telegram.Send(ctx, fmt.Sprintf("telegram:%s?parseMode=HTML", recipient), msg); err != nil {
+			return fmt.Errorf("problem sending user telegram notification about comment ID %s to %q: %w",
+				req.Comment.ID, recipient, err)
+		}
+		return nil
+	})
 }
 
 // buildMessage generates message for generic notification about new comment
@@ -0,0 +1,413 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pkgz/lcw/v2"
+	log "github.com/go-pkgz/lgr"
+	ntf "github.com/go-pkgz/notify"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// actions of moderation buttons, callback data of the button is "<action>:<comment id>"
+const (
+	tgActionDelete   = "delete"
+	tgActionBlock    = "block"
+	tgActionVerify   = "verify"
+	tgActionReadOnly = "readonly"
+)
+
+const tgModerationHelp = `Moderation commands:
+/last [n] - last n comments, 5 by default
+/block &lt;user id&gt; [duration] - block user on all sites, permanently if duration (e.g. 24h) not set
+/unblock &lt;user id&gt; - unblock user on all sites
+/readonly &lt;post url&gt; [off] - make post read-only, or writable with "off"`
+
+// ModerationStore defines data operations used to look up targets of moderation, implemented by service.DataStore
+type ModerationStore interface {
+	Get(locator store.Locator, commentID string, user store.User) (store.Comment, error)
+	Last(siteID string, limit int, since time.Time, user store.User) ([]store.Comment, error)
+	Info(locator store.Locator, readonlyAge int) (store.PostInfo, error)
+}
+
+// Moderator makes moderation actions on behalf of the actor the same way as admin api,
+// with audit log and notifications, implemented by moderation.Service
+type Moderator interface {
+	DeleteComment(actor store.User, locator store.Locator, commentID string) error
+	SetBlock(actor store.User, siteID, userID string, status bool, ttl time.Duration) error
+	SetVerified(actor store.User, siteID, userID string, status bool) error
+	SetReadOnly(actor store.User, locator store.Locator, status bool) error
+}
+
+// TelegramModeratorParams contain settings for moderation with telegram bot
+type TelegramModeratorParams struct {
+	AdminChats []string // ids of users and group chats allowed to moderate, all members of the group chat are allowed
+	Sites      []string // sites to look for comments, users and posts
+	Store      ModerationStore
+	Moderator  Moderator
+	Cache      interface{ Flush(req lcw.FlusherRequest) } // cache of rest api, flushed for the site on each change
+}
+
+// TelegramModerator handles moderation commands and buttons of admin notifications received by telegram bot.
+// Accepts them from admin chats only and makes changes with the moderator on behalf of telegram user.
+type TelegramModerator struct {
+	TelegramModeratorParams
+
+	tg        *Telegram   // formats messages the same way as notifications
+	requester tgRequester // telegram api
+}
+
+type tgRequester interface {
+	Request(ctx context.Context, method string, b []byte, data any) error
+}
+
+// tgUpdates is a part of telegram updates used for moderation
+type tgUpdates struct {
+	Result []struct {
+		UpdateID      int              `json:"update_id"`
+		Message       *tgMessage       `json:"message"`
+		CallbackQuery *tgCallbackQuery `json:"callback_query"`
+	} `json:"result"`
+}
+
+type tgMessage struct {
+	Chat struct {
+		ID   int64  `json:"id"`
+		Type string `json:"type"`
+	} `json:"chat"`
+	From     tgUser `json:"from"`
+	Text     string `json:"text"`
+	Entities []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"entities"`
+}
+
+type tgCallbackQuery struct {
+	ID      string     `json:"id"`
+	From    tgUser     `json:"from"`
+	Message *tgMessage `json:"message"`
+	Data    string     `json:"data"`
+}
+
+type tgUser struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	FirstName string `json:"first_name"`
+}
+
+type tgKeyboard struct {
+	InlineKeyboard [][]tgButton `json:"inline_keyboard"`
+}
+
+type tgButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// NewTelegramModerator makes moderator using bot of telegram notifications
+func NewTelegramModerator(tg *Telegram, params TelegramModeratorParams) *TelegramModerator {
+	log.Printf("[DEBUG] create new telegram moderator for chats %v, sites %v", params.AdminChats, params.Sites)
+	return &TelegramModerator{TelegramModeratorParams: params, tg: tg, requester: tg.Telegram}
+}
+
+// ProcessUpdate handles moderation commands and button presses of the telegram update, ignores everything else
+func (m *TelegramModerator) ProcessUpdate(ctx context.Context, textUpdate string) error {
+	var updates tgUpdates
+	if err := json.Unmarshal([]byte(textUpdate), &updates); err != nil {
+		return fmt.Errorf("failed to decode provided telegram update: %w", err)
+	}
+	for _, u := range updates.Result {
+		switch {
+		case u.CallbackQuery != nil:
+			m.processButton(ctx, *u.CallbackQuery)
+		case u.Message != nil && strings.HasPrefix(u.Message.Text, "/"):
+			m.processCommand(ctx, *u.Message)
+		}
+	}
+	return nil
+}
+
+func (m *TelegramModerator) String() string {
+	return "telegram moderator for chats " + strings.Join(m.AdminChats, ",")
+}
+
+// processButton makes action of the pressed moderation button and shows its result to the user
+func (m *TelegramModerator) processButton(ctx context.Context, q tgCallbackQuery) {
+	if q.Message == nil || !m.allowed(*q.Message, q.From) {
+		log.Printf("[WARN] telegram moderation rejected for user %d, not in admin chats", q.From.ID)
+		m.answer(ctx, q.ID, "not allowed")
+		return
+	}
+	action, commentID, _ := strings.Cut(q.Data, ":")
+	log.Printf("[INFO] telegram moderation %s for comment %s by user %d", action, commentID, q.From.ID)
+	result, err := m.buttonAction(q.From, action, commentID, q.Message.postURL(commentID))
+	if err != nil {
+		log.Printf("[WARN] telegram moderation %s for comment %s failed, %v", action, commentID, err)
+		result = fmt.Sprintf("%s failed: %v", action, err)
+	}
+	m.answer(ctx, q.ID, result)
+}
+
+func (m *TelegramModerator) buttonAction(from tgUser, action, commentID, postURL string) (string, error) {
+	comment, err := m.findComment(commentID, postURL)
+	if err != nil {
+		return "", err
+	}
+	locator, userID, actor := comment.Locator, comment.User.ID, from.actor()
+	switch action {
+	case tgActionDelete:
+		if err = m.Moderator.DeleteComment(actor, locator, commentID); err != nil {
+			return "", err
+		}
+		m.flush(locator.SiteID)
+		return "comment deleted", nil
+	case tgActionBlock:
+		if err = m.Moderator.SetBlock(actor, locator.SiteID, userID, true, 0); err != nil {
+			return "", err
+		}
+		m.flush(locator.SiteID)
+		return fmt.Sprintf("user %s blocked", comment.User.Name), nil
+	case tgActionVerify:
+		if err = m.Moderator.SetVerified(actor, locator.SiteID, userID, true); err != nil {
+			return "", err
+		}
+		m.flush(locator.SiteID)
+		return fmt.Sprintf("user %s verified", comment.User.Name), nil
+	case tgActionReadOnly:
+		if err = m.Moderator.SetReadOnly(actor, locator, true); err != nil {
+			return "", err
+		}
+		m.flush(locator.SiteID)
+		return "post is read-only", nil
+	}
+	return "", errors.New("unknown action")
+}
+
+// processCommand runs moderation command, commands not related to moderation are ignored
+func (m *TelegramModerator) processCommand(ctx context.Context, msg tgMessage) {
+	args := strings.Fields(msg.Text)
+	cmd, _, _ := strings.Cut(args[0], "@") // commands in group chats can be addressed as /cmd@bot_name
+	if !slices.Contains([]string{"/last", "/block", "/unblock", "/readonly", "/help"}, cmd) {
+		return
+	}
+	if !m.allowed(msg, msg.From) {
+		log.Printf("[WARN] telegram command %s rejected for user %d, not in admin chats", cmd, msg.From.ID)
+		return
+	}
+	log.Printf("[INFO] telegram command %q by user %d", msg.Text, msg.From.ID)
+
+	chatID := strconv.FormatInt(msg.Chat.ID, 10)
+	var reply string
+	var err error
+	switch cmd {
+	case "/last":
+		if err = m.last(ctx, chatID, args[1:]); err == nil {
+			return
+		}
+	case "/block":
+		reply, err = m.blockCmd(msg.From, args[1:], true)
+	case "/unblock":
+		reply, err = m.blockCmd(msg.From, args[1:], false)
+	case "/readonly":
+		reply, err = m.readOnlyCmd(msg.From, args[1:])
+	case "/help":
+		reply = tgModerationHelp
+	}
+	if err != nil {
+		reply = "❌ " + ntf.EscapeTelegramText(err.Error())
+	}
+	if err = sendTelegramMessage(ctx, m.requester, chatID, reply, nil); err != nil {
+		log.Printf("[WARN] can't reply to telegram command %s, %v", cmd, err)
+	}
+}
+
+// last sends n last comments of all sites, with moderation buttons, oldest first
+func (m *TelegramModerator) last(ctx context.Context, chatID string, args []string) error {
+	limit := 5
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("bad number of comments %q", args[0])
+		}
+		limit = min(n, 20)
+	}
+
+	var comments []store.Comment
+	for _, siteID := range m.Sites {
+		res, err := m.Store.Last(siteID, limit, time.Time{}, store.User{Admin: true})
+		if err != nil {
+			return fmt.Errorf("can't get last comments of %s: %w", siteID, err)
+		}
+		comments = append(comments, res...)
+	}
+	if len(comments) == 0 {
+		return errors.New("no comments")
+	}
+	sort.Slice(comments, func(i, j int) bool { return comments[i].Timestamp.After(comments[j].Timestamp) })
+	comments = comments[:min(limit, len(comments))]
+
+	for _, c := range slices.Backward(comments) {
+		req := Request{Comment: c}
+		if c.ParentID != "" {
+			if parent, err := m.Store.Get(c.Locator, c.ParentID, store.User{Admin: true}); err == nil {
+				req.parent = parent
+			}
+		}
+		if err := sendTelegramMessage(ctx, m.requester, chatID, m.tg.buildMessage(req), telegramModerationKeyboard(c.ID)); err != nil {
+			return fmt.Errorf("can't send comment %s: %w", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// blockCmd blocks or unblocks user on all sites
+func (m *TelegramModerator) blockCmd(from tgUser, args []string, status bool) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("user id is required")
+	}
+	userID, ttl := args[0], time.Duration(0)
+	if status && len(args) > 1 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return "", fmt.Errorf("bad duration %q", args[1])
+		}
+		ttl = d
+	}
+	for _, siteID := range m.Sites {
+		if err := m.Moderator.SetBlock(from.actor(), siteID, userID, status, ttl); err != nil {
+			return "", fmt.Errorf("can't change block status on %s: %w", siteID, err)
+		}
+		m.flush(siteID)
+	}
+	switch {
+	case !status:
+		return fmt.Sprintf("user %s unblocked", ntf.EscapeTelegramText(userID)), nil
+	case ttl > 0:
+		return fmt.Sprintf("user %s blocked for %s", ntf.EscapeTelegramText(userID), ttl), nil
+	}
+	return fmt.Sprintf("user %s blocked permanently", ntf.EscapeTelegramText(userID)), nil
+}
+
+// readOnlyCmd changes read-only status of the post on all sites having it
+func (m *TelegramModerator) readOnlyCmd(from tgUser, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("post url is required")
+	}
+	status := len(args) < 2 || args[1] != "off"
+	found := false
+	for _, siteID := range m.Sites {
+		locator := store.Locator{SiteID: siteID, URL: args[0]}
+		if _, err := m.Store.Info(locator, 0); err != nil {
+			continue
+		}
+		if err := m.Moderator.SetReadOnly(from.actor(), locator, status); err != nil {
+			return "", fmt.Errorf("can't change read-only status on %s: %w", siteID, err)
+		}
+		m.flush(siteID)
+		found = true
+	}
+	if !found {
+		return "", fmt.Errorf("post %s not found", args[0])
+	}
+	if !status {
+		return fmt.Sprintf("post %s is writable", ntf.EscapeTelegramText(args[0])), nil
+	}
+	return fmt.Sprintf("post %s is read-only", ntf.EscapeTelegramText(args[0])), nil
+}
+
+// findComment looks for the comment of the post on all sites
+func (m *TelegramModerator) findComment(commentID, postURL string) (store.Comment, error) {
+	if postURL == "" {
+		return store.Comment{}, errors.New("no link to the comment in the message")
+	}
+	for _, siteID := range m.Sites {
+		if c, err := m.Store.Get(store.Locator{SiteID: siteID, URL: postURL}, commentID, store.User{Admin: true}); err == nil {
+			return c, nil
+		}
+	}
+	return store.Comment{}, fmt.Errorf("comment %s not found", commentID)
+}
+
+// flush flushes cache of the site changed by moderation action
+func (m *TelegramModerator) flush(siteID string) {
+	m.Cache.Flush(lcw.Flusher(siteID))
+}
+
+// allowed checks if user or chat of the message is one of admin chats. Channel itself doesn't give access,
+// as all its subscribers can press the buttons
+func (m *TelegramModerator) allowed(msg tgMessage, from tgUser) bool {
+	if slices.Contains(m.AdminChats, strconv.FormatInt(from.ID, 10)) {
+		return true
+	}
+	return msg.Chat.Type != "channel" && slices.Contains(m.AdminChats, strconv.FormatInt(msg.Chat.ID, 10))
+}
+
+// answer shows result of button press to the user
+func (m *TelegramModerator) answer(ctx context.Context, queryID, text string) {
+	b, err := json.Marshal(struct {
+		ID   string `json:"callback_query_id"`
+		Text string `json:"text"`
+	}{ID: queryID, Text: text})
+	if err != nil {
+		log.Printf("[WARN] can't marshal telegram callback answer, %v", err)
+		return
+	}
+	if err = m.requester.Request(ctx, "answerCallbackQuery", b, &struct{}{}); err != nil {
+		log.Printf("[WARN] can't answer telegram callback, %v", err)
+	}
+}
+
+// actor returns telegram user as the actor of moderation actions, recorded in the audit log as "telegram_<user id>"
+func (u tgUser) actor() store.User {
+	name := u.Username
+	if name == "" {
+		name = u.FirstName
+	}
+	return store.User{ID: "telegram_" + strconv.FormatInt(u.ID, 10), Name: name, Admin: true}
+}
+
+// postURL returns url of the post from the link to the comment in the message, empty if not found
+func (msg tgMessage) postURL(commentID string) string {
+	for _, e := range msg.Entities {
+		if e.Type == "text_link" && strings.HasSuffix(e.URL, uiNav+commentID) {
+			return strings.TrimSuffix(e.URL, uiNav+commentID)
+		}
+	}
+	return ""
+}
+
+// telegramModerationKeyboard returns moderation buttons for the comment
+func telegramModerationKeyboard(commentID string) *tgKeyboard {
+	button := func(text, action string) tgButton {
+		return tgButton{Text: text, CallbackData: action + ":" + commentID}
+	}
+	return &tgKeyboard{InlineKeyboard: [][]tgButton{
+		{button("🗑 Delete", tgActionDelete), button("⛔ Block user", tgActionBlock)},
+		{button("✅ Verify user", tgActionVerify), button("🔒 Read-only post", tgActionReadOnly)},
+	}}
+}
+
+// sendTelegramMessage sends html message to the chat, with buttons if keyboard set
+func sendTelegramMessage(ctx context.Context, requester tgRequester, chatID, text string, keyboard *tgKeyboard) error {
+	b, err := json.Marshal(struct {
+		ChatID                string      `json:"chat_id"`
+		Text                  string      `json:"text"`
+		ParseMode             string      `json:"parse_mode"`
+		DisableWebPagePreview bool        `json:"disable_web_page_preview"`
+		ReplyMarkup           *tgKeyboard `json:"reply_markup,omitempty"`
+	}{ChatID: chatID, Text: text, ParseMode: "HTML", DisableWebPagePreview: true, ReplyMarkup: keyboard})
+	if err != nil {
+		return fmt.Errorf("can't marshal telegram message: %w", err)
+	}
+	return requester.Request(ctx, "sendMessage", b, &struct{}{})
+}
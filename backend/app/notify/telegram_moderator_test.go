@@ -0,0 +1,244 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-pkgz/lcw/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/admin"
+	"github.com/umputun/remark42/backend/app/store/engine"
+	"github.com/umputun/remark42/backend/app/store/service"
+)
+
+func TestTelegramModerator_Buttons(t *testing.T) {
+	m, ds, requester := prepModerator(t)
+	id := createComment(t, ds, "user1")
+
+	press := func(data string, fromID, chatID int64, chatType string) string {
+		update := fmt.Sprintf(`{"ok": true, "result": [{"update_id": 1, "callback_query": {"id": "q1", "from": {"id": %d, "username": "moder"},
+			"message": {"chat": {"id": %d, "type": %q}, "text": "user1", "entities": [{"type": "text_link", "url": "https://example.com/post1#remark42__comment-%s"}]},
+			"data": %q}}]}`, fromID, chatID, chatType, id, data)
+		require.NoError(t, m.ProcessUpdate(context.Background(), update))
+		calls := requester.get()
+		require.NotEmpty(t, calls)
+		assert.Equal(t, "answerCallbackQuery", calls[len(calls)-1].method)
+		return calls[len(calls)-1].body["text"].(string)
+	}
+
+	assert.Equal(t, "not allowed", press("verify:"+id, 5, -300, "channel"), "user not listed")
+	assert.Equal(t, "not allowed", press("verify:"+id, 5, -100, "channel"), "listed channel doesn't give access to subscribers")
+	assert.False(t, ds.IsVerified("remark", "user1"))
+
+	assert.Equal(t, "user user1 verified", press("verify:"+id, 5, -200, "supergroup"), "member of admin group")
+	assert.True(t, ds.IsVerified("remark", "user1"))
+	assert.Equal(t, "post is read-only", press("readonly:"+id, 100, -300, "channel"), "admin user in any chat")
+	assert.True(t, ds.IsReadOnly(store.Locator{SiteID: "remark", URL: "https://example.com/post1"}))
+	assert.Equal(t, "comment deleted", press("delete:"+id, 100, 100, "private"))
+	c, err := ds.Get(store.Locator{SiteID: "remark", URL: "https://example.com/post1"}, id, store.User{})
+	require.NoError(t, err)
+	assert.True(t, c.Deleted)
+	assert.Equal(t, "user user1 blocked", press("block:"+id, 100, 100, "private"))
+	assert.True(t, ds.IsBlocked("remark", "user1"))
+	assert.Equal(t, "unknown failed: unknown action", press("unknown:"+id, 100, 100, "private"))
+	assert.Equal(t, "delete failed: no link to the comment in the message", press("delete:bad-id", 100, 100, "private"))
+
+	actions := m.Moderator.(*mockModerator).get()
+	require.Len(t, actions, 4)
+	assert.Equal(t, []string{"verify", "readonly", "delete", "block"},
+		[]string{actions[0].action, actions[1].action, actions[2].action, actions[3].action})
+	assert.Equal(t, store.User{ID: "telegram_5", Name: "moder", Admin: true}, actions[0].actor)
+	assert.Equal(t, 4, m.Cache.(*mockFlusher).count())
+}
+
+func TestTelegramModerator_Commands(t *testing.T) {
+	m, ds, requester := prepModerator(t)
+	id1 := createComment(t, ds, "user1")
+	time.Sleep(time.Millisecond) // comments ordered by time
+	id2 := createComment(t, ds, "user2")
+
+	command := func(text string, fromID int64) []tgCall {
+		update := fmt.Sprintf(`{"ok": true, "result": [{"update_id": 1, "message": {"chat": {"id": %d, "type": "private"},
+			"from": {"id": %d, "first_name": "Moder"}, "text": %q}}]}`, fromID, fromID, text)
+		before := len(requester.get())
+		require.NoError(t, m.ProcessUpdate(context.Background(), update))
+		return requester.get()[before:]
+	}
+	reply := func(text string) string {
+		calls := command(text, 100)
+		require.Len(t, calls, 1, text)
+		assert.Equal(t, "sendMessage", calls[0].method)
+		assert.Equal(t, "100", calls[0].body["chat_id"])
+		return calls[0].body["text"].(string)
+	}
+
+	assert.Empty(t, command("/block user1", 5), "not allowed user ignored")
+	assert.Empty(t, command("/start token", 100), "not moderation command")
+	assert.False(t, ds.IsBlocked("remark", "user1"))
+
+	calls := command("/last 2", 100)
+	require.Len(t, calls, 2)
+	assert.Contains(t, calls[0].body["text"], "#remark42__comment-"+id1, "oldest first")
+	assert.Contains(t, calls[1].body["text"], "#remark42__comment-"+id2)
+	keyboard := calls[1].body["reply_markup"].(map[string]any)["inline_keyboard"].([]any)
+	require.Len(t, keyboard, 2)
+	assert.Equal(t, "delete:"+id2, keyboard[0].([]any)[0].(map[string]any)["callback_data"])
+	require.Len(t, command("/last@remark_bot 1", 100), 1)
+	assert.Equal(t, `❌ bad number of comments "abc"`, reply("/last abc"))
+
+	assert.Equal(t, "user user1 blocked for 24h0m0s", reply("/block user1 24h"))
+	assert.True(t, ds.IsBlocked("remark", "user1"))
+	assert.Equal(t, "user user1 unblocked", reply("/unblock user1"))
+	assert.False(t, ds.IsBlocked("remark", "user1"))
+	assert.Equal(t, "user user2 blocked permanently", reply("/block user2"))
+	assert.True(t, ds.IsBlocked("remark", "user2"))
+	assert.Equal(t, "❌ user id is required", reply("/block"))
+	assert.Equal(t, `❌ bad duration "1x"`, reply("/block user1 1x"))
+
+	locator := store.Locator{SiteID: "remark", URL: "https://example.com/post1"}
+	assert.Equal(t, "post https://example.com/post1 is read-only", reply("/readonly https://example.com/post1"))
+	assert.True(t, ds.IsReadOnly(locator))
+	assert.Equal(t, "post https://example.com/post1 is writable", reply("/readonly https://example.com/post1 off"))
+	assert.False(t, ds.IsReadOnly(locator))
+	assert.Equal(t, "❌ post https://example.com/bad not found", reply("/readonly https://example.com/bad"))
+	assert.Equal(t, tgModerationHelp, reply("/help"))
+
+	actions := m.Moderator.(*mockModerator).get()
+	require.Len(t, actions, 5)
+	assert.Equal(t, store.User{ID: "telegram_100", Name: "Moder", Admin: true}, actions[4].actor)
+}
+
+func TestTelegram_ModerationKeyboard(t *testing.T) {
+	requester := &mockRequester{}
+	require.NoError(t, sendTelegramMessage(context.Background(), requester, "-100", "<b>text</b>", telegramModerationKeyboard("123")))
+	calls := requester.get()
+	require.Len(t, calls, 1)
+	body, err := json.Marshal(calls[0].body)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"chat_id": "-100", "text": "<b>text</b>", "parse_mode": "HTML", "disable_web_page_preview": true,
+		"reply_markup": {"inline_keyboard": [
+			[{"text": "🗑 Delete", "callback_data": "delete:123"}, {"text": "⛔ Block user", "callback_data": "block:123"}],
+			[{"text": "✅ Verify user", "callback_data": "verify:123"}, {"text": "🔒 Read-only post", "callback_data": "readonly:123"}]
+		]}}`, string(body))
+}
+
+func prepModerator(t *testing.T) (*TelegramModerator, *service.DataStore, *mockRequester) {
+	b, err := engine.NewBoltDB(bolt.Options{}, engine.BoltSite{FileName: filepath.Join(t.TempDir(), "test.db"), SiteID: "remark"})
+	require.NoError(t, err)
+	ds := &service.DataStore{Engine: b, AdminStore: admin.NewStaticStore("secret", []string{"remark"}, nil, ""), MaxCommentSize: 1000}
+	t.Cleanup(func() { _ = ds.Close() })
+
+	requester := &mockRequester{}
+	m := &TelegramModerator{
+		TelegramModeratorParams: TelegramModeratorParams{AdminChats: []string{"100", "-200", "-100"}, Sites: []string{"remark"},
+			Store: ds, Moderator: &mockModerator{ds: ds}, Cache: &mockFlusher{}},
+		tg:        &Telegram{},
+		requester: requester,
+	}
+	assert.Equal(t, "telegram moderator for chats 100,-200,-100", m.String())
+	return m, ds, requester
+}
+
+func createComment(t *testing.T, ds *service.DataStore, userID string) string {
+	id, err := ds.Create(store.Comment{Text: "comment of " + userID, Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post1"},
+		User: store.User{ID: userID, Name: userID}})
+	require.NoError(t, err)
+	return id
+}
+
+type tgCall struct {
+	method string
+	body   map[string]any
+}
+
+type mockRequester struct {
+	mu    sync.Mutex
+	calls []tgCall
+}
+
+func (m *mockRequester) Request(_ context.Context, method string, b []byte, _ any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	call := tgCall{method: method}
+	if err := json.Unmarshal(b, &call.body); err != nil {
+		return err
+	}
+	m.calls = append(m.calls, call)
+	return nil
+}
+
+func (m *mockRequester) get() []tgCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]tgCall{}, m.calls...)
+}
+
+type mockFlusher struct {
+	mu      sync.Mutex
+	flushes int
+}
+
+func (m *mockFlusher) Flush(lcw.FlusherRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flushes++
+}
+
+func (m *mockFlusher) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.flushes
+}
+
+type moderatorCall struct {
+	action string
+	actor  store.User
+}
+
+// mockModerator makes moderation actions with the store directly and records them with the actor
+type mockModerator struct {
+	ds    *service.DataStore
+	mu    sync.Mutex
+	calls []moderatorCall
+}
+
+func (m *mockModerator) DeleteComment(actor store.User, locator store.Locator, commentID string) error {
+	m.add("delete", actor)
+	return m.ds.Delete(locator, commentID, store.SoftDelete)
+}
+
+func (m *mockModerator) SetBlock(actor store.User, siteID, userID string, status bool, ttl time.Duration) error {
+	m.add("block", actor)
+	return m.ds.SetBlock(siteID, userID, status, ttl)
+}
+
+func (m *mockModerator) SetVerified(actor store.User, siteID, userID string, status bool) error {
+	m.add("verify", actor)
+	return m.ds.SetVerified(siteID, userID, status)
+}
+
+func (m *mockModerator) SetReadOnly(actor store.User, locator store.Locator, status bool) error {
+	m.add("readonly", actor)
+	return m.ds.SetReadOnly(locator, status)
+}
+
+func (m *mockModerator) add(action string, actor store.User) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, moderatorCall{action: action, actor: actor})
+}
+
+func (m *mockModerator) get() []moderatorCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]moderatorCall{}, m.calls...)
+}
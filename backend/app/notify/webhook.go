@@ -3,25 +3,41 @@ package notify
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"slices"
 	"text/template"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
 	ntf "github.com/go-pkgz/notify"
+
+	"github.com/umputun/remark42/backend/app/store"
 )
 
 const (
 	webhookDefaultTemplate = `{"text": {{.Text | escapeJSONString}}}`
 )
 
+// headers set for each webhook request
+const (
+	WebhookEventHeader     = "X-Remark42-Event"
+	WebhookSignatureHeader = "X-Remark42-Signature" // in format "t=<unix timestamp>,sha256=<hex signature>"
+)
+
 // WebhookParams contain settings for webhook notifications
 type WebhookParams struct {
 	URL      string
 	Template string
 	Headers  []string
 	Timeout  time.Duration
+	JSON     bool     // send structured json payload of the event instead of template
+	Secret   string   // secret to sign payload with, not signed if empty
+	Events   []Event  // events sent to webhook, new comments only if empty
+	Sites    []string // sites with events sent to webhook, all if empty
 }
 
 // Webhook implements notify.Destination for Webhook notifications
@@ -30,6 +46,20 @@ type Webhook struct {
 
 	url      string
 	template *template.Template
+	json     bool
+	secret   string
+	events   []Event
+	sites    []string
+}
+
+// webhookPayload is the structured json payload of the webhook
+type webhookPayload struct {
+	Event    Event          `json:"event"`
+	Locator  store.Locator  `json:"locator"`
+	Comment  *store.Comment `json:"comment,omitempty"`   // not set for block and readonly events
+	User     *store.User    `json:"user,omitempty"`      // blocked or unblocked user, for block event
+	Vote     int            `json:"vote,omitempty"`      // +1 or -1, for vote event
+	ReadOnly *bool          `json:"read_only,omitempty"` // read-only status of the post, for readonly event
 }
 
 // NewWebhook makes Webhook
@@ -39,13 +69,26 @@ func NewWebhook(params WebhookParams) (*Webhook, error) {
 			Timeout: params.Timeout,
 			Headers: params.Headers,
 		}),
-		url: params.URL,
+		url:    params.URL,
+		json:   params.JSON,
+		secret: params.Secret,
+		events: params.Events,
+		sites:  params.Sites,
 	}
 
 	if res.url == "" {
 		return nil, fmt.Errorf("webhook URL is required for webhook notifications")
 	}
 
+	if len(res.events) == 0 {
+		res.events = []Event{EventCreate}
+	}
+	for _, e := range res.events {
+		if !slices.Contains(Events, e) {
+			return nil, fmt.Errorf("unknown webhook event %q", e)
+		}
+	}
+
 	if params.Template == "" {
 		params.Template = webhookDefaultTemplate
 	}
@@ -57,21 +100,31 @@ func NewWebhook(params WebhookParams) (*Webhook, error) {
 
 	res.template = payloadTmpl
 
-	log.Printf("[DEBUG] create new webhook notifier for %s", res.url)
+	log.Printf("[DEBUG] create new webhook notifier for %s, events %v", res.url, res.events)
 
 	return res, nil
 }
 
+// Accepts checks if the event and the site of request are ones webhook is subscribed to
+func (w *Webhook) Accepts(req Request) bool {
+	if !slices.Contains(w.events, req.event()) {
+		return false
+	}
+	return len(w.sites) == 0 || slices.Contains(w.sites, req.Comment.Locator.SiteID)
+}
+
 // Send sends Webhook notification
 func (w *Webhook) Send(ctx context.Context, req Request) error {
-	log.Printf("[DEBUG] send webhook notification, comment id %s", req.Comment.ID)
-	var payload bytes.Buffer
-	err := w.template.Execute(&payload, req.Comment)
+	log.Printf("[DEBUG] send webhook %s notification, comment id %s", req.event(), req.Comment.ID)
+	payload, err := w.payload(req)
 	if err != nil {
-		return fmt.Errorf("unable to compile webhook template: %w", err)
+		return err
 	}
 
-	return w.Webhook.Send(ctx, w.url, payload.String())
+	// copy of the client sharing http client, with headers of this request
+	wh := *w.Webhook
+	wh.Headers = w.headers(req, payload, time.Now())
+	return wh.Send(ctx, w.url, payload)
 }
 
 // SendVerification is not implemented for Webhook
@@ -84,6 +137,64 @@ func (w *Webhook) String() string {
 	return fmt.Sprintf("%s to %s", w.Webhook.String(), w.url)
 }
 
+// Key identifies webhook in the notification outbox by its url, so more than one webhook can be configured
+func (w *Webhook) Key() string {
+	h := sha256.Sum256([]byte(w.url))
+	return "webhook-" + hex.EncodeToString(h[:8])
+}
+
+// payload makes json payload of the request, or executes the template with the comment
+func (w *Webhook) payload(req Request) (string, error) {
+	if !w.json {
+		var payload bytes.Buffer
+		if err := w.template.Execute(&payload, req.Comment); err != nil {
+			return "", fmt.Errorf("unable to compile webhook template: %w", err)
+		}
+		return payload.String(), nil
+	}
+
+	p := webhookPayload{Event: req.event(), Locator: req.Comment.Locator}
+	switch req.event() {
+	case EventBlock:
+		p.User = &req.User
+	case EventReadOnly:
+		p.ReadOnly = &req.ReadOnly
+	default:
+		c := req.Comment
+		c.Votes, c.VotedIPs = nil, nil // voters are not exposed
+		p.Comment = &c
+		p.Vote = req.Vote
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal webhook payload: %w", err)
+	}
+	return string(data), nil
+}
+
+// headers returns headers of the webhook request, with event type and signature of payload if secret set
+func (w *Webhook) headers(req Request, payload string, ts time.Time) []string {
+	res := make([]string, 0, len(w.Headers)+3)
+	if w.json {
+		res = append(res, "Content-Type:application/json") // can be overridden by user's headers
+	}
+	res = append(res, w.Headers...)
+	res = append(res, WebhookEventHeader+":"+string(req.event()))
+	if w.secret != "" {
+		res = append(res, WebhookSignatureHeader+":"+WebhookSignature(w.secret, ts, payload))
+	}
+	return res
+}
+
+// WebhookSignature returns signature of webhook payload sent at ts, in format "t=<unix timestamp>,sha256=<hex signature>".
+// Signature is HMAC-SHA256 of "<unix timestamp>.<payload>" with the secret. The receiver expected to calculate it
+// the same way, compare with hmac.Equal and reject requests with timestamp too old, to prevent replays.
+func WebhookSignature(secret string, ts time.Time, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.%s", ts.Unix(), payload)
+	return fmt.Sprintf("t=%d,sha256=%s", ts.Unix(), hex.EncodeToString(mac.Sum(nil)))
+}
+
 // escapeJSONString escapes string for JSON
 func escapeJSONString(s string) (string, error) {
 	b, err := json.Marshal(s)
@@ -2,9 +2,16 @@ package notify
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -116,3 +123,86 @@ func TestWebhook_String(t *testing.T) {
 	str := wh.String()
 	assert.Equal(t, "webhook notification with timeout 5m0s to https://example.org/webhook", str)
 }
+
+func TestWebhook_SendJSONSigned(t *testing.T) {
+	var headers []http.Header
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		headers = append(headers, r.Header)
+		bodies = append(bodies, string(body))
+	}))
+	defer ts.Close()
+
+	wh, err := NewWebhook(WebhookParams{URL: ts.URL, JSON: true, Secret: "secret123", Headers: []string{"X-Custom:val"},
+		Events: []Event{EventCreate, EventBlock, EventReadOnly}})
+	require.NoError(t, err)
+
+	c := store.Comment{ID: "999", Text: "some text", Locator: store.Locator{SiteID: "remark", URL: "https://example.com/post"},
+		User: store.User{ID: "u1", Name: "user1"}, Votes: map[string]bool{"u2": true}}
+	require.NoError(t, wh.Send(context.Background(), Request{Comment: c}))
+	require.NoError(t, wh.Send(context.Background(), Request{Event: EventBlock, Comment: store.Comment{Locator: store.Locator{SiteID: "remark"}},
+		User: store.User{ID: "u1", Blocked: true}}))
+	require.NoError(t, wh.Send(context.Background(), Request{Event: EventReadOnly, Comment: store.Comment{Locator: c.Locator}, ReadOnly: true}))
+	require.Len(t, bodies, 3)
+
+	var payload struct {
+		Event    Event          `json:"event"`
+		Locator  store.Locator  `json:"locator"`
+		Comment  *store.Comment `json:"comment"`
+		User     *store.User    `json:"user"`
+		ReadOnly *bool          `json:"read_only"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(bodies[0]), &payload))
+	assert.Equal(t, EventCreate, payload.Event)
+	assert.Equal(t, c.Locator, payload.Locator)
+	require.NotNil(t, payload.Comment)
+	assert.Equal(t, "999", payload.Comment.ID)
+	assert.Equal(t, "some text", payload.Comment.Text)
+	assert.Empty(t, payload.Comment.Votes)
+	assert.Nil(t, payload.User)
+	assert.Equal(t, "application/json", headers[0].Get("Content-Type"))
+	assert.Equal(t, "val", headers[0].Get("X-Custom"))
+	assert.Equal(t, "create", headers[0].Get(WebhookEventHeader))
+
+	// signature checked the way receiver does it
+	sig := headers[0].Get(WebhookSignatureHeader)
+	var sigTS int64
+	var sigHex string
+	_, err = fmt.Sscanf(strings.ReplaceAll(sig, ",", " "), "t=%d sha256=%s", &sigTS, &sigHex)
+	require.NoError(t, err, sig)
+	assert.InDelta(t, time.Now().Unix(), sigTS, 5)
+	mac := hmac.New(sha256.New, []byte("secret123"))
+	mac.Write([]byte(strconv.FormatInt(sigTS, 10) + "." + bodies[0]))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), sigHex)
+
+	assert.JSONEq(t, `{"event":"block","locator":{"site":"remark","url":""},"user":{"name":"","id":"u1","picture":"","admin":false,"block":true}}`,
+		bodies[1])
+	assert.Equal(t, "block", headers[1].Get(WebhookEventHeader))
+	assert.JSONEq(t, `{"event":"readonly","locator":{"site":"remark","url":"https://example.com/post"},"read_only":true}`, bodies[2])
+}
+
+func TestWebhook_Accepts(t *testing.T) {
+	_, err := NewWebhook(WebhookParams{URL: "https://example.org/webhook", Events: []Event{"bad"}})
+	assert.EqualError(t, err, `unknown webhook event "bad"`)
+
+	wh, err := NewWebhook(WebhookParams{URL: "https://example.org/webhook"})
+	require.NoError(t, err)
+	assert.True(t, wh.Accepts(Request{}), "new comments by default")
+	assert.True(t, wh.Accepts(Request{Event: EventCreate}))
+	assert.False(t, wh.Accepts(Request{Event: EventEdit}))
+
+	wh, err = NewWebhook(WebhookParams{URL: "https://example.org/webhook", Events: []Event{EventEdit, EventVote}, Sites: []string{"s1", "s2"}})
+	require.NoError(t, err)
+	assert.False(t, wh.Accepts(Request{Comment: store.Comment{Locator: store.Locator{SiteID: "s1"}}}))
+	assert.True(t, wh.Accepts(Request{Event: EventEdit, Comment: store.Comment{Locator: store.Locator{SiteID: "s1"}}}))
+	assert.True(t, wh.Accepts(Request{Event: EventVote, Comment: store.Comment{Locator: store.Locator{SiteID: "s2"}}}))
+	assert.False(t, wh.Accepts(Request{Event: EventVote, Comment: store.Comment{Locator: store.Locator{SiteID: "s3"}}}))
+}
+
+func TestWebhookSignature(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, "t=1704164645,sha256=18d1adeabd7d1271e38b77a895283687c0565fdd8d8b19eb28e7958d8b9f7611",
+		WebhookSignature("secret", ts, `{"event":"create"}`))
+}
@@ -0,0 +1,344 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/umputun/remark42/backend/app/safehttp"
+)
+
+// WebPushParams contain settings for web push notifications
+type WebPushParams struct {
+	VAPIDPrivateKey string        // base64url encoded P-256 private key of VAPID key pair, public key derived from it
+	Subject         string        // contact of the sender for push services, mailto: or https: URL
+	TTL             time.Duration // time push service keeps the message for the browser being offline, 1 day if not set
+	Timeout         time.Duration // http client timeout
+	// Transport, if non-nil, is used as-is for requests to push services and is the caller's
+	// responsibility to make SSRF-safe, as the endpoints are provided by users. When nil,
+	// safehttp.Transport() is installed, which blocks dialing any private/reserved IP.
+	Transport http.RoundTripper
+}
+
+// WebPush implements notify.Destination for web push notifications (RFC 8030) of replies to users' browsers,
+// with payload encrypted according to RFC 8291 and VAPID (RFC 8292) authentication of the sender
+type WebPush struct {
+	subject   string
+	ttl       time.Duration
+	key       *ecdsa.PrivateKey
+	publicKey string // base64url encoded uncompressed public key, used by browsers as applicationServerKey
+	client    http.Client
+}
+
+// WebPushSubscription is a push subscription of the browser, in format of PushSubscription.toJSON()
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"` // base64url encoded public key of the browser
+		Auth   string `json:"auth"`   // base64url encoded authentication secret
+	} `json:"keys"`
+}
+
+// webPushMessage is the payload of push message, shown as a notification by the service worker
+type webPushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+	Tag   string `json:"tag"` // comment id, for browser to replace notifications about the same comment
+}
+
+const (
+	webPushDefaultTTL = 24 * time.Hour
+	webPushRecordSize = 4096
+	// max size of the payload, push services accept messages up to 4096 bytes with encryption header
+	// of 86 bytes, padding delimiter and 16 bytes of AEAD tag
+	webPushMaxPayload = 4096 - 86 - 1 - 16
+)
+
+// NewWebPush makes web push notifications destination
+func NewWebPush(params WebPushParams) (*WebPush, error) {
+	if params.Subject == "" {
+		return nil, errors.New("web push subject is required")
+	}
+	rawKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(params.VAPIDPrivateKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode VAPID private key: %w", err)
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), rawKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse VAPID private key: %w", err)
+	}
+	publicKey, err := key.PublicKey.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("can't make VAPID public key: %w", err)
+	}
+	if params.TTL <= 0 {
+		params.TTL = webPushDefaultTTL
+	}
+	if params.Timeout == 0 {
+		params.Timeout = time.Second * 5
+	}
+	if params.Transport == nil {
+		params.Transport = safehttp.Transport()
+	}
+
+	res := &WebPush{
+		subject:   params.Subject,
+		ttl:       params.TTL,
+		key:       key,
+		publicKey: base64.RawURLEncoding.EncodeToString(publicKey),
+		client:    http.Client{Timeout: params.Timeout, Transport: params.Transport},
+	}
+	log.Printf("[DEBUG] create new web push notifier with VAPID key %s", res.publicKey)
+	return res, nil
+}
+
+// PublicKey returns base64url encoded VAPID public key, used by browsers to subscribe
+func (w *WebPush) PublicKey() string {
+	return w.publicKey
+}
+
+// Send push message to all subscriptions of users interested in the reply. Subscriptions gone
+// from the push service are skipped without error, as browser might be uninstalled long ago.
+func (w *WebPush) Send(ctx context.Context, req Request) error {
+	if len(req.WebPushes) == 0 {
+		return nil
+	}
+	log.Printf("[DEBUG] send web push notification for comment ID %s", req.Comment.ID)
+
+	payload, err := w.buildMessage(req)
+	if err != nil {
+		return err
+	}
+	subs := map[string]WebPushSubscription{} // by endpoint, used as recipient
+	endpoints := []string{}
+	for _, value := range req.WebPushes {
+		parsed, err := ParseWebPushSubscriptions(value)
+		if err != nil {
+			log.Printf("[WARN] skip invalid web push subscriptions, %v", err) // retry won't fix it
+			continue
+		}
+		for _, sub := range parsed {
+			if _, ok := subs[sub.Endpoint]; !ok {
+				endpoints = append(endpoints, sub.Endpoint)
+			}
+			subs[sub.Endpoint] = sub
+		}
+	}
+	return sendAll(req, endpoints, func(endpoint string) error {
+		if err := w.push(ctx, subs[endpoint], payload); err != nil {
+			return fmt.Errorf("problem sending web push notification about comment ID %s to %s: %w", req.Comment.ID, endpoint, err)
+		}
+		return nil
+	})
+}
+
+// SendVerification is not needed for web push, subscription is made by the browser of logged-in user
+func (w *WebPush) SendVerification(_ context.Context, _ VerificationRequest) error {
+	return nil
+}
+
+func (w *WebPush) String() string {
+	return "web push notifications destination"
+}
+
+// buildMessage generates json payload of the push message about the reply
+func (w *WebPush) buildMessage(req Request) ([]byte, error) {
+	text := []rune(req.Comment.Orig)
+	if len(text) > commentTextLengthLimit {
+		text = append(text[:commentTextLengthLimit], []rune("...")...)
+	}
+	msg := webPushMessage{
+		Title: "New reply from " + req.Comment.User.Name,
+		Body:  string(text),
+		URL:   req.Comment.Locator.URL + uiNav + req.Comment.ID,
+		Tag:   req.Comment.ID,
+	}
+	if req.Comment.PostTitle != "" {
+		msg.Title += " to «" + req.Comment.PostTitle + "»"
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal web push message: %w", err)
+	}
+	return data, nil
+}
+
+// push sends encrypted payload to the endpoint of the subscription
+func (w *WebPush) push(ctx context.Context, sub WebPushSubscription, payload []byte) error {
+	body, err := webPushEncrypt(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := w.vapidAuth(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	// SSRF safety: client.Transport is safehttp.Transport() unless set by the caller, see WebPushParams.Transport
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("can't make request: %w", err)
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(w.ttl.Seconds())))
+	req.Header.Set("Urgency", "normal")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		log.Printf("[INFO] web push subscription %s expired", sub.Endpoint)
+		return nil
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("unexpected push service response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// vapidAuth makes value of Authorization header with VAPID token for the origin of endpoint
+func (w *WebPush) vapidAuth(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("can't parse endpoint: %w", err)
+	}
+	claims := jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": w.subject,
+	}
+	tkn, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(w.key)
+	if err != nil {
+		return "", fmt.Errorf("can't sign VAPID token: %w", err)
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", tkn, w.publicKey), nil
+}
+
+// ParseWebPushSubscriptions parses json list of subscriptions, as stored in user details
+func ParseWebPushSubscriptions(value string) ([]WebPushSubscription, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var res []WebPushSubscription
+	if err := json.Unmarshal([]byte(value), &res); err != nil {
+		return nil, fmt.Errorf("can't parse web push subscriptions: %w", err)
+	}
+	return res, nil
+}
+
+// Validate checks the endpoint is https URL and keys are usable for encryption of messages
+func (s WebPushSubscription) Validate() error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return errors.New("endpoint should be https URL")
+	}
+	if _, _, err := s.keys(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// keys returns decoded public key and authentication secret of the browser
+func (s WebPushSubscription) keys() (*ecdh.PublicKey, []byte, error) {
+	rawKey, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s.Keys.P256dh, "="))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't decode p256dh key: %w", err)
+	}
+	key, err := ecdh.P256().NewPublicKey(rawKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad p256dh key: %w", err)
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s.Keys.Auth, "="))
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't decode auth secret: %w", err)
+	}
+	if len(secret) != 16 {
+		return nil, nil, errors.New("auth secret should be 16 bytes")
+	}
+	return key, secret, nil
+}
+
+// webPushEncrypt encrypts payload for the subscription with aes128gcm content encoding (RFC 8188)
+// and key derived from ECDH with ephemeral key and auth secret of the browser (RFC 8291)
+func webPushEncrypt(sub WebPushSubscription, payload []byte) ([]byte, error) {
+	if len(payload) > webPushMaxPayload {
+		return nil, fmt.Errorf("payload size %d is over %d bytes", len(payload), webPushMaxPayload)
+	}
+	uaKey, authSecret, err := sub.keys()
+	if err != nil {
+		return nil, err
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("can't generate ephemeral key: %w", err)
+	}
+	sharedSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, fmt.Errorf("can't make shared secret: %w", err)
+	}
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("can't generate salt: %w", err)
+	}
+
+	asPublic := asKey.PublicKey().Bytes()
+	keyInfo := "WebPush: info\x00" + string(uaKey.Bytes()) + string(asPublic)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, fmt.Errorf("can't derive input key: %w", err)
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, fmt.Errorf("can't derive content encryption key: %w", err)
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, fmt.Errorf("can't derive nonce: %w", err)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, fmt.Errorf("can't make cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("can't make gcm: %w", err)
+	}
+
+	// header: salt, record size, key id length and key id, which is the ephemeral public key
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	// single record, 0x02 delimiter marks the last record
+	return gcm.Seal(header, nonce, slices.Concat(payload, []byte{0x02}), nil), nil
+}
@@ -0,0 +1,284 @@
+package notify
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestWebPush_New(t *testing.T) {
+	_, err := NewWebPush(WebPushParams{VAPIDPrivateKey: testVAPIDKey(t)})
+	assert.EqualError(t, err, "web push subject is required")
+	_, err = NewWebPush(WebPushParams{VAPIDPrivateKey: "bad key", Subject: "mailto:admin@example.com"})
+	assert.ErrorContains(t, err, "can't decode VAPID private key")
+	_, err = NewWebPush(WebPushParams{VAPIDPrivateKey: "AAAA", Subject: "mailto:admin@example.com"})
+	assert.ErrorContains(t, err, "can't parse VAPID private key")
+
+	wp, err := NewWebPush(WebPushParams{VAPIDPrivateKey: testVAPIDKey(t), Subject: "mailto:admin@example.com"})
+	require.NoError(t, err)
+	publicKey, err := base64.RawURLEncoding.DecodeString(wp.PublicKey())
+	require.NoError(t, err)
+	assert.Len(t, publicKey, 65, "uncompressed public key")
+	assert.Equal(t, "web push notifications destination", wp.String())
+	assert.NoError(t, wp.SendVerification(context.Background(), VerificationRequest{}))
+}
+
+func TestWebPush_Send(t *testing.T) {
+	wp, err := NewWebPush(WebPushParams{VAPIDPrivateKey: testVAPIDKey(t), Subject: "mailto:admin@example.com",
+		Transport: http.DefaultTransport})
+	require.NoError(t, err)
+	ps := newMockPushService(t, wp.PublicKey())
+
+	browser1, sub1 := ps.subscribe(t, "/push/1")
+	browser2, sub2 := ps.subscribe(t, "/push/2")
+	_, gone := ps.subscribe(t, "/push/gone")
+	user1, err := json.Marshal([]WebPushSubscription{sub1, gone})
+	require.NoError(t, err)
+	user2, err := json.Marshal([]WebPushSubscription{sub2})
+	require.NoError(t, err)
+
+	c := store.Comment{ID: "999", ParentID: "1", Orig: "some *reply* " + strings.Repeat("long ", 30), PostTitle: "post",
+		Locator: store.Locator{URL: "http://example.org/"}, User: store.User{Name: "from"}}
+	require.NoError(t, wp.Send(context.Background(), Request{Comment: c}), "nothing to send")
+	require.NoError(t, wp.Send(context.Background(), Request{Comment: c, WebPushes: []string{string(user1), string(user2)}}))
+
+	msgs := ps.received()
+	require.Len(t, msgs, 2, "gone subscription skipped")
+	var msg webPushMessage
+	require.NoError(t, json.Unmarshal(browser1.decrypt(t, msgs["/push/1"]), &msg))
+	assert.Equal(t, "New reply from from to «post»", msg.Title)
+	assert.Equal(t, "http://example.org/#remark42__comment-999", msg.URL)
+	assert.Equal(t, "999", msg.Tag)
+	assert.True(t, strings.HasPrefix(msg.Body, "some *reply* long"))
+	assert.True(t, strings.HasSuffix(msg.Body, "..."), "long text truncated")
+	require.NoError(t, json.Unmarshal(browser2.decrypt(t, msgs["/push/2"]), &msg))
+	assert.Equal(t, "999", msg.Tag)
+
+	bad := sub1
+	bad.Endpoint = ps.URL + "/push/error"
+	badValue, err := json.Marshal([]WebPushSubscription{bad})
+	require.NoError(t, err)
+	err = wp.Send(context.Background(), Request{Comment: c, WebPushes: []string{string(badValue), "not json", string(user1)}})
+	var partialErr *PartialError
+	require.ErrorAs(t, err, &partialErr, "invalid subscriptions skipped")
+	assert.Equal(t, "problem sending web push notification about comment ID 999 to "+bad.Endpoint+
+		": unexpected push service response status 400", err.Error())
+	assert.Contains(t, partialErr.Sent, sub1.Endpoint)
+
+	// retry skips the subscription notified before
+	ps.mu.Lock()
+	ps.msgs = map[string][]byte{}
+	ps.mu.Unlock()
+	err = wp.Send(context.Background(), Request{Comment: c, WebPushes: []string{string(badValue), string(user1)}, Sent: partialErr.Sent})
+	require.Error(t, err)
+	assert.False(t, errors.As(err, &partialErr))
+	assert.Empty(t, ps.received())
+}
+
+func TestWebPush_SSRF(t *testing.T) {
+	wp, err := NewWebPush(WebPushParams{VAPIDPrivateKey: testVAPIDKey(t), Subject: "mailto:admin@example.com"})
+	require.NoError(t, err)
+	ps := newMockPushService(t, wp.PublicKey())
+	_, sub := ps.subscribe(t, "/push/1")
+
+	err = wp.push(context.Background(), sub, []byte("msg"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "access to private address is not allowed")
+	assert.Empty(t, ps.received())
+}
+
+func TestWebPushSubscription_Validate(t *testing.T) {
+	_, sub := (&mockPushService{Server: &httptest.Server{URL: "https://push.example.com"}}).subscribe(t, "/push/1")
+	require.NoError(t, sub.Validate())
+
+	tbl := []struct {
+		name   string
+		update func(s *WebPushSubscription)
+		err    string
+	}{
+		{"http endpoint", func(s *WebPushSubscription) { s.Endpoint = "http://push.example.com/1" }, "endpoint should be https URL"},
+		{"no endpoint", func(s *WebPushSubscription) { s.Endpoint = "" }, "endpoint should be https URL"},
+		{"bad key", func(s *WebPushSubscription) { s.Keys.P256dh = "AAAA" }, "bad p256dh key: crypto/ecdh: invalid public key"},
+		{"bad auth", func(s *WebPushSubscription) { s.Keys.Auth = "AAAA" }, "auth secret should be 16 bytes"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			s := sub
+			tt.update(&s)
+			assert.EqualError(t, s.Validate(), tt.err)
+		})
+	}
+
+	subs, err := ParseWebPushSubscriptions("")
+	require.NoError(t, err)
+	assert.Empty(t, subs)
+}
+
+func TestWebPush_DecryptRFCExample(t *testing.T) {
+	// example from RFC 8291 appendix A, checks decryption used to verify messages in tests
+	decode := func(s string) []byte {
+		res, err := base64.RawURLEncoding.DecodeString(s)
+		require.NoError(t, err)
+		return res
+	}
+	key, err := ecdh.P256().NewPrivateKey(decode("q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"))
+	require.NoError(t, err)
+	b := &mockBrowser{key: key, auth: decode("BTBZMqHH6r4Tts7J_aSIgg")}
+	body := decode("DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wE" +
+		"qKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+	assert.Equal(t, "When I grow up, I want to be a watermelon", string(b.decrypt(t, body)))
+}
+
+func TestWebPush_PayloadTooBig(t *testing.T) {
+	_, sub := (&mockPushService{Server: &httptest.Server{URL: "https://push.example.com"}}).subscribe(t, "/push/1")
+	_, err := webPushEncrypt(sub, make([]byte, webPushMaxPayload))
+	require.NoError(t, err)
+	_, err = webPushEncrypt(sub, make([]byte, webPushMaxPayload+1))
+	assert.EqualError(t, err, "payload size 3994 is over 3993 bytes")
+}
+
+func testVAPIDKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	raw, err := key.Bytes()
+	require.NoError(t, err)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// mockPushService is a local push service stand-in, checking VAPID token and keeping received messages by path.
+// Messages to /push/gone answered with 410 and to /push/error with 400.
+type mockPushService struct {
+	*httptest.Server
+	mu   sync.Mutex
+	msgs map[string][]byte
+}
+
+func newMockPushService(t *testing.T, vapidPublicKey string) *mockPushService {
+	ps := &mockPushService{msgs: map[string][]byte{}}
+	ps.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "aes128gcm", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "86400", r.Header.Get("TTL"))
+		if err := checkVAPID(r.Header.Get("Authorization"), vapidPublicKey, "http://"+r.Host); err != nil {
+			t.Logf("bad vapid auth, %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/push/gone":
+			w.WriteHeader(http.StatusGone)
+			return
+		case "/push/error":
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		ps.mu.Lock()
+		ps.msgs[r.URL.Path] = body
+		ps.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(ps.Close)
+	return ps
+}
+
+func (ps *mockPushService) received() map[string][]byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.msgs
+}
+
+// subscribe makes subscription of browser with new keys to the path of push service
+func (ps *mockPushService) subscribe(t *testing.T, path string) (*mockBrowser, WebPushSubscription) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	b := &mockBrowser{key: key, auth: make([]byte, 16)}
+	_, err = rand.Read(b.auth)
+	require.NoError(t, err)
+	sub := WebPushSubscription{Endpoint: ps.URL + path}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes())
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(b.auth)
+	return b, sub
+}
+
+// checkVAPID verifies VAPID token of authorization header with the public key of the sender
+func checkVAPID(auth, publicKey, aud string) error {
+	tkn, k, ok := strings.Cut(strings.TrimPrefix(auth, "vapid t="), ", k=")
+	if !ok || k != publicKey {
+		return fmt.Errorf("bad authorization header %q", auth)
+	}
+	rawKey, err := base64.RawURLEncoding.DecodeString(k)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), rawKey)
+	if err != nil {
+		return err
+	}
+	claims := jwt.MapClaims{}
+	if _, err = jwt.ParseWithClaims(tkn, claims, func(*jwt.Token) (any, error) { return key, nil },
+		jwt.WithValidMethods([]string{"ES256"}), jwt.WithAudience(aud), jwt.WithExpirationRequired()); err != nil {
+		return err
+	}
+	if claims["sub"] != "mailto:admin@example.com" {
+		return errors.New("bad subject")
+	}
+	return nil
+}
+
+// mockBrowser keeps keys of the subscription to decrypt messages
+type mockBrowser struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+}
+
+// decrypt decrypts aes128gcm message, as browser does according to RFC 8291
+func (b *mockBrowser) decrypt(t *testing.T, body []byte) []byte {
+	require.Greater(t, len(body), 86)
+	salt, rs, idLen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	assert.Equal(t, uint32(4096), rs)
+	require.Equal(t, 65, idLen)
+	asPublic, ciphertext := body[21:21+idLen], body[21+idLen:]
+
+	asKey, err := ecdh.P256().NewPublicKey(asPublic)
+	require.NoError(t, err)
+	secret, err := b.key.ECDH(asKey)
+	require.NoError(t, err)
+	ikm, err := hkdf.Key(sha256.New, secret, b.auth, "WebPush: info\x00"+string(b.key.PublicKey().Bytes())+string(asPublic), 32)
+	require.NoError(t, err)
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	require.NoError(t, err)
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	require.NoError(t, err)
+	block, err := aes.NewCipher(cek)
+	require.NoError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x02), plain[len(plain)-1], "last record delimiter")
+	return plain[:len(plain)-1]
+}
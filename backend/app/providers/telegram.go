@@ -39,31 +39,34 @@ func DispatchTelegramUpdates(ctx context.Context, requester tgRequester, receive
 			processUpdatedTicker.Stop()
 			return
 		case <-processUpdatedTicker.C:
-			url := `getUpdates?allowed_updates=["message"]`
+			url := `getUpdates?allowed_updates=["message","callback_query"]`
 			if updateOffset != 0 {
 				url += fmt.Sprintf("&offset=%d", updateOffset)
 			}
 
-			var update ntf.TelegramUpdate
-
-			err := requester.Request(ctx, url, nil, &update)
+			// raw updates passed to receivers as is, as each of them reads its own part of the update
+			var raw json.RawMessage
+			err := requester.Request(ctx, url, nil, &raw)
 			if err != nil {
 				log.Printf("[WARN] failed to fetch updates: %v", err)
 				continue
 			}
 
+			var update ntf.TelegramUpdate
+			if err = json.Unmarshal(raw, &update); err != nil {
+				log.Printf("[WARN] failed to decode updates: %v", err)
+				continue
+			}
 			for _, u := range update.Result {
 				if u.UpdateID >= updateOffset {
 					updateOffset = u.UpdateID + 1
 				}
 			}
 
-			if raw, err := json.Marshal(update); err == nil {
-				for _, r := range receivers {
-					e := r.ProcessUpdate(ctx, string(raw))
-					if e != nil {
-						log.Printf("[ERROR] failure from destination %s on processing telegram update %v", r, e)
-					}
+			for _, r := range receivers {
+				e := r.ProcessUpdate(ctx, string(raw))
+				if e != nil {
+					log.Printf("[ERROR] failure from destination %s on processing telegram update %v", r, e)
 				}
 			}
 		}
@@ -33,6 +33,13 @@ const getUpdatesResp = `{
               "type": "group"
            }
         }
+     },
+     {
+        "update_id": 999,
+        "callback_query": {
+           "id": "123",
+           "data": "delete:1"
+        }
      }
 ]
 }`
@@ -66,6 +73,7 @@ func (m *mockTGUpdatesReceiver) ProcessUpdate(_ context.Context, textUpdate stri
 	assert.NoError(m.t, err)
 	if m.hit < 2 {
 		assert.NotNil(m.t, result.Result)
+		assert.Contains(m.t, textUpdate, `"callback_query"`, "passed as is, with parts unknown to ntf.TelegramUpdate")
 		m.hit++
 		return nil
 	}
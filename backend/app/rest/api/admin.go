@@ -1,10 +1,12 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,33 +16,66 @@ import (
 	log "github.com/go-pkgz/lgr"
 	R "github.com/go-pkgz/rest"
 
+	"github.com/umputun/remark42/backend/app/moderation"
+	"github.com/umputun/remark42/backend/app/notify"
 	"github.com/umputun/remark42/backend/app/rest"
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/audit"
 	"github.com/umputun/remark42/backend/app/store/engine"
+	"github.com/umputun/remark42/backend/app/store/image"
+	"github.com/umputun/remark42/backend/app/store/settings"
 )
 
 // admin provides router for all requests available for admin users only
 type admin struct {
 	dataService   adminStore
+	moderator     *moderation.Service // moderation actions shared with moderation by bots of notifications
 	cache         LoadingCache
 	authenticator *auth.Service
-	readOnlyAge   int
+	siteSettings  func(siteID string) settings.Settings
+	settingsStore *settings.Store
+	auditLog      *audit.Store
 	migrator      *Migrator
+	notifyService *notify.Service
+	imageService  *image.Service
+	sites         []string
+
+	slackSigningSecret string
 }
 
 type adminStore interface {
+	Get(locator store.Locator, commentID string, user store.User) (store.Comment, error)
 	Delete(locator store.Locator, commentID string, mode store.DeleteMode) error
 	DeleteUser(siteID, userID string, mode store.DeleteMode) error
 	DeleteUserDetail(siteID, userID string, detail engine.UserDetail) error
 	User(siteID, userID string, limit, skip int, user store.User) ([]store.Comment, error)
+	SearchAll(siteID, query string, limit, skip int, user store.User) ([]store.Comment, error)
+	UserCount(siteID, userID string, user store.User) (int, error)
 	IsBlocked(siteID, userID string) bool
 	SetBlock(siteID, userID string, status bool, ttl time.Duration) error
+	IsShadowBanned(siteID, userID string) bool
+	SetShadowBan(siteID, userID string, status bool) error
 	BlockedUsers(siteID string) ([]store.BlockedUser, error)
 	Info(locator store.Locator, readonlyAge int) (store.PostInfo, error)
 	SetTitle(locator store.Locator, commentID string) (comment store.Comment, err error)
 	SetVerified(siteID, userID string, status bool) error
+	IsVerified(siteID, userID string) bool
 	SetReadOnly(locator store.Locator, status bool) error
 	SetPin(locator store.Locator, commentID string, status bool) error
+	Pending(siteID string, limit, skip int) ([]store.Comment, error)
+	Approve(locator store.Locator, commentID string) (comment store.Comment, err error)
+	Reported(siteID string, limit, skip int) ([]store.Comment, error)
+	ResolveReports(locator store.Locator, commentID string) error
+	DismissReports(locator store.Locator, commentID string) (comment store.Comment, err error)
+	ImageComments(sites []string) (map[string][]store.Comment, error)
+	RemoveImage(sites []string, imageID string) ([]store.Comment, error)
+	DeleteUserImages(sites []string, userID string) ([]string, error)
+}
+
+// pictureInfo is the uploaded image with the number of comments referencing it
+type pictureInfo struct {
+	image.Meta
+	Comments int `json:"comments"`
 }
 
 // DELETE /comment/{id}?site=siteID&url=post-url - removes comment
@@ -49,25 +84,35 @@ func (a *admin) deleteCommentCtrl(w http.ResponseWriter, r *http.Request) {
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 	log.Printf("[INFO] delete comment %s", id)
 
-	err := a.dataService.Delete(locator, id, store.SoftDelete)
-	if err != nil {
+	if err := a.deleteComment(r, locator, id); err != nil {
 		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't delete comment", rest.ErrInternal)
 		return
 	}
-	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.SiteID, locator.URL, lastCommentsScope))
 	R.RenderJSON(w, R.JSON{"id": id, "locator": locator})
 }
 
+// deleteComment soft-deletes the comment on behalf of the user of the request
+func (a *admin) deleteComment(r *http.Request, locator store.Locator, id string) error {
+	if err := a.moderator.DeleteComment(rest.GetUserOrEmpty(r), locator, id); err != nil {
+		return err
+	}
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.SiteID, locator.URL, lastCommentsScope))
+	return nil
+}
+
 // DELETE /user/{userid}?site=side-id - delete all user comments for requested userid
 func (a *admin) deleteUserCtrl(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("userid")
 	siteID := r.URL.Query().Get("site")
 	log.Printf("[INFO] delete all user comments for %s, site %s", userID, siteID)
 
+	before := a.userState(siteID, userID)
 	if err := a.dataService.DeleteUser(siteID, userID, store.HardDelete); err != nil {
 		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't delete user", rest.ErrInternal)
 		return
 	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionDeleteUser, Target: userID}, before, a.userState(siteID, userID))
+	a.deleteUserImages(siteID, userID)
 	a.cache.Flush(cache.Flusher(siteID).Scopes(userID, siteID, lastCommentsScope))
 	R.RenderJSON(w, R.JSON{"user_id": userID, "site_id": siteID})
 }
@@ -86,6 +131,118 @@ func (a *admin) getUserInfoCtrl(w http.ResponseWriter, r *http.Request) {
 	R.RenderJSON(w, ucomments[0].User)
 }
 
+// GET /search?site=siteID&q=query&limit=50&skip=10 - full-text search for comments, including deleted and blocked
+func (a *admin) searchCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	log.Printf("[INFO] search comments for %q, site %s", query, siteID)
+
+	if query == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("empty search query"), "can't search comments", rest.ErrDecode)
+		return
+	}
+
+	limit, skip, err := limitSkip(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't search comments", rest.ErrDecode)
+		return
+	}
+
+	comments, err := a.dataService.SearchAll(siteID, query, limit, skip, rest.GetUserOrEmpty(r))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't search comments", rest.ErrInternal)
+		return
+	}
+	R.RenderJSON(w, comments)
+}
+
+// GET /pending?site=siteID&limit=50&skip=10 - get comments awaiting approval, oldest first
+func (a *admin) pendingCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+
+	limit, skip, err := limitSkip(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get pending comments", rest.ErrDecode)
+		return
+	}
+
+	comments, err := a.dataService.Pending(siteID, limit, skip)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get pending comments", rest.ErrInternal)
+		return
+	}
+	R.RenderJSON(w, comments)
+}
+
+// PUT /approve/{id}?site=siteID&url=post-url - approve pending comment, makes it visible to everyone
+func (a *admin) approveCommentCtrl(w http.ResponseWriter, r *http.Request) {
+	commentID := r.PathValue("id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	log.Printf("[INFO] approve comment %s", commentID)
+
+	before := a.commentState(r, locator, commentID)
+	comment, err := a.dataService.Approve(locator, commentID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't approve comment", rest.ErrActionRejected)
+		return
+	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: locator.SiteID, Action: audit.ActionApprove, Target: commentID, URL: locator.URL},
+		before, a.commentState(r, locator, commentID))
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.SiteID, locator.URL, lastCommentsScope, comment.User.ID))
+
+	// notification postponed on creation of pending comment
+	if a.notifyService != nil && !a.dataService.IsShadowBanned(locator.SiteID, comment.User.ID) {
+		a.notifyService.Submit(notify.Request{Comment: comment})
+	}
+	R.RenderJSON(w, R.JSON{"id": commentID, "locator": locator, "approved": true})
+}
+
+// GET /reports?site=siteID&limit=50&skip=10 - list of reported comments, the most reported first
+func (a *admin) reportedCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+
+	limit, skip, err := limitSkip(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get reported comments", rest.ErrDecode)
+		return
+	}
+
+	comments, err := a.dataService.Reported(siteID, limit, skip)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get reported comments", rest.ErrInternal)
+		return
+	}
+	R.RenderJSON(w, comments)
+}
+
+// PUT /reports/{id}?site=siteID&url=post-url&action=resolve|dismiss - review reports of the comment.
+// resolve deletes reported comment, dismiss drops reports and makes comment visible if it was hidden by reports
+func (a *admin) reviewReportsCtrl(w http.ResponseWriter, r *http.Request) {
+	commentID := r.PathValue("id")
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	action := r.URL.Query().Get("action")
+	log.Printf("[INFO] %s reports for comment %s", action, commentID)
+
+	before := a.commentState(r, locator, commentID)
+	var err error
+	switch action {
+	case "resolve":
+		err = a.dataService.ResolveReports(locator, commentID)
+	case "dismiss":
+		_, err = a.dataService.DismissReports(locator, commentID)
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't review comment reports", rest.ErrActionRejected)
+		return
+	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: locator.SiteID, Action: audit.ActionReports, Target: commentID, URL: locator.URL},
+		before, a.commentState(r, locator, commentID))
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.SiteID, locator.URL, lastCommentsScope))
+	R.RenderJSON(w, R.JSON{"id": commentID, "locator": locator, "action": action})
+}
+
 // GET /deleteme?token=jwt - delete all user comments and details by user's request. Gets info about deleted used from provided token
 // request made GET to allow direct click from the email sent by user
 func (a *admin) deleteMeRequestCtrl(w http.ResponseWriter, r *http.Request) {
@@ -113,6 +270,7 @@ func (a *admin) deleteMeRequestCtrl(w http.ResponseWriter, r *http.Request) {
 
 	audience := claims.Audience[0]
 
+	before := a.userState(audience, claims.User.ID)
 	if err = a.dataService.DeleteUserDetail(audience, claims.User.ID, engine.AllUserDetails); err != nil {
 		code := parseError(err, rest.ErrInternal)
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't delete user details for user", code)
@@ -123,6 +281,9 @@ func (a *admin) deleteMeRequestCtrl(w http.ResponseWriter, r *http.Request) {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't delete user", rest.ErrNoAccess)
 		return
 	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: audience, Action: audit.ActionDeleteUser, Target: claims.User.ID},
+		before, a.userState(audience, claims.User.ID))
+	a.deleteUserImages(audience, claims.User.ID)
 
 	if claims.User.Picture != "" && a.authenticator.AvatarProxy() != nil {
 		if avatarID := avatarIDFromPicture(claims.User.Picture); avatarID != "" {
@@ -152,10 +313,24 @@ func avatarIDFromPicture(picture string) string {
 	return ""
 }
 
-// PUT /user/{userid}?site=side-id&block=1&ttl=7d - block or unblock user
+// PUT /user/{userid}?site=side-id&block=1&ttl=7d - block or unblock user, block=shadow sets shadow ban
 func (a *admin) setBlockCtrl(w http.ResponseWriter, r *http.Request) {
 	userID := r.PathValue("userid")
 	siteID := r.URL.Query().Get("site")
+
+	// shadow ban, user keeps posting but comments are visible to the user and admins only
+	if r.URL.Query().Get("block") == "shadow" {
+		before := a.userState(siteID, userID)
+		if err := a.dataService.SetShadowBan(siteID, userID, true); err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set shadow ban", rest.ErrActionRejected)
+			return
+		}
+		addAudit(a.auditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionBlock, Target: userID}, before, a.userState(siteID, userID))
+		a.cache.Flush(cache.Flusher(siteID).Scopes(userID, siteID, lastCommentsScope))
+		R.RenderJSON(w, R.JSON{"user_id": userID, "site_id": siteID, "block": false, "shadow": true})
+		return
+	}
+
 	blockStatus := r.URL.Query().Get("block") == "1"
 
 	ttl := time.Duration(0) // unlimited duration by default
@@ -165,19 +340,21 @@ func (a *admin) setBlockCtrl(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := a.dataService.SetBlock(siteID, userID, blockStatus, ttl); err != nil {
+	if err := a.setBlock(r, siteID, userID, blockStatus, ttl); err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set blocking status", rest.ErrActionRejected)
 		return
 	}
+	R.RenderJSON(w, R.JSON{"user_id": userID, "site_id": siteID, "block": blockStatus})
+}
 
-	// delete comments for permanently blocked user.
-	if blockStatus && ttl == time.Duration(0) {
-		if err := a.dataService.DeleteUser(siteID, userID, store.SoftDelete); err != nil {
-			log.Printf("[WARN] can't delete comments for blocked user %s on site %s, %v", userID, siteID, err)
-		}
+// setBlock blocks or unblocks the user on behalf of the user of the request, zero ttl blocks permanently.
+// Comments of permanently blocked user are deleted.
+func (a *admin) setBlock(r *http.Request, siteID, userID string, blockStatus bool, ttl time.Duration) error {
+	if err := a.moderator.SetBlock(rest.GetUserOrEmpty(r), siteID, userID, blockStatus, ttl); err != nil {
+		return err
 	}
 	a.cache.Flush(cache.Flusher(siteID).Scopes(userID, siteID, lastCommentsScope))
-	R.RenderJSON(w, R.JSON{"user_id": userID, "site_id": siteID, "block": blockStatus})
+	return nil
 }
 
 // GET /blocked?site=siteID - list blocked users
@@ -191,26 +368,199 @@ func (a *admin) blockedUsersCtrl(w http.ResponseWriter, r *http.Request) {
 	R.RenderJSON(w, users)
 }
 
+// PUT /picture/{user}/{id}/ban?site=siteID - ban the uploaded image on the site, so it and similar images can't be uploaded again
+func (a *admin) banPictureCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	imgID := path.Join(r.PathValue("user"), r.PathValue("id"))
+	if a.imageService == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("no image service"), "can't ban image", rest.ErrActionRejected)
+		return
+	}
+	ban, err := a.imageService.Ban(siteID, imgID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't ban image", rest.ErrActionRejected)
+		return
+	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionBanImage, Target: imgID}, nil, ban)
+	R.RenderJSON(w, ban)
+}
+
+// GET /picture/bans?site=siteID - list images banned on the site, the most recent first
+func (a *admin) pictureBansCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	if a.imageService == nil {
+		R.RenderJSON(w, []image.BannedImage{})
+		return
+	}
+	bans, err := a.imageService.Bans(siteID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get banned images", rest.ErrInternal)
+		return
+	}
+	R.RenderJSON(w, bans)
+}
+
+// DELETE /picture/bans/{hash}?site=siteID - remove image hash from banned on the site
+func (a *admin) unbanPictureCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	hash := r.PathValue("hash")
+	if a.imageService == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("no image service"), "can't unban image", rest.ErrActionRejected)
+		return
+	}
+	var before *image.BannedImage
+	if bans, err := a.imageService.Bans(siteID); err == nil {
+		for _, b := range bans {
+			if b.Hash == hash {
+				before = &b
+				break
+			}
+		}
+	}
+	if err := a.imageService.Unban(siteID, hash); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't unban image", rest.ErrActionRejected)
+		return
+	}
+	target := hash
+	if before != nil {
+		target = before.ImageID
+	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionBanImage, Target: target}, before, nil)
+	R.RenderJSON(w, R.JSON{"hash": hash, "site_id": siteID, "banned": false})
+}
+
+// GET /pictures?site=siteID&user=userID - list uploaded images of the user, or images used in comments on the site
+// if user is not set, the most recent first. Comments referencing the user's images are counted on all sites.
+func (a *admin) picturesCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID, userID := r.URL.Query().Get("site"), r.URL.Query().Get("user")
+	if a.imageService == nil {
+		R.RenderJSON(w, []pictureInfo{})
+		return
+	}
+	images, err := a.imageService.List(userID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't list images", rest.ErrInternal)
+		return
+	}
+	sites := []string{siteID}
+	if userID != "" {
+		sites = a.imageSites(siteID)
+	}
+	refs, err := a.dataService.ImageComments(sites)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get comments with images", rest.ErrInternal)
+		return
+	}
+	res := []pictureInfo{}
+	for _, img := range images {
+		if userID == "" && len(refs[img.ID]) == 0 {
+			continue
+		}
+		res = append(res, pictureInfo{Meta: img, Comments: len(refs[img.ID])})
+	}
+	R.RenderJSON(w, res)
+}
+
+// GET /pictures/orphaned?site=siteID - list committed images not used in any comment on any site, the most recent first
+func (a *admin) orphanedPicturesCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	if a.imageService == nil {
+		R.RenderJSON(w, []image.Meta{})
+		return
+	}
+	images, err := a.imageService.List("")
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't list images", rest.ErrInternal)
+		return
+	}
+	refs, err := a.dataService.ImageComments(a.imageSites(siteID))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get comments with images", rest.ErrInternal)
+		return
+	}
+	res := []image.Meta{}
+	for _, img := range images {
+		// staged images are not used in comments yet and removed on cleanup if never used
+		if _, ok := refs[img.ID]; !ok && !img.Staging {
+			res = append(res, img)
+		}
+	}
+	R.RenderJSON(w, res)
+}
+
+// DELETE /picture/{user}/{id}?site=siteID - delete uploaded image and remove it from all comments using it on all sites
+func (a *admin) deletePictureCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	imgID := path.Join(r.PathValue("user"), r.PathValue("id"))
+	if a.imageService == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("no image service"), "can't delete image", rest.ErrActionRejected)
+		return
+	}
+	var before *image.Meta
+	if images, err := a.imageService.List(r.PathValue("user")); err == nil {
+		for _, img := range images {
+			if img.ID == imgID {
+				before = &img
+				break
+			}
+		}
+	}
+	log.Printf("[INFO] delete image %s, site %s", imgID, siteID)
+	changed, err := a.dataService.RemoveImage(a.imageSites(siteID), imgID)
+	for _, c := range changed {
+		a.cache.Flush(cache.Flusher(c.Locator.SiteID).Scopes(c.Locator.SiteID, c.Locator.URL, lastCommentsScope, c.User.ID))
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't delete image", rest.ErrInternal)
+		return
+	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionDeleteImage, Target: imgID}, before, nil)
+	R.RenderJSON(w, R.JSON{"id": imgID, "site_id": siteID, "comments": len(changed)})
+}
+
+// imageSites returns sites sharing the uploaded images, the site of the request if not set
+func (a *admin) imageSites(siteID string) []string {
+	if len(a.sites) == 0 {
+		return []string{siteID}
+	}
+	return a.sites
+}
+
+// deleteUserImages deletes the user's uploaded images not used in comments anymore, i.e. after the user's comments deleted
+func (a *admin) deleteUserImages(siteID, userID string) {
+	if a.imageService == nil {
+		return
+	}
+	deleted, err := a.dataService.DeleteUserImages(a.imageSites(siteID), userID)
+	if err != nil {
+		log.Printf("[WARN] can't delete images of user %s, %v", userID, err)
+	}
+	if len(deleted) > 0 {
+		log.Printf("[INFO] deleted %d images of user %s", len(deleted), userID)
+	}
+}
+
 // PUT /readonly?site=siteID&url=post-url&ro=1 - set or reset read-only status for the post
 func (a *admin) setReadOnlyCtrl(w http.ResponseWriter, r *http.Request) {
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 	roStatus := r.URL.Query().Get("ro") == "1"
 
+	readOnlyAge := a.siteSettings(locator.SiteID).ReadOnlyAge
 	isRoByAge := func(info store.PostInfo) bool {
-		return a.readOnlyAge > 0 && !info.FirstTS.IsZero() &&
-			info.FirstTS.AddDate(0, 0, a.readOnlyAge).Before(time.Now())
+		return readOnlyAge > 0 && !info.FirstTS.IsZero() &&
+			info.FirstTS.AddDate(0, 0, readOnlyAge).Before(time.Now())
 	}
 
 	// don't allow to reset ro for posts turned to ro by ReadOnlyAge
 	if !roStatus {
-		if info, e := a.dataService.Info(locator, a.readOnlyAge); e == nil && isRoByAge(info) {
+		if info, e := a.dataService.Info(locator, readOnlyAge); e == nil && isRoByAge(info) {
 			rest.SendErrorJSON(w, r, http.StatusForbidden, fmt.Errorf("rejected"),
 				"read-only due the age", rest.ErrActionRejected)
 			return
 		}
 	}
 
-	if err := a.dataService.SetReadOnly(locator, roStatus); err != nil {
+	if err := a.moderator.SetReadOnly(rest.GetUserOrEmpty(r), locator, roStatus); err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set readonly status", rest.ErrPostNotFound)
 		return
 	}
@@ -218,16 +568,160 @@ func (a *admin) setReadOnlyCtrl(w http.ResponseWriter, r *http.Request) {
 	R.RenderJSON(w, R.JSON{"locator": locator, "read-only": roStatus})
 }
 
+// GET /audit?site=siteID&since=unix_ts_msec&actor=userID&limit=100 - moderation actions, the most recent first
+func (a *admin) auditCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	if a.auditLog == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("audit log disabled"), "can't get audit log", rest.ErrActionRejected)
+		return
+	}
+
+	since, err := parseSince(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't translate since parameter", rest.ErrDecode)
+		return
+	}
+	limit := 0
+	if v, e := strconv.Atoi(r.URL.Query().Get("limit")); e == nil {
+		limit = v
+	}
+
+	records, err := a.auditLog.Find(audit.FindRequest{SiteID: siteID, Since: since, Actor: r.URL.Query().Get("actor"), Limit: limit})
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get audit log", rest.ErrInternal)
+		return
+	}
+	R.RenderJSON(w, records)
+}
+
+// GET /notify?site=siteID - retrying deliveries and dead letters of notification outbox, the oldest first
+func (a *admin) notifyDeliveriesCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	retrying, dead, err := a.notifier().Deliveries(siteID)
+	if errors.Is(err, notify.ErrNoOutbox) {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get notification deliveries", rest.ErrActionRejected)
+		return
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't get notification deliveries", rest.ErrInternal)
+		return
+	}
+	R.RenderJSON(w, R.JSON{"retrying": hideTokens(retrying), "dead": hideTokens(dead)})
+}
+
+// PUT /notify/replay?site=siteID&id=deliveryID - send dead letter or retrying delivery again, all of them without id
+func (a *admin) notifyReplayCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID, id := r.URL.Query().Get("site"), r.URL.Query().Get("id")
+	count, err := a.notifier().Replay(siteID, id)
+	if errors.Is(err, notify.ErrNoOutbox) {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't replay notification deliveries", rest.ErrActionRejected)
+		return
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't replay notification deliveries", rest.ErrInternal)
+		return
+	}
+	if id != "" && count == 0 {
+		rest.SendErrorJSON(w, r, http.StatusNotFound, fmt.Errorf("no delivery %s", id), "can't replay notification delivery", rest.ErrActionRejected)
+		return
+	}
+	R.RenderJSON(w, R.JSON{"replayed": count})
+}
+
+// notifier returns notification service, do-nothing one if not set
+func (a *admin) notifier() *notify.Service {
+	if a.notifyService == nil {
+		return notify.NopService
+	}
+	return a.notifyService
+}
+
+// hideTokens returns deliveries with verification tokens and digest unsubscribe links removed, never nil
+func hideTokens(deliveries []notify.Delivery) []notify.Delivery {
+	res := make([]notify.Delivery, len(deliveries))
+	for i, d := range deliveries {
+		if d.Verification != nil {
+			v := *d.Verification
+			v.Token = ""
+			d.Verification = &v
+		}
+		if d.Digest != nil {
+			dg := *d.Digest
+			dg.UnsubscribeLink = ""
+			d.Digest = &dg
+		}
+		res[i] = d
+	}
+	return res
+}
+
+// GET /settings?site=siteID - get site's settings and site's override of the default settings
+func (a *admin) getSettingsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	override := json.RawMessage(`{}`)
+	if a.settingsStore != nil {
+		if o := a.settingsStore.Override(siteID); o != nil {
+			override = o
+		}
+	}
+	R.RenderJSON(w, R.JSON{"settings": a.siteSettings(siteID), "override": override})
+}
+
+// PUT /settings?site=siteID - set site's override of the default settings, body is json object with changed fields only
+func (a *admin) setSettingsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	if a.settingsStore == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("per-site settings disabled"),
+			"can't set site settings", rest.ErrActionRejected)
+		return
+	}
+
+	override := json.RawMessage{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, hardBodyLimit)).Decode(&override); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind settings", rest.ErrDecode)
+		return
+	}
+	before := a.settingsStore.Override(siteID)
+	if _, err := a.settingsStore.Set(siteID, override); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set site settings", rest.ErrActionRejected)
+		return
+	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionSettings, Target: siteID}, before, a.settingsStore.Override(siteID))
+	a.cache.Flush(cache.Flusher(siteID).Scopes(siteID))
+	R.RenderJSON(w, R.JSON{"settings": a.siteSettings(siteID), "override": a.settingsStore.Override(siteID)})
+}
+
+// DELETE /settings?site=siteID - reset site's settings to defaults
+func (a *admin) deleteSettingsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	if a.settingsStore == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, errors.New("per-site settings disabled"),
+			"can't reset site settings", rest.ErrActionRejected)
+		return
+	}
+	before := a.settingsStore.Override(siteID)
+	if err := a.settingsStore.Delete(siteID); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't reset site settings", rest.ErrInternal)
+		return
+	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionSettings, Target: siteID}, before, nil)
+	a.cache.Flush(cache.Flusher(siteID).Scopes(siteID))
+	R.RenderJSON(w, R.JSON{"settings": a.siteSettings(siteID), "override": json.RawMessage(`{}`)})
+}
+
 // PUT /title/{id}?site=siteID&url=post-url - set comment PostTitle to page's title
 func (a *admin) setTitleCtrl(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 
+	before := a.commentState(r, locator, id)
 	c, err := a.dataService.SetTitle(locator, id)
 	if err != nil {
 		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't set title", rest.ErrInternal)
 		return
 	}
+	addAudit(a.auditLog, r, audit.Record{SiteID: locator.SiteID, Action: audit.ActionTitle, Target: id, URL: locator.URL},
+		before, a.commentState(r, locator, id))
 	log.Printf("[INFO] set comment's title %s to %q", id, c.PostTitle)
 
 	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope))
@@ -240,7 +734,7 @@ func (a *admin) setVerifyCtrl(w http.ResponseWriter, r *http.Request) {
 	siteID := r.URL.Query().Get("site")
 	verifyStatus := r.URL.Query().Get("verified") == "1"
 
-	if err := a.dataService.SetVerified(siteID, userID, verifyStatus); err != nil {
+	if err := a.moderator.SetVerified(rest.GetUserOrEmpty(r), siteID, userID, verifyStatus); err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set verify status", rest.ErrActionRejected)
 		return
 	}
@@ -255,10 +749,33 @@ func (a *admin) setPinCtrl(w http.ResponseWriter, r *http.Request) {
 	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 	pinStatus := r.URL.Query().Get("pin") == "1"
 
-	if err := a.dataService.SetPin(locator, commentID, pinStatus); err != nil {
+	if err := a.setPin(r, locator, commentID, pinStatus); err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set pin status", rest.ErrActionRejected)
 		return
 	}
-	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL))
 	R.RenderJSON(w, R.JSON{"id": commentID, "locator": locator, "pin": pinStatus})
 }
+
+// setPin pins or unpins the comment on behalf of the user of the request
+func (a *admin) setPin(r *http.Request, locator store.Locator, commentID string, pinStatus bool) error {
+	if err := a.moderator.SetPin(rest.GetUserOrEmpty(r), locator, commentID, pinStatus); err != nil {
+		return err
+	}
+	a.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL))
+	return nil
+}
+
+// userState returns moderation state of the user for audit log
+func (a *admin) userState(siteID, userID string) moderation.UserState {
+	return a.moderator.UserState(siteID, userID)
+}
+
+// commentState returns comment as seen by the admin for audit log, nil if comment can't be read
+func (a *admin) commentState(r *http.Request, locator store.Locator, commentID string) any {
+	return a.moderator.CommentState(rest.GetUserOrEmpty(r), locator, commentID)
+}
+
+// addAudit records moderation action made by the user of the request, does nothing without audit log
+func addAudit(auditLog *audit.Store, r *http.Request, rec audit.Record, before, after any) {
+	moderation.AddAudit(auditLog, rest.GetUserOrEmpty(r), rec, before, after)
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/slack-go/slack"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/rest"
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// POST /slack/interaction - moderation by buttons of slack notifications, called by slack and authenticated by
+// the request signature. Made on behalf of slack user, recorded in the audit log as "slack_<slack user id>".
+func (a *admin) slackInteractionCtrl(w http.ResponseWriter, r *http.Request) {
+	verifier, err := slack.NewSecretsVerifier(r.Header, a.slackSigningSecret)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusUnauthorized, err, "invalid slack request", rest.ErrNoAccess)
+		return
+	}
+	body, err := io.ReadAll(io.TeeReader(http.MaxBytesReader(w, r.Body, hardBodyLimit), &verifier))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't read request", rest.ErrDecode)
+		return
+	}
+	if err = verifier.Ensure(); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusUnauthorized, err, "invalid slack signature", rest.ErrNoAccess)
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't parse request", rest.ErrDecode)
+		return
+	}
+	var callback slack.InteractionCallback
+	if err = json.Unmarshal([]byte(form.Get("payload")), &callback); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't decode slack payload", rest.ErrDecode)
+		return
+	}
+
+	actor := store.User{ID: "slack_" + callback.User.ID, Name: callback.User.Name, Admin: true}
+	r = rest.SetUserInfo(r, actor)
+	for _, action := range callback.ActionCallback.BlockActions {
+		if action.BlockID != notify.SlackModerationBlockID {
+			continue
+		}
+		var target notify.SlackAction
+		if err = json.Unmarshal([]byte(action.Value), &target); err != nil {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't decode slack action", rest.ErrDecode)
+			return
+		}
+		log.Printf("[INFO] slack action %s on comment %s by %s", action.ActionID, target.CommentID, actor.ID)
+		result, actErr := a.slackAction(r, action.ActionID, target)
+		if actErr != nil {
+			result = fmt.Sprintf("Action %s failed: %v", action.ActionID, actErr)
+		}
+		a.slackRespond(r.Context(), callback.ResponseURL, fmt.Sprintf("%s by <@%s>", result, callback.User.ID))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// slackAction makes moderation action of the button, returns description of the result
+func (a *admin) slackAction(r *http.Request, actionID string, target notify.SlackAction) (string, error) {
+	locator := store.Locator{SiteID: target.SiteID, URL: target.URL}
+	switch actionID {
+	case notify.SlackActionDelete:
+		return "Comment deleted", a.deleteComment(r, locator, target.CommentID)
+	case notify.SlackActionBlock1d:
+		return "User blocked for 1 day", a.setBlock(r, target.SiteID, target.UserID, true, 24*time.Hour)
+	case notify.SlackActionBlock:
+		return "User blocked permanently", a.setBlock(r, target.SiteID, target.UserID, true, 0)
+	case notify.SlackActionPin:
+		return "Comment pinned", a.setPin(r, locator, target.CommentID, true)
+	}
+	return "", errors.New("unknown action")
+}
+
+// slackRespond posts result of the action to the channel of the message with buttons, failure logged only
+func (a *admin) slackRespond(ctx context.Context, responseURL, text string) {
+	if responseURL == "" {
+		return
+	}
+	msg := &slack.WebhookMessage{Text: text, ResponseType: slack.ResponseTypeInChannel, ReplaceOriginal: false}
+	if err := slack.PostWebhookContext(ctx, responseURL, msg); err != nil {
+		log.Printf("[WARN] can't respond to slack action, %v", err)
+	}
+}
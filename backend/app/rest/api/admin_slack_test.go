@@ -0,0 +1,130 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/audit"
+)
+
+func TestAdmin_SlackInteraction(t *testing.T) {
+	ts, srv, teardown := startupT(t, func(srv *Rest) {
+		auditLog, err := audit.NewStore(filepath.Join(t.TempDir(), "audit.log"))
+		require.NoError(t, err)
+		srv.AuditLog = auditLog
+		srv.SlackSigningSecret = "slack-secret"
+	})
+	defer teardown()
+
+	var mu sync.Mutex
+	var responses []string
+	slackSrv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		msg := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		mu.Lock()
+		responses = append(responses, msg["text"].(string))
+		mu.Unlock()
+	}))
+	defer slackSrv.Close()
+
+	locator := store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}
+	id, err := srv.DataService.Create(store.Comment{Text: "test test #1", Locator: locator, User: store.User{Name: "user1 name", ID: "user1"}})
+	require.NoError(t, err)
+
+	send := func(actionID, secret string, sentAt time.Time) int {
+		value, e := json.Marshal(notify.SlackAction{SiteID: locator.SiteID, URL: locator.URL, CommentID: id, UserID: "user1"})
+		require.NoError(t, e)
+		payload, e := json.Marshal(map[string]any{
+			"type":         "block_actions",
+			"user":         map[string]string{"id": "U123", "name": "moderator"},
+			"response_url": slackSrv.URL,
+			"actions":      []map[string]string{{"action_id": actionID, "block_id": notify.SlackModerationBlockID, "value": string(value)}},
+		})
+		require.NoError(t, e)
+		body := "payload=" + url.QueryEscape(string(payload))
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		_, _ = fmt.Fprintf(mac, "v0:%d:%s", sentAt.Unix(), body)
+		req, e := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/slack/interaction", strings.NewReader(body))
+		require.NoError(t, e)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Slack-Request-Timestamp", fmt.Sprintf("%d", sentAt.Unix()))
+		req.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+		resp, e := http.DefaultClient.Do(req)
+		require.NoError(t, e)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, send(notify.SlackActionDelete, "bad-secret", time.Now()), "wrong signature")
+	assert.Equal(t, http.StatusUnauthorized, send(notify.SlackActionDelete, "slack-secret", time.Now().Add(-time.Hour)), "expired")
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/slack/interaction", strings.NewReader("payload={}"))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "not signed")
+	c, err := srv.DataService.Get(locator, id, store.User{})
+	require.NoError(t, err)
+	assert.False(t, c.Deleted, "rejected requests make no changes")
+
+	assert.Equal(t, http.StatusOK, send(notify.SlackActionPin, "slack-secret", time.Now()))
+	c, err = srv.DataService.Get(locator, id, store.User{})
+	require.NoError(t, err)
+	assert.True(t, c.Pin)
+
+	assert.Equal(t, http.StatusOK, send(notify.SlackActionBlock1d, "slack-secret", time.Now()))
+	assert.True(t, srv.DataService.IsBlocked("remark42", "user1"))
+	blocked, err := srv.DataService.BlockedUsers("remark42")
+	require.NoError(t, err)
+	require.Len(t, blocked, 1)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), blocked[0].Until, time.Minute)
+
+	assert.Equal(t, http.StatusOK, send(notify.SlackActionDelete, "slack-secret", time.Now()))
+	c, err = srv.DataService.Get(locator, id, store.User{})
+	require.NoError(t, err)
+	assert.True(t, c.Deleted)
+
+	assert.Equal(t, http.StatusOK, send("unknown", "slack-secret", time.Now()))
+
+	mu.Lock()
+	assert.Equal(t, []string{"Comment pinned by <@U123>", "User blocked for 1 day by <@U123>", "Comment deleted by <@U123>",
+		"Action unknown failed: unknown action by <@U123>"}, responses)
+	mu.Unlock()
+
+	recs, err := srv.AuditLog.Find(audit.FindRequest{SiteID: "remark42"})
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	assert.Equal(t, audit.ActionDeleteComment, recs[0].Action)
+	assert.Equal(t, audit.ActionBlock, recs[1].Action)
+	assert.Equal(t, audit.ActionPin, recs[2].Action)
+	for _, rec := range recs {
+		assert.Equal(t, audit.Actor{ID: "slack_U123", Name: "moderator"}, rec.Actor)
+	}
+}
+
+func TestAdmin_SlackInteractionDisabled(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	resp, err := http.Post(ts.URL+"/api/v1/slack/interaction", "application/x-www-form-urlencoded", strings.NewReader("payload={}"))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
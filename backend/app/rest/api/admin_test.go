@@ -3,13 +3,18 @@ package api
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -19,9 +24,14 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 
+	"github.com/umputun/remark42/backend/app/notify"
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/audit"
+	"github.com/umputun/remark42/backend/app/store/image"
 	"github.com/umputun/remark42/backend/app/store/service"
+	"github.com/umputun/remark42/backend/app/store/settings"
 )
 
 func TestAdmin_Delete(t *testing.T) {
@@ -213,6 +223,75 @@ func TestAdmin_DeleteUser(t *testing.T) {
 	assert.True(t, cmntWithInfo.Comments[2].Deleted)
 }
 
+func TestAdmin_WebhookEvents(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	var mu sync.Mutex
+	var events []string
+	var payloads []map[string]any
+	hook := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		payload := map[string]any{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		assert.NotEmpty(t, r.Header.Get(notify.WebhookSignatureHeader))
+		mu.Lock()
+		events = append(events, r.Header.Get(notify.WebhookEventHeader))
+		payloads = append(payloads, payload)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+	getEvents := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, events...)
+	}
+
+	wh, err := notify.NewWebhook(notify.WebhookParams{URL: hook.URL, JSON: true, Secret: "123", Events: notify.Events})
+	require.NoError(t, err)
+	srv.privRest.notifyService = notify.NewService(srv.DataService, 10, wh)
+	srv.adminRest.notifyService = srv.privRest.notifyService
+	srv.adminRest.moderator.SetNotifier(srv.privRest.notifyService)
+	defer srv.privRest.notifyService.Close()
+
+	send := func(method, url, body, tkn string) int {
+		req, err := http.NewRequest(method, ts.URL+url, strings.NewReader(body))
+		require.NoError(t, err)
+		if tkn == "" {
+			req.SetBasicAuth("admin", "password")
+		}
+		resp, err := sendReq(req, tkn)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	id := addComment(t, store.Comment{Text: "test test #1", Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}}, ts)
+	waitForCount(t, 1, func() int { return len(getEvents()) })
+	query := "?site=remark42&url=https://radio-t.com/blah"
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/api/v1/comment/"+id+query, `{"text":"edited text"}`, devToken))
+	waitForCount(t, 2, func() int { return len(getEvents()) })
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/api/v1/vote/"+id+query+"&vote=1", "", dev2Token))
+	waitForCount(t, 3, func() int { return len(getEvents()) })
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/api/v1/admin/pin/"+id+query+"&pin=1", "", ""))
+	waitForCount(t, 4, func() int { return len(getEvents()) })
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/api/v1/admin/readonly"+query+"&ro=1", "", ""))
+	waitForCount(t, 5, func() int { return len(getEvents()) })
+	assert.Equal(t, http.StatusOK, send(http.MethodPut, "/api/v1/admin/user/provider2_dev?site=remark42&block=1&ttl=10m", "", ""))
+	waitForCount(t, 6, func() int { return len(getEvents()) })
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/api/v1/admin/comment/"+id+query, "", ""))
+	waitForCount(t, 7, func() int { return len(getEvents()) })
+
+	assert.Equal(t, []string{"create", "edit", "vote", "pin", "readonly", "block", "delete"}, getEvents())
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "edited text", payloads[1]["comment"].(map[string]any)["orig"])
+	assert.InDelta(t, 1, payloads[2]["vote"], 0)
+	assert.Equal(t, true, payloads[3]["comment"].(map[string]any)["pin"])
+	assert.Equal(t, true, payloads[4]["read_only"])
+	assert.Equal(t, map[string]any{"id": "provider2_dev", "name": "", "picture": "", "admin": false, "block": true}, payloads[5]["user"])
+	assert.Equal(t, true, payloads[6]["comment"].(map[string]any)["delete"])
+}
+
 func TestAdmin_Pin(t *testing.T) {
 	ts, _, teardown := startupT(t)
 	defer teardown()
@@ -380,6 +459,274 @@ func TestAdmin_Block(t *testing.T) {
 	assert.False(t, srv.adminRest.dataService.IsBlocked("remark42", "user2"))
 }
 
+func TestAdmin_Search(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	c1 := store.Comment{Text: "test test #1", Locator: store.Locator{SiteID: "remark42",
+		URL: "https://radio-t.com/blah"}, User: store.User{Name: "user1 name", ID: "user1"}}
+	c2 := store.Comment{Text: "test test #2", Locator: store.Locator{SiteID: "remark42",
+		URL: "https://radio-t.com/blah"}, User: store.User{Name: "user2 name", ID: "user2"}}
+	id1, err := srv.DataService.Create(c1)
+	require.NoError(t, err)
+	_, err = srv.DataService.Create(c2)
+	require.NoError(t, err)
+
+	// block user1 and delete user2's comment, both still visible to admin. Deleted comment has no text anymore
+	// and can be found by user name only
+	require.NoError(t, srv.DataService.SetBlock("remark42", "user1", true, 0))
+	id3, err := srv.DataService.Create(store.Comment{Text: "test deleted", Locator: store.Locator{SiteID: "remark42",
+		URL: "https://radio-t.com/blah"}, User: store.User{Name: "user2 name", ID: "user2"}})
+	require.NoError(t, err)
+	require.NoError(t, srv.DataService.Delete(store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}, id3, store.SoftDelete))
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/admin/search?site=remark42&q=name", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+	res, err := sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	comments := []store.Comment{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&comments))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 3, len(comments), "deleted and blocked included")
+	deleted := 0
+	for _, c := range comments {
+		if c.Deleted {
+			deleted++
+		}
+	}
+	assert.Equal(t, 1, deleted)
+
+	req, err = http.NewRequest("GET", ts.URL+"/api/v1/admin/search?site=remark42&q=user1", http.NoBody)
+	require.NoError(t, err)
+	res, err = sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	comments = []store.Comment{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&comments))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 1, len(comments), "blocked user's comment found by name")
+	assert.Equal(t, id1, comments[0].ID)
+	assert.True(t, comments[0].User.Blocked)
+
+	req, err = http.NewRequest("GET", ts.URL+"/api/v1/admin/search?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	res, err = sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	_, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/search?site=remark42&q=name&skip=-1")
+	assert.Equal(t, http.StatusBadRequest, code, "negative skip rejected")
+}
+
+func TestAdmin_PendingApprove(t *testing.T) {
+	ts, _, teardown := startupT(t, func(srv *Rest) {
+		srv.DataService.PreModeration.Sites = []string{"remark42"}
+	})
+	defer teardown()
+
+	id := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}}, ts)
+
+	lastComments := func(token string) []store.Comment {
+		req, err := http.NewRequest("GET", ts.URL+"/api/v1/last/10?site=remark42", http.NoBody)
+		require.NoError(t, err)
+		res, err := sendReq(req, token)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		comments := []store.Comment{}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&comments))
+		require.NoError(t, res.Body.Close())
+		return comments
+	}
+	assert.Equal(t, 0, len(lastComments("")), "pending comment hidden from anonymous")
+	assert.Equal(t, 0, len(lastComments(dev2Token)), "pending comment hidden from other user")
+	comments := lastComments(devToken)
+	require.Equal(t, 1, len(comments), "pending comment visible to author")
+	assert.True(t, comments[0].Pending)
+	body, code := get(t, ts.URL+"/api/v1/count?site=remark42&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"count":0,"locator":{"site":"remark42","url":"https://radio-t.com/blah"}}`+"\n", body)
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/admin/pending?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+	res, err := sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	comments = []store.Comment{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&comments))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 1, len(comments))
+	assert.Equal(t, id, comments[0].ID)
+
+	req, err = http.NewRequest("PUT", ts.URL+"/api/v1/admin/approve/"+id+"?site=remark42&url=https://radio-t.com/blah", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+	res, err = sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	comments = lastComments("")
+	require.Equal(t, 1, len(comments), "approved comment visible to everyone")
+	assert.False(t, comments[0].Pending)
+
+	res, err = sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "already approved")
+
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/pending?site=remark42")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+
+	_, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/pending?site=remark42&skip=-1")
+	assert.Equal(t, http.StatusBadRequest, code, "negative skip rejected")
+}
+
+func TestAdmin_Reports(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	id1 := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}}, ts)
+	id2 := addComment(t, store.Comment{Text: "test test #2",
+		Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}}, ts)
+
+	for _, id := range []string{id1, id2} {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/report/"+id+"?site=remark42&url=https://radio-t.com/blah",
+			strings.NewReader(`{"reason":"abuse","note":"rude"}`))
+		require.NoError(t, err)
+		res, err := sendReq(req, dev2Token)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/admin/reports?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+	res, err := sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	comments := []store.Comment{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&comments))
+	require.NoError(t, res.Body.Close())
+	require.Equal(t, 2, len(comments))
+	assert.Equal(t, store.ReportAbuse, comments[0].Reports["provider1_dev2"].Reason)
+	assert.Equal(t, "rude", comments[0].Reports["provider1_dev2"].Note)
+
+	body, code := get(t, ts.URL+"/api/v1/id/"+id1+"?site=remark42&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, "rude", "reports hidden from non-admin")
+
+	review := func(id, action string) int {
+		req, err := http.NewRequest("PUT",
+			ts.URL+"/api/v1/admin/reports/"+id+"?site=remark42&url=https://radio-t.com/blah&action="+action, http.NoBody)
+		require.NoError(t, err)
+		requireAdminOnly(t, req)
+		res, err := sendReq(req, adminUmputunToken)
+		require.NoError(t, err)
+		require.NoError(t, res.Body.Close())
+		return res.StatusCode
+	}
+	assert.Equal(t, http.StatusBadRequest, review(id1, "blah"))
+	assert.Equal(t, http.StatusOK, review(id1, "dismiss"))
+	assert.Equal(t, http.StatusBadRequest, review(id1, "dismiss"), "no reports left")
+	assert.Equal(t, http.StatusOK, review(id2, "resolve"))
+
+	body, code = get(t, ts.URL+"/api/v1/id/"+id2+"?site=remark42&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusOK, code)
+	c := store.Comment{}
+	require.NoError(t, json.Unmarshal([]byte(body), &c))
+	assert.True(t, c.Deleted, "resolved comment deleted")
+
+	body, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/reports?site=remark42")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", body)
+
+	_, code = getWithAdminAuth(t, ts.URL+"/api/v1/admin/reports?site=remark42&limit=-1")
+	assert.Equal(t, http.StatusBadRequest, code, "negative limit rejected")
+}
+
+func TestAdmin_ShadowBan(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	mockDestination := &notify.MockDest{}
+	srv.privRest.notifyService = notify.NewService(srv.DataService, 1, mockDestination)
+	defer srv.privRest.notifyService.Close()
+
+	block := func(val string) R.JSON {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/admin/user/provider1_dev?site=remark42&block="+val, http.NoBody)
+		require.NoError(t, err)
+		requireAdminOnly(t, req)
+		resp, err := sendReq(req, adminUmputunToken)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		j := R.JSON{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&j))
+		require.NoError(t, resp.Body.Close())
+		return j
+	}
+
+	j := block("shadow")
+	assert.Equal(t, true, j["shadow"])
+	assert.Equal(t, false, j["block"])
+	assert.True(t, srv.DataService.IsShadowBanned("remark42", "provider1_dev"))
+	assert.False(t, srv.DataService.IsBlocked("remark42", "provider1_dev"))
+
+	id := addComment(t, store.Comment{Text: "shadowed text",
+		Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}}, ts)
+
+	find := func(token string) []store.Comment {
+		req, err := http.NewRequest("GET", ts.URL+"/api/v1/find?site=remark42&url=https://radio-t.com/blah&format=plain", http.NoBody)
+		require.NoError(t, err)
+		resp, err := sendReq(req, token)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		res := commentsWithInfo{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		require.NoError(t, resp.Body.Close())
+		return res.Comments
+	}
+	assert.Empty(t, find(""), "hidden from anonymous")
+	assert.Empty(t, find(dev2Token), "hidden from other user")
+	comments := find(devToken)
+	require.Equal(t, 1, len(comments), "visible to the user")
+	assert.False(t, comments[0].User.Shadowed)
+	comments = find(adminUmputunToken)
+	require.Equal(t, 1, len(comments), "visible to admin")
+	assert.Equal(t, id, comments[0].ID)
+	assert.True(t, comments[0].User.Shadowed, "marked as shadowed for admin")
+
+	body, code := get(t, ts.URL+"/api/v1/count?site=remark42&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"count":0,"locator":{"site":"remark42","url":"https://radio-t.com/blah"}}`+"\n", body)
+	body, code = get(t, ts.URL+"/api/v1/rss/site?site=remark42")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, body, "shadowed text")
+
+	// comment of the other user notified, shadowed one is not
+	req, err := http.NewRequest("POST", ts.URL+"/api/v1/comment?site=remark42",
+		strings.NewReader(`{"text": "regular text", "locator":{"url": "https://radio-t.com/blah", "site": "remark42"}}`))
+	require.NoError(t, err)
+	resp, err := sendReq(req, dev2Token)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	waitForCount(t, 1, func() int { return len(mockDestination.Get()) })
+	assert.Equal(t, "regular text", mockDestination.Get()[0].Comment.Orig)
+
+	j = block("0")
+	assert.Equal(t, false, j["block"])
+	assert.False(t, srv.DataService.IsShadowBanned("remark42", "provider1_dev"), "unblock lifts shadow ban")
+	assert.Equal(t, 2, len(find("")))
+}
+
 func TestAdmin_BlockedList(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
@@ -457,6 +804,449 @@ func TestAdmin_BlockedList(t *testing.T) {
 	}, waitTimeout, httpPoll)
 }
 
+func TestAdmin_SiteSettings(t *testing.T) {
+	ts, _, teardown := startupT(t, func(srv *Rest) {
+		st, err := settings.NewStore(filepath.Join(t.TempDir(), "site-settings.json"),
+			settings.Settings{MaxCommentSize: 4000, EditDuration: settings.Duration(5 * time.Minute), LowScore: -5})
+		require.NoError(t, err)
+		srv.SiteSettings, srv.DataService.SiteSettings = st, st
+	})
+	defer teardown()
+
+	siteSettings := func(method, body string) (code int, res R.JSON) {
+		req, err := http.NewRequest(method, ts.URL+"/api/v1/admin/settings?site=remark42", strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := sendReq(req, adminUmputunToken)
+		require.NoError(t, err)
+		res = R.JSON{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode, res
+	}
+	config := func() R.JSON {
+		body, code := get(t, ts.URL+"/api/v1/config?site=remark42")
+		require.Equal(t, http.StatusOK, code)
+		res := R.JSON{}
+		require.NoError(t, json.Unmarshal([]byte(body), &res))
+		return res
+	}
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/admin/settings?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+
+	code, res := siteSettings("GET", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 4000.0, res["settings"].(map[string]any)["max_comment_size"])
+	assert.Equal(t, map[string]any{}, res["override"])
+
+	code, res = siteSettings("PUT", `{"max_comment_size": 10, "edit_duration": "1h"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 10.0, res["settings"].(map[string]any)["max_comment_size"])
+	assert.Equal(t, -5.0, res["settings"].(map[string]any)["low_score"], "default kept")
+	assert.Equal(t, map[string]any{"max_comment_size": 10.0, "edit_duration": "1h"}, res["override"])
+	assert.Equal(t, 10.0, config()["max_comment_size"])
+	assert.Equal(t, 3600.0, config()["edit_duration"])
+
+	c := store.Comment{Text: "comment longer than 10 characters", Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}}
+	b, err := json.Marshal(c)
+	require.NoError(t, err)
+	resp, err := post(t, ts.URL+"/api/v1/comment?site=remark42", string(b))
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "site's max comment size applied")
+
+	code, res = siteSettings("PUT", `{"max_comment_size": "big"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "can't set site settings", res["details"])
+	assert.Equal(t, 10.0, config()["max_comment_size"], "settings not changed")
+
+	code, res = siteSettings("DELETE", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 4000.0, res["settings"].(map[string]any)["max_comment_size"])
+	assert.Equal(t, 4000.0, config()["max_comment_size"])
+}
+
+func TestAdmin_SiteSettingsDisabled(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/settings?site=remark42")
+	assert.Equal(t, http.StatusOK, code)
+	res := R.JSON{}
+	require.NoError(t, json.Unmarshal([]byte(body), &res))
+	assert.Equal(t, 4000.0, res["settings"].(map[string]any)["max_comment_size"], "cli settings used")
+
+	req, err := http.NewRequest("PUT", ts.URL+"/api/v1/admin/settings?site=remark42", strings.NewReader(`{"max_comment_size": 10}`))
+	require.NoError(t, err)
+	resp, err := sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAdmin_Audit(t *testing.T) {
+	ts, srv, teardown := startupT(t, func(srv *Rest) {
+		auditLog, err := audit.NewStore(filepath.Join(t.TempDir(), "audit.log"))
+		require.NoError(t, err)
+		srv.AuditLog, srv.Migrator.AuditLog = auditLog, auditLog
+	})
+	defer teardown()
+
+	c1 := store.Comment{Text: "test test #1", Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"},
+		User: store.User{Name: "user1 name", ID: "user1"}}
+	id1, err := srv.DataService.Create(c1)
+	require.NoError(t, err)
+
+	adminReq := func(method, url string) {
+		req, e := http.NewRequest(method, ts.URL+url, http.NoBody)
+		require.NoError(t, e)
+		resp, e := sendReq(req, adminUmputunToken)
+		require.NoError(t, e)
+		require.NoError(t, resp.Body.Close())
+		require.Equal(t, http.StatusOK, resp.StatusCode, url)
+	}
+	adminReq("PUT", "/api/v1/admin/pin/"+id1+"?site=remark42&url=https://radio-t.com/blah&pin=1")
+	adminReq("PUT", "/api/v1/admin/user/user1?site=remark42&block=1&ttl=1h")
+	adminReq("DELETE", "/api/v1/admin/comment/"+id1+"?site=remark42&url=https://radio-t.com/blah")
+	adminReq("GET", "/api/v1/admin/export?site=remark42&mode=stream")
+	req, err := http.NewRequest("PUT", ts.URL+"/api/v1/admin/verify/user1?site=remark42&verified=1", http.NoBody)
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "password")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", ts.URL+"/api/v1/admin/audit?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+
+	auditRecords := func(query string) []audit.Record {
+		body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/audit?site=remark42"+query)
+		require.Equal(t, http.StatusOK, code, body)
+		res := []audit.Record{}
+		require.NoError(t, json.Unmarshal([]byte(body), &res))
+		return res
+	}
+
+	recs := auditRecords("")
+	require.Len(t, recs, 5)
+	assert.Equal(t, audit.ActionVerify, recs[0].Action, "most recent first")
+	assert.Equal(t, "admin", recs[0].Actor.ID)
+	assert.JSONEq(t, `{"blocked":true,"shadow":false,"verified":false,"comments":1}`, string(recs[0].Before))
+	assert.JSONEq(t, `{"blocked":true,"shadow":false,"verified":true,"comments":1}`, string(recs[0].After))
+
+	assert.Equal(t, audit.ActionExport, recs[1].Action)
+	assert.Equal(t, audit.Actor{ID: "github_ef0f706a7", Name: "Umputun"}, recs[1].Actor)
+
+	assert.Equal(t, audit.ActionDeleteComment, recs[2].Action)
+	assert.Equal(t, id1, recs[2].Target)
+	assert.Equal(t, "https://radio-t.com/blah", recs[2].URL)
+	before, after := store.Comment{}, store.Comment{}
+	require.NoError(t, json.Unmarshal(recs[2].Before, &before))
+	require.NoError(t, json.Unmarshal(recs[2].After, &after))
+	assert.Equal(t, "test test #1", before.Text)
+	assert.False(t, before.Deleted)
+	assert.Empty(t, after.Text)
+	assert.True(t, after.Deleted)
+
+	assert.Equal(t, audit.ActionBlock, recs[3].Action)
+	assert.Equal(t, "user1", recs[3].Target)
+	assert.JSONEq(t, `{"blocked":false,"shadow":false,"verified":false,"comments":1}`, string(recs[3].Before))
+	assert.JSONEq(t, `{"blocked":true,"shadow":false,"verified":false,"comments":1}`, string(recs[3].After))
+
+	assert.Equal(t, audit.ActionPin, recs[4].Action)
+	before, after = store.Comment{}, store.Comment{}
+	require.NoError(t, json.Unmarshal(recs[4].Before, &before))
+	require.NoError(t, json.Unmarshal(recs[4].After, &after))
+	assert.False(t, before.Pin)
+	assert.True(t, after.Pin)
+
+	recs = auditRecords("&actor=admin")
+	require.Len(t, recs, 1)
+	assert.Equal(t, audit.ActionVerify, recs[0].Action)
+
+	recs = auditRecords(fmt.Sprintf("&since=%d", time.Now().Add(time.Hour).UnixMilli()))
+	assert.Empty(t, recs)
+
+	recs = auditRecords("&limit=2")
+	require.Len(t, recs, 2)
+	assert.Equal(t, audit.ActionExport, recs[1].Action)
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/audit?site=remark42&since=bad")
+	assert.Equal(t, http.StatusBadRequest, code, body)
+}
+
+func TestAdmin_AuditDisabled(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/audit?site=remark42")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "audit log disabled")
+}
+
+func TestAdmin_PictureBans(t *testing.T) {
+	ts, srv, teardown := startupT(t, func(srv *Rest) {
+		auditLog, err := audit.NewStore(filepath.Join(t.TempDir(), "audit.log"))
+		require.NoError(t, err)
+		srv.AuditLog = auditLog
+		srv.ImageService.Hashes, err = image.NewHashStore(filepath.Join(t.TempDir(), "hashes.db"), bolt.Options{})
+		require.NoError(t, err)
+	})
+	defer teardown()
+	defer srv.ImageService.Hashes.Close()
+
+	upload := func() (code int, id string) {
+		bodyBuf := &bytes.Buffer{}
+		bodyWriter := multipart.NewWriter(bodyBuf)
+		fileWriter, err := bodyWriter.CreateFormFile("file", "picture.png")
+		require.NoError(t, err)
+		_, err = io.Copy(fileWriter, gopherPNG())
+		require.NoError(t, err)
+		require.NoError(t, bodyWriter.Close())
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/picture?site=remark42", bodyBuf)
+		require.NoError(t, err)
+		req.Header.Add("Content-Type", bodyWriter.FormDataContentType())
+		resp, err := sendReq(req, devToken)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		m := map[string]string{}
+		_ = json.NewDecoder(resp.Body).Decode(&m)
+		return resp.StatusCode, m["id"]
+	}
+	adminReq := func(method, url string) (code int, body []byte) {
+		req, err := http.NewRequest(method, ts.URL+url, http.NoBody)
+		require.NoError(t, err)
+		requireAdminOnly(t, req)
+		resp, err := sendReq(req, adminUmputunToken)
+		require.NoError(t, err)
+		body, err = io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode, body
+	}
+
+	code, id := upload()
+	require.Equal(t, http.StatusOK, code)
+	code, id2 := upload()
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, id, id2, "re-upload of the same image reuses it")
+
+	code, body := adminReq(http.MethodPut, "/api/v1/admin/picture/"+id+"/ban?site=remark42")
+	require.Equal(t, http.StatusOK, code, string(body))
+	ban := image.BannedImage{}
+	require.NoError(t, json.Unmarshal(body, &ban))
+	assert.Equal(t, id, ban.ImageID)
+	assert.Len(t, ban.Hash, 16)
+	code, _ = adminReq(http.MethodPut, "/api/v1/admin/picture/dev/unknown.png/ban?site=remark42")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = upload()
+	assert.Equal(t, http.StatusForbidden, code, "banned image rejected")
+
+	code, body = adminReq(http.MethodGet, "/api/v1/admin/picture/bans?site=remark42")
+	require.Equal(t, http.StatusOK, code)
+	bans := []image.BannedImage{}
+	require.NoError(t, json.Unmarshal(body, &bans))
+	require.Len(t, bans, 1)
+	assert.Equal(t, ban.Hash, bans[0].Hash)
+
+	code, _ = adminReq(http.MethodDelete, "/api/v1/admin/picture/bans/"+ban.Hash+"?site=remark42")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = adminReq(http.MethodDelete, "/api/v1/admin/picture/bans/"+ban.Hash+"?site=remark42")
+	assert.Equal(t, http.StatusBadRequest, code, "not banned anymore")
+	code, _ = upload()
+	assert.Equal(t, http.StatusOK, code)
+
+	recs, err := srv.AuditLog.Find(audit.FindRequest{SiteID: "remark42"})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, audit.ActionBanImage, recs[0].Action)
+	assert.Equal(t, id, recs[0].Target)
+	assert.Empty(t, recs[0].After, "unban")
+	assert.Equal(t, id, recs[1].Target)
+	assert.Empty(t, recs[1].Before, "ban")
+}
+
+func TestAdmin_Pictures(t *testing.T) {
+	ts, srv, teardown := startupT(t, func(srv *Rest) {
+		auditLog, err := audit.NewStore(filepath.Join(t.TempDir(), "audit.log"))
+		require.NoError(t, err)
+		srv.AuditLog = auditLog
+		srv.DataService.ImageService = srv.ImageService
+	})
+	defer teardown()
+	defer srv.ImageService.Close(context.Background()) // comments submit their images, which starts the submitter
+
+	upload := func() (code int, id string) {
+		bodyBuf := &bytes.Buffer{}
+		bodyWriter := multipart.NewWriter(bodyBuf)
+		fileWriter, err := bodyWriter.CreateFormFile("file", "picture.png")
+		require.NoError(t, err)
+		_, err = io.Copy(fileWriter, gopherPNG())
+		require.NoError(t, err)
+		require.NoError(t, bodyWriter.Close())
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/picture?site=remark42", bodyBuf)
+		require.NoError(t, err)
+		req.Header.Add("Content-Type", bodyWriter.FormDataContentType())
+		resp, err := sendReq(req, devToken)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		m := map[string]string{}
+		_ = json.NewDecoder(resp.Body).Decode(&m)
+		return resp.StatusCode, m["id"]
+	}
+	adminReq := func(method, url string, res any) int {
+		req, err := http.NewRequest(method, ts.URL+url, http.NoBody)
+		require.NoError(t, err)
+		resp, err := sendReq(req, adminUmputunToken)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if res != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(res))
+		}
+		return resp.StatusCode
+	}
+
+	code, id1 := upload()
+	require.Equal(t, http.StatusOK, code)
+	code, id2 := upload()
+	require.Equal(t, http.StatusOK, code)
+	cid := addComment(t, store.Comment{Text: fmt.Sprintf("pic ![](%s/api/v1/picture/%s) here", srv.RemarkURL, id1),
+		Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah1"}}, ts)
+	require.NoError(t, srv.ImageService.Commit(func() []string { return []string{id1, id2} }))
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/admin/pictures?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+	pics := []pictureInfo{}
+	require.Equal(t, http.StatusOK, adminReq(http.MethodGet, "/api/v1/admin/pictures?site=remark42&user=provider1_dev", &pics))
+	require.Len(t, pics, 2)
+	comments := map[string]int{pics[0].ID: pics[0].Comments, pics[1].ID: pics[1].Comments}
+	assert.Equal(t, map[string]int{id1: 1, id2: 0}, comments)
+	assert.Equal(t, int64(1462), pics[0].Size)
+	assert.False(t, pics[0].Created.IsZero())
+
+	pics = []pictureInfo{}
+	require.Equal(t, http.StatusOK, adminReq(http.MethodGet, "/api/v1/admin/pictures?site=remark42", &pics))
+	require.Len(t, pics, 1, "only images used on the site")
+	assert.Equal(t, id1, pics[0].ID)
+
+	orphans := []image.Meta{}
+	require.Equal(t, http.StatusOK, adminReq(http.MethodGet, "/api/v1/admin/pictures/orphaned?site=remark42", &orphans))
+	require.Len(t, orphans, 1)
+	assert.Equal(t, id2, orphans[0].ID)
+
+	res := map[string]any{}
+	require.Equal(t, http.StatusOK, adminReq(http.MethodDelete, "/api/v1/admin/picture/"+id1+"?site=remark42", &res))
+	assert.Equal(t, map[string]any{"id": id1, "site_id": "remark42", "comments": 1.0}, res)
+	_, err = srv.ImageService.Load(id1)
+	assert.Error(t, err, "image deleted")
+	c, err := srv.DataService.Get(store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah1"}, cid, store.User{})
+	require.NoError(t, err)
+	assert.Equal(t, "<p>pic  here</p>\n", c.Text)
+	assert.Equal(t, "pic  here", c.Orig)
+
+	recs, err := srv.AuditLog.Find(audit.FindRequest{SiteID: "remark42"})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, audit.ActionDeleteImage, recs[0].Action)
+	assert.Equal(t, id1, recs[0].Target)
+	assert.Contains(t, string(recs[0].Before), `"size":1462`)
+
+	srv.ImageService.UserQuota = 2000
+	code, _ = upload()
+	assert.Equal(t, http.StatusForbidden, code, "over quota with the orphaned image")
+	srv.ImageService.UserQuota = 0
+
+	// user deletion removes the user's images not used in comments
+	require.Equal(t, http.StatusOK, adminReq(http.MethodDelete, "/api/v1/admin/user/provider1_dev?site=remark42", nil))
+	_, err = srv.ImageService.Load(id2)
+	assert.Error(t, err, "orphaned image of the deleted user removed")
+	pics = []pictureInfo{}
+	require.Equal(t, http.StatusOK, adminReq(http.MethodGet, "/api/v1/admin/pictures?site=remark42&user=provider1_dev", &pics))
+	assert.Empty(t, pics)
+}
+
+func TestAdmin_NotifyOutbox(t *testing.T) {
+	outbox, err := notify.NewOutbox(filepath.Join(t.TempDir(), "outbox.db"), bolt.Options{}, notify.OutboxParams{Attempts: 1})
+	require.NoError(t, err)
+	notifyService := notify.NewServiceWithOutbox(nil, outbox, failingDest{})
+	defer notifyService.Close()
+	ts, _, teardown := startupT(t, func(srv *Rest) { srv.NotifyService = notifyService })
+	defer teardown()
+
+	notifyService.Submit(notify.Request{Comment: store.Comment{ID: "c1", Locator: store.Locator{SiteID: "remark42"}}})
+	notifyService.SubmitVerification(notify.VerificationRequest{SiteID: "remark42", User: "user1", Token: "secret token"})
+	notifyService.Submit(notify.Request{Comment: store.Comment{ID: "c2", Locator: store.Locator{SiteID: "other"}}})
+
+	var res struct {
+		Retrying []notify.Delivery `json:"retrying"`
+		Dead     []notify.Delivery `json:"dead"`
+	}
+	require.Eventually(t, func() bool {
+		body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/notify?site=remark42")
+		return code == http.StatusOK && json.Unmarshal([]byte(body), &res) == nil && len(res.Dead) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Empty(t, res.Retrying)
+	assert.Equal(t, "c1", res.Dead[0].Request.Comment.ID)
+	assert.Equal(t, "failingdest", res.Dead[0].Destination)
+	assert.Equal(t, "failed to send", res.Dead[0].LastError)
+	assert.Equal(t, "user1", res.Dead[1].Verification.User)
+	assert.Empty(t, res.Dead[1].Verification.Token, "token hidden")
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/admin/notify/replay?site=remark42&id="+res.Dead[0].ID, http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+	resp, err := sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assert.JSONEq(t, `{"replayed":1}`, string(body))
+
+	req, err = http.NewRequest(http.MethodPut, ts.URL+"/api/v1/admin/notify/replay?site=remark42&id=bad", http.NoBody)
+	require.NoError(t, err)
+	resp, err = sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/v1/admin/notify?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	requireAdminOnly(t, req)
+}
+
+func TestAdmin_NotifyOutboxDisabled(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	body, code := getWithAdminAuth(t, ts.URL+"/api/v1/admin/notify?site=remark42")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "notification outbox disabled")
+
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/admin/notify/replay?site=remark42", http.NoBody)
+	require.NoError(t, err)
+	resp, err := sendReq(req, adminUmputunToken)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// failingDest is notification destination failing all sends
+type failingDest struct{}
+
+func (failingDest) String() string { return "failing destination" }
+
+func (failingDest) Send(context.Context, notify.Request) error { return errors.New("failed to send") }
+
+func (failingDest) SendVerification(context.Context, notify.VerificationRequest) error {
+	return errors.New("failed to send")
+}
+
 func TestAdmin_ReadOnly(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/didip/tollbooth/v8"
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// CreateEmailReply creates comment from the reply to email notification, received by notify.EmailReplyServer.
+// Token of the reply address identifies the user and the comment replied to, the reply should be sent from the
+// email of the user. The comment checked and rate limited by user the same way as comment posted with api.
+// Paid subscription is known from auth token only, so replies by email rejected for subscribers-only sites.
+func (s *Rest) CreateEmailReply(_ context.Context, reply notify.EmailReply) error {
+	if s.EmailReplies == nil {
+		return errors.New("replies by email disabled")
+	}
+	target, err := s.EmailReplies.Get(reply.Token)
+	if err != nil {
+		return fmt.Errorf("unknown reply address: %w", err)
+	}
+
+	email, err := s.DataService.GetUserEmail(target.SiteID, target.UserID)
+	if err != nil || email == "" || !strings.EqualFold(email, reply.From) {
+		return fmt.Errorf("sender %s is not the recipient of the notification", reply.From)
+	}
+
+	if s.siteSettings(target.SiteID).SubscribersOnly {
+		return errors.New("only subscribers allowed to comment")
+	}
+
+	s.emailReplyOnce.Do(func() {
+		s.emailReplyLimiter = tollbooth.NewLimiter(s.updateLimiter(), nil)
+		_, s.emailReplyRest, _, _ = s.controllerGroups()
+	})
+	if httpErr := tollbooth.LimitByKeys(s.emailReplyLimiter, []string{target.SiteID, target.UserID}); httpErr != nil {
+		return errors.New("too many replies")
+	}
+
+	// name and picture of the user taken from the last comment of the user, as there is no other source of them
+	// without auth. Viewed as the user, so the comments hidden from others, pending or shadow banned, are found too
+	comments, err := s.DataService.User(target.SiteID, target.UserID, 1, 0, store.User{ID: target.UserID})
+	if err != nil || len(comments) == 0 {
+		return fmt.Errorf("can't find user %s", target.UserID)
+	}
+	user := store.User{ID: target.UserID, Name: comments[0].User.Name, Picture: comments[0].User.Picture, SiteID: target.SiteID}
+
+	// status of the user is the current one, not the one of the comment
+	admins, err := s.DataService.AdminStore.Admins(target.SiteID)
+	if err != nil {
+		return fmt.Errorf("can't get admins for %s: %w", target.SiteID, err)
+	}
+	user.Admin = slices.Contains(admins, user.ID)
+	user.Blocked = s.DataService.IsBlocked(target.SiteID, user.ID)
+	user.Verified = !user.Blocked && s.DataService.IsVerified(target.SiteID, user.ID)
+
+	comment := store.Comment{Locator: store.Locator{SiteID: target.SiteID, URL: target.URL}, ParentID: target.ParentID, Text: reply.Text}
+	c, err := s.emailReplyRest.createComment(comment, user)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] created comment %s from email reply of %s to %s", c.ID, user.ID, target.ParentID)
+	return nil
+}
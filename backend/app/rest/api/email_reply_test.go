@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/emailreply"
+)
+
+func TestRest_CreateEmailReply(t *testing.T) {
+	_, srv, teardown := startupT(t, func(srv *Rest) {
+		replies, err := emailreply.NewStore(filepath.Join(t.TempDir(), "replies.db"), 0, bolt.Options{})
+		require.NoError(t, err)
+		srv.EmailReplies = replies
+	})
+	defer teardown()
+	replies := srv.EmailReplies
+	defer replies.Close()
+
+	locator := store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}
+	_, err := srv.DataService.Create(store.Comment{Text: "dev comment", Locator: locator, User: store.User{ID: "dev", Name: "developer one"}})
+	require.NoError(t, err)
+	parentID, err := srv.DataService.Create(store.Comment{Text: "reply to dev", Locator: locator, User: store.User{ID: "user1", Name: "user one"}})
+	require.NoError(t, err)
+	_, err = srv.DataService.SetUserEmail("remark42", "dev", "dev@example.com")
+	require.NoError(t, err)
+	token, err := srv.EmailReplies.Add(emailreply.Target{SiteID: "remark42", URL: locator.URL, ParentID: parentID, UserID: "dev"})
+	require.NoError(t, err)
+
+	// replies received by the smtp server
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	replyServer := &notify.EmailReplyServer{ReplyAddress: "reply@example.com", Handler: srv.CreateEmailReply}
+	go func() { _ = replyServer.Serve(ctx, lst) }()
+
+	msg := "From: Dev <dev@example.com>\r\nSubject: Re: New reply\r\n\r\nmy *answer*\r\n\r\nOn Mon, 1 Jan 2024, Remark42 wrote:\r\n> reply to dev\r\n"
+	err = smtp.SendMail(lst.Addr().String(), nil, "dev@example.com", []string{notify.EmailReplyAddress("reply@example.com", token)}, []byte(msg))
+	require.NoError(t, err)
+
+	comments, err := srv.DataService.User("remark42", "dev", 1, 0, store.User{})
+	require.NoError(t, err)
+	require.Len(t, comments, 1)
+	assert.Equal(t, "<p>my <em>answer</em></p>\n", comments[0].Text)
+	assert.Equal(t, "my *answer*", comments[0].Orig)
+	assert.Equal(t, parentID, comments[0].ParentID)
+	assert.Equal(t, locator, comments[0].Locator)
+	assert.Equal(t, "developer one", comments[0].User.Name)
+
+	err = smtp.SendMail(lst.Addr().String(), nil, "dev@example.com", []string{"reply+bad@example.com"}, []byte(msg))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "reply rejected: unknown reply address: reply token not found")
+
+	err = srv.CreateEmailReply(ctx, notify.EmailReply{Token: token, From: "other@example.com", Text: "reply"})
+	assert.EqualError(t, err, "sender other@example.com is not the recipient of the notification")
+	err = srv.CreateEmailReply(ctx, notify.EmailReply{Token: token, From: "DEV@example.com", Text: "reply with duck"})
+	assert.EqualError(t, err, "invalid comment: comment contains restricted words")
+
+	for i := 0; i < 20; i++ {
+		if err = srv.CreateEmailReply(ctx, notify.EmailReply{Token: token, From: "dev@example.com", Text: "one more reply"}); err != nil {
+			break
+		}
+	}
+	assert.EqualError(t, err, "too many replies", "rate limited by user")
+
+	srv.EmailReplies = nil
+	err = srv.CreateEmailReply(ctx, notify.EmailReply{Token: token, From: "dev@example.com", Text: "reply"})
+	assert.EqualError(t, err, "replies by email disabled")
+}
+
+func TestRest_CreateEmailReplyUserStatus(t *testing.T) {
+	_, srv, teardown := startupT(t, func(srv *Rest) {
+		replies, err := emailreply.NewStore(filepath.Join(t.TempDir(), "replies.db"), 0, bolt.Options{})
+		require.NoError(t, err)
+		srv.EmailReplies = replies
+	})
+	defer teardown()
+	defer srv.EmailReplies.Close()
+
+	// status of the last comment is stale, user is not admin and paid subscription unknown
+	locator := store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}
+	parentID, err := srv.DataService.Create(store.Comment{Text: "some comment", Locator: locator,
+		User: store.User{ID: "dev", Name: "developer one", Admin: true, PaidSub: true}})
+	require.NoError(t, err)
+	_, err = srv.DataService.SetUserEmail("remark42", "dev", "dev@example.com")
+	require.NoError(t, err)
+	token, err := srv.EmailReplies.Add(emailreply.Target{SiteID: "remark42", URL: locator.URL, ParentID: parentID, UserID: "dev"})
+	require.NoError(t, err)
+
+	err = srv.CreateEmailReply(context.Background(), notify.EmailReply{Token: token, From: "dev@example.com", Text: "my answer"})
+	require.NoError(t, err)
+	comments, err := srv.DataService.User("remark42", "dev", 1, 0, store.User{ID: "dev"})
+	require.NoError(t, err)
+	require.Len(t, comments, 1)
+	assert.Equal(t, "my answer", comments[0].Orig)
+	assert.False(t, comments[0].User.Admin, "admin status is the current one")
+	assert.False(t, comments[0].User.PaidSub)
+
+	require.NoError(t, srv.DataService.SetBlock("remark42", "dev", true, 0))
+	err = srv.CreateEmailReply(context.Background(), notify.EmailReply{Token: token, From: "dev@example.com", Text: "blocked answer"})
+	assert.EqualError(t, err, "user blocked: rejected")
+	require.NoError(t, srv.DataService.SetBlock("remark42", "dev", false, 0))
+
+	srv.SubscribersOnly = true
+	err = srv.CreateEmailReply(context.Background(), notify.EmailReply{Token: token, From: "dev@example.com", Text: "paid answer"})
+	assert.EqualError(t, err, "only subscribers allowed to comment", "paid subscription can't be checked without auth")
+}
+
+func TestRest_CreateEmailReplyShadowBanned(t *testing.T) {
+	_, srv, teardown := startupT(t, func(srv *Rest) {
+		replies, err := emailreply.NewStore(filepath.Join(t.TempDir(), "replies.db"), 0, bolt.Options{})
+		require.NoError(t, err)
+		srv.EmailReplies = replies
+	})
+	defer teardown()
+	defer srv.EmailReplies.Close()
+
+	locator := store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}
+	parentID, err := srv.DataService.Create(store.Comment{Text: "some comment", Locator: locator, User: store.User{ID: "user1", Name: "user one"}})
+	require.NoError(t, err)
+	_, err = srv.DataService.Create(store.Comment{Text: "shadow comment", Locator: locator, User: store.User{ID: "shadow", Name: "shadow one"}})
+	require.NoError(t, err)
+	_, err = srv.DataService.SetUserEmail("remark42", "shadow", "shadow@example.com")
+	require.NoError(t, err)
+	require.NoError(t, srv.DataService.SetShadowBan("remark42", "shadow", true))
+	token, err := srv.EmailReplies.Add(emailreply.Target{SiteID: "remark42", URL: locator.URL, ParentID: parentID, UserID: "shadow"})
+	require.NoError(t, err)
+
+	err = srv.CreateEmailReply(context.Background(), notify.EmailReply{Token: token, From: "shadow@example.com", Text: "my answer"})
+	require.NoError(t, err, "user found by own hidden comments")
+
+	comments, err := srv.DataService.User("remark42", "shadow", 1, 0, store.User{ID: "shadow"})
+	require.NoError(t, err)
+	require.Len(t, comments, 1)
+	assert.Equal(t, "my answer", comments[0].Orig)
+	assert.Equal(t, "shadow one", comments[0].User.Name)
+}
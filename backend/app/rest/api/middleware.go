@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/mail"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +15,9 @@ import (
 	"github.com/didip/tollbooth/v8/limiter"
 	log "github.com/go-pkgz/lgr"
 	R "github.com/go-pkgz/rest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
 	"github.com/umputun/remark42/backend/app/rest"
 	"github.com/umputun/remark42/backend/app/store"
 )
@@ -279,11 +283,11 @@ func securityHeadersMiddleware(imageProxyEnabled bool, allowedAncestors []string
 	}
 }
 
-// subscribersOnly is a middleware rejecting non-paid_sub users
-func subscribersOnly(enable bool) func(http.Handler) http.Handler {
+// subscribersOnly is a middleware rejecting non-paid_sub users for sites with enabled(siteID)
+func subscribersOnly(enabled func(siteID string) bool) func(http.Handler) http.Handler {
 	return func(h http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
-			if enable {
+			if enabled(r.URL.Query().Get("site")) {
 				user, err := rest.GetUserInfo(r)
 				if err != nil {
 					http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -358,3 +362,56 @@ func rateLimiter(maxReq float64) func(http.Handler) http.Handler {
 	})
 	return tollbooth.HTTPMiddleware(lmt)
 }
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "remark42_http_requests_total", Help: "HTTP requests by route group and status"}, []string{"group", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "remark42_http_request_duration_seconds", Help: "HTTP requests latency by route group"}, []string{"group"})
+)
+
+// metricsMiddleware counts requests of the route group by response status and records their latency.
+// Should be the first middleware of the group, to count requests rejected by others, i.e. by rate limiter
+func metricsMiddleware(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			timer := prometheus.NewTimer(httpDuration.WithLabelValues(group))
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+			httpRequests.WithLabelValues(group, strconv.Itoa(sw.status)).Inc()
+			timer.ObserveDuration()
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// statusWriter keeps response status. Implements http.Flusher for wrappers asserting it, i.e. request logger,
+// and Unwrap for http.ResponseController, both needed to flush streamed responses
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/umputun/remark42/backend/app/migrator"
 	"github.com/umputun/remark42/backend/app/rest"
+	"github.com/umputun/remark42/backend/app/store/audit"
 	"github.com/umputun/remark42/backend/app/store/engine"
 )
 
@@ -33,6 +34,7 @@ type Migrator struct {
 	NativeExporter    migrator.Exporter
 	URLMapperMaker    migrator.MapperMaker
 	KeyStore          KeyStore
+	AuditLog          *audit.Store
 
 	busy map[string]bool
 	lock sync.Mutex
@@ -60,6 +62,7 @@ func (m *Migrator) importCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	m.addImportAudit(r, siteID, tmpfile)
 	go m.runImport(siteID, r.URL.Query().Get("provider"), tmpfile) // import runs in background and sets busy flag for site
 
 	_ = R.EncodeJSON(w, http.StatusAccepted, R.JSON{"status": "import request accepted"})
@@ -114,6 +117,7 @@ func (m *Migrator) importFormCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	m.addImportAudit(r, siteID, tmpfile)
 	go m.runImport(siteID, r.URL.Query().Get("provider"), tmpfile) // import runs in background and sets busy flag for site
 
 	_ = R.EncodeJSON(w, http.StatusAccepted, R.JSON{"status": "import request accepted"})
@@ -148,6 +152,8 @@ func (m *Migrator) waitCtrl(w http.ResponseWriter, r *http.Request) {
 // exports all comments for siteID as gz file
 func (m *Migrator) exportCtrl(w http.ResponseWriter, r *http.Request) {
 	siteID := r.URL.Query().Get("site")
+	addAudit(m.AuditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionExport, Target: siteID},
+		nil, R.JSON{"mode": r.URL.Query().Get("mode")})
 
 	if r.URL.Query().Get("mode") == "file" {
 		// buffer to memory to handle errors before committing to response
@@ -197,13 +203,20 @@ func exportErrStatus(err error) (status, errCode int) {
 func (m *Migrator) remapCtrl(w http.ResponseWriter, r *http.Request) {
 	siteID := r.URL.Query().Get("site")
 
+	defer r.Body.Close() //nolint gosec // we don't care about response body
+	rules, err := io.ReadAll(r.Body)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "remap failed, can't read rules", rest.ErrDecode)
+		return
+	}
+
 	// create new url-mapper from given rules in body
-	mapper, err := m.URLMapperMaker(r.Body)
+	mapper, err := m.URLMapperMaker(bytes.NewReader(rules))
 	if err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "remap failed, bad given rules", rest.ErrDecode)
 		return
 	}
-	defer r.Body.Close() //nolint gosec // we don't care about response body
+	addAudit(m.AuditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionRemap, Target: siteID}, nil, R.JSON{"rules": string(rules)})
 
 	// start remap procedure with mapper
 	go func() {
@@ -247,6 +260,15 @@ func (m *Migrator) remapCtrl(w http.ResponseWriter, r *http.Request) {
 	_ = R.EncodeJSON(w, http.StatusAccepted, R.JSON{"status": "convert request accepted"})
 }
 
+// addImportAudit records accepted import request, with provider and size of the uploaded file
+func (m *Migrator) addImportAudit(r *http.Request, siteID, tmpfile string) {
+	after := R.JSON{"provider": r.URL.Query().Get("provider")}
+	if fi, err := os.Stat(tmpfile); err == nil {
+		after["size"] = fi.Size()
+	}
+	addAudit(m.AuditLog, r, audit.Record{SiteID: siteID, Action: audit.ActionImport, Target: siteID}, nil, after)
+}
+
 // runImport reads from tmpfile and import for given siteID and provider
 func (m *Migrator) runImport(siteID, provider, tmpfile string) {
 	m.setBusy(siteID, true)
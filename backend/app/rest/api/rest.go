@@ -13,19 +13,26 @@ import (
 	"sync"
 	"time"
 
+	"github.com/didip/tollbooth/v8/limiter"
 	"github.com/go-pkgz/auth/v2"
 	"github.com/go-pkgz/lcw/v2"
 	log "github.com/go-pkgz/lgr"
 	R "github.com/go-pkgz/rest"
 	"github.com/go-pkgz/rest/logger"
 	"github.com/go-pkgz/routegroup"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/umputun/remark42/backend/app/moderation"
 	"github.com/umputun/remark42/backend/app/notify"
 	"github.com/umputun/remark42/backend/app/rest"
 	"github.com/umputun/remark42/backend/app/rest/proxy"
 	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/audit"
+	"github.com/umputun/remark42/backend/app/store/emailreply"
 	"github.com/umputun/remark42/backend/app/store/image"
 	"github.com/umputun/remark42/backend/app/store/service"
+	"github.com/umputun/remark42/backend/app/store/settings"
+	"github.com/umputun/remark42/backend/app/stream"
 	"github.com/umputun/remark42/backend/app/webassets"
 )
 
@@ -41,7 +48,16 @@ type Rest struct {
 	Migrator         *Migrator
 	NotifyService    *notify.Service
 	TelegramService  telegramService
+	MatrixService    matrixService
 	ImageService     *image.Service
+	StreamHub        *stream.Hub
+	SiteSettings     *settings.Store     // optional, per-site overrides of the settings below and of DataService ones
+	AuditLog         *audit.Store        // optional, log of moderation actions
+	Moderator        *moderation.Service // optional, shared with moderation by telegram bot, made from DataService if not set
+	Sites            []string            // all served sites, sharing the uploaded images, only the request's site if empty
+
+	SlackSigningSecret string            // enables moderation by buttons of slack notifications, POST /slack/interaction
+	EmailReplies       *emailreply.Store // optional, tokens of reply addresses of email notifications, for CreateEmailReply
 
 	AnonVote        bool
 	WebRoot         string
@@ -57,6 +73,8 @@ type Rest struct {
 	UpdateLimiter              float64
 	EmailNotifications         bool
 	TelegramNotifications      bool
+	MatrixNotifications        bool
+	WebPushPublicKey           string // VAPID public key for browsers subscribing to web push notifications, disabled if empty
 	EmojiEnabled               bool
 	SimpleView                 bool
 	ProxyCORS                  bool
@@ -66,6 +84,7 @@ type Rest struct {
 	DisableSignature           bool // prevent signature from being added to headers
 	DisableFancyTextFormatting bool // disables SmartyPants in the comment text rendering of the posted comments
 	ExternalImageProxy         bool
+	MetricsPasswd              string // serve prometheus metrics on /metrics with basic auth of "metrics" user if set
 
 	SSLConfig         SSLConfig
 	httpsServer       *http.Server
@@ -78,6 +97,10 @@ type Rest struct {
 	adminRest        admin
 	rssRest          rss
 	openRouteLimiter float64
+
+	emailReplyOnce    sync.Once
+	emailReplyLimiter *limiter.Limiter
+	emailReplyRest    private // creates comments of email replies, the same way as private api
 }
 
 // LoadingCache defines interface for caching
@@ -90,6 +113,9 @@ type LoadingCache interface {
 const hardBodyLimit = 1024 * 64 // limit size of body
 const openRouteLimiter = 10     // limit for open routes
 const lastCommentsScope = "last"
+const streamKeepAlive = 30 * time.Second // interval of keep-alive comments sent to idle stream clients
+const emailDigestImmediate = "immediate" // email notifications mode without digest
+const maxPageLimit = 100                  // max limit of paginated search, pending and reported comments
 
 type commentsWithInfo struct {
 	Comments []store.Comment `json:"comments"`
@@ -238,6 +264,7 @@ func (s *Rest) routes() http.Handler {
 	authHandler, avatarHandler := s.Authenticator.Handlers()
 
 	router.Route(func(r *routegroup.Bundle) {
+		r.Use(metricsMiddleware("auth"))
 		r.Use(R.Timeout(5 * time.Second))
 		r.Use(logInfoWithBody, rateLimiter(2), R.NoCache)
 		r.Use(validEmailAuth()) // reject suspicious email logins
@@ -245,6 +272,7 @@ func (s *Rest) routes() http.Handler {
 	})
 
 	router.Route(func(r *routegroup.Bundle) {
+		r.Use(metricsMiddleware("avatar"))
 		r.Use(R.Timeout(5 * time.Second))
 		r.Use(rateLimiter(100))
 		r.Handle("/avatar/", avatarHandler)
@@ -257,6 +285,7 @@ func (s *Rest) routes() http.Handler {
 	rapi.Use(apiCSPMiddleware)
 
 	rapi.Group().Route(func(rava *routegroup.Bundle) {
+		rava.Use(metricsMiddleware("avatar"))
 		rava.Use(R.Timeout(5 * time.Second))
 		rava.Use(rateLimiter(100))
 		rava.Handle("/avatar/", avatarHandler)
@@ -264,6 +293,7 @@ func (s *Rest) routes() http.Handler {
 
 	// open routes
 	rapi.Group().Route(func(ropen *routegroup.Bundle) {
+		ropen.Use(metricsMiddleware("public"))
 		ropen.Use(R.Timeout(30 * time.Second))
 		ropen.Use(rateLimiter(s.openRouteLimiter))
 		ropen.Use(authMiddleware.Trace, R.NoCache, logInfoWithBody)
@@ -272,6 +302,7 @@ func (s *Rest) routes() http.Handler {
 		ropen.HandleFunc("GET /id/{id}", s.pubRest.commentByIDCtrl)
 		ropen.HandleFunc("GET /comments", s.pubRest.findUserCommentsCtrl)
 		ropen.HandleFunc("GET /last/{limit}", s.pubRest.lastCommentsCtrl)
+		ropen.HandleFunc("GET /search", s.pubRest.searchCommentsCtrl)
 		ropen.HandleFunc("GET /count", s.pubRest.countCtrl)
 		ropen.HandleFunc("POST /counts", s.pubRest.countMultiCtrl)
 		ropen.HandleFunc("GET /list", s.pubRest.listCtrl)
@@ -284,6 +315,15 @@ func (s *Rest) routes() http.Handler {
 		})
 	})
 
+	// open streaming route deliberately runs without R.Timeout: that middleware buffers the whole response
+	// and aborts at the deadline, which would break long-lived server-sent events connection
+	rapi.Group().Route(func(rstream *routegroup.Bundle) {
+		rstream.Use(metricsMiddleware("stream"))
+		rstream.Use(rateLimiter(s.openRouteLimiter))
+		rstream.Use(authMiddleware.Trace, R.NoCache, logInfoWithBody)
+		rstream.HandleFunc("GET /stream", s.pubRest.streamCtrl)
+	})
+
 	// open routes, cached. /img lives here (not in the NoCache group above) because
 	// R.NoCache strips If-None-Match from incoming requests, which would
 	// defeat the proxy handler's 304 short-circuit. The handler sets a 30-day
@@ -291,6 +331,7 @@ func (s *Rest) routes() http.Handler {
 	// invalidation on revalidation); error responses get Cache-Control: no-store
 	// so transient failures aren't pinned in the cache.
 	rapi.Group().Route(func(ropen *routegroup.Bundle) {
+		ropen.Use(metricsMiddleware("media"))
 		ropen.Use(R.Timeout(30 * time.Second))
 		ropen.Use(rateLimiter(10))
 		ropen.Use(authMiddleware.Trace, logInfoWithBody)
@@ -299,8 +340,20 @@ func (s *Rest) routes() http.Handler {
 		ropen.HandleFunc("GET /qr/telegram", s.pubRest.telegramQrCtrl)
 	})
 
+	// slack interaction callbacks, authenticated by slack request signature instead of the token
+	if s.SlackSigningSecret != "" {
+		rapi.Group().Route(func(rslack *routegroup.Bundle) {
+			rslack.Use(metricsMiddleware("slack"))
+			rslack.Use(R.Timeout(10 * time.Second))
+			rslack.Use(rateLimiter(10))
+			rslack.Use(R.NoCache, logInfoWithBody)
+			rslack.HandleFunc("POST /slack/interaction", s.adminRest.slackInteractionCtrl)
+		})
+	}
+
 	// protected routes, require auth
 	rapi.Group().Route(func(rauth *routegroup.Bundle) {
+		rauth.Use(metricsMiddleware("private"))
 		rauth.Use(rateLimiter(10))
 		rauth.Use(authMiddleware.Auth, matchSiteID, R.NoCache, logInfoWithBody)
 
@@ -317,6 +370,7 @@ func (s *Rest) routes() http.Handler {
 
 	// admin routes, require auth and admin users only
 	rapi.Mount("/admin").Route(func(radmin *routegroup.Bundle) {
+		radmin.Use(metricsMiddleware("admin"))
 		radmin.Use(rateLimiter(10))
 		radmin.Use(authMiddleware.Auth, authMiddleware.AdminOnly, matchSiteID)
 		radmin.Use(R.NoCache, logInfoWithBody)
@@ -332,8 +386,25 @@ func (s *Rest) routes() http.Handler {
 			r.HandleFunc("PUT /verify/{userid}", s.adminRest.setVerifyCtrl)
 			r.HandleFunc("PUT /pin/{id}", s.adminRest.setPinCtrl)
 			r.HandleFunc("GET /blocked", s.adminRest.blockedUsersCtrl)
+			r.HandleFunc("PUT /picture/{user}/{id}/ban", s.adminRest.banPictureCtrl)
+			r.HandleFunc("GET /picture/bans", s.adminRest.pictureBansCtrl)
+			r.HandleFunc("DELETE /picture/bans/{hash}", s.adminRest.unbanPictureCtrl)
+			r.HandleFunc("GET /pictures", s.adminRest.picturesCtrl)
+			r.HandleFunc("GET /pictures/orphaned", s.adminRest.orphanedPicturesCtrl)
+			r.HandleFunc("DELETE /picture/{user}/{id}", s.adminRest.deletePictureCtrl)
+			r.HandleFunc("GET /search", s.adminRest.searchCommentsCtrl)
+			r.HandleFunc("GET /pending", s.adminRest.pendingCommentsCtrl)
+			r.HandleFunc("PUT /approve/{id}", s.adminRest.approveCommentCtrl)
+			r.HandleFunc("GET /reports", s.adminRest.reportedCommentsCtrl)
+			r.HandleFunc("PUT /reports/{id}", s.adminRest.reviewReportsCtrl)
 			r.HandleFunc("PUT /readonly", s.adminRest.setReadOnlyCtrl)
 			r.HandleFunc("PUT /title/{id}", s.adminRest.setTitleCtrl)
+			r.HandleFunc("GET /settings", s.adminRest.getSettingsCtrl)
+			r.HandleFunc("PUT /settings", s.adminRest.setSettingsCtrl)
+			r.HandleFunc("DELETE /settings", s.adminRest.deleteSettingsCtrl)
+			r.HandleFunc("GET /audit", s.adminRest.auditCtrl)
+			r.HandleFunc("GET /notify", s.adminRest.notifyDeliveriesCtrl)
+			r.HandleFunc("PUT /notify/replay", s.adminRest.notifyReplayCtrl)
 		})
 
 		// migrator routes deliberately run without R.Timeout: GET /export streams a full-site
@@ -349,26 +420,38 @@ func (s *Rest) routes() http.Handler {
 
 	// protected routes, throttled to 10/s by default, controlled by external UpdateLimiter param
 	rapi.Group().Route(func(rauth *routegroup.Bundle) {
+		rauth.Use(metricsMiddleware("private"))
 		rauth.Use(R.Timeout(10 * time.Second))
 		rauth.Use(rateLimiter(s.updateLimiter()))
-		rauth.Use(authMiddleware.Auth, matchSiteID, subscribersOnly(s.SubscribersOnly))
+		rauth.Use(authMiddleware.Auth, matchSiteID, subscribersOnly(func(siteID string) bool { return s.siteSettings(siteID).SubscribersOnly }))
 		rauth.Use(R.NoCache, logInfoWithBody)
 
 		rauth.HandleFunc("PUT /comment/{id}", s.privRest.updateCommentCtrl)
 		rauth.HandleFunc("POST /preview", s.privRest.previewCommentCtrl)
 		rauth.HandleFunc("POST /comment", s.privRest.createCommentCtrl)
 		rauth.HandleFunc("PUT /vote/{id}", s.privRest.voteCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("POST /report/{id}", s.privRest.reportCtrl)
 		rauth.With(rejectAnonUser).HandleFunc("POST /deleteme", s.privRest.deleteMeCtrl)
 		rauth.With(rejectAnonUser).HandleFunc("GET /email", s.privRest.getEmailCtrl)
 		rauth.With(rejectAnonUser).HandleFunc("POST /email/subscribe", s.privRest.sendEmailConfirmationCtrl)
 		rauth.With(rejectAnonUser).HandleFunc("POST /email/confirm", s.privRest.setConfirmedEmailCtrl)
 		rauth.With(rejectAnonUser).HandleFunc("DELETE /email", s.privRest.deleteEmailCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("PUT /email/digest", s.privRest.setEmailDigestCtrl)
 		rauth.With(rejectAnonUser, rejectHead("GET")).HandleFunc("GET /telegram/subscribe", s.privRest.telegramSubscribeCtrl)
 		rauth.With(rejectAnonUser).HandleFunc("DELETE /telegram", s.privRest.deleteTelegramCtrl)
+		rauth.With(rejectAnonUser, rejectHead("GET")).HandleFunc("GET /matrix/subscribe", s.privRest.matrixSubscribeCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("DELETE /matrix", s.privRest.deleteMatrixCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("POST /webpush/subscribe", s.privRest.webPushSubscribeCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("DELETE /webpush", s.privRest.deleteWebPushCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("POST /subscribe", s.privRest.subscribeCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("POST /subscribe/confirm", s.privRest.subscribeConfirmCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("DELETE /subscribe", s.privRest.unsubscribeCtrl)
+		rauth.With(rejectAnonUser).HandleFunc("GET /subscriptions", s.privRest.subscriptionsCtrl)
 	})
 
 	// protected routes, anonymous rejected
 	rapi.Group().Route(func(rauth *routegroup.Bundle) {
+		rauth.Use(metricsMiddleware("private"))
 		rauth.Use(R.Timeout(10 * time.Second))
 		rauth.Use(rateLimiter(s.updateLimiter()))
 		rauth.Use(authMiddleware.Auth, rejectAnonUser, matchSiteID)
@@ -378,11 +461,15 @@ func (s *Rest) routes() http.Handler {
 
 	// open routes on root level
 	router.Route(func(rroot *routegroup.Bundle) {
+		rroot.Use(metricsMiddleware("root"))
 		rroot.Use(R.Timeout(10 * time.Second))
 		rroot.Use(rateLimiter(50))
 		rroot.HandleFunc("GET /robots.txt", s.pubRest.robotsCtrl)
 		rroot.With(rejectHead("GET, POST")).HandleFunc("GET /email/unsubscribe.html", s.privRest.emailUnsubscribeCtrl)
 		rroot.HandleFunc("POST /email/unsubscribe.html", s.privRest.emailUnsubscribeCtrl)
+		if s.MetricsPasswd != "" {
+			rroot.With(R.BasicAuthWithUserPasswd("metrics", s.MetricsPasswd)).Handle("GET /metrics", promhttp.Handler())
+		}
 	})
 
 	// file server for /web: the frontend build first, then the assets embedded in the binary.
@@ -404,7 +491,8 @@ func (s *Rest) controllerGroups() (public, private, admin, rss) {
 		cache:            s.Cache,
 		imageService:     s.ImageService,
 		commentFormatter: s.CommentFormatter,
-		readOnlyAge:      s.ReadOnlyAge,
+		siteSettings:     s.siteSettings,
+		streamHub:        s.StreamHub,
 	}
 
 	privGrp := private{
@@ -412,21 +500,38 @@ func (s *Rest) controllerGroups() (public, private, admin, rss) {
 		cache:                      s.Cache,
 		imageService:               s.ImageService,
 		commentFormatter:           s.CommentFormatter,
-		readOnlyAge:                s.ReadOnlyAge,
+		siteSettings:               s.siteSettings,
 		authenticator:              s.Authenticator,
 		notifyService:              s.NotifyService,
 		telegramService:            s.TelegramService,
+		matrixService:              s.MatrixService,
+		webPushEnabled:             s.WebPushPublicKey != "",
 		remarkURL:                  s.RemarkURL,
-		anonVote:                   s.AnonVote,
 		disableFancyTextFormatting: s.DisableFancyTextFormatting,
 	}
 
+	moderator := s.Moderator
+	if moderator == nil {
+		moderator = &moderation.Service{Store: s.DataService, AuditLog: s.AuditLog,
+			ReadOnlyAge: func(siteID string) int { return s.siteSettings(siteID).ReadOnlyAge }}
+		if s.NotifyService != nil {
+			moderator.SetNotifier(s.NotifyService)
+		}
+	}
 	admGrp := admin{
 		dataService:   s.DataService,
+		moderator:     moderator,
 		migrator:      s.Migrator,
 		cache:         s.Cache,
 		authenticator: s.Authenticator,
-		readOnlyAge:   s.ReadOnlyAge,
+		siteSettings:  s.siteSettings,
+		settingsStore: s.SiteSettings,
+		auditLog:      s.AuditLog,
+		notifyService: s.NotifyService,
+		imageService:  s.ImageService,
+		sites:         s.Sites,
+
+		slackSigningSecret: s.SlackSigningSecret,
 	}
 
 	rssGrp := rss{
@@ -437,6 +542,28 @@ func (s *Rest) controllerGroups() (public, private, admin, rss) {
 	return pubGrp, privGrp, admGrp, rssGrp
 }
 
+// siteSettings returns settings of the site. Without SiteSettings the same settings, set by Rest and DataService
+// fields, used for all sites
+func (s *Rest) siteSettings(siteID string) settings.Settings {
+	if s.SiteSettings == nil {
+		return settings.Settings{
+			MaxCommentSize:  s.DataService.MaxCommentSize,
+			MinCommentSize:  s.DataService.MinCommentSize,
+			EditDuration:    settings.Duration(s.DataService.EditDuration),
+			LowScore:        s.ScoreThresholds.Low,
+			CriticalScore:   s.ScoreThresholds.Critical,
+			PositiveScore:   s.DataService.PositiveScore,
+			ReadOnlyAge:     s.ReadOnlyAge,
+			AnonVote:        s.AnonVote,
+			SubscribersOnly: s.SubscribersOnly,
+			MaxVotes:        s.DataService.MaxVotes,
+		}
+	}
+	res := s.SiteSettings.Get(siteID)
+	res.AnonVote = res.AnonVote && s.DataService.RestrictSameIPVotes.Enabled // anonymous votes work with votes-ip only
+	return res
+}
+
 // updateLimiter returns UpdateLimiter if set, or 10 if not
 func (s *Rest) updateLimiter() float64 {
 	lmt := 10.0
@@ -449,6 +576,7 @@ func (s *Rest) updateLimiter() float64 {
 // GET /config?site=siteID - returns configuration
 func (s *Rest) configCtrl(w http.ResponseWriter, r *http.Request) {
 	siteID := r.URL.Query().Get("site")
+	siteSettings := s.siteSettings(siteID)
 
 	admins, _ := s.DataService.AdminStore.Admins(siteID)
 	emails, _ := s.DataService.AdminStore.Email(siteID)
@@ -470,30 +598,34 @@ func (s *Rest) configCtrl(w http.ResponseWriter, r *http.Request) {
 		MaxImageSize          int      `json:"max_image_size"`
 		EmailNotifications    bool     `json:"email_notifications"`
 		TelegramNotifications bool     `json:"telegram_notifications"`
+		MatrixNotifications   bool     `json:"matrix_notifications"`
+		WebPushPublicKey      string   `json:"webpush_public_key,omitempty"`
 		EmojiEnabled          bool     `json:"emoji_enabled"`
 		SimpleView            bool     `json:"simple_view"`
 		SendJWTHeader         bool     `json:"send_jwt_header"`
 		SubscribersOnly       bool     `json:"subscribers_only"`
 	}{
 		Version:               s.Version,
-		EditDuration:          int(s.DataService.EditDuration.Seconds()),
+		EditDuration:          int(time.Duration(siteSettings.EditDuration).Seconds()),
 		AdminEdit:             s.DataService.AdminEdits,
-		MinCommentSize:        s.DataService.MinCommentSize,
-		MaxCommentSize:        s.DataService.MaxCommentSize,
+		MinCommentSize:        siteSettings.MinCommentSize,
+		MaxCommentSize:        siteSettings.MaxCommentSize,
 		Admins:                admins,
 		AdminEmail:            emails,
-		LowScore:              s.ScoreThresholds.Low,
-		CriticalScore:         s.ScoreThresholds.Critical,
-		PositiveScore:         s.DataService.PositiveScore,
-		ReadOnlyAge:           s.ReadOnlyAge,
+		LowScore:              siteSettings.LowScore,
+		CriticalScore:         siteSettings.CriticalScore,
+		PositiveScore:         siteSettings.PositiveScore,
+		ReadOnlyAge:           siteSettings.ReadOnlyAge,
 		MaxImageSize:          s.ImageService.MaxSize,
 		EmailNotifications:    s.EmailNotifications,
 		TelegramNotifications: s.TelegramNotifications,
+		MatrixNotifications:   s.MatrixNotifications,
+		WebPushPublicKey:      s.WebPushPublicKey,
 		EmojiEnabled:          s.EmojiEnabled,
-		AnonVote:              s.AnonVote,
+		AnonVote:              siteSettings.AnonVote,
 		SimpleView:            s.SimpleView,
 		SendJWTHeader:         s.SendJWTHeader,
-		SubscribersOnly:       s.SubscribersOnly,
+		SubscribersOnly:       siteSettings.SubscribersOnly,
 	}
 
 	cnf.Auth = []string{}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
@@ -28,20 +29,23 @@ import (
 	"github.com/umputun/remark42/backend/app/store/engine"
 	"github.com/umputun/remark42/backend/app/store/image"
 	"github.com/umputun/remark42/backend/app/store/service"
+	"github.com/umputun/remark42/backend/app/store/settings"
+	"github.com/umputun/remark42/backend/app/store/subscription"
 	"github.com/umputun/remark42/backend/app/templates"
 )
 
 type private struct {
 	dataService                privStore
 	cache                      LoadingCache
-	readOnlyAge                int
+	siteSettings               func(siteID string) settings.Settings
 	commentFormatter           *store.CommentFormatter
 	imageService               *image.Service
 	notifyService              *notify.Service
 	authenticator              *auth.Service
 	telegramService            telegramService
+	matrixService              matrixService
+	webPushEnabled             bool
 	remarkURL                  string
-	anonVote                   bool
 	disableFancyTextFormatting bool // disables SmartyPants in the comment text rendering of the posted comments
 }
 
@@ -52,21 +56,39 @@ type telegramService interface {
 	GetBotUsername() string
 }
 
+// matrixService is a subset of Matrix service used for setting up user matrix notifications
+type matrixService interface {
+	AddToken(token, user, site, address string, expires time.Time)
+	CheckToken(token, userID string) (address, site string, err error)
+}
+
 type privStore interface {
 	Create(comment store.Comment) (commentID string, err error)
 	EditComment(locator store.Locator, commentID string, req service.EditRequest) (comment store.Comment, err error)
 	Vote(req service.VoteReq) (comment store.Comment, err error)
+	Report(req service.ReportReq) (comment store.Comment, err error)
 	Get(locator store.Locator, commentID string, user store.User) (store.Comment, error)
 	User(siteID, userID string, limit, skip int, user store.User) ([]store.Comment, error)
 	GetUserEmail(siteID, userID string) (string, error)
 	SetUserEmail(siteID, userID, value string) (string, error)
 	GetUserTelegram(siteID, userID string) (string, error)
 	SetUserTelegram(siteID, userID, value string) (string, error)
+	GetUserMatrix(siteID, userID string) (string, error)
+	SetUserMatrix(siteID, userID, value string) (string, error)
+	GetUserWebPush(siteID, userID string) (string, error)
+	SetUserWebPush(siteID, userID, value string) (string, error)
+	GetUserEmailDigest(siteID, userID string) (string, error)
+	SetUserEmailDigest(siteID, userID, value string) (string, error)
+	Subscribe(sub subscription.Subscription) (subscription.Subscription, error)
+	Unsubscribe(locator store.Locator, userID string, ch subscription.Channel) error
+	UserSubscriptions(siteID, userID string) ([]subscription.Subscription, error)
 	DeleteUserDetail(siteID, userID string, detail engine.UserDetail) error
 	ValidateComment(c *store.Comment) error
 	IsVerified(siteID, userID string) bool
 	IsReadOnly(locator store.Locator) bool
 	IsBlocked(siteID, userID string) bool
+	IsShadowBanned(siteID, userID string) bool
+	PreModerated(siteID string, user store.User) bool
 	Info(locator store.Locator, readonlyAge int) (store.PostInfo, error)
 }
 
@@ -118,13 +140,44 @@ func (s *private) createCommentCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	comment.PrepareUntrusted() // clean all fields user not supposed to set
+	user.IP = extractIP(r.RemoteAddr)
+	finalComment, err := s.createComment(comment, user)
+	var cerr *commentError
+	if errors.As(err, &cerr) {
+		rest.SendErrorJSON(w, r, cerr.status, cerr.err, cerr.details, cerr.code)
+		return
+	}
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't save comment", rest.ErrInternal)
+		return
+	}
+
+	log.Printf("[DEBUG] created comment %+v", finalComment)
+
+	_ = R.EncodeJSON(w, http.StatusCreated, &finalComment)
+}
+
+// commentError is a rejection of the comment by createComment, with status and error code of the api response
+type commentError struct {
+	status  int
+	code    int
+	details string
+	err     error
+}
+
+func (e *commentError) Error() string { return e.details + ": " + e.err.Error() }
+
+func (e *commentError) Unwrap() error { return e.err }
+
+// createComment validates the comment of the user and creates it, notifying subscribers. The same checks made
+// for comments posted with api and received as replies by email. Returns the created comment.
+func (s *private) createComment(comment store.Comment, user store.User) (store.Comment, error) {
 	comment.User = user
-	comment.User.IP = extractIP(r.RemoteAddr)
+	comment.Pending = s.dataService.PreModerated(comment.Locator.SiteID, user) // hidden from others until approved
 
 	comment.Orig = comment.Text // original comment text, prior to md render
 	if err := s.dataService.ValidateComment(&comment); err != nil {
-		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid comment", rest.ErrCommentValidation)
-		return
+		return store.Comment{}, &commentError{http.StatusBadRequest, rest.ErrCommentValidation, "invalid comment", err}
 	}
 	comment = s.commentFormatter.Format(comment, s.disableFancyTextFormatting)
 
@@ -132,48 +185,43 @@ func (s *private) createCommentCtrl(w http.ResponseWriter, r *http.Request) {
 	for _, id := range s.imageService.ExtractNonProxiedPictures(comment.Text) {
 		_, err := s.imageService.Load(id)
 		if err != nil {
-			rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't load picture from the comment", rest.ErrImgNotFound)
-			return
+			return store.Comment{}, &commentError{http.StatusBadRequest, rest.ErrImgNotFound, "can't load picture from the comment", err}
 		}
 	}
 
 	// check if user blocked
 	if s.dataService.IsBlocked(comment.Locator.SiteID, comment.User.ID) {
-		rest.SendErrorJSON(w, r, http.StatusForbidden, fmt.Errorf("rejected"), "user blocked", rest.ErrUserBlocked)
-		return
+		return store.Comment{}, &commentError{http.StatusForbidden, rest.ErrUserBlocked, "user blocked", fmt.Errorf("rejected")}
 	}
 
 	if s.isReadOnly(comment.Locator) {
-		rest.SendErrorJSON(w, r, http.StatusForbidden, fmt.Errorf("rejected"), "old post, read-only", rest.ErrReadOnly)
-		return
+		return store.Comment{}, &commentError{http.StatusForbidden, rest.ErrReadOnly, "old post, read-only", fmt.Errorf("rejected")}
 	}
 
 	id, err := s.dataService.Create(comment)
 	if errors.Is(err, service.ErrRestrictedWordsFound) {
-		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid comment", rest.ErrCommentRestrictWords)
-		return
+		return store.Comment{}, &commentError{http.StatusBadRequest, rest.ErrCommentRestrictWords, "invalid comment", err}
+	}
+	if errors.Is(err, service.ErrSpamDetected) {
+		return store.Comment{}, &commentError{http.StatusBadRequest, rest.ErrCommentRejected, "comment rejected", err}
 	}
 	if err != nil {
-		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't save comment", rest.ErrInternal)
-		return
+		return store.Comment{}, fmt.Errorf("can't save comment: %w", err)
 	}
 
 	// dataService modifies comment
-	finalComment, err := s.dataService.Get(comment.Locator, id, rest.GetUserOrEmpty(r))
+	finalComment, err := s.dataService.Get(comment.Locator, id, user)
 	if err != nil {
-		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't load created comment", rest.ErrInternal)
-		return
+		return store.Comment{}, fmt.Errorf("can't load created comment: %w", err)
 	}
 	s.cache.Flush(cache.Flusher(comment.Locator.SiteID).
 		Scopes(comment.Locator.URL, lastCommentsScope, comment.User.ID, comment.Locator.SiteID))
 
-	if s.notifyService != nil {
+	// notification for pending comment sent on approval, comments of shadow-banned users never notified
+	if s.notifyService != nil && !finalComment.Pending && !s.dataService.IsShadowBanned(comment.Locator.SiteID, user.ID) {
 		s.notifyService.Submit(notify.Request{Comment: finalComment})
 	}
-
-	log.Printf("[DEBUG] created comment %+v", finalComment)
-
-	_ = R.EncodeJSON(w, http.StatusCreated, &finalComment)
+	return finalComment, nil
 }
 
 // PUT /comment/{id}?site=siteID&url=post-url - update comment
@@ -221,6 +269,10 @@ func (s *private) updateCommentCtrl(w http.ResponseWriter, r *http.Request) {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid comment", rest.ErrCommentValidation)
 		return
 	}
+	if errors.Is(err, service.ErrSpamDetected) {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "comment rejected", rest.ErrCommentRejected)
+		return
+	}
 
 	if err != nil {
 		code := parseError(err, rest.ErrCommentRejected)
@@ -229,6 +281,14 @@ func (s *private) updateCommentCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	s.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.SiteID, locator.URL, lastCommentsScope, user.ID))
+
+	if s.notifyService != nil && !res.Pending && !s.dataService.IsShadowBanned(locator.SiteID, user.ID) {
+		event := notify.EventEdit
+		if edit.Delete {
+			event = notify.EventDelete
+		}
+		s.notifyService.Submit(notify.Request{Event: event, Comment: res})
+	}
 	R.RenderJSON(w, res)
 }
 
@@ -253,11 +313,11 @@ func (s *private) userInfoCtrl(w http.ResponseWriter, r *http.Request) {
 // PUT /vote/{id}?site=siteID&url=post-url&vote=1 - vote for/against comment
 func (s *private) voteCtrl(w http.ResponseWriter, r *http.Request) {
 	user := rest.MustGetUserInfo(r)
-	if !s.anonVote && strings.HasPrefix(user.ID, "anonymous_") {
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	if !s.siteSettings(locator.SiteID).AnonVote && strings.HasPrefix(user.ID, "anonymous_") {
 		http.Error(w, "Access denied", http.StatusForbidden)
 		return
 	}
-	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
 	id := r.PathValue("id")
 	log.Printf("[DEBUG] vote for comment %s", id)
 
@@ -288,9 +348,56 @@ func (s *private) voteCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	s.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, comment.User.ID))
+
+	if s.notifyService != nil {
+		voteVal := -1
+		if vote {
+			voteVal = 1
+		}
+		s.notifyService.Submit(notify.Request{Event: notify.EventVote, Comment: comment, Vote: voteVal})
+	}
 	R.RenderJSON(w, R.JSON{"id": comment.ID, "score": comment.Score})
 }
 
+// POST /report/{id}?site=siteID&url=post-url, body is {"reason": "spam", "note": "optional details"}
+// reports comment to admins, returns comment id and locator
+func (s *private) reportCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	id := r.PathValue("id")
+	log.Printf("[DEBUG] report for comment %s", id)
+
+	report := struct {
+		Reason store.ReportReason `json:"reason"`
+		Note   string             `json:"note"`
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, hardBodyLimit)).Decode(&report); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't bind report", rest.ErrDecode)
+		return
+	}
+
+	// check if user blocked
+	if s.dataService.IsBlocked(locator.SiteID, user.ID) {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, fmt.Errorf("rejected"), "user blocked", rest.ErrUserBlocked)
+		return
+	}
+
+	req := service.ReportReq{
+		Locator:   locator,
+		CommentID: id,
+		UserID:    user.ID,
+		Reason:    report.Reason,
+		Note:      report.Note,
+	}
+	comment, err := s.dataService.Report(req)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't report comment", rest.ErrActionRejected)
+		return
+	}
+	s.cache.Flush(cache.Flusher(locator.SiteID).Scopes(locator.URL, lastCommentsScope, comment.User.ID))
+	R.RenderJSON(w, R.JSON{"id": comment.ID, "locator": comment.Locator})
+}
+
 // getEmailCtrl gets email address for authenticated user.
 // GET /email?site=siteID
 func (s *private) getEmailCtrl(w http.ResponseWriter, r *http.Request) {
@@ -300,8 +407,42 @@ func (s *private) getEmailCtrl(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("[WARN] can't read email for %s, %v", user.ID, err)
 	}
+	digest, err := s.dataService.GetUserEmailDigest(siteID, user.ID)
+	if err != nil {
+		log.Printf("[WARN] can't read email digest for %s, %v", user.ID, err)
+	}
+	if digest == "" {
+		digest = emailDigestImmediate
+	}
+
+	R.RenderJSON(w, R.JSON{"user": user, "address": address, "digest": digest})
+}
+
+// PUT /email/digest?site=siteID&mode=immediate|hourly|daily - sets delivery mode of user's email notifications,
+// replies sent one by one for immediate mode or collected to hourly or daily digest otherwise
+func (s *private) setEmailDigestCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	siteID := r.URL.Query().Get("site")
+	mode := r.URL.Query().Get("mode")
 
-	R.RenderJSON(w, R.JSON{"user": user, "address": address})
+	var err error
+	switch mode {
+	case emailDigestImmediate:
+		err = s.dataService.DeleteUserDetail(siteID, user.ID, engine.UserEmailDigest)
+	case notify.EmailDigestHourly, notify.EmailDigestDaily:
+		_, err = s.dataService.SetUserEmailDigest(siteID, user.ID, mode)
+	default:
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("unknown mode %q", mode),
+			"mode should be immediate, hourly or daily", rest.ErrDecode)
+		return
+	}
+	if err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set email digest for user", code)
+		return
+	}
+	log.Printf("[DEBUG] set email digest %s for user %s", mode, user.ID)
+	R.RenderJSON(w, R.JSON{"updated": true, "digest": mode})
 }
 
 // sendEmailConfirmationCtrl gets address and siteID from query, makes confirmation token and sends it to user.
@@ -444,6 +585,139 @@ func (s *private) telegramSubscribeCtrl(w http.ResponseWriter, r *http.Request)
 	R.RenderJSON(w, R.JSON{"updated": true, "address": val})
 }
 
+// matrixSubscribeCtrl sends verification token to matrix id and verifies it
+// GET /matrix/subscribe?site=siteID&address=@user:matrix.org<&tkn=token>
+func (s *private) matrixSubscribeCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+
+	if s.matrixService == nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError,
+			fmt.Errorf("not enabled"), "matrix notifications are not enabled", rest.ErrActionRejected)
+		return
+	}
+
+	queryToken := r.URL.Query().Get("tkn")
+	if queryToken == "" {
+		// GET /matrix/subscribe?site=siteID&address=@user:matrix.org (No token supplied)
+		siteID, address := r.URL.Query().Get("site"), r.URL.Query().Get("address")
+		if siteID == "" || address == "" {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("missing parameter"),
+				"site and address parameters are required", rest.ErrInternal)
+			return
+		}
+		if localPart, server, ok := strings.Cut(address, ":"); !ok || len(localPart) < 2 || localPart[0] != '@' || server == "" {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("bad matrix id %q", address),
+				"address should be matrix id like @user:matrix.org", rest.ErrInternal)
+			return
+		}
+		// we don't care as much if we can't retrieve the current value of that field for the user, so ignore the error
+		if existingAddress, _ := s.dataService.GetUserMatrix(siteID, user.ID); existingAddress != "" {
+			rest.SendErrorJSON(w, r, http.StatusConflict,
+				fmt.Errorf("already subscribed"), "matrix subscription is already set for this user, delete if first to re-subscribe", rest.ErrActionRejected)
+			return
+		}
+		// generate token and send it to the matrix id
+		tkn, err := randToken()
+		if err != nil {
+			rest.SendErrorJSON(w, r, http.StatusForbidden, err, "failed to generate verification token", rest.ErrInternal)
+			return
+		}
+		expires := time.Now().Add(10 * time.Minute)
+
+		s.matrixService.AddToken(tkn, user.ID, siteID, address, expires)
+		s.notifyService.SubmitVerification(notify.VerificationRequest{SiteID: siteID, User: user.Name, Matrix: address, Token: tkn})
+
+		R.RenderJSON(w, R.JSON{"address": address, "updated": false})
+		return
+	}
+
+	// GET /matrix/subscribe?tkn=token (verify token)
+	address, siteID, err := s.matrixService.CheckToken(queryToken, user.ID)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusNotFound, err, "request is not verified", rest.ErrInternal)
+		return
+	}
+
+	log.Printf("[DEBUG] set matrix notifications for user %s", user.ID)
+
+	val, err := s.dataService.SetUserMatrix(siteID, user.ID, address)
+	if err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set matrix for user", code)
+		return
+	}
+
+	R.RenderJSON(w, R.JSON{"updated": true, "address": val})
+}
+
+// maxWebPushSubscriptions limits number of browsers subscribed by the user, the oldest subscription dropped over it
+const maxWebPushSubscriptions = 10
+
+// webPushSubscribeCtrl adds push subscription of the browser to the user's web push subscriptions
+// POST /webpush/subscribe?site=siteID, body is PushSubscription json of the browser
+func (s *private) webPushSubscribeCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	siteID := r.URL.Query().Get("site")
+
+	if !s.webPushEnabled {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError,
+			fmt.Errorf("not enabled"), "web push notifications are not enabled", rest.ErrActionRejected)
+		return
+	}
+
+	sub := notify.WebPushSubscription{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, hardBodyLimit)).Decode(&sub); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't parse request body", rest.ErrDecode)
+		return
+	}
+	if err := sub.Validate(); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "invalid push subscription", rest.ErrInternal)
+		return
+	}
+
+	subs := s.webPushSubscriptions(siteID, user.ID)
+	subs = slices.DeleteFunc(subs, func(ws notify.WebPushSubscription) bool { return ws.Endpoint == sub.Endpoint })
+	subs = append(subs, sub)
+	if len(subs) > maxWebPushSubscriptions {
+		subs = subs[len(subs)-maxWebPushSubscriptions:]
+	}
+	if err := s.setWebPushSubscriptions(siteID, user.ID, subs); err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't set web push subscription for user", code)
+		return
+	}
+	log.Printf("[DEBUG] add web push subscription for user %s, total %d", user.ID, len(subs))
+	R.RenderJSON(w, R.JSON{"updated": true, "endpoint": sub.Endpoint})
+}
+
+// webPushSubscriptions returns web push subscriptions of the user, broken stored value ignored
+func (s *private) webPushSubscriptions(siteID, userID string) []notify.WebPushSubscription {
+	value, err := s.dataService.GetUserWebPush(siteID, userID)
+	if err != nil {
+		log.Printf("[WARN] can't read web push subscriptions for %s, %v", userID, err)
+		return nil
+	}
+	subs, err := notify.ParseWebPushSubscriptions(value)
+	if err != nil {
+		log.Printf("[WARN] can't parse web push subscriptions for %s, %v", userID, err)
+		return nil
+	}
+	return subs
+}
+
+// setWebPushSubscriptions stores web push subscriptions of the user, removing user detail for empty list
+func (s *private) setWebPushSubscriptions(siteID, userID string, subs []notify.WebPushSubscription) error {
+	if len(subs) == 0 {
+		return s.dataService.DeleteUserDetail(siteID, userID, engine.UserWebPush)
+	}
+	value, err := json.Marshal(subs)
+	if err != nil {
+		return fmt.Errorf("can't marshal web push subscriptions: %w", err)
+	}
+	_, err = s.dataService.SetUserWebPush(siteID, userID, string(value))
+	return err
+}
+
 // setConfirmedEmailCtrl uses provided token parameter (generated by sendEmailConfirmationCtrl) to set email and add it to user token
 // POST /email/confirm with site and token in json body
 func (s *private) setConfirmedEmailCtrl(w http.ResponseWriter, r *http.Request) {
@@ -512,7 +786,8 @@ func (s *private) setEmail(w http.ResponseWriter, r *http.Request, userID, siteI
 	R.RenderJSON(w, R.JSON{"updated": true, "address": val})
 }
 
-// POST/GET /email/unsubscribe.html?site=siteID&tkn=jwt - unsubscribe the user in token from email notifications
+// POST/GET /email/unsubscribe.html?site=siteID&tkn=jwt<&url=post-url> - unsubscribe the user in token from email notifications,
+// including email subscriptions to posts with the same address. With url set, unsubscribes from this post only.
 func (s *private) emailUnsubscribeCtrl(w http.ResponseWriter, r *http.Request) {
 	tkn := r.URL.Query().Get("tkn")
 	if tkn == "" {
@@ -540,40 +815,68 @@ func (s *private) emailUnsubscribeCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 	userID := elems[0]
 	address := elems[1]
-
-	existingAddress, err := s.dataService.GetUserEmail(siteID, userID)
-	if err != nil {
-		// we don't care as much if we can't retrieve the current value of that field for the user,
-		// as it's only used to check if we're trying to set to the same value it's already set to
-		log.Printf("[WARN] can't read email for %s, %v", userID, err)
+	postURL := r.URL.Query().Get("url")
+
+	// email subscriptions to posts with the same address, only one for the post url if set
+	var postSubs []subscription.Subscription
+	if subs, e := s.dataService.UserSubscriptions(siteID, userID); e == nil {
+		for _, sub := range subs {
+			if sub.Email == address && (postURL == "" || sub.URL == postURL) {
+				postSubs = append(postSubs, sub)
+			}
+		}
 	}
-	if existingAddress == "" {
-		rest.SendErrorHTML(w, r, http.StatusConflict, fmt.Errorf("user is not subscribed"), "user does not have active email subscription", rest.ErrInternal)
+	if postURL != "" && len(postSubs) == 0 {
+		rest.SendErrorHTML(w, r, http.StatusConflict, fmt.Errorf("user is not subscribed"), "user does not have email subscription to the post", rest.ErrInternal)
 		return
 	}
-	if address != existingAddress {
-		rest.SendErrorHTML(w, r, http.StatusBadRequest, fmt.Errorf("wrong email unsubscription"), "email address in request does not match known for this user", rest.ErrInternal)
-		return
+
+	existingAddress := ""
+	if postURL == "" {
+		existingAddress, err = s.dataService.GetUserEmail(siteID, userID)
+		if err != nil {
+			// we don't care as much if we can't retrieve the current value of that field for the user,
+			// as it's only used to check if we're trying to set to the same value it's already set to
+			log.Printf("[WARN] can't read email for %s, %v", userID, err)
+		}
+		if existingAddress == "" && len(postSubs) == 0 {
+			rest.SendErrorHTML(w, r, http.StatusConflict, fmt.Errorf("user is not subscribed"), "user does not have active email subscription", rest.ErrInternal)
+			return
+		}
+		if address != existingAddress && len(postSubs) == 0 {
+			rest.SendErrorHTML(w, r, http.StatusBadRequest, fmt.Errorf("wrong email unsubscription"), "email address in request does not match known for this user", rest.ErrInternal)
+			return
+		}
 	}
 
 	log.Printf("[DEBUG] unsubscribe user %s", userID)
 
-	if err = s.dataService.DeleteUserDetail(siteID, userID, engine.UserEmail); err != nil {
-		code := parseError(err, rest.ErrInternal)
-		rest.SendErrorHTML(w, r, http.StatusBadRequest, err, "can't delete email for user", code)
-		return
-	}
-	// clean User.Email from the token, if user has the token
-	claims, _, err := s.authenticator.TokenService().Get(r)
-	if err != nil {
-		log.Printf("[DEBUG] unsubscribed user doesn't have valid JWT token to update %s, %v", userID, err)
+	for _, sub := range postSubs {
+		if err = s.dataService.Unsubscribe(store.Locator{SiteID: siteID, URL: sub.URL}, userID, subscription.ChannelEmail); err != nil {
+			code := parseError(err, rest.ErrInternal)
+			rest.SendErrorHTML(w, r, http.StatusBadRequest, err, "can't delete email subscription to the post", code)
+			return
+		}
 	}
-	if claims.User != nil && claims.User.Email != "" {
-		claims.User.Email = ""
-		if _, err = s.authenticator.TokenService().Set(w, claims); err != nil {
-			rest.SendErrorHTML(w, r, http.StatusInternalServerError, err, "failed to set token", rest.ErrInternal)
+
+	if existingAddress != "" && address == existingAddress {
+		if err = s.dataService.DeleteUserDetail(siteID, userID, engine.UserEmail); err != nil {
+			code := parseError(err, rest.ErrInternal)
+			rest.SendErrorHTML(w, r, http.StatusBadRequest, err, "can't delete email for user", code)
 			return
 		}
+		// clean User.Email from the token, if user has the token
+		claims, _, err := s.authenticator.TokenService().Get(r)
+		if err != nil {
+			log.Printf("[DEBUG] unsubscribed user doesn't have valid JWT token to update %s, %v", userID, err)
+		}
+		if claims.User != nil && claims.User.Email != "" {
+			claims.User.Email = ""
+			if _, err = s.authenticator.TokenService().Set(w, claims); err != nil {
+				rest.SendErrorHTML(w, r, http.StatusInternalServerError, err, "failed to set token", rest.ErrInternal)
+				return
+			}
+		}
 	}
 
 	// MustExecute behaves like template.Execute, but panics if an error occurs.
@@ -596,6 +899,178 @@ func (s *private) emailUnsubscribeCtrl(w http.ResponseWriter, r *http.Request) {
 	rest.HTMLResponse(w, http.StatusOK, msg.String())
 }
 
+// subscribeCtrl subscribes the user to all new comments of the post by email or telegram.
+// Email subscription is confirmed right away for user's verified email or the email user logged in with,
+// otherwise confirmation token is sent to the address, and "updated" is set to false.
+// Telegram subscription uses user's telegram, set by /telegram/subscribe.
+// POST /subscribe?site=siteID&url=post-url<&type=telegram> with address in json body for email subscription
+func (s *private) subscribeCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	if locator.URL == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("missing parameter"), "url parameter is required", rest.ErrInternal)
+		return
+	}
+	// fail early, before sending confirmation, if subscriptions disabled
+	if _, err := s.dataService.UserSubscriptions(locator.SiteID, user.ID); err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't subscribe user to the post", code)
+		return
+	}
+
+	if r.URL.Query().Get("type") == string(subscription.ChannelTelegram) {
+		address, err := s.dataService.GetUserTelegram(locator.SiteID, user.ID)
+		if err != nil || address == "" {
+			rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("telegram is not set"),
+				"telegram is not set for this user, subscribe to telegram notifications first", rest.ErrActionRejected)
+			return
+		}
+		s.subscribe(w, r, subscription.Subscription{SiteID: locator.SiteID, URL: locator.URL, UserID: user.ID, Telegram: address})
+		return
+	}
+
+	subscribe := struct {
+		Address string
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, hardBodyLimit)).Decode(&subscribe); err != nil && err != io.EOF {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't parse request body", rest.ErrDecode)
+		return
+	}
+	if subscribe.Address == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest,
+			fmt.Errorf("missing parameter"), "address parameter is required", rest.ErrInternal)
+		return
+	}
+
+	// confirm right away the address already verified for the user, or the one user logged in with
+	//
+	// nolint:gosec // this is not used for security purposes
+	existingAddress, _ := s.dataService.GetUserEmail(locator.SiteID, user.ID)
+	if subscribe.Address == existingAddress ||
+		strings.HasPrefix(user.ID, "email_") && strings.TrimPrefix(user.ID, "email_") == token.HashID(sha1.New(), subscribe.Address) {
+		s.subscribe(w, r, subscription.Subscription{SiteID: locator.SiteID, URL: locator.URL, UserID: user.ID, Email: subscribe.Address})
+		return
+	}
+
+	claims := token.Claims{
+		Handshake: &token.Handshake{ID: user.ID + "::" + subscribe.Address, From: locator.URL},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{locator.SiteID},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * time.Minute)),
+			NotBefore: jwt.NewNumericDate(time.Now().Add(-1 * time.Minute)),
+			Issuer:    "remark42",
+		},
+	}
+	tkn, err := s.authenticator.TokenService().Token(claims)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, err, "failed to make verification token", rest.ErrInternal)
+		return
+	}
+
+	s.notifyService.SubmitVerification(
+		notify.VerificationRequest{
+			SiteID: locator.SiteID,
+			User:   user.Name,
+			Email:  subscribe.Address,
+			Token:  tkn,
+		},
+	)
+
+	R.RenderJSON(w, R.JSON{"address": subscribe.Address, "url": locator.URL, "updated": false})
+}
+
+// subscribeConfirmCtrl uses provided token parameter (generated by subscribeCtrl) to subscribe the user to the post by email.
+// Site is taken from the token, site in the body, if set, should match it.
+// POST /subscribe/confirm with site and token in json body
+func (s *private) subscribeConfirmCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+
+	confirm := struct {
+		Site  string
+		Token string
+	}{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, hardBodyLimit)).Decode(&confirm); err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't parse request body", rest.ErrDecode)
+		return
+	}
+	if confirm.Token == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("missing parameter"), "token parameter is required", rest.ErrInternal)
+		return
+	}
+	confClaims, err := s.authenticator.TokenService().Parse(confirm.Token)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, err, "failed to verify confirmation token", rest.ErrInternal)
+		return
+	}
+	if s.authenticator.TokenService().IsExpired(confClaims) {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, fmt.Errorf("expired"), "failed to verify confirmation token", rest.ErrInternal)
+		return
+	}
+
+	// handshake.ID is user.ID + "::" + address, handshake.From is post url, audience is site
+	if confClaims.Handshake == nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("no handshake"), "invalid handshake token", rest.ErrInternal)
+		return
+	}
+	elems := strings.Split(confClaims.Handshake.ID, "::")
+	if len(elems) != 2 || elems[0] != user.ID || confClaims.Handshake.From == "" || len(confClaims.Audience) != 1 {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("%s", confClaims.Handshake.ID), "invalid handshake token", rest.ErrInternal)
+		return
+	}
+	siteID := confClaims.Audience[0]
+	if confirm.Site != "" && confirm.Site != siteID {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("site %q doesn't match token site %q", confirm.Site, siteID),
+			"invalid handshake token", rest.ErrActionRejected)
+		return
+	}
+	s.subscribe(w, r, subscription.Subscription{SiteID: siteID, URL: confClaims.Handshake.From, UserID: user.ID, Email: elems[1]})
+}
+
+func (s *private) subscribe(w http.ResponseWriter, r *http.Request, sub subscription.Subscription) {
+	log.Printf("[DEBUG] subscribe user %s to %s", sub.UserID, sub.URL)
+	res, err := s.dataService.Subscribe(sub)
+	if err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't subscribe user to the post", code)
+		return
+	}
+	R.RenderJSON(w, R.JSON{"updated": true, "subscription": res})
+}
+
+// DELETE /subscribe?site=siteID&url=post-url<&type=email|telegram> - unsubscribes the user from the post, from all channels if type not set
+func (s *private) unsubscribeCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	ch := subscription.Channel(r.URL.Query().Get("type"))
+
+	err := s.dataService.Unsubscribe(locator, user.ID, ch)
+	if errors.Is(err, subscription.ErrNotSubscribed) {
+		rest.SendErrorJSON(w, r, http.StatusConflict, err, "user is not subscribed to the post", rest.ErrActionRejected)
+		return
+	}
+	if err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't unsubscribe user from the post", code)
+		return
+	}
+	R.RenderJSON(w, R.JSON{"deleted": true})
+}
+
+// GET /subscriptions?site=siteID - returns list of user's subscriptions to posts
+func (s *private) subscriptionsCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	subs, err := s.dataService.UserSubscriptions(r.URL.Query().Get("site"), user.ID)
+	if err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't get user subscriptions", code)
+		return
+	}
+	if subs == nil {
+		subs = []subscription.Subscription{}
+	}
+	R.RenderJSON(w, subs)
+}
+
 // DELETE /email?site=siteID - removes user's email
 func (s *private) deleteEmailCtrl(w http.ResponseWriter, r *http.Request) {
 	user := rest.MustGetUserInfo(r)
@@ -637,6 +1112,39 @@ func (s *private) deleteTelegramCtrl(w http.ResponseWriter, r *http.Request) {
 	R.RenderJSON(w, R.JSON{"deleted": true})
 }
 
+// DELETE /matrix?site=siteID - removes user's matrix id
+func (s *private) deleteMatrixCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	siteID := r.URL.Query().Get("site")
+	log.Printf("[DEBUG] remove matrix for user %s", user.ID)
+
+	if err := s.dataService.DeleteUserDetail(siteID, user.ID, engine.UserMatrix); err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't delete matrix for user", code)
+		return
+	}
+	R.RenderJSON(w, R.JSON{"deleted": true})
+}
+
+// DELETE /webpush?site=siteID&endpoint=url - removes user's web push subscription with endpoint, all without endpoint
+func (s *private) deleteWebPushCtrl(w http.ResponseWriter, r *http.Request) {
+	user := rest.MustGetUserInfo(r)
+	siteID, endpoint := r.URL.Query().Get("site"), r.URL.Query().Get("endpoint")
+	log.Printf("[DEBUG] remove web push subscription for user %s", user.ID)
+
+	var subs []notify.WebPushSubscription
+	if endpoint != "" {
+		subs = slices.DeleteFunc(s.webPushSubscriptions(siteID, user.ID),
+			func(ws notify.WebPushSubscription) bool { return ws.Endpoint == endpoint })
+	}
+	if err := s.setWebPushSubscriptions(siteID, user.ID, subs); err != nil {
+		code := parseError(err, rest.ErrInternal)
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't delete web push subscription for user", code)
+		return
+	}
+	R.RenderJSON(w, R.JSON{"deleted": true})
+}
+
 // GET /userdata?site=siteID - exports all data about the user as a json with user info and list of all comments
 func (s *private) userAllDataCtrl(w http.ResponseWriter, r *http.Request) {
 	siteID := r.URL.Query().Get("site")
@@ -744,7 +1252,15 @@ func (s *private) savePictureCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 	defer func() { _ = file.Close() }()
 
-	id, err := s.imageService.Save(user.ID, file)
+	id, err := s.imageService.Save(r.URL.Query().Get("site"), user.ID, file)
+	if errors.Is(err, image.ErrBanned) {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, err, "image is banned", rest.ErrActionRejected)
+		return
+	}
+	if errors.Is(err, image.ErrQuotaExceeded) {
+		rest.SendErrorJSON(w, r, http.StatusForbidden, err, "images quota exceeded", rest.ErrActionRejected)
+		return
+	}
 	if err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't save image", rest.ErrInternal)
 		return
@@ -754,9 +1270,9 @@ func (s *private) savePictureCtrl(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *private) isReadOnly(locator store.Locator) bool {
-	if s.readOnlyAge > 0 {
+	if readOnlyAge := s.siteSettings(locator.SiteID).ReadOnlyAge; readOnlyAge > 0 {
 		// check RO by age
-		if info, e := s.dataService.Info(locator, s.readOnlyAge); e == nil && info.ReadOnly {
+		if info, e := s.dataService.Info(locator, readOnlyAge); e == nil && info.ReadOnly {
 			return true
 		}
 	}
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -22,11 +23,15 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 
 	"github.com/umputun/remark42/backend/app/notify"
+	"github.com/umputun/remark42/backend/app/rest"
 	"github.com/umputun/remark42/backend/app/rest/proxy"
 	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/store/image"
+	"github.com/umputun/remark42/backend/app/store/service"
+	"github.com/umputun/remark42/backend/app/store/subscription"
 )
 
 // gopher png for test, from https://golang.org/src/image/png/example_test.go
@@ -248,6 +253,39 @@ func TestRest_CreateWithRestrictedWord(t *testing.T) {
 	assert.Equal(t, "invalid comment", c["details"])
 }
 
+func TestRest_CreateSpam(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	classifier := service.NewSpamClassifier("", 0.9)
+	srv.DataService.SpamClassifier, srv.DataService.SpamAction = classifier, service.SpamReject
+	for range 5 {
+		require.NoError(t, classifier.Train(store.Comment{Locator: store.Locator{SiteID: "remark42"},
+			Text: "<p>buy cheap pills</p>"}, true))
+		require.NoError(t, classifier.Train(store.Comment{Locator: store.Locator{SiteID: "remark42"},
+			Text: "<p>nice episode</p>"}, false))
+	}
+
+	req, err := http.NewRequest("POST", ts.URL+"/api/v1/comment?site=remark42",
+		strings.NewReader(`{"text": "buy cheap pills", "locator":{"url": "https://radio-t.com/blah1", "site": "remark42"}}`))
+	require.NoError(t, err)
+	resp, err := sendReq(req, devToken)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	c := R.JSON{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&c))
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "comment rejected as spam", c["error"])
+	assert.Equal(t, float64(rest.ErrCommentRejected), c["code"])
+
+	req, err = http.NewRequest("POST", ts.URL+"/api/v1/comment?site=remark42",
+		strings.NewReader(`{"text": "nice episode", "locator":{"url": "https://radio-t.com/blah1", "site": "remark42"}}`))
+	require.NoError(t, err)
+	resp, err = sendReq(req, devToken)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
 func TestRest_CreateRelativeURL(t *testing.T) {
 	ts, _, teardown := startupT(t)
 	defer teardown()
@@ -708,6 +746,38 @@ func TestRest_UpdateWithRestrictedWords(t *testing.T) {
 	assert.Equal(t, "invalid comment", c["details"])
 }
 
+func TestRest_Report(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+	srv.DataService.ReportThreshold = 1
+
+	id := addComment(t, store.Comment{Text: "test test #1",
+		Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah"}}, ts)
+
+	report := func(token, body string) int {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/report/"+id+"?site=remark42&url=https://radio-t.com/blah",
+			strings.NewReader(body))
+		require.NoError(t, err)
+		resp, err := sendReq(req, token)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, report("", `{"reason":"spam"}`))
+	assert.Equal(t, http.StatusForbidden, report(anonToken, `{"reason":"spam"}`), "anonymous can't report")
+	assert.Equal(t, http.StatusBadRequest, report(dev2Token, `{"reason":"spam"`), "bad json")
+	assert.Equal(t, http.StatusBadRequest, report(dev2Token, `{"reason":"blah"}`), "unknown reason")
+	assert.Equal(t, http.StatusBadRequest, report(devToken, `{"reason":"spam"}`), "own comment")
+	assert.Equal(t, http.StatusOK, report(dev2Token, `{"reason":"spam","note":"ads"}`))
+	assert.Equal(t, http.StatusBadRequest, report(dev2Token, `{"reason":"spam"}`), "hidden after threshold")
+
+	body, code := get(t, ts.URL+"/api/v1/count?site=remark42&url=https://radio-t.com/blah")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"count":0,"locator":{"site":"remark42","url":"https://radio-t.com/blah"}}`+"\n", body,
+		"reported comment hidden")
+}
+
 func TestRest_Vote(t *testing.T) {
 	ts, _, teardown := startupT(t)
 	defer teardown()
@@ -838,7 +908,7 @@ func TestRest_AnonVote(t *testing.T) {
 	}
 
 	assert.Equal(t, http.StatusForbidden, vote(1), "vote is disallowed with anonVote false")
-	srv.privRest.anonVote = true
+	srv.AnonVote = true
 	assert.Equal(t, http.StatusOK, vote(1), "first vote allowed")
 	assert.Equal(t, http.StatusBadRequest, vote(1), "second vote rejected")
 	body, code := getWithAnonAuth(fmt.Sprintf("%s/api/v1/id/%s?site=remark42&url=https://radio-t.com/blah", ts.URL, id1))
@@ -895,13 +965,18 @@ func TestRest_EmailAndTelegram(t *testing.T) {
 		{description: "set user email, token is good, old query param", url: fmt.Sprintf("/api/v1/email/confirm?site=remark42&tkn=%s", goodToken), method: http.MethodPost, responseCode: http.StatusOK, cookieEmail: "good@example.com"},
 		{description: "send confirmation with same address", url: "/api/v1/email/subscribe?site=remark42&address=good@example.com", method: http.MethodPost, responseCode: http.StatusConflict},
 		{description: "get user email", url: "/api/v1/email?site=remark42", method: http.MethodGet, responseCode: http.StatusOK},
+		{description: "set email digest without auth", url: "/api/v1/email/digest?site=remark42&mode=daily", method: http.MethodPut, responseCode: http.StatusUnauthorized, noAuth: true},
+		{description: "set email digest, bad mode", url: "/api/v1/email/digest?site=remark42&mode=weekly", method: http.MethodPut, responseCode: http.StatusBadRequest},
+		{description: "set email digest", url: "/api/v1/email/digest?site=remark42&mode=daily", method: http.MethodPut, responseCode: http.StatusOK},
+		{description: "set immediate email notifications", url: "/api/v1/email/digest?site=remark42&mode=immediate", method: http.MethodPut, responseCode: http.StatusOK},
 		{description: "delete user email", url: "/api/v1/email?site=remark42", method: http.MethodDelete, responseCode: http.StatusOK},
 		{description: "send another confirmation", url: "/api/v1/email/subscribe?site=remark42&address=good@example.com", method: http.MethodPost, responseCode: http.StatusOK},
 		{description: "set user email, token is good", url: "/api/v1/email/confirm?site=remark42", method: http.MethodPost, responseCode: http.StatusOK, cookieEmail: "good@example.com", body: fmt.Sprintf(`{"site":"remark42","token":%q}`, goodToken)},
 		{description: "set user email, token is good, old query param", url: fmt.Sprintf("/api/v1/email/confirm?site=remark42&tkn=%s", goodToken), method: http.MethodPost, responseCode: http.StatusOK, cookieEmail: "good@example.com"},
 		{description: "unsubscribe user, no token", url: "/email/unsubscribe.html?site=remark42", method: http.MethodPost, responseCode: http.StatusBadRequest},
 		{description: "unsubscribe user, wrong token", url: "/email/unsubscribe.html?site=remark42&tkn=jwt", method: http.MethodGet, responseCode: http.StatusForbidden},
-		{description: "unsubscribe user, good token", url: fmt.Sprintf("/email/unsubscribe.html?site=remark42&tkn=%s", goodToken), method: http.MethodPost, responseCode: http.StatusOK},
+		// one-click unsubscribe from List-Unsubscribe-Post header, RFC 8058
+		{description: "unsubscribe user, good token", url: fmt.Sprintf("/email/unsubscribe.html?site=remark42&tkn=%s", goodToken), method: http.MethodPost, responseCode: http.StatusOK, body: "List-Unsubscribe=One-Click"},
 		{description: "unsubscribe user second time, good token", url: fmt.Sprintf("/email/unsubscribe.html?site=remark42&tkn=%s", goodToken), method: http.MethodPost, responseCode: http.StatusConflict},
 		{description: "issue delete request without auth", url: "/api/v1/telegram", method: http.MethodDelete, responseCode: http.StatusUnauthorized, noAuth: true},
 		{description: "issue delete request without site_id", url: "/api/v1/telegram", method: http.MethodDelete, responseCode: http.StatusForbidden},
@@ -948,6 +1023,307 @@ func TestRest_EmailAndTelegram(t *testing.T) {
 	}
 }
 
+func TestRest_EmailDigest(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	getDigest := func() string {
+		body, code := getWithDevAuth(t, ts.URL+"/api/v1/email?site=remark42")
+		require.Equal(t, http.StatusOK, code, body)
+		res := struct {
+			Digest string `json:"digest"`
+		}{}
+		require.NoError(t, json.Unmarshal([]byte(body), &res))
+		return res.Digest
+	}
+	setDigest := func(mode string) (string, int) {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/email/digest?site=remark42&mode="+mode, http.NoBody)
+		require.NoError(t, err)
+		resp, err := sendReq(req, devToken)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return string(body), resp.StatusCode
+	}
+
+	assert.Equal(t, "immediate", getDigest(), "immediate by default")
+
+	body, code := setDigest("hourly")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"updated":true,"digest":"hourly"}`, body)
+	assert.Equal(t, "hourly", getDigest())
+
+	body, code = setDigest("weekly")
+	assert.Equal(t, http.StatusBadRequest, code, body)
+	assert.Equal(t, "hourly", getDigest(), "not changed by bad mode")
+
+	body, code = setDigest("immediate")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "immediate", getDigest())
+}
+
+func TestRest_Matrix(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	mockDestination := &notify.MockDest{}
+	srv.privRest.notifyService = notify.NewService(srv.DataService, 1, mockDestination)
+	defer srv.privRest.notifyService.Close()
+
+	send := func(method, url string) (string, int) {
+		req, err := http.NewRequest(method, ts.URL+url, http.NoBody)
+		require.NoError(t, err)
+		resp, err := sendReq(req, devToken)
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return string(b), resp.StatusCode
+	}
+
+	body, code := send(http.MethodGet, "/api/v1/matrix/subscribe?site=remark42&address=@dev:matrix.org")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Contains(t, body, "matrix notifications are not enabled")
+
+	matrix, err := notify.NewMatrix(notify.MatrixParams{Server: "https://matrix.example.com", Token: "tkn", UserNotifications: true})
+	require.NoError(t, err)
+	srv.privRest.matrixService = matrix
+
+	_, code = send(http.MethodGet, "/api/v1/matrix/subscribe?site=remark42")
+	assert.Equal(t, http.StatusBadRequest, code, "no address")
+	body, code = send(http.MethodGet, "/api/v1/matrix/subscribe?site=remark42&address=dev")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "address should be matrix id like @user:matrix.org")
+
+	body, code = send(http.MethodGet, "/api/v1/matrix/subscribe?site=remark42&address=@dev:matrix.org")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"address":"@dev:matrix.org","updated":false}`, body, "token not returned")
+	waitForCount(t, 1, func() int { return len(mockDestination.GetVerify()) })
+	verification := mockDestination.GetVerify()[0]
+	assert.Equal(t, "@dev:matrix.org", verification.Matrix)
+	assert.Empty(t, verification.Email)
+
+	_, code = send(http.MethodGet, "/api/v1/matrix/subscribe?site=remark42&tkn=bad")
+	assert.Equal(t, http.StatusNotFound, code)
+	body, code = send(http.MethodGet, "/api/v1/matrix/subscribe?site=remark42&tkn="+verification.Token)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"address":"@dev:matrix.org","updated":true}`, body)
+	address, err := srv.DataService.GetUserMatrix("remark42", "provider1_dev")
+	require.NoError(t, err)
+	assert.Equal(t, "@dev:matrix.org", address)
+
+	_, code = send(http.MethodGet, "/api/v1/matrix/subscribe?site=remark42&address=@dev:matrix.org")
+	assert.Equal(t, http.StatusConflict, code, "already set")
+	_, code = send(http.MethodHead, "/api/v1/matrix/subscribe?site=remark42&address=@dev:matrix.org")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	body, code = send(http.MethodDelete, "/api/v1/matrix?site=remark42")
+	require.Equal(t, http.StatusOK, code, body)
+	address, err = srv.DataService.GetUserMatrix("remark42", "provider1_dev")
+	require.NoError(t, err)
+	assert.Empty(t, address)
+}
+
+func TestRest_WebPush(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	send := func(method, url, body string) (string, int) {
+		reqBody := io.Reader(http.NoBody)
+		if body != "" {
+			reqBody = strings.NewReader(body)
+		}
+		req, err := http.NewRequest(method, ts.URL+url, reqBody)
+		require.NoError(t, err)
+		resp, err := sendReq(req, devToken)
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return string(b), resp.StatusCode
+	}
+	subscription := func(endpoint string) string {
+		// keys of the subscription example from RFC 8291
+		return fmt.Sprintf(`{"endpoint":%q,"expirationTime":null,"keys":{"p256dh":`+
+			`"BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4",`+
+			`"auth":"BTBZMqHH6r4Tts7J_aSIgg"}}`, endpoint)
+	}
+	stored := func() []string {
+		value, err := srv.DataService.GetUserWebPush("remark42", "provider1_dev")
+		require.NoError(t, err)
+		subs, err := notify.ParseWebPushSubscriptions(value)
+		require.NoError(t, err)
+		res := []string{}
+		for _, sub := range subs {
+			res = append(res, sub.Endpoint)
+		}
+		return res
+	}
+
+	body, code := send(http.MethodPost, "/api/v1/webpush/subscribe?site=remark42", subscription("https://push.example.com/1"))
+	assert.Equal(t, http.StatusInternalServerError, code)
+	assert.Contains(t, body, "web push notifications are not enabled")
+
+	srv.privRest.webPushEnabled = true
+	_, code = send(http.MethodPost, "/api/v1/webpush/subscribe?site=remark42", "bad json")
+	assert.Equal(t, http.StatusBadRequest, code)
+	body, code = send(http.MethodPost, "/api/v1/webpush/subscribe?site=remark42", subscription("http://push.example.com/1"))
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "endpoint should be https URL")
+
+	body, code = send(http.MethodPost, "/api/v1/webpush/subscribe?site=remark42", subscription("https://push.example.com/1"))
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"updated":true,"endpoint":"https://push.example.com/1"}`, body)
+	assert.Equal(t, []string{"https://push.example.com/1"}, stored())
+
+	seed := make([]string, 0, maxWebPushSubscriptions)
+	for i := 1; i <= maxWebPushSubscriptions; i++ {
+		seed = append(seed, subscription(fmt.Sprintf("https://push.example.com/%d", i)))
+	}
+	_, err := srv.DataService.SetUserWebPush("remark42", "provider1_dev", "["+strings.Join(seed, ",")+"]")
+	require.NoError(t, err)
+	_, code = send(http.MethodPost, "/api/v1/webpush/subscribe?site=remark42", subscription("https://push.example.com/11"))
+	require.Equal(t, http.StatusOK, code)
+	subs := stored()
+	require.Len(t, subs, maxWebPushSubscriptions, "oldest subscription dropped")
+	assert.Equal(t, "https://push.example.com/2", subs[0])
+	assert.Equal(t, "https://push.example.com/11", subs[maxWebPushSubscriptions-1])
+
+	_, code = send(http.MethodPost, "/api/v1/webpush/subscribe?site=remark42", subscription("https://push.example.com/3"))
+	require.Equal(t, http.StatusOK, code)
+	subs = stored()
+	require.Len(t, subs, maxWebPushSubscriptions, "same endpoint not duplicated")
+	assert.Equal(t, "https://push.example.com/3", subs[maxWebPushSubscriptions-1], "moved to the end")
+
+	body, code = send(http.MethodDelete, "/api/v1/webpush?site=remark42&endpoint=https://push.example.com/3", "")
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Len(t, stored(), maxWebPushSubscriptions-1)
+	assert.NotContains(t, stored(), "https://push.example.com/3")
+
+	_, code = send(http.MethodDelete, "/api/v1/webpush?site=remark42", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, stored())
+}
+
+func TestRest_PostSubscriptions(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	mockDestination := &notify.MockDest{}
+	srv.privRest.notifyService = notify.NewService(srv.DataService, 1, mockDestination)
+	defer srv.privRest.notifyService.Close()
+
+	send := func(method, url, body, tkn string) (string, int) {
+		reqBody := io.Reader(http.NoBody)
+		if body != "" {
+			reqBody = strings.NewReader(body)
+		}
+		req, err := http.NewRequest(method, ts.URL+url, reqBody)
+		require.NoError(t, err)
+		resp, err := sendReq(req, tkn)
+		require.NoError(t, err)
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return string(b), resp.StatusCode
+	}
+	postURL := "https://radio-t.com/blah1"
+	subscribeURL := "/api/v1/subscribe?site=remark42&url=" + postURL
+
+	body, code := send(http.MethodPost, subscribeURL, `{"address":"dev@example.com"}`, devToken)
+	assert.Equal(t, http.StatusBadRequest, code, "subscriptions disabled")
+	assert.Contains(t, body, "post subscriptions disabled")
+
+	subs, err := subscription.NewStore(filepath.Join(t.TempDir(), "subscriptions.db"), bolt.Options{})
+	require.NoError(t, err)
+	srv.DataService.Subscriptions = subs
+
+	_, code = send(http.MethodPost, subscribeURL, `{"address":"dev@example.com"}`, "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	_, code = send(http.MethodPost, "/api/v1/subscribe?site=remark42", `{"address":"dev@example.com"}`, devToken)
+	assert.Equal(t, http.StatusBadRequest, code, "no url")
+	_, code = send(http.MethodPost, subscribeURL, "", devToken)
+	assert.Equal(t, http.StatusBadRequest, code, "no address")
+	_, code = send(http.MethodPost, subscribeURL+"&type=telegram", "", devToken)
+	assert.Equal(t, http.StatusBadRequest, code, "no telegram set for the user")
+
+	// email unknown for the user, confirmation sent
+	body, code = send(http.MethodPost, subscribeURL, `{"address":"dev@example.com"}`, devToken)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"address":"dev@example.com","url":"https://radio-t.com/blah1","updated":false}`, body)
+	waitForCount(t, 1, func() int { return len(mockDestination.GetVerify()) })
+	assert.Equal(t, "dev@example.com", mockDestination.GetVerify()[0].Email)
+	verificationToken := mockDestination.GetVerify()[0].Token
+
+	body, code = send(http.MethodGet, "/api/v1/subscriptions?site=remark42", "", devToken)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "[]\n", body, "not confirmed yet")
+
+	_, code = send(http.MethodPost, "/api/v1/subscribe/confirm?site=remark42", `{"site":"remark42","token":"bad"}`, devToken)
+	assert.Equal(t, http.StatusForbidden, code)
+	body, code = send(http.MethodPost, "/api/v1/subscribe/confirm?site=remark42", fmt.Sprintf(`{"site":"remark42","token":%q}`, devToken), devToken)
+	assert.Equal(t, http.StatusBadRequest, code, "valid token without handshake")
+	assert.Contains(t, body, "invalid handshake token")
+	_, code = send(http.MethodPost, "/api/v1/subscribe/confirm?site=remark42", fmt.Sprintf(`{"site":"remark42","token":%q}`, verificationToken), emailUserToken)
+	assert.Equal(t, http.StatusBadRequest, code, "token of another user")
+	body, code = send(http.MethodPost, "/api/v1/subscribe/confirm?site=remark42", fmt.Sprintf(`{"site":"other","token":%q}`, verificationToken), devToken)
+	assert.Equal(t, http.StatusBadRequest, code, "token of another site")
+	assert.Contains(t, body, "invalid handshake token")
+	body, code = send(http.MethodPost, "/api/v1/subscribe/confirm?site=remark42", fmt.Sprintf(`{"site":"remark42","token":%q}`, verificationToken), devToken)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"updated":true`)
+
+	// email user logged in with the address, subscribed right away
+	body, code = send(http.MethodPost, subscribeURL, `{"address":"good@example.com"}`, emailUserToken)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Contains(t, body, `"updated":true`)
+
+	body, code = send(http.MethodGet, "/api/v1/subscriptions?site=remark42", "", devToken)
+	require.Equal(t, http.StatusOK, code, body)
+	var userSubs []subscription.Subscription
+	require.NoError(t, json.Unmarshal([]byte(body), &userSubs))
+	require.Len(t, userSubs, 1)
+	assert.Equal(t, postURL, userSubs[0].URL)
+	assert.Equal(t, "dev@example.com", userSubs[0].Email)
+
+	// new comment on the post notifies both subscribers, the author is excluded
+	_, code = send(http.MethodPost, "/api/v1/comment?site=remark42",
+		`{"text": "test 123", "locator":{"url": "https://radio-t.com/blah1", "site": "remark42"}}`, devToken)
+	require.Equal(t, http.StatusCreated, code)
+	waitForCount(t, 1, func() int { return len(mockDestination.Get()) })
+	assert.Equal(t, []string{"good@example.com"}, mockDestination.Get()[0].Emails)
+
+	// unsubscribe link of the post
+	claims := token.Claims{
+		Handshake: &token.Handshake{ID: "provider1_dev::dev@example.com"},
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{"remark42"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(10 * time.Minute)),
+			NotBefore: jwt.NewNumericDate(time.Now().Add(-1 * time.Minute)),
+			Issuer:    "remark42",
+		},
+	}
+	tkn, err := srv.Authenticator.TokenService().Token(claims)
+	require.NoError(t, err)
+	_, code = send(http.MethodPost, "/email/unsubscribe.html?site=remark42&url=https://radio-t.com/other&tkn="+tkn, "", "")
+	assert.Equal(t, http.StatusConflict, code, "not subscribed to other post")
+	body, code = send(http.MethodPost, "/email/unsubscribe.html?site=remark42&url=https://radio-t.com/blah1&tkn="+tkn, "", "")
+	assert.Equal(t, http.StatusOK, code, body)
+	_, code = send(http.MethodPost, "/email/unsubscribe.html?site=remark42&url=https://radio-t.com/blah1&tkn="+tkn, "", "")
+	assert.Equal(t, http.StatusConflict, code, "already unsubscribed")
+
+	// unsubscribe from the post via api
+	_, code = send(http.MethodDelete, subscribeURL+"&type=telegram", "", emailUserToken)
+	assert.Equal(t, http.StatusConflict, code, "not subscribed by telegram")
+	body, code = send(http.MethodDelete, subscribeURL, "", emailUserToken)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"deleted":true}`, body)
+	body, code = send(http.MethodGet, "/api/v1/subscriptions?site=remark42", "", emailUserToken)
+	require.Equal(t, http.StatusOK, code, body)
+	assert.Equal(t, "[]\n", body)
+}
+
 func TestRest_EmailNotification(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
@@ -23,14 +23,17 @@ import (
 	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/store/image"
 	"github.com/umputun/remark42/backend/app/store/service"
+	"github.com/umputun/remark42/backend/app/store/settings"
+	"github.com/umputun/remark42/backend/app/stream"
 )
 
 type public struct {
 	dataService      pubStore
 	cache            LoadingCache
-	readOnlyAge      int
+	siteSettings     func(siteID string) settings.Settings
 	commentFormatter *store.CommentFormatter
 	imageService     *image.Service
+	streamHub        *stream.Hub
 }
 
 type pubStore interface {
@@ -38,8 +41,9 @@ type pubStore interface {
 	Get(locator store.Locator, commentID string, user store.User) (store.Comment, error)
 	FindSince(locator store.Locator, sort string, user store.User, since time.Time) ([]store.Comment, error)
 	Last(siteID string, limit int, since time.Time, user store.User) ([]store.Comment, error)
+	Search(siteID, query string, limit, skip int, user store.User) ([]store.Comment, error)
 	User(siteID, userID string, limit, skip int, user store.User) ([]store.Comment, error)
-	UserCount(siteID, userID string) (int, error)
+	UserCount(siteID, userID string, user store.User) (int, error)
 	Count(locator store.Locator) (int, error)
 	List(siteID string, limit, skip int) ([]store.PostInfo, error)
 	Info(locator store.Locator, readonlyAge int) (store.PostInfo, error)
@@ -69,7 +73,7 @@ func (s *public) findCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 
 	view := r.URL.Query().Get("view")
-	since, err := s.parseSince(r)
+	since, err := parseSince(r)
 	if err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't parse since", rest.ErrCommentNotFound)
 		return
@@ -107,7 +111,7 @@ func (s *public) findCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 		comments = s.applyView(comments, view)
 
 		var commentsInfo store.PostInfo
-		if info, ee := s.dataService.Info(locator, s.readOnlyAge); ee == nil {
+		if info, ee := s.dataService.Info(locator, s.siteSettings(locator.SiteID).ReadOnlyAge); ee == nil {
 			commentsInfo = info
 		}
 
@@ -164,7 +168,7 @@ func (s *public) infoCtrl(w http.ResponseWriter, r *http.Request) {
 
 	key := cache.NewKey(locator.SiteID).ID(URLKey(r)).Scopes(locator.SiteID, locator.URL)
 	data, err := s.cache.Get(key, func() ([]byte, error) {
-		info, e := s.dataService.Info(locator, s.readOnlyAge)
+		info, e := s.dataService.Info(locator, s.siteSettings(locator.SiteID).ReadOnlyAge)
 		if e != nil {
 			return nil, e
 		}
@@ -192,13 +196,13 @@ func (s *public) lastCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 		limit = 0
 	}
 
-	sinceTime, err := s.parseSince(r)
+	sinceTime, err := parseSince(r)
 	if err != nil {
 		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't translate since parameter", rest.ErrDecode)
 		return
 	}
 
-	key := cache.NewKey(siteID).ID(URLKey(r)).Scopes(lastCommentsScope)
+	key := cache.NewKey(siteID).ID(URLKeyWithUser(r)).Scopes(lastCommentsScope) // pending comments visible to their authors
 	data, err := s.cache.Get(key, func() ([]byte, error) {
 		comments, e := s.dataService.Last(siteID, limit, sinceTime, rest.GetUserOrEmpty(r))
 		if e != nil {
@@ -219,6 +223,98 @@ func (s *public) lastCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GET /search?site=siteID&q=query&limit=50&skip=10 - full-text search for comments across all posts of the site.
+// Matches comment's text, links, user name and post title. Deleted comments and comments of blocked users are excluded.
+func (s *public) searchCommentsCtrl(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("site")
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	log.Printf("[DEBUG] search comments for %q, %s", query, siteID)
+
+	if query == "" {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, fmt.Errorf("empty search query"), "can't search comments", rest.ErrDecode)
+		return
+	}
+
+	limit, skip, err := limitSkip(r)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusBadRequest, err, "can't search comments", rest.ErrDecode)
+		return
+	}
+
+	key := cache.NewKey(siteID).ID(URLKeyWithUser(r)).Scopes(siteID, lastCommentsScope)
+	data, err := s.cache.Get(key, func() ([]byte, error) {
+		comments, e := s.dataService.Search(siteID, query, limit, skip, rest.GetUserOrEmpty(r))
+		if e != nil {
+			return nil, e
+		}
+		return encodeJSONWithHTML(comments)
+	})
+
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusInternalServerError, err, "can't search comments", rest.ErrInternal)
+		return
+	}
+
+	if err = R.RenderJSONFromBytes(w, r, data); err != nil {
+		log.Printf("[WARN] can't render search results for site %s", siteID)
+	}
+}
+
+// GET /stream?site=siteID&url=post-url - server-sent events stream of created, updated, deleted and voted comments.
+// url is optional, without it events for all posts of the site are sent. Each event named after its type
+// (create, update, delete or vote) and its data is the comment, as returned by /id
+func (s *public) streamCtrl(w http.ResponseWriter, r *http.Request) {
+	locator := store.Locator{SiteID: r.URL.Query().Get("site"), URL: r.URL.Query().Get("url")}
+	log.Printf("[DEBUG] stream comments for %+v", locator)
+
+	if s.streamHub == nil {
+		rest.SendErrorJSON(w, r, http.StatusServiceUnavailable, fmt.Errorf("stream disabled"), "can't stream comments", rest.ErrActionRejected)
+		return
+	}
+
+	events, err := s.streamHub.Subscribe(r.Context(), locator)
+	if err != nil {
+		rest.SendErrorJSON(w, r, http.StatusServiceUnavailable, err, "can't stream comments", rest.ErrActionRejected)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // disable response buffering by nginx
+	w.WriteHeader(http.StatusOK)
+	if err = rc.Flush(); err != nil {
+		log.Printf("[WARN] can't flush stream for %+v, %v", locator, err)
+		return
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return // unsubscribed on client disconnect or server shutdown
+			}
+			data, e := encodeJSONWithHTML(ev.Comment)
+			if e != nil {
+				log.Printf("[WARN] can't encode stream event for %s, %v", ev.Comment.ID, e)
+				continue
+			}
+			if _, e = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, bytes.TrimSpace(data)); e != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, e := fmt.Fprint(w, ": keep-alive\n\n"); e != nil {
+				return
+			}
+		}
+		if e := rc.Flush(); e != nil {
+			return
+		}
+	}
+}
+
 // GET /id/{id}?site=siteID&url=post-url - gets a comment by id
 func (s *public) commentByIDCtrl(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
@@ -271,7 +367,7 @@ func (s *public) findUserCommentsCtrl(w http.ResponseWriter, r *http.Request) {
 			return nil, e
 		}
 		comments = filterComments(comments, func(c store.Comment) bool { return !c.Deleted })
-		count, e := s.dataService.UserCount(siteID, userID)
+		count, e := s.dataService.UserCount(siteID, userID, rest.GetUserOrEmpty(r))
 		if e != nil {
 			return nil, e
 		}
@@ -397,7 +493,7 @@ func sendPictureError(w http.ResponseWriter, r *http.Request, status int, err er
 	rest.SendErrorJSON(w, r, status, err, details, code)
 }
 
-// GET /picture/{user}/{id} - get picture
+// GET /picture/{user}/{id}?w=640 - get picture, optional w selects the narrowest responsive variant not narrower than w
 func (s *public) loadPictureCtrl(w http.ResponseWriter, r *http.Request) {
 	rest.SetImageDefenseHeaders(w)
 
@@ -408,7 +504,8 @@ func (s *public) loadPictureCtrl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	id := user + "/" + imgID
-	img, err := s.imageService.Load(id)
+	width, _ := strconv.Atoi(r.URL.Query().Get("w")) // original picture for missing or invalid width
+	img, loadedID, err := s.imageService.LoadVariant(id, width)
 	if err != nil {
 		log.Printf("[WARN] can't load image %s: %v", id, err)
 		sendPictureError(w, r, http.StatusBadRequest, fmt.Errorf("image not found"), "can't get image", rest.ErrAssetNotFound)
@@ -430,7 +527,8 @@ func (s *public) loadPictureCtrl(w http.ResponseWriter, r *http.Request) {
 	// Content-Disposition: inline), not on byte normalization. Picture IDs are limited
 	// to safePictureSegment (alphanumeric xid-generated guids), so the comma split
 	// inside rest.EtagMatches cannot collide; if the ID format ever changes, revisit.
-	etag := `"` + id + `"`
+	// Variants get own etag, as the same id with different width serves different bytes.
+	etag := `"` + loadedID + `"`
 	w.Header().Set("Etag", etag)
 	w.Header().Set("Cache-Control", "max-age=604800") // 7 days
 	if match := r.Header.Get("If-None-Match"); match != "" && rest.EtagMatches(match, etag) {
@@ -510,7 +608,7 @@ func (s *public) applyView(comments []store.Comment, view string) []store.Commen
 	return comments
 }
 
-func (s *public) parseSince(r *http.Request) (time.Time, error) {
+func parseSince(r *http.Request) (time.Time, error) {
 	sinceTS := time.Time{}
 	if since := r.URL.Query().Get("since"); since != "" {
 		unixTS, e := strconv.ParseInt(since, 10, 64)
@@ -522,6 +620,29 @@ func (s *public) parseSince(r *http.Request) (time.Time, error) {
 	return sinceTS, nil
 }
 
+// limitSkip parses optional limit and skip parameters of paginated listing. Missing limit is 0, i.e. the default
+// of the listing, and limit over maxPageLimit capped. Negative and non-numeric values rejected
+func limitSkip(r *http.Request) (limit, skip int, err error) {
+	parse := func(key string) (int, error) {
+		v := r.URL.Query().Get(key)
+		if v == "" {
+			return 0, nil
+		}
+		res, e := strconv.Atoi(v)
+		if e != nil || res < 0 {
+			return 0, fmt.Errorf("invalid %s parameter %q", key, v)
+		}
+		return res, nil
+	}
+	if limit, err = parse("limit"); err != nil {
+		return 0, 0, err
+	}
+	if skip, err = parse("skip"); err != nil {
+		return 0, 0, err
+	}
+	return min(limit, maxPageLimit), skip, nil
+}
+
 // limitComments returns limited list of comments and count of comments left after limit.
 // If offsetID is provided, the list will be sliced starting from the comment with this ID.
 // If offsetID is not found, the full list will be returned.
@@ -1,8 +1,11 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image/png"
 	"io"
@@ -25,6 +28,7 @@ import (
 	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/store/image"
 	"github.com/umputun/remark42/backend/app/store/service"
+	"github.com/umputun/remark42/backend/app/stream"
 )
 
 func TestRest_Ping(t *testing.T) {
@@ -442,6 +446,179 @@ func TestRest_Last(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, code)
 }
 
+func TestRest_Search(t *testing.T) {
+	ts, srv, teardown := startupT(t)
+	defer teardown()
+
+	res, code := get(t, ts.URL+"/api/v1/search?site=remark42&q=test")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", res, "empty search should return empty list")
+
+	_, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=+")
+	assert.Equal(t, http.StatusBadRequest, code, "empty query rejected")
+
+	c1 := store.Comment{Text: `test #1, <a href="https://example.com/page">link</a>`,
+		Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah1"}}
+	c2 := store.Comment{Text: "test #2, another", Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah2"}}
+	// push the clock past a millisecond boundary between comments to make the time order stable
+	id1 := addComment(t, c1, ts)
+	waitPastMillisecond(time.Now())
+	id2 := addComment(t, c2, ts)
+	waitPastMillisecond(time.Now())
+	id3 := addComment(t, c2, ts)
+
+	res, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=test")
+	assert.Equal(t, http.StatusOK, code)
+	comments := []store.Comment{}
+	require.NoError(t, json.Unmarshal([]byte(res), &comments))
+	require.Equal(t, 3, len(comments), "should have 3 comments")
+	assert.Equal(t, id3, comments[0].ID, "newest first")
+
+	res, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=example.com/page")
+	assert.Equal(t, http.StatusOK, code)
+	comments = []store.Comment{}
+	require.NoError(t, json.Unmarshal([]byte(res), &comments))
+	require.Equal(t, 1, len(comments), "found by link")
+	assert.Equal(t, id1, comments[0].ID)
+
+	res, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=anoth&limit=1&skip=1")
+	assert.Equal(t, http.StatusOK, code)
+	comments = []store.Comment{}
+	require.NoError(t, json.Unmarshal([]byte(res), &comments))
+	require.Equal(t, 1, len(comments))
+	assert.Equal(t, id2, comments[0].ID)
+
+	// deleted comments excluded
+	err := srv.DataService.Delete(store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah2"}, id3, store.SoftDelete)
+	assert.NoError(t, err)
+	srv.Cache.Flush(cache.FlusherRequest{})
+	res, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=test")
+	assert.Equal(t, http.StatusOK, code)
+	comments = []store.Comment{}
+	require.NoError(t, json.Unmarshal([]byte(res), &comments))
+	assert.Equal(t, 2, len(comments), "should have 2 comments")
+
+	// comments of blocked users excluded
+	require.NoError(t, srv.DataService.SetBlock("remark42", "provider1_dev", true, 0))
+	srv.Cache.Flush(cache.FlusherRequest{})
+	res, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=test")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "[]\n", res)
+
+	_, code = get(t, ts.URL+"/api/v1/search?site=remark42-BLAH&q=test")
+	assert.Equal(t, http.StatusInternalServerError, code)
+
+	_, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=test&limit=-1")
+	assert.Equal(t, http.StatusBadRequest, code, "negative limit rejected")
+	_, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=test&skip=-10")
+	assert.Equal(t, http.StatusBadRequest, code, "negative skip rejected")
+	_, code = get(t, ts.URL+"/api/v1/search?site=remark42&q=test&limit=1000000")
+	assert.Equal(t, http.StatusOK, code, "limit capped")
+}
+
+func Test_limitSkip(t *testing.T) {
+	tbl := []struct {
+		query       string
+		limit, skip int
+		err         string
+	}{
+		{"", 0, 0, ""},
+		{"limit=10&skip=20", 10, 20, ""},
+		{"limit=1000", maxPageLimit, 0, ""},
+		{"limit=-1", 0, 0, `invalid limit parameter "-1"`},
+		{"skip=-1", 0, 0, `invalid skip parameter "-1"`},
+		{"limit=abc", 0, 0, `invalid limit parameter "abc"`},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r, err := http.NewRequest("GET", "http://example.com/search?"+tt.query, http.NoBody)
+			require.NoError(t, err)
+			limit, skip, err := limitSkip(r)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.limit, limit)
+			assert.Equal(t, tt.skip, skip)
+		})
+	}
+}
+
+func TestRest_Stream(t *testing.T) {
+	hub, err := stream.NewHub(nil, 1)
+	require.NoError(t, err)
+	ts, _, teardown := startupT(t, func(srv *Rest) {
+		srv.StreamHub = hub
+		srv.DataService.EventPublisher = hub
+	})
+	defer teardown()
+	defer hub.Close() // runs before teardown, closes active streams
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		ts.URL+"/api/v1/stream?site=remark42&url=https://radio-t.com/blah1", http.NoBody)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// second subscriber rejected, hub allows one only
+	_, code := get(t, ts.URL+"/api/v1/stream?site=remark42")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	addComment(t, store.Comment{Text: "other post", Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah2"}}, ts)
+	id := addComment(t, store.Comment{Text: "test 123", Locator: store.Locator{SiteID: "remark42", URL: "https://radio-t.com/blah1"}}, ts)
+
+	rd := bufio.NewReader(resp.Body)
+	readEvent := func() (name string, c store.Comment) {
+		for {
+			line, e := rd.ReadString('\n')
+			require.NoError(t, e)
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &c))
+			case line == "" && name != "":
+				return name, c
+			}
+		}
+	}
+
+	name, c := readEvent()
+	assert.Equal(t, "create", name, "event for other post not sent")
+	assert.Equal(t, id, c.ID)
+	assert.Equal(t, "<p>test 123</p>\n", c.Text)
+	assert.Equal(t, "provider1_dev", c.User.ID)
+
+	voteReq, err := http.NewRequest(http.MethodPut,
+		fmt.Sprintf("%s/api/v1/vote/%s?site=remark42&url=https://radio-t.com/blah1&vote=1", ts.URL, id), http.NoBody)
+	require.NoError(t, err)
+	voteResp, err := sendReq(voteReq, dev2Token)
+	require.NoError(t, err)
+	require.NoError(t, voteResp.Body.Close())
+	require.Equal(t, http.StatusOK, voteResp.StatusCode)
+
+	name, c = readEvent()
+	assert.Equal(t, "vote", name)
+	assert.Equal(t, id, c.ID)
+	assert.Equal(t, 1, c.Score)
+}
+
+func TestRest_StreamDisabled(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	_, code := get(t, ts.URL+"/api/v1/stream?site=remark42")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
 func TestRest_FindUserComments(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
@@ -1013,7 +1190,7 @@ func TestRest_Info(t *testing.T) {
 	ts, srv, teardown := startupT(t)
 	defer teardown()
 
-	srv.pubRest.readOnlyAge = 10000000 // make sure we don't hit read-only
+	srv.ReadOnlyAge = 10000000 // make sure we don't hit read-only
 
 	user := store.User{ID: "user1", Name: "user name 1"}
 	c1 := store.Comment{User: user, Text: "test test #1", Locator: store.Locator{SiteID: "remark42",
@@ -1213,6 +1390,44 @@ func TestRest_LoadPictureDefenseHeaders(t *testing.T) {
 	assert.Equal(t, http.StatusNotModified, resp3.StatusCode, "exact etag must round-trip as 304")
 }
 
+func TestRest_LoadPictureVariant(t *testing.T) {
+	pic, err := io.ReadAll(gopherPNG())
+	require.NoError(t, err)
+	imageStore := image.StoreMock{LoadFunc: func(id string) ([]byte, error) {
+		if id == "dev_user/pic" || id == "dev_user/pic.w320" {
+			return pic, nil
+		}
+		return nil, errors.New("not found")
+	}}
+	p := &public{imageService: image.NewService(&imageStore, image.ServiceParams{Variants: []int{320, 640}})}
+
+	router := routegroup.New(http.NewServeMux())
+	router.HandleFunc("GET /api/v1/picture/{user}/{id}", p.loadPictureCtrl)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	tbl := []struct {
+		query  string
+		loaded string
+	}{
+		{"", "dev_user/pic"},
+		{"?w=100", "dev_user/pic.w320"},
+		{"?w=320", "dev_user/pic.w320"},
+		{"?w=500", "dev_user/pic"}, // 640 variant missing
+		{"?w=2000", "dev_user/pic"},
+		{"?w=bad", "dev_user/pic"},
+		{"?w=-1", "dev_user/pic"},
+	}
+	for _, tt := range tbl {
+		resp, err := http.Get(ts.URL + "/api/v1/picture/dev_user/pic" + tt.query)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode, tt.query)
+		assert.Equal(t, `"`+tt.loaded+`"`, resp.Header.Get("Etag"), tt.query)
+		assert.Equal(t, tt.loaded, imageStore.LoadCalls()[len(imageStore.LoadCalls())-1].ID, tt.query)
+	}
+}
+
 // TestRest_LoadPictureRejectsNonImage proves the /picture/ handler rejects bytes that
 // don't sniff as a real image — even when retrieved successfully from the image store.
 // Uses a StoreMock so we can return arbitrary attacker bytes for a valid-looking id.
@@ -365,6 +365,43 @@ func TestRest_AvatarMounts(t *testing.T) {
 	}
 }
 
+func TestRest_Metrics(t *testing.T) {
+	ts, _, teardown := startupT(t, func(srv *Rest) { srv.MetricsPasswd = "secret" })
+	defer teardown()
+
+	_, code := get(t, ts.URL+"/api/v1/config?site=remark42")
+	assert.Equal(t, http.StatusOK, code)
+	_, code = get(t, ts.URL+"/api/v1/admin/blocked?site=remark42")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	_, code = get(t, ts.URL+"/metrics")
+	assert.Equal(t, http.StatusUnauthorized, code, "metrics require basic auth")
+
+	req, err := http.NewRequest("GET", ts.URL+"/metrics", http.NoBody)
+	require.NoError(t, err)
+	req.SetBasicAuth("metrics", "secret")
+	resp, err := sendReq(req, "")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	body := string(b)
+	assert.Contains(t, body, "# TYPE remark42_http_requests_total counter")
+	assert.Contains(t, body, `remark42_http_requests_total{group="public",status="200"}`)
+	assert.Contains(t, body, `remark42_http_requests_total{group="admin",status="401"}`)
+	assert.Contains(t, body, `remark42_http_request_duration_seconds_count{group="public"}`)
+	assert.Contains(t, body, "# TYPE remark42_bolt_tx_duration_seconds histogram")
+}
+
+func TestRest_MetricsDisabled(t *testing.T) {
+	ts, _, teardown := startupT(t)
+	defer teardown()
+
+	_, code := get(t, ts.URL+"/metrics")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
 func TestRest_Shutdown(t *testing.T) {
 	srv := Rest{Authenticator: &auth.Service{}, ImageProxy: &proxy.Image{}}
 	port := chooseUnusedPort(t)
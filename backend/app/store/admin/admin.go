@@ -31,6 +31,21 @@ const (
 	EvVote
 )
 
+// String returns event name, i.e. "create"
+func (e EventType) String() string {
+	switch e {
+	case EvCreate:
+		return "create"
+	case EvDelete:
+		return "delete"
+	case EvUpdate:
+		return "update"
+	case EvVote:
+		return "vote"
+	}
+	return fmt.Sprintf("event-%d", int(e))
+}
+
 // StaticStore implements keys.Store with a single set of admins and email for all sites
 type StaticStore struct {
 	admins []string
@@ -44,3 +44,11 @@ func TestStaticStore_Get(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, false, enabled)
 }
+
+func TestEventType_String(t *testing.T) {
+	assert.Equal(t, "create", EvCreate.String())
+	assert.Equal(t, "delete", EvDelete.String())
+	assert.Equal(t, "update", EvUpdate.String())
+	assert.Equal(t, "vote", EvVote.String())
+	assert.Equal(t, "event-42", EventType(42).String())
+}
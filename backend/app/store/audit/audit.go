@@ -0,0 +1,289 @@
+// Package audit implements log of moderation actions, like comment deletion or user blocking.
+// Each record keeps who made the action, when, on what target and the state of the target before and after.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/google/uuid"
+)
+
+// Action is a type of moderation action
+type Action string
+
+// enum of all moderation actions
+const (
+	ActionDeleteComment Action = "delete_comment"
+	ActionDeleteUser    Action = "delete_user"
+	ActionBlock         Action = "block"
+	ActionVerify        Action = "verify"
+	ActionPin           Action = "pin"
+	ActionReadOnly      Action = "readonly"
+	ActionTitle         Action = "title"
+	ActionApprove       Action = "approve"
+	ActionReports       Action = "reports"
+	ActionSettings      Action = "settings"
+	ActionImport        Action = "import"
+	ActionRemap         Action = "remap"
+	ActionExport        Action = "export"
+	ActionBanImage      Action = "ban_image"
+	ActionDeleteImage   Action = "delete_image"
+)
+
+// Record is a single moderation action. Before and After are json snapshots of the target, empty if not applicable
+type Record struct {
+	ID        string          `json:"id"`
+	SiteID    string          `json:"site"`
+	Timestamp time.Time       `json:"time"`
+	Action    Action          `json:"action"`
+	Actor     Actor           `json:"actor"`
+	Target    string          `json:"target"`        // comment id, user id, post url, image id or migration provider
+	URL       string          `json:"url,omitempty"` // post url for comment's actions
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+}
+
+// Actor is the user made the action
+type Actor struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// FindRequest is a filter for Find, all fields are optional except SiteID
+type FindRequest struct {
+	SiteID string
+	Since  time.Time // records made at this time or later
+	Actor  string    // actor's id
+	Limit  int       // max number of records, the most recent ones, 0 means no limit
+}
+
+// Store appends audit records to a json-lines file and scans it on Find, so records are not kept in memory.
+// Without path records are kept in memory only. Records are never changed or removed. Thread safe.
+type Store struct {
+	path string
+
+	lock    sync.RWMutex
+	records []Record // used without path only
+}
+
+// NewStore makes Store for path. Existing file is checked on open: malformed records skipped with a warning,
+// and the last one, torn by a crash in the middle of writing, truncated, so next records are appended after
+// the last complete one
+func NewStore(path string) (*Store, error) {
+	res := &Store{path: path}
+	if path == "" {
+		return res, nil
+	}
+
+	fh, err := os.OpenFile(path, os.O_RDWR, 0o600) //nolint:gosec // path comes from operator CLI flag
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open audit log %s: %w", path, err)
+	}
+	defer fh.Close() //nolint:errcheck // closed after truncate, if any
+
+	count, offset, torn := 0, int64(0), false
+	rd := bufio.NewReader(fh)
+	for line := 1; ; line++ {
+		data, readErr := rd.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return nil, fmt.Errorf("can't read audit log %s: %w", path, readErr)
+		}
+		complete := readErr == nil
+		if len(bytes.TrimSpace(data)) > 0 {
+			rec := Record{}
+			switch err = json.Unmarshal(data, &rec); {
+			case err != nil && !complete:
+				torn = true
+				log.Printf("[WARN] truncate torn audit record at %s:%d, %v", path, line, err)
+			case err != nil:
+				log.Printf("[WARN] skip malformed audit record at %s:%d, %v", path, line, err)
+			default:
+				count++
+			}
+		}
+		if !complete {
+			if !torn && len(data) > 0 { // complete record without line end, terminate it for next appends
+				if _, err = fh.WriteAt([]byte("\n"), offset+int64(len(data))); err != nil {
+					return nil, fmt.Errorf("can't terminate last audit record of %s: %w", path, err)
+				}
+			}
+			break
+		}
+		offset += int64(len(data))
+	}
+	if torn {
+		if err = fh.Truncate(offset); err != nil {
+			return nil, fmt.Errorf("can't truncate torn audit record of %s: %w", path, err)
+		}
+	}
+	log.Printf("[INFO] audit log %s has %d records", path, count)
+	return res, nil
+}
+
+// Add appends the record to the log. ID and Timestamp set if missing
+func (s *Store) Add(rec Record) error {
+	if rec.SiteID == "" {
+		return errors.New("missing site id")
+	}
+	newID := rec.ID == ""
+	if newID {
+		rec.ID = uuid.New().String()
+	}
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !newID {
+		ids, err := s.ids()
+		if err != nil {
+			return err
+		}
+		if ids[rec.ID] {
+			return fmt.Errorf("duplicate audit record %s", rec.ID)
+		}
+	}
+	return s.append(rec)
+}
+
+// Find returns records of the site matched the request, the most recent first
+func (s *Store) Find(req FindRequest) ([]Record, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	res := []Record{}
+	err := s.scan(func(rec Record) {
+		if rec.SiteID != req.SiteID || rec.Timestamp.Before(req.Since) {
+			return
+		}
+		if req.Actor != "" && rec.Actor.ID != req.Actor {
+			return
+		}
+		res = append(res, rec)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// records added in order, but imported ones may be older than existing
+	slices.SortStableFunc(res, func(a, b Record) int { return b.Timestamp.Compare(a.Timestamp) })
+	if req.Limit > 0 && len(res) > req.Limit {
+		res = res[:req.Limit]
+	}
+	return res, nil
+}
+
+// Import adds records, i.e. from backup, to the site. Records already in the log skipped,
+// so the same backup can be imported many times
+func (s *Store) Import(siteID string, records []Record) (size int, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ids, err := s.ids()
+	if err != nil {
+		return 0, err
+	}
+	added := []Record{}
+	for _, rec := range records {
+		if rec.ID == "" || ids[rec.ID] {
+			continue
+		}
+		rec.SiteID = siteID
+		added, ids[rec.ID] = append(added, rec), true
+	}
+	if err = s.append(added...); err != nil {
+		return 0, err
+	}
+	return len(added), nil
+}
+
+// scan calls fn for each record of the log, in order of addition. Malformed records skipped,
+// they are reported on open. Should be called under lock
+func (s *Store) scan(fn func(rec Record)) error {
+	if s.path == "" {
+		for _, rec := range s.records {
+			fn(rec)
+		}
+		return nil
+	}
+
+	fh, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't open audit log %s: %w", s.path, err)
+	}
+	defer fh.Close() //nolint:errcheck // read-only file
+
+	rd := bufio.NewReader(fh)
+	for {
+		data, readErr := rd.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("can't read audit log %s: %w", s.path, readErr)
+		}
+		rec := Record{}
+		if len(bytes.TrimSpace(data)) > 0 && json.Unmarshal(data, &rec) == nil {
+			fn(rec)
+		}
+		if readErr != nil {
+			return nil
+		}
+	}
+}
+
+// ids returns set of ids of all records in the log, should be called under lock
+func (s *Store) ids() (map[string]bool, error) {
+	res := map[string]bool{}
+	err := s.scan(func(rec Record) { res[rec.ID] = true })
+	return res, err
+}
+
+// append writes records to the file, or adds them to memory without path, should be called under lock
+func (s *Store) append(records ...Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if s.path == "" {
+		s.records = append(s.records, records...)
+		return nil
+	}
+
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			return fmt.Errorf("can't marshal audit record %s: %w", rec.ID, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("can't make audit log location: %w", err)
+	}
+	fh, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600) //nolint:gosec // path comes from operator CLI flag
+	if err != nil {
+		return fmt.Errorf("can't open audit log %s: %w", s.path, err)
+	}
+	if _, err = fh.Write(buf.Bytes()); err != nil {
+		_ = fh.Close()
+		return fmt.Errorf("can't write audit log %s: %w", s.path, err)
+	}
+	if err = fh.Close(); err != nil {
+		return fmt.Errorf("can't close audit log %s: %w", s.path, err)
+	}
+	return nil
+}
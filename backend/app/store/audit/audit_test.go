@@ -0,0 +1,150 @@
+package audit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_AddFind(t *testing.T) {
+	s, err := NewStore("")
+	require.NoError(t, err)
+
+	ts := time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, s.Add(Record{SiteID: "site1", Timestamp: ts, Action: ActionDeleteComment,
+		Actor: Actor{ID: "admin1", Name: "Admin One"}, Target: "c1", URL: "https://example.com/p1",
+		Before: json.RawMessage(`{"text":"bad"}`)}))
+	require.NoError(t, s.Add(Record{SiteID: "site1", Timestamp: ts.Add(time.Minute), Action: ActionBlock,
+		Actor: Actor{ID: "admin2", Name: "Admin Two"}, Target: "user1"}))
+	require.NoError(t, s.Add(Record{SiteID: "site2", Timestamp: ts.Add(2 * time.Minute), Action: ActionVerify,
+		Actor: Actor{ID: "admin1", Name: "Admin One"}, Target: "user1"}))
+	require.NoError(t, s.Add(Record{SiteID: "site1", Action: ActionPin, Actor: Actor{ID: "admin1"}, Target: "c2"}))
+	assert.EqualError(t, s.Add(Record{Action: ActionPin}), "missing site id")
+
+	recs, err := s.Find(FindRequest{SiteID: "site1"})
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	assert.Equal(t, ActionPin, recs[0].Action, "most recent first")
+	assert.NotEmpty(t, recs[0].ID, "id set")
+	assert.WithinDuration(t, time.Now(), recs[0].Timestamp, time.Second, "timestamp set")
+	assert.Equal(t, ActionBlock, recs[1].Action)
+	assert.Equal(t, ActionDeleteComment, recs[2].Action)
+	assert.JSONEq(t, `{"text":"bad"}`, string(recs[2].Before))
+
+	recs, err = s.Find(FindRequest{SiteID: "site1", Actor: "admin1"})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "c2", recs[0].Target)
+	assert.Equal(t, "c1", recs[1].Target)
+
+	recs, err = s.Find(FindRequest{SiteID: "site1", Since: ts.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "c2", recs[0].Target)
+	assert.Equal(t, "user1", recs[1].Target)
+
+	recs, err = s.Find(FindRequest{SiteID: "site1", Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, "c2", recs[0].Target)
+	assert.ErrorContains(t, s.Add(Record{ID: recs[0].ID, SiteID: "site1"}), "duplicate audit record")
+
+	recs, err = s.Find(FindRequest{SiteID: "bad"})
+	require.NoError(t, err)
+	assert.Empty(t, recs)
+}
+
+func TestStore_Import(t *testing.T) {
+	s, err := NewStore("")
+	require.NoError(t, err)
+	ts := time.Date(2026, 5, 1, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, s.Add(Record{ID: "id1", SiteID: "site1", Timestamp: ts, Action: ActionBlock}))
+
+	size, err := s.Import("site2", []Record{
+		{ID: "id1", SiteID: "site1", Timestamp: ts, Action: ActionBlock}, // already in the log
+		{ID: "id2", SiteID: "site1", Timestamp: ts.Add(-time.Hour), Action: ActionPin},
+		{ID: "id2", SiteID: "site1", Timestamp: ts.Add(-time.Hour), Action: ActionPin}, // duplicate
+		{SiteID: "site1", Action: ActionVerify},                                        // no id
+		{ID: "id3", SiteID: "site1", Timestamp: ts.Add(time.Hour), Action: ActionTitle},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	recs, err := s.Find(FindRequest{SiteID: "site2"})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, "id3", recs[0].ID)
+	assert.Equal(t, "site2", recs[0].SiteID, "site changed to imported one")
+	assert.Equal(t, "id2", recs[1].ID)
+
+	size, err = s.Import("site2", recs)
+	require.NoError(t, err)
+	assert.Equal(t, 0, size, "repeated import skipped")
+}
+
+func TestStore_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "var", "audit.log")
+	s, err := NewStore(file)
+	require.NoError(t, err)
+	require.NoError(t, s.Add(Record{SiteID: "site1", Action: ActionDeleteUser, Actor: Actor{ID: "admin1"}, Target: "user1",
+		Before: json.RawMessage(`{"blocked":false,"shadow":false,"verified":false,"comments":5}`)}))
+	require.NoError(t, s.Add(Record{SiteID: "site1", Action: ActionReadOnly, Target: "https://example.com/p1"}))
+	size, err := s.Import("site2", []Record{{ID: "id1", Action: ActionExport, Timestamp: time.Now().Add(-time.Hour)}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, size)
+
+	s, err = NewStore(file)
+	require.NoError(t, err)
+	recs, err := s.Find(FindRequest{SiteID: "site1"})
+	require.NoError(t, err)
+	require.Len(t, recs, 2)
+	assert.Equal(t, ActionReadOnly, recs[0].Action)
+	assert.Equal(t, ActionDeleteUser, recs[1].Action)
+	assert.JSONEq(t, `{"blocked":false,"shadow":false,"verified":false,"comments":5}`, string(recs[1].Before))
+	recs, err = s.Find(FindRequest{SiteID: "site2"})
+	require.NoError(t, err)
+	require.Len(t, recs, 1)
+	assert.Equal(t, "id1", recs[0].ID)
+
+	// records appended to existing file
+	require.NoError(t, s.Add(Record{SiteID: "site1", Action: ActionPin}))
+	s, err = NewStore(file)
+	require.NoError(t, err)
+	recs, err = s.Find(FindRequest{SiteID: "site1"})
+	require.NoError(t, err)
+	assert.Len(t, recs, 3)
+
+}
+
+func TestStore_Malformed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+
+	// malformed record in the middle skipped, torn last record truncated
+	require.NoError(t, os.WriteFile(file, []byte("{\"id\":\"id1\",\"site\":\"site1\"}\n\nbad json\n"+
+		"{\"id\":\"id2\",\"site\":\"site1\"}\n{\"id\":\"id3\",\"si"), 0o600))
+	s, err := NewStore(file)
+	require.NoError(t, err)
+	require.NoError(t, s.Add(Record{ID: "id4", SiteID: "site1"}))
+	recs, err := s.Find(FindRequest{SiteID: "site1"})
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+	assert.Equal(t, []string{"id4", "id1", "id2"}, []string{recs[0].ID, recs[1].ID, recs[2].ID}, "most recent first")
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "id3")
+
+	// complete last record without line end kept and terminated
+	require.NoError(t, os.WriteFile(file, []byte("{\"id\":\"id1\",\"site\":\"site1\"}"), 0o600))
+	s, err = NewStore(file)
+	require.NoError(t, err)
+	require.NoError(t, s.Add(Record{ID: "id2", SiteID: "site1"}))
+	recs, err = s.Find(FindRequest{SiteID: "site1"})
+	require.NoError(t, err)
+	assert.Len(t, recs, 2)
+	assert.ErrorContains(t, s.Add(Record{ID: "id1", SiteID: "site1"}), "duplicate audit record")
+}
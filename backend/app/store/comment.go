@@ -22,12 +22,16 @@ type Comment struct {
 	Score       int                    `json:"score"`
 	Votes       map[string]bool        `json:"votes,omitempty"`
 	VotedIPs    map[string]VotedIPInfo `json:"voted_ips,omitempty"` // voted ips (hashes) with TS
+	Reports     map[string]Report      `json:"reports,omitempty"`   // user reports by reporter's id, visible to admins only
 	Vote        int                    `json:"vote"`                // vote for the current user, -1/1/0.
 	Controversy float64                `json:"controversy,omitempty"`
 	Timestamp   time.Time              `json:"time" bson:"time"`
 	Edit        *Edit                  `json:"edit,omitempty" bson:"edit,omitempty"` // pointer to have empty default in json response
 	Pin         bool                   `json:"pin,omitempty" bson:"pin,omitempty"`
 	Deleted     bool                   `json:"delete,omitempty" bson:"delete"`
+	Pending     bool                   `json:"pending,omitempty" bson:"pending"` // awaiting approval, visible to author and admins only
+	Hidden      bool                   `json:"hidden,omitempty" bson:"hidden"`   // pending because of user reports, flag shown to admins only
+	Spam        bool                   `json:"spam,omitempty" bson:"spam"`       // classified as spam, visible to admins only
 	Imported    bool                   `json:"imported,omitempty" bson:"imported"`
 	PostTitle   string                 `json:"title,omitempty" bson:"title"`
 }
@@ -68,6 +72,29 @@ type VotedIPInfo struct {
 	Value     bool
 }
 
+// Report is a user's complaint about the comment
+type Report struct {
+	Reason    ReportReason `json:"reason"`
+	Note      string       `json:"note,omitempty"`
+	Timestamp time.Time    `json:"time"`
+}
+
+// ReportReason defines category of the report
+type ReportReason string
+
+// ReportReason enum
+const (
+	ReportSpam     ReportReason = "spam"
+	ReportAbuse    ReportReason = "abuse"
+	ReportOffTopic ReportReason = "off-topic"
+	ReportOther    ReportReason = "other"
+)
+
+// Valid checks if reason is one of known categories
+func (r ReportReason) Valid() bool {
+	return slices.Contains([]ReportReason{ReportSpam, ReportAbuse, ReportOffTopic, ReportOther}, r)
+}
+
 // DeleteMode defines how much comment info will be erased
 type DeleteMode int
 
@@ -88,11 +115,15 @@ func (c *Comment) PrepareUntrusted() {
 	c.Timestamp = time.Time{} // reset time, force auto-gen
 	c.Votes = make(map[string]bool)
 	c.VotedIPs = make(map[string]VotedIPInfo)
+	c.Reports = nil
 	c.Score = 0
 	c.Controversy = 0
 	c.Edit = nil
 	c.Pin = false
 	c.Deleted = false
+	c.Pending = false
+	c.Hidden = false
+	c.Spam = false
 	c.Imported = false
 }
 
@@ -104,6 +135,7 @@ func (c *Comment) SetDeleted(mode DeleteMode) {
 	c.Controversy = 0
 	c.Votes = map[string]bool{}
 	c.VotedIPs = make(map[string]VotedIPInfo)
+	c.Reports = nil // deleted comment has nothing left to review
 	c.Edit = nil
 	c.Deleted = true
 	c.Pin = false
@@ -116,6 +148,9 @@ func (c *Comment) SetDeleted(mode DeleteMode) {
 	}
 }
 
+// srcsetRegex matches srcset attribute with http(s) image URLs and width descriptors only
+var srcsetRegex = regexp.MustCompile(`^https?://[^\s,"'<>]+ \d+w(, https?://[^\s,"'<>]+ \d+w)*$`)
+
 // Sanitize clean dangerous html/js from the comment.
 // Comment.Orig which is used to store the original comment text is not sanitized
 // as we expect to never render it as HTML and render Comment.Text instead
@@ -132,6 +167,8 @@ func (c *Comment) Sanitize() {
 		"|mo|o|ow|p|c|ch|cm|cp|cpf|c1|cs|g|gd|ge|gr|gh|gi|go|gp|gs|gu|gt|gl)$"
 	p.AllowAttrs("class").Matching(regexp.MustCompile(codeSpanClassRegex)).OnElements("span")
 	p.AllowAttrs("loading").Matching(regexp.MustCompile("^(lazy|eager)$")).OnElements("img")
+	// srcset of responsive image variants added by CommentFormatter, bluemonday doesn't check URLs in it
+	p.AllowAttrs("srcset").Matching(srcsetRegex).OnElements("img")
 	c.Text = p.Sanitize(c.Text)
 	c.User.ID = template.HTMLEscapeString(c.User.ID)
 	c.User.Name = c.SanitizeText(c.User.Name)
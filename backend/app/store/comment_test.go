@@ -39,6 +39,12 @@ func TestComment_Sanitize(t *testing.T) {
 			inp: Comment{Text: "blah `123`"},
 			out: Comment{Text: "blah `123`"},
 		},
+		{
+			inp: Comment{Text: `<img src="https://r.example.com/pic" srcset="https://r.example.com/pic?w=320 320w, https://r.example.com/pic 2400w"/>` +
+				`<img src="https://r.example.com/pic" srcset="javascript:alert(1) 320w"/>`},
+			out: Comment{Text: `<img src="https://r.example.com/pic" srcset="https://r.example.com/pic?w=320 320w, https://r.example.com/pic 2400w"/>` +
+				`<img src="https://r.example.com/pic"/>`},
+		},
 		{
 			inp: Comment{Text: "blah & & 123 &mdash; &mdash;"},
 			out: Comment{Text: `blah &amp; &amp; 123 — —`},
@@ -120,8 +126,11 @@ func TestComment_PrepareUntrusted(t *testing.T) {
 		Score:       10,
 		Pin:         true,
 		Deleted:     true,
+		Pending:     true,
+		Spam:        true,
 		Timestamp:   time.Date(2018, 1, 1, 9, 30, 0, 0, time.UTC),
 		Votes:       map[string]bool{"uu": true},
+		Reports:     map[string]Report{"uu": {Reason: ReportSpam}},
 		Controversy: 123,
 		Imported:    true,
 	}
@@ -134,8 +143,11 @@ func TestComment_PrepareUntrusted(t *testing.T) {
 	assert.Equal(t, false, comment.Pin)
 	assert.Equal(t, time.Time{}, comment.Timestamp)
 	assert.Equal(t, false, comment.Deleted)
+	assert.Equal(t, false, comment.Pending)
+	assert.Equal(t, false, comment.Spam)
 	assert.Equal(t, make(map[string]bool), comment.Votes)
 	assert.Equal(t, make(map[string]VotedIPInfo), comment.VotedIPs)
+	assert.Nil(t, comment.Reports)
 	assert.Equal(t, User{ID: "username"}, comment.User)
 	assert.Equal(t, 0., comment.Controversy)
 	assert.Equal(t, false, comment.Imported)
@@ -152,6 +164,7 @@ func TestComment_SetDeleted(t *testing.T) {
 		Deleted:   false,
 		Timestamp: time.Date(2018, 1, 1, 9, 30, 0, 0, time.UTC),
 		Votes:     map[string]bool{"uu": true},
+		Reports:   map[string]Report{"uu": {Reason: ReportAbuse}},
 		Pin:       true,
 	}
 
@@ -160,6 +173,7 @@ func TestComment_SetDeleted(t *testing.T) {
 	assert.Equal(t, "", comment.Text)
 	assert.Equal(t, "", comment.Orig)
 	assert.Equal(t, map[string]bool{}, comment.Votes)
+	assert.Nil(t, comment.Reports)
 	assert.Equal(t, map[string]VotedIPInfo{}, comment.VotedIPs)
 	assert.Equal(t, 0, comment.Score)
 	assert.True(t, comment.Deleted)
@@ -168,6 +182,14 @@ func TestComment_SetDeleted(t *testing.T) {
 	assert.Equal(t, User{Name: "username", ID: "userid", Picture: "pic", Admin: false, Blocked: false, IP: "123"}, comment.User)
 }
 
+func TestComment_ReportReasonValid(t *testing.T) {
+	for _, r := range []ReportReason{ReportSpam, ReportAbuse, ReportOffTopic, ReportOther} {
+		assert.True(t, r.Valid(), r)
+	}
+	assert.False(t, ReportReason("").Valid())
+	assert.False(t, ReportReason("bad").Valid())
+}
+
 func TestComment_SetDeletedHard(t *testing.T) {
 	comment := Comment{
 		Text:      `blah`,
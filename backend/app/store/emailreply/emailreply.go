@@ -0,0 +1,159 @@
+// Package emailreply implements store of tokens of reply addresses of email notifications.
+// Each token identifies the user the notification sent to and the comment the reply to the email answers.
+package emailreply
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Target of the reply by email, the post and the comment user replies to
+type Target struct {
+	SiteID   string    `json:"site"`
+	URL      string    `json:"url"`
+	ParentID string    `json:"parent_id"`
+	UserID   string    `json:"user_id"`
+	Created  time.Time `json:"created"`
+}
+
+// ErrNotFound returned by Get for unknown or expired token
+var ErrNotFound = errors.New("reply token not found")
+
+// Store keeps reply targets in bolt file, by random token. Thread safe.
+// Tokens older than TTL are not returned and removed on the store opening, on Get and by Cleanup.
+type Store struct {
+	db  *bolt.DB
+	ttl time.Duration
+}
+
+const (
+	bucketName = "reply_tokens"
+	defaultTTL = 30 * 24 * time.Hour
+)
+
+// NewStore makes reply tokens store in bolt file, with tokens valid for ttl, 30 days if not set
+func NewStore(fileName string, ttl time.Duration, options bolt.Options) (*Store, error) {
+	db, err := bolt.Open(fileName, 0o600, &options) //nolint:gocritic //octalLiteral is OK as FileMode
+	if err != nil {
+		return nil, fmt.Errorf("failed to make boltdb for %s: %w", fileName, err)
+	}
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	res := &Store{db: db, ttl: ttl}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bkt, e := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if e != nil {
+			return fmt.Errorf("failed to create top level bucket %s: %w", bucketName, e)
+		}
+		return res.removeExpired(bkt)
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize boltdb db %q buckets: %w", fileName, err)
+	}
+	return res, nil
+}
+
+// Add stores the target and returns new token for it, lowercase hex string
+func (s *Store) Add(t Target) (string, error) {
+	if t.SiteID == "" || t.URL == "" || t.ParentID == "" || t.UserID == "" {
+		return "", errors.New("site, url, parent and user id are required")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("can't get random: %w", err)
+	}
+	token := hex.EncodeToString(b)
+	t.Created = time.Now()
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("can't marshal reply target %s: %w", t.ParentID, err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketName)).Put([]byte(token), data)
+	})
+	if err != nil {
+		return "", fmt.Errorf("can't put reply token: %w", err)
+	}
+	return token, nil
+}
+
+// Get returns target of the token, ErrNotFound if there is no such token or it's expired.
+// Expired token is deleted. Token is case-insensitive, as mail servers may change the case of the address.
+func (s *Store) Get(token string) (res Target, err error) {
+	key := []byte(strings.ToLower(token))
+	expired := false
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(bucketName)).Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		if e := json.Unmarshal(v, &res); e != nil {
+			return fmt.Errorf("can't unmarshal reply target: %w", e)
+		}
+		if time.Since(res.Created) > s.ttl {
+			expired = true
+			return ErrNotFound
+		}
+		return nil
+	})
+	if expired {
+		if e := s.db.Update(func(tx *bolt.Tx) error { return tx.Bucket([]byte(bucketName)).Delete(key) }); e != nil {
+			log.Printf("[WARN] can't delete expired reply token, %v", e)
+		}
+	}
+	return res, err
+}
+
+// Cleanup removes expired tokens every interval. Blocking loop, should be called inside of goroutine by consumer
+func (s *Store) Cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.db.Update(func(tx *bolt.Tx) error { return s.removeExpired(tx.Bucket([]byte(bucketName))) })
+			if err != nil {
+				log.Printf("[WARN] failed to cleanup reply tokens, %v", err)
+			}
+		}
+	}
+}
+
+// Close bolt file
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// removeExpired deletes all tokens older than ttl
+func (s *Store) removeExpired(bkt *bolt.Bucket) error {
+	var expired [][]byte
+	err := bkt.ForEach(func(k, v []byte) error {
+		var t Target
+		if err := json.Unmarshal(v, &t); err != nil || time.Since(t.Created) > s.ttl {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range expired {
+		if err = bkt.Delete(k); err != nil {
+			return fmt.Errorf("can't delete expired reply token: %w", err)
+		}
+	}
+	return nil
+}
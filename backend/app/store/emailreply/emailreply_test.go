@@ -0,0 +1,89 @@
+package emailreply
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore_AddGet(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "replies.db"), 0, bolt.Options{})
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, defaultTTL, s.ttl)
+
+	target := Target{SiteID: "site1", URL: "https://example.com/post1", ParentID: "c1", UserID: "u1"}
+	token, err := s.Add(target)
+	require.NoError(t, err)
+	assert.Len(t, token, 32)
+	token2, err := s.Add(target)
+	require.NoError(t, err)
+	assert.NotEqual(t, token, token2, "new token for each call")
+
+	res, err := s.Get(strings.ToUpper(token))
+	require.NoError(t, err)
+	assert.False(t, res.Created.IsZero())
+	res.Created = time.Time{}
+	assert.Equal(t, target, res)
+
+	_, err = s.Get("bad")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.Add(Target{SiteID: "site1", URL: "https://example.com/post1", UserID: "u1"})
+	assert.EqualError(t, err, "site, url, parent and user id are required")
+}
+
+func TestStore_Expired(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "replies.db")
+	s, err := NewStore(fileName, 50*time.Millisecond, bolt.Options{})
+	require.NoError(t, err)
+	token, err := s.Add(Target{SiteID: "site1", URL: "https://example.com/post1", ParentID: "c1", UserID: "u1"})
+	require.NoError(t, err)
+	_, err = s.Get(token)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = s.Get(token)
+	assert.ErrorIs(t, err, ErrNotFound, "expired")
+	err = s.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(bucketName)).Get([]byte(token)), "expired token removed on get")
+		return nil
+	})
+	require.NoError(t, err)
+	token, err = s.Add(Target{SiteID: "site1", URL: "https://example.com/post1", ParentID: "c1", UserID: "u1"})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, s.Close())
+
+	s, err = NewStore(fileName, 50*time.Millisecond, bolt.Options{})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(bucketName)).Get([]byte(token)), "expired token removed on opening")
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestStore_Cleanup(t *testing.T) {
+	s, err := NewStore(filepath.Join(t.TempDir(), "replies.db"), 50*time.Millisecond, bolt.Options{})
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.Add(Target{SiteID: "site1", URL: "https://example.com/post1", ParentID: "c1", UserID: "u1"})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.Cleanup(ctx, 10*time.Millisecond)
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		assert.Equal(t, 0, tx.Bucket([]byte(bucketName)).Stats().KeyN, "expired tokens removed")
+		return nil
+	})
+	require.NoError(t, err)
+}
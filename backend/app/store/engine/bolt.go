@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
 	log "github.com/go-pkgz/lgr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	bolt "go.etcd.io/bbolt"
 	berrors "go.etcd.io/bbolt/errors"
 
@@ -16,7 +19,7 @@ import (
 )
 
 // BoltDB implements store.Interface, represents multiple sites with multiplexing to different bolt dbs. Thread safe.
-// there are 6 types of top-level buckets:
+// there are 9 types of top-level buckets:
 //   - comments for post in "posts" top-level bucket. Each url (post) makes its own bucket and each k:v pair is commentID:comment
 //   - history of all comments. They all in a single "last" bucket (per site) and key is defined by ref struct as ts+commentID
 //     value is not full comment but a reference combined from post-url+commentID
@@ -24,8 +27,13 @@ import (
 //     is a nested bucket named userID with kv as ts:reference
 //   - users details in "user_details" bucket. Key is userID, value - UserDetailEntry
 //   - blocking info sits in "block" bucket. Key is userID, value - ts
+//   - shadow-banned users in "shadowed" bucket. Key is userID, value - ts
 //   - counts per post to keep number of comments. Key is post url, value - count
 //   - readonly per post to keep status of manually set RO posts. Key is post url, value - ts
+//   - full-text search index in "search" bucket. Key is word+"\x00"+reference, value is empty. Words from
+//     comment's text, links, user name and post title, prefix scan on the word gives all references
+//   - comments awaiting approval in "pending" bucket. Key is reference, same as in "last" bucket, value is empty
+//   - comments reported by users in "reports" bucket. Key is reference, value is empty
 type BoltDB struct {
 	dbs map[string]*bolt.DB
 }
@@ -40,6 +48,10 @@ const (
 	infoBucketName        = "info"
 	readonlyBucketName    = "readonly"
 	verifiedBucketName    = "verified"
+	searchBucketName      = "search"
+	pendingBucketName     = "pending"
+	reportsBucketName     = "reports"
+	shadowedBucketName    = "shadowed"
 
 	tsNano = "2006-01-02T15:04:05.000000000Z07:00"
 )
@@ -62,13 +74,18 @@ func NewBoltDB(options bolt.Options, sites ...BoltSite) (*BoltDB, error) {
 
 		// make top-level buckets
 		topBuckets := []string{postsBucketName, lastBucketName, userBucketName, userDetailsBucketName,
-			blocksBucketName, infoBucketName, readonlyBucketName, verifiedBucketName}
+			blocksBucketName, infoBucketName, readonlyBucketName, verifiedBucketName, searchBucketName, pendingBucketName,
+			reportsBucketName, shadowedBucketName}
 		err = db.Update(func(tx *bolt.Tx) error {
+			noIndex := tx.Bucket([]byte(searchBucketName)) == nil
 			for _, bktName := range topBuckets {
 				if _, e := tx.CreateBucketIfNotExists([]byte(bktName)); e != nil {
 					return fmt.Errorf("failed to create top level bucket %s: %w", bktName, e)
 				}
 			}
+			if noIndex { // db made before search index added, build it from existing comments
+				return result.buildSearchIndex(tx)
+			}
 			return nil
 		})
 
@@ -93,7 +110,7 @@ func (b *BoltDB) Create(comment store.Comment) (commentID string, err error) {
 		return "", fmt.Errorf("post %s is read-only", comment.Locator.URL)
 	}
 
-	err = bdb.Update(func(tx *bolt.Tx) (err error) {
+	err = boltUpdate(bdb, func(tx *bolt.Tx) (err error) {
 		var postBkt, lastBkt, userBkt *bolt.Bucket
 
 		if postBkt, err = b.makePostBucket(tx, comment.Locator.URL); err != nil {
@@ -127,11 +144,23 @@ func (b *BoltDB) Create(comment store.Comment) (commentID string, err error) {
 			return fmt.Errorf("failed to put user comment %s for %s: %w", comment.ID, comment.User.ID, err)
 		}
 
+		// add reference to comment awaiting approval and to reported comment, i.e. imported one
+		if comment.Pending {
+			if err = b.setIndexRef(tx, pendingBucketName, comment, true); err != nil {
+				return err
+			}
+		}
+		if len(comment.Reports) > 0 {
+			if err = b.setIndexRef(tx, reportsBucketName, comment, true); err != nil {
+				return err
+			}
+		}
+
 		// set info with the count for post url
 		if _, err = b.setInfo(tx, comment); err != nil {
 			return fmt.Errorf("failed to set info for %s: %w", comment.Locator, err)
 		}
-		return nil
+		return b.indexComment(tx, comment, true)
 	})
 
 	return comment.ID, err
@@ -144,7 +173,7 @@ func (b *BoltDB) Get(req GetRequest) (comment store.Comment, err error) {
 		return comment, err
 	}
 
-	err = bdb.View(func(tx *bolt.Tx) error {
+	err = boltView(bdb, func(tx *bolt.Tx) error {
 		bucket, e := b.getPostBucket(tx, req.Locator.URL)
 		if e != nil {
 			return e
@@ -164,8 +193,29 @@ func (b *BoltDB) Find(req FindRequest) (comments []store.Comment, err error) {
 	}
 
 	switch {
+	case req.Locator.SiteID != "" && req.Query != "": // full-text search for site, or for post if url set
+		if comments, err = b.searchComments(bdb, req.Locator, req.Query); err != nil {
+			return nil, err
+		}
+		visible := SearchFilter(req, func(flag Flag, userID string) bool {
+			return b.checkFlag(FlagRequest{Locator: store.Locator{SiteID: req.Locator.SiteID}, UserID: userID, Flag: flag})
+		})
+		comments = slices.DeleteFunc(comments, func(c store.Comment) bool { return !visible(c) })
+		return searchPage(SortComments(comments, req.Sort), req.Limit, req.Skip), nil
+	case req.Locator.SiteID != "" && req.Pending: // comments awaiting approval for site, or for post if url set
+		comments, err = b.indexedComments(bdb, pendingBucketName, req.Locator, func(c store.Comment) bool { return c.Pending })
+		if err != nil {
+			return nil, err
+		}
+		return searchPage(SortComments(comments, req.Sort), req.Limit, req.Skip), nil
+	case req.Locator.SiteID != "" && req.Reported: // reported comments for site, or for post if url set
+		comments, err = b.indexedComments(bdb, reportsBucketName, req.Locator, func(c store.Comment) bool { return len(c.Reports) > 0 })
+		if err != nil {
+			return nil, err
+		}
+		return searchPage(SortComments(comments, req.Sort), req.Limit, req.Skip), nil
 	case req.Locator.SiteID != "" && req.Locator.URL != "": // find post comments, i.e. for site and url
-		err = bdb.View(func(tx *bolt.Tx) error {
+		err = boltView(bdb, func(tx *bolt.Tx) error {
 			bucket, e := b.getPostBucket(tx, req.Locator.URL)
 			if e != nil {
 				return e
@@ -183,9 +233,9 @@ func (b *BoltDB) Find(req FindRequest) (comments []store.Comment, err error) {
 			})
 		})
 	case req.Locator.SiteID != "" && req.Locator.URL == "" && req.UserID == "": // find last comments for site
-		comments, err = b.lastComments(req.Locator.SiteID, req.Limit, req.Since)
+		comments, err = b.lastComments(req)
 	case req.Locator.SiteID != "" && req.UserID != "": // find comments for user
-		comments, err = b.userComments(req.Locator.SiteID, req.UserID, req.Limit, req.Skip)
+		comments, err = b.userComments(req)
 	}
 
 	if err != nil {
@@ -209,7 +259,7 @@ func (b *BoltDB) Flag(req FlagRequest) (val bool, err error) {
 // and all site's details listing under the same function (and not to extend interface by two separate functions).
 func (b *BoltDB) UserDetail(req UserDetailRequest) ([]UserDetailEntry, error) {
 	switch req.Detail {
-	case UserEmail, UserTelegram:
+	case UserEmail, UserTelegram, UserEmailDigest, UserMatrix, UserWebPush:
 		if req.UserID == "" {
 			return nil, fmt.Errorf("userid cannot be empty in request for single detail")
 		}
@@ -247,12 +297,27 @@ func (b *BoltDB) Update(comment store.Comment) error {
 		return err
 	}
 
-	return bdb.Update(func(tx *bolt.Tx) error {
+	return boltUpdate(bdb, func(tx *bolt.Tx) error {
 		bucket, e := b.getPostBucket(tx, comment.Locator.URL)
 		if e != nil {
 			return e
 		}
-		return b.save(bucket, comment.ID, comment)
+		oldComment := store.Comment{}
+		if e = b.load(bucket, comment.ID, &oldComment); e == nil {
+			if e = b.indexComment(tx, oldComment, false); e != nil {
+				return e
+			}
+			if e = b.updatePending(tx, oldComment, comment); e != nil {
+				return e
+			}
+		}
+		if e = b.setIndexRef(tx, reportsBucketName, comment, len(comment.Reports) > 0); e != nil {
+			return e
+		}
+		if e = b.save(bucket, comment.ID, comment); e != nil {
+			return e
+		}
+		return b.indexComment(tx, comment, true)
 	})
 }
 
@@ -264,7 +329,7 @@ func (b *BoltDB) Count(req FindRequest) (count int, err error) {
 	}
 
 	if req.Locator.URL != "" { // comment's count for post
-		err = bdb.View(func(tx *bolt.Tx) error {
+		err = boltView(bdb, func(tx *bolt.Tx) error {
 			var e error
 			count, e = b.count(tx, req.Locator.URL, 0)
 			return e
@@ -273,15 +338,27 @@ func (b *BoltDB) Count(req FindRequest) (count int, err error) {
 	}
 
 	if req.UserID != "" { // comment's count for user
-		err = bdb.View(func(tx *bolt.Tx) error {
+		err = boltView(bdb, func(tx *bolt.Tx) error {
 			usersBkt := tx.Bucket([]byte(userBucketName))
 			userIDBkt := usersBkt.Bucket([]byte(req.UserID))
 			if userIDBkt == nil {
 				return fmt.Errorf("no comments for user %s in store for %s site", req.UserID, req.Locator.SiteID)
 			}
-			stats := userIDBkt.Stats()
-			count = stats.KeyN
-			return nil
+			if !req.Visible {
+				count = userIDBkt.Stats().KeyN
+				return nil
+			}
+			visible := b.viewerFilter(tx, req)
+			return userIDBkt.ForEach(func(_, v []byte) error {
+				url, commentID, e := b.parseRef(v)
+				if e != nil {
+					return fmt.Errorf("can't parse reference %s: %w", v, e)
+				}
+				if comment, e := b.loadComment(tx, url, commentID); e == nil && visible(comment) {
+					count++
+				}
+				return nil
+			})
 		})
 		return count, err
 	}
@@ -298,7 +375,7 @@ func (b *BoltDB) Info(req InfoRequest) ([]store.PostInfo, error) {
 
 	if req.Locator.URL != "" { // post info
 		info := store.PostInfo{}
-		err = bdb.View(func(tx *bolt.Tx) error {
+		err = boltView(bdb, func(tx *bolt.Tx) error {
 			infoBkt := tx.Bucket([]byte(infoBucketName))
 			if e := b.load(infoBkt, req.Locator.URL, &info); e != nil {
 				return fmt.Errorf("can't load info for %s: %w", req.Locator.URL, e)
@@ -316,18 +393,21 @@ func (b *BoltDB) Info(req InfoRequest) ([]store.PostInfo, error) {
 
 	if req.Locator.URL == "" && req.Locator.SiteID != "" { // site info (list)
 		list := []store.PostInfo{}
-		err = bdb.View(func(tx *bolt.Tx) error {
+		err = boltView(bdb, func(tx *bolt.Tx) error {
 			postsBkt := tx.Bucket([]byte(postsBucketName))
 
 			c := postsBkt.Cursor()
 			n := 0
+			infoBkt := tx.Bucket([]byte(infoBucketName))
 			for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+				if infoBkt.Get(k) == nil {
+					continue // post with comments awaiting approval only, not revealed yet
+				}
 				n++
 				if req.Skip > 0 && n <= req.Skip {
 					continue
 				}
 				postURL := string(k)
-				infoBkt := tx.Bucket([]byte(infoBucketName))
 				info := store.PostInfo{}
 				if e := b.load(infoBkt, postURL, &info); e != nil {
 					return fmt.Errorf("can't load info for %s: %w", postURL, e)
@@ -355,9 +435,12 @@ func (b *BoltDB) ListFlags(req FlagRequest) (res []any, err error) {
 
 	res = []any{}
 	switch req.Flag {
-	case Verified:
-		err = bdb.View(func(tx *bolt.Tx) error {
-			usersBkt := tx.Bucket([]byte(verifiedBucketName))
+	case Verified, Shadowed:
+		err = boltView(bdb, func(tx *bolt.Tx) error {
+			var usersBkt *bolt.Bucket
+			if usersBkt, err = b.flagBucket(tx, req.Flag); err != nil {
+				return err
+			}
 			_ = usersBkt.ForEach(func(k, _ []byte) error {
 				res = append(res, string(k))
 				return nil
@@ -366,7 +449,7 @@ func (b *BoltDB) ListFlags(req FlagRequest) (res []any, err error) {
 		})
 		return res, err
 	case Blocked:
-		err = bdb.View(func(tx *bolt.Tx) error {
+		err = boltView(bdb, func(tx *bolt.Tx) error {
 			bucket := tx.Bucket([]byte(blocksBucketName))
 			return bucket.ForEach(func(k []byte, v []byte) error {
 				ts, errParse := time.ParseInLocation(tsNano, string(v), time.Local)
@@ -424,27 +507,30 @@ func (b *BoltDB) Close() error {
 	return errors.Join(errs...)
 }
 
-// Last returns up to max last comments for given siteID
-func (b *BoltDB) lastComments(siteID string, maximum int, since time.Time) (comments []store.Comment, err error) {
+// lastComments returns last comments for site, newest first, limited by req.Limit and req.Since.
+// Deleted comments skipped, as well as ones not visible to the viewer with req.Visible set
+func (b *BoltDB) lastComments(req FindRequest) (comments []store.Comment, err error) {
 	comments = []store.Comment{}
 
+	maximum := req.Limit
 	if maximum > lastLimit || maximum == 0 {
 		maximum = lastLimit
 	}
 
-	bdb, err := b.db(siteID)
+	bdb, err := b.db(req.Locator.SiteID)
 	if err != nil {
 		return nil, err
 	}
 
-	err = bdb.View(func(tx *bolt.Tx) error {
+	err = boltView(bdb, func(tx *bolt.Tx) error {
 		lastBkt := tx.Bucket([]byte(lastBucketName))
 		c := lastBkt.Cursor()
+		visible := b.viewerFilter(tx, req)
 
 		for k, v := c.Last(); k != nil; k, v = c.Prev() {
-			if !since.IsZero() {
+			if !req.Since.IsZero() {
 				// stop if reached "since" ts
-				tsSince := []byte(since.Format(tsNano))
+				tsSince := []byte(req.Since.Format(tsNano))
 				if bytes.Compare(k, tsSince) <= 0 {
 					break
 				}
@@ -453,17 +539,12 @@ func (b *BoltDB) lastComments(siteID string, maximum int, since time.Time) (comm
 			if e != nil {
 				return e
 			}
-			postBkt, e := b.getPostBucket(tx, url)
+			comment, e := b.loadComment(tx, url, commentID)
 			if e != nil {
-				return e
-			}
-
-			comment := store.Comment{}
-			if e = b.load(postBkt, commentID, &comment); e != nil {
-				log.Printf("[WARN] can't load comment for %s from store %s", commentID, url)
+				log.Printf("[WARN] can't load comment for %s from store %s, %v", commentID, url, e)
 				continue
 			}
-			if comment.Deleted {
+			if comment.Deleted || !visible(comment) {
 				continue
 			}
 			comments = append(comments, comment)
@@ -477,61 +558,73 @@ func (b *BoltDB) lastComments(siteID string, maximum int, since time.Time) (comm
 	return comments, err
 }
 
-// userComments extracts all comments for given site and given userID
-// "users" bucket has sub-bucket for each userID, and keeps it as ts:ref
-func (b *BoltDB) userComments(siteID, userID string, limit, skip int) (comments []store.Comment, err error) {
+// userComments extracts comments for given site and given userID, newest first, limited by req.Limit and req.Skip.
+// "users" bucket has sub-bucket for each userID, and keeps it as ts:ref. Comments not visible to the viewer
+// skipped before the pagination with req.Visible set
+func (b *BoltDB) userComments(req FindRequest) (comments []store.Comment, err error) {
 	comments = []store.Comment{}
-	commentRefs := []string{}
 
-	bdb, err := b.db(siteID)
+	bdb, err := b.db(req.Locator.SiteID)
 	if err != nil {
 		return nil, err
 	}
 
+	limit := req.Limit
 	if limit == 0 || limit > userLimit {
 		limit = userLimit
 	}
 
-	// get list of references to comments
-	err = bdb.View(func(tx *bolt.Tx) error {
+	err = boltView(bdb, func(tx *bolt.Tx) error {
 		usersBkt := tx.Bucket([]byte(userBucketName))
-		userIDBkt := usersBkt.Bucket([]byte(userID))
+		userIDBkt := usersBkt.Bucket([]byte(req.UserID))
 		if userIDBkt == nil {
-			return fmt.Errorf("no comments for user %s in store", userID)
+			return fmt.Errorf("no comments for user %s in store", req.UserID)
 		}
 
+		visible := b.viewerFilter(tx, req)
 		c := userIDBkt.Cursor()
 		skipComments := 0
-		for k, v := c.Last(); k != nil; k, v = c.Prev() {
-			if len(commentRefs) >= limit {
-				break
+		for k, v := c.Last(); k != nil && len(comments) < limit; k, v = c.Prev() {
+			url, commentID, e := b.parseRef(v)
+			if e != nil {
+				return fmt.Errorf("can't parse reference %s: %w", v, e)
+			}
+			comment, e := b.loadComment(tx, url, commentID)
+			if e != nil {
+				continue // comment of the reference is gone
 			}
-			if skip > 0 && skipComments < skip {
+			if !visible(comment) {
+				continue
+			}
+			if req.Skip > 0 && skipComments < req.Skip {
 				skipComments++
 				continue
 			}
-			commentRefs = append(commentRefs, string(v))
+			comments = append(comments, comment)
 		}
 		return nil
 	})
 
+	return comments, err
+}
+
+// loadComment loads comment of the post in the transaction
+func (b *BoltDB) loadComment(tx *bolt.Tx, url, commentID string) (comment store.Comment, err error) {
+	postBkt, err := b.getPostBucket(tx, url)
 	if err != nil {
-		return comments, err
+		return comment, err
 	}
+	err = b.load(postBkt, commentID, &comment)
+	return comment, err
+}
 
-	// retrieve comments for refs
-	for _, v := range commentRefs {
-		url, commentID, errParse := b.parseRef([]byte(v))
-		if errParse != nil {
-			return comments, fmt.Errorf("can't parse reference %s: %w", v, errParse)
-		}
-		getReq := GetRequest{Locator: store.Locator{SiteID: siteID, URL: url}, CommentID: commentID}
-		if c, errRef := b.Get(getReq); errRef == nil {
-			comments = append(comments, c)
-		}
+// viewerFilter returns ViewerFilter of the request made in the transaction, or filter keeping all comments
+// if req.Visible not set
+func (b *BoltDB) viewerFilter(tx *bolt.Tx, req FindRequest) func(c store.Comment) bool {
+	if !req.Visible {
+		return func(store.Comment) bool { return true }
 	}
-
-	return comments, err
+	return ViewerFilter(req, func(userID string) bool { return b.shadowed(tx, userID) })
 }
 
 func (b *BoltDB) checkFlag(req FlagRequest) (val bool) {
@@ -547,7 +640,7 @@ func (b *BoltDB) checkFlag(req FlagRequest) (val bool) {
 
 	if req.Flag == Blocked {
 		var blocked bool
-		_ = bdb.View(func(tx *bolt.Tx) error {
+		_ = boltView(bdb, func(tx *bolt.Tx) error {
 			bucket := tx.Bucket([]byte(blocksBucketName))
 			v := bucket.Get([]byte(key))
 			if v == nil {
@@ -566,7 +659,7 @@ func (b *BoltDB) checkFlag(req FlagRequest) (val bool) {
 		return blocked
 	}
 
-	_ = bdb.View(func(tx *bolt.Tx) error {
+	_ = boltView(bdb, func(tx *bolt.Tx) error {
 		var bucket *bolt.Bucket
 		if bucket, err = b.flagBucket(tx, req.Flag); err != nil {
 			return err
@@ -588,7 +681,7 @@ func (b *BoltDB) setFlag(req FlagRequest) (res bool, err error) {
 		key = req.UserID
 	}
 
-	err = bdb.Update(func(tx *bolt.Tx) error {
+	err = boltUpdate(bdb, func(tx *bolt.Tx) error {
 		var bucket *bolt.Bucket
 		if bucket, err = b.flagBucket(tx, req.Flag); err != nil {
 			return err
@@ -607,12 +700,22 @@ func (b *BoltDB) setFlag(req FlagRequest) (res bool, err error) {
 				return nil
 			}
 
+			if req.Flag == Shadowed && bucket.Get([]byte(key)) == nil {
+				if e = b.recountUser(tx, key, -1); e != nil {
+					return e
+				}
+			}
 			if e = bucket.Put([]byte(key), []byte(time.Now().Format(tsNano))); e != nil {
 				return fmt.Errorf("failed to set flag %s for %s: %w", req.Flag, req.Locator.URL, e)
 			}
 			res = true
 			return nil
 		case FlagFalse:
+			if req.Flag == Shadowed && bucket.Get([]byte(key)) != nil {
+				if e = b.recountUser(tx, key, 1); e != nil {
+					return e
+				}
+			}
 			if e = bucket.Delete([]byte(key)); e != nil {
 				return fmt.Errorf("failed to clean flag %s for %s: %w", req.Flag, req.Locator.URL, e)
 			}
@@ -624,6 +727,38 @@ func (b *BoltDB) setFlag(req FlagRequest) (res bool, err error) {
 	return res, err
 }
 
+// shadowed checks if user is shadow-banned, comments of such users are not counted for posts
+func (b *BoltDB) shadowed(tx *bolt.Tx, userID string) bool {
+	return tx.Bucket([]byte(shadowedBucketName)).Get([]byte(userID)) != nil
+}
+
+// recountUser adds delta to posts counts for each counted (not deleted and not pending) comment of the user.
+// Used on shadow ban change, as comments of shadow-banned users are not counted.
+func (b *BoltDB) recountUser(tx *bolt.Tx, userID string, delta int) error {
+	userIDBkt := tx.Bucket([]byte(userBucketName)).Bucket([]byte(userID))
+	if userIDBkt == nil {
+		return nil // no comments for user
+	}
+	return userIDBkt.ForEach(func(_, v []byte) error {
+		url, commentID, err := b.parseRef(v)
+		if err != nil {
+			return fmt.Errorf("can't parse reference %s: %w", v, err)
+		}
+		postBkt, err := b.getPostBucket(tx, url)
+		if err != nil {
+			return nil // post removed, nothing to count
+		}
+		comment := store.Comment{}
+		if err = b.load(postBkt, commentID, &comment); err != nil || comment.Deleted || comment.Pending {
+			return nil
+		}
+		if _, err = b.count(tx, url, delta); err != nil {
+			return fmt.Errorf("failed to change count for %s: %w", url, err)
+		}
+		return nil
+	})
+}
+
 func (b *BoltDB) flagBucket(tx *bolt.Tx, flag Flag) (bkt *bolt.Bucket, err error) {
 	switch flag {
 	case ReadOnly:
@@ -632,6 +767,8 @@ func (b *BoltDB) flagBucket(tx *bolt.Tx, flag Flag) (bkt *bolt.Bucket, err error
 		bkt = tx.Bucket([]byte(blocksBucketName))
 	case Verified:
 		bkt = tx.Bucket([]byte(verifiedBucketName))
+	case Shadowed:
+		bkt = tx.Bucket([]byte(shadowedBucketName))
 	default:
 		return nil, fmt.Errorf("unsupported flag %v", flag)
 	}
@@ -646,7 +783,7 @@ func (b *BoltDB) getUserDetail(req UserDetailRequest) (result []UserDetailEntry,
 		return result, e
 	}
 
-	err = bdb.View(func(tx *bolt.Tx) error {
+	err = boltView(bdb, func(tx *bolt.Tx) error {
 		var entry UserDetailEntry
 		bucket := tx.Bucket([]byte(userDetailsBucketName))
 		value := bucket.Get([]byte(req.UserID))
@@ -660,6 +797,12 @@ func (b *BoltDB) getUserDetail(req UserDetailRequest) (result []UserDetailEntry,
 				result = []UserDetailEntry{{UserID: req.UserID, Email: entry.Email}}
 			case UserTelegram:
 				result = []UserDetailEntry{{UserID: req.UserID, Telegram: entry.Telegram}}
+			case UserEmailDigest:
+				result = []UserDetailEntry{{UserID: req.UserID, EmailDigest: entry.EmailDigest}}
+			case UserMatrix:
+				result = []UserDetailEntry{{UserID: req.UserID, Matrix: entry.Matrix}}
+			case UserWebPush:
+				result = []UserDetailEntry{{UserID: req.UserID, WebPush: entry.WebPush}}
 			}
 		}
 		return nil
@@ -677,7 +820,7 @@ func (b *BoltDB) setUserDetail(req UserDetailRequest) (result []UserDetailEntry,
 	}
 
 	var entry UserDetailEntry
-	err = bdb.View(func(tx *bolt.Tx) error {
+	err = boltView(bdb, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(userDetailsBucketName))
 		value := bucket.Get([]byte(req.UserID))
 		// return no error in case of absent entry
@@ -702,9 +845,15 @@ func (b *BoltDB) setUserDetail(req UserDetailRequest) (result []UserDetailEntry,
 		entry.Email = req.Update
 	case UserTelegram:
 		entry.Telegram = req.Update
+	case UserEmailDigest:
+		entry.EmailDigest = req.Update
+	case UserMatrix:
+		entry.Matrix = req.Update
+	case UserWebPush:
+		entry.WebPush = req.Update
 	}
 
-	err = bdb.Update(func(tx *bolt.Tx) error {
+	err = boltUpdate(bdb, func(tx *bolt.Tx) error {
 		err = b.save(tx.Bucket([]byte(userDetailsBucketName)), req.UserID, entry)
 		if err != nil {
 			return fmt.Errorf("failed to update detail %s for %s in %s: %w", req.Detail, req.UserID, req.Locator.SiteID, err)
@@ -722,7 +871,7 @@ func (b *BoltDB) listDetails(loc store.Locator) (result []UserDetailEntry, err e
 		return result, e
 	}
 
-	err = bdb.View(func(tx *bolt.Tx) error {
+	err = boltView(bdb, func(tx *bolt.Tx) error {
 		var entry UserDetailEntry
 		bucket := tx.Bucket([]byte(userDetailsBucketName))
 		return bucket.ForEach(func(_, value []byte) error {
@@ -739,7 +888,7 @@ func (b *BoltDB) listDetails(loc store.Locator) (result []UserDetailEntry, err e
 // deleteUserDetail deletes requested UserDetail or whole UserDetailEntry
 func (b *BoltDB) deleteUserDetail(bdb *bolt.DB, userID string, userDetail UserDetail) error {
 	var entry UserDetailEntry
-	err := bdb.View(func(tx *bolt.Tx) error {
+	err := boltView(bdb, func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(userDetailsBucketName))
 		value := bucket.Get([]byte(userID))
 		// return no error in case of absent entry
@@ -764,13 +913,19 @@ func (b *BoltDB) deleteUserDetail(bdb *bolt.DB, userID string, userDetail UserDe
 		entry.Email = ""
 	case UserTelegram:
 		entry.Telegram = ""
+	case UserEmailDigest:
+		entry.EmailDigest = ""
+	case UserMatrix:
+		entry.Matrix = ""
+	case UserWebPush:
+		entry.WebPush = ""
 	case AllUserDetails:
 		entry = UserDetailEntry{UserID: userID}
 	}
 
 	if entry == (UserDetailEntry{UserID: userID}) {
 		// if entry doesn't have non-empty details, we should delete it
-		return bdb.Update(func(tx *bolt.Tx) error {
+		return boltUpdate(bdb, func(tx *bolt.Tx) error {
 			err := tx.Bucket([]byte(userDetailsBucketName)).Delete([]byte(userID))
 			if err != nil {
 				return fmt.Errorf("failed to delete user detail %s for %s: %w", userDetail, userID, err)
@@ -779,7 +934,7 @@ func (b *BoltDB) deleteUserDetail(bdb *bolt.DB, userID string, userDetail UserDe
 		})
 	}
 
-	return bdb.Update(func(tx *bolt.Tx) error {
+	return boltUpdate(bdb, func(tx *bolt.Tx) error {
 		// updated entry is not empty and we need to store its updated copy
 		err := b.save(tx.Bucket([]byte(userDetailsBucketName)), userID, entry)
 		if err != nil {
@@ -790,7 +945,7 @@ func (b *BoltDB) deleteUserDetail(bdb *bolt.DB, userID string, userDetail UserDe
 }
 
 func (b *BoltDB) deleteComment(bdb *bolt.DB, locator store.Locator, commentID string, mode store.DeleteMode) error {
-	return bdb.Update(func(tx *bolt.Tx) error {
+	return boltUpdate(bdb, func(tx *bolt.Tx) error {
 		postBkt, e := b.getPostBucket(tx, locator.URL)
 		if e != nil {
 			return e
@@ -801,19 +956,27 @@ func (b *BoltDB) deleteComment(bdb *bolt.DB, locator store.Locator, commentID st
 			return fmt.Errorf("can't load key %s from bucket %s: %w", commentID, locator.URL, e)
 		}
 
-		if !comment.Deleted {
-			// decrement comments count for post url
+		if !comment.Deleted && !comment.Pending && !b.shadowed(tx, comment.User.ID) {
+			// decrement comments count for post url, pending and shadowed comments not counted
 			if _, e = b.count(tx, comment.Locator.URL, -1); e != nil {
 				return fmt.Errorf("failed to decrement count for %s: %w", comment.Locator, e)
 			}
 		}
 
+		// drop index for the original content, deleted comment indexed again below with whatever left
+		if e = b.indexComment(tx, comment, false); e != nil {
+			return e
+		}
+
 		// set deleted status and clear fields
 		comment.SetDeleted(mode)
 
 		if e = b.save(postBkt, commentID, comment); e != nil {
 			return fmt.Errorf("can't save deleted comment for key %s from bucket %s: %w", commentID, locator.URL, e)
 		}
+		if e = b.indexComment(tx, comment, true); e != nil {
+			return e
+		}
 
 		// delete from "last" bucket
 		lastBkt := tx.Bucket([]byte(lastBucketName))
@@ -821,17 +984,23 @@ func (b *BoltDB) deleteComment(bdb *bolt.DB, locator store.Locator, commentID st
 			return fmt.Errorf("can't delete key %s from bucket %s: %w", commentID, lastBucketName, e)
 		}
 
-		return nil
+		// deleted comment is not awaiting approval anymore, but stays pending to be hidden from others.
+		// its reports are dropped as well, nothing left to review
+		if e = b.setIndexRef(tx, pendingBucketName, comment, false); e != nil {
+			return e
+		}
+		return b.setIndexRef(tx, reportsBucketName, comment, false)
 	})
 }
 
 // deleteAll removes all top-level buckets for given siteID
 func (b *BoltDB) deleteAll(bdb *bolt.DB, siteID string) error {
 	// delete all buckets except blocked users
-	toDelete := []string{postsBucketName, lastBucketName, userBucketName, userDetailsBucketName, infoBucketName}
+	toDelete := []string{postsBucketName, lastBucketName, userBucketName, userDetailsBucketName, infoBucketName,
+		searchBucketName, pendingBucketName, reportsBucketName}
 
 	// delete top-level buckets
-	err := bdb.Update(func(tx *bolt.Tx) error {
+	err := boltUpdate(bdb, func(tx *bolt.Tx) error {
 		for _, bktName := range toDelete {
 			if e := tx.DeleteBucket([]byte(bktName)); e != nil {
 				return fmt.Errorf("failed to delete top level bucket %s: %w", bktName, e)
@@ -866,7 +1035,7 @@ func (b *BoltDB) deleteUser(bdb *bolt.DB, siteID, userID string, mode store.Dele
 	// get list of commentID for all user's comment
 	comments := []commentInfo{}
 	for _, postInfo := range posts {
-		err = bdb.View(func(tx *bolt.Tx) error {
+		err = boltView(bdb, func(tx *bolt.Tx) error {
 			postsBkt := tx.Bucket([]byte(postsBucketName))
 			postBkt := postsBkt.Bucket([]byte(postInfo.URL))
 			err = postBkt.ForEach(func(_ []byte, commentVal []byte) error {
@@ -902,7 +1071,7 @@ func (b *BoltDB) deleteUser(bdb *bolt.DB, siteID, userID string, mode store.Dele
 	// no per-user bucket, so tolerate ErrBucketNotFound; the top-level users bucket is created
 	// by NewBoltDB and is always present.
 	if mode == store.HardDelete {
-		err = bdb.Update(func(tx *bolt.Tx) error {
+		err = boltUpdate(bdb, func(tx *bolt.Tx) error {
 			usersBkt := tx.Bucket([]byte(userBucketName))
 			if e := usersBkt.DeleteBucket([]byte(userID)); e != nil && !errors.Is(e, berrors.ErrBucketNotFound) {
 				return fmt.Errorf("failed to delete user bucket for %s: %w", userID, e)
@@ -917,6 +1086,187 @@ func (b *BoltDB) deleteUser(bdb *bolt.DB, siteID, userID string, mode store.Dele
 	return b.deleteUserDetail(bdb, userID, AllUserDetails)
 }
 
+// indexedComments returns all non-deleted comments referenced by index bucket, i.e. "pending" or "reports", limited
+// to locator.URL if set. fn filters out stale references
+func (b *BoltDB) indexedComments(bdb *bolt.DB, bktName string, locator store.Locator, fn func(store.Comment) bool) ([]store.Comment, error) {
+	comments := []store.Comment{}
+	err := boltView(bdb, func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bktName)).ForEach(func(k, _ []byte) error {
+			url, commentID, e := b.parseRef(k)
+			if e != nil {
+				return e
+			}
+			if locator.URL != "" && url != locator.URL {
+				return nil
+			}
+			postBkt, e := b.getPostBucket(tx, url)
+			if e != nil {
+				return e
+			}
+			comment := store.Comment{}
+			if e = b.load(postBkt, commentID, &comment); e != nil {
+				log.Printf("[WARN] can't load comment for %s from store %s", commentID, url)
+				return nil
+			}
+			if !comment.Deleted && fn(comment) {
+				comments = append(comments, comment)
+			}
+			return nil
+		})
+	})
+	return comments, err
+}
+
+// setIndexRef adds or removes comment's reference in index bucket, i.e. "pending" or "reports"
+func (b *BoltDB) setIndexRef(tx *bolt.Tx, bktName string, comment store.Comment, present bool) error {
+	bkt, ref := tx.Bucket([]byte(bktName)), b.makeRef(comment)
+	if !present {
+		if err := bkt.Delete(ref); err != nil {
+			return fmt.Errorf("can't delete reference %s from %s: %w", ref, bktName, err)
+		}
+		return nil
+	}
+	if err := bkt.Put(ref, []byte{}); err != nil {
+		return fmt.Errorf("can't put reference %s to %s: %w", ref, bktName, err)
+	}
+	return nil
+}
+
+// updatePending keeps "pending" bucket and post's count in sync with the change of comment's pending status
+func (b *BoltDB) updatePending(tx *bolt.Tx, oldComment, comment store.Comment) error {
+	if oldComment.Pending == comment.Pending {
+		return nil
+	}
+	if err := b.setIndexRef(tx, pendingBucketName, comment, comment.Pending); err != nil {
+		return err
+	}
+	counted := !comment.Deleted && !b.shadowed(tx, comment.User.ID)
+	if comment.Pending {
+		if !counted {
+			return nil
+		}
+		if _, err := b.count(tx, comment.Locator.URL, -1); err != nil {
+			return fmt.Errorf("failed to change count for %s: %w", comment.Locator, err)
+		}
+		return nil
+	}
+
+	// approved comment counted from now and reveals the post, the same way as newly created comment
+	infoBkt := tx.Bucket([]byte(infoBucketName))
+	info := store.PostInfo{}
+	if err := b.load(infoBkt, comment.Locator.URL, &info); err != nil {
+		info = store.PostInfo{URL: comment.Locator.URL, FirstTS: comment.Timestamp, LastTS: comment.Timestamp}
+	}
+	if comment.Timestamp.Before(info.FirstTS) {
+		info.FirstTS = comment.Timestamp
+	}
+	if comment.Timestamp.After(info.LastTS) {
+		info.LastTS = comment.Timestamp
+	}
+	if counted {
+		info.Count++
+	}
+	if err := b.save(infoBkt, comment.Locator.URL, &info); err != nil {
+		return fmt.Errorf("failed to set info for %s: %w", comment.Locator, err)
+	}
+	return nil
+}
+
+// searchComments returns all comments matching query, using prefix scan of search index for each query word.
+// Comments should match all words, i.e. references sets for words intersected.
+func (b *BoltDB) searchComments(bdb *bolt.DB, locator store.Locator, query string) ([]store.Comment, error) {
+	comments := []store.Comment{}
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return comments, nil
+	}
+
+	err := boltView(bdb, func(tx *bolt.Tx) error {
+		var refs map[string]bool
+		searchBkt := tx.Bucket([]byte(searchBucketName))
+		for _, term := range terms {
+			termRefs := map[string]bool{}
+			c := searchBkt.Cursor()
+			prefix := []byte(term)
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if _, ref, ok := bytes.Cut(k, []byte{0}); ok && (refs == nil || refs[string(ref)]) {
+					termRefs[string(ref)] = true
+				}
+			}
+			refs = termRefs
+			if len(refs) == 0 {
+				return nil
+			}
+		}
+
+		for ref := range refs {
+			url, commentID, e := b.parseRef([]byte(ref))
+			if e != nil {
+				return e
+			}
+			if locator.URL != "" && url != locator.URL {
+				continue
+			}
+			postBkt, e := b.getPostBucket(tx, url)
+			if e != nil {
+				return e
+			}
+			comment := store.Comment{}
+			if e = b.load(postBkt, commentID, &comment); e != nil {
+				return fmt.Errorf("can't load searched comment %s: %w", ref, e)
+			}
+			comments = append(comments, comment)
+		}
+		return nil
+	})
+	return comments, err
+}
+
+// indexComment adds (or removes with add=false) search index entries for all comment's words. Should run in update tx
+func (b *BoltDB) indexComment(tx *bolt.Tx, comment store.Comment, add bool) error {
+	searchBkt := tx.Bucket([]byte(searchBucketName))
+	ref := b.makeRef(comment)
+	for _, word := range searchWords(comment) {
+		key := append(append([]byte(word), 0), ref...)
+		var err error
+		if add {
+			err = searchBkt.Put(key, []byte{})
+		} else {
+			err = searchBkt.Delete(key)
+		}
+		if err != nil {
+			return fmt.Errorf("can't update search index for %s: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+// buildSearchIndex indexes all stored comments. Should run in update tx
+func (b *BoltDB) buildSearchIndex(tx *bolt.Tx) error {
+	postsBkt := tx.Bucket([]byte(postsBucketName))
+	if postsBkt == nil {
+		return nil
+	}
+	count := 0
+	err := postsBkt.ForEachBucket(func(postURL []byte) error {
+		return postsBkt.Bucket(postURL).ForEach(func(_, v []byte) error {
+			comment := store.Comment{}
+			if e := json.Unmarshal(v, &comment); e != nil {
+				return fmt.Errorf("failed to unmarshal: %w", e)
+			}
+			count++
+			return b.indexComment(tx, comment, true)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build search index: %w", err)
+	}
+	if count > 0 {
+		log.Printf("[INFO] search index built for %d comments", count)
+	}
+	return nil
+}
+
 // getPostBucket return bucket with all comments for postURL
 func (b *BoltDB) getPostBucket(tx *bolt.Tx, postURL string) (*bolt.Bucket, error) {
 	postsBkt := tx.Bucket([]byte(postsBucketName))
@@ -997,9 +1347,14 @@ func (b *BoltDB) count(tx *bolt.Tx, postURL string, val int) (int, error) {
 	return info.Count, b.save(infoBkt, postURL, &info)
 }
 
+// setInfo creates or updates info of the post with the new comment. Comment awaiting approval
+// doesn't reveal the post, its info is set on approval by updatePending
 func (b *BoltDB) setInfo(tx *bolt.Tx, comment store.Comment) (store.PostInfo, error) {
 	infoBkt := tx.Bucket([]byte(infoBucketName))
 	info := store.PostInfo{}
+	if comment.Pending {
+		return info, nil
+	}
 	if err := b.load(infoBkt, comment.Locator.URL, &info); err != nil {
 		info = store.PostInfo{
 			Count:   0,
@@ -1008,8 +1363,10 @@ func (b *BoltDB) setInfo(tx *bolt.Tx, comment store.Comment) (store.PostInfo, er
 			LastTS:  comment.Timestamp,
 		}
 	}
-	info.Count++
-	info.LastTS = comment.Timestamp
+	if !b.shadowed(tx, comment.User.ID) {
+		info.Count++
+		info.LastTS = comment.Timestamp
+	}
 	err := b.save(infoBkt, comment.Locator.URL, &info)
 	return info, err
 }
@@ -1021,6 +1378,21 @@ func (b *BoltDB) db(siteID string) (*bolt.DB, error) {
 	return nil, fmt.Errorf("site %q %w", siteID, ErrSiteNotFound)
 }
 
+var boltTxDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "remark42_bolt_tx_duration_seconds", Help: "bolt transaction latency by type"}, []string{"type"})
+
+// boltView runs read-only transaction, reports its latency
+func boltView(bdb *bolt.DB, fn func(tx *bolt.Tx) error) error {
+	defer prometheus.NewTimer(boltTxDuration.WithLabelValues("view")).ObserveDuration()
+	return bdb.View(fn)
+}
+
+// boltUpdate runs read-write transaction, reports its latency
+func boltUpdate(bdb *bolt.DB, fn func(tx *bolt.Tx) error) error {
+	defer prometheus.NewTimer(boltTxDuration.WithLabelValues("update")).ObserveDuration()
+	return bdb.Update(fn)
+}
+
 // makeRef creates reference combining url and comment id
 func (b *BoltDB) makeRef(comment store.Comment) []byte {
 	return fmt.Appendf(nil, "%s!!%s", comment.Locator.URL, comment.ID)
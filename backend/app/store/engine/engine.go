@@ -25,8 +25,8 @@ type Interface interface {
 	Update(comment store.Comment) error                         // update comment, mutable parts only
 	Get(req GetRequest) (store.Comment, error)                  // get comment by id
 	Find(req FindRequest) ([]store.Comment, error)              // find comments for locator or site
-	Info(req InfoRequest) ([]store.PostInfo, error)             // get post(s) meta info
-	Count(req FindRequest) (int, error)                         // get count for post or user
+	Info(req InfoRequest) ([]store.PostInfo, error)             // get post(s) meta info, shadow-banned users not counted
+	Count(req FindRequest) (int, error)                         // get count for post or user, shadow-banned users not counted for post
 	Delete(req DeleteRequest) error                             // Delete post(s), user, comment, user details, or everything
 	Flag(req FlagRequest) (bool, error)                         // set and get flags
 	ListFlags(req FlagRequest) ([]any, error)                   // get list of flagged keys, like blocked & verified user
@@ -47,12 +47,21 @@ type GetRequest struct {
 
 // FindRequest is the input for all find operations
 type FindRequest struct {
-	Locator store.Locator `json:"locator"`           // lack of URL means site operation
-	UserID  string        `json:"user_id,omitempty"` // presence of UserID treated as user-related find
-	Sort    string        `json:"sort,omitempty"`    // sort order with +/-field syntax
-	Since   time.Time     `json:"since"`             // time limit for found results
-	Limit   int           `json:"limit,omitempty"`
-	Skip    int           `json:"skip,omitempty"`
+	Locator  store.Locator `json:"locator"`            // lack of URL means site operation
+	UserID   string        `json:"user_id,omitempty"`  // presence of UserID treated as user-related find
+	Query    string        `json:"query,omitempty"`    // presence of Query treated as full-text search
+	Pending  bool          `json:"pending,omitempty"`  // find comments awaiting approval only
+	Reported bool          `json:"reported,omitempty"` // find comments reported by users only
+	Sort     string        `json:"sort,omitempty"`     // sort order with +/-field syntax
+	Since    time.Time     `json:"since"`              // time limit for found results
+	Limit    int           `json:"limit,omitempty"`
+	Skip     int           `json:"skip,omitempty"`
+
+	// search results visibility, see SearchFilter, and visibility of last and user's comments, see ViewerFilter
+	ViewerID    string `json:"viewer_id,omitempty"`    // user making the request, sees own hidden comments
+	ViewerAdmin bool   `json:"viewer_admin,omitempty"` // admin making the request, sees all hidden comments
+	Deleted     bool   `json:"deleted,omitempty"`      // include deleted comments and comments of blocked users
+	Visible     bool   `json:"visible,omitempty"`      // last and user's comments visible to the viewer only
 }
 
 // InfoRequest is the input of Info operation used to get meta data about posts
@@ -90,6 +99,7 @@ const (
 	ReadOnly = Flag("readonly")
 	Verified = Flag("verified")
 	Blocked  = Flag("blocked")
+	Shadowed = Flag("shadowed") // shadow-banned user, comments visible to the user and admins only
 )
 
 // All possible user details
@@ -98,6 +108,12 @@ const (
 	UserEmail = UserDetail("email")
 	// UserTelegram is a user telegram
 	UserTelegram = UserDetail("telegram")
+	// UserEmailDigest is a user email notifications mode, empty for immediate delivery or digest period
+	UserEmailDigest = UserDetail("email_digest")
+	// UserMatrix is a user matrix id, i.e. @user:matrix.org
+	UserMatrix = UserDetail("matrix")
+	// UserWebPush is a user web push subscriptions of browsers, json list
+	UserWebPush = UserDetail("webpush")
 	// AllUserDetails used for listing and deletion requests
 	AllUserDetails = UserDetail("all")
 )
@@ -116,9 +132,12 @@ type UserDetail string
 
 // UserDetailEntry contains single user details entry
 type UserDetailEntry struct {
-	UserID   string `json:"user_id"`            // duplicate user's id to use this structure not only embedded but separately
-	Email    string `json:"email,omitempty"`    // UserEmail
-	Telegram string `json:"telegram,omitempty"` // UserTelegram
+	UserID      string `json:"user_id"`                // duplicate user's id to use this structure not only embedded but separately
+	Email       string `json:"email,omitempty"`        // UserEmail
+	Telegram    string `json:"telegram,omitempty"`     // UserTelegram
+	EmailDigest string `json:"email_digest,omitempty"` // UserEmailDigest
+	Matrix      string `json:"matrix,omitempty"`       // UserMatrix
+	WebPush     string `json:"webpush,omitempty"`      // UserWebPush
 }
 
 // UserDetailRequest is the input for both get/set for details, like email
@@ -169,6 +188,15 @@ func SortComments(comments []store.Comment, sortFld string) []store.Comment {
 			}
 			return comments[i].Controversy < comments[j].Controversy
 
+		case "+reports", "-reports", "reports":
+			if len(comments[i].Reports) == len(comments[j].Reports) {
+				return comments[i].Timestamp.Before(comments[j].Timestamp)
+			}
+			if strings.HasPrefix(sortFld, "-") {
+				return len(comments[i].Reports) > len(comments[j].Reports)
+			}
+			return len(comments[i].Reports) < len(comments[j].Reports)
+
 		default:
 			return comments[i].Timestamp.Before(comments[j].Timestamp)
 		}
@@ -1,20 +1,110 @@
 package engine
 
 import (
+	"fmt"
+	"path/filepath"
 	"testing"
+	"testing/synctest"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 
 	"github.com/umputun/remark42/backend/app/store"
 )
 
+// testEngines are the engines behavioral tests run against, each made empty
+var testEngines = []struct {
+	name    string
+	makeNew func(t *testing.T) Interface
+}{
+	{name: "bolt", makeNew: func(t *testing.T) Interface {
+		b, err := NewBoltDB(bolt.Options{}, BoltSite{FileName: filepath.Join(t.TempDir(), "test-remark.db"), SiteID: "radio-t"})
+		require.NoError(t, err)
+		return b
+	}},
+	{name: "sqlite", makeNew: func(t *testing.T) Interface {
+		s, err := NewSQLite(filepath.Join(t.TempDir(), "remark.db"), time.Second, "radio-t")
+		require.NoError(t, err)
+		return s
+	}},
+}
+
+// TestEngine runs the same behavioral tests against all engines, so any difference between them fails
+func TestEngine(t *testing.T) {
+	tbl := []struct {
+		name   string
+		fn     func(t *testing.T, db Interface)
+		empty  bool // no comments made by prepComments
+		bubble bool // runs in synctest bubble, with fake time
+	}{
+		{name: "CreateAndFind", fn: testCreateAndFind},
+		{name: "CreateFailedReadOnly", fn: testCreateFailedReadOnly},
+		{name: "Get", fn: testGet},
+		{name: "Update", fn: testUpdate},
+		{name: "FindLast", fn: testFindLast},
+		{name: "FindNoPost", fn: testFindNoPost},
+		{name: "FindLastSince", fn: testFindLastSince},
+		{name: "FindInPostSince", fn: testFindInPostSince},
+		{name: "FindForUser", fn: testFindForUser},
+		{name: "FindForUserPagination", fn: testFindForUserPagination, empty: true},
+		{name: "CountPost", fn: testCountPost},
+		{name: "CountUser", fn: testCountUser},
+		{name: "InfoPost", fn: testInfoPost},
+		{name: "InfoList", fn: testInfoList},
+		{name: "InfoNotCounted", fn: testInfoNotCounted},
+		{name: "FlagBlockedUser", fn: testFlagBlockedUser},
+		{name: "FlagReadOnlyPost", fn: testFlagReadOnlyPost},
+		{name: "FlagVerified", fn: testFlagVerified},
+		{name: "FlagListVerified", fn: testFlagListVerified},
+		{name: "FlagShadowed", fn: testFlagShadowed},
+		{name: "CountShadowed", fn: testCountShadowed},
+		{name: "FlagListBlocked", fn: testFlagListBlocked, bubble: true},
+		{name: "UserDetail", fn: testUserDetail},
+		{name: "DeleteComment", fn: testDeleteComment},
+		{name: "DeleteHard", fn: testDeleteHard},
+		{name: "DeleteAll", fn: testDeleteAll},
+		{name: "DeleteUserDetail", fn: testDeleteUserDetail},
+		{name: "DeleteUserHard", fn: testDeleteUserHard},
+		{name: "DeleteUserHard_NoComments", fn: testDeleteUserHardNoComments},
+		{name: "DeleteUserSoft_NoComments", fn: testDeleteUserSoftNoComments},
+		{name: "DeleteUserSoft", fn: testDeleteUserSoft},
+		{name: "Search", fn: testSearch},
+		{name: "Pending", fn: testPending},
+		{name: "Reported", fn: testReported},
+	}
+
+	for _, eng := range testEngines {
+		for _, tt := range tbl {
+			t.Run(eng.name+"/"+tt.name, func(t *testing.T) {
+				run := func(t *testing.T) {
+					db := eng.makeNew(t)
+					defer func() { require.NoError(t, db.Close()) }()
+					if !tt.empty {
+						prepComments(t, db)
+					}
+					tt.fn(t, db)
+				}
+				if tt.bubble {
+					synctest.Test(t, run)
+					return
+				}
+				run(t)
+			})
+		}
+	}
+}
+
 func TestEngine_sortComments(t *testing.T) {
 	cc := []store.Comment{
-		{ID: "1", Score: 5, Controversy: 1, Timestamp: time.Date(2018, 2, 5, 10, 1, 0, 0, time.UTC)},
-		{ID: "2", Score: 4, Controversy: 2, Timestamp: time.Date(2018, 2, 5, 10, 2, 0, 0, time.UTC)},
+		{ID: "1", Score: 5, Controversy: 1, Timestamp: time.Date(2018, 2, 5, 10, 1, 0, 0, time.UTC),
+			Reports: map[string]store.Report{"u1": {}}},
+		{ID: "2", Score: 4, Controversy: 2, Timestamp: time.Date(2018, 2, 5, 10, 2, 0, 0, time.UTC),
+			Reports: map[string]store.Report{"u1": {}, "u2": {}, "u3": {}}},
 		{ID: "3", Score: 6, Controversy: 3, Timestamp: time.Date(2018, 2, 5, 10, 3, 0, 0, time.UTC)},
-		{ID: "4", Score: 6, Controversy: 1, Timestamp: time.Date(2018, 2, 5, 10, 4, 0, 0, time.UTC)},
+		{ID: "4", Score: 6, Controversy: 1, Timestamp: time.Date(2018, 2, 5, 10, 4, 0, 0, time.UTC),
+			Reports: map[string]store.Report{"u2": {}}},
 	}
 
 	SortComments(cc, "+time")
@@ -52,4 +142,1260 @@ func TestEngine_sortComments(t *testing.T) {
 	assert.Equal(t, "2", cc[1].ID)
 	assert.Equal(t, "1", cc[2].ID)
 	assert.Equal(t, "4", cc[3].ID)
+
+	SortComments(cc, "reports")
+	assert.Equal(t, "3", cc[0].ID)
+	assert.Equal(t, "1", cc[1].ID)
+	assert.Equal(t, "4", cc[2].ID)
+	assert.Equal(t, "2", cc[3].ID)
+
+	SortComments(cc, "-reports")
+	assert.Equal(t, "2", cc[0].ID)
+	assert.Equal(t, "1", cc[1].ID)
+	assert.Equal(t, "4", cc[2].ID)
+	assert.Equal(t, "3", cc[3].ID)
+}
+
+func testCreateAndFind(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, Sort: "time"}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, `some text, <a href="http://radio-t.com">link</a>`, res[0].Text)
+	assert.Equal(t, "user1", res[0].User.ID)
+	t.Log(res[0].ID)
+
+	_, err = db.Create(store.Comment{ID: res[0].ID, Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}})
+	assert.Error(t, err)
+	assert.Equal(t, "key id-1 already in store", err.Error())
+
+	req = FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t-bad"}, Sort: "time"}
+	_, err = db.Find(req)
+	assert.EqualError(t, err, `site "radio-t-bad" not found`)
+
+	assert.NoError(t, db.Close())
+}
+
+func testCreateFailedReadOnly(t *testing.T, db Interface) {
+
+	comment := store.Comment{
+		ID:        "id-ro",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 22, 0, time.UTC),
+		Locator:   store.Locator{URL: "https://radio-t.com/ro", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+
+	flagReq := FlagRequest{Locator: comment.Locator, Flag: ReadOnly, Update: FlagTrue}
+	v, err := db.Flag(flagReq)
+	require.NoError(t, err)
+	assert.Equal(t, true, v)
+
+	_, err = db.Create(comment)
+	assert.Error(t, err)
+	assert.Equal(t, "post https://radio-t.com/ro is read-only", err.Error())
+
+	flagReq = FlagRequest{Locator: comment.Locator, Flag: ReadOnly, Update: FlagFalse}
+	v, err = db.Flag(flagReq)
+	require.NoError(t, err)
+	assert.Equal(t, false, v)
+
+	_, err = db.Create(comment)
+	assert.NoError(t, err)
+}
+
+func testGet(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, Sort: "time"}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res), "2 records initially")
+
+	comment, err := db.Get(getReq(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, res[1].ID))
+	assert.NoError(t, err)
+	assert.Equal(t, "some text2", comment.Text)
+
+	comment, err = db.Get(getReq(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, "1234567"))
+	assert.Error(t, err)
+
+	_, err = db.Get(getReq(store.Locator{URL: "https://radio-t.com", SiteID: "bad"}, res[1].ID))
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func testUpdate(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, Sort: "time"}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res), "2 records initially")
+
+	comment := res[0]
+	comment.Text = "abc 123"
+	comment.Score = 100
+	comment.User.Name = "changed name" // immutable, should be ignored
+	err = db.Update(comment)
+	assert.NoError(t, err)
+
+	comment, err = db.Get(getReq(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, res[0].ID))
+	assert.NoError(t, err)
+	assert.Equal(t, "abc 123", comment.Text)
+	assert.Equal(t, res[0].ID, comment.ID)
+	assert.Equal(t, "user name", comment.User.Name)
+	assert.Equal(t, 100, comment.Score)
+
+	comment.Locator.SiteID = "bad"
+	err = db.Update(comment)
+	assert.EqualError(t, err, `site "bad" not found`)
+
+	comment.Locator.SiteID = "radio-t"
+	comment.Locator.URL = "https://radio-t.com-bad"
+	err = db.Update(comment)
+	assert.EqualError(t, err, `no bucket https://radio-t.com-bad in store`)
+}
+
+func testFindLast(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "-time"}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	req.Limit = 1
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	req.Locator.SiteID = "bad"
+	_, err = db.Find(req)
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func testFindNoPost(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{URL: "https://radio-t.com/no-such-post", SiteID: "radio-t"}, Sort: "time"}
+	_, err := db.Find(req)
+	assert.EqualError(t, err, "no bucket https://radio-t.com/no-such-post in store")
+
+	// existing post with no comments since the requested time is not an error
+	req = FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, Sort: "time",
+		Since: time.Date(2017, 12, 20, 16, 18, 22, 0, time.UTC)}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+}
+
+func testFindLastSince(t *testing.T, db Interface) {
+
+	ts := time.Date(2017, 12, 20, 15, 18, 21, 0, time.UTC)
+	req := FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "-time", Since: ts}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	req.Since = time.Date(2017, 12, 20, 15, 18, 22, 0, time.UTC)
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	req.Since = time.Date(2017, 12, 20, 16, 18, 22, 0, time.UTC)
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func testFindInPostSince(t *testing.T, db Interface) {
+
+	ts := time.Date(2017, 12, 20, 15, 18, 21, 0, time.UTC)
+	req := FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, Sort: "-time", Since: ts}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	req.Since = time.Date(2017, 12, 20, 15, 18, 22, 0, time.UTC)
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "some text2", res[0].Text)
+
+	req.Since = time.Date(2017, 12, 20, 16, 18, 22, 0, time.UTC)
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func testFindForUser(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "-time", UserID: "user1", Limit: 5}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "some text2", res[0].Text, "sorted by -time")
+
+	req = FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "-time", UserID: "user1", Limit: 1}
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res), "allow 1 comment")
+	assert.Equal(t, "some text2", res[0].Text, "sorted by -time")
+
+	req = FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "-time", UserID: "user1", Limit: 1, Skip: 1}
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res), "allow 1 comment")
+	assert.Equal(t, `some text, <a href="http://radio-t.com">link</a>`, res[0].Text, "second comment")
+
+	req = FindRequest{Locator: store.Locator{SiteID: "bad"}, Sort: "-time", UserID: "user1", Limit: 1, Skip: 1}
+	_, err = db.Find(req)
+	assert.EqualError(t, err, `site "bad" not found`)
+
+	req = FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "-time", UserID: "userZ", Limit: 1, Skip: 1}
+	_, err = db.Find(req)
+	assert.EqualError(t, err, `no comments for user userZ in store`)
+}
+
+func testFindForUserPagination(t *testing.T, db Interface) {
+	c := store.Comment{
+		Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		User:    store.User{ID: "user1", Name: "user name"},
+	}
+
+	// write 200 comments
+	for i := range 200 {
+		c.ID = fmt.Sprintf("id-%d", i)
+		c.Text = fmt.Sprintf("text #%d", i)
+		c.Timestamp = time.Date(2017, 12, 20, 15, 18, i, 0, time.UTC)
+		_, err := db.Create(c)
+		require.NoError(t, err)
+	}
+
+	// get all comments
+	req := FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "-time", UserID: "user1"}
+	res, err := db.Find(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, len(res))
+	assert.Equal(t, "id-199", res[0].ID)
+
+	// seek 0, 5 comments
+	req.Limit = 5
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 5, len(res))
+	assert.Equal(t, "id-199", res[0].ID)
+	assert.Equal(t, "id-195", res[4].ID)
+
+	// seek 10, 3 comments
+	req.Skip, req.Limit = 10, 3
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	assert.Equal(t, "id-189", res[0].ID)
+	assert.Equal(t, "id-187", res[2].ID)
+
+	// seek 195, ask 10 comments
+	req.Skip, req.Limit = 195, 10
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	require.Equal(t, 5, len(res))
+	assert.Equal(t, "id-4", res[0].ID)
+	assert.Equal(t, "id-0", res[4].ID)
+
+	// seek 255, ask 10 comments
+	req.Skip, req.Limit = 255, 10
+	res, err = db.Find(req)
+	assert.NoError(t, err)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func testCountPost(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}}
+	c, err := db.Count(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, c)
+
+	req = FindRequest{Locator: store.Locator{URL: "https://radio-t.com-xxx", SiteID: "radio-t"}}
+	c, err = db.Count(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c)
+
+	req = FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "bad"}}
+	_, err = db.Count(req)
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func testCountUser(t *testing.T, db Interface) {
+
+	req := FindRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1"}
+	c, err := db.Count(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, c)
+
+	req = FindRequest{Locator: store.Locator{SiteID: "bad"}, UserID: "user1"}
+	_, err = db.Count(req)
+	assert.EqualError(t, err, `site "bad" not found`)
+
+	req = FindRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "userZ"}
+	_, err = db.Count(req)
+	assert.EqualError(t, err, `no comments for user userZ in store for radio-t site`)
+}
+
+func testInfoPost(t *testing.T, db Interface) {
+
+	ts := func(minute int) time.Time { return time.Date(2017, 12, 20, 15, 18, minute, 0, time.UTC) }
+
+	// add one more for https://radio-t.com/2
+	comment := store.Comment{
+		ID:        "12345",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 24, 0, time.UTC),
+		Locator:   store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err := db.Create(comment)
+	assert.NoError(t, err)
+
+	req := InfoRequest{Locator: store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, ReadOnlyAge: 0}
+	r, err := db.Info(req)
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(24), LastTS: ts(24)}}, r)
+
+	req = InfoRequest{Locator: store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, ReadOnlyAge: 10}
+	r, err = db.Info(req)
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(24), LastTS: ts(24),
+		ReadOnly: true}}, r)
+
+	req = InfoRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, ReadOnlyAge: 0}
+	r, err = db.Info(req)
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, r)
+
+	req = InfoRequest{Locator: store.Locator{URL: "https://radio-t.com/error", SiteID: "radio-t"}, ReadOnlyAge: 0}
+	_, err = db.Info(req)
+	require.Error(t, err)
+
+	req = InfoRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t-error"}, ReadOnlyAge: 0}
+	_, err = db.Info(req)
+	require.Error(t, err)
+
+	fr := FlagRequest{Flag: ReadOnly, Locator: store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, Update: FlagTrue}
+	_, err = db.Flag(fr)
+	require.NoError(t, err)
+	req = InfoRequest{Locator: store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, ReadOnlyAge: 0}
+	r, err = db.Info(req)
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(24), LastTS: ts(24),
+		ReadOnly: true}}, r)
+}
+
+func testInfoList(t *testing.T, db Interface) {
+
+	// add one more for https://radio-t.com/2
+	comment := store.Comment{
+		ID:        "12345",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 22, 0, time.UTC),
+		Locator:   store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err := db.Create(comment)
+	assert.NoError(t, err)
+
+	ts := func(sec int) time.Time { return time.Date(2017, 12, 20, 15, 18, sec, 0, time.UTC) }
+
+	req := InfoRequest{Locator: store.Locator{SiteID: "radio-t"}}
+	res, err := db.Info(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(22), LastTS: ts(22)},
+		{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, res)
+
+	req = InfoRequest{Locator: store.Locator{SiteID: "radio-t"}, Limit: -1, Skip: -1}
+	res, err = db.Info(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(22), LastTS: ts(22)},
+		{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, res)
+
+	req = InfoRequest{Locator: store.Locator{SiteID: "radio-t"}, Limit: 1}
+	res, err = db.Info(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/2", Count: 1, FirstTS: ts(22), LastTS: ts(22)}}, res)
+
+	req = InfoRequest{Locator: store.Locator{SiteID: "radio-t"}, Limit: 1, Skip: 1}
+	res, err = db.Info(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, res)
+
+	req = InfoRequest{Locator: store.Locator{SiteID: "bad"}, Limit: 1, Skip: 1}
+	_, err = db.Info(req)
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func testInfoNotCounted(t *testing.T, db Interface) {
+
+	ts := func(sec int) time.Time { return time.Date(2017, 12, 20, 15, 18, sec, 0, time.UTC) }
+
+	_, err := db.Flag(FlagRequest{Flag: Shadowed, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user2", Update: FlagTrue})
+	require.NoError(t, err)
+
+	// comments by shadow-banned user and awaiting approval don't move post's times
+	for _, c := range []store.Comment{
+		{ID: "id-shadowed", Text: "shadowed", Timestamp: ts(25), User: store.User{ID: "user2", Name: "user2"}},
+		{ID: "id-pending", Text: "pending", Timestamp: ts(26), User: store.User{ID: "user3", Name: "user3"}, Pending: true},
+	} {
+		c.Locator = store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+		_, err = db.Create(c)
+		require.NoError(t, err)
+	}
+
+	// post with shadow-banned comments only has both times set to its first comment
+	for _, c := range []store.Comment{
+		{ID: "id-shadowed-1", Text: "shadowed 1", Timestamp: ts(30), User: store.User{ID: "user2", Name: "user2"}},
+		{ID: "id-shadowed-2", Text: "shadowed 2", Timestamp: ts(31), User: store.User{ID: "user2", Name: "user2"}},
+	} {
+		c.Locator = store.Locator{URL: "https://radio-t.com/shadowed", SiteID: "radio-t"}
+		_, err = db.Create(c)
+		require.NoError(t, err)
+	}
+
+	r, err := db.Info(InfoRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}})
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, r)
+
+	r, err = db.Info(InfoRequest{Locator: store.Locator{SiteID: "radio-t"}})
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com/shadowed", Count: 0, FirstTS: ts(30), LastTS: ts(30)},
+		{URL: "https://radio-t.com", Count: 2, FirstTS: ts(22), LastTS: ts(23)}}, r)
+}
+
+func testFlagBlockedUser(t *testing.T, db Interface) {
+
+	req := FlagRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1"}
+	val, err := db.Flag(req)
+	assert.NoError(t, err)
+	assert.False(t, val, "nothing blocked yet")
+
+	req = FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Update: FlagTrue}
+	_, err = db.Flag(req)
+	assert.NoError(t, err)
+	val, err = db.Flag(FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1"})
+	assert.NoError(t, err)
+	assert.True(t, val, "user1 blocked")
+
+	req = FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Update: FlagTrue}
+	_, err = db.Flag(req)
+	assert.NoError(t, err)
+	val, err = db.Flag(FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1"})
+	assert.NoError(t, err)
+	assert.True(t, val, "user1 still blocked")
+
+	req = FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Update: FlagFalse}
+	_, err = db.Flag(req)
+	assert.NoError(t, err)
+	val, err = db.Flag(FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1"})
+	assert.NoError(t, err)
+	assert.False(t, val, "user1 unblocked")
+
+	req = FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "bad"}, UserID: "user1", Update: FlagTrue}
+	_, err = db.Flag(req)
+	assert.EqualError(t, err, `site "bad" not found`)
+
+	req = FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}, UserID: "userX", Update: FlagTrue}
+	_, err = db.Flag(req)
+	assert.NoError(t, err, "non-existing user can't be blocked")
+
+	req = FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t-bad"}, UserID: "user1"}
+	val, err = db.Flag(req)
+	assert.NoError(t, err)
+	assert.False(t, val, "nothing blocked on wrong site")
+}
+
+func testFlagReadOnlyPost(t *testing.T, db Interface) {
+
+	req := FlagRequest{Locator: store.Locator{SiteID: "radio-t", URL: "url-1"}, Flag: ReadOnly}
+	val, err := db.Flag(req)
+	assert.NoError(t, err)
+	assert.False(t, val, "nothing ro")
+
+	req = FlagRequest{Locator: store.Locator{SiteID: "radio-t", URL: "url-1"}, Flag: ReadOnly, Update: FlagTrue}
+	val, err = db.Flag(req)
+	assert.NoError(t, err)
+	assert.Equal(t, true, val)
+	req = FlagRequest{Locator: store.Locator{SiteID: "radio-t", URL: "url-1"}, Flag: ReadOnly}
+	val, err = db.Flag(req)
+	assert.NoError(t, err)
+	assert.True(t, val, "url-1 ro")
+
+	req = FlagRequest{Locator: store.Locator{SiteID: "radio-t", URL: "url-2"}, Flag: ReadOnly}
+	val, err = db.Flag(req)
+	assert.NoError(t, err)
+	assert.False(t, val, "url-2 still writable")
+
+	req = FlagRequest{Locator: store.Locator{SiteID: "radio-t", URL: "url-1"}, Flag: ReadOnly, Update: FlagFalse}
+	_, err = db.Flag(req)
+	assert.NoError(t, err)
+	req = FlagRequest{Locator: store.Locator{SiteID: "radio-t", URL: "url-1"}, Flag: ReadOnly}
+	val, err = db.Flag(req)
+	assert.NoError(t, err)
+	assert.False(t, val, "url-1 writable")
+
+	req = FlagRequest{Locator: store.Locator{SiteID: "bad", URL: "url-1"}, Flag: ReadOnly, Update: FlagFalse}
+	_, err = db.Flag(req)
+	assert.EqualError(t, err, `site "bad" not found`)
+
+	req = FlagRequest{Locator: store.Locator{SiteID: "radio-t-bad", URL: "url-1"}, Flag: ReadOnly}
+	val, err = db.Flag(req)
+	assert.NoError(t, err)
+	assert.False(t, val, "nothing ro on wrong site")
+}
+
+func testFlagVerified(t *testing.T, db Interface) {
+
+	isVerified := func(site, user string) bool {
+		req := FlagRequest{Flag: Verified, Locator: store.Locator{SiteID: site}, UserID: user}
+		v, err := db.Flag(req)
+		require.NoError(t, err)
+		return v
+	}
+
+	setVerified := func(site, user string, status FlagStatus) error {
+		req := FlagRequest{Flag: Verified, Locator: store.Locator{SiteID: site}, UserID: user, Update: status}
+		_, err := db.Flag(req)
+		return err
+	}
+
+	assert.False(t, isVerified("radio-t", "u1"), "nothing verified")
+
+	assert.NoError(t, setVerified("radio-t", "u1", FlagTrue))
+	assert.True(t, isVerified("radio-t", "u1"), "u1 verified")
+
+	assert.False(t, isVerified("radio-t", "u2"), "u2 still not verified")
+	assert.NoError(t, setVerified("radio-t", "u1", FlagFalse))
+	assert.False(t, isVerified("radio-t", "u1"), "u1 not verified anymore")
+
+	assert.EqualError(t, setVerified("bad", "u1", FlagTrue), `site "bad" not found`)
+	assert.NoError(t, setVerified("radio-t", "u1xyz", FlagFalse))
+
+	assert.False(t, isVerified("radio-t-bad", "u1"), "nothing verified on wrong site")
+
+	assert.NoError(t, setVerified("radio-t", "u1", FlagTrue))
+	assert.NoError(t, setVerified("radio-t", "u2", FlagTrue))
+	assert.NoError(t, setVerified("radio-t", "u3", FlagFalse))
+}
+
+func testFlagListVerified(t *testing.T, db Interface) {
+
+	toIDs := func(inp []any) (res []string) {
+		res = make([]string, len(inp))
+		for i, v := range inp {
+			vv, ok := v.(string)
+			require.True(t, ok)
+			res[i] = vv
+		}
+		return res
+	}
+
+	setVerified := func(site, user string, status FlagStatus) error {
+		req := FlagRequest{Flag: Verified, Locator: store.Locator{SiteID: site}, UserID: user, Update: status}
+		_, err := db.Flag(req)
+		return err
+	}
+
+	ids, err := db.ListFlags(FlagRequest{Flag: Verified, Locator: store.Locator{SiteID: "radio-t"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, toIDs(ids), "verified list empty")
+
+	assert.NoError(t, setVerified("radio-t", "u1", FlagTrue))
+	assert.NoError(t, setVerified("radio-t", "u2", FlagTrue))
+	ids, err = db.ListFlags(FlagRequest{Flag: Verified, Locator: store.Locator{SiteID: "radio-t"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"u1", "u2"}, toIDs(ids), "verified 2 ids")
+
+	_, err = db.ListFlags(FlagRequest{Flag: Verified, Locator: store.Locator{SiteID: "radio-t-bad"}})
+	assert.Error(t, err, "site \"radio-t-bad\" not found", "fail on wrong site")
+}
+
+func testFlagShadowed(t *testing.T, db Interface) {
+
+	setShadowed := func(user string, status FlagStatus) {
+		_, err := db.Flag(FlagRequest{Flag: Shadowed, Locator: store.Locator{SiteID: "radio-t"}, UserID: user, Update: status})
+		require.NoError(t, err)
+	}
+	isShadowed := func(user string) bool {
+		v, err := db.Flag(FlagRequest{Flag: Shadowed, Locator: store.Locator{SiteID: "radio-t"}, UserID: user})
+		require.NoError(t, err)
+		return v
+	}
+
+	assert.False(t, isShadowed("u1"))
+	setShadowed("u1", FlagTrue)
+	setShadowed("u2", FlagTrue)
+	setShadowed("u2", FlagFalse)
+	assert.True(t, isShadowed("u1"))
+	assert.False(t, isShadowed("u2"))
+
+	ids, err := db.ListFlags(FlagRequest{Flag: Shadowed, Locator: store.Locator{SiteID: "radio-t"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"u1"}, ids)
+}
+
+func testCountShadowed(t *testing.T, db Interface) {
+	locator := store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}
+
+	setShadowed := func(status FlagStatus) {
+		_, err := db.Flag(FlagRequest{Flag: Shadowed, Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Update: status})
+		require.NoError(t, err)
+	}
+	checkCount := func(expected int) {
+		t.Helper()
+		count, err := db.Count(FindRequest{Locator: locator})
+		require.NoError(t, err)
+		assert.Equal(t, expected, count)
+		info, err := db.Info(InfoRequest{Locator: locator})
+		require.NoError(t, err)
+		assert.Equal(t, expected, info[0].Count)
+		infos, err := db.Info(InfoRequest{Locator: store.Locator{SiteID: "radio-t"}})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(infos))
+		assert.Equal(t, expected, infos[0].Count)
+	}
+
+	checkCount(2)
+	setShadowed(FlagTrue)
+	checkCount(0)
+	setShadowed(FlagTrue) // repeated ban doesn't change counts
+	checkCount(0)
+
+	_, err := db.Create(store.Comment{ID: "id-3", Locator: locator, User: store.User{ID: "user1"}, Text: "shadowed"})
+	require.NoError(t, err)
+	_, err = db.Create(store.Comment{ID: "id-4", Locator: locator, User: store.User{ID: "user2"}, Text: "visible"})
+	require.NoError(t, err)
+	checkCount(1)
+
+	err = db.Delete(DeleteRequest{Locator: locator, CommentID: "id-1", DeleteMode: store.SoftDelete})
+	require.NoError(t, err)
+	checkCount(1)
+
+	setShadowed(FlagFalse)
+	checkCount(3)
+}
+
+func testFlagListBlocked(t *testing.T, db Interface) {
+
+	setBlocked := func(site, user string, status FlagStatus, ttl time.Duration) error {
+		req := FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: site}, UserID: user, Update: status, TTL: ttl}
+		_, err := db.Flag(req)
+		return err
+	}
+
+	toBlocked := func(inp []any) (res []store.BlockedUser) {
+		res = make([]store.BlockedUser, len(inp))
+		for i, v := range inp {
+			vv, ok := v.(store.BlockedUser)
+			require.True(t, ok)
+			res[i] = vv
+		}
+		return res
+	}
+	assert.NoError(t, setBlocked("radio-t", "user1", FlagTrue, 0))
+	assert.NoError(t, setBlocked("radio-t", "user2", FlagTrue, 150*time.Millisecond))
+	assert.NoError(t, setBlocked("radio-t", "user3", FlagFalse, 0))
+
+	vv, err := db.ListFlags(FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}})
+	assert.NoError(t, err)
+
+	blockedList := toBlocked(vv)
+	require.Equal(t, 2, len(blockedList))
+	assert.Equal(t, "user1", blockedList[0].ID)
+	assert.Equal(t, "user name", blockedList[0].Name)
+	assert.Equal(t, "user2", blockedList[1].ID)
+	assert.Equal(t, "", blockedList[1].Name)
+	t.Logf("%+v", blockedList)
+
+	// check block expiration
+	time.Sleep(150 * time.Millisecond)
+	vv, err = db.ListFlags(FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "radio-t"}})
+	assert.NoError(t, err)
+	blockedList = toBlocked(vv)
+	require.Equal(t, 1, len(blockedList))
+	assert.Equal(t, "user1", blockedList[0].ID)
+
+	_, err = db.ListFlags(FlagRequest{Flag: Blocked, Locator: store.Locator{SiteID: "bad"}})
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func testUserDetail(t *testing.T, db Interface) {
+
+	// add two entries to DB before we start
+	result, err := db.UserDetail(UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u1", Detail: UserEmail, Update: "test@example.com"})
+	assert.NoError(t, err, "No error inserting entry expected")
+	assert.ElementsMatch(t, []UserDetailEntry{{UserID: "u1", Email: "test@example.com"}}, result)
+	result, err = db.UserDetail(UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u2", Detail: UserEmail, Update: "other@example.com"})
+	assert.NoError(t, err, "No error inserting entry expected")
+	assert.ElementsMatch(t, []UserDetailEntry{{UserID: "u2", Email: "other@example.com"}}, result)
+	result, err = db.UserDetail(UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u2", Detail: UserEmailDigest, Update: "daily"})
+	assert.NoError(t, err, "No error inserting entry expected")
+	assert.ElementsMatch(t, []UserDetailEntry{{UserID: "u2", Email: "other@example.com", EmailDigest: "daily"}}, result)
+	result, err = db.UserDetail(UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u2", Detail: UserMatrix, Update: "@u2:matrix.org"})
+	assert.NoError(t, err, "No error inserting entry expected")
+	assert.ElementsMatch(t, []UserDetailEntry{{UserID: "u2", Email: "other@example.com", EmailDigest: "daily", Matrix: "@u2:matrix.org"}}, result)
+	result, err = db.UserDetail(UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u2", Detail: UserWebPush, Update: "[]"})
+	assert.NoError(t, err)
+	assert.Equal(t, "[]", result[0].WebPush)
+
+	// stateless tests without changing the state we set up before
+	var testData = []struct {
+		req      UserDetailRequest
+		error    string
+		expected []UserDetailEntry
+	}{
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u1", Detail: UserEmail},
+			expected: []UserDetailEntry{{UserID: "u1", Email: "test@example.com"}}},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u2", Detail: UserEmailDigest},
+			expected: []UserDetailEntry{{UserID: "u2", EmailDigest: "daily"}}},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u2", Detail: UserMatrix},
+			expected: []UserDetailEntry{{UserID: "u2", Matrix: "@u2:matrix.org"}}},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u2", Detail: UserWebPush},
+			expected: []UserDetailEntry{{UserID: "u2", WebPush: "[]"}}},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, Detail: UserEmail},
+			error: "userid cannot be empty in request for single detail"},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, Detail: AllUserDetails, UserID: "u1"},
+			error: "unsupported request with userdetail all"},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "bad"}, UserID: "u1", Detail: UserEmail},
+			error: `site "bad" not found`},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "u1xyz", Detail: UserEmail}},
+		{req: UserDetailRequest{Detail: UserEmail, Update: "new_value"},
+			error: `userid cannot be empty in request for single detail`},
+		{req: UserDetailRequest{Detail: UserDetail("bad")},
+			error: `unsupported detail "bad"`},
+		{req: UserDetailRequest{Update: "not_relevant", Detail: AllUserDetails},
+			error: `unsupported request with userdetail all`},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "bad"}, Detail: AllUserDetails},
+			error: `site "bad" not found`},
+		{req: UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, Detail: AllUserDetails},
+			expected: []UserDetailEntry{{UserID: "u1", Email: "test@example.com"}, {UserID: "u2", Email: "other@example.com", EmailDigest: "daily", Matrix: "@u2:matrix.org", WebPush: "[]"}}},
+	}
+
+	for i, x := range testData {
+		result, err := db.UserDetail(x.req)
+		if x.error != "" {
+			assert.EqualError(t, err, x.error, "Error should match expected for case %d", i)
+		} else {
+			assert.NoError(t, err, "Error is not expected expected for case %d", i)
+		}
+		assert.ElementsMatch(t, x.expected, result, "Result should match expected for case %d", i)
+	}
+}
+
+func testDeleteComment(t *testing.T, db Interface) {
+
+	reqReq := FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, Sort: "time"}
+	res, err := db.Find(reqReq)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(res), "initially 2 comments")
+
+	count, err := db.Count(reqReq)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count, "count=2 initially")
+
+	delReq := DeleteRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		CommentID: res[0].ID, DeleteMode: store.SoftDelete}
+
+	err = db.Delete(delReq)
+	assert.NoError(t, err)
+
+	res, err = db.Find(reqReq)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "", res[0].Text)
+	assert.True(t, res[0].Deleted, "marked deleted")
+	assert.Equal(t, store.User{Name: "user name", ID: "user1", Picture: "", Admin: false, Blocked: false, IP: ""}, res[0].User)
+
+	// repeated deletion should not decrease comments count
+	err = db.Delete(delReq)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "some text2", res[1].Text)
+	assert.False(t, res[1].Deleted)
+
+	comments, err := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(comments), "1 in last, 1 removed")
+
+	count, err = db.Count(reqReq)
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	delReq.CommentID = "123456"
+	err = db.Delete(delReq)
+	assert.Error(t, err)
+
+	delReq.Locator.SiteID = "bad"
+	delReq.CommentID = res[0].ID
+	err = db.Delete(delReq)
+	assert.EqualError(t, err, `site "bad" not found`)
+
+	delReq.Locator = store.Locator{URL: "https://radio-t.com/bad", SiteID: "radio-t"}
+	err = db.Delete(delReq)
+	assert.EqualError(t, err, `no bucket https://radio-t.com/bad in store`)
+}
+
+func testDeleteHard(t *testing.T, db Interface) {
+
+	reqReq := FindRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, Sort: "time"}
+	res, err := db.Find(reqReq)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res), "initially 2 comments")
+
+	delReq := DeleteRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		CommentID: res[0].ID, DeleteMode: store.HardDelete}
+	err = db.Delete(delReq)
+	assert.NoError(t, err)
+
+	res, err = db.Find(reqReq)
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "", res[0].Text)
+	assert.True(t, res[0].Deleted, "marked deleted")
+	assert.Equal(t, store.User{Name: "deleted", ID: "deleted", Picture: "", Admin: false, Blocked: false, IP: ""}, res[0].User)
+}
+
+func testDeleteAll(t *testing.T, db Interface) {
+
+	delReq := DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}}
+	err := db.Delete(delReq)
+	assert.NoError(t, err)
+
+	comments, err := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(comments), "nothing left")
+
+	_, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}})
+	assert.EqualError(t, err, "no bucket https://radio-t.com in store")
+
+	delReq = DeleteRequest{Locator: store.Locator{SiteID: "bad"}}
+	err = db.Delete(delReq)
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func testDeleteUserDetail(t *testing.T, db Interface) {
+	var (
+		createUser = UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Detail: UserEmail, Update: "value1"}
+		readUser   = UserDetailRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Detail: UserEmail}
+		emailSet   = []UserDetailEntry{{UserID: "user1", Email: "value1"}}
+	)
+
+	var testData = []struct {
+		delReq    DeleteRequest
+		detailReq UserDetailRequest
+		expected  []UserDetailEntry
+		err       string
+	}{
+		{delReq: DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", UserDetail: UserEmail},
+			detailReq: createUser, expected: emailSet},
+		{delReq: DeleteRequest{Locator: store.Locator{SiteID: "bad"}, UserID: "user1", UserDetail: UserEmail},
+			detailReq: readUser, expected: emailSet, err: `site "bad" not found`},
+		{delReq: DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", UserDetail: UserEmail},
+			detailReq: readUser},
+		{delReq: DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", UserDetail: AllUserDetails},
+			detailReq: createUser, expected: emailSet},
+		{delReq: DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", UserDetail: AllUserDetails},
+			detailReq: readUser},
+	}
+
+	for i, x := range testData {
+		err := db.Delete(x.delReq)
+		if x.err == "" {
+			require.NoError(t, err, "delete request #%d error", i)
+		} else {
+			require.EqualError(t, err, x.err, "delete request #%d error", i)
+		}
+
+		val, err := db.UserDetail(x.detailReq)
+		require.NoError(t, err, "user request #%d error", i)
+		require.Equal(t, x.expected, val, "user request #%d result", i)
+	}
+}
+
+func testDeleteUserHard(t *testing.T, db Interface) {
+
+	comments, err := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}, Sort: "time"})
+	assert.NoError(t, err)
+
+	// soft delete one comment
+	delReq := DeleteRequest{
+		Locator:    store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		CommentID:  comments[0].ID,
+		DeleteMode: store.SoftDelete,
+	}
+	err = db.Delete(delReq)
+	assert.NoError(t, err)
+
+	err = db.Delete(DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", DeleteMode: store.HardDelete})
+	require.NoError(t, err)
+
+	comments, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}, Sort: "time"})
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(comments), "2 comments with deleted info")
+	assert.Equal(t, store.User{Name: "deleted", ID: "deleted", Picture: "", Admin: false, Blocked: false, IP: ""}, comments[0].User)
+	assert.Equal(t, store.User{Name: "deleted", ID: "deleted", Picture: "", Admin: false, Blocked: false, IP: ""}, comments[1].User)
+
+	c, err := db.Count(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c, "0 count")
+
+	_, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Limit: 5})
+	assert.EqualError(t, err, "no comments for user user1 in store")
+
+	comments, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "time"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(comments), "nothing left")
+
+	err = db.Delete(DeleteRequest{Locator: store.Locator{SiteID: "radio-t-bad"}, UserID: "user1"})
+	assert.EqualError(t, err, `site "radio-t-bad" not found`)
+}
+
+// TestBoltAdmin_DeleteUserHard_NoComments covers hard-deleting a user who has no comments
+// (and therefore no user bucket) — e.g. one who only logged in. This must succeed rather than
+// fail on the missing bucket, and must still remove any stored user details.
+func testDeleteUserHardNoComments(t *testing.T, db Interface) {
+
+	t.Run("login-only user with a detail but no comments", func(t *testing.T) {
+		const userID = "login-only-user"
+		loc := store.Locator{SiteID: "radio-t"}
+
+		// user logged in and has a stored detail, but never commented (no user bucket)
+		_, err := db.UserDetail(UserDetailRequest{Locator: loc, UserID: userID, Detail: UserEmail, Update: "user@example.com"})
+		require.NoError(t, err)
+
+		err = db.Delete(DeleteRequest{Locator: loc, UserID: userID, DeleteMode: store.HardDelete})
+		require.NoError(t, err, "hard delete must not fail on a missing user bucket")
+
+		details, err := db.UserDetail(UserDetailRequest{Locator: loc, UserID: userID, Detail: UserEmail})
+		require.NoError(t, err)
+		assert.Empty(t, details, "stored user detail must be removed on hard delete")
+	})
+
+	t.Run("unknown user is a no-op", func(t *testing.T) {
+		err := db.Delete(DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "never-seen-user", DeleteMode: store.HardDelete})
+		assert.NoError(t, err, "hard-deleting an unknown user must not error")
+	})
+}
+
+// TestBoltAdmin_DeleteUserSoft_NoComments covers soft-deleting a user with no comments. As with the
+// hard path (and the existing soft path for users who do have comments) it cleans stored user
+// details and is a no-op for an unknown user.
+func testDeleteUserSoftNoComments(t *testing.T, db Interface) {
+
+	t.Run("login-only user with a detail but no comments", func(t *testing.T) {
+		const userID = "login-only-soft"
+		loc := store.Locator{SiteID: "radio-t"}
+
+		_, err := db.UserDetail(UserDetailRequest{Locator: loc, UserID: userID, Detail: UserEmail, Update: "user@example.com"})
+		require.NoError(t, err)
+
+		err = db.Delete(DeleteRequest{Locator: loc, UserID: userID, DeleteMode: store.SoftDelete})
+		require.NoError(t, err)
+
+		details, err := db.UserDetail(UserDetailRequest{Locator: loc, UserID: userID, Detail: UserEmail})
+		require.NoError(t, err)
+		assert.Empty(t, details, "soft delete cleans stored user details, consistent with the has-comments path")
+	})
+
+	t.Run("unknown user is a no-op", func(t *testing.T) {
+		err := db.Delete(DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "never-seen-soft", DeleteMode: store.SoftDelete})
+		assert.NoError(t, err, "soft-deleting an unknown user must not error")
+	})
+}
+
+func testDeleteUserSoft(t *testing.T, db Interface) {
+
+	comments, err := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}, Sort: "time"})
+	assert.NoError(t, err)
+
+	// soft delete one comment
+	delReq := DeleteRequest{
+		Locator:    store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		CommentID:  comments[0].ID,
+		DeleteMode: store.SoftDelete,
+	}
+	err = db.Delete(delReq)
+	assert.NoError(t, err)
+
+	err = db.Delete(DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", DeleteMode: store.SoftDelete})
+	require.NoError(t, err)
+
+	comments, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}, Sort: "time"})
+	assert.NoError(t, err)
+	require.Equal(t, 2, len(comments), "2 comments with deleted info")
+	assert.Equal(t, store.User{Name: "user name", ID: "user1", Picture: "", Admin: false, Blocked: false, IP: ""}, comments[0].User)
+	assert.Equal(t, store.User{Name: "user name", ID: "user1", Picture: "", Admin: false, Blocked: false, IP: ""}, comments[1].User)
+
+	c, err := db.Count(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c, "0 count")
+
+	comments, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Limit: 5})
+	assert.NoError(t, err, "no comments for user user1 in store")
+	require.Equal(t, 2, len(comments), "2 comments with deleted info")
+	assert.True(t, comments[0].Deleted)
+	assert.True(t, comments[1].Deleted)
+	assert.Equal(t, "", comments[0].Text)
+	assert.Equal(t, "", comments[1].Text)
+
+	comments, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Sort: "time"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(comments), "nothing left")
+
+	err = db.Delete(DeleteRequest{Locator: store.Locator{SiteID: "radio-t-bad"}, UserID: "user1"})
+	assert.EqualError(t, err, `site "radio-t-bad" not found`)
+}
+
+func testSearch(t *testing.T, db Interface) {
+
+	_, err := db.Create(store.Comment{ID: "id-3", Text: `check <a href="https://example.com/some/page">this</a> Ünïcode`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 24, 0, time.UTC), PostTitle: "Podcast 123",
+		Locator: store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, User: store.User{ID: "user2", Name: "Jane User"}})
+	require.NoError(t, err)
+
+	search := func(query string) (ids []string) {
+		res, e := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: query, Sort: "time"})
+		require.NoError(t, e)
+		ids = []string{}
+		for _, c := range res {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"id-1", "id-2"}, search("some text"))
+	assert.Equal(t, []string{"id-2"}, search("TEXT2"))
+	assert.Equal(t, []string{"id-1", "id-2", "id-3"}, search("user"), "user name and text prefix")
+	assert.Equal(t, []string{"id-3"}, search("example.com/some"), "link")
+	assert.Equal(t, []string{"id-3"}, search("jane"), "user name")
+	assert.Equal(t, []string{"id-3"}, search("podcast 12"), "post title")
+	assert.Equal(t, []string{"id-3"}, search("ünï"))
+	assert.Equal(t, []string{}, search("text podcast"), "all words should match")
+	assert.Equal(t, []string{}, search("ext"), "only prefix match")
+	assert.Equal(t, []string{}, search("...."), "no words in query")
+
+	// update drops old words and adds new ones
+	comment, err := db.Get(getReq(store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, "id-2"))
+	require.NoError(t, err)
+	comment.Text = "updated content"
+	require.NoError(t, db.Update(comment))
+	assert.Equal(t, []string{}, search("text2"))
+	assert.Equal(t, []string{"id-2"}, search("updated"))
+
+	// limit, skip and sort
+	res, err := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: "user", Sort: "-time", Limit: 1, Skip: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-2", res[0].ID)
+
+	// deleted comment excluded
+	err = db.Delete(DeleteRequest{Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, CommentID: "id-1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{}, search("link"), "deleted text not searchable")
+	assert.Equal(t, []string{"id-2"}, search("user name"))
+	res, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: "user name", Sort: "time", Deleted: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "deleted included on request")
+	assert.True(t, res[0].Deleted)
+
+	// hidden comments excluded before pagination
+	res, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: "user", Sort: "-time", Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-3", res[0].ID)
+	_, err = db.Flag(FlagRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user2", Flag: Blocked, Update: FlagTrue})
+	require.NoError(t, err)
+	res, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: "user", Sort: "-time", Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "page is full with blocked user's comment excluded")
+	assert.Equal(t, "id-2", res[0].ID)
+	_, err = db.Flag(FlagRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user2", Flag: Blocked, Update: FlagFalse})
+	require.NoError(t, err)
+
+	// pending comments and comments of shadow-banned users visible to their author and admin only
+	comment, err = db.Get(getReq(store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"}, "id-3"))
+	require.NoError(t, err)
+	comment.Pending = true
+	require.NoError(t, db.Update(comment))
+	_, err = db.Flag(FlagRequest{Locator: store.Locator{SiteID: "radio-t"}, UserID: "user1", Flag: Shadowed, Update: FlagTrue})
+	require.NoError(t, err)
+	viewerSearch := func(viewerID string, admin bool) (ids []string) {
+		res, e := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: "user", Sort: "time",
+			ViewerID: viewerID, ViewerAdmin: admin})
+		require.NoError(t, e)
+		ids = []string{}
+		for _, c := range res {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{}, viewerSearch("", false))
+	assert.Equal(t, []string{"id-2"}, viewerSearch("user1", false))
+	assert.Equal(t, []string{"id-3"}, viewerSearch("user2", false))
+	assert.Equal(t, []string{"id-2", "id-3"}, viewerSearch("admin", true))
+
+	// search limited to post
+	res, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t", URL: "https://radio-t.com/2"}, Query: "user", ViewerAdmin: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-3", res[0].ID)
+
+	_, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "bad"}, Query: "user"})
+	assert.EqualError(t, err, `site "bad" not found`)
+
+	// site deletion clears index
+	require.NoError(t, db.Delete(DeleteRequest{Locator: store.Locator{SiteID: "radio-t"}}))
+	assert.Equal(t, []string{}, search("user"))
+}
+
+func testPending(t *testing.T, db Interface) {
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	for i, id := range []string{"id-3", "id-4"} {
+		_, err := db.Create(store.Comment{ID: id, Text: "pending text", Pending: true, Locator: loc,
+			Timestamp: time.Date(2017, 12, 20, 15, 18, 24+i, 0, time.UTC), User: store.User{ID: "user2"}})
+		require.NoError(t, err)
+	}
+	_, err := db.Create(store.Comment{ID: "id-5", Text: "pending text", Pending: true,
+		Locator:   store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"},
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 30, 0, time.UTC), User: store.User{ID: "user2"}})
+	require.NoError(t, err)
+
+	pending := func(locator store.Locator) (ids []string) {
+		res, e := db.Find(FindRequest{Locator: locator, Pending: true, Sort: "time"})
+		require.NoError(t, e)
+		ids = []string{}
+		for _, c := range res {
+			assert.True(t, c.Pending)
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	count := func() int {
+		c, e := db.Count(FindRequest{Locator: loc})
+		require.NoError(t, e)
+		return c
+	}
+
+	assert.Equal(t, []string{"id-3", "id-4", "id-5"}, pending(store.Locator{SiteID: "radio-t"}))
+	assert.Equal(t, []string{"id-3", "id-4"}, pending(loc), "limited to post")
+	assert.Equal(t, 2, count(), "pending comments not counted")
+	info, err := db.Info(InfoRequest{Locator: loc})
+	require.NoError(t, err)
+	assert.Equal(t, 2, info[0].Count)
+
+	res, err := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Pending: true, Sort: "-time", Limit: 1, Skip: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-4", res[0].ID, "limit, skip and sort")
+
+	// approve
+	comment, err := db.Get(getReq(loc, "id-3"))
+	require.NoError(t, err)
+	comment.Pending = false
+	require.NoError(t, db.Update(comment))
+	assert.Equal(t, []string{"id-4", "id-5"}, pending(store.Locator{SiteID: "radio-t"}))
+	assert.Equal(t, 3, count(), "approved comment counted")
+
+	// reject
+	require.NoError(t, db.Delete(DeleteRequest{Locator: loc, CommentID: "id-4"}))
+	assert.Equal(t, []string{"id-5"}, pending(store.Locator{SiteID: "radio-t"}), "deleted comment not in the queue")
+	assert.Equal(t, 3, count())
+	comment, err = db.Get(getReq(loc, "id-4"))
+	require.NoError(t, err)
+	assert.True(t, comment.Deleted)
+	assert.True(t, comment.Pending, "rejected comment stays hidden")
+
+	_, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "bad"}, Pending: true})
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+func testReported(t *testing.T, db Interface) {
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	reported := func(locator store.Locator) (ids []string) {
+		res, e := db.Find(FindRequest{Locator: locator, Reported: true, Sort: "-reports"})
+		require.NoError(t, e)
+		ids = []string{}
+		for _, c := range res {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{}, reported(store.Locator{SiteID: "radio-t"}))
+
+	_, err := db.Create(store.Comment{ID: "id-3", Text: "imported with report",
+		Locator:   store.Locator{URL: "https://radio-t.com/2", SiteID: "radio-t"},
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 24, 0, time.UTC), User: store.User{ID: "user2"},
+		Reports: map[string]store.Report{"user1": {Reason: store.ReportSpam}}})
+	require.NoError(t, err)
+
+	for id, reports := range map[string]map[string]store.Report{
+		"id-1": {"user2": {Reason: store.ReportSpam}},
+		"id-2": {"user2": {Reason: store.ReportAbuse}, "user3": {Reason: store.ReportOther, Note: "note"}},
+	} {
+		comment, e := db.Get(getReq(loc, id))
+		require.NoError(t, e)
+		comment.Reports = reports
+		require.NoError(t, db.Update(comment))
+	}
+	assert.Equal(t, []string{"id-2", "id-1", "id-3"}, reported(store.Locator{SiteID: "radio-t"}), "sorted by number of reports")
+	assert.Equal(t, []string{"id-2", "id-1"}, reported(loc), "limited to post")
+
+	res, err := db.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Reported: true, Sort: "-reports", Limit: 1, Skip: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-1", res[0].ID, "limit and skip")
+
+	// dismiss reports
+	comment, err := db.Get(getReq(loc, "id-2"))
+	require.NoError(t, err)
+	assert.Equal(t, "note", comment.Reports["user3"].Note)
+	comment.Reports = nil
+	require.NoError(t, db.Update(comment))
+	assert.Equal(t, []string{"id-1", "id-3"}, reported(store.Locator{SiteID: "radio-t"}))
+
+	// deleted comment has no reports
+	require.NoError(t, db.Delete(DeleteRequest{Locator: loc, CommentID: "id-1"}))
+	assert.Equal(t, []string{"id-3"}, reported(store.Locator{SiteID: "radio-t"}))
+
+	_, err = db.Find(FindRequest{Locator: store.Locator{SiteID: "bad"}, Reported: true})
+	assert.EqualError(t, err, `site "bad" not found`)
+}
+
+// prepComments makes two comments of user1 for https://radio-t.com
+func prepComments(t *testing.T, db Interface) {
+	comment := store.Comment{
+		ID:        "id-1",
+		Text:      `some text, <a href="http://radio-t.com">link</a>`,
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 22, 0, time.UTC),
+		Locator:   store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err := db.Create(comment)
+	require.NoError(t, err)
+
+	comment = store.Comment{
+		ID:        "id-2",
+		Text:      "some text2",
+		Timestamp: time.Date(2017, 12, 20, 15, 18, 23, 0, time.UTC),
+		Locator:   store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"},
+		User:      store.User{ID: "user1", Name: "user name"},
+	}
+	_, err = db.Create(comment)
+	require.NoError(t, err)
+}
+
+func getReq(locator store.Locator, commentID string) GetRequest {
+	return GetRequest{Locator: locator, CommentID: commentID}
 }
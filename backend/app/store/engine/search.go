@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"html"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/microcosm-cc/bluemonday"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// search matches comment words by prefix. Query "radio-t.com/pod" is split to "radio", "t", "com", "pod"
+// and comment matches if each of query words is a prefix of some word in comment's text, user name or post title.
+// Links from comment's text are indexed as well, so searching for an url finds all comments linking it.
+
+const searchLimit = 100
+
+var reSearchLink = regexp.MustCompile(`(?:href|src)="([^"]*)"`)
+
+// MatchSearch checks if comment matches full-text search query. Empty query matches nothing.
+// Used by engines without own search index.
+func MatchSearch(comment store.Comment, query string) bool {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return false
+	}
+	words := searchWords(comment)
+	for _, term := range terms {
+		if !slices.ContainsFunc(words, func(w string) bool { return strings.HasPrefix(w, term) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchFilter returns function checking if found comment should be in search results. Deleted comments and
+// comments of blocked users included with req.Deleted only. Pending comments and comments of shadow-banned users
+// included for the admin and their author only. flagged reports user's flag, it is called once per user.
+// Engines apply the filter before the pagination, so each page of results is full.
+func SearchFilter(req FindRequest, flagged func(flag Flag, userID string) bool) func(c store.Comment) bool {
+	type userFlag struct {
+		flag   Flag
+		userID string
+	}
+	flags := map[userFlag]bool{}
+	check := func(flag Flag, userID string) bool {
+		key := userFlag{flag: flag, userID: userID}
+		val, ok := flags[key]
+		if !ok {
+			val = flagged(flag, userID)
+			flags[key] = val
+		}
+		return val
+	}
+
+	visible := ViewerFilter(req, func(userID string) bool { return check(Shadowed, userID) })
+	return func(c store.Comment) bool {
+		if !req.Deleted && (c.Deleted || check(Blocked, c.User.ID)) {
+			return false
+		}
+		return visible(c)
+	}
+}
+
+// ViewerFilter returns function checking if comment is visible to the viewer of the request. Pending comments
+// and comments of shadow-banned users visible to the admin and their author only. shadowed reports if user is
+// shadow-banned, it is called once per user. Engines apply the filter before the pagination of last and user's
+// comments with req.Visible set, so each page is full.
+func ViewerFilter(req FindRequest, shadowed func(userID string) bool) func(c store.Comment) bool {
+	users := map[string]bool{}
+	return func(c store.Comment) bool {
+		if req.ViewerAdmin || (req.ViewerID != "" && c.User.ID == req.ViewerID) {
+			return true
+		}
+		if c.Pending {
+			return false
+		}
+		val, ok := users[c.User.ID]
+		if !ok {
+			val = shadowed(c.User.ID)
+			users[c.User.ID] = val
+		}
+		return !val
+	}
+}
+
+// searchWords returns unique, sorted list of lowercase words for comment's text, links, user name and post title
+func searchWords(comment store.Comment) []string {
+	links := []string{}
+	for _, m := range reSearchLink.FindAllStringSubmatch(comment.Text, -1) {
+		links = append(links, m[1])
+	}
+	text := html.UnescapeString(bluemonday.StrictPolicy().Sanitize(comment.Text))
+	doc := strings.Join(append(links, text, comment.User.Name, comment.PostTitle), " ")
+
+	words := searchTerms(doc)
+	slices.Sort(words)
+	return slices.Compact(words)
+}
+
+// searchTerms splits text to lowercase words, anything but letters and digits is a separator
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// searchPage applies skip and limit to search results, limit defaults to and capped by searchLimit
+func searchPage(comments []store.Comment, limit, skip int) []store.Comment {
+	if limit <= 0 || limit > searchLimit {
+		limit = searchLimit
+	}
+	if skip < 0 {
+		skip = 0
+	}
+	if skip >= len(comments) {
+		return []store.Comment{}
+	}
+	return comments[skip:min(skip+limit, len(comments))]
+}
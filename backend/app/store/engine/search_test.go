@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestMatchSearch(t *testing.T) {
+	c := store.Comment{
+		Text:      `<p>Some <b>bold</b> text, <a href="https://radio-t.com/p/2024/">link</a> &amp; more</p>`,
+		User:      store.User{ID: "user1", Name: "John Smith"},
+		PostTitle: "Episode 900",
+	}
+
+	tbl := []struct {
+		query string
+		match bool
+	}{
+		{"some", true},
+		{"SOME BOLD", true},
+		{"bo tex", true},
+		{"old", false},
+		{"radio-t.com/p/2024", true},
+		{"https", true},
+		{"john", true},
+		{"user1", false},
+		{"episode 9", true},
+		{"p", true},
+		{"amp", false},
+		{"more episode smith", true},
+		{"more missing", false},
+		{"", false},
+		{" ,.! ", false},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.match, MatchSearch(c, tt.query))
+		})
+	}
+}
+
+func TestSearchFilter(t *testing.T) {
+	calls := 0
+	flagged := func(flag Flag, userID string) bool {
+		calls++
+		return (flag == Blocked && userID == "blocked") || (flag == Shadowed && userID == "shadowed")
+	}
+	regular := store.Comment{User: store.User{ID: "user1"}}
+	deleted := store.Comment{User: store.User{ID: "user1"}, Deleted: true}
+	pending := store.Comment{User: store.User{ID: "user1"}, Pending: true}
+	blocked := store.Comment{User: store.User{ID: "blocked"}}
+	shadowed := store.Comment{User: store.User{ID: "shadowed"}}
+
+	tbl := []struct {
+		req  FindRequest
+		want []bool // regular, deleted, pending, blocked, shadowed
+	}{
+		{FindRequest{}, []bool{true, false, false, false, false}},
+		{FindRequest{ViewerID: "user1"}, []bool{true, false, true, false, false}},
+		{FindRequest{ViewerID: "shadowed"}, []bool{true, false, false, false, true}},
+		{FindRequest{ViewerID: "admin", ViewerAdmin: true}, []bool{true, false, true, false, true}},
+		{FindRequest{ViewerID: "admin", ViewerAdmin: true, Deleted: true}, []bool{true, true, true, true, true}},
+	}
+	for i, tt := range tbl {
+		calls = 0
+		visible := SearchFilter(tt.req, flagged)
+		res := []bool{}
+		for _, c := range []store.Comment{regular, deleted, pending, blocked, shadowed, regular, blocked} {
+			res = append(res, visible(c))
+		}
+		assert.Equal(t, tt.want, res[:5], "case #%d", i)
+		assert.LessOrEqual(t, calls, 5, "each flag checked once per user, case #%d", i)
+	}
+}
+
+func TestSearchWords(t *testing.T) {
+	c := store.Comment{Text: `<p>text Text <img src="/api/v1/picture/dev/pic.png"/></p>`, User: store.User{Name: "Dev"}}
+	assert.Equal(t, []string{"api", "dev", "pic", "picture", "png", "text", "v1"}, searchWords(c))
+}
+
+func TestSearchPage(t *testing.T) {
+	cc := make([]store.Comment, 150)
+	for i := range cc {
+		cc[i].ID = string(rune('a' + i%26))
+	}
+
+	assert.Equal(t, searchLimit, len(searchPage(cc, 0, 0)), "default limit")
+	assert.Equal(t, searchLimit, len(searchPage(cc, 1000, 0)), "limit capped")
+	assert.Equal(t, 10, len(searchPage(cc, 10, -1)))
+	assert.Equal(t, 5, len(searchPage(cc, 10, 145)))
+	assert.Equal(t, "c", searchPage(cc, 10, 2)[0].ID)
+	assert.Equal(t, []store.Comment{}, searchPage(cc, 10, 150))
+}
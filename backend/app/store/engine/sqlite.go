@@ -0,0 +1,908 @@
+package engine
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	_ "modernc.org/sqlite" // pure-go sqlite driver, registers "sqlite"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// SQLite implements store.Interface on top of a single sqlite database file shared by all sites. Thread safe.
+// Unlike BoltDB it allows reading the data with standard sqlite tooling while the server is running.
+// Tables:
+//   - comments keeps every comment as json in data column, with site, url, id, user_id, ts, deleted and pending
+//     copied to separate columns for filtering. ts is unix time in nanoseconds. reports is number of user reports.
+//     search column keeps space-separated words used for full-text search
+//   - flags keeps readonly posts and verified/blocked/shadowed users. key is post url or user id, until is
+//     the expiration time for blocked users (unix nanoseconds) and the set time for other flags
+//   - user_details keeps UserDetailEntry as json in data column, keyed by site and user id
+type SQLite struct {
+	db    *sql.DB
+	sites []string
+}
+
+// sqliteConn is implemented by both *sql.DB and *sql.Tx, allows to run load and save inside transaction
+type sqliteConn interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS comments (
+	site TEXT NOT NULL,
+	url TEXT NOT NULL,
+	id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	ts INTEGER NOT NULL,
+	deleted INTEGER NOT NULL DEFAULT 0,
+	pending INTEGER NOT NULL DEFAULT 0,
+	reports INTEGER NOT NULL DEFAULT 0,
+	data TEXT NOT NULL,
+	search TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (site, url, id)
+);
+CREATE INDEX IF NOT EXISTS idx_comments_site_ts ON comments (site, ts);
+CREATE INDEX IF NOT EXISTS idx_comments_site_user ON comments (site, user_id, ts);
+CREATE TABLE IF NOT EXISTS flags (
+	site TEXT NOT NULL,
+	flag TEXT NOT NULL,
+	key TEXT NOT NULL,
+	until INTEGER NOT NULL,
+	PRIMARY KEY (site, flag, key)
+);
+CREATE TABLE IF NOT EXISTS user_details (
+	site TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	data TEXT NOT NULL,
+	PRIMARY KEY (site, user_id)
+);`
+
+// NewSQLite makes persistent sqlite-based store. All sites share the same database file
+func NewSQLite(fileName string, busyTimeout time.Duration, sites ...string) (*SQLite, error) {
+	log.Printf("[INFO] sqlite store for sites %+v, file %s", sites, fileName)
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_txlock=immediate",
+		fileName, busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite %s: %w", fileName, err)
+	}
+	// single connection serializes writers and keeps the per-connection pragmas in effect
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create sqlite schema in %s: %w", fileName, err)
+	}
+	res := &SQLite{db: db, sites: sites}
+	if err = res.migrate(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to migrate sqlite schema in %s: %w", fileName, err)
+	}
+	return res, nil
+}
+
+// Create saves new comment to store
+func (s *SQLite) Create(comment store.Comment) (commentID string, err error) {
+	if err = s.checkSite(comment.Locator.SiteID); err != nil {
+		return "", err
+	}
+
+	if s.checkFlag(FlagRequest{Locator: comment.Locator, Flag: ReadOnly}) {
+		return "", fmt.Errorf("post %s is read-only", comment.Locator.URL)
+	}
+
+	data, err := json.Marshal(comment)
+	if err != nil {
+		return "", fmt.Errorf("can't marshal comment: %w", err)
+	}
+
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO comments (site, url, id, user_id, ts, deleted, pending, reports, data, search)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, comment.Locator.SiteID, comment.Locator.URL, comment.ID, comment.User.ID,
+		comment.Timestamp.UnixNano(), comment.Deleted, comment.Pending, len(comment.Reports), data, sqliteSearchValue(comment))
+	if err != nil {
+		return "", fmt.Errorf("failed to insert comment %s for %s: %w", comment.ID, comment.Locator.URL, err)
+	}
+	if n, e := res.RowsAffected(); e == nil && n == 0 {
+		return "", fmt.Errorf("key %s already in store", comment.ID)
+	}
+	return comment.ID, nil
+}
+
+// Get returns comment for locator.URL and commentID string
+func (s *SQLite) Get(req GetRequest) (comment store.Comment, err error) {
+	if err = s.checkSite(req.Locator.SiteID); err != nil {
+		return comment, err
+	}
+	return s.load(s.db, req.Locator, req.CommentID)
+}
+
+// Find returns all comments for given request and sorts results
+func (s *SQLite) Find(req FindRequest) (comments []store.Comment, err error) {
+	if err = s.checkSite(req.Locator.SiteID); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case req.Locator.SiteID != "" && req.Query != "": // full-text search for site, or for post if url set
+		if comments, err = s.searchComments(req); err != nil {
+			return nil, err
+		}
+		return searchPage(SortComments(comments, req.Sort), req.Limit, req.Skip), nil
+	case req.Locator.SiteID != "" && req.Pending: // comments awaiting approval for site, or for post if url set
+		if comments, err = s.indexedComments(req.Locator, "pending = 1"); err != nil {
+			return nil, err
+		}
+		return searchPage(SortComments(comments, req.Sort), req.Limit, req.Skip), nil
+	case req.Locator.SiteID != "" && req.Reported: // reported comments for site, or for post if url set
+		if comments, err = s.indexedComments(req.Locator, "reports > 0"); err != nil {
+			return nil, err
+		}
+		return searchPage(SortComments(comments, req.Sort), req.Limit, req.Skip), nil
+	case req.Locator.SiteID != "" && req.Locator.URL != "": // find post comments, i.e. for site and url
+		comments, err = s.postComments(req)
+	case req.Locator.SiteID != "" && req.Locator.URL == "" && req.UserID == "": // find last comments for site
+		comments, err = s.lastComments(req)
+	case req.Locator.SiteID != "" && req.UserID != "": // find comments for user
+		comments, err = s.userComments(req)
+	default:
+		comments = []store.Comment{}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return SortComments(comments, req.Sort), nil
+}
+
+// Flag sets and gets flag values
+func (s *SQLite) Flag(req FlagRequest) (val bool, err error) {
+	if req.Update == FlagNonSet { // read flag value, no update requested
+		return s.checkFlag(req), nil
+	}
+
+	// write flag value
+	return s.setFlag(req)
+}
+
+// UserDetail sets or gets single detail value, or gets all details for requested site.
+// UserDetail returns list even for single entry request is a compromise in order to have both single detail getting and setting
+// and all site's details listing under the same function (and not to extend interface by two separate functions).
+func (s *SQLite) UserDetail(req UserDetailRequest) ([]UserDetailEntry, error) {
+	switch req.Detail {
+	case UserEmail, UserTelegram, UserEmailDigest, UserMatrix, UserWebPush:
+		if req.UserID == "" {
+			return nil, fmt.Errorf("userid cannot be empty in request for single detail")
+		}
+		if err := s.checkSite(req.Locator.SiteID); err != nil {
+			return nil, err
+		}
+
+		if req.Update == "" { // read detail value, no update requested
+			return s.getUserDetail(req)
+		}
+
+		return s.setUserDetail(req)
+	case AllUserDetails:
+		// list of all details returned in case request is a read request
+		// (Update is not set) and does not have UserID
+		if req.Update == "" && req.UserID == "" { // read list of all details
+			return s.listDetails(req.Locator)
+		}
+		return nil, fmt.Errorf("unsupported request with userdetail all")
+	default:
+		return nil, fmt.Errorf("unsupported detail %q", req.Detail)
+	}
+}
+
+// Update for locator.URL with mutable part of comment
+func (s *SQLite) Update(comment store.Comment) error {
+	if err := s.checkSite(comment.Locator.SiteID); err != nil {
+		return err
+	}
+
+	return s.update(func(tx *sql.Tx) error {
+		curComment, err := s.load(tx, comment.Locator, comment.ID)
+		if err != nil {
+			return err
+		}
+		// preserve immutable fields
+		comment.ParentID = curComment.ParentID
+		comment.Locator = curComment.Locator
+		comment.Timestamp = curComment.Timestamp
+		comment.User = curComment.User
+
+		return s.save(tx, comment)
+	})
+}
+
+// sqliteCounted matches comments counted for post, i.e. not deleted, not pending and not by shadow-banned user
+const sqliteCounted = `deleted = 0 AND pending = 0 AND user_id NOT IN ` +
+	`(SELECT key FROM flags WHERE flags.site = comments.site AND flag = '` + string(Shadowed) + `')`
+
+// Count returns number of comments for post or user
+func (s *SQLite) Count(req FindRequest) (count int, err error) {
+	if err = s.checkSite(req.Locator.SiteID); err != nil {
+		return 0, err
+	}
+
+	if req.Locator.URL != "" { // comment's count for post
+		err = s.db.QueryRow(`SELECT COUNT(*) FROM comments WHERE site = ? AND url = ? AND `+sqliteCounted,
+			req.Locator.SiteID, req.Locator.URL).Scan(&count)
+		return count, err
+	}
+
+	if req.UserID != "" { // comment's count for user
+		err = s.db.QueryRow(`SELECT COUNT(*) FROM comments WHERE site = ? AND user_id = ?`,
+			req.Locator.SiteID, req.UserID).Scan(&count)
+		if err == nil && count == 0 {
+			return 0, fmt.Errorf("no comments for user %s in store for %s site", req.UserID, req.Locator.SiteID)
+		}
+		if err != nil || !req.Visible {
+			return count, err
+		}
+		cond, args := sqliteVisible(req)
+		err = s.db.QueryRow(`SELECT COUNT(*) FROM comments WHERE site = ? AND user_id = ?`+cond,
+			append([]any{req.Locator.SiteID, req.UserID}, args...)...).Scan(&count)
+		return count, err
+	}
+
+	return 0, fmt.Errorf("invalid count request %+v", req)
+}
+
+// Info get post(s) meta info
+func (s *SQLite) Info(req InfoRequest) ([]store.PostInfo, error) {
+	if err := s.checkSite(req.Locator.SiteID); err != nil {
+		return []store.PostInfo{}, err
+	}
+
+	// comments awaiting approval don't reveal the post and don't change its first and last time,
+	// the same for comments not counted for post. Post without counted comments has both times set to its first comment
+	const infoQuery = `SELECT url, SUM(CASE WHEN ` + sqliteCounted + ` THEN 1 ELSE 0 END), ` +
+		`COALESCE(MIN(CASE WHEN ` + sqliteCounted + ` THEN ts END), MIN(ts)), ` +
+		`COALESCE(MAX(CASE WHEN ` + sqliteCounted + ` THEN ts END), MIN(ts)) FROM comments`
+
+	if req.Locator.URL != "" { // post info
+		list, err := s.queryInfo(infoQuery+` WHERE site = ? AND url = ? AND pending = 0 GROUP BY url`, req.Locator.SiteID, req.Locator.URL)
+		if err != nil {
+			return []store.PostInfo{{}}, err
+		}
+		info := store.PostInfo{}
+		if len(list) == 0 {
+			err = fmt.Errorf("can't load info for %s: no value for %s", req.Locator.URL, req.Locator.URL)
+		} else {
+			info = list[0]
+		}
+
+		// set read-only from age and manual flag
+		info.ReadOnly = req.ReadOnlyAge > 0 && !info.FirstTS.IsZero() && info.FirstTS.AddDate(0, 0, req.ReadOnlyAge).Before(time.Now())
+		if !info.ReadOnly && s.checkFlag(FlagRequest{Locator: req.Locator, Flag: ReadOnly}) {
+			info.ReadOnly = true
+		}
+		return []store.PostInfo{info}, err
+	}
+
+	if req.Locator.URL == "" && req.Locator.SiteID != "" { // site info (list)
+		limit, skip := req.Limit, req.Skip
+		if limit <= 0 {
+			limit = -1 // no limit in sqlite
+		}
+		skip = max(skip, 0)
+		return s.queryInfo(infoQuery+` WHERE site = ? AND pending = 0 GROUP BY url ORDER BY url DESC LIMIT ? OFFSET ?`,
+			req.Locator.SiteID, limit, skip)
+	}
+
+	return nil, fmt.Errorf("invalid info request %+v", req)
+}
+
+// ListFlags get list of flagged keys, like blocked & verified user
+// works for full locator (post flags) or with userID
+func (s *SQLite) ListFlags(req FlagRequest) (res []any, err error) {
+	if err = s.checkSite(req.Locator.SiteID); err != nil {
+		return nil, err
+	}
+
+	res = []any{}
+	switch req.Flag {
+	case Verified, Shadowed:
+		rows, e := s.db.Query(`SELECT key FROM flags WHERE site = ? AND flag = ? ORDER BY key`, req.Locator.SiteID, req.Flag)
+		if e != nil {
+			return nil, fmt.Errorf("can't list %s users: %w", req.Flag, e)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			if err = rows.Scan(&key); err != nil {
+				return nil, fmt.Errorf("can't scan %s user: %w", req.Flag, err)
+			}
+			res = append(res, key)
+		}
+		return res, rows.Err()
+	case Blocked:
+		type blockedRec struct {
+			id    string
+			until time.Time
+		}
+		recs := []blockedRec{}
+		err = func() error {
+			rows, e := s.db.Query(`SELECT key, until FROM flags WHERE site = ? AND flag = ? AND until > ? ORDER BY key`,
+				req.Locator.SiteID, Blocked, time.Now().UnixNano())
+			if e != nil {
+				return fmt.Errorf("can't list blocked users: %w", e)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var key string
+				var until int64
+				if e = rows.Scan(&key, &until); e != nil {
+					return fmt.Errorf("can't scan blocked user: %w", e)
+				}
+				recs = append(recs, blockedRec{id: key, until: time.Unix(0, until)})
+			}
+			return rows.Err()
+		}()
+		if err != nil {
+			return nil, err
+		}
+
+		// get user names from comment user section, made outside of rows iteration as the store has a single connection
+		for _, r := range recs {
+			userName := ""
+			findReq := FindRequest{Locator: store.Locator{SiteID: req.Locator.SiteID}, UserID: r.id, Limit: 1}
+			if userComments, errUser := s.Find(findReq); errUser == nil && len(userComments) > 0 {
+				userName = userComments[0].User.Name
+			}
+			res = append(res, store.BlockedUser{ID: r.id, Name: userName, Until: r.until})
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("flag %s not listable", req.Flag)
+}
+
+// Delete post(s), user, comment, user details, or everything
+func (s *SQLite) Delete(req DeleteRequest) error {
+	if err := s.checkSite(req.Locator.SiteID); err != nil {
+		return err
+	}
+
+	switch {
+	case req.UserDetail != "": // delete user detail
+		return s.deleteUserDetail(req.Locator.SiteID, req.UserID, req.UserDetail)
+	case req.Locator.URL != "" && req.CommentID != "" && req.UserDetail == "": // delete comment
+		return s.deleteComment(req.Locator, req.CommentID, req.DeleteMode)
+	case req.Locator.SiteID != "" && req.UserID != "" && req.CommentID == "" && req.UserDetail == "": // delete user
+		return s.deleteUser(req.Locator.SiteID, req.UserID, req.DeleteMode)
+	case req.Locator.SiteID != "" && req.Locator.URL == "" && req.CommentID == "" && req.UserID == "" && req.UserDetail == "": // delete site
+		return s.deleteAll(req.Locator.SiteID)
+	}
+
+	return fmt.Errorf("invalid delete request %+v", req)
+}
+
+// Close sqlite store
+func (s *SQLite) Close() error {
+	if err := s.db.Close(); err != nil {
+		return fmt.Errorf("can't close sqlite store: %w", err)
+	}
+	return nil
+}
+
+// lastComments returns up to req.Limit last non-deleted comments for the site, newest first.
+// Comments not visible to the viewer skipped before the limit with req.Visible set
+func (s *SQLite) lastComments(req FindRequest) ([]store.Comment, error) {
+	maximum := req.Limit
+	if maximum > lastLimit || maximum == 0 {
+		maximum = lastLimit
+	}
+	cond, args := sqliteVisible(req)
+	return s.query(`SELECT data FROM comments WHERE site = ? AND deleted = 0 AND ts > ?`+cond+` ORDER BY ts DESC LIMIT ?`,
+		append(append([]any{req.Locator.SiteID, sinceNano(req.Since)}, args...), maximum)...)
+}
+
+// userComments extracts comments for given site and given userID, newest first.
+// Comments not visible to the viewer skipped before the pagination with req.Visible set
+func (s *SQLite) userComments(req FindRequest) ([]store.Comment, error) {
+	limit := req.Limit
+	if limit == 0 || limit > userLimit {
+		limit = userLimit
+	}
+
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM comments WHERE site = ? AND user_id = ?`, req.Locator.SiteID, req.UserID).Scan(&count); err != nil {
+		return nil, fmt.Errorf("can't count comments for user %s: %w", req.UserID, err)
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no comments for user %s in store", req.UserID)
+	}
+
+	cond, args := sqliteVisible(req)
+	return s.query(`SELECT data FROM comments WHERE site = ? AND user_id = ?`+cond+` ORDER BY ts DESC LIMIT ? OFFSET ?`,
+		append(append([]any{req.Locator.SiteID, req.UserID}, args...), limit, max(req.Skip, 0))...)
+}
+
+// sqliteVisible returns condition, with its args, limiting comments to ones visible to the viewer of the request,
+// see ViewerFilter. Empty if req.Visible not set or the viewer is admin
+func sqliteVisible(req FindRequest) (cond string, args []any) {
+	if !req.Visible || req.ViewerAdmin {
+		return "", nil
+	}
+	return ` AND (user_id = ? OR (pending = 0 AND user_id NOT IN (SELECT key FROM flags WHERE site = ? AND flag = ?)))`,
+		[]any{req.ViewerID, req.Locator.SiteID, Shadowed}
+}
+
+func (s *SQLite) checkFlag(req FlagRequest) (val bool) {
+	if s.checkSite(req.Locator.SiteID) != nil {
+		return false
+	}
+
+	key := req.Locator.URL
+	if req.UserID != "" {
+		key = req.UserID
+	}
+
+	var until int64
+	err := s.db.QueryRow(`SELECT until FROM flags WHERE site = ? AND flag = ? AND key = ?`, req.Locator.SiteID, req.Flag, key).Scan(&until)
+	if err != nil {
+		return false
+	}
+	if req.Flag == Blocked {
+		return time.Now().Before(time.Unix(0, until))
+	}
+	return true
+}
+
+func (s *SQLite) setFlag(req FlagRequest) (res bool, err error) {
+	if err = s.checkSite(req.Locator.SiteID); err != nil {
+		return false, err
+	}
+
+	switch req.Flag {
+	case ReadOnly, Blocked, Verified, Shadowed:
+	default:
+		return false, fmt.Errorf("unsupported flag %v", req.Flag)
+	}
+
+	key := req.Locator.URL
+	if req.UserID != "" {
+		key = req.UserID
+	}
+
+	switch req.Update {
+	case FlagTrue:
+		val := time.Now()
+		if req.Flag == Blocked {
+			val = time.Now().AddDate(100, 0, 0) // permanent is 100 year
+			if req.TTL > 0 {
+				val = time.Now().Add(req.TTL)
+			}
+		}
+		_, err = s.db.Exec(`INSERT INTO flags (site, flag, key, until) VALUES (?, ?, ?, ?)
+			ON CONFLICT (site, flag, key) DO UPDATE SET until = excluded.until`, req.Locator.SiteID, req.Flag, key, val.UnixNano())
+		if err != nil {
+			return false, fmt.Errorf("failed to set flag %s for %s: %w", req.Flag, key, err)
+		}
+		return true, nil
+	case FlagFalse:
+		if _, err = s.db.Exec(`DELETE FROM flags WHERE site = ? AND flag = ? AND key = ?`, req.Locator.SiteID, req.Flag, key); err != nil {
+			return false, fmt.Errorf("failed to clean flag %s for %s: %w", req.Flag, key, err)
+		}
+	}
+	return false, nil
+}
+
+// getUserDetail returns UserDetailEntry with requested userDetail (omitting other details)
+// as an only element of the slice.
+func (s *SQLite) getUserDetail(req UserDetailRequest) (result []UserDetailEntry, err error) {
+	entry, found, err := s.loadUserDetail(req.Locator.SiteID, req.UserID)
+	if err != nil || !found { // return no error in case of absent entry
+		return nil, err
+	}
+	switch req.Detail {
+	case UserEmail:
+		result = []UserDetailEntry{{UserID: req.UserID, Email: entry.Email}}
+	case UserTelegram:
+		result = []UserDetailEntry{{UserID: req.UserID, Telegram: entry.Telegram}}
+	case UserEmailDigest:
+		result = []UserDetailEntry{{UserID: req.UserID, EmailDigest: entry.EmailDigest}}
+	case UserMatrix:
+		result = []UserDetailEntry{{UserID: req.UserID, Matrix: entry.Matrix}}
+	case UserWebPush:
+		result = []UserDetailEntry{{UserID: req.UserID, WebPush: entry.WebPush}}
+	}
+	return result, nil
+}
+
+// setUserDetail sets requested userDetail, returning complete updated UserDetailEntry as an only
+// element of the slice in case of success
+func (s *SQLite) setUserDetail(req UserDetailRequest) (result []UserDetailEntry, err error) {
+	entry, _, err := s.loadUserDetail(req.Locator.SiteID, req.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if entry.UserID == "" {
+		// new entry to be created, need to set UserID for it
+		entry.UserID = req.UserID
+	}
+
+	switch req.Detail {
+	case UserEmail:
+		entry.Email = req.Update
+	case UserTelegram:
+		entry.Telegram = req.Update
+	case UserEmailDigest:
+		entry.EmailDigest = req.Update
+	case UserMatrix:
+		entry.Matrix = req.Update
+	case UserWebPush:
+		entry.WebPush = req.Update
+	}
+
+	if err = s.saveUserDetail(req.Locator.SiteID, entry); err != nil {
+		return nil, fmt.Errorf("failed to update detail %s for %s in %s: %w", req.Detail, req.UserID, req.Locator.SiteID, err)
+	}
+	return []UserDetailEntry{entry}, nil
+}
+
+// listDetails lists all available users details for given site
+func (s *SQLite) listDetails(loc store.Locator) (result []UserDetailEntry, err error) {
+	if err = s.checkSite(loc.SiteID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT data FROM user_details WHERE site = ? ORDER BY user_id`, loc.SiteID)
+	if err != nil {
+		return nil, fmt.Errorf("can't list user details: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var data []byte
+		if err = rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("can't scan user details: %w", err)
+		}
+		var entry UserDetailEntry
+		if err = json.Unmarshal(data, &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal entry: %w", err)
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+// deleteUserDetail deletes requested UserDetail or whole UserDetailEntry
+func (s *SQLite) deleteUserDetail(siteID, userID string, userDetail UserDetail) error {
+	entry, found, err := s.loadUserDetail(siteID, userID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		// absent entry means that we should not do anything
+		return nil
+	}
+
+	switch userDetail {
+	case UserEmail:
+		entry.Email = ""
+	case UserTelegram:
+		entry.Telegram = ""
+	case UserEmailDigest:
+		entry.EmailDigest = ""
+	case UserMatrix:
+		entry.Matrix = ""
+	case UserWebPush:
+		entry.WebPush = ""
+	case AllUserDetails:
+		entry = UserDetailEntry{UserID: userID}
+	}
+
+	if entry == (UserDetailEntry{UserID: userID}) {
+		// if entry doesn't have non-empty details, we should delete it
+		if _, err = s.db.Exec(`DELETE FROM user_details WHERE site = ? AND user_id = ?`, siteID, userID); err != nil {
+			return fmt.Errorf("failed to delete user detail %s for %s: %w", userDetail, userID, err)
+		}
+		return nil
+	}
+
+	// updated entry is not empty and we need to store its updated copy
+	if err = s.saveUserDetail(siteID, entry); err != nil {
+		return fmt.Errorf("failed to update detail %s for %s: %w", userDetail, userID, err)
+	}
+	return nil
+}
+
+func (s *SQLite) loadUserDetail(siteID, userID string) (entry UserDetailEntry, found bool, err error) {
+	var data []byte
+	err = s.db.QueryRow(`SELECT data FROM user_details WHERE site = ? AND user_id = ?`, siteID, userID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserDetailEntry{}, false, nil
+	}
+	if err != nil {
+		return UserDetailEntry{}, false, fmt.Errorf("can't load user details for %s: %w", userID, err)
+	}
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return UserDetailEntry{}, false, fmt.Errorf("failed to unmarshal entry: %w", err)
+	}
+	return entry, true, nil
+}
+
+func (s *SQLite) saveUserDetail(siteID string, entry UserDetailEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("can't marshal user details: %w", err)
+	}
+	_, err = s.db.Exec(`INSERT INTO user_details (site, user_id, data) VALUES (?, ?, ?)
+		ON CONFLICT (site, user_id) DO UPDATE SET data = excluded.data`, siteID, entry.UserID, data)
+	return err
+}
+
+func (s *SQLite) deleteComment(locator store.Locator, commentID string, mode store.DeleteMode) error {
+	return s.update(func(tx *sql.Tx) error {
+		comment, err := s.load(tx, locator, commentID)
+		if err != nil {
+			return err
+		}
+
+		// set deleted status and clear fields
+		comment.SetDeleted(mode)
+		if err = s.save(tx, comment); err != nil {
+			return fmt.Errorf("can't save deleted comment %s for %s: %w", commentID, locator.URL, err)
+		}
+		return nil
+	})
+}
+
+// deleteAll removes all comments and users details for given siteID, flags are kept
+func (s *SQLite) deleteAll(siteID string) error {
+	return s.update(func(tx *sql.Tx) error {
+		for _, q := range []string{`DELETE FROM comments WHERE site = ?`, `DELETE FROM user_details WHERE site = ?`} {
+			if _, err := tx.Exec(q, siteID); err != nil {
+				return fmt.Errorf("failed to delete data from site %s: %w", siteID, err)
+			}
+		}
+		return nil
+	})
+}
+
+// deleteUser removes all comments and details for given user. Everything will be marked as deleted
+// and, in hard mode, user name and userID will be changed to "deleted".
+func (s *SQLite) deleteUser(siteID, userID string, mode store.DeleteMode) error {
+	comments, err := s.query(`SELECT data FROM comments WHERE site = ? AND user_id = ?`, siteID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to collect list of comments for deletion: %w", err)
+	}
+	log.Printf("[DEBUG] comments for removal=%d", len(comments))
+
+	for _, c := range comments {
+		if e := s.deleteComment(c.Locator, c.ID, mode); e != nil {
+			return fmt.Errorf("failed to delete comment %s: %w", c.ID, e)
+		}
+	}
+
+	return s.deleteUserDetail(siteID, userID, AllUserDetails)
+}
+
+// update runs fn in a transaction, committed if fn returns no error and rolled back otherwise.
+// fn should use tx for all queries, as the only connection is held by the transaction
+func (s *SQLite) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("can't start transaction: %w", err)
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// postComments returns comments for post since req.Since, missing post reported the same way as by bolt engine
+func (s *SQLite) postComments(req FindRequest) ([]store.Comment, error) {
+	comments, err := s.query(`SELECT data FROM comments WHERE site = ? AND url = ? AND ts > ?`,
+		req.Locator.SiteID, req.Locator.URL, sinceNano(req.Since))
+	if err != nil || len(comments) > 0 {
+		return comments, err
+	}
+	var posts int
+	if err = s.db.QueryRow(`SELECT COUNT(*) FROM comments WHERE site = ? AND url = ?`,
+		req.Locator.SiteID, req.Locator.URL).Scan(&posts); err != nil {
+		return nil, fmt.Errorf("can't count comments for %s: %w", req.Locator.URL, err)
+	}
+	if posts == 0 {
+		return nil, fmt.Errorf("no bucket %s in store", req.Locator.URL)
+	}
+	return comments, nil
+}
+
+// load comment by locator and id
+func (s *SQLite) load(conn sqliteConn, locator store.Locator, commentID string) (comment store.Comment, err error) {
+	var data []byte
+	err = conn.QueryRow(`SELECT data FROM comments WHERE site = ? AND url = ? AND id = ?`,
+		locator.SiteID, locator.URL, commentID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		// keep errors compatible with bolt engine, missing post and missing comment reported differently
+		var posts int
+		if e := conn.QueryRow(`SELECT COUNT(*) FROM comments WHERE site = ? AND url = ?`, locator.SiteID, locator.URL).Scan(&posts); e == nil && posts == 0 {
+			return comment, fmt.Errorf("no bucket %s in store", locator.URL)
+		}
+		return comment, fmt.Errorf("can't load key %s from bucket %s: no value for %s", commentID, locator.URL, commentID)
+	}
+	if err != nil {
+		return comment, fmt.Errorf("can't load comment %s: %w", commentID, err)
+	}
+	if err = json.Unmarshal(data, &comment); err != nil {
+		return comment, fmt.Errorf("failed to unmarshal: %w", err)
+	}
+	return comment, nil
+}
+
+// save existing comment, user_id, deleted, pending and reports columns follow the comment's content
+func (s *SQLite) save(conn sqliteConn, comment store.Comment) error {
+	data, err := json.Marshal(comment)
+	if err != nil {
+		return fmt.Errorf("can't marshal comment: %w", err)
+	}
+	_, err = conn.Exec(`UPDATE comments SET user_id = ?, deleted = ?, pending = ?, reports = ?, data = ?, search = ?
+		WHERE site = ? AND url = ? AND id = ?`, comment.User.ID, comment.Deleted, comment.Pending, len(comment.Reports), data,
+		sqliteSearchValue(comment), comment.Locator.SiteID, comment.Locator.URL, comment.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save comment %s: %w", comment.ID, err)
+	}
+	return nil
+}
+
+// searchComments returns all comments matching query and visible in search results, see SearchFilter.
+// Each query word should be a prefix of some word in search column
+func (s *SQLite) searchComments(req FindRequest) ([]store.Comment, error) {
+	terms := searchTerms(req.Query)
+	if len(terms) == 0 {
+		return []store.Comment{}, nil
+	}
+
+	q, args := `SELECT data FROM comments WHERE site = ?`, []any{req.Locator.SiteID}
+	if req.Locator.URL != "" {
+		q, args = q+` AND url = ?`, append(args, req.Locator.URL)
+	}
+	for _, term := range terms {
+		// terms have letters and digits only, no need to escape LIKE wildcards
+		q, args = q+` AND search LIKE ?`, append(args, "% "+term+"%")
+	}
+
+	if !req.Deleted {
+		q, args = q+` AND deleted = 0 AND user_id NOT IN (SELECT key FROM flags WHERE site = ? AND flag = ? AND until > ?)`,
+			append(args, req.Locator.SiteID, Blocked, time.Now().UnixNano())
+	}
+	req.Visible = true // search results are always limited to visible to the viewer
+	cond, condArgs := sqliteVisible(req)
+	return s.query(q+cond, append(args, condArgs...)...)
+}
+
+// indexedComments returns all non-deleted comments matching condition on indexed column, i.e. pending or reported,
+// for the site, limited to locator.URL if set
+func (s *SQLite) indexedComments(locator store.Locator, cond string) ([]store.Comment, error) {
+	q, args := `SELECT data FROM comments WHERE site = ? AND deleted = 0 AND `+cond, []any{locator.SiteID}
+	if locator.URL != "" {
+		q, args = q+` AND url = ?`, append(args, locator.URL)
+	}
+	return s.query(q, args...)
+}
+
+// migrate adds columns missing in the database made by the older version. Columns with default values good for
+// all existing comments added first, as they are used by save called from migrateSearch.
+func (s *SQLite) migrate() error {
+	// comments made before pre-moderation and reports support are all approved and not reported
+	for _, name := range []string{"pending", "reports"} {
+		has, err := s.hasColumn(name)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		if _, err = s.db.Exec(`ALTER TABLE comments ADD COLUMN ` + name + ` INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return fmt.Errorf("can't add %s column: %w", name, err)
+		}
+		log.Printf("[INFO] %s column added", name)
+	}
+	return s.migrateSearch()
+}
+
+// hasColumn checks if comments table has column with given name
+func (s *SQLite) hasColumn(name string) (bool, error) {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('comments') WHERE name = ?`, name).Scan(&count); err != nil {
+		return false, fmt.Errorf("can't check %s column: %w", name, err)
+	}
+	return count > 0, nil
+}
+
+// migrateSearch adds search column to the database made before full-text search support and fills it
+func (s *SQLite) migrateSearch() error {
+	hasSearch, err := s.hasColumn("search")
+	if err != nil || hasSearch {
+		return err
+	}
+	if _, err = s.db.Exec(`ALTER TABLE comments ADD COLUMN search TEXT NOT NULL DEFAULT ''`); err != nil {
+		return fmt.Errorf("can't add search column: %w", err)
+	}
+	comments, err := s.query(`SELECT data FROM comments`)
+	if err != nil {
+		return err
+	}
+	for _, c := range comments {
+		if err = s.save(s.db, c); err != nil {
+			return err
+		}
+	}
+	log.Printf("[INFO] search column added for %d comments", len(comments))
+	return nil
+}
+
+// sqliteSearchValue makes value for search column, each word prefixed by space to be matched with LIKE '% word%'
+func sqliteSearchValue(comment store.Comment) string {
+	return " " + strings.Join(searchWords(comment), " ")
+}
+
+// query runs select returning data column and unmarshal results to comments
+func (s *SQLite) query(query string, args ...any) ([]store.Comment, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("can't query comments: %w", err)
+	}
+	defer rows.Close()
+
+	comments := []store.Comment{}
+	for rows.Next() {
+		var data []byte
+		if err = rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("can't scan comment: %w", err)
+		}
+		comment := store.Comment{}
+		if err = json.Unmarshal(data, &comment); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal: %w", err)
+		}
+		comments = append(comments, comment)
+	}
+	return comments, rows.Err()
+}
+
+func (s *SQLite) queryInfo(query string, args ...any) ([]store.PostInfo, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("can't query info: %w", err)
+	}
+	defer rows.Close()
+
+	list := []store.PostInfo{}
+	for rows.Next() {
+		var url string
+		var count int
+		var firstTS, lastTS int64
+		if err = rows.Scan(&url, &count, &firstTS, &lastTS); err != nil {
+			return nil, fmt.Errorf("can't scan info: %w", err)
+		}
+		list = append(list, store.PostInfo{URL: url, Count: count,
+			FirstTS: time.Unix(0, firstTS).UTC(), LastTS: time.Unix(0, lastTS).UTC()})
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLite) checkSite(siteID string) error {
+	if slices.Contains(s.sites, siteID) {
+		return nil
+	}
+	return fmt.Errorf("site %q %w", siteID, ErrSiteNotFound)
+}
+
+// sinceNano returns since as unix nanoseconds, zero time matches everything
+func sinceNano(since time.Time) int64 {
+	if since.IsZero() {
+		return -1 << 63
+	}
+	return since.UnixNano()
+}
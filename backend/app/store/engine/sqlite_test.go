@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestSQLite_UpdateConcurrent(t *testing.T) {
+	var s, teardown = prepSQLite(t)
+	defer teardown()
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	orig, err := s.Get(getReq(loc, "id-1"))
+	require.NoError(t, err)
+
+	// updates and deletes load and save comment in a single transaction, and don't block each other
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c := orig
+			c.Text = fmt.Sprintf("text %d", i)
+			assert.NoError(t, s.Update(c))
+		}()
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.Delete(DeleteRequest{Locator: loc, CommentID: "id-1", DeleteMode: store.SoftDelete}))
+		}()
+	}
+	wg.Wait()
+
+	comment, err := s.Get(getReq(loc, "id-1"))
+	require.NoError(t, err)
+	assert.Equal(t, orig.User, comment.User)
+	assert.Equal(t, orig.Timestamp.UnixNano(), comment.Timestamp.UnixNano())
+}
+
+func TestSQLite_SearchMigration(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "remark.db")
+	s, err := NewSQLite(fileName, time.Second, "radio-t")
+	require.NoError(t, err)
+	_, err = s.Create(store.Comment{ID: "id-1", Text: "some text", Timestamp: time.Now(),
+		Locator: store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}, User: store.User{ID: "user1"}})
+	require.NoError(t, err)
+
+	// drop search and pending columns to simulate database made before search and pre-moderation support
+	_, err = s.db.Exec(`ALTER TABLE comments DROP COLUMN search`)
+	require.NoError(t, err)
+	_, err = s.db.Exec(`ALTER TABLE comments DROP COLUMN pending`)
+	require.NoError(t, err)
+	_, err = s.db.Exec(`ALTER TABLE comments DROP COLUMN reports`)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = NewSQLite(fileName, time.Second, "radio-t")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, s.Close()) }()
+	res, err := s.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Query: "text"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-1", res[0].ID)
+
+	res, err = s.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Pending: true})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+	res, err = s.Find(FindRequest{Locator: store.Locator{SiteID: "radio-t"}, Reported: true})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+}
+
+func TestSQLite_MultipleSites(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "remark.db")
+	s, err := NewSQLite(fileName, time.Second, "site1", "site2")
+	require.NoError(t, err)
+
+	for _, site := range []string{"site1", "site2"} {
+		_, err = s.Create(store.Comment{ID: "id-1", Text: "text " + site, Timestamp: time.Now(),
+			Locator: store.Locator{URL: "https://example.com", SiteID: site}, User: store.User{ID: "user1"}})
+		require.NoError(t, err)
+	}
+	assert.NoError(t, s.Delete(DeleteRequest{Locator: store.Locator{SiteID: "site1"}}))
+	require.NoError(t, s.Close())
+
+	// reopen, the data for site2 should survive
+	s, err = NewSQLite(fileName, time.Second, "site1", "site2")
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, s.Close()) }()
+
+	_, err = s.Find(FindRequest{Locator: store.Locator{SiteID: "site1", URL: "https://example.com"}})
+	assert.EqualError(t, err, "no bucket https://example.com in store")
+
+	res, err := s.Find(FindRequest{Locator: store.Locator{SiteID: "site2", URL: "https://example.com"}})
+	assert.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "text site2", res[0].Text)
+}
+
+func TestSQLite_NewFailed(t *testing.T) {
+	_, err := NewSQLite("/tmp/no-such-place/tmp.db", time.Second, "radio-t")
+	assert.ErrorContains(t, err, "failed to create sqlite schema in /tmp/no-such-place/tmp.db")
+}
+
+func TestSQLite_DoubleClose(t *testing.T) {
+	var s, teardown = prepSQLite(t)
+	defer teardown()
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close(), "second call should not result in panic or errors")
+}
+
+func TestSQLite_PendingInfoSameAsBolt(t *testing.T) {
+	b, teardownBolt := prep(t)
+	defer teardownBolt()
+	s, teardownSQLite := prepSQLite(t)
+	defer teardownSQLite()
+
+	loc := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	pendingLoc := store.Locator{URL: "https://radio-t.com/pending", SiteID: "radio-t"}
+	ts := time.Date(2017, 12, 20, 15, 18, 30, 0, time.UTC)
+	for _, e := range []Interface{b, s} {
+		_, err := e.Create(store.Comment{ID: "id-3", Text: "pending text", Pending: true, Locator: loc, Timestamp: ts,
+			User: store.User{ID: "user2"}})
+		require.NoError(t, err)
+		_, err = e.Create(store.Comment{ID: "id-4", Text: "pending text", Pending: true, Locator: pendingLoc,
+			Timestamp: ts.Add(time.Second), User: store.User{ID: "user2"}})
+		require.NoError(t, err)
+	}
+
+	infos := func(e Interface) (post store.PostInfo, list []store.PostInfo) {
+		res, err := e.Info(InfoRequest{Locator: loc})
+		require.NoError(t, err)
+		post = res[0]
+		list, err = e.Info(InfoRequest{Locator: store.Locator{SiteID: "radio-t"}})
+		require.NoError(t, err)
+		return post, list
+	}
+
+	for _, e := range []Interface{b, s} {
+		post, list := infos(e)
+		assert.Equal(t, 2, post.Count, "%T", e)
+		assert.Equal(t, time.Date(2017, 12, 20, 15, 18, 23, 0, time.UTC), post.LastTS.UTC(), "%T, pending doesn't advance", e)
+		require.Len(t, list, 1, "%T, post with pending comments only is not revealed", e)
+		_, err := e.Info(InfoRequest{Locator: pendingLoc})
+		assert.Error(t, err, "%T", e)
+
+		for _, l := range []store.Locator{loc, pendingLoc} {
+			res, err := e.Find(FindRequest{Locator: l, Pending: true})
+			require.NoError(t, err)
+			require.Len(t, res, 1)
+			res[0].Pending = false
+			require.NoError(t, e.Update(res[0]))
+		}
+	}
+
+	boltPost, boltList := infos(b)
+	sqlitePost, sqliteList := infos(s)
+	assert.Equal(t, 3, boltPost.Count)
+	assert.Equal(t, ts, boltPost.LastTS.UTC(), "approval advances last time")
+	assert.Equal(t, boltPost.Count, sqlitePost.Count)
+	assert.Equal(t, boltPost.FirstTS.UTC(), sqlitePost.FirstTS.UTC())
+	assert.Equal(t, boltPost.LastTS.UTC(), sqlitePost.LastTS.UTC())
+
+	require.Len(t, boltList, 2)
+	require.Len(t, sqliteList, 2)
+	for i := range boltList {
+		assert.Equal(t, boltList[i].URL, sqliteList[i].URL)
+		assert.Equal(t, boltList[i].Count, sqliteList[i].Count)
+		assert.Equal(t, boltList[i].FirstTS.UTC(), sqliteList[i].FirstTS.UTC())
+		assert.Equal(t, boltList[i].LastTS.UTC(), sqliteList[i].LastTS.UTC())
+	}
+	assert.Equal(t, "https://radio-t.com/pending", boltList[0].URL)
+	assert.Equal(t, 1, boltList[0].Count)
+	assert.Equal(t, ts.Add(time.Second), boltList[0].FirstTS.UTC())
+}
+
+// makes new sqlite store, put two records
+func prepSQLite(t *testing.T) (s *SQLite, teardown func()) {
+	s, err := NewSQLite(filepath.Join(t.TempDir(), "remark.db"), time.Second, "radio-t")
+	require.NoError(t, err)
+	prepComments(t, s)
+
+	teardown = func() {
+		require.NoError(t, s.Close())
+	}
+	return s, teardown
+}
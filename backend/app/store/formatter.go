@@ -1,7 +1,9 @@
 package store
 
 import (
+	"fmt"
 	"net/url"
+	"slices"
 	"strings"
 
 	"github.com/Depado/bfchroma/v2"
@@ -13,6 +15,15 @@ import (
 // CommentFormatter implements all generic formatting ops on comment
 type CommentFormatter struct {
 	converters []CommentConverter
+
+	ImageVariants ImageVariants // responsive variants of uploaded images, srcset of them added to images if set
+}
+
+// ImageVariants defines responsive variants of uploaded images, served with ?w= parameter of the image URL
+type ImageVariants struct {
+	ImageAPI string // URL prefix of uploaded images, i.e. https://remark42.example.com/api/v1/picture/
+	Widths   []int  // widths of image variants
+	MaxWidth int    // max width of uploaded images, width of the original image in srcset
 }
 
 // CommentConverter defines interface to convert some parts of commentHTML
@@ -104,7 +115,7 @@ func (f *CommentFormatter) unEscape(txt string) (res string) {
 	return res
 }
 
-// lazyImage adds loading=“lazy” attribute to all images
+// lazyImage adds loading=“lazy” attribute to all images, and srcset with responsive variants to uploaded images
 func (f *CommentFormatter) lazyImage(commentHTML string) (resHTML string) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(commentHTML))
 	if err != nil {
@@ -112,6 +123,13 @@ func (f *CommentFormatter) lazyImage(commentHTML string) (resHTML string) {
 	}
 	doc.Find("img").Each(func(_ int, s *goquery.Selection) {
 		s.SetAttr("loading", "lazy")
+		src, ok := s.Attr("src")
+		if _, hasSrcset := s.Attr("srcset"); !ok || hasSrcset {
+			return
+		}
+		if srcset := f.srcset(src); srcset != "" {
+			s.SetAttr("srcset", srcset)
+		}
 	})
 	resHTML, err = doc.Find("body").Html()
 	if err != nil {
@@ -120,6 +138,26 @@ func (f *CommentFormatter) lazyImage(commentHTML string) (resHTML string) {
 	return resHTML
 }
 
+// srcset returns srcset attribute value for the image with variants of all widths and the original image,
+// empty for images which are not uploaded ones
+func (f *CommentFormatter) srcset(src string) string {
+	iv := f.ImageVariants
+	if len(iv.Widths) == 0 || iv.ImageAPI == "" || !strings.HasPrefix(src, iv.ImageAPI) || strings.ContainsAny(src, "?, ") {
+		return ""
+	}
+	widths := slices.Sorted(slices.Values(iv.Widths))
+	res := make([]string, 0, len(widths)+1)
+	for _, w := range widths {
+		if w > 0 && (iv.MaxWidth <= 0 || w < iv.MaxWidth) {
+			res = append(res, fmt.Sprintf("%s?w=%d %dw", src, w, w))
+		}
+	}
+	if iv.MaxWidth > 0 {
+		res = append(res, fmt.Sprintf("%s %dw", src, iv.MaxWidth))
+	}
+	return strings.Join(res, ", ")
+}
+
 // GetMdExtensionsAndRenderer returns blackfriday extensions and renderer used for rendering markdown
 // within store module.
 //
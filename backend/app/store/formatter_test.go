@@ -150,3 +150,26 @@ func TestCommentFormatter_lazyImage(t *testing.T) {
 		})
 	}
 }
+
+func TestCommentFormatter_lazyImageSrcset(t *testing.T) {
+	tbl := []struct {
+		inp, out string
+	}{
+		{`<img src="https://r.example.com/api/v1/picture/user1/pic1"/>`, `<img src="https://r.example.com/api/v1/picture/user1/pic1" loading="lazy" ` +
+			`srcset="https://r.example.com/api/v1/picture/user1/pic1?w=320 320w, https://r.example.com/api/v1/picture/user1/pic1?w=640 640w, ` +
+			`https://r.example.com/api/v1/picture/user1/pic1 1200w"/>`},
+		{`<img src="https://r.example.com/api/v1/picture/user1/pic1" srcset="other.png 100w"/>`,
+			`<img src="https://r.example.com/api/v1/picture/user1/pic1" srcset="other.png 100w" loading="lazy"/>`},
+		{`<img src="https://r.example.com/api/v1/picture/user1/pic1?w=320"/>`, `<img src="https://r.example.com/api/v1/picture/user1/pic1?w=320" loading="lazy"/>`},
+		{`<img src="https://r.example.com/api/v1/img?src=aHR0cA=="/>`, `<img src="https://r.example.com/api/v1/img?src=aHR0cA==" loading="lazy"/>`},
+		{`<img src="http://example.com/pp2.jpg">`, `<img src="http://example.com/pp2.jpg" loading="lazy"/>`},
+	}
+
+	f := NewCommentFormatter()
+	f.ImageVariants = ImageVariants{ImageAPI: "https://r.example.com/api/v1/picture/", Widths: []int{1600, 640, 320}, MaxWidth: 1200}
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, tt.out, f.lazyImage(tt.inp))
+		})
+	}
+}
@@ -15,10 +15,12 @@ import (
 const imagesStagedBktName = "imagesStaged"
 const imagesBktName = "images"
 const insertTimeBktName = "insertTimestamps"
+const commitTimeBktName = "commitTimestamps"
 
 // Bolt provides image Store for images keeping data in bolt DB, restricts max size.
-// It uses 3 buckets to manage images data.
-// Two buckets contains image data (staged and committed images). Third bucket holds insertion timestamps.
+// It uses 4 buckets to manage images data.
+// Two buckets contains image data (staged and committed images). Third bucket holds insertion timestamps
+// of staged images, and the fourth one keeps them for committed images, as staged ones are removed on Cleanup.
 type Bolt struct {
 	fileName string
 	db       *bolt.DB
@@ -41,6 +43,9 @@ func NewBoltStorage(fileName string, options bolt.Options) (*Bolt, error) {
 		if _, e := tx.CreateBucketIfNotExists([]byte(insertTimeBktName)); e != nil {
 			return fmt.Errorf("failed to create top level bucket %s: %w", insertTimeBktName, e)
 		}
+		if _, e := tx.CreateBucketIfNotExists([]byte(commitTimeBktName)); e != nil {
+			return fmt.Errorf("failed to create top level bucket %s: %w", commitTimeBktName, e)
+		}
 		return nil
 	})
 	if err != nil {
@@ -81,6 +86,17 @@ func (b *Bolt) Commit(id string) error {
 		if err != nil {
 			return fmt.Errorf("can't put to bucket with %s: %w", id, err)
 		}
+		tsData := tx.Bucket([]byte(insertTimeBktName)).Get([]byte(id))
+		if tsData == nil {
+			tsBuf := &bytes.Buffer{}
+			if err = binary.Write(tsBuf, binary.LittleEndian, time.Now().UnixNano()); err != nil {
+				return fmt.Errorf("can't serialize timestamp for %s: %w", id, err)
+			}
+			tsData = tsBuf.Bytes()
+		}
+		if err = tx.Bucket([]byte(commitTimeBktName)).Put([]byte(id), tsData); err != nil {
+			return fmt.Errorf("can't put to bucket with %s: %w", id, err)
+		}
 		return nil
 	})
 }
@@ -127,10 +143,51 @@ func (b *Bolt) Delete(id string) error {
 		// or image is absent in both buckets
 		err := tx.Bucket([]byte(imagesBktName)).Delete([]byte(id))
 		err = errors.Join(err, tx.Bucket([]byte(imagesStagedBktName)).Delete([]byte(id)))
+		err = errors.Join(err, tx.Bucket([]byte(commitTimeBktName)).Delete([]byte(id)))
 		return err
 	})
 }
 
+// List returns images of the user, or all images if userID is empty, both committed and staged.
+// Upload time is unknown for images committed before it was recorded.
+func (b *Bolt) List(userID string) ([]Meta, error) {
+	prefix := []byte{}
+	if userID != "" {
+		prefix = []byte(userID + "/")
+	}
+	var res []Meta
+	err := b.db.View(func(tx *bolt.Tx) error {
+		committed := tx.Bucket([]byte(imagesBktName))
+		for _, bktName := range []string{imagesBktName, imagesStagedBktName} {
+			staging := bktName == imagesStagedBktName
+			tsBkt := tx.Bucket([]byte(commitTimeBktName))
+			if staging {
+				tsBkt = tx.Bucket([]byte(insertTimeBktName))
+			}
+			c := tx.Bucket([]byte(bktName)).Cursor()
+			for id, img := c.Seek(prefix); id != nil && bytes.HasPrefix(id, prefix); id, img = c.Next() {
+				if staging && committed.Get(id) != nil {
+					continue // committed image stays in staging bucket till cleanup
+				}
+				m := Meta{ID: string(id), Size: int64(len(img)), Staging: staging}
+				if tsData := tsBkt.Get(id); tsData != nil {
+					var ts int64
+					if err := binary.Read(bytes.NewReader(tsData), binary.LittleEndian, &ts); err != nil {
+						return fmt.Errorf("failed to deserialize timestamp for %s: %w", id, err)
+					}
+					m.Created = time.Unix(0, ts)
+				}
+				res = append(res, m)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't list images: %w", err)
+	}
+	return res, nil
+}
+
 // Cleanup runs scan of staging and removes old data based on ttl
 func (b *Bolt) Cleanup(_ context.Context, ttl time.Duration) error {
 	return b.db.Update(func(tx *bolt.Tx) error {
@@ -192,3 +249,8 @@ func (b *Bolt) Info() (StoreInfo, error) {
 	}
 	return StoreInfo{FirstStagingImageTS: ts}, nil
 }
+
+// Close bolt db
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
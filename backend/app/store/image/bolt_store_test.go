@@ -158,6 +158,39 @@ func TestBolt_Info(t *testing.T) {
 	assert.False(t, info.FirstStagingImageTS.IsZero())
 }
 
+func TestBolt_List(t *testing.T) {
+	svc, teardown := prepareBoltImageStorageTest(t)
+	defer teardown()
+
+	images, err := svc.List("")
+	require.NoError(t, err)
+	assert.Empty(t, images)
+
+	for _, id := range []string{"user1/img1", "user1/img2", "user2/img1", "user10/img1"} {
+		require.NoError(t, svc.Save(id, gopherPNGBytes()))
+	}
+	require.NoError(t, svc.Commit("user1/img1"))
+	require.NoError(t, svc.Cleanup(context.Background(), 0)) // committed image keeps its upload time
+
+	require.NoError(t, svc.Save("user1/img2", gopherPNGBytes()))
+	images, err = svc.List("user1")
+	require.NoError(t, err)
+	require.Len(t, images, 2)
+	assert.Equal(t, "user1/img1", images[0].ID)
+	assert.Equal(t, int64(1462), images[0].Size)
+	assert.False(t, images[0].Staging)
+	assert.WithinDuration(t, time.Now(), images[0].Created, time.Second)
+	assert.Equal(t, "user1/img2", images[1].ID)
+	assert.True(t, images[1].Staging)
+
+	images, err = svc.List("")
+	require.NoError(t, err)
+	assert.Len(t, images, 2, "staged images of other users cleaned up")
+
+	require.NoError(t, svc.Delete("user1/img1"))
+	assertBoltImgNil(t, svc.db, commitTimeBktName, "user1/img1")
+}
+
 func assertBoltImgNil(t *testing.T, db *bolt.DB, bucket, id string) {
 	checkBoltImgData(t, db, bucket, id, func(data []byte) error {
 		assert.Nil(t, data, id)
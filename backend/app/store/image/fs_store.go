@@ -186,6 +186,54 @@ func (f *FileSystem) Info() (StoreInfo, error) {
 	return StoreInfo{FirstStagingImageTS: ts}, nil
 }
 
+// List returns images of the user, or all images if userID is empty, from both permanent location and staging.
+// Upload time of the image is the modification time of its file.
+func (f *FileSystem) List(userID string) ([]Meta, error) {
+	images := map[string]Meta{}
+	for _, base := range []string{f.Staging, f.Location} { // committed image overrides staged one with the same id
+		dir := base
+		if userID != "" {
+			if dir = path.Join(base, userID); path.Dir(dir) != path.Clean(base) {
+				return nil, fmt.Errorf("invalid user id %q", userID)
+			}
+		}
+		err := filepath.Walk(dir, func(fpath string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				if base != f.Staging && filepath.Clean(fpath) == filepath.Clean(f.Staging) {
+					return filepath.SkipDir // staging located inside of permanent location
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(base, fpath)
+			if err != nil {
+				return err
+			}
+			// path is user/partition/file, or user/file without partitions
+			elems := strings.Split(filepath.ToSlash(rel), "/")
+			if len(elems) < 2 {
+				return nil
+			}
+			id := elems[0] + "/" + elems[len(elems)-1]
+			images[id] = Meta{ID: id, Size: info.Size(), Created: info.ModTime(), Staging: base == f.Staging}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't list images in %s: %w", dir, err)
+		}
+	}
+	res := make([]Meta, 0, len(images))
+	for _, m := range images {
+		res = append(res, m)
+	}
+	return res, nil
+}
+
 // location gets full path for id by adding partition to the final path in order to keep files in different subdirectories
 // and avoid too many files in a single place.
 // the end result is a full path like this - /tmp/images/user1/92/xxx-yyy.png.
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -286,6 +287,44 @@ func TestFsStore_Info(t *testing.T) {
 	assert.False(t, ts.FirstStagingImageTS.IsZero())
 }
 
+func TestFsStore_List(t *testing.T) {
+	svc, teardown := prepareImageTest(t)
+	defer teardown()
+
+	images, err := svc.List("")
+	require.NoError(t, err)
+	assert.Empty(t, images)
+
+	for _, id := range []string{"user1/img1.png", "user1/img2.png", "user2/img1.png", "user10/img1.png"} {
+		require.NoError(t, svc.Save(id, gopherPNGBytes()))
+	}
+	require.NoError(t, svc.Commit("user1/img1.png"))
+	mtime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(svc.location(svc.Location, "user1/img1.png"), mtime, mtime))
+
+	images, err = svc.List("user1")
+	require.NoError(t, err)
+	slices.SortFunc(images, func(a, b Meta) int { return strings.Compare(a.ID, b.ID) })
+	require.Len(t, images, 2)
+	assert.Equal(t, "user1/img1.png", images[0].ID)
+	assert.Equal(t, int64(1462), images[0].Size)
+	assert.False(t, images[0].Staging)
+	assert.WithinDuration(t, mtime, images[0].Created, time.Second)
+	assert.Equal(t, "user1/img2.png", images[1].ID)
+	assert.True(t, images[1].Staging)
+
+	images, err = svc.List("")
+	require.NoError(t, err)
+	assert.Len(t, images, 4)
+
+	images, err = svc.List("unknown")
+	require.NoError(t, err)
+	assert.Empty(t, images)
+
+	_, err = svc.List("..")
+	assert.EqualError(t, err, `invalid user id ".."`)
+}
+
 func prepareImageTest(t *testing.T) (svc *FileSystem, teardown func()) {
 	loc, err := os.MkdirTemp("", "test_image_r42")
 	require.NoError(t, err, "failed to make temp dir")
@@ -0,0 +1,207 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math/bits"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
+)
+
+// ErrBanned returned by Service.Save for the image similar to one banned on the site
+var ErrBanned = errors.New("image is banned")
+
+// banDistance is the max number of different bits of perceptual hashes of the banned and the saved images,
+// for them to be considered the same picture, i.e. resized or recompressed
+const banDistance = 6
+
+// BannedImage is perceptual hash of the image banned on the site
+type BannedImage struct {
+	Hash    string    `json:"hash"`     // hex string of the perceptual hash
+	ImageID string    `json:"image_id"` // image the hash made from
+	Created time.Time `json:"created"`
+}
+
+// HashStore keeps sha256 digests of the images saved by users, for duplicates detection,
+// and perceptual hashes of the images banned on the sites. Thread safe.
+type HashStore struct {
+	db *bolt.DB
+}
+
+const (
+	imageDigestsBktName = "image_digests" // key is user/sha256 of the image, value is image id
+	bannedHashesBktName = "banned_hashes" // nested bucket per site, key is hash, value is BannedImage json
+
+	// legacyImageHashesBktName keyed the images by perceptual hash, which matched edited copies of the image
+	legacyImageHashesBktName = "image_hashes"
+)
+
+// imageHash is perceptual hash of the image
+type imageHash uint64
+
+// NewHashStore makes hash store in bolt file
+func NewHashStore(fileName string, options bolt.Options) (*HashStore, error) {
+	db, err := bolt.Open(fileName, 0o600, &options) //nolint:gocritic //octalLiteral is OK as FileMode
+	if err != nil {
+		return nil, fmt.Errorf("failed to make boltdb for %s: %w", fileName, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bktName := range []string{imageDigestsBktName, bannedHashesBktName} {
+			if _, e := tx.CreateBucketIfNotExists([]byte(bktName)); e != nil {
+				return fmt.Errorf("failed to create top level bucket %s: %w", bktName, e)
+			}
+		}
+		if e := tx.DeleteBucket([]byte(legacyImageHashesBktName)); e != nil && !errors.Is(e, bolt.ErrBucketNotFound) {
+			return fmt.Errorf("failed to delete bucket %s: %w", legacyImageHashesBktName, e)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize boltdb db %q buckets: %w", fileName, err)
+	}
+	return &HashStore{db: db}, nil
+}
+
+// Ban adds perceptual hash of the image to the banned on the site
+func (s *HashStore) Ban(siteID string, b BannedImage) error {
+	if _, err := strconv.ParseUint(b.Hash, 16, 64); err != nil || len(b.Hash) != 16 {
+		return fmt.Errorf("invalid image hash %q", b.Hash)
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("can't marshal banned image %s: %w", b.Hash, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt, e := tx.Bucket([]byte(bannedHashesBktName)).CreateBucketIfNotExists([]byte(siteID))
+		if e != nil {
+			return fmt.Errorf("can't make bucket for site %s: %w", siteID, e)
+		}
+		return bkt.Put([]byte(b.Hash), data)
+	})
+}
+
+// Unban removes the hash from the banned on the site
+func (s *HashStore) Unban(siteID, hash string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bannedHashesBktName)).Bucket([]byte(siteID))
+		if bkt == nil || bkt.Get([]byte(hash)) == nil {
+			return fmt.Errorf("image hash %q is not banned on site %s", hash, siteID)
+		}
+		return bkt.Delete([]byte(hash))
+	})
+}
+
+// Bans returns all images banned on the site, the most recent first
+func (s *HashStore) Bans(siteID string) ([]BannedImage, error) {
+	res := []BannedImage{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bannedHashesBktName)).Bucket([]byte(siteID))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(_, v []byte) error {
+			var b BannedImage
+			if err := json.Unmarshal(v, &b); err != nil {
+				return fmt.Errorf("can't unmarshal banned image: %w", err)
+			}
+			res = append(res, b)
+			return nil
+		})
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.After(res[j].Created) })
+	return res, err
+}
+
+// Close bolt file
+func (s *HashStore) Close() error {
+	return s.db.Close()
+}
+
+// banned checks if the hash is close enough to any of the hashes banned on the site
+func (s *HashStore) banned(siteID string, h imageHash) (bool, error) {
+	res := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bannedHashesBktName)).Bucket([]byte(siteID))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, _ []byte) error {
+			banned, err := strconv.ParseUint(string(k), 16, 64)
+			if err != nil {
+				return fmt.Errorf("bad banned image hash %q: %w", k, err)
+			}
+			if bits.OnesCount64(banned^uint64(h)) <= banDistance {
+				res = true
+			}
+			return nil
+		})
+	})
+	return res, err
+}
+
+// findImage returns ID of the image with the same digest saved by the user before, empty if not found
+func (s *HashStore) findImage(userID, digest string) (id string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket([]byte(imageDigestsBktName)).Get([]byte(userID + "/" + digest)))
+		return nil
+	})
+	return id, err
+}
+
+// setImage stores ID of the image saved by the user
+func (s *HashStore) setImage(userID, digest, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(imageDigestsBktName)).Put([]byte(userID+"/"+digest), []byte(id))
+	})
+}
+
+// String returns hash as 16 characters hex string
+func (h imageHash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// imageDigest returns sha256 of the image as hex string. Unlike perceptual hash, it differs for the image
+// with any pixel changed, i.e. with a part redacted, so only exact copies are matched by it.
+func imageDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// perceptualHash returns difference hash (dHash) of the image. Each bit of it is set if the pixel of grayscale
+// 9x8 thumbnail of the image is darker than the pixel on the right, so the same pictures resized or recompressed
+// have hashes with few different bits.
+func perceptualHash(data []byte) (imageHash, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("can't decode image config: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(maxImagePixels) {
+		return 0, fmt.Errorf("image dimensions %dx%d exceed safe limit", cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("can't decode image: %w", err)
+	}
+	thumb := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(thumb, thumb.Bounds(), src, src.Bounds(), draw.Src, nil)
+	var res imageHash
+	for y := range 8 {
+		for x := range 8 {
+			res <<= 1
+			if thumb.GrayAt(x, y).Y < thumb.GrayAt(x+1, y).Y {
+				res |= 1
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,203 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/bits"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/image/draw"
+)
+
+func TestPerceptualHash(t *testing.T) {
+	orig := hashTestImage(t, 400, 300, 0)
+	h1, err := perceptualHash(orig)
+	require.NoError(t, err)
+	assert.Len(t, h1.String(), 16)
+
+	// the same picture resized and recompressed to jpeg
+	src, err := png.Decode(bytes.NewReader(orig))
+	require.NoError(t, err)
+	m := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	draw.CatmullRom.Scale(m, m.Bounds(), src, src.Bounds(), draw.Src, nil)
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, m, &jpeg.Options{Quality: 50}))
+	h2, err := perceptualHash(buf.Bytes())
+	require.NoError(t, err)
+	assert.LessOrEqual(t, bits.OnesCount64(uint64(h1^h2)), banDistance, "similar images, %s and %s", h1, h2)
+
+	h3, err := perceptualHash(hashTestImage(t, 400, 300, 1))
+	require.NoError(t, err)
+	assert.Greater(t, bits.OnesCount64(uint64(h1^h3)), banDistance, "different images, %s and %s", h1, h3)
+
+	_, err = perceptualHash([]byte("not an image"))
+	assert.Error(t, err)
+}
+
+func TestHashStore_Bans(t *testing.T) {
+	s, err := NewHashStore(filepath.Join(t.TempDir(), "hashes.db"), bolt.Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	bans, err := s.Bans("site1")
+	require.NoError(t, err)
+	assert.Empty(t, bans)
+
+	ts := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, s.Ban("site1", BannedImage{Hash: "00000000000000ff", ImageID: "user1/id1", Created: ts}))
+	require.NoError(t, s.Ban("site1", BannedImage{Hash: "ffffffffffffffff", ImageID: "user2/id2", Created: ts.Add(time.Hour)}))
+	require.NoError(t, s.Ban("site2", BannedImage{Hash: "0f0f0f0f0f0f0f0f", ImageID: "user3/id3", Created: ts}))
+	assert.EqualError(t, s.Ban("site1", BannedImage{Hash: "bad"}), `invalid image hash "bad"`)
+
+	bans, err = s.Bans("site1")
+	require.NoError(t, err)
+	assert.Equal(t, []BannedImage{
+		{Hash: "ffffffffffffffff", ImageID: "user2/id2", Created: ts.Add(time.Hour)},
+		{Hash: "00000000000000ff", ImageID: "user1/id1", Created: ts},
+	}, bans)
+
+	banned, err := s.banned("site1", imageHash(0x000000000000003f))
+	require.NoError(t, err)
+	assert.True(t, banned, "2 bits differ")
+	banned, err = s.banned("site1", imageHash(0x0000000000000000))
+	require.NoError(t, err)
+	assert.False(t, banned, "8 bits differ")
+	banned, err = s.banned("site3", imageHash(0xff))
+	require.NoError(t, err)
+	assert.False(t, banned, "no bans on the site")
+
+	require.NoError(t, s.Unban("site1", "00000000000000ff"))
+	assert.EqualError(t, s.Unban("site1", "00000000000000ff"), `image hash "00000000000000ff" is not banned on site site1`)
+	banned, err = s.banned("site1", imageHash(0x000000000000003f))
+	require.NoError(t, err)
+	assert.False(t, banned)
+}
+
+func TestHashStore_LegacyImageHashesRemoved(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "hashes.db")
+	db, err := bolt.Open(fileName, 0o600, &bolt.Options{})
+	require.NoError(t, err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bkt, e := tx.CreateBucket([]byte(legacyImageHashesBktName))
+		if e != nil {
+			return e
+		}
+		return bkt.Put([]byte("user1/a5a5a5a5a5a5a5a5-400x300"), []byte("user1/id1"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	s, err := NewHashStore(fileName, bolt.Options{})
+	require.NoError(t, err)
+	defer s.Close()
+	err = s.db.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(legacyImageHashesBktName)))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestService_SaveDuplicatesAndBans(t *testing.T) {
+	fs, teardown := prepareImageTest(t)
+	defer teardown()
+	hashes, err := NewHashStore(filepath.Join(t.TempDir(), "hashes.db"), bolt.Options{})
+	require.NoError(t, err)
+	defer hashes.Close()
+	svc := NewService(fs, ServiceParams{MaxSize: 5_000_000, MaxWidth: 200, MaxHeight: 200, Hashes: hashes})
+
+	pic := hashTestImage(t, 400, 300, 0)
+	id1, err := svc.Save("site1", "user1", bytes.NewReader(pic))
+	require.NoError(t, err)
+	id2, err := svc.Save("site1", "user1", bytes.NewReader(pic))
+	require.NoError(t, err)
+	assert.Equal(t, id1, id2, "the same image of the same user reused")
+	id3, err := svc.Save("site1", "user2", bytes.NewReader(pic))
+	require.NoError(t, err)
+	assert.NotEqual(t, id1, id3, "the same image of another user saved")
+	id4, err := svc.Save("site1", "user1", bytes.NewReader(hashTestImage(t, 400, 300, 1)))
+	require.NoError(t, err)
+	assert.NotEqual(t, id1, id4, "another image of the user saved")
+
+	// the same picture with a part redacted has the same perceptual hash, but is not the same image
+	src, err := png.Decode(bytes.NewReader(pic))
+	require.NoError(t, err)
+	redacted := image.NewRGBA(src.Bounds())
+	draw.Copy(redacted, image.Point{}, src, src.Bounds(), draw.Src, nil)
+	draw.Draw(redacted, image.Rect(10, 10, 30, 20), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, redacted))
+	h1, err := perceptualHash(pic)
+	require.NoError(t, err)
+	h2, err := perceptualHash(buf.Bytes())
+	require.NoError(t, err)
+	require.LessOrEqual(t, bits.OnesCount64(uint64(h1^h2)), banDistance, "similar images, %s and %s", h1, h2)
+	id, err := svc.Save("site1", "user1", bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.NotEqual(t, id1, id, "redacted image saved, not the original reused")
+	orig, err := svc.Load(id1)
+	require.NoError(t, err)
+	img, err := svc.Load(id)
+	require.NoError(t, err)
+	assert.NotEqual(t, orig, img)
+
+	require.NoError(t, svc.Delete(id1))
+	id5, err := svc.Save("site1", "user1", bytes.NewReader(pic))
+	require.NoError(t, err)
+	assert.NotEqual(t, id1, id5, "deleted image not reused")
+
+	ban, err := svc.Ban("site1", id3)
+	require.NoError(t, err)
+	assert.Equal(t, id3, ban.ImageID)
+	_, err = svc.Save("site1", "user3", bytes.NewReader(pic))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrBanned))
+	_, err = svc.Save("site1", "user3", bytes.NewReader(hashTestImage(t, 800, 600, 0)))
+	assert.True(t, errors.Is(err, ErrBanned), "similar image of another size banned")
+	_, err = svc.Save("site2", "user3", bytes.NewReader(pic))
+	assert.NoError(t, err, "image allowed on another site")
+	_, err = svc.Ban("site1", "user1/unknown")
+	assert.Error(t, err)
+
+	bans, err := svc.Bans("site1")
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, ban.Hash, bans[0].Hash)
+	assert.Equal(t, id3, bans[0].ImageID)
+	assert.WithinDuration(t, ban.Created, bans[0].Created, time.Millisecond)
+	require.NoError(t, svc.Unban("site1", ban.Hash))
+	_, err = svc.Save("site1", "user3", bytes.NewReader(pic))
+	assert.NoError(t, err)
+
+	svc.Hashes = nil
+	_, err = svc.Ban("site1", id3)
+	assert.EqualError(t, err, "image hashes are disabled")
+	bans, err = svc.Bans("site1")
+	require.NoError(t, err)
+	assert.Empty(t, bans)
+}
+
+// hashTestImage makes png image of gradient bands, pattern changes the direction of the gradient
+func hashTestImage(t *testing.T, width, height, pattern int) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := range width {
+		for y := range height {
+			v := uint8((x * 4 * 255 / width) % 256) //nolint:gosec // in range
+			if pattern == 1 {
+				v = uint8((y*3*255/height + x*255/width) % 256) //nolint:gosec // in range
+			}
+			m.Set(x, y, color.RGBA{R: v, G: v / 2, B: 255 - v, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, m))
+	return buf.Bytes()
+}
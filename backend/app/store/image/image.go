@@ -1,5 +1,5 @@
 // Package image handles storing, resizing and retrieval of images
-// Provides Store with Save and Load implementations on top of local file system and bolt db.
+// Provides Store with Save and Load implementations on top of local file system, bolt db and S3-compatible storage.
 // Service object encloses Store and add common methods, this is the one consumer should use.
 package image
 
@@ -14,13 +14,15 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	_ "image/gif"  // register gif decoder
-	_ "image/jpeg" // register jpeg decoder
+	_ "image/gif" // register gif decoder
+	"image/jpeg"
 	"image/png"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -28,6 +30,8 @@ import (
 
 	"github.com/PuerkitoBio/goquery"
 	log "github.com/go-pkgz/lgr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/xid"
 	"golang.org/x/image/draw"
 	_ "golang.org/x/image/webp" // register webp decoder so DecodeConfig accepts what readAndValidateImage allows
@@ -55,22 +59,42 @@ type ServiceParams struct {
 	MaxSize      int
 	MaxHeight    int
 	MaxWidth     int
+
+	Variants       []int  // widths of responsive image variants made on commit, no variants if empty
+	VariantFormat  string // format of variants, "png", "jpeg" or "auto" for jpeg variants of jpeg images and png for others
+	VariantQuality int    // quality of jpeg variants, 1-100
+
+	Hashes *HashStore // digests of saved and hashes of banned images, duplicates detection and bans are disabled if nil
+
+	UserQuota int64 // max total size of images saved by the user, in bytes, unlimited if 0
 }
 
+// ErrQuotaExceeded returned by Service.Save when the user's images would take more than ServiceParams.UserQuota
+var ErrQuotaExceeded = errors.New("images quota exceeded")
+
 // StoreInfo contains image store meta information
 type StoreInfo struct {
 	FirstStagingImageTS time.Time
 }
 
+// Meta contains information about the stored image
+type Meta struct {
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"` // upload time, zero if unknown
+	Staging bool      `json:"staging"` // image is not committed yet, i.e. not used in any posted comment
+}
+
 // Store defines interface for saving and loading pictures.
 // Declares two-stage save with Commit. Save stores to staging area and Commit moves to the final location.
 // Two-stage commit scheme is used for not storing images which are uploaded but later never used in the comments,
 // e.g. when somebody uploaded a picture but did not sent the comment.
 type Store interface {
-	Info() (StoreInfo, error)         // get meta information about storage
-	Save(id string, img []byte) error // store image with passed id to staging
-	Load(id string) ([]byte, error)   // load image by ID
-	Delete(id string) error           // delete image by ID
+	Info() (StoreInfo, error)           // get meta information about storage
+	Save(id string, img []byte) error   // store image with passed id to staging
+	Load(id string) ([]byte, error)     // load image by ID
+	Delete(id string) error             // delete image by ID
+	List(userID string) ([]Meta, error) // list images of the user, all images if userID is empty
 
 	ResetCleanupTimer(id string) error                    // resets cleanup timer for the image, called on comment preview
 	Commit(id string) error                               // move image from staging to permanent
@@ -79,6 +103,20 @@ type Store interface {
 
 const submitQueueSize = 5000
 
+// cachedImagesPrefix is the prefix of IDs of external images cached by the image proxy
+const cachedImagesPrefix = "cached_images/"
+
+var (
+	stagingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "remark42_image_staging_submits", Help: "submits waiting for images commit from staging"})
+	savedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "remark42_image_saved_total", Help: "images saved to staging"})
+	commitCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "remark42_image_commits_total", Help: "images commits from staging by status"}, []string{"status"})
+	cleanupCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "remark42_image_cleanups_total", Help: "staging cleanup runs by status"}, []string{"status"})
+)
+
 type submitReq struct {
 	idsFn func() (ids []string)
 	TS    time.Time
@@ -89,13 +127,19 @@ func NewService(s Store, p ServiceParams) *Service {
 	return &Service{ServiceParams: p, store: s}
 }
 
-// Commit multiple ids immediately
+// Commit multiple ids immediately, and make responsive variants of committed images
 func (s *Service) Commit(idsFn func() []string) error {
 	var errs []error
 	for _, id := range idsFn() {
 		err := s.store.Commit(id)
 		if err != nil {
+			commitCounter.WithLabelValues("error").Inc()
 			errs = append(errs, fmt.Errorf("failed to commit image %s: %w", id, err))
+			continue
+		}
+		commitCounter.WithLabelValues("ok").Inc()
+		if err = s.makeVariants(id); err != nil {
+			errs = append(errs, fmt.Errorf("failed to make variants of image %s: %w", id, err))
 		}
 	}
 	return errors.Join(errs...)
@@ -122,12 +166,14 @@ func (s *Service) Submit(idsFn func() []string) {
 				}
 
 				s.submitCount.Add(-1)
+				stagingGauge.Add(-1)
 			}
 			log.Printf("[INFO] image submitter terminated")
 		})
 	})
 
 	s.submitCount.Add(1)
+	stagingGauge.Add(1)
 
 	// reset cleanup timer before submitting the images
 	// to prevent them from being cleaned up while waiting for EditDuration to expire
@@ -150,6 +196,30 @@ func (s *Service) ExtractNonProxiedPictures(commentHTML string) (ids []string) {
 	return s.extractImageIDs(commentHTML, false)
 }
 
+// RemovePicture removes all images with the id from the doc html, i.e. user/pic.png.
+// Returns the doc html unchanged if it has no such images.
+func (s *Service) RemovePicture(commentHTML, id string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(commentHTML))
+	if err != nil {
+		log.Printf("[ERROR] can't parse commentHTML to remove image %s: %q, error: %v", id, commentHTML, err)
+		return commentHTML
+	}
+	images := doc.Find("img").FilterFunction(func(_ int, sl *goquery.Selection) bool {
+		im, ok := sl.Attr("src")
+		return ok && s.uploadedImageID(im) == id
+	})
+	if images.Length() == 0 {
+		return commentHTML
+	}
+	images.Remove()
+	res, err := doc.Find("body").Html()
+	if err != nil {
+		log.Printf("[ERROR] can't render commentHTML after image %s removal: %v", id, err)
+		return commentHTML
+	}
+	return res
+}
+
 // Cleanup runs periodic cleanup with 1.5*ServiceParams.EditDuration. Blocking loop, should be called inside of goroutine by consumer
 func (s *Service) Cleanup(ctx context.Context) {
 	if s.EditDuration <= 0 {
@@ -168,8 +238,11 @@ func (s *Service) Cleanup(ctx context.Context) {
 			return
 		case <-time.After(cleanupTTL):
 			if err := s.store.Cleanup(ctx, cleanupTTL); err != nil {
+				cleanupCounter.WithLabelValues("error").Inc()
 				log.Printf("[WARN] failed to cleanup, %v", err)
+				continue
 			}
+			cleanupCounter.WithLabelValues("ok").Inc()
 		}
 	}
 }
@@ -217,24 +290,261 @@ func (s *Service) Load(id string) ([]byte, error) {
 	return s.store.Load(id)
 }
 
-// Delete wraps storage Delete function.
+// LoadVariant loads the narrowest variant of the image not narrower than width,
+// or the original image if there is no such variant or width is not positive.
+// Returns ID of the loaded image, which is the passed id for the original image.
+func (s *Service) LoadVariant(id string, width int) (img []byte, loadedID string, err error) {
+	best := 0
+	for _, w := range s.Variants {
+		if width > 0 && w >= width && (best == 0 || w < best) {
+			best = w
+		}
+	}
+	// variant could be missing if the image is not committed yet or narrower than the variant
+	if best > 0 {
+		if img, err = s.store.Load(VariantID(id, best)); err == nil {
+			return img, VariantID(id, best), nil
+		}
+	}
+	img, err = s.store.Load(id)
+	return img, id, err
+}
+
+// Delete wraps storage Delete function, variants of the image deleted as well.
 func (s *Service) Delete(id string) error {
+	for _, w := range s.Variants {
+		_ = s.store.Delete(VariantID(id, w)) // variant could be missing, i.e. for images narrower than it
+	}
 	return s.store.Delete(id)
 }
 
-// Save wraps storage Save function, validating and resizing the image before calling it.
-func (s *Service) Save(userID string, r io.Reader) (id string, err error) {
-	id = path.Join(userID, guid())
-	return id, s.SaveWithID(id, r)
+// Save wraps storage Save function, validating, stripping metadata and resizing the image before calling it.
+// With ServiceParams.Hashes set, the image similar to one banned on the site is rejected with ErrBanned,
+// and for exactly the same image, after metadata stripping, saved by the user before ID of the existing image
+// returned instead of saving it again.
+// New image exceeding the user's quota is rejected with ErrQuotaExceeded.
+func (s *Service) Save(siteID, userID string, r io.Reader) (id string, err error) {
+	img, err := s.prepareImage(r)
+	if err != nil {
+		return "", err
+	}
+	if s.Hashes == nil {
+		return s.saveUserImage(userID, img)
+	}
+
+	hash, err := perceptualHash(img)
+	if err != nil {
+		return "", fmt.Errorf("can't hash image: %w", err)
+	}
+	banned, err := s.Hashes.banned(siteID, hash)
+	if err != nil {
+		return "", fmt.Errorf("can't check banned images: %w", err)
+	}
+	if banned {
+		return "", fmt.Errorf("image %s rejected on site %s: %w", hash, siteID, ErrBanned)
+	}
+	digest := imageDigest(img)
+	if id, err = s.Hashes.findImage(userID, digest); err == nil && id != "" {
+		// the image could be removed since, e.g. cleaned up from staging as never used in a comment
+		if _, err = s.store.Load(id); err == nil {
+			_ = s.store.ResetCleanupTimer(id) // fails for committed images, which are not cleaned up anyway
+			log.Printf("[DEBUG] image %s reused for duplicate upload by %s", id, userID)
+			return id, nil
+		}
+	}
+
+	if id, err = s.saveUserImage(userID, img); err != nil {
+		return "", err
+	}
+	if err = s.Hashes.setImage(userID, digest, id); err != nil {
+		log.Printf("[WARN] can't store digest of image %s, %v", id, err)
+	}
+	return id, nil
 }
 
-// SaveWithID wraps storage Save function, validating and resizing the image before calling it.
+// SaveWithID wraps storage Save function, validating, stripping metadata and resizing the image before calling it.
 func (s *Service) SaveWithID(id string, r io.Reader) error {
 	img, err := s.prepareImage(r)
 	if err != nil {
 		return err
 	}
-	return s.store.Save(id, img)
+	return s.save(id, img)
+}
+
+// Ban bans the image on the site, so it and similar images are rejected by Save.
+// Returns the hash of the image, which could be passed to Unban.
+func (s *Service) Ban(siteID, id string) (BannedImage, error) {
+	if s.Hashes == nil {
+		return BannedImage{}, errors.New("image hashes are disabled")
+	}
+	img, err := s.store.Load(id)
+	if err != nil {
+		return BannedImage{}, fmt.Errorf("can't load image %s: %w", id, err)
+	}
+	hash, err := perceptualHash(img)
+	if err != nil {
+		return BannedImage{}, fmt.Errorf("can't hash image %s: %w", id, err)
+	}
+	res := BannedImage{Hash: hash.String(), ImageID: id, Created: time.Now()}
+	if err = s.Hashes.Ban(siteID, res); err != nil {
+		return BannedImage{}, fmt.Errorf("can't ban image %s: %w", id, err)
+	}
+	return res, nil
+}
+
+// Unban removes the image hash from banned on the site
+func (s *Service) Unban(siteID, hash string) error {
+	if s.Hashes == nil {
+		return errors.New("image hashes are disabled")
+	}
+	return s.Hashes.Unban(siteID, hash)
+}
+
+// Bans returns images banned on the site, empty list if hashes are disabled
+func (s *Service) Bans(siteID string) ([]BannedImage, error) {
+	if s.Hashes == nil {
+		return []BannedImage{}, nil
+	}
+	return s.Hashes.Bans(siteID)
+}
+
+// List returns images of the user, or all images if userID is empty, the most recent first.
+// Variants of the images and cached external images are not listed.
+func (s *Service) List(userID string) ([]Meta, error) {
+	images, err := s.store.List(userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Meta, 0, len(images))
+	for _, m := range images {
+		if strings.HasPrefix(m.ID, cachedImagesPrefix) || isVariantID(m.ID) {
+			continue
+		}
+		res = append(res, m)
+	}
+	slices.SortFunc(res, func(a, b Meta) int {
+		if c := b.Created.Compare(a.Created); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return res, nil
+}
+
+// saveUserImage saves the image of the user with new ID, checking the user's quota first
+func (s *Service) saveUserImage(userID string, img []byte) (string, error) {
+	if s.UserQuota > 0 {
+		images, err := s.List(userID)
+		if err != nil {
+			return "", fmt.Errorf("can't list images of %s: %w", userID, err)
+		}
+		total := int64(len(img))
+		for _, m := range images {
+			total += m.Size
+		}
+		if total > s.UserQuota {
+			return "", fmt.Errorf("user %s images size %d over %d bytes: %w", userID, total, s.UserQuota, ErrQuotaExceeded)
+		}
+	}
+	id := path.Join(userID, guid())
+	return id, s.save(id, img)
+}
+
+func (s *Service) save(id string, img []byte) error {
+	if err := s.store.Save(id, img); err != nil {
+		return err
+	}
+	savedCounter.Inc()
+	return nil
+}
+
+// makeVariants saves and commits resized variants of the committed image for all configured widths smaller than
+// the image. Variants not smaller in size than the original image are not saved, as well as variants of gif images,
+// which would lose all frames of animation but the first one. Cached external images don't get variants,
+// as they are served by the image proxy.
+func (s *Service) makeVariants(id string) error {
+	if len(s.Variants) == 0 || strings.HasPrefix(id, cachedImagesPrefix) {
+		return nil
+	}
+	data, err := s.store.Load(id)
+	if err != nil {
+		return fmt.Errorf("can't load image: %w", err)
+	}
+	contentType := http.DetectContentType(data)
+	if contentType == "image/gif" {
+		return nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("can't decode image config: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > int64(maxImagePixels) || !slices.ContainsFunc(s.Variants, func(w int) bool { return w < cfg.Width }) {
+		return nil
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("can't decode image: %w", err)
+	}
+
+	// webp images get png variants, there is no webp encoder without cgo
+	useJPEG := s.VariantFormat == "jpeg" || (s.VariantFormat == "auto" && contentType == "image/jpeg")
+	var errs []error
+	for _, w := range s.Variants {
+		if w <= 0 || w >= cfg.Width {
+			continue
+		}
+		variant, err := encodeVariant(src, w, useJPEG, s.VariantQuality)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("can't encode %dpx variant: %w", w, err))
+			continue
+		}
+		if len(variant) >= len(data) {
+			continue // original image is smaller, served instead of the variant
+		}
+		if err = s.store.Save(VariantID(id, w), variant); err == nil {
+			err = s.store.Commit(VariantID(id, w))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("can't store %dpx variant: %w", w, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// encodeVariant resizes image proportionally to the width and encodes it to png or jpeg with given quality.
+// Transparent areas of jpeg variants are filled with white, as jpeg has no transparency.
+func encodeVariant(src image.Image, width int, useJPEG bool, quality int) ([]byte, error) {
+	b := src.Bounds()
+	height := max(1, b.Dy()*width/b.Dx())
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	var out bytes.Buffer
+	if !useJPEG {
+		draw.CatmullRom.Scale(m, m.Bounds(), src, b, draw.Src, nil)
+		err := png.Encode(&out, m)
+		return out.Bytes(), err
+	}
+	draw.Draw(m, m.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(m, m.Bounds(), src, b, draw.Over, nil)
+	if quality <= 0 || quality > 100 {
+		quality = jpeg.DefaultQuality
+	}
+	err := jpeg.Encode(&out, m, &jpeg.Options{Quality: quality})
+	return out.Bytes(), err
+}
+
+// VariantID returns ID of the image variant with given width
+func VariantID(id string, width int) string {
+	return id + ".w" + strconv.Itoa(width)
+}
+
+// isVariantID checks if the ID is the one of the image variant made by VariantID
+func isVariantID(id string) bool {
+	i := strings.LastIndex(id, ".w")
+	if i < 0 {
+		return false
+	}
+	_, err := strconv.Atoi(id[i+2:])
+	return err == nil
 }
 
 // returns list of image IDs from the comment html, including proxied images if includeProxied is true
@@ -246,12 +556,8 @@ func (s *Service) extractImageIDs(commentHTML string, includeProxied bool) (ids
 	}
 	doc.Find("img").Each(func(_ int, sl *goquery.Selection) {
 		if im, ok := sl.Attr("src"); ok {
-			if strings.Contains(im, s.ImageAPI) {
-				elems := strings.Split(im, "/")
-				if len(elems) >= 2 {
-					id := elems[len(elems)-2] + "/" + elems[len(elems)-1]
-					ids = append(ids, id)
-				}
+			if id := s.uploadedImageID(im); id != "" {
+				ids = append(ids, id)
 			}
 			if includeProxied && strings.Contains(im, s.ProxyAPI) {
 				proxiedURL, err := url.Parse(im)
@@ -274,6 +580,18 @@ func (s *Service) extractImageIDs(commentHTML string, includeProxied bool) (ids
 	return ids
 }
 
+// uploadedImageID returns image ID from the url of uploaded image, empty for other urls
+func (s *Service) uploadedImageID(imgURL string) string {
+	if !strings.Contains(imgURL, s.ImageAPI) {
+		return ""
+	}
+	elems := strings.Split(imgURL, "/")
+	if len(elems) < 2 {
+		return ""
+	}
+	return elems[len(elems)-2] + "/" + elems[len(elems)-1]
+}
+
 // maxImagePixels caps the declared pixel count of an image before any raster decode
 // is allowed. Without this, a tiny compressed "decompression bomb" image declaring
 // e.g. 65535x65535 px would force image.Decode to allocate gigabytes of pixel memory
@@ -281,13 +599,19 @@ func (s *Service) extractImageIDs(commentHTML string, includeProxied bool) (ids
 // (~4096x4096) while keeping peak allocation bounded.
 const maxImagePixels = 16 * 1024 * 1024
 
-// prepareImage calls readAndValidateImage and resize on provided image.
+// prepareImage calls readAndValidateImage, stripMetadata and resize on provided image.
+// Metadata is stripped before resize, as images fitting the limits are not re-encoded by it,
+// and the orientation of the image is applied before its size is checked.
 func (s *Service) prepareImage(r io.Reader) ([]byte, error) {
 	data, err := readAndValidateImage(r, s.MaxSize)
 	if err != nil {
 		return nil, fmt.Errorf("can't load image: %w", err)
 	}
 
+	if data, err = stripMetadata(data); err != nil {
+		return nil, fmt.Errorf("can't strip image metadata: %w", err)
+	}
+
 	resized := resize(data, s.MaxWidth, s.MaxHeight)
 	if resized == nil {
 		return nil, fmt.Errorf("image rejected: malformed or exceeds %d-pixel safe limit", maxImagePixels)
@@ -423,5 +747,5 @@ func CachedImgID(imgURL string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("can parse url %s: %w", imgURL, err)
 	}
-	return fmt.Sprintf("cached_images/%s-%s", Sha1Str(parsedURL.Hostname()), Sha1Str(imgURL)), nil
+	return fmt.Sprintf(cachedImagesPrefix+"%s-%s", Sha1Str(parsedURL.Hostname()), Sha1Str(imgURL)), nil
 }
@@ -31,6 +31,9 @@ var _ Store = &StoreMock{}
 //			InfoFunc: func() (StoreInfo, error) {
 //				panic("mock out the Info method")
 //			},
+//			ListFunc: func(userID string) ([]Meta, error) {
+//				panic("mock out the List method")
+//			},
 //			LoadFunc: func(id string) ([]byte, error) {
 //				panic("mock out the Load method")
 //			},
@@ -59,6 +62,9 @@ type StoreMock struct {
 	// InfoFunc mocks the Info method.
 	InfoFunc func() (StoreInfo, error)
 
+	// ListFunc mocks the List method.
+	ListFunc func(userID string) ([]Meta, error)
+
 	// LoadFunc mocks the Load method.
 	LoadFunc func(id string) ([]byte, error)
 
@@ -90,6 +96,11 @@ type StoreMock struct {
 		// Info holds details about calls to the Info method.
 		Info []struct {
 		}
+		// List holds details about calls to the List method.
+		List []struct {
+			// UserID is the userID argument value.
+			UserID string
+		}
 		// Load holds details about calls to the Load method.
 		Load []struct {
 			// ID is the id argument value.
@@ -112,6 +123,7 @@ type StoreMock struct {
 	lockCommit            sync.RWMutex
 	lockDelete            sync.RWMutex
 	lockInfo              sync.RWMutex
+	lockList              sync.RWMutex
 	lockLoad              sync.RWMutex
 	lockResetCleanupTimer sync.RWMutex
 	lockSave              sync.RWMutex
@@ -244,6 +256,38 @@ func (mock *StoreMock) InfoCalls() []struct {
 	return calls
 }
 
+// List calls ListFunc.
+func (mock *StoreMock) List(userID string) ([]Meta, error) {
+	if mock.ListFunc == nil {
+		panic("StoreMock.ListFunc: method is nil but Store.List was just called")
+	}
+	callInfo := struct {
+		UserID string
+	}{
+		UserID: userID,
+	}
+	mock.lockList.Lock()
+	mock.calls.List = append(mock.calls.List, callInfo)
+	mock.lockList.Unlock()
+	return mock.ListFunc(userID)
+}
+
+// ListCalls gets all the calls that were made to List.
+// Check the length with:
+//
+//	len(mockedStore.ListCalls())
+func (mock *StoreMock) ListCalls() []struct {
+	UserID string
+} {
+	var calls []struct {
+		UserID string
+	}
+	mock.lockList.RLock()
+	calls = mock.calls.List
+	mock.lockList.RUnlock()
+	return calls
+}
+
 // Load calls LoadFunc.
 func (mock *StoreMock) Load(id string) ([]byte, error) {
 	if mock.LoadFunc == nil {
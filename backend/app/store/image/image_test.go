@@ -6,6 +6,10 @@ import (
 	"encoding/base64"
 	"fmt"
 	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"os"
 	"strconv"
@@ -14,6 +18,7 @@ import (
 	"testing/synctest"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -82,7 +87,7 @@ func assertImageFits(t *testing.T, data []byte, limitW, limitH int) {
 func TestService_SaveTooLarge(t *testing.T) {
 	svc := Service{ServiceParams: ServiceParams{ImageAPI: "/blah/"}}
 	svc.MaxSize = 2000
-	_, err := svc.Save("user2", io.MultiReader(gopherPNG(), gopherPNG()))
+	_, err := svc.Save("site", "user2", io.MultiReader(gopherPNG(), gopherPNG()))
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "is too large")
 	err = svc.SaveWithID("test_id", io.MultiReader(gopherPNG(), gopherPNG()))
@@ -93,7 +98,7 @@ func TestService_SaveTooLarge(t *testing.T) {
 func TestService_WrongFormat(t *testing.T) {
 	svc := Service{ServiceParams: ServiceParams{ImageAPI: "/blah/"}}
 
-	_, err := svc.Save("user1", strings.NewReader("blah blah bad image"))
+	_, err := svc.Save("site", "user1", strings.NewReader("blah blah bad image"))
 	assert.Error(t, err)
 }
 
@@ -141,6 +146,18 @@ func TestService_ExtractPictures(t *testing.T) {
 	require.Empty(t, ids)
 }
 
+func TestService_RemovePicture(t *testing.T) {
+	svc := Service{ServiceParams: ServiceParams{ImageAPI: "https://remark42.example.com/api/v1/picture/", ProxyAPI: "https://remark42.example.com/api/v1/img"}}
+	html := `<p>blah <img src="https://remark42.example.com/api/v1/picture/user1/pic1.png" alt="pic1" loading="lazy"/> foo</p>
+<p><img src="https://remark42.example.com/api/v1/picture/user1/pic2.png"/><img src="https://remark42.example.com/api/v1/picture/user1/pic1.png"/></p>`
+	res := svc.RemovePicture(html, "user1/pic1.png")
+	assert.Equal(t, `<p>blah  foo</p>
+<p><img src="https://remark42.example.com/api/v1/picture/user1/pic2.png"/></p>`, res)
+	assert.Equal(t, []string{"user1/pic2.png"}, svc.ExtractPictures(res))
+
+	assert.Equal(t, html, svc.RemovePicture(html, "user1/pic3.png"), "no image, html not changed")
+}
+
 func TestService_Cleanup(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		store := StoreMock{
@@ -165,8 +182,10 @@ func TestService_Submit(t *testing.T) {
 			ResetCleanupTimerFunc: func(string) error { return nil },
 		}
 		svc := NewService(&store, ServiceParams{ImageAPI: "/blah/", EditDuration: time.Millisecond * 100})
+		commits, staging := testutil.ToFloat64(commitCounter.WithLabelValues("ok")), testutil.ToFloat64(stagingGauge)
 		svc.Submit(func() []string { return []string{"id1", "id2", "id3"} })
 		assert.Equal(t, 3, len(store.ResetCleanupTimerCalls()))
+		assert.InDelta(t, staging+1, testutil.ToFloat64(stagingGauge), 0.001)
 		err := svc.Commit(func() []string { return []string{"id4", "id5"} })
 		assert.NoError(t, err)
 		svc.Submit(func() []string { return []string{"id6", "id7"} })
@@ -175,6 +194,8 @@ func TestService_Submit(t *testing.T) {
 		assert.Equal(t, 2, len(store.CommitCalls()))
 		time.Sleep(time.Millisecond * 175)
 		assert.Equal(t, 7, len(store.CommitCalls()))
+		assert.InDelta(t, commits+7, testutil.ToFloat64(commitCounter.WithLabelValues("ok")), 0.001)
+		assert.InDelta(t, staging, testutil.ToFloat64(stagingGauge), 0.001)
 		svc.Close(context.TODO())
 	})
 }
@@ -337,6 +358,124 @@ func TestService_resizeRejectsDecompressionBomb(t *testing.T) {
 	assert.Equal(t, 0, len(store.SaveCalls()), "rejected bomb must not be stored")
 }
 
+func TestService_Variants(t *testing.T) {
+	fs, teardown := prepareImageTest(t)
+	defer teardown()
+	svc := NewService(fs, ServiceParams{MaxSize: 5_000_000, MaxWidth: 2400, MaxHeight: 900, Variants: []int{200, 400, 1000},
+		VariantFormat: "auto", VariantQuality: 80})
+
+	pic := func(format string) io.Reader {
+		m := image.NewRGBA(image.Rect(0, 0, 800, 600))
+		for x := range 800 {
+			for y := range 600 {
+				m.Set(x, y, color.RGBA{R: uint8(x * y), G: uint8(x + y), B: uint8(x ^ y), A: 255}) //nolint:gosec // overflow is the pattern
+			}
+		}
+		var buf bytes.Buffer
+		switch format {
+		case "jpeg":
+			require.NoError(t, jpeg.Encode(&buf, m, nil))
+		case "gif":
+			require.NoError(t, gif.Encode(&buf, m, nil))
+		default:
+			require.NoError(t, png.Encode(&buf, m))
+		}
+		return &buf
+	}
+	decode := func(data []byte) (format string, width int) {
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+		require.NoError(t, err)
+		return format, cfg.Width
+	}
+
+	require.NoError(t, svc.SaveWithID("user1/png", pic("png")))
+	require.NoError(t, svc.SaveWithID("user1/jpeg", pic("jpeg")))
+	require.NoError(t, svc.SaveWithID("user1/gif", pic("gif")))
+	_, loadedID, err := svc.LoadVariant("user1/png", 200)
+	require.NoError(t, err)
+	assert.Equal(t, "user1/png", loadedID, "original image served before commit")
+
+	require.NoError(t, svc.Commit(func() []string { return []string{"user1/png", "user1/jpeg", "user1/gif"} }))
+
+	tbl := []struct {
+		id       string
+		width    int
+		loadedID string
+		format   string
+		resW     int
+	}{
+		{"user1/png", 100, "user1/png.w200", "png", 200},
+		{"user1/png", 200, "user1/png.w200", "png", 200},
+		{"user1/png", 201, "user1/png.w400", "png", 400},
+		{"user1/png", 500, "user1/png", "png", 800},
+		{"user1/png", 2000, "user1/png", "png", 800},
+		{"user1/jpeg", 300, "user1/jpeg.w400", "jpeg", 400},
+		{"user1/gif", 300, "user1/gif", "gif", 800},
+	}
+	for _, tt := range tbl {
+		img, loadedID, err := svc.LoadVariant(tt.id, tt.width)
+		require.NoError(t, err)
+		assert.Equal(t, tt.loadedID, loadedID)
+		format, width := decode(img)
+		assert.Equal(t, tt.format, format, loadedID)
+		assert.Equal(t, tt.resW, width, loadedID)
+	}
+
+	svc.VariantFormat = "jpeg"
+	require.NoError(t, svc.SaveWithID("user1/png2", pic("png")))
+	require.NoError(t, svc.Commit(func() []string { return []string{"user1/png2"} }))
+	img, _, err := svc.LoadVariant("user1/png2", 200)
+	require.NoError(t, err)
+	format, _ := decode(img)
+	assert.Equal(t, "jpeg", format)
+
+	require.NoError(t, svc.Delete("user1/png"))
+	_, err = svc.Load("user1/png")
+	assert.Error(t, err)
+	_, err = fs.Load("user1/png.w200")
+	assert.Error(t, err, "variant deleted")
+}
+
+func TestService_ListAndQuota(t *testing.T) {
+	fs, teardown := prepareImageTest(t)
+	defer teardown()
+	svc := NewService(fs, ServiceParams{MaxSize: 5_000_000, MaxWidth: 2000, MaxHeight: 2000, UserQuota: 3000})
+
+	id1, err := svc.Save("site", "user1", gopherPNG())
+	require.NoError(t, err)
+	require.NoError(t, svc.Commit(func() []string { return []string{id1} }))
+	require.NoError(t, fs.Save(VariantID(id1, 100), gopherPNGBytes()))
+	require.NoError(t, svc.SaveWithID(cachedImagesPrefix+"abc", gopherPNG()))
+	mtime := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(fs.location(fs.Location, id1), mtime, mtime))
+
+	id2, err := svc.Save("site", "user1", gopherPNG())
+	require.NoError(t, err)
+	_, err = svc.Save("site", "user1", gopherPNG())
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Contains(t, err.Error(), "user user1 images size 4386 over 3000 bytes")
+	_, err = svc.Save("site", "user2", gopherPNG())
+	require.NoError(t, err, "quota is per user")
+
+	images, err := svc.List("user1")
+	require.NoError(t, err)
+	require.Len(t, images, 2, "variants not listed")
+	assert.Equal(t, id2, images[0].ID, "the most recent first")
+	assert.True(t, images[0].Staging)
+	assert.Equal(t, id1, images[1].ID)
+	assert.False(t, images[1].Staging)
+	assert.Equal(t, int64(1462), images[1].Size)
+
+	images, err = svc.List("")
+	require.NoError(t, err)
+	assert.Len(t, images, 3, "cached images not listed")
+
+	require.NoError(t, svc.Delete(id2))
+	_, err = svc.Save("site", "user1", gopherPNG())
+	assert.NoError(t, err, "space freed by deleted image")
+}
+
 func TestGetProportionalSizes(t *testing.T) {
 	tbl := []struct {
 		inpW, inpH     int
@@ -0,0 +1,317 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+
+	"golang.org/x/image/draw"
+)
+
+// stripMetadata removes metadata, like EXIF with GPS location and camera serial number or XMP, from the image.
+// Metadata is removed on the container level, so the image itself is not re-encoded, except for jpeg images
+// with EXIF orientation, which are rotated to be shown the same way without the orientation tag.
+// Malformed images are rejected, as the metadata can't be reliably found in them.
+func stripMetadata(data []byte) ([]byte, error) {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		res, orientation, err := stripJPEG(data)
+		if err != nil || orientation <= 1 || orientation > 8 {
+			return res, err
+		}
+		return orientJPEG(res, orientation)
+	case "image/png":
+		return stripPNG(data)
+	case "image/webp":
+		return stripWebP(data)
+	case "image/gif":
+		return stripGIF(data)
+	}
+	return nil, errors.New("unsupported image format")
+}
+
+// stripJPEG removes all APPn segments but JFIF (APP0), ICC profile (APP2) and Adobe color transform (APP14),
+// as well as comments. Returns EXIF orientation of the image, 0 if not set.
+func stripJPEG(data []byte) (res []byte, orientation int, err error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, errors.New("malformed jpeg, no start of image")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	pos := 2
+	for {
+		if pos >= len(data) || data[pos] != 0xFF {
+			return nil, 0, fmt.Errorf("malformed jpeg, no marker at %d", pos)
+		}
+		for pos < len(data) && data[pos] == 0xFF { // markers may be preceded by any number of fill bytes
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, 0, errors.New("malformed jpeg, unexpected end of data")
+		}
+		marker := data[pos]
+		pos++
+		if marker == 0xD9 || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) { // segments without length
+			out.Write([]byte{0xFF, marker})
+			if marker == 0xD9 {
+				return out.Bytes(), orientation, nil
+			}
+			continue
+		}
+		if pos+2 > len(data) {
+			return nil, 0, errors.New("malformed jpeg, unexpected end of data")
+		}
+		size := int(binary.BigEndian.Uint16(data[pos:]))
+		if size < 2 || pos+size > len(data) {
+			return nil, 0, fmt.Errorf("malformed jpeg, bad segment size at %d", pos)
+		}
+		segment := data[pos+2 : pos+size]
+		if marker == 0xDA { // start of scan, the rest is image data with no metadata
+			out.Write([]byte{0xFF, marker})
+			out.Write(data[pos:])
+			return out.Bytes(), orientation, nil
+		}
+		keep := true
+		switch {
+		case marker == 0xE1:
+			if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				orientation = exifOrientation(segment[6:])
+			}
+			keep = false
+		case marker == 0xE2:
+			keep = bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00"))
+		case marker == 0xE0 || marker == 0xEE:
+			keep = true
+		case marker > 0xE0 && marker <= 0xEF, marker == 0xFE:
+			keep = false
+		}
+		if keep {
+			out.Write([]byte{0xFF, marker})
+			out.Write(data[pos : pos+size])
+		}
+		pos += size
+	}
+}
+
+// exifOrientation returns value of orientation tag from IFD0 of EXIF tiff data, 0 if not found
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := range count {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 { // orientation, short
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// orientJPEG rotates and flips jpeg image according to EXIF orientation and re-encodes it
+func orientJPEG(data []byte, orientation int) ([]byte, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode jpeg config: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > int64(maxImagePixels) {
+		return nil, fmt.Errorf("image dimensions %dx%d exceed safe limit", cfg.Width, cfg.Height)
+	}
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode jpeg: %w", err)
+	}
+	var out bytes.Buffer
+	if err = jpeg.Encode(&out, orient(src, orientation), &jpeg.Options{Quality: 90}); err != nil {
+		return nil, fmt.Errorf("can't encode jpeg: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// orient returns image transformed according to EXIF orientation 2-8, from mirrored to rotated by 90° clockwise
+func orient(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	m := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(m, m.Bounds(), src, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	res := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 { // transposed orientations swap width and height
+		res = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := range h {
+		for x := range w {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(res.Pix[res.PixOffset(dx, dy):res.PixOffset(dx, dy)+4], m.Pix[m.PixOffset(x, y):m.PixOffset(x, y)+4])
+		}
+	}
+	return res
+}
+
+// stripPNG removes text, EXIF and modification time chunks
+func stripPNG(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errors.New("malformed png, no signature")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+	pos := len(signature)
+	for pos+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + size // length, type, data and crc
+		if size < 0 || end > len(data) || end < pos {
+			return nil, fmt.Errorf("malformed png, bad chunk size at %d", pos)
+		}
+		switch chunkType {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+		if chunkType == "IEND" {
+			return out.Bytes(), nil
+		}
+	}
+	return nil, errors.New("malformed png, no end chunk")
+}
+
+// stripWebP removes EXIF and XMP chunks and clears flags of them in extended format header
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("malformed webp, no riff header")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	pos := 12
+	for pos+8 <= len(data) {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size + size%2 // chunks are padded to even size
+		if size%2 == 1 && end == len(data)+1 {
+			end = len(data) // some encoders omit padding of the last chunk
+		}
+		if size < 0 || end > len(data) || end < pos {
+			return nil, fmt.Errorf("malformed webp, bad chunk size at %d", pos)
+		}
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			chunk := bytes.Clone(data[pos:end])
+			if len(chunk) > 8 {
+				chunk[8] &^= 0x08 | 0x04 // exif and xmp flags
+			}
+			out.Write(chunk)
+		default:
+			out.Write(data[pos:end])
+		}
+		pos = end
+	}
+	res := out.Bytes()
+	binary.LittleEndian.PutUint32(res[4:], uint32(len(res)-8)) //nolint:gosec // size is limited by max image size
+	return res, nil
+}
+
+// stripGIF removes comment and XMP application extensions
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return nil, errors.New("malformed gif, no header")
+	}
+	colorTableSize := func(flags byte) int {
+		if flags&0x80 == 0 {
+			return 0
+		}
+		return 3 << ((flags & 0x07) + 1)
+	}
+	// subBlocksEnd returns position after the chain of data sub-blocks starting at pos
+	subBlocksEnd := func(pos int) (int, error) {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return pos, nil
+			}
+		}
+		return 0, errors.New("malformed gif, unexpected end of data")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	pos := 13 + colorTableSize(data[10]) // header, logical screen descriptor and global color table
+	if pos > len(data) {
+		return nil, errors.New("malformed gif, unexpected end of data")
+	}
+	out.Write(data[:pos])
+	for pos < len(data) {
+		start := pos
+		switch data[pos] {
+		case 0x3B: // trailer, data after it is ignored by decoders and dropped
+			out.WriteByte(0x3B)
+			return out.Bytes(), nil
+		case 0x21: // extension
+			if pos+2 > len(data) {
+				return nil, errors.New("malformed gif, unexpected end of data")
+			}
+			label := data[pos+1]
+			end, err := subBlocksEnd(pos + 2)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			isXMP := label == 0xFF && bytes.HasPrefix(data[start+2:end], []byte("\x0bXMP DataXMP"))
+			if label == 0xFE || isXMP {
+				continue
+			}
+		case 0x2C: // image descriptor, local color table, lzw code size and image data
+			if pos+11 > len(data) {
+				return nil, errors.New("malformed gif, unexpected end of data")
+			}
+			end, err := subBlocksEnd(pos + 10 + colorTableSize(data[pos+9]) + 1)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+		default:
+			return nil, fmt.Errorf("malformed gif, unknown block %#x at %d", data[pos], pos)
+		}
+		out.Write(data[start:pos])
+	}
+	return nil, errors.New("malformed gif, no trailer")
+}
@@ -0,0 +1,239 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripMetadata_JPEG(t *testing.T) {
+	orig, err := os.ReadFile("testdata/circles.jpg")
+	require.NoError(t, err)
+	require.Contains(t, string(orig), "Exif")
+	require.Contains(t, string(orig), "Photoshop")
+
+	res, err := stripMetadata(orig)
+	require.NoError(t, err)
+	assert.NotContains(t, string(res), "Exif")
+	assert.NotContains(t, string(res), "Photoshop")
+	assert.Contains(t, string(res), "JFIF", "jfif header kept")
+	assert.Equal(t, len(orig)-90-58, len(res), "only exif and iptc segments removed, image data kept as is")
+	assert.Equal(t, orig[len(orig)-1000:], res[len(res)-1000:])
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(res))
+	require.NoError(t, err)
+	assert.Equal(t, image.Config{ColorModel: color.YCbCrModel, Width: 600, Height: 800}, cfg)
+
+	// gps data in exif, xmp and comment are all removed
+	withMeta := jpegWithSegments(t, 16, 8,
+		jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifTIFF(binary.BigEndian, 1, "GPS 55.7558N 37.6173E")...)),
+		jpegSegment(0xE1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>serial 12345</x:xmpmeta>")),
+		jpegSegment(0xED, []byte("Photoshop 3.0\x00IPTC location")),
+		jpegSegment(0xFE, []byte("taken at home")),
+	)
+	res, err = stripMetadata(withMeta)
+	require.NoError(t, err)
+	for _, s := range []string{"GPS", "xmpmeta", "IPTC", "taken at home"} {
+		assert.NotContains(t, string(res), s)
+	}
+	_, err = jpeg.Decode(bytes.NewReader(res))
+	require.NoError(t, err)
+
+	_, err = stripMetadata(orig[:300])
+	assert.EqualError(t, err, "malformed jpeg, bad segment size at 239")
+}
+
+func TestStripMetadata_JPEGOrientation(t *testing.T) {
+	tbl := []struct {
+		orientation   int
+		order         binary.AppendByteOrder
+		width, height int
+		topLeft       color.RGBA // left half of the original image is red, right is blue
+	}{
+		{1, binary.BigEndian, 32, 16, color.RGBA{R: 255, A: 255}},
+		{2, binary.LittleEndian, 32, 16, color.RGBA{B: 255, A: 255}},
+		{3, binary.BigEndian, 32, 16, color.RGBA{B: 255, A: 255}},
+		{6, binary.LittleEndian, 16, 32, color.RGBA{R: 255, A: 255}},
+		{8, binary.BigEndian, 16, 32, color.RGBA{B: 255, A: 255}},
+	}
+	for _, tt := range tbl {
+		orig := jpegWithSegments(t, 32, 16, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifTIFF(tt.order, tt.orientation, "")...)))
+		res, err := stripMetadata(orig)
+		require.NoError(t, err)
+		assert.NotContains(t, string(res), "Exif")
+		m, err := jpeg.Decode(bytes.NewReader(res))
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, tt.width, tt.height), m.Bounds(), "orientation %d", tt.orientation)
+		r, _, b, _ := m.At(1, 1).RGBA()
+		assert.InDelta(t, float64(tt.topLeft.R), float64(r>>8), 30, "orientation %d", tt.orientation)
+		assert.InDelta(t, float64(tt.topLeft.B), float64(b>>8), 30, "orientation %d", tt.orientation)
+	}
+}
+
+func TestStripMetadata_PNG(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))))
+	orig := buf.Bytes()
+	iend := len(orig) - 12
+	withMeta := bytes.Clone(orig[:iend])
+	withMeta = append(withMeta, pngChunk("tEXt", "Comment\x00taken at home")...)
+	withMeta = append(withMeta, pngChunk("eXIf", "MM\x00\x2aGPS")...)
+	withMeta = append(withMeta, pngChunk("tIME", "\x07\xea\x0a\x11\x0c\x00\x00")...)
+	withMeta = append(withMeta, orig[iend:]...)
+	_, err := png.Decode(bytes.NewReader(withMeta))
+	require.NoError(t, err)
+
+	res, err := stripMetadata(withMeta)
+	require.NoError(t, err)
+	assert.Equal(t, orig, res)
+
+	_, err = stripMetadata(orig[:iend])
+	assert.EqualError(t, err, "malformed png, no end chunk")
+}
+
+func TestStripMetadata_WebP(t *testing.T) {
+	orig, err := os.ReadFile("testdata/pixel.webp")
+	require.NoError(t, err)
+	res, err := stripMetadata(orig)
+	require.NoError(t, err)
+	assert.Equal(t, orig, res, "image without metadata is not changed")
+
+	// extended format with exif and xmp chunks
+	vp8x := []byte{0x08 | 0x04 | 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0} // exif, xmp and alpha flags, 1x1 canvas
+	var body []byte
+	body = append(body, riffChunk("VP8X", vp8x)...)
+	body = append(body, orig[12:]...)
+	body = append(body, riffChunk("EXIF", []byte("MM\x00\x2aGPS"))...)
+	body = append(body, riffChunk("XMP ", []byte("<x:xmpmeta>serial</x:xmpmeta>"))...)
+	withMeta := append([]byte("RIFF\x00\x00\x00\x00WEBP"), body...)
+	binary.LittleEndian.PutUint32(withMeta[4:], uint32(len(withMeta)-8)) //nolint:gosec // small test data
+
+	res, err = stripMetadata(withMeta)
+	require.NoError(t, err)
+	assert.NotContains(t, string(res), "GPS")
+	assert.NotContains(t, string(res), "xmpmeta")
+	assert.Equal(t, byte(0x10), res[20], "only alpha flag left")
+	assert.Equal(t, uint32(len(res)-8), binary.LittleEndian.Uint32(res[4:]))
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(res))
+	require.NoError(t, err)
+	assert.Equal(t, "webp", format)
+	assert.Equal(t, 1, cfg.Width)
+
+	_, err = stripMetadata(withMeta[:40])
+	assert.EqualError(t, err, "malformed webp, bad chunk size at 30")
+}
+
+func TestStripMetadata_GIF(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&buf, &gif.GIF{
+		Image:     []*image.Paletted{gifFrame(color.White), gifFrame(color.Black)},
+		Delay:     []int{10, 10},
+		LoopCount: 0,
+	}))
+	orig := buf.Bytes()
+	pos := 13 // header and screen descriptor, no global color table as frames have local ones
+	withMeta := bytes.Clone(orig[:pos])
+	withMeta = append(withMeta, "\x21\xfe\x0dtaken at home\x00"...)
+	withMeta = append(withMeta, "\x21\xff\x0bXMP DataXMP\x0a<x:xmpmet>\x00"...)
+	withMeta = append(withMeta, orig[pos:]...)
+	g, err := gif.DecodeAll(bytes.NewReader(withMeta))
+	require.NoError(t, err)
+	require.Len(t, g.Image, 2)
+
+	res, err := stripMetadata(withMeta)
+	require.NoError(t, err)
+	assert.Equal(t, orig, res)
+	g, err = gif.DecodeAll(bytes.NewReader(res))
+	require.NoError(t, err)
+	assert.Len(t, g.Image, 2, "animation kept")
+
+	_, err = stripMetadata(orig[:len(orig)-1])
+	assert.EqualError(t, err, "malformed gif, no trailer")
+}
+
+func TestService_SaveStripsMetadata(t *testing.T) {
+	store := StoreMock{SaveFunc: func(string, []byte) error { return nil }}
+	svc := NewService(&store, ServiceParams{MaxSize: 100_000, MaxWidth: 1000, MaxHeight: 1000})
+	orig := jpegWithSegments(t, 16, 8, jpegSegment(0xE1, append([]byte("Exif\x00\x00"), exifTIFF(binary.BigEndian, 1, "GPS")...)))
+	_, err := svc.Save("site", "user1", bytes.NewReader(orig))
+	require.NoError(t, err)
+	require.Len(t, store.SaveCalls(), 1)
+	assert.NotContains(t, string(store.SaveCalls()[0].Img), "GPS", "metadata stripped without resize")
+}
+
+// jpegWithSegments encodes width x height jpeg, red on the left half and blue on the right,
+// and inserts segments after start of image marker
+func jpegWithSegments(t *testing.T, width, height int, segments ...[]byte) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := range width {
+		for y := range height {
+			if x < width/2 {
+				m.Set(x, y, color.RGBA{R: 255, A: 255})
+				continue
+			}
+			m.Set(x, y, color.RGBA{B: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, m, &jpeg.Options{Quality: 100}))
+	res := append([]byte{}, buf.Bytes()[:2]...)
+	for _, s := range segments {
+		res = append(res, s...)
+	}
+	return append(res, buf.Bytes()[2:]...)
+}
+
+func jpegSegment(marker byte, data []byte) []byte {
+	return append([]byte{0xFF, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)}, data...)
+}
+
+// exifTIFF makes tiff header with IFD0 with orientation tag and some extra data after it
+func exifTIFF(order binary.AppendByteOrder, orientation int, extra string) []byte {
+	res := []byte("II\x2a\x00")
+	if order == binary.BigEndian {
+		res = []byte("MM\x00\x2a")
+	}
+	res = order.AppendUint32(res, 8)
+	res = order.AppendUint16(res, 1)
+	res = order.AppendUint16(res, 0x0112)
+	res = order.AppendUint16(res, 3)
+	res = order.AppendUint32(res, 1)
+	res = order.AppendUint16(res, uint16(orientation)) //nolint:gosec // small test value
+	res = order.AppendUint16(res, 0)
+	res = order.AppendUint32(res, 0) // no next IFD
+	return append(res, extra...)
+}
+
+func pngChunk(chunkType, data string) []byte {
+	res := binary.BigEndian.AppendUint32(nil, uint32(len(data))) //nolint:gosec // small test data
+	res = append(res, chunkType+data...)
+	return binary.BigEndian.AppendUint32(res, crc32.ChecksumIEEE([]byte(chunkType+data)))
+}
+
+func riffChunk(fourCC string, data []byte) []byte {
+	res := binary.LittleEndian.AppendUint32([]byte(fourCC), uint32(len(data))) //nolint:gosec // small test data
+	res = append(res, data...)
+	if len(data)%2 == 1 {
+		res = append(res, 0)
+	}
+	return res
+}
+
+func gifFrame(c color.Color) *image.Paletted {
+	m := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.White, color.Black})
+	for x := range 4 {
+		for y := range 4 {
+			m.Set(x, y, c)
+		}
+	}
+	return m
+}
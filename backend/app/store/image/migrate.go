@@ -0,0 +1,89 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+const migrateProgressEvery = 100
+
+// Migrate copies all images, committed and staged, from src to dst store keeping ids and staging state.
+// With verify set every copied image loaded back from dst and compared to the source, and dst listing
+// checked to have all images with the same staging state at the end.
+// Failures of separate images logged and skipped, returns number of migrated images
+// and error if any of images failed.
+func Migrate(dst, src Store, verify bool) (int, error) {
+	metas, err := src.List("")
+	if err != nil {
+		return 0, fmt.Errorf("can't list source images: %w", err)
+	}
+	log.Printf("[INFO] %d images to migrate", len(metas))
+
+	count, failed := 0, map[string]bool{}
+	for i, m := range metas {
+		if err = migrateImage(dst, src, m, verify); err != nil {
+			log.Printf("[WARN] can't migrate image %s, %v", m.ID, err)
+			failed[m.ID] = true
+			continue
+		}
+		count++
+		if (i+1)%migrateProgressEvery == 0 {
+			log.Printf("[INFO] processed %d of %d images, failed %d", i+1, len(metas), len(failed))
+		}
+	}
+
+	if verify {
+		dstMetas, e := dst.List("")
+		if e != nil {
+			return count, fmt.Errorf("can't list destination images: %w", e)
+		}
+		staged := make(map[string]bool, len(dstMetas))
+		for _, m := range dstMetas {
+			staged[m.ID] = m.Staging
+		}
+		for _, m := range metas {
+			if failed[m.ID] {
+				continue
+			}
+			if st, ok := staged[m.ID]; !ok || st != m.Staging {
+				log.Printf("[WARN] image %s missing in destination or has wrong staging state", m.ID)
+				failed[m.ID] = true
+				count--
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return count, fmt.Errorf("failed to migrate %d of %d images", len(failed), len(metas))
+	}
+	return count, nil
+}
+
+// migrateImage copies a single image from src to dst and commits it if the source one is committed
+func migrateImage(dst, src Store, m Meta, verify bool) error {
+	img, err := src.Load(m.ID)
+	if err != nil {
+		return fmt.Errorf("can't load: %w", err)
+	}
+	if err = dst.Save(m.ID, img); err != nil {
+		return fmt.Errorf("can't save: %w", err)
+	}
+	if !m.Staging {
+		if err = dst.Commit(m.ID); err != nil {
+			return fmt.Errorf("can't commit: %w", err)
+		}
+	}
+	if !verify {
+		return nil
+	}
+	res, err := dst.Load(m.ID)
+	if err != nil {
+		return fmt.Errorf("can't load copied image: %w", err)
+	}
+	if !bytes.Equal(img, res) {
+		return fmt.Errorf("copied image differs, %d bytes instead of %d", len(res), len(img))
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package image
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	src, teardownSrc := prepareImageTest(t)
+	defer teardownSrc()
+	dst, teardownDst := prepareBoltImageStorageTest(t)
+	defer teardownDst()
+	defer dst.Close()
+
+	require.NoError(t, src.Save("user1/img1.png", gopherPNGBytes()))
+	require.NoError(t, src.Commit("user1/img1.png"))
+	require.NoError(t, src.Save("user1/img2.png", []byte("some image")))
+	require.NoError(t, src.Save("user2/img3.png", gopherPNGBytes()))
+	require.NoError(t, src.Commit("user2/img3.png"))
+
+	count, err := Migrate(dst, src, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	list, err := dst.List("")
+	require.NoError(t, err)
+	staged := map[string]bool{}
+	for _, m := range list {
+		staged[m.ID] = m.Staging
+	}
+	assert.Equal(t, map[string]bool{"user1/img1.png": false, "user1/img2.png": true, "user2/img3.png": false}, staged)
+
+	img, err := dst.Load("user1/img2.png")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("some image"), img)
+
+	// repeated migration overwrites images
+	count, err = Migrate(dst, src, true)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestMigrate_Errors(t *testing.T) {
+	dst, teardown := prepareBoltImageStorageTest(t)
+	defer teardown()
+	defer dst.Close()
+
+	src := &StoreMock{
+		ListFunc: func(string) ([]Meta, error) {
+			return []Meta{{ID: "user1/good.png"}, {ID: "user1/bad.png", Staging: true}}, nil
+		},
+		LoadFunc: func(id string) ([]byte, error) {
+			if id == "user1/bad.png" {
+				return nil, errors.New("load error")
+			}
+			return gopherPNGBytes(), nil
+		},
+	}
+	count, err := Migrate(dst, src, true)
+	assert.EqualError(t, err, "failed to migrate 1 of 2 images")
+	assert.Equal(t, 1, count)
+
+	img, err := dst.Load("user1/good.png")
+	require.NoError(t, err)
+	assert.Equal(t, gopherPNGBytes(), img)
+
+	src.ListFunc = func(string) ([]Meta, error) { return nil, errors.New("list error") }
+	_, err = Migrate(dst, src, false)
+	assert.EqualError(t, err, "can't list source images: list error")
+}
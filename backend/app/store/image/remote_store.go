@@ -47,6 +47,19 @@ func (r *RPC) Delete(id string) error {
 	return err
 }
 
+// List returns images of the user, all images if userID is empty
+func (r *RPC) List(userID string) ([]Meta, error) {
+	resp, err := r.Call("image.list", userID)
+	if err != nil {
+		return nil, err
+	}
+	res := []Meta{}
+	if err = json.Unmarshal(*resp.Result, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // Commit file stored in staging location by moving it to permanent location
 func (r *RPC) Commit(id string) error {
 	_, err := r.Call("image.commit", id)
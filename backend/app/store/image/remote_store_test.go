@@ -103,6 +103,17 @@ func TestRemote_Info(t *testing.T) {
 	assert.False(t, info.FirstStagingImageTS.IsZero())
 }
 
+func TestRemote_List(t *testing.T) {
+	ts := testServer(t, `{"method":"image.list","params":"user1","id":1}`,
+		`{"result":[{"id":"user1/img1","size":123,"created":"2026-10-17T12:00:00Z","staging":true}],"id":1}`)
+	defer ts.Close()
+	c := RPC{Client: jrpc.Client{API: ts.URL, Client: http.Client{}}}
+
+	images, err := c.List("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Meta{{ID: "user1/img1", Size: 123, Created: time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC), Staging: true}}, images)
+}
+
 func testServer(t *testing.T, req, resp string) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		body, err := io.ReadAll(r.Body)
@@ -0,0 +1,368 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// S3 provides image Store for S3-compatible object storage, i.e. AWS S3 or MinIO.
+// Images kept in the bucket under Prefix, and staged images under StagingPrefix.
+// Age of staged image is the modification time of its object, updated by ResetCleanupTimer.
+type S3 struct {
+	S3Params
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// S3Params contains parameters of S3 store
+type S3Params struct {
+	Endpoint      string        // S3 API endpoint, i.e. http://minio:9000, AWS endpoint for the Region if empty
+	Region        string        // region of the bucket, us-east-1 if empty
+	Bucket        string        // bucket name
+	AccessKey     string        // access key ID
+	SecretKey     string        // secret access key
+	Prefix        string        // prefix of committed images in the bucket
+	StagingPrefix string        // prefix of staged images in the bucket
+	VirtualHost   bool          // use virtual-hosted addressing bucket.endpoint instead of endpoint/bucket
+	Timeout       time.Duration // http client timeout
+}
+
+// s3Error is an error response of S3 API
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// NewS3Storage makes S3 image store
+func NewS3Storage(params S3Params) (*S3, error) {
+	if params.Bucket == "" || params.AccessKey == "" || params.SecretKey == "" {
+		return nil, errors.New("s3 bucket, access key and secret key are required")
+	}
+	params.Prefix, params.StagingPrefix = strings.Trim(params.Prefix, "/"), strings.Trim(params.StagingPrefix, "/")
+	if params.Prefix == "" || params.StagingPrefix == "" {
+		return nil, errors.New("s3 prefixes of images and staging images are required")
+	}
+	// staging is listed by its prefix on cleanup, overlapping prefixes would remove committed images
+	if strings.HasPrefix(params.Prefix+"/", params.StagingPrefix+"/") || strings.HasPrefix(params.StagingPrefix+"/", params.Prefix+"/") {
+		return nil, fmt.Errorf("s3 prefixes of images %q and staging images %q should not overlap", params.Prefix, params.StagingPrefix)
+	}
+	if params.Region == "" {
+		params.Region = "us-east-1"
+	}
+	if params.Endpoint == "" {
+		params.Endpoint = "https://s3." + params.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(params.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", params.Endpoint)
+	}
+	if params.Timeout == 0 {
+		params.Timeout = 30 * time.Second
+	}
+	return &S3{S3Params: params, endpoint: endpoint, client: &http.Client{Timeout: params.Timeout}}, nil
+}
+
+// Save saves image with given id to staging
+func (s *S3) Save(id string, img []byte) error {
+	if _, err := s.request(context.Background(), http.MethodPut, s.key(s.StagingPrefix, id), nil, img, nil); err != nil {
+		return fmt.Errorf("can't save image %s: %w", id, err)
+	}
+	log.Printf("[DEBUG] image %s saved to s3 staging, size=%d", id, len(img))
+	return nil
+}
+
+// Commit image stored in staging by copying it to permanent location and removing from staging
+func (s *S3) Commit(id string) error {
+	log.Printf("[DEBUG] Commit image %s", id)
+	stagingKey := s.key(s.StagingPrefix, id)
+	if err := s.copy(stagingKey, s.key(s.Prefix, id)); err != nil {
+		return fmt.Errorf("failed to commit image %s: %w", id, err)
+	}
+	if _, err := s.request(context.Background(), http.MethodDelete, stagingKey, nil, nil, nil); err != nil {
+		return fmt.Errorf("failed to remove committed image %s from staging: %w", id, err)
+	}
+	return nil
+}
+
+// ResetCleanupTimer resets cleanup timer for the image by copying staged object to itself,
+// which updates its modification time
+func (s *S3) ResetCleanupTimer(id string) error {
+	key := s.key(s.StagingPrefix, id)
+	if err := s.copy(key, key); err != nil {
+		return fmt.Errorf("can't reset cleanup timer for %s: %w", id, err)
+	}
+	return nil
+}
+
+// Load image with given id, first from permanent location and if not found from staging
+func (s *S3) Load(id string) ([]byte, error) {
+	img, err := s.request(context.Background(), http.MethodGet, s.key(s.Prefix, id), nil, nil, nil)
+	if err == nil {
+		return img, nil
+	}
+	img, stagingErr := s.request(context.Background(), http.MethodGet, s.key(s.StagingPrefix, id), nil, nil, nil)
+	if stagingErr != nil {
+		return nil, fmt.Errorf("can't load image %s: %w", id, errors.Join(err, stagingErr))
+	}
+	return img, nil
+}
+
+// Delete image from both permanent location and staging.
+// Deleting non-existing object doesn't return an error in S3, so it's safe to delete both.
+func (s *S3) Delete(id string) error {
+	_, err := s.request(context.Background(), http.MethodDelete, s.key(s.Prefix, id), nil, nil, nil)
+	_, stagingErr := s.request(context.Background(), http.MethodDelete, s.key(s.StagingPrefix, id), nil, nil, nil)
+	if err = errors.Join(err, stagingErr); err != nil {
+		return fmt.Errorf("can't delete image %s: %w", id, err)
+	}
+	return nil
+}
+
+// Cleanup runs scan of staging and removes old images based on ttl
+func (s *S3) Cleanup(ctx context.Context, ttl time.Duration) error {
+	var expired []string
+	err := s.list(ctx, s.StagingPrefix+"/", func(key string, _ int64, modified time.Time) {
+		if time.Since(modified) > ttl {
+			expired = append(expired, key)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cleanup images: %w", err)
+	}
+	for _, key := range expired {
+		log.Printf("[INFO] remove staging image %s", key)
+		if _, err := s.request(ctx, http.MethodDelete, key, nil, nil, nil); err != nil {
+			return fmt.Errorf("failed to remove staging image %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Info returns meta information about storage
+func (s *S3) Info() (StoreInfo, error) {
+	var ts time.Time
+	err := s.list(context.Background(), s.StagingPrefix+"/", func(_ string, _ int64, modified time.Time) {
+		if ts.IsZero() || modified.Before(ts) {
+			ts = modified
+		}
+	})
+	if err != nil {
+		return StoreInfo{}, fmt.Errorf("problem retrieving first timestamp from staging images on s3: %w", err)
+	}
+	return StoreInfo{FirstStagingImageTS: ts}, nil
+}
+
+// List returns images of the user, or all images if userID is empty, from both permanent location and staging.
+// Upload time of the image is the modification time of its object, which is the commit time for committed images.
+func (s *S3) List(userID string) ([]Meta, error) {
+	images := map[string]Meta{}
+	for _, prefix := range []string{s.StagingPrefix, s.Prefix} { // committed image overrides staged one with the same id
+		listPrefix := prefix + "/"
+		if userID != "" {
+			listPrefix += userID + "/"
+		}
+		err := s.list(context.Background(), listPrefix, func(key string, size int64, modified time.Time) {
+			id := strings.TrimPrefix(key, prefix+"/")
+			images[id] = Meta{ID: id, Size: size, Created: modified, Staging: prefix == s.StagingPrefix}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	res := make([]Meta, 0, len(images))
+	for _, m := range images {
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// key makes object key for image id under given prefix
+func (s *S3) key(prefix, id string) string {
+	return prefix + "/" + id
+}
+
+// copy object from src to dst key. Metadata replaced to allow copying object to itself.
+func (s *S3) copy(src, dst string) error {
+	header := http.Header{
+		"X-Amz-Copy-Source":        {s3Escape("/"+s.Bucket+"/"+src, false)},
+		"X-Amz-Metadata-Directive": {"REPLACE"},
+	}
+	resp, err := s.request(context.Background(), http.MethodPut, dst, nil, nil, header)
+	if err != nil {
+		return err
+	}
+	// copy could fail after 200 OK response was sent, with the error in the body
+	e := s3Error{StatusCode: http.StatusOK}
+	if xml.Unmarshal(resp, &e) == nil && e.Code != "" {
+		return &e
+	}
+	return nil
+}
+
+// list lists all objects with the key prefix page by page and calls fn with key, size and modification time of each
+func (s *S3) list(ctx context.Context, prefix string, fn func(key string, size int64, modified time.Time)) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.request(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return fmt.Errorf("can't list images with prefix %s: %w", prefix, err)
+		}
+		var res struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err = xml.Unmarshal(resp, &res); err != nil {
+			return fmt.Errorf("can't decode list of images with prefix %s: %w", prefix, err)
+		}
+		for _, obj := range res.Contents {
+			fn(obj.Key, obj.Size, obj.LastModified)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// request makes signed request to the object with the key, or to the bucket if key is empty,
+// and returns response body. Responses with non-2xx status returned as s3Error.
+func (s *S3) request(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	u := *s.endpoint
+	objPath := "/" + s.Bucket
+	if s.VirtualHost {
+		u.Host, objPath = s.Bucket+"."+u.Host, ""
+	}
+	if key != "" {
+		objPath += "/" + key
+	}
+	u.Path, u.RawPath, u.RawQuery = u.Path+objPath, u.Path+s3Escape(objPath, false), query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("can't make request: %w", err)
+	}
+	maps.Copy(req.Header, header)
+	payloadHash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(payloadHash[:]), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't send request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		e := s3Error{StatusCode: resp.StatusCode}
+		_ = xml.Unmarshal(respBody, &e) // body is empty for HEAD requests and some errors
+		return nil, &e
+	}
+	return respBody, nil
+}
+
+// sign request with AWS Signature Version 4, all headers of the request are signed
+func (s *S3) sign(r *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := []string{"host"}
+	for h := range r.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(h))
+	}
+	slices.Sort(signedHeaders)
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.AccessKey, s.scope(amzDate), strings.Join(signedHeaders, ";"), s.signature(r, signedHeaders, amzDate)))
+}
+
+// signature calculates SigV4 signature of the request with given signed headers (lowercase and sorted)
+func (s *S3) signature(r *http.Request, signedHeaders []string, amzDate string) string {
+	var canonicalHeaders strings.Builder
+	for _, h := range signedHeaders {
+		value := strings.Join(r.Header.Values(h), ",")
+		if h == "host" {
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	query := r.URL.Query()
+	var canonicalQuery []string
+	for _, k := range slices.Sorted(maps.Keys(query)) {
+		for _, v := range slices.Sorted(slices.Values(query[k])) {
+			canonicalQuery = append(canonicalQuery, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+
+	canonicalURI := s3Escape(r.URL.Path, false)
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalRequest := strings.Join([]string{r.Method, canonicalURI, strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(), strings.Join(signedHeaders, ";"), r.Header.Get("X-Amz-Content-Sha256")}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + s.scope(amzDate) + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + s.SecretKey)
+	for _, v := range []string{amzDate[:8], s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// scope returns credential scope of the request made at amzDate
+func (s *S3) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.Region + "/s3/aws4_request"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes all characters except unreserved ones as required by SigV4,
+// slash is kept for object paths and encoded for query params
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
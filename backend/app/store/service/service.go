@@ -6,21 +6,27 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"regexp"
 	"slices"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-pkgz/lcw/v2"
 	log "github.com/go-pkgz/lgr"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	bf "github.com/russross/blackfriday/v2"
 
 	"github.com/umputun/remark42/backend/app/store"
 	"github.com/umputun/remark42/backend/app/store/admin"
 	"github.com/umputun/remark42/backend/app/store/engine"
 	"github.com/umputun/remark42/backend/app/store/image"
+	"github.com/umputun/remark42/backend/app/store/settings"
+	"github.com/umputun/remark42/backend/app/store/subscription"
 )
 
 // DataStore wraps store.Interface with additional methods
@@ -39,7 +45,18 @@ type DataStore struct {
 	TitleExtractor         *TitleExtractor
 	RestrictedWordsMatcher *RestrictedWordsMatcher
 	ImageService           *image.Service
-	AdminEdits             bool // allow admin unlimited edits
+	AdminEdits             bool            // allow admin unlimited edits
+	EventPublisher         EventPublisher  // optional, gets comment events for live stream
+	ReportThreshold        int             // number of user reports hiding comment until reviewed, 0 - never hidden
+	SpamClassifier         *SpamClassifier // optional, classifies new comments, trained by admin actions
+	SpamAction             SpamAction      // action for new comment classified as spam, tagged by default
+	SpamChecker            SpamChecker     // optional, external check of new and edited comments
+	SiteSettings           *settings.Store // optional, per-site overrides of comment size, edit duration and votes limits
+	PreModeration          struct {
+		Sites      []string // sites with all new comments awaiting approval
+		Unverified bool     // new comments of unverified users awaiting approval
+	}
+	Subscriptions *subscription.Store // optional, users subscriptions to all new comments of the post
 
 	// granular locks
 	scopedLocks struct {
@@ -62,9 +79,15 @@ type UserMetaData struct {
 		Until  time.Time `json:"until"`
 	} `json:"blocked"`
 	Verified bool                   `json:"verified"`
+	Shadowed bool                   `json:"shadowed,omitempty"`
 	Details  engine.UserDetailEntry `json:"details"`
 }
 
+// EventPublisher defines interface for comment events consumer, i.e. live stream of comments
+type EventPublisher interface {
+	Publish(et admin.EventType, comment store.Comment)
+}
+
 // PostMetaData keeps info about post flags
 type PostMetaData struct {
 	URL      string `json:"url"`
@@ -73,6 +96,7 @@ type PostMetaData struct {
 
 const defaultCommentMaxSize = 2048
 const maxLastCommentsReply = 5000
+const maxReportNoteSize = 500
 
 // UnlimitedVotes doesn't restrict MaxVotes
 const UnlimitedVotes = -1
@@ -82,6 +106,9 @@ var nonAdminUser = store.User{}
 // ErrRestrictedWordsFound returned in case comment text contains restricted words
 var ErrRestrictedWordsFound = fmt.Errorf("comment contains restricted words")
 
+var commentsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "remark42_comments_total", Help: "comments created, edited, deleted and voted by site"}, []string{"site", "action"})
+
 // Create prepares comment and forward to Interface.Create
 func (s *DataStore) Create(comment store.Comment) (commentID string, err error) {
 	if comment, err = s.prepareNewComment(comment); err != nil {
@@ -92,6 +119,26 @@ func (s *DataStore) Create(comment store.Comment) (commentID string, err error)
 		return "", ErrRestrictedWordsFound
 	}
 
+	if s.SpamClassifier != nil && !comment.User.Admin {
+		if spam, prob := s.SpamClassifier.Classify(comment); spam {
+			log.Printf("[INFO] comment from %s on %s classified as spam [%.0f%%], %s", comment.User.ID,
+				comment.Locator.URL, prob*100, s.SpamAction)
+			switch s.SpamAction {
+			case SpamReject:
+				return "", ErrSpamDetected
+			case SpamQueue:
+				comment.Pending = true
+			}
+			comment.Spam = true
+		}
+	}
+
+	if !comment.User.Admin {
+		if comment, err = s.checkSpam(comment); err != nil {
+			return "", err
+		}
+	}
+
 	func() { // keep input title and set to extracted if missing
 		if s.TitleExtractor == nil || comment.PostTitle != "" {
 			return
@@ -110,6 +157,12 @@ func (s *DataStore) Create(comment store.Comment) (commentID string, err error)
 	if e := s.AdminStore.OnEvent(comment.Locator.SiteID, admin.EvCreate); e != nil {
 		log.Printf("[WARN] failed to send create event, %s", e)
 	}
+	if err == nil {
+		s.publishEvent(admin.EvCreate, comment)
+		if !comment.Imported {
+			commentsCounter.WithLabelValues(comment.Locator.SiteID, "create").Inc()
+		}
+	}
 	return commentID, err
 }
 
@@ -126,9 +179,10 @@ func (s *DataStore) FindSince(locator store.Locator, sortMethod string, user sto
 	if err != nil {
 		return comments, err
 	}
+	flags := s.newUserFlagCache()
+	comments = visibleComments(comments, user, flags)
 
 	changedSort := false
-	flags := s.newUserFlagCache()
 	// sets votes controversy for comments added prior to #274
 	// also sanitizes locator.URL for comments added prior to #927
 	for i, c := range comments {
@@ -155,7 +209,14 @@ func (s *DataStore) Get(locator store.Locator, commentID string, user store.User
 	if err != nil {
 		return store.Comment{}, err
 	}
-	return s.alterComment(c, user), nil
+	flags := s.newUserFlagCache()
+	if !isVisible(c, user, flags) {
+		if c.Pending {
+			return store.Comment{}, fmt.Errorf("comment %s is pending approval", commentID)
+		}
+		return store.Comment{}, fmt.Errorf("comment %s not found", commentID) // comment of shadow-banned user
+	}
+	return s.alterCommentCached(c, user, flags), nil
 }
 
 // Put updates comment, mutable parts only
@@ -230,6 +291,140 @@ func (s *DataStore) SetUserTelegram(siteID, userID, value string) (string, error
 	return "", nil
 }
 
+// GetUserEmailDigest gets user email digest period, empty for immediate email notifications
+func (s *DataStore) GetUserEmailDigest(siteID, userID string) (string, error) {
+	res, err := s.Engine.UserDetail(engine.UserDetailRequest{
+		Detail:  engine.UserEmailDigest,
+		Locator: store.Locator{SiteID: siteID},
+		UserID:  userID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 1 {
+		return res[0].EmailDigest, nil
+	}
+	return "", nil
+}
+
+// SetUserEmailDigest sets user email digest period
+func (s *DataStore) SetUserEmailDigest(siteID, userID, value string) (string, error) {
+	res, err := s.Engine.UserDetail(engine.UserDetailRequest{
+		Detail:  engine.UserEmailDigest,
+		Locator: store.Locator{SiteID: siteID},
+		UserID:  userID,
+		Update:  value,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 1 {
+		return res[0].EmailDigest, nil
+	}
+	return "", nil
+}
+
+// GetUserMatrix gets user matrix id
+func (s *DataStore) GetUserMatrix(siteID, userID string) (string, error) {
+	res, err := s.Engine.UserDetail(engine.UserDetailRequest{
+		Detail:  engine.UserMatrix,
+		Locator: store.Locator{SiteID: siteID},
+		UserID:  userID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 1 {
+		return res[0].Matrix, nil
+	}
+	return "", nil
+}
+
+// SetUserMatrix sets user matrix id
+func (s *DataStore) SetUserMatrix(siteID, userID, value string) (string, error) {
+	res, err := s.Engine.UserDetail(engine.UserDetailRequest{
+		Detail:  engine.UserMatrix,
+		Locator: store.Locator{SiteID: siteID},
+		UserID:  userID,
+		Update:  value,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 1 {
+		return res[0].Matrix, nil
+	}
+	return "", nil
+}
+
+// GetUserWebPush gets user web push subscriptions, json list
+func (s *DataStore) GetUserWebPush(siteID, userID string) (string, error) {
+	res, err := s.Engine.UserDetail(engine.UserDetailRequest{
+		Detail:  engine.UserWebPush,
+		Locator: store.Locator{SiteID: siteID},
+		UserID:  userID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 1 {
+		return res[0].WebPush, nil
+	}
+	return "", nil
+}
+
+// SetUserWebPush sets user web push subscriptions
+func (s *DataStore) SetUserWebPush(siteID, userID, value string) (string, error) {
+	res, err := s.Engine.UserDetail(engine.UserDetailRequest{
+		Detail:  engine.UserWebPush,
+		Locator: store.Locator{SiteID: siteID},
+		UserID:  userID,
+		Update:  value,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res) == 1 {
+		return res[0].WebPush, nil
+	}
+	return "", nil
+}
+
+// ErrNoSubscriptions returned by subscription methods if DataStore has no Subscriptions store
+var ErrNoSubscriptions = errors.New("post subscriptions disabled")
+
+// Subscribe adds user's subscription to all new comments of the post, or adds channel to the existing one
+func (s *DataStore) Subscribe(sub subscription.Subscription) (subscription.Subscription, error) {
+	if s.Subscriptions == nil {
+		return subscription.Subscription{}, ErrNoSubscriptions
+	}
+	return s.Subscriptions.Subscribe(sub)
+}
+
+// Unsubscribe removes channel from user's subscription to the post, all channels for empty one
+func (s *DataStore) Unsubscribe(locator store.Locator, userID string, ch subscription.Channel) error {
+	if s.Subscriptions == nil {
+		return ErrNoSubscriptions
+	}
+	return s.Subscriptions.Unsubscribe(locator.SiteID, locator.URL, userID, ch)
+}
+
+// UserSubscriptions returns all subscriptions of the user on the site
+func (s *DataStore) UserSubscriptions(siteID, userID string) ([]subscription.Subscription, error) {
+	if s.Subscriptions == nil {
+		return nil, ErrNoSubscriptions
+	}
+	return s.Subscriptions.List(siteID, userID)
+}
+
+// PostSubscriptions returns all subscriptions to the post, empty list if subscriptions disabled
+func (s *DataStore) PostSubscriptions(locator store.Locator) ([]subscription.Subscription, error) {
+	if s.Subscriptions == nil {
+		return nil, nil
+	}
+	return s.Subscriptions.Find(locator.SiteID, locator.URL)
+}
+
 // DeleteUserDetail deletes user detail
 func (s *DataStore) DeleteUserDetail(siteID, userID string, detail engine.UserDetail) error {
 	return s.Engine.Delete(engine.DeleteRequest{
@@ -329,7 +524,13 @@ func (s *DataStore) SetPin(locator store.Locator, commentID string, status bool)
 	}
 	comment.Pin = status
 	comment.Locator = locator
-	return s.Engine.Update(comment)
+	if err = s.Engine.Update(comment); err != nil {
+		return err
+	}
+	if status {
+		s.trainSpam(comment, false)
+	}
+	return nil
 }
 
 // VoteReq is the request ot make a vote
@@ -352,6 +553,10 @@ func (s *DataStore) Vote(req VoteReq) (comment store.Comment, err error) {
 		return comment, err
 	}
 
+	if comment.Pending {
+		return comment, fmt.Errorf("comment %s is pending approval", req.CommentID)
+	}
+
 	if comment.User.ID == req.UserID && req.UserID != "dev" {
 		return comment, fmt.Errorf("user %s can not vote for his own comment %s", req.UserID, req.CommentID)
 	}
@@ -374,8 +579,9 @@ func (s *DataStore) Vote(req VoteReq) (comment store.Comment, err error) {
 		return comment, fmt.Errorf("the same ip %s already voted for %s", userIPHash, req.CommentID)
 	}
 
-	maxVotes := s.MaxVotes // 0 value allowed and treated as "no comments allowed"
-	if s.MaxVotes < 0 {    // any negative value reset max votes to unlimited
+	siteSettings := s.siteSettings(req.Locator.SiteID)
+	maxVotes := siteSettings.MaxVotes // 0 value allowed and treated as "no comments allowed"
+	if maxVotes < 0 {                 // any negative value reset max votes to unlimited
 		maxVotes = UnlimitedVotes
 	}
 
@@ -383,7 +589,7 @@ func (s *DataStore) Vote(req VoteReq) (comment store.Comment, err error) {
 		return comment, fmt.Errorf("maximum number of votes exceeded for comment %s", req.CommentID)
 	}
 
-	if s.PositiveScore && comment.Score <= 0 && !req.Val {
+	if siteSettings.PositiveScore && comment.Score <= 0 && !req.Val {
 		return comment, fmt.Errorf("minimal score reached for comment %s", req.CommentID)
 	}
 
@@ -426,7 +632,12 @@ func (s *DataStore) Vote(req VoteReq) (comment store.Comment, err error) {
 
 	comment.Controversy = s.controversy(s.upsAndDowns(comment))
 	comment.Locator = req.Locator
-	return comment, s.Engine.Update(comment)
+	if err = s.Engine.Update(comment); err != nil {
+		return comment, err
+	}
+	s.publishEvent(admin.EvVote, comment)
+	commentsCounter.WithLabelValues(req.Locator.SiteID, "vote").Inc()
+	return comment, nil
 }
 
 func (s *DataStore) isSameIPVote(req VoteReq, userIPHash string, comment store.Comment) bool {
@@ -477,7 +688,8 @@ func (s *DataStore) EditComment(locator store.Locator, commentID string, req Edi
 		}
 
 		// edit allowed in editDuration window only
-		if s.EditDuration > 0 && time.Now().After(comment.Timestamp.Add(s.EditDuration)) {
+		editDuration := time.Duration(s.siteSettings(locator.SiteID).EditDuration)
+		if editDuration > 0 && time.Now().After(comment.Timestamp.Add(editDuration)) {
 			return fmt.Errorf("too late to edit %s", commentID)
 		}
 
@@ -508,7 +720,14 @@ func (s *DataStore) EditComment(locator store.Locator, commentID string, req Edi
 		}
 		comment.Deleted = true
 		delReq := engine.DeleteRequest{Locator: locator, CommentID: commentID, DeleteMode: store.SoftDelete}
-		return comment, s.Engine.Delete(delReq)
+		if err = s.Engine.Delete(delReq); err != nil {
+			return comment, err
+		}
+		deleted := comment
+		deleted.SetDeleted(store.SoftDelete)
+		s.publishEvent(admin.EvDelete, deleted)
+		commentsCounter.WithLabelValues(locator.SiteID, "delete").Inc()
+		return comment, nil
 	}
 
 	if s.RestrictedWordsMatcher != nil && s.RestrictedWordsMatcher.Match(comment.Locator.SiteID, req.Text) {
@@ -521,12 +740,135 @@ func (s *DataStore) EditComment(locator store.Locator, commentID string, req Edi
 	comment.Locator = locator
 	comment.Sanitize()
 
+	if !req.Admin {
+		if comment, err = s.checkSpam(comment); err != nil {
+			return comment, err
+		}
+	}
+
 	if e := s.AdminStore.OnEvent(comment.Locator.SiteID, admin.EvUpdate); e != nil {
 		log.Printf("[WARN] failed to send update event, %s", e)
 	}
 
-	err = s.Engine.Update(comment)
-	return comment, err
+	if err = s.Engine.Update(comment); err != nil {
+		return comment, err
+	}
+	s.publishEvent(admin.EvUpdate, comment)
+	commentsCounter.WithLabelValues(locator.SiteID, "edit").Inc()
+	return comment, nil
+}
+
+// ReportReq is the input for Report
+type ReportReq struct {
+	Locator   store.Locator
+	CommentID string
+	UserID    string
+	Reason    store.ReportReason
+	Note      string
+}
+
+// Report adds user's report for the comment, one report per user. With ReportThreshold set, comment reaching it
+// becomes pending, i.e. hidden from everyone except its author and admins, until reports reviewed
+func (s *DataStore) Report(req ReportReq) (comment store.Comment, err error) {
+	if !req.Reason.Valid() {
+		return comment, fmt.Errorf("unknown report reason %q", req.Reason)
+	}
+	if utf8.RuneCountInString(req.Note) > maxReportNoteSize {
+		return comment, fmt.Errorf("report note is too long, max %d characters allowed", maxReportNoteSize)
+	}
+
+	cLock := s.getScopedLocks(req.Locator.URL) // get lock for URL scope
+	cLock.Lock()                               // prevents race on reporting
+	defer cLock.Unlock()
+
+	comment, err = s.Engine.Get(engine.GetRequest{Locator: req.Locator, CommentID: req.CommentID})
+	if err != nil {
+		return comment, err
+	}
+
+	if comment.Deleted || comment.Pending {
+		return comment, fmt.Errorf("comment %s can't be reported", req.CommentID)
+	}
+	if comment.User.ID == req.UserID {
+		return comment, fmt.Errorf("user %s can not report own comment %s", req.UserID, req.CommentID)
+	}
+	if _, reported := comment.Reports[req.UserID]; reported {
+		return comment, fmt.Errorf("user %s already reported %s", req.UserID, req.CommentID)
+	}
+
+	if comment.Reports == nil {
+		comment.Reports = make(map[string]store.Report)
+	}
+	comment.Reports[req.UserID] = store.Report{Reason: req.Reason, Note: comment.SanitizeText(req.Note), Timestamp: time.Now()}
+	if s.ReportThreshold > 0 && len(comment.Reports) >= s.ReportThreshold {
+		comment.Pending, comment.Hidden = true, true
+		log.Printf("[INFO] comment %s hidden after %d reports", req.CommentID, len(comment.Reports))
+	}
+
+	comment.Locator = req.Locator
+	if err = s.Engine.Update(comment); err != nil {
+		return comment, err
+	}
+	if comment.Hidden {
+		s.publishHidden(comment)
+	}
+	return comment, nil
+}
+
+// Reported returns comments with user reports for the site, the most reported first
+func (s *DataStore) Reported(siteID string, limit, skip int) ([]store.Comment, error) {
+	req := engine.FindRequest{Locator: store.Locator{SiteID: siteID}, Reported: true, Limit: limit, Skip: skip, Sort: "-reports"}
+	comments, err := s.Engine.Find(req)
+	if err != nil {
+		return comments, err
+	}
+	return s.alterComments(comments, store.User{Admin: true}), nil
+}
+
+// ResolveReports accepts reports of the comment, the comment deleted along with its reports.
+// Spam classifier trained with the comment only if it was reported as spam
+func (s *DataStore) ResolveReports(locator store.Locator, commentID string) error {
+	comment, err := s.Engine.Get(engine.GetRequest{Locator: locator, CommentID: commentID})
+	if err != nil {
+		return err
+	}
+	if len(comment.Reports) == 0 {
+		return fmt.Errorf("comment %s has no reports", commentID)
+	}
+	spam := false
+	for _, r := range comment.Reports {
+		spam = spam || r.Reason == store.ReportSpam
+	}
+	return s.delete(locator, commentID, store.SoftDelete, spam)
+}
+
+// DismissReports rejects reports of the comment, drops them and makes comment hidden by reports visible again
+func (s *DataStore) DismissReports(locator store.Locator, commentID string) (comment store.Comment, err error) {
+	cLock := s.getScopedLocks(locator.URL) // get lock for URL scope, prevents race with new reports
+	cLock.Lock()
+	defer cLock.Unlock()
+
+	comment, err = s.Engine.Get(engine.GetRequest{Locator: locator, CommentID: commentID})
+	if err != nil {
+		return comment, err
+	}
+	if len(comment.Reports) == 0 {
+		return comment, fmt.Errorf("comment %s has no reports", commentID)
+	}
+
+	// comment put on hold for approval after it was hidden, i.e. edited, stays pending
+	unhide := comment.Hidden
+	comment.Reports = nil
+	if unhide {
+		comment.Pending, comment.Hidden = false, false
+	}
+	if err = s.Engine.Update(comment); err != nil {
+		return comment, err
+	}
+	if unhide {
+		s.publishEvent(admin.EvCreate, comment)
+	}
+	return comment, nil
 }
 
 // HasReplies checks if there is any reply to the comments
@@ -585,8 +927,9 @@ func (s *DataStore) UserReplies(siteID, userID string, limit int, duration time.
 		}
 
 		if c.ParentID != "" && !c.Deleted && c.User.ID != userID { // not interested in replies to yourself
+			// parent loaded directly from engine, as it can be pending comment replied by admin
 			var pc store.Comment
-			if pc, e = s.Get(c.Locator, c.ParentID, nonAdminUser); e != nil {
+			if pc, e = s.Engine.Get(engine.GetRequest{Locator: c.Locator, CommentID: c.ParentID}); e != nil {
 				return nil, "", fmt.Errorf("can't get parent comment: %w", e)
 			}
 			if pc.User.ID == userID {
@@ -636,8 +979,9 @@ func (s *DataStore) Counts(siteID string, postIDs []string) ([]store.PostInfo, e
 // It also validates the absence of relative links as they are almost never the intention of the commenter,
 // usually added by mistakes and only create confusion.
 func (s *DataStore) ValidateComment(c *store.Comment) error {
-	maxSize := s.MaxCommentSize
-	if s.MaxCommentSize <= 0 {
+	siteSettings := s.siteSettings(c.Locator.SiteID)
+	maxSize := siteSettings.MaxCommentSize
+	if maxSize <= 0 {
 		maxSize = defaultCommentMaxSize
 	}
 	if c.Orig == "" {
@@ -647,8 +991,8 @@ func (s *DataStore) ValidateComment(c *store.Comment) error {
 	if commentLength > maxSize {
 		return fmt.Errorf("comment text exceeded max allowed size %d (%d)", maxSize, commentLength)
 	}
-	if s.MinCommentSize > 0 && commentLength < s.MinCommentSize {
-		return fmt.Errorf("comment text is smaller than min allowed size %d (%d)", s.MinCommentSize, commentLength)
+	if siteSettings.MinCommentSize > 0 && commentLength < siteSettings.MinCommentSize {
+		return fmt.Errorf("comment text is smaller than min allowed size %d (%d)", siteSettings.MinCommentSize, commentLength)
 	}
 	if c.User.ID == "" || c.User.Name == "" {
 		return fmt.Errorf("empty user info")
@@ -680,6 +1024,47 @@ func (s *DataStore) IsAdmin(siteID, userID string) bool {
 	return slices.Contains(admins, userID)
 }
 
+// PreModerated checks if new comment of the user should wait for admin approval. Admins never pre-moderated
+func (s *DataStore) PreModerated(siteID string, user store.User) bool {
+	if user.Admin {
+		return false
+	}
+	if slices.Contains(s.PreModeration.Sites, siteID) {
+		return true
+	}
+	return s.PreModeration.Unverified && !s.IsVerified(siteID, user.ID)
+}
+
+// Pending returns comments awaiting approval for the site, oldest first
+func (s *DataStore) Pending(siteID string, limit, skip int) ([]store.Comment, error) {
+	req := engine.FindRequest{Locator: store.Locator{SiteID: siteID}, Pending: true, Limit: limit, Skip: skip, Sort: "+time"}
+	comments, err := s.Engine.Find(req)
+	if err != nil {
+		return comments, err
+	}
+	return s.alterComments(comments, store.User{Admin: true}), nil
+}
+
+// Approve makes pending comment visible to everyone. Returns approved comment altered as for anonymous reader
+func (s *DataStore) Approve(locator store.Locator, commentID string) (comment store.Comment, err error) {
+	comment, err = s.Engine.Get(engine.GetRequest{Locator: locator, CommentID: commentID})
+	if err != nil {
+		return comment, err
+	}
+	if !comment.Pending || comment.Deleted {
+		return comment, fmt.Errorf("comment %s is not pending approval", commentID)
+	}
+
+	comment.Pending, comment.Hidden = false, false
+	comment.Spam = false
+	if err = s.Engine.Update(comment); err != nil {
+		return comment, err
+	}
+	s.trainSpam(comment, false)
+	s.publishEvent(admin.EvCreate, comment)
+	return s.alterComment(comment, nonAdminUser), nil
+}
+
 // IsReadOnly checks if post read-only
 func (s *DataStore) IsReadOnly(locator store.Locator) bool {
 	req := engine.FlagRequest{Locator: locator, Flag: engine.ReadOnly}
@@ -735,6 +1120,24 @@ func (s *DataStore) SetBlock(siteID, userID string, status bool, ttl time.Durati
 	return err
 }
 
+// IsShadowBanned checks if user shadow-banned
+func (s *DataStore) IsShadowBanned(siteID, userID string) bool {
+	req := engine.FlagRequest{Locator: store.Locator{SiteID: siteID}, UserID: userID, Flag: engine.Shadowed}
+	ro, err := s.Engine.Flag(req)
+	return err == nil && ro
+}
+
+// SetShadowBan set/reset shadow ban for user. Comments of shadow-banned user visible to the user and admins only
+func (s *DataStore) SetShadowBan(siteID, userID string, status bool) error {
+	roStatus := engine.FlagFalse
+	if status {
+		roStatus = engine.FlagTrue
+	}
+	req := engine.FlagRequest{Locator: store.Locator{SiteID: siteID}, UserID: userID, Flag: engine.Shadowed, Update: roStatus}
+	_, err := s.Engine.Flag(req)
+	return err
+}
+
 // BlockedUsers returns list with all blocked users for given siteID
 func (s *DataStore) BlockedUsers(siteID string) (res []store.BlockedUser, err error) {
 	blocked, e := s.Engine.ListFlags(engine.FlagRequest{Locator: store.Locator{SiteID: siteID}, Flag: engine.Blocked})
@@ -776,8 +1179,13 @@ func (s *DataStore) Info(locator store.Locator, readonlyAge int) (store.PostInfo
 
 }
 
-// Delete comment by id
+// Delete comment by id, spam classifier trained with the deleted comment as spam
 func (s *DataStore) Delete(locator store.Locator, commentID string, mode store.DeleteMode) error {
+	return s.delete(locator, commentID, mode, true)
+}
+
+// delete comment by id, trains spam classifier with the comment as spam if spam set
+func (s *DataStore) delete(locator store.Locator, commentID string, mode store.DeleteMode, spam bool) error {
 	if e := s.AdminStore.OnEvent(locator.SiteID, admin.EvDelete); e != nil {
 		log.Printf("[WARN] failed to send delete event, %s", e)
 	}
@@ -821,13 +1229,116 @@ func (s *DataStore) Delete(locator store.Locator, commentID string, mode store.D
 	log.Printf("[DEBUG] commentImgIDs: %v, pageImgIDs: %v", commentImgIDs, pageImgIDs)
 
 	req := engine.DeleteRequest{Locator: locator, CommentID: commentID, DeleteMode: mode}
-	return s.Engine.Delete(req)
+	if err = s.Engine.Delete(req); err != nil {
+		return err
+	}
+	if spam {
+		s.trainSpam(comment, true)
+	}
+	comment.SetDeleted(mode)
+	s.publishEvent(admin.EvDelete, comment)
+	commentsCounter.WithLabelValues(locator.SiteID, "delete").Inc()
+	return nil
 }
 
 // DeleteUser removes all comments from user
 func (s *DataStore) DeleteUser(siteID, userID string, mode store.DeleteMode) error {
 	req := engine.DeleteRequest{Locator: store.Locator{SiteID: siteID}, UserID: userID, DeleteMode: mode}
-	return s.Engine.Delete(req)
+	if err := s.Engine.Delete(req); err != nil {
+		return err
+	}
+	if mode == store.HardDelete && s.Subscriptions != nil {
+		if err := s.Subscriptions.DeleteUser(siteID, userID); err != nil {
+			return fmt.Errorf("can't delete subscriptions of %s: %w", userID, err)
+		}
+	}
+	return nil
+}
+
+// ImageComments returns comments of the sites referencing uploaded images, by image ID. All comments of all posts
+// are scanned, including pending ones and comments of shadow banned users, which are still shown to some readers.
+func (s *DataStore) ImageComments(sites []string) (map[string][]store.Comment, error) {
+	res := map[string][]store.Comment{}
+	if s.ImageService == nil {
+		return res, nil
+	}
+	for _, siteID := range sites {
+		posts, err := s.Engine.Info(engine.InfoRequest{Locator: store.Locator{SiteID: siteID}})
+		if err != nil {
+			return nil, fmt.Errorf("can't get posts of site %s: %w", siteID, err)
+		}
+		for _, post := range posts {
+			comments, err := s.Engine.Find(engine.FindRequest{Locator: store.Locator{SiteID: siteID, URL: post.URL}, Sort: "time"})
+			if err != nil {
+				return nil, fmt.Errorf("can't get comments of post %s on site %s: %w", post.URL, siteID, err)
+			}
+			for _, c := range comments {
+				ids := s.ImageService.ExtractPictures(c.Text)
+				slices.Sort(ids)
+				for _, id := range slices.Compact(ids) {
+					res[id] = append(res[id], c)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// RemoveImage deletes the uploaded image and removes it from all comments of the sites referencing it.
+// Returns the changed comments.
+func (s *DataStore) RemoveImage(sites []string, imageID string) ([]store.Comment, error) {
+	if s.ImageService == nil {
+		return nil, errors.New("no image service")
+	}
+	refs, err := s.ImageComments(sites)
+	if err != nil {
+		return nil, err
+	}
+	mdImage := regexp.MustCompile(`!\[[^\]]*\]\([^)\s]*/` + regexp.QuoteMeta(imageID) + `(\s+"[^"]*")?\)`)
+	res := []store.Comment{}
+	for _, c := range refs[imageID] {
+		c.Text = s.ImageService.RemovePicture(c.Text, imageID)
+		c.Orig = mdImage.ReplaceAllString(c.Orig, "")
+		if err = s.Engine.Update(c); err != nil {
+			return res, fmt.Errorf("can't remove image %s from comment %s: %w", imageID, c.ID, err)
+		}
+		s.publishEvent(admin.EvUpdate, c)
+		res = append(res, c)
+	}
+	if err = s.ImageService.Delete(imageID); err != nil {
+		return res, fmt.Errorf("can't delete image %s: %w", imageID, err)
+	}
+	return res, nil
+}
+
+// DeleteUserImages deletes images uploaded by the user which are not referenced by any comment of the sites,
+// e.g. left after the user's comments deleted. Returns IDs of deleted images.
+func (s *DataStore) DeleteUserImages(sites []string, userID string) ([]string, error) {
+	if s.ImageService == nil {
+		return []string{}, nil
+	}
+	images, err := s.ImageService.List(userID)
+	if err != nil {
+		return nil, fmt.Errorf("can't list images of %s: %w", userID, err)
+	}
+	if len(images) == 0 {
+		return []string{}, nil
+	}
+	refs, err := s.ImageComments(sites)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, img := range images {
+		if _, ok := refs[img.ID]; ok {
+			continue
+		}
+		if err = s.ImageService.Delete(img.ID); err != nil {
+			return res, fmt.Errorf("can't delete image %s: %w", img.ID, err)
+		}
+		res = append(res, img.ID)
+	}
+	return res, nil
 }
 
 // List of commented posts
@@ -892,6 +1403,21 @@ func (s *DataStore) Metas(siteID string) (umetas []UserMetaData, pmetas []PostMe
 		m[v] = val
 	}
 
+	// process shadow-banned users
+	shadowed, err := s.Engine.ListFlags(engine.FlagRequest{Locator: store.Locator{SiteID: siteID}, Flag: engine.Shadowed})
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't get list of shadow-banned users for %s: %w", siteID, err)
+	}
+	for _, vi := range shadowed {
+		v := vi.(string)
+		val, ok := m[v]
+		if !ok {
+			val = UserMetaData{ID: v}
+		}
+		val.Shadowed = true
+		m[v] = val
+	}
+
 	// process users details
 	usersDetails, err := s.Engine.UserDetail(engine.UserDetailRequest{Locator: store.Locator{SiteID: siteID}, Detail: engine.AllUserDetails})
 	if err != nil {
@@ -933,6 +1459,9 @@ func (s *DataStore) SetMetas(siteID string, umetas []UserMetaData, pmetas []Post
 		if um.Verified {
 			errs = append(errs, s.SetVerified(siteID, um.ID, true))
 		}
+		if um.Shadowed {
+			errs = append(errs, s.SetShadowBan(siteID, um.ID, true))
+		}
 		// this code doesn't delete user details in case they are not set in import but present in DB already
 		if um.Details.Email != "" {
 			req := engine.UserDetailRequest{Locator: store.Locator{SiteID: siteID}, UserID: um.ID, Detail: engine.UserEmail, Update: um.Details.Email}
@@ -944,10 +1473,11 @@ func (s *DataStore) SetMetas(siteID string, umetas []UserMetaData, pmetas []Post
 	return errors.Join(errs...)
 }
 
-// User gets comment for given userID on siteID
+// User gets comment for given userID on siteID.
+// Comments not visible to the user excluded by the engine before the pagination
 func (s *DataStore) User(siteID, userID string, limit, skip int, user store.User) ([]store.Comment, error) {
 	req := engine.FindRequest{Locator: store.Locator{SiteID: siteID}, UserID: userID,
-		Limit: limit, Skip: skip, Sort: "-time"}
+		Limit: limit, Skip: skip, Sort: "-time", Visible: true, ViewerID: user.ID, ViewerAdmin: user.Admin}
 	comments, err := s.Engine.Find(req)
 	if err != nil {
 		return comments, err
@@ -955,15 +1485,39 @@ func (s *DataStore) User(siteID, userID string, limit, skip int, user store.User
 	return s.alterComments(comments, user), nil
 }
 
-// UserCount is comments count by user
-func (s *DataStore) UserCount(siteID, userID string) (int, error) {
-	req := engine.FindRequest{Locator: store.Locator{SiteID: siteID}, UserID: userID}
+// UserCount is comments count by user, counts comments visible to the user only
+func (s *DataStore) UserCount(siteID, userID string, user store.User) (int, error) {
+	req := engine.FindRequest{Locator: store.Locator{SiteID: siteID}, UserID: userID,
+		Visible: true, ViewerID: user.ID, ViewerAdmin: user.Admin}
 	return s.Engine.Count(req)
 }
 
-// Last gets last comments for site, cross-post. Limited by count and optional since ts
+// Last gets last comments for site, cross-post. Limited by count and optional since ts.
+// Comments not visible to the user excluded by the engine before the limit
 func (s *DataStore) Last(siteID string, limit int, since time.Time, user store.User) ([]store.Comment, error) {
-	req := engine.FindRequest{Locator: store.Locator{SiteID: siteID}, Limit: limit, Since: since, Sort: "-time"}
+	req := engine.FindRequest{Locator: store.Locator{SiteID: siteID}, Limit: limit, Since: since, Sort: "-time",
+		Visible: true, ViewerID: user.ID, ViewerAdmin: user.Admin}
+	comments, err := s.Engine.Find(req)
+	if err != nil {
+		return comments, err
+	}
+	return s.alterComments(comments, user), nil
+}
+
+// Search gets comments for site matching full-text query, cross-post. Sorted by time, newest first.
+// Deleted comments, comments of blocked users and comments not visible to the user excluded by the engine before pagination
+func (s *DataStore) Search(siteID, query string, limit, skip int, user store.User) ([]store.Comment, error) {
+	return s.search(engine.FindRequest{Locator: store.Locator{SiteID: siteID}, Query: query, Limit: limit, Skip: skip}, user)
+}
+
+// SearchAll is Search including deleted comments and comments of blocked users, for admin
+func (s *DataStore) SearchAll(siteID, query string, limit, skip int, user store.User) ([]store.Comment, error) {
+	return s.search(engine.FindRequest{Locator: store.Locator{SiteID: siteID}, Query: query, Limit: limit, Skip: skip,
+		Deleted: true}, user)
+}
+
+func (s *DataStore) search(req engine.FindRequest, user store.User) ([]store.Comment, error) {
+	req.Sort, req.ViewerID, req.ViewerAdmin = "-time", user.ID, user.Admin
 	comments, err := s.Engine.Find(req)
 	if err != nil {
 		return comments, err
@@ -980,10 +1534,42 @@ func (s *DataStore) Close() error {
 	if s.TitleExtractor != nil {
 		errs = append(errs, s.TitleExtractor.Close())
 	}
+	if s.Subscriptions != nil {
+		errs = append(errs, s.Subscriptions.Close())
+	}
 	errs = append(errs, s.Engine.Close())
 	return errors.Join(errs...)
 }
 
+// siteSettings returns settings of the site, DataStore's own settings used for all sites without SiteSettings
+func (s *DataStore) siteSettings(siteID string) settings.Settings {
+	if s.SiteSettings != nil {
+		return s.SiteSettings.Get(siteID)
+	}
+	return settings.Settings{MinCommentSize: s.MinCommentSize, MaxCommentSize: s.MaxCommentSize,
+		EditDuration: settings.Duration(s.EditDuration), PositiveScore: s.PositiveScore, MaxVotes: s.MaxVotes}
+}
+
+// publishEvent sends comment event to EventPublisher, if any. Comment altered the same way as for anonymous reader,
+// pending comments and comments of shadow-banned users are not visible for it and never published
+func (s *DataStore) publishEvent(et admin.EventType, comment store.Comment) {
+	if s.EventPublisher == nil || comment.Pending {
+		return
+	}
+	if s.IsShadowBanned(comment.Locator.SiteID, comment.User.ID) {
+		return
+	}
+	s.EventPublisher.Publish(et, s.alterComment(comment, nonAdminUser))
+}
+
+// publishHidden sends delete event for the comment just hidden from others, as it disappears for them the same way
+func (s *DataStore) publishHidden(comment store.Comment) {
+	hidden := comment
+	hidden.Pending, hidden.Hidden = false, false
+	hidden.SetDeleted(store.SoftDelete)
+	s.publishEvent(admin.EvDelete, hidden)
+}
+
 func (s *DataStore) upsAndDowns(c store.Comment) (ups, downs int) {
 	for _, v := range c.Votes {
 		if v {
@@ -1010,9 +1596,41 @@ func (s *DataStore) getScopedLocks(id string) (lock sync.Locker) {
 	return lock
 }
 
+// trainSpam trains spam classifier, if any, with comment approved, pinned or deleted by admin
+func (s *DataStore) trainSpam(comment store.Comment, spam bool) {
+	if s.SpamClassifier == nil || comment.Deleted || comment.User.Admin {
+		return
+	}
+	if err := s.SpamClassifier.Train(comment, spam); err != nil {
+		log.Printf("[WARN] can't train spam classifier with %s, %v", comment.ID, err)
+	}
+}
+
+// isVisible checks if comment can be shown to the user. Pending comments and comments of shadow-banned users
+// visible to their author and admins only
+func isVisible(c store.Comment, user store.User, flags *userFlagCache) bool {
+	if user.Admin || (user.ID != "" && c.User.ID == user.ID) {
+		return true
+	}
+	return !c.Pending && !flags.shadowed(c.Locator.SiteID, c.User.ID)
+}
+
+// visibleComments filters out comments not visible to the user
+func visibleComments(cc []store.Comment, user store.User, flags *userFlagCache) []store.Comment {
+	res := cc[:0]
+	for _, c := range cc {
+		if isVisible(c, user, flags) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// alterComments filters out comments not visible to the user and alters the rest
 func (s *DataStore) alterComments(cc []store.Comment, user store.User) (res []store.Comment) {
-	res = make([]store.Comment, len(cc))
 	flags := s.newUserFlagCache()
+	cc = visibleComments(cc, user, flags)
+	res = make([]store.Comment, len(cc))
 	for i, c := range cc {
 		res[i] = s.alterCommentCached(c, user, flags)
 	}
@@ -1036,9 +1654,17 @@ func (s *DataStore) alterCommentCached(c store.Comment, user store.User, flags *
 		c.User.Verified = flags.verified(c.Locator.SiteID, c.User.ID)
 	}
 
+	// mark shadow-banned user for admins only, the user itself shouldn't know about it
+	if user.Admin && flags.shadowed(c.Locator.SiteID, c.User.ID) {
+		c.User.Shadowed = true
+	}
+
 	// hide info from non-admins
 	if !user.Admin {
 		c.User.IP = ""
+		c.Reports = nil
+		c.Hidden = false
+		c.Spam = false
 	}
 
 	c = s.prepVotes(c, user)
@@ -1053,6 +1679,7 @@ type userFlagCache struct {
 	s         *DataStore
 	blockedM  map[flagKey]bool
 	verifiedM map[flagKey]bool
+	shadowedM map[flagKey]bool
 }
 
 type flagKey struct {
@@ -1061,7 +1688,7 @@ type flagKey struct {
 }
 
 func (s *DataStore) newUserFlagCache() *userFlagCache {
-	return &userFlagCache{s: s, blockedM: map[flagKey]bool{}, verifiedM: map[flagKey]bool{}}
+	return &userFlagCache{s: s, blockedM: map[flagKey]bool{}, verifiedM: map[flagKey]bool{}, shadowedM: map[flagKey]bool{}}
 }
 
 func (f *userFlagCache) blocked(siteID, userID string) bool {
@@ -1092,6 +1719,19 @@ func (f *userFlagCache) verified(siteID, userID string) bool {
 	return v
 }
 
+func (f *userFlagCache) shadowed(siteID, userID string) bool {
+	key := flagKey{siteID: siteID, userID: userID}
+	if v, ok := f.shadowedM[key]; ok {
+		return v
+	}
+	v, err := f.s.Engine.Flag(engine.FlagRequest{Flag: engine.Shadowed, Locator: store.Locator{SiteID: siteID}, UserID: userID})
+	if err != nil {
+		return false // don't cache on error, retry on the next comment for this user
+	}
+	f.shadowedM[key] = v
+	return v
+}
+
 // prepare vote info for client view
 func (s *DataStore) prepVotes(c store.Comment, user store.User) store.Comment {
 	c.Vote = 0 // default is "none" (not voted)
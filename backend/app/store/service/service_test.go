@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -18,6 +19,7 @@ import (
 	"time"
 
 	"github.com/go-pkgz/lgr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	bolt "go.etcd.io/bbolt"
@@ -26,6 +28,8 @@ import (
 	"github.com/umputun/remark42/backend/app/store/admin"
 	"github.com/umputun/remark42/backend/app/store/engine"
 	"github.com/umputun/remark42/backend/app/store/image"
+	"github.com/umputun/remark42/backend/app/store/settings"
+	"github.com/umputun/remark42/backend/app/store/subscription"
 )
 
 func TestService_CreateFromEmpty(t *testing.T) {
@@ -380,6 +384,37 @@ func TestService_Vote(t *testing.T) {
 	assert.Equal(t, map[string]store.VotedIPInfo(nil), res[0].VotedIPs, "vote reset ok")
 }
 
+func TestService_CommentsCounter(t *testing.T) {
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), MaxVotes: -1}
+	defer b.Close()
+
+	before := map[string]float64{}
+	for _, action := range []string{"create", "edit", "vote", "delete"} {
+		before[action] = testutil.ToFloat64(commentsCounter.WithLabelValues("radio-t", action))
+	}
+
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	id, err := b.Create(store.Comment{Text: "text", User: store.User{ID: "user", Name: "name"}, Locator: locator})
+	require.NoError(t, err)
+	_, err = b.Create(store.Comment{ID: "imported", Text: "text", User: store.User{ID: "user", Name: "name"},
+		Locator: locator, Imported: true})
+	require.NoError(t, err)
+	_, err = b.EditComment(locator, id, EditRequest{Orig: "text", Text: "edited"})
+	require.NoError(t, err)
+	_, err = b.Vote(VoteReq{Locator: locator, CommentID: "id-1", UserID: "user2", Val: true})
+	require.NoError(t, err)
+	_, err = b.EditComment(locator, id, EditRequest{Delete: true})
+	require.NoError(t, err)
+	require.NoError(t, b.Delete(locator, "id-2", store.SoftDelete))
+
+	assert.InDelta(t, before["create"]+1, testutil.ToFloat64(commentsCounter.WithLabelValues("radio-t", "create")), 0.001, "imported not counted")
+	assert.InDelta(t, before["edit"]+1, testutil.ToFloat64(commentsCounter.WithLabelValues("radio-t", "edit")), 0.001)
+	assert.InDelta(t, before["vote"]+1, testutil.ToFloat64(commentsCounter.WithLabelValues("radio-t", "vote")), 0.001)
+	assert.InDelta(t, before["delete"]+2, testutil.ToFloat64(commentsCounter.WithLabelValues("radio-t", "delete")), 0.001)
+}
+
 func TestService_VoteLimit(t *testing.T) {
 	eng, teardown := prepStoreEngine(t)
 	defer teardown()
@@ -849,6 +884,60 @@ func TestService_DeleteComment(t *testing.T) {
 	t.Logf("%+v", c)
 }
 
+func TestService_EventPublisher(t *testing.T) {
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	pub := &testEventPublisher{}
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), MaxVotes: -1, EventPublisher: pub}
+	defer b.Close()
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	id, err := b.Create(store.Comment{Text: "text", User: store.User{IP: "192.168.1.1", ID: "user", Name: "name"},
+		Locator: locator})
+	require.NoError(t, err)
+	require.Len(t, pub.events, 1)
+	assert.Equal(t, admin.EvCreate, pub.events[0].et)
+	assert.Equal(t, id, pub.events[0].comment.ID)
+	assert.Equal(t, "text", pub.events[0].comment.Text)
+	assert.Empty(t, pub.events[0].comment.User.IP, "ip hidden")
+
+	_, err = b.Vote(VoteReq{Locator: locator, CommentID: id, UserID: "user1", Val: true})
+	require.NoError(t, err)
+	require.Len(t, pub.events, 2)
+	assert.Equal(t, admin.EvVote, pub.events[1].et)
+	assert.Equal(t, 1, pub.events[1].comment.Score)
+	assert.Equal(t, 0, pub.events[1].comment.Vote, "voter's vote not exposed")
+	assert.Nil(t, pub.events[1].comment.Votes, "voters hidden")
+
+	_, err = b.Vote(VoteReq{Locator: locator, CommentID: id, UserID: "user1", Val: true})
+	require.Error(t, err)
+	require.Len(t, pub.events, 2, "no event for rejected vote")
+
+	_, err = b.EditComment(locator, id, EditRequest{Orig: "edited", Text: "edited"})
+	require.NoError(t, err)
+	require.Len(t, pub.events, 3)
+	assert.Equal(t, admin.EvUpdate, pub.events[2].et)
+	assert.Equal(t, "edited", pub.events[2].comment.Text)
+
+	_, err = b.EditComment(locator, id, EditRequest{Delete: true})
+	require.NoError(t, err)
+	require.Len(t, pub.events, 4)
+	assert.Equal(t, admin.EvDelete, pub.events[3].et)
+	assert.True(t, pub.events[3].comment.Deleted)
+	assert.Empty(t, pub.events[3].comment.Text)
+
+	err = b.Delete(locator, "id-1", store.HardDelete)
+	require.NoError(t, err)
+	require.Len(t, pub.events, 5)
+	assert.Equal(t, admin.EvDelete, pub.events[4].et)
+	assert.Equal(t, "id-1", pub.events[4].comment.ID)
+	assert.Equal(t, "deleted", pub.events[4].comment.User.Name)
+
+	err = b.Delete(locator, "bad-id", store.SoftDelete)
+	require.Error(t, err)
+	require.Len(t, pub.events, 5, "no event for failed delete")
+}
+
 func TestService_EditCommentDurationFailed(t *testing.T) {
 	eng, teardown := prepStoreEngine(t)
 	defer teardown()
@@ -944,6 +1033,31 @@ func TestService_ValidateComment(t *testing.T) {
 	}
 }
 
+func TestService_SiteSettings(t *testing.T) {
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	st, err := settings.NewStore("", settings.Settings{MaxCommentSize: 2000, MaxVotes: -1})
+	require.NoError(t, err)
+	_, err = st.Set("radio-t", json.RawMessage(`{"min_comment_size": 10, "max_votes": 0, "edit_duration": "1ns"}`))
+	require.NoError(t, err)
+	// DataStore's own settings ignored with SiteSettings
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), SiteSettings: st, MinCommentSize: 1}
+	defer b.Close()
+
+	c := store.Comment{Orig: "short", User: store.User{ID: "myid", Name: "name"}, Locator: store.Locator{SiteID: "radio-t"}}
+	assert.EqualError(t, b.ValidateComment(&c), "comment text is smaller than min allowed size 10 (5)")
+	c.Locator.SiteID = "other"
+	assert.NoError(t, b.ValidateComment(&c), "default settings for other site")
+
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	_, err = b.Vote(VoteReq{Locator: locator, CommentID: "id-1", UserID: "user2", Val: true})
+	assert.EqualError(t, err, "maximum number of votes exceeded for comment id-1")
+
+	time.Sleep(time.Millisecond)
+	_, err = b.EditComment(locator, "id-1", EditRequest{Orig: "yyy", Text: "xxx"})
+	assert.EqualError(t, err, "too late to edit id-1")
+}
+
 func TestService_Counts(t *testing.T) {
 	b, teardown := prepStoreEngine(t) // two comments for https://radio-t.com
 	defer teardown()
@@ -1068,12 +1182,39 @@ func TestService_UserDetailsOperations(t *testing.T) {
 	result, err = b.GetUserTelegram("radio-t", "u1")
 	assert.NoError(t, err, "No error reading entry expected")
 	assert.Equal(t, "test@example.com", result)
+	result, err = b.GetUserEmailDigest("radio-t", "u1")
+	assert.NoError(t, err, "No error reading entry expected")
+	assert.Empty(t, result, "immediate by default")
+	result, err = b.SetUserEmailDigest("radio-t", "u1", "daily")
+	assert.NoError(t, err, "No error inserting entry expected")
+	assert.Equal(t, "daily", result)
+	result, err = b.GetUserEmailDigest("radio-t", "u1")
+	assert.NoError(t, err, "No error reading entry expected")
+	assert.Equal(t, "daily", result)
+	result, err = b.SetUserMatrix("radio-t", "u1", "@u1:matrix.org")
+	assert.NoError(t, err, "No error inserting entry expected")
+	assert.Equal(t, "@u1:matrix.org", result)
+	result, err = b.GetUserMatrix("radio-t", "u1")
+	assert.NoError(t, err, "No error reading entry expected")
+	assert.Equal(t, "@u1:matrix.org", result)
+	result, err = b.SetUserWebPush("radio-t", "u1", `[{"endpoint":"https://push.example.com/1"}]`)
+	assert.NoError(t, err, "No error inserting entry expected")
+	assert.Equal(t, `[{"endpoint":"https://push.example.com/1"}]`, result)
+	result, err = b.GetUserWebPush("radio-t", "u1")
+	assert.NoError(t, err, "No error reading entry expected")
+	assert.Equal(t, `[{"endpoint":"https://push.example.com/1"}]`, result)
 
 	// delete existing entry
 	err = b.DeleteUserDetail("radio-t", "u1", engine.UserEmail)
 	assert.NoError(t, err, "No error deleting entry expected")
 	err = b.DeleteUserDetail("radio-t", "u1", engine.UserTelegram)
 	assert.NoError(t, err, "No error deleting entry expected")
+	err = b.DeleteUserDetail("radio-t", "u1", engine.UserEmailDigest)
+	assert.NoError(t, err, "No error deleting entry expected")
+	err = b.DeleteUserDetail("radio-t", "u1", engine.UserMatrix)
+	assert.NoError(t, err, "No error deleting entry expected")
+	err = b.DeleteUserDetail("radio-t", "u1", engine.UserWebPush)
+	assert.NoError(t, err, "No error deleting entry expected")
 
 	// read deleted entry
 	result, err = b.GetUserEmail("radio-t", "u1")
@@ -1082,6 +1223,15 @@ func TestService_UserDetailsOperations(t *testing.T) {
 	result, err = b.GetUserTelegram("radio-t", "u1")
 	assert.NoError(t, err, "No error reading entry expected")
 	assert.Empty(t, result)
+	result, err = b.GetUserEmailDigest("radio-t", "u1")
+	assert.NoError(t, err, "No error reading entry expected")
+	assert.Empty(t, result)
+	result, err = b.GetUserMatrix("radio-t", "u1")
+	assert.NoError(t, err, "No error reading entry expected")
+	assert.Empty(t, result)
+	result, err = b.GetUserWebPush("radio-t", "u1")
+	assert.NoError(t, err, "No error reading entry expected")
+	assert.Empty(t, result)
 
 	// insert entry with invalid site_id
 	result, err = b.SetUserEmail("bad-site", "u3", "does_not_matter@example.com")
@@ -1323,6 +1473,431 @@ func TestService_FindSince(t *testing.T) {
 	assert.Equal(t, "id-2", res[0].ID)
 }
 
+func TestService_Search(t *testing.T) {
+	// two comments for https://radio-t.com, no reply
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	b := DataStore{Engine: eng, EditDuration: 100 * time.Millisecond,
+		AdminStore: admin.NewStaticStore("secret 123", nil, []string{"user2"}, "user@email.com")}
+
+	res, err := b.Search("radio-t", "some text", 0, 0, store.User{})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "id-2", res[0].ID, "sorted by time, newest first")
+	assert.Equal(t, "id-1", res[1].ID)
+
+	res, err = b.Search("radio-t", "LINK", 0, 0, store.User{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-1", res[0].ID)
+
+	res, err = b.Search("radio-t", "some", 1, 1, store.User{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-1", res[0].ID)
+
+	res, err = b.Search("radio-t", "nothing", 0, 0, store.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+
+	_, err = b.Search("bad-site", "some", 0, 0, store.User{})
+	assert.Error(t, err)
+
+	// deleted comment excluded before pagination, included for SearchAll
+	require.NoError(t, b.Delete(store.Locator{SiteID: "radio-t", URL: "https://radio-t.com"}, "id-2", store.SoftDelete))
+	res, err = b.Search("radio-t", "user", 1, 0, store.User{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, "id-1", res[0].ID)
+	res, err = b.SearchAll("radio-t", "user", 0, 0, store.User{ID: "user2", Admin: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.True(t, res[0].Deleted)
+}
+
+func TestService_PreModerated(t *testing.T) {
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123")}
+	require.NoError(t, b.SetVerified("radio-t", "verified", true))
+
+	assert.False(t, b.PreModerated("radio-t", store.User{ID: "user1"}), "pre-moderation disabled")
+
+	b.PreModeration.Unverified = true
+	assert.True(t, b.PreModerated("radio-t", store.User{ID: "user1"}))
+	assert.False(t, b.PreModerated("radio-t", store.User{ID: "verified"}))
+	assert.False(t, b.PreModerated("radio-t", store.User{ID: "admin", Admin: true}))
+
+	b.PreModeration.Unverified = false
+	b.PreModeration.Sites = []string{"radio-t"}
+	assert.True(t, b.PreModerated("radio-t", store.User{ID: "verified"}), "all comments on the site pre-moderated")
+	assert.False(t, b.PreModerated("radio-t", store.User{ID: "admin", Admin: true}))
+	assert.False(t, b.PreModerated("other-site", store.User{ID: "user1"}))
+}
+
+func TestService_Pending(t *testing.T) {
+	// two comments for https://radio-t.com
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	pub := &testEventPublisher{}
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), MaxVotes: -1, EventPublisher: pub}
+	defer b.Close()
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	id, err := b.Create(store.Comment{Text: "pending text", Pending: true, Locator: locator,
+		User: store.User{IP: "192.168.1.1", ID: "user2", Name: "user two"}})
+	require.NoError(t, err)
+	assert.Empty(t, pub.events, "pending comment not published")
+
+	author, other, adm := store.User{ID: "user2"}, store.User{ID: "user1"}, store.User{ID: "admin", Admin: true}
+	for _, tt := range []struct {
+		user    store.User
+		visible bool
+	}{{user: author, visible: true}, {user: adm, visible: true}, {user: other}, {user: store.User{}}} {
+		res, e := b.Find(locator, "time", tt.user)
+		require.NoError(t, e)
+		assert.Equal(t, tt.visible, len(res) == 3, "find for %+v", tt.user)
+
+		res, e = b.Last("radio-t", 10, time.Time{}, tt.user)
+		require.NoError(t, e)
+		assert.Equal(t, tt.visible, len(res) == 3, "last for %+v", tt.user)
+
+		res, e = b.User("radio-t", "user2", 10, 0, tt.user)
+		require.NoError(t, e)
+		assert.Equal(t, tt.visible, len(res) == 1, "user for %+v", tt.user)
+
+		res, e = b.Search("radio-t", "pending", 10, 0, tt.user)
+		require.NoError(t, e)
+		assert.Equal(t, tt.visible, len(res) == 1, "search for %+v", tt.user)
+
+		_, e = b.Get(locator, id, tt.user)
+		assert.Equal(t, tt.visible, e == nil, "get for %+v", tt.user)
+	}
+
+	counts, err := b.Counts("radio-t", []string{"https://radio-t.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com", Count: 2}}, counts, "pending comment not counted")
+
+	_, err = b.Vote(VoteReq{Locator: locator, CommentID: id, UserID: "user1", Val: true})
+	assert.EqualError(t, err, "comment "+id+" is pending approval")
+
+	res, err := b.Pending("radio-t", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, id, res[0].ID)
+	assert.NotEmpty(t, res[0].User.IP, "ip not hidden from admin")
+
+	c, err := b.Approve(locator, id)
+	require.NoError(t, err)
+	assert.False(t, c.Pending)
+	require.Len(t, pub.events, 1)
+	assert.Equal(t, admin.EvCreate, pub.events[0].et)
+	assert.Equal(t, id, pub.events[0].comment.ID)
+
+	res, err = b.Find(locator, "time", store.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(res), "approved comment visible to everyone")
+	res, err = b.Pending("radio-t", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+
+	_, err = b.Approve(locator, id)
+	assert.EqualError(t, err, "comment "+id+" is not pending approval")
+	_, err = b.Approve(locator, "bad-id")
+	assert.Error(t, err)
+	_, err = b.Pending("bad-site", 0, 0)
+	assert.Error(t, err)
+}
+
+func TestService_Report(t *testing.T) {
+	// two comments for https://radio-t.com, both by user1
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	pub := &testEventPublisher{}
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), ReportThreshold: 2, EventPublisher: pub}
+	defer b.Close()
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+	req := ReportReq{Locator: locator, CommentID: "id-1", UserID: "user2", Reason: store.ReportSpam, Note: "<b>buy</b> stuff"}
+
+	c, err := b.Report(req)
+	require.NoError(t, err)
+	assert.False(t, c.Pending, "below threshold")
+	assert.Equal(t, "buy stuff", c.Reports["user2"].Note, "note sanitized")
+
+	_, err = b.Report(req)
+	assert.EqualError(t, err, "user user2 already reported id-1")
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: "id-1", UserID: "user1", Reason: store.ReportSpam})
+	assert.EqualError(t, err, "user user1 can not report own comment id-1")
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: "id-1", UserID: "user3", Reason: "bad"})
+	assert.EqualError(t, err, `unknown report reason "bad"`)
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: "id-1", UserID: "user3", Reason: store.ReportOther,
+		Note: strings.Repeat("x", 501)})
+	assert.EqualError(t, err, "report note is too long, max 500 characters allowed")
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: "id-bad", UserID: "user3", Reason: store.ReportOther})
+	assert.Error(t, err)
+
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: "id-2", UserID: "user3", Reason: store.ReportAbuse})
+	require.NoError(t, err)
+	require.Empty(t, pub.events)
+	c, err = b.Report(ReportReq{Locator: locator, CommentID: "id-1", UserID: "user3", Reason: store.ReportOffTopic})
+	require.NoError(t, err)
+	assert.True(t, c.Pending, "hidden on threshold")
+	assert.True(t, c.Hidden)
+	require.Len(t, pub.events, 1, "hidden comment removed from stream")
+	assert.Equal(t, admin.EvDelete, pub.events[0].et)
+	assert.Equal(t, "id-1", pub.events[0].comment.ID)
+	assert.True(t, pub.events[0].comment.Deleted)
+	assert.Empty(t, pub.events[0].comment.Text)
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: "id-1", UserID: "user4", Reason: store.ReportOffTopic})
+	assert.EqualError(t, err, "comment id-1 can't be reported", "hidden comment can't be reported")
+
+	res, err := b.Find(locator, "time", store.User{})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res), "hidden comment not visible")
+	assert.Nil(t, res[0].Reports, "reports hidden from non-admin")
+
+	res, err = b.Reported("radio-t", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, "id-1", res[0].ID, "the most reported first")
+	assert.Equal(t, 2, len(res[0].Reports))
+	assert.Equal(t, "id-2", res[1].ID)
+
+	// dismiss makes hidden comment visible again
+	c, err = b.DismissReports(locator, "id-1")
+	require.NoError(t, err)
+	assert.False(t, c.Pending)
+	assert.False(t, c.Hidden)
+	require.Len(t, pub.events, 2)
+	assert.Equal(t, admin.EvCreate, pub.events[1].et)
+	res, err = b.Find(locator, "time", store.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(res))
+	_, err = b.DismissReports(locator, "id-1")
+	assert.EqualError(t, err, "comment id-1 has no reports")
+
+	// resolve deletes comment
+	require.NoError(t, b.ResolveReports(locator, "id-2"))
+	c, err = b.Get(locator, "id-2", store.User{})
+	require.NoError(t, err)
+	assert.True(t, c.Deleted)
+	assert.EqualError(t, b.ResolveReports(locator, "id-2"), "comment id-2 has no reports")
+
+	res, err = b.Reported("radio-t", 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+	_, err = b.Reported("bad-site", 0, 0)
+	assert.Error(t, err)
+}
+
+func TestService_ShadowBan(t *testing.T) {
+	// two comments for https://radio-t.com, both by user1
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	pub := &testEventPublisher{}
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), EventPublisher: pub}
+	defer b.Close()
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	assert.False(t, b.IsShadowBanned("radio-t", "user1"))
+	require.NoError(t, b.SetShadowBan("radio-t", "user1", true))
+	assert.True(t, b.IsShadowBanned("radio-t", "user1"))
+
+	res, err := b.Find(locator, "time", store.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res), "hidden from anonymous")
+	res, err = b.Find(locator, "time", store.User{ID: "user2"})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res), "hidden from other user")
+	res, err = b.Find(locator, "time", store.User{ID: "user1"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "visible to the user")
+	assert.False(t, res[0].User.Shadowed, "user doesn't know about shadow ban")
+	res, err = b.Find(locator, "time", store.User{ID: "admin", Admin: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res), "visible to admin")
+	assert.True(t, res[0].User.Shadowed, "marked for admin")
+
+	res, err = b.Last("radio-t", 10, time.Time{}, store.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+	_, err = b.Get(locator, "id-1", store.User{})
+	assert.EqualError(t, err, "comment id-1 not found")
+	c, err := b.Get(locator, "id-1", store.User{ID: "user1"})
+	require.NoError(t, err)
+	assert.Equal(t, "id-1", c.ID)
+
+	count, err := b.Count(locator)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+	counts, err := b.Counts("radio-t", []string{"https://radio-t.com"})
+	require.NoError(t, err)
+	assert.Equal(t, []store.PostInfo{{URL: "https://radio-t.com", Count: 0}}, counts)
+	info, err := b.Info(locator, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, info.Count)
+	posts, err := b.List("radio-t", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(posts))
+	assert.Equal(t, 0, posts[0].Count)
+
+	_, err = b.Create(store.Comment{Text: "text", Locator: locator, User: store.User{ID: "user1"}})
+	require.NoError(t, err)
+	assert.Empty(t, pub.events, "events for shadow-banned user not published")
+
+	umetas, _, err := b.Metas("radio-t")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(umetas))
+	assert.Equal(t, UserMetaData{ID: "user1", Shadowed: true}, umetas[0])
+
+	require.NoError(t, b.SetShadowBan("radio-t", "user1", false))
+	count, err = b.Count(locator)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	res, err = b.Find(locator, "time", store.User{})
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(res))
+}
+
+func TestService_HiddenBeforePagination(t *testing.T) {
+	boltEng, err := engine.NewBoltDB(bolt.Options{}, engine.BoltSite{FileName: path.Join(t.TempDir(), "test.db"), SiteID: "radio-t"})
+	require.NoError(t, err)
+	sqliteEng, err := engine.NewSQLite(path.Join(t.TempDir(), "test.sqlite"), time.Second, "radio-t")
+	require.NoError(t, err)
+
+	for _, eng := range []engine.Interface{boltEng, sqliteEng} {
+		t.Run(fmt.Sprintf("%T", eng), func(t *testing.T) {
+			b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123")}
+			defer b.Close()
+			locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+			ts := time.Date(2017, 12, 20, 15, 18, 0, 0, time.UTC)
+			add := func(id, userID string, pending bool) {
+				ts = ts.Add(time.Second)
+				_, e := eng.Create(store.Comment{ID: id, Text: "text " + id, Timestamp: ts, Locator: locator,
+					User: store.User{ID: userID, Name: userID}, Pending: pending})
+				require.NoError(t, e)
+			}
+			// newest comments are pending or made by shadow-banned user
+			add("id-1", "user1", false)
+			add("id-2", "user1", false)
+			add("id-3", "user1", true)
+			add("id-4", "shadowed", false)
+			add("id-5", "shadowed", false)
+			require.NoError(t, b.SetShadowBan("radio-t", "shadowed", true))
+
+			ids := func(cc []store.Comment, err error) []string {
+				require.NoError(t, err)
+				res := []string{}
+				for _, c := range cc {
+					res = append(res, c.ID)
+				}
+				return res
+			}
+			anon, author, adm := store.User{}, store.User{ID: "user1"}, store.User{ID: "admin", Admin: true}
+
+			assert.Equal(t, []string{"id-2", "id-1"}, ids(b.Last("radio-t", 2, time.Time{}, anon)), "full page")
+			assert.Equal(t, []string{"id-3", "id-2"}, ids(b.Last("radio-t", 2, time.Time{}, author)))
+			assert.Equal(t, []string{"id-5", "id-4"}, ids(b.Last("radio-t", 2, time.Time{}, adm)))
+
+			assert.Equal(t, []string{"id-2"}, ids(b.User("radio-t", "user1", 1, 0, anon)))
+			assert.Equal(t, []string{"id-1"}, ids(b.User("radio-t", "user1", 1, 1, anon)), "skip of visible comments")
+			assert.Equal(t, []string{"id-3"}, ids(b.User("radio-t", "user1", 1, 0, author)))
+			assert.Equal(t, []string{}, ids(b.User("radio-t", "shadowed", 10, 0, anon)))
+			assert.Equal(t, []string{"id-5", "id-4"}, ids(b.User("radio-t", "shadowed", 10, 0, store.User{ID: "shadowed"})))
+
+			count := func(userID string, user store.User) int {
+				c, e := b.UserCount("radio-t", userID, user)
+				require.NoError(t, e)
+				return c
+			}
+			assert.Equal(t, 2, count("user1", anon))
+			assert.Equal(t, 3, count("user1", author))
+			assert.Equal(t, 3, count("user1", adm))
+			assert.Equal(t, 0, count("shadowed", anon))
+			assert.Equal(t, 2, count("shadowed", adm))
+		})
+	}
+}
+
+func TestService_Spam(t *testing.T) {
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	classifier := NewSpamClassifier("", 0.9)
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), SpamClassifier: classifier}
+	defer b.Close()
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	spamText := `<p>cheap pills <a href="https://pills.example.com">here</a></p>`
+	for range spamMinTrained {
+		require.NoError(t, classifier.Train(store.Comment{Locator: locator, Text: spamText}, true))
+		require.NoError(t, classifier.Train(store.Comment{Locator: locator, Text: "<p>nice episode</p>"}, false))
+	}
+
+	// default action tags spam comment
+	id, err := b.Create(store.Comment{Text: spamText, Locator: locator, User: store.User{ID: "spammer"}})
+	require.NoError(t, err)
+	c, err := b.Get(locator, id, store.User{Admin: true})
+	require.NoError(t, err)
+	assert.True(t, c.Spam, "tagged for admin")
+	assert.False(t, c.Pending)
+	c, err = b.Get(locator, id, store.User{})
+	require.NoError(t, err)
+	assert.False(t, c.Spam, "tag hidden from non-admin")
+
+	id, err = b.Create(store.Comment{Text: "<p>nice episode</p>", Locator: locator, User: store.User{ID: "user2"}})
+	require.NoError(t, err)
+	c, err = b.Get(locator, id, store.User{Admin: true})
+	require.NoError(t, err)
+	assert.False(t, c.Spam, "ham not tagged")
+
+	_, err = b.Create(store.Comment{Text: spamText, Locator: locator, User: store.User{ID: "admin", Admin: true}})
+	require.NoError(t, err, "admin comments never classified")
+
+	b.SpamAction = SpamQueue
+	id, err = b.Create(store.Comment{Text: spamText, Locator: locator, User: store.User{ID: "spammer"}})
+	require.NoError(t, err)
+	c, err = b.Get(locator, id, store.User{Admin: true})
+	require.NoError(t, err)
+	assert.True(t, c.Pending, "queued for approval")
+	assert.True(t, c.Spam)
+
+	// approval trains as ham and drops spam tag
+	_, err = b.Approve(locator, id)
+	require.NoError(t, err)
+	c, err = b.Get(locator, id, store.User{Admin: true})
+	require.NoError(t, err)
+	assert.False(t, c.Spam)
+	assert.Equal(t, spamMinTrained+1, classifier.model("radio-t").Ham)
+
+	b.SpamAction = SpamReject
+	_, err = b.Create(store.Comment{Text: spamText, Locator: locator, User: store.User{ID: "spammer"}})
+	assert.ErrorIs(t, err, ErrSpamDetected)
+
+	// pin trains as ham, delete as spam
+	require.NoError(t, b.SetPin(locator, "id-1", true))
+	assert.Equal(t, spamMinTrained+2, classifier.model("radio-t").Ham)
+	require.NoError(t, b.SetPin(locator, "id-1", false))
+	assert.Equal(t, spamMinTrained+2, classifier.model("radio-t").Ham, "unpin doesn't train")
+	require.NoError(t, b.Delete(locator, "id-2", store.SoftDelete))
+	assert.Equal(t, spamMinTrained+1, classifier.model("radio-t").Spam)
+	require.NoError(t, b.Delete(locator, "id-2", store.SoftDelete))
+	assert.Equal(t, spamMinTrained+1, classifier.model("radio-t").Spam, "deleted comment not trained again")
+
+	// resolved reports train as spam only if reported as spam
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: "id-1", UserID: "user3", Reason: store.ReportAbuse})
+	require.NoError(t, err)
+	require.NoError(t, b.ResolveReports(locator, "id-1"))
+	assert.Equal(t, spamMinTrained+1, classifier.model("radio-t").Spam, "abuse report doesn't train")
+	id, err = b.Create(store.Comment{Text: "<p>more pills</p>", Locator: locator, User: store.User{ID: "user4"}})
+	require.NoError(t, err)
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: id, UserID: "user3", Reason: store.ReportOther})
+	require.NoError(t, err)
+	_, err = b.Report(ReportReq{Locator: locator, CommentID: id, UserID: "user5", Reason: store.ReportSpam})
+	require.NoError(t, err)
+	require.NoError(t, b.ResolveReports(locator, id))
+	assert.Equal(t, spamMinTrained+2, classifier.model("radio-t").Spam, "spam report trains")
+}
+
 func TestService_Info(t *testing.T) {
 	// two comments for https://radio-t.com, no reply
 	eng, teardown := prepStoreEngine(t)
@@ -1475,6 +2050,67 @@ func TestService_deleteImagesOnCommentDelete(t *testing.T) {
 	})
 }
 
+func TestService_Images(t *testing.T) {
+	mockStore := image.StoreMock{
+		DeleteFunc: func(string) error { return nil },
+		ListFunc: func(string) ([]image.Meta, error) {
+			return []image.Meta{{ID: "user1/pic1.png"}, {ID: "user1/pic2.png"}, {ID: "user1/pic4.png"}}, nil
+		},
+	}
+	imgSvc := image.NewService(&mockStore, image.ServiceParams{ImageAPI: "https://example.com/api/v1/picture/", ProxyAPI: "/non_existent"})
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	pub := &testEventPublisher{}
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), ImageService: imgSvc, EventPublisher: pub}
+
+	for _, c := range []store.Comment{
+		{ID: "id-11", Text: `<p>pic <img src="https://example.com/api/v1/picture/user1/pic1.png" alt="pic"/> and ` +
+			`<img src="https://example.com/api/v1/picture/user1/pic1.png"/> again</p>`,
+			Orig:    "pic ![pic](https://example.com/api/v1/picture/user1/pic1.png) and ![](https://example.com/api/v1/picture/user1/pic1.png \"t\") again",
+			Locator: store.Locator{URL: "https://radio-t.com/p1", SiteID: "radio-t"}, User: store.User{ID: "user1"}},
+		{ID: "id-12", Text: `<img src="https://example.com/api/v1/picture/user1/pic1.png"/><img src="https://example.com/api/v1/picture/user1/pic2.png"/>`,
+			Locator: store.Locator{URL: "https://radio-t.com/p2", SiteID: "radio-t"}, User: store.User{ID: "user2"}, Pending: true},
+		{ID: "id-13", Text: `<img src="https://example.com/api/v1/picture/user1/pic3.png"/>`,
+			Locator: store.Locator{URL: "https://radio-t.com/p2", SiteID: "radio-t"}, User: store.User{ID: "user1"}},
+	} {
+		_, err := eng.Create(c)
+		require.NoError(t, err)
+	}
+
+	refs, err := b.ImageComments([]string{"radio-t"})
+	require.NoError(t, err)
+	require.Len(t, refs, 3)
+	require.Len(t, refs["user1/pic1.png"], 2, "comment with the image twice counted once")
+	assert.ElementsMatch(t, []string{"id-11", "id-12"}, []string{refs["user1/pic1.png"][0].ID, refs["user1/pic1.png"][1].ID},
+		"pending comment included")
+	require.Len(t, refs["user1/pic2.png"], 1)
+	require.Len(t, refs["user1/pic3.png"], 1)
+
+	deleted, err := b.DeleteUserImages([]string{"radio-t"}, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user1/pic4.png"}, deleted, "only images not referenced by comments deleted")
+	require.Len(t, mockStore.DeleteCalls(), 1)
+	assert.Equal(t, "user1/pic4.png", mockStore.DeleteCalls()[0].ID)
+
+	changed, err := b.RemoveImage([]string{"radio-t"}, "user1/pic1.png")
+	require.NoError(t, err)
+	require.Len(t, changed, 2)
+	c, err := eng.Get(getReq(store.Locator{URL: "https://radio-t.com/p1", SiteID: "radio-t"}, "id-11"))
+	require.NoError(t, err)
+	assert.Equal(t, "<p>pic  and  again</p>", c.Text)
+	assert.Equal(t, "pic  and  again", c.Orig)
+	c, err = eng.Get(getReq(store.Locator{URL: "https://radio-t.com/p2", SiteID: "radio-t"}, "id-12"))
+	require.NoError(t, err)
+	assert.Equal(t, `<img src="https://example.com/api/v1/picture/user1/pic2.png"/>`, c.Text)
+	assert.Equal(t, "user1/pic1.png", mockStore.DeleteCalls()[1].ID)
+	require.Len(t, pub.events, 1, "pending comment update not published")
+	assert.Equal(t, admin.EvUpdate, pub.events[0].et)
+
+	refs, err = b.ImageComments([]string{"radio-t"})
+	require.NoError(t, err)
+	assert.NotContains(t, refs, "user1/pic1.png")
+}
+
 // DeleteUser removes all comments from user
 func TestService_DeleteUser(t *testing.T) {
 	// two comments for https://radio-t.com, no reply
@@ -1507,6 +2143,45 @@ func TestService_DeleteUser(t *testing.T) {
 	assert.Equal(t, "user2", res[0].User.ID)
 }
 
+func TestService_Subscriptions(t *testing.T) {
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticStore("secret 123", nil, nil, "user@email.com")}
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	_, err := b.Subscribe(subscription.Subscription{SiteID: "radio-t", URL: locator.URL, UserID: "user1", Email: "u1@example.com"})
+	assert.ErrorIs(t, err, ErrNoSubscriptions)
+	assert.ErrorIs(t, b.Unsubscribe(locator, "user1", ""), ErrNoSubscriptions)
+	_, err = b.UserSubscriptions("radio-t", "user1")
+	assert.ErrorIs(t, err, ErrNoSubscriptions)
+	subs, err := b.PostSubscriptions(locator)
+	assert.NoError(t, err, "no error for notifications if disabled")
+	assert.Empty(t, subs)
+
+	b.Subscriptions, err = subscription.NewStore(path.Join(t.TempDir(), "subscriptions.db"), bolt.Options{})
+	require.NoError(t, err)
+	defer b.Close()
+
+	_, err = b.Subscribe(subscription.Subscription{SiteID: "radio-t", URL: locator.URL, UserID: "user1", Email: "u1@example.com"})
+	require.NoError(t, err)
+	_, err = b.Subscribe(subscription.Subscription{SiteID: "radio-t", URL: locator.URL, UserID: "user2", Telegram: "tg2"})
+	require.NoError(t, err)
+	subs, err = b.PostSubscriptions(locator)
+	require.NoError(t, err)
+	assert.Len(t, subs, 2)
+
+	require.NoError(t, b.Unsubscribe(locator, "user2", subscription.ChannelTelegram))
+	subs, err = b.UserSubscriptions("radio-t", "user2")
+	require.NoError(t, err)
+	assert.Empty(t, subs)
+
+	// hard delete of the user removes subscriptions
+	require.NoError(t, b.DeleteUser("radio-t", "user1", store.HardDelete))
+	subs, err = b.PostSubscriptions(locator)
+	require.NoError(t, err)
+	assert.Empty(t, subs)
+}
+
 func TestService_List(t *testing.T) {
 	// two comments for https://radio-t.com, no reply
 	eng, teardown := prepStoreEngine(t)
@@ -1613,15 +2288,15 @@ func TestService_UserCount(t *testing.T) {
 	_, err := b.Create(comment)
 	assert.NoError(t, err)
 
-	c, err := b.UserCount("radio-t", "user1")
+	c, err := b.UserCount("radio-t", "user1", store.User{})
 	assert.NoError(t, err)
 	assert.Equal(t, 2, c)
 
-	c, err = b.UserCount("radio-t", "user2")
+	c, err = b.UserCount("radio-t", "user2", store.User{})
 	assert.NoError(t, err)
 	assert.Equal(t, 1, c)
 
-	_, err = b.UserCount("radio-t", "userBad")
+	_, err = b.UserCount("radio-t", "userBad", store.User{})
 	assert.EqualError(t, err, "no comments for user userBad in store for radio-t site")
 }
 
@@ -1835,11 +2510,12 @@ func TestService_alterComment(t *testing.T) {
 	r = svc.alterComment(store.Comment{ID: "123", User: store.User{IP: "127.0.0.1", ID: "devid"}},
 		store.User{Name: "dev", ID: "devid", Admin: true})
 	assert.Equal(t, store.Comment{ID: "123", User: store.User{IP: "127.0.0.1", ID: "devid"}}, r, "ip not cleaned")
-	assert.Equal(t, 4, len(engineMock.FlagCalls()))
+	assert.Equal(t, 5, len(engineMock.FlagCalls()))
 	assert.Equal(t, engine.FlagRequest{Flag: engine.Blocked, UserID: "devid"}, engineMock.FlagCalls()[0].Req)
 	assert.Equal(t, engine.FlagRequest{Flag: engine.Verified, UserID: "devid"}, engineMock.FlagCalls()[1].Req)
 	assert.Equal(t, engine.FlagRequest{Flag: engine.Blocked, UserID: "devid"}, engineMock.FlagCalls()[2].Req)
 	assert.Equal(t, engine.FlagRequest{Flag: engine.Verified, UserID: "devid"}, engineMock.FlagCalls()[3].Req)
+	assert.Equal(t, engine.FlagRequest{Flag: engine.Shadowed, UserID: "devid"}, engineMock.FlagCalls()[4].Req, "admin only")
 
 	first := true
 	engineMock = engine.InterfaceMock{
@@ -1913,8 +2589,8 @@ func TestService_alterCommentsFlagCaching(t *testing.T) {
 		}
 		res := svc.alterComments(comments, store.User{ID: "admin", Admin: true})
 
-		// u1: Blocked+Verified (2); blocked user: Blocked only, Verified skipped (1) = 3 total
-		assert.Equal(t, 3, len(engineMock.FlagCalls()), "two distinct users -> 3 flag lookups")
+		// u1: Blocked+Verified+Shadowed (3); blocked user: Blocked+Shadowed, Verified skipped (2) = 5 total
+		assert.Equal(t, 5, len(engineMock.FlagCalls()), "two distinct users -> 5 flag lookups")
 		assert.True(t, res[2].User.Blocked && res[3].User.Blocked, "blocked user marked blocked")
 		assert.False(t, res[0].User.Blocked, "u1 not blocked")
 	})
@@ -2034,6 +2710,20 @@ func prepStoreEngine(t *testing.T) (e engine.Interface, teardown func()) {
 	}
 }
 
+type testEventPublisher struct {
+	events []struct {
+		et      admin.EventType
+		comment store.Comment
+	}
+}
+
+func (p *testEventPublisher) Publish(et admin.EventType, comment store.Comment) {
+	p.events = append(p.events, struct {
+		et      admin.EventType
+		comment store.Comment
+	}{et: et, comment: comment})
+}
+
 func getReq(locator store.Locator, commentID string) engine.GetRequest {
 	return engine.GetRequest{
 		Locator:   locator,
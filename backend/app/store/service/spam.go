@@ -0,0 +1,201 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/microcosm-cc/bluemonday"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// SpamAction defines what to do with a new comment classified as spam
+type SpamAction string
+
+// enum of all spam actions
+const (
+	SpamReject SpamAction = "reject" // comment rejected
+	SpamQueue  SpamAction = "queue"  // comment stored as pending, awaiting admin approval
+	SpamTag    SpamAction = "tag"    // comment stored and marked as spam for admins
+)
+
+// ErrSpamDetected returned on creation of comment classified as spam with SpamReject action
+var ErrSpamDetected = errors.New("comment rejected as spam")
+
+const (
+	spamMinTrained   = 5  // minimal number of trained comments of each class required for classification
+	spamMaxTokenSize = 32 // longer words are ignored, most likely it's a garbage
+)
+
+var reSpamLink = regexp.MustCompile(`(?:href|src)="([^"]*)"`)
+
+// SpamClassifier is a naive-Bayes classifier of comments. It's trained by admin actions, i.e. deleted comments
+// are spam and approved or pinned are ham. Model kept per site and persisted to Path as siteID.json, if Path set.
+// Thread safe.
+type SpamClassifier struct {
+	path      string
+	threshold float64
+
+	lock   sync.Mutex
+	models map[string]*spamModel
+}
+
+// spamModel keeps number of trained comments and number of spam and ham comments with each token
+type spamModel struct {
+	Spam   int                  `json:"spam"`
+	Ham    int                  `json:"ham"`
+	Tokens map[string]spamCount `json:"tokens"`
+}
+
+type spamCount struct {
+	Spam int `json:"s,omitempty"`
+	Ham  int `json:"h,omitempty"`
+}
+
+// NewSpamClassifier makes classifier with models location and spam probability threshold, i.e. 0.9.
+// Models loaded from path on the first use of each site.
+func NewSpamClassifier(path string, threshold float64) *SpamClassifier {
+	log.Printf("[INFO] spam classifier, models path %q, threshold %.2f", path, threshold)
+	return &SpamClassifier{path: path, threshold: threshold, models: map[string]*spamModel{}}
+}
+
+// Classify returns spam probability of the comment and true if it reaches threshold.
+// Comments never classified as spam till site's model trained with enough spam and ham comments.
+func (c *SpamClassifier) Classify(comment store.Comment) (spam bool, prob float64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	m := c.model(comment.Locator.SiteID)
+	if m.Spam < spamMinTrained || m.Ham < spamMinTrained {
+		return false, 0
+	}
+
+	// log-likelihoods with Laplace smoothing, tokens never seen in training ignored
+	spamLL := math.Log(float64(m.Spam) / float64(m.Spam+m.Ham))
+	hamLL := math.Log(float64(m.Ham) / float64(m.Spam+m.Ham))
+	for _, t := range spamTokens(comment) {
+		cnt, ok := m.Tokens[t]
+		if !ok {
+			continue
+		}
+		spamLL += math.Log(float64(cnt.Spam+1) / float64(m.Spam+2))
+		hamLL += math.Log(float64(cnt.Ham+1) / float64(m.Ham+2))
+	}
+	prob = 1 / (1 + math.Exp(hamLL-spamLL))
+	return prob >= c.threshold, prob
+}
+
+// Train updates site's model with the comment as spam or ham and saves the model
+func (c *SpamClassifier) Train(comment store.Comment, spam bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	m := c.model(comment.Locator.SiteID)
+	if spam {
+		m.Spam++
+	} else {
+		m.Ham++
+	}
+	for _, t := range spamTokens(comment) {
+		cnt := m.Tokens[t]
+		if spam {
+			cnt.Spam++
+		} else {
+			cnt.Ham++
+		}
+		m.Tokens[t] = cnt
+	}
+	return c.save(comment.Locator.SiteID, m)
+}
+
+// model returns site's model, loads it on the first call. Should be called under lock
+func (c *SpamClassifier) model(siteID string) *spamModel {
+	if m, ok := c.models[siteID]; ok {
+		return m
+	}
+	m := &spamModel{Tokens: map[string]spamCount{}}
+	if c.path != "" {
+		data, err := os.ReadFile(c.modelFile(siteID))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			log.Printf("[WARN] can't read spam model for %s, %v", siteID, err)
+		default:
+			if err = json.Unmarshal(data, m); err != nil {
+				log.Printf("[WARN] can't unmarshal spam model for %s, %v", siteID, err)
+				m = &spamModel{}
+			}
+			if m.Tokens == nil {
+				m.Tokens = map[string]spamCount{}
+			}
+		}
+	}
+	c.models[siteID] = m
+	return m
+}
+
+// save writes model to a temp file and renames it, so the model never left partially written
+func (c *SpamClassifier) save(siteID string, m *spamModel) error {
+	if c.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.path, 0o700); err != nil {
+		return fmt.Errorf("can't make spam models location %s: %w", c.path, err)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("can't marshal spam model for %s: %w", siteID, err)
+	}
+	tmpFile := c.modelFile(siteID) + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0o600); err != nil {
+		return fmt.Errorf("can't write spam model for %s: %w", siteID, err)
+	}
+	if err = os.Rename(tmpFile, c.modelFile(siteID)); err != nil {
+		return fmt.Errorf("can't save spam model for %s: %w", siteID, err)
+	}
+	return nil
+}
+
+func (c *SpamClassifier) modelFile(siteID string) string {
+	return filepath.Join(c.path, filepath.Base(siteID)+".json")
+}
+
+// spamTokens returns unique lowercase words of comment's text and hosts of links, prefixed with "host:"
+func spamTokens(comment store.Comment) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	add := func(t string) {
+		if t == "" || seen[t] || utf8.RuneCountInString(t) > spamMaxTokenSize {
+			return
+		}
+		seen[t] = true
+		res = append(res, t)
+	}
+
+	for _, m := range reSpamLink.FindAllStringSubmatch(comment.Text, -1) {
+		if u, err := url.Parse(html.UnescapeString(m[1])); err == nil {
+			add("host:" + strings.TrimPrefix(strings.ToLower(u.Hostname()), "www."))
+		}
+	}
+
+	text := html.UnescapeString(bluemonday.StrictPolicy().Sanitize(comment.Text))
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		add(w)
+	}
+	return res
+}
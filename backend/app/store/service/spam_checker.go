@@ -0,0 +1,78 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-pkgz/jrpc"
+	log "github.com/go-pkgz/lgr"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+// SpamChecker defines interface for external spam check of new and edited comments
+type SpamChecker interface {
+	Check(comment store.Comment) (SpamCheckResult, error)
+}
+
+// SpamVerdict defines decision of SpamChecker about the comment
+type SpamVerdict string
+
+// enum of all spam verdicts
+const (
+	SpamVerdictAccept SpamVerdict = "accept" // comment stored as usual
+	SpamVerdictReject SpamVerdict = "reject" // comment rejected with the reason
+	SpamVerdictHold   SpamVerdict = "hold"   // comment stored as pending, awaiting admin approval
+)
+
+// SpamCheckResult returned by SpamChecker. Reason is optional and passed to the user on rejection
+type SpamCheckResult struct {
+	Verdict SpamVerdict `json:"verdict"`
+	Reason  string      `json:"reason,omitempty"`
+}
+
+// SpamRPC implements SpamChecker and delegates all Calls to remote http server
+type SpamRPC struct {
+	jrpc.Client
+}
+
+// Check sends comment to remote spam checker and returns its verdict
+func (r *SpamRPC) Check(comment store.Comment) (res SpamCheckResult, err error) {
+	resp, err := r.Call("spam.check", comment)
+	if err != nil {
+		return SpamCheckResult{}, err
+	}
+
+	err = json.Unmarshal(*resp.Result, &res)
+	return res, err
+}
+
+// checkSpam consults SpamChecker about the comment. Rejected comment returns ErrSpamDetected with the reason,
+// held one set pending. Comment accepted if checker failed, spam check is not a reason to lose the comment.
+func (s *DataStore) checkSpam(comment store.Comment) (store.Comment, error) {
+	if s.SpamChecker == nil {
+		return comment, nil
+	}
+
+	res, err := s.SpamChecker.Check(comment)
+	if err != nil {
+		log.Printf("[WARN] spam check failed for comment from %s on %s, %v", comment.User.ID, comment.Locator.URL, err)
+		return comment, nil
+	}
+
+	switch res.Verdict {
+	case SpamVerdictReject:
+		log.Printf("[INFO] comment from %s on %s rejected by spam checker, %q", comment.User.ID, comment.Locator.URL, res.Reason)
+		if res.Reason != "" {
+			return comment, fmt.Errorf("%w: %s", ErrSpamDetected, res.Reason)
+		}
+		return comment, ErrSpamDetected
+	case SpamVerdictHold:
+		log.Printf("[INFO] comment from %s on %s held by spam checker, %q", comment.User.ID, comment.Locator.URL, res.Reason)
+		comment.Pending, comment.Hidden = true, false // awaits approval now, dismissed reports don't make it visible
+	case SpamVerdictAccept:
+	default:
+		log.Printf("[WARN] unknown spam check verdict %q for comment from %s, accepted", res.Verdict, comment.User.ID)
+	}
+	return comment, nil
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-pkgz/jrpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/admin"
+)
+
+func TestSpamRPC_Check(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := struct {
+			Method string        `json:"method"`
+			Params store.Comment `json:"params"`
+		}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "spam.check", req.Method)
+		if req.Params.Text == "bad" {
+			_, _ = fmt.Fprint(w, `{"error":"failed","id":1}`)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"result":{"verdict":"reject","reason":"link to %s"},"id":1}`, req.Params.User.ID)
+	}))
+	defer ts.Close()
+
+	var c SpamChecker = &SpamRPC{Client: jrpc.Client{API: ts.URL, Client: http.Client{}}}
+	res, err := c.Check(store.Comment{Text: "buy it", User: store.User{ID: "user1"}})
+	require.NoError(t, err)
+	assert.Equal(t, SpamCheckResult{Verdict: SpamVerdictReject, Reason: "link to user1"}, res)
+
+	_, err = c.Check(store.Comment{Text: "bad"})
+	assert.EqualError(t, err, "failed")
+}
+
+func TestService_SpamChecker(t *testing.T) {
+	eng, teardown := prepStoreEngine(t)
+	defer teardown()
+	checker := &mockSpamChecker{res: SpamCheckResult{Verdict: SpamVerdictAccept}}
+	b := DataStore{Engine: eng, AdminStore: admin.NewStaticKeyStore("secret 123"), SpamChecker: checker}
+	defer b.Close()
+	locator := store.Locator{URL: "https://radio-t.com", SiteID: "radio-t"}
+
+	id, err := b.Create(store.Comment{Text: "accepted", Locator: locator, User: store.User{ID: "user1"}})
+	require.NoError(t, err)
+	c, err := b.Get(locator, id, store.User{})
+	require.NoError(t, err)
+	assert.False(t, c.Pending)
+	assert.Equal(t, 1, checker.calls)
+
+	checker.res = SpamCheckResult{Verdict: SpamVerdictHold, Reason: "suspicious"}
+	id, err = b.Create(store.Comment{Text: "held", Locator: locator, User: store.User{ID: "user1"}})
+	require.NoError(t, err)
+	c, err = b.Get(locator, id, store.User{Admin: true})
+	require.NoError(t, err)
+	assert.True(t, c.Pending, "held for moderation")
+
+	checker.res = SpamCheckResult{Verdict: SpamVerdictReject, Reason: "too many links"}
+	_, err = b.Create(store.Comment{Text: "rejected", Locator: locator, User: store.User{ID: "user1"}})
+	assert.ErrorIs(t, err, ErrSpamDetected)
+	assert.EqualError(t, err, "comment rejected as spam: too many links")
+
+	checker.res = SpamCheckResult{Verdict: SpamVerdictReject}
+	_, err = b.Create(store.Comment{Text: "rejected", Locator: locator, User: store.User{ID: "user1"}})
+	assert.EqualError(t, err, "comment rejected as spam")
+
+	calls := checker.calls
+	_, err = b.Create(store.Comment{Text: "admin", Locator: locator, User: store.User{ID: "admin", Admin: true}})
+	require.NoError(t, err, "admin comments never checked")
+	assert.Equal(t, calls, checker.calls)
+
+	checker.err = errors.New("checker is down")
+	_, err = b.Create(store.Comment{Text: "accepted on failure", Locator: locator, User: store.User{ID: "user1"}})
+	require.NoError(t, err, "comment accepted if checker failed")
+	checker.err = nil
+
+	// edit checked as well
+	_, err = b.EditComment(locator, "id-1", EditRequest{Text: "edited spam"})
+	assert.ErrorIs(t, err, ErrSpamDetected)
+	assert.Equal(t, "edited spam", checker.last.Text)
+	c, err = b.Get(locator, "id-1", store.User{})
+	require.NoError(t, err)
+	assert.NotEqual(t, "edited spam", c.Text, "rejected edit not saved")
+
+	checker.res = SpamCheckResult{Verdict: SpamVerdictHold}
+	c, err = b.EditComment(locator, "id-1", EditRequest{Text: "edited"})
+	require.NoError(t, err)
+	assert.True(t, c.Pending, "edited comment held for moderation")
+
+	checker.res = SpamCheckResult{Verdict: SpamVerdictReject}
+	_, err = b.EditComment(locator, "id-2", EditRequest{Text: "admin edit", Admin: true})
+	require.NoError(t, err, "admin edits never checked")
+
+	// comment hidden by reports and held on edit stays pending after reports dismissed
+	b.ReportThreshold = 1
+	checker.res = SpamCheckResult{Verdict: SpamVerdictAccept}
+	id, err = b.Create(store.Comment{Text: "reported", Locator: locator, User: store.User{ID: "user1"}})
+	require.NoError(t, err)
+	c, err = b.Report(ReportReq{Locator: locator, CommentID: id, UserID: "user2", Reason: store.ReportSpam})
+	require.NoError(t, err)
+	assert.True(t, c.Hidden)
+	checker.res = SpamCheckResult{Verdict: SpamVerdictHold}
+	_, err = b.EditComment(locator, id, EditRequest{Text: "reported and edited"})
+	require.NoError(t, err)
+	c, err = b.DismissReports(locator, id)
+	require.NoError(t, err)
+	assert.True(t, c.Pending, "still awaits approval")
+	assert.False(t, c.Hidden)
+}
+
+type mockSpamChecker struct {
+	res   SpamCheckResult
+	err   error
+	calls int
+	last  store.Comment
+}
+
+func (m *mockSpamChecker) Check(comment store.Comment) (SpamCheckResult, error) {
+	m.calls++
+	m.last = comment
+	return m.res, m.err
+}
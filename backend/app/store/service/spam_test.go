@@ -0,0 +1,70 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+)
+
+func TestSpamClassifier_Classify(t *testing.T) {
+	c := NewSpamClassifier("", 0.9)
+	spam := store.Comment{Locator: store.Locator{SiteID: "site1"},
+		Text: `<p>cheap pills, buy now at <a href="https://www.pills.example.com/buy">our store</a></p>`}
+	ham := store.Comment{Locator: store.Locator{SiteID: "site1"}, Text: "<p>thanks for the episode, great discussion about go</p>"}
+
+	for i := range spamMinTrained - 1 {
+		require.NoError(t, c.Train(spam, true))
+		require.NoError(t, c.Train(ham, false), i)
+	}
+	isSpam, prob := c.Classify(spam)
+	assert.False(t, isSpam, "not enough trained comments")
+	assert.Equal(t, 0.0, prob)
+
+	require.NoError(t, c.Train(spam, true))
+	require.NoError(t, c.Train(ham, false))
+
+	isSpam, prob = c.Classify(store.Comment{Locator: store.Locator{SiteID: "site1"},
+		Text: `<p>buy pills <a href="https://pills.example.com/new">here</a></p>`})
+	assert.True(t, isSpam)
+	assert.Greater(t, prob, 0.9)
+
+	isSpam, prob = c.Classify(store.Comment{Locator: store.Locator{SiteID: "site1"}, Text: "<p>great episode about go</p>"})
+	assert.False(t, isSpam)
+	assert.Less(t, prob, 0.1)
+
+	isSpam, _ = c.Classify(store.Comment{Locator: store.Locator{SiteID: "site2"}, Text: spam.Text})
+	assert.False(t, isSpam, "model is per site")
+}
+
+func TestSpamClassifier_Persistence(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spam")
+	c := NewSpamClassifier(dir, 0.9)
+	for i := range spamMinTrained {
+		require.NoError(t, c.Train(store.Comment{Locator: store.Locator{SiteID: "site1"}, Text: fmt.Sprintf("spam text %d", i)}, true))
+		require.NoError(t, c.Train(store.Comment{Locator: store.Locator{SiteID: "site1"}, Text: fmt.Sprintf("ham words %d", i)}, false))
+	}
+	assert.FileExists(t, filepath.Join(dir, "site1.json"))
+	assert.NoFileExists(t, filepath.Join(dir, "site1.json.tmp"))
+
+	loaded := NewSpamClassifier(dir, 0.9)
+	isSpam, prob := loaded.Classify(store.Comment{Locator: store.Locator{SiteID: "site1"}, Text: "spam text"})
+	assert.True(t, isSpam, "model loaded from file")
+	assert.Greater(t, prob, 0.9)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "site2.json"), []byte("bad json"), 0o600))
+	isSpam, _ = loaded.Classify(store.Comment{Locator: store.Locator{SiteID: "site2"}, Text: "spam text"})
+	assert.False(t, isSpam, "broken model ignored")
+	require.NoError(t, loaded.Train(store.Comment{Locator: store.Locator{SiteID: "site2"}, Text: "spam text"}, true))
+}
+
+func TestSpamClassifier_Tokens(t *testing.T) {
+	tokens := spamTokens(store.Comment{Text: `<p>Buy NOW, buy <a href="https://www.Example.com/x?a=1&amp;b=2">link</a> ` +
+		`<img src="http://img.example.org/pic.png"/> Привет aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa</p>`})
+	assert.Equal(t, []string{"host:example.com", "host:img.example.org", "buy", "now", "link", "привет"}, tokens)
+}
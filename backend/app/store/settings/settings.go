@@ -0,0 +1,194 @@
+// Package settings defines and implements store for per-site settings, like comment size limits or edit duration.
+// Sites without own settings use the defaults, i.e. set by cli options.
+package settings
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// Settings defines site's policies
+type Settings struct {
+	MaxCommentSize  int      `json:"max_comment_size"`
+	MinCommentSize  int      `json:"min_comment_size"`
+	EditDuration    Duration `json:"edit_duration"`
+	LowScore        int      `json:"low_score"`
+	CriticalScore   int      `json:"critical_score"`
+	PositiveScore   bool     `json:"positive_score"`
+	ReadOnlyAge     int      `json:"readonly_age"`
+	RestrictedWords []string `json:"restricted_words"`
+	AnonVote        bool     `json:"anon_vote"`
+	SubscribersOnly bool     `json:"subscribers_only"`
+	MaxVotes        int      `json:"max_votes"`
+}
+
+// Duration is a time.Duration marshaled to json as a string, i.e. "5m"
+type Duration time.Duration
+
+// MarshalJSON returns duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses duration from a string, like "5m" or "1h30m"
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string: %w", err)
+	}
+	dd, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(dd)
+	return nil
+}
+
+func (s Settings) validate() error {
+	switch {
+	case s.MinCommentSize < 0 || s.MaxCommentSize < 0:
+		return errors.New("comment size can't be negative")
+	case s.MaxCommentSize > 0 && s.MinCommentSize > s.MaxCommentSize:
+		return fmt.Errorf("min comment size %d is bigger than max %d", s.MinCommentSize, s.MaxCommentSize)
+	case s.EditDuration < 0:
+		return errors.New("edit duration can't be negative")
+	case s.ReadOnlyAge < 0:
+		return errors.New("read-only age can't be negative")
+	}
+	return nil
+}
+
+// Store keeps per-site overrides of the default settings and persists them to a json file, if path set.
+// Override is a json object with the changed fields only, all other fields taken from defaults. Thread safe.
+type Store struct {
+	path     string
+	defaults Settings
+
+	lock      sync.RWMutex
+	overrides map[string]json.RawMessage // as set, in order to keep following defaults for missing fields
+	sites     map[string]Settings        // overrides applied to defaults
+}
+
+// NewStore makes Store with defaults and loads overrides from path, if the file exists
+func NewStore(path string, defaults Settings) (*Store, error) {
+	res := &Store{path: path, defaults: defaults, overrides: map[string]json.RawMessage{}, sites: map[string]Settings{}}
+	if path == "" {
+		return res, nil
+	}
+
+	data, err := os.ReadFile(path) //nolint:gosec // path comes from operator CLI flag
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read site settings %s: %w", path, err)
+	}
+
+	overrides := map[string]json.RawMessage{}
+	if err = json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("can't unmarshal site settings %s: %w", path, err)
+	}
+	for siteID, override := range overrides {
+		st, e := res.apply(override)
+		if e != nil {
+			return nil, fmt.Errorf("bad settings for site %s: %w", siteID, e)
+		}
+		res.overrides[siteID], res.sites[siteID] = override, st
+	}
+	log.Printf("[INFO] loaded settings for %d site(s) from %s", len(overrides), path)
+	return res, nil
+}
+
+// Get returns settings of the site, defaults if site doesn't have own settings
+func (s *Store) Get(siteID string) Settings {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if st, ok := s.sites[siteID]; ok {
+		return st
+	}
+	return s.defaults
+}
+
+// Override returns site's override as it was set, nil if site uses defaults
+func (s *Store) Override(siteID string) json.RawMessage {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.overrides[siteID]
+}
+
+// Set replaces site's override and saves all overrides. Returns resulting settings of the site
+func (s *Store) Set(siteID string, override json.RawMessage) (Settings, error) {
+	compacted := bytes.Buffer{}
+	if err := json.Compact(&compacted, override); err != nil {
+		return Settings{}, fmt.Errorf("bad settings for site %s: %w", siteID, err)
+	}
+	st, err := s.apply(compacted.Bytes())
+	if err != nil {
+		return Settings{}, fmt.Errorf("bad settings for site %s: %w", siteID, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.overrides[siteID], s.sites[siteID] = compacted.Bytes(), st
+	return st, s.save()
+}
+
+// Delete removes site's override, site uses defaults after that
+func (s *Store) Delete(siteID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.overrides, siteID)
+	delete(s.sites, siteID)
+	return s.save()
+}
+
+// List returns restricted words of the site, implements service.RestrictedWordsLister
+func (s *Store) List(siteID string) (restricted []string, err error) {
+	return s.Get(siteID).RestrictedWords, nil
+}
+
+// apply returns defaults with override applied. Override rejected if it has unknown fields or bad values
+func (s *Store) apply(override json.RawMessage) (Settings, error) {
+	res := s.defaults
+	res.RestrictedWords = slices.Clone(s.defaults.RestrictedWords) // unmarshal reuses backing array of the slice
+	dec := json.NewDecoder(bytes.NewReader(override))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&res); err != nil {
+		return Settings{}, err
+	}
+	if err := res.validate(); err != nil {
+		return Settings{}, err
+	}
+	return res, nil
+}
+
+// save writes all overrides to a temp file and renames it, should be called under lock
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.overrides, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't marshal site settings: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("can't make site settings location: %w", err)
+	}
+	tmpFile := s.path + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0o600); err != nil {
+		return fmt.Errorf("can't write site settings %s: %w", tmpFile, err)
+	}
+	if err = os.Rename(tmpFile, s.path); err != nil {
+		return fmt.Errorf("can't save site settings %s: %w", s.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package settings
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var defaults = Settings{MaxCommentSize: 2048, EditDuration: Duration(5 * time.Minute), LowScore: -5, CriticalScore: -10,
+	RestrictedWords: []string{"bad"}, MaxVotes: -1}
+
+func TestStore_GetSet(t *testing.T) {
+	s, err := NewStore("", defaults)
+	require.NoError(t, err)
+	assert.Equal(t, defaults, s.Get("site1"))
+	assert.Nil(t, s.Override("site1"))
+
+	st, err := s.Set("site1", json.RawMessage(`{"max_comment_size": 500, "edit_duration": "1h", "restricted_words": ["xxx", "yyy"]}`))
+	require.NoError(t, err)
+	exp := defaults
+	exp.MaxCommentSize, exp.EditDuration, exp.RestrictedWords = 500, Duration(time.Hour), []string{"xxx", "yyy"}
+	assert.Equal(t, exp, st)
+	assert.Equal(t, exp, s.Get("site1"))
+	assert.JSONEq(t, `{"max_comment_size": 500, "edit_duration": "1h", "restricted_words": ["xxx", "yyy"]}`, string(s.Override("site1")))
+	assert.Equal(t, []string{"bad"}, defaults.RestrictedWords, "defaults not changed")
+	assert.Equal(t, defaults, s.Get("site2"))
+
+	words, err := s.List("site1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"xxx", "yyy"}, words)
+	words, err = s.List("site2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bad"}, words)
+
+	require.NoError(t, s.Delete("site1"))
+	assert.Equal(t, defaults, s.Get("site1"))
+}
+
+func TestStore_SetBad(t *testing.T) {
+	s, err := NewStore("", defaults)
+	require.NoError(t, err)
+
+	tbl := []struct {
+		override string
+		err      string
+	}{
+		{`{"max_comment_size": 500`, "bad settings for site site1: unexpected end of JSON input"},
+		{`{"unknown": 1}`, `bad settings for site site1: json: unknown field "unknown"`},
+		{`{"edit_duration": "blah"}`, `bad settings for site site1: time: invalid duration "blah"`},
+		{`{"edit_duration": 10}`, "bad settings for site site1: duration should be a string: json: cannot unmarshal number into Go value of type string"},
+		{`{"edit_duration": "-1m"}`, "bad settings for site site1: edit duration can't be negative"},
+		{`{"min_comment_size": 5000}`, "bad settings for site site1: min comment size 5000 is bigger than max 2048"},
+		{`{"max_comment_size": -1}`, "bad settings for site site1: comment size can't be negative"},
+		{`{"readonly_age": -1}`, "bad settings for site site1: read-only age can't be negative"},
+	}
+	for _, tt := range tbl {
+		t.Run(tt.override, func(t *testing.T) {
+			_, err := s.Set("site1", json.RawMessage(tt.override))
+			assert.EqualError(t, err, tt.err)
+			assert.Equal(t, defaults, s.Get("site1"), "settings not changed")
+		})
+	}
+}
+
+func TestStore_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "var", "sites.json")
+	s, err := NewStore(file, defaults)
+	require.NoError(t, err)
+	_, err = s.Set("site1", json.RawMessage(`{"max_comment_size": 500}`))
+	require.NoError(t, err)
+	_, err = s.Set("site2", json.RawMessage(`{"anon_vote": true}`))
+	require.NoError(t, err)
+	assert.NoFileExists(t, file+".tmp")
+
+	// changed defaults applied to loaded overrides
+	newDefaults := defaults
+	newDefaults.LowScore = -3
+	s, err = NewStore(file, newDefaults)
+	require.NoError(t, err)
+	assert.Equal(t, 500, s.Get("site1").MaxCommentSize)
+	assert.Equal(t, -3, s.Get("site1").LowScore)
+	assert.True(t, s.Get("site2").AnonVote)
+
+	require.NoError(t, s.Delete("site1"))
+	s, err = NewStore(file, defaults)
+	require.NoError(t, err)
+	assert.Equal(t, defaults, s.Get("site1"))
+	assert.True(t, s.Get("site2").AnonVote)
+
+	require.NoError(t, os.WriteFile(file, []byte(`{"site1": {"max_comment_size": -1}}`), 0o600))
+	_, err = NewStore(file, defaults)
+	assert.EqualError(t, err, "bad settings for site site1: comment size can't be negative")
+
+	require.NoError(t, os.WriteFile(file, []byte(`bad json`), 0o600))
+	_, err = NewStore(file, defaults)
+	assert.ErrorContains(t, err, "can't unmarshal site settings")
+}
+
+func TestDuration_JSON(t *testing.T) {
+	data, err := json.Marshal(Settings{EditDuration: Duration(90 * time.Second)})
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"edit_duration":"1m30s"`)
+
+	st := Settings{}
+	require.NoError(t, json.Unmarshal(data, &st))
+	assert.Equal(t, Duration(90*time.Second), st.EditDuration)
+}
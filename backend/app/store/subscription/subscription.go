@@ -0,0 +1,194 @@
+// Package subscription implements store of users subscriptions to all new comments of the post,
+// delivered by email or telegram.
+package subscription
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Channel is a way to deliver notifications of subscription
+type Channel string
+
+// enum of all channels
+const (
+	ChannelEmail    Channel = "email"
+	ChannelTelegram Channel = "telegram"
+)
+
+// Subscription of the user to all new comments of the post, by email, telegram or both
+type Subscription struct {
+	SiteID   string    `json:"site"`
+	URL      string    `json:"url"`
+	UserID   string    `json:"user_id"`
+	Email    string    `json:"email,omitempty"`
+	Telegram string    `json:"telegram,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// ErrNotSubscribed returned by Unsubscribe if there is no such subscription
+var ErrNotSubscribed = errors.New("not subscribed")
+
+// Store keeps subscriptions in bolt file. Thread safe.
+// Uses single "subscriptions" bucket, key is site, post url and user id separated by newline,
+// so subscriptions of the post are next to each other.
+type Store struct {
+	db *bolt.DB
+}
+
+const bucketName = "subscriptions"
+
+// NewStore makes subscriptions store in bolt file
+func NewStore(fileName string, options bolt.Options) (*Store, error) {
+	db, err := bolt.Open(fileName, 0o600, &options) //nolint:gocritic //octalLiteral is OK as FileMode
+	if err != nil {
+		return nil, fmt.Errorf("failed to make boltdb for %s: %w", fileName, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, e := tx.CreateBucketIfNotExists([]byte(bucketName)); e != nil {
+			return fmt.Errorf("failed to create top level bucket %s: %w", bucketName, e)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize boltdb db %q buckets: %w", fileName, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Subscribe adds subscription of the user to the post, or adds channel to the existing one.
+// Returns the resulting subscription.
+func (s *Store) Subscribe(sub Subscription) (res Subscription, err error) {
+	if sub.SiteID == "" || sub.URL == "" || sub.UserID == "" {
+		return Subscription{}, errors.New("site, url and user id are required")
+	}
+	if sub.Email == "" && sub.Telegram == "" {
+		return Subscription{}, errors.New("email or telegram is required")
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucketName))
+		k := key(sub.SiteID, sub.URL, sub.UserID)
+		res = Subscription{SiteID: sub.SiteID, URL: sub.URL, UserID: sub.UserID, Created: time.Now()}
+		if v := bkt.Get(k); v != nil {
+			if e := json.Unmarshal(v, &res); e != nil {
+				return fmt.Errorf("can't unmarshal subscription %s: %w", string(k), e)
+			}
+		}
+		if sub.Email != "" {
+			res.Email = sub.Email
+		}
+		if sub.Telegram != "" {
+			res.Telegram = sub.Telegram
+		}
+		return put(bkt, res)
+	})
+	return res, err
+}
+
+// Unsubscribe removes channel from subscription of the user to the post, all channels for empty one.
+// Subscription without channels left is removed. Returns ErrNotSubscribed if there is nothing to remove.
+func (s *Store) Unsubscribe(siteID, url, userID string, ch Channel) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucketName))
+		k := key(siteID, url, userID)
+		v := bkt.Get(k)
+		if v == nil {
+			return ErrNotSubscribed
+		}
+		var sub Subscription
+		if err := json.Unmarshal(v, &sub); err != nil {
+			return fmt.Errorf("can't unmarshal subscription %s: %w", string(k), err)
+		}
+		switch {
+		case ch == ChannelEmail && sub.Email != "":
+			sub.Email = ""
+		case ch == ChannelTelegram && sub.Telegram != "":
+			sub.Telegram = ""
+		case ch == "":
+			sub.Email, sub.Telegram = "", ""
+		default:
+			return ErrNotSubscribed
+		}
+		if sub.Email == "" && sub.Telegram == "" {
+			return bkt.Delete(k)
+		}
+		return put(bkt, sub)
+	})
+}
+
+// Find returns all subscriptions to the post
+func (s *Store) Find(siteID, url string) (res []Subscription, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return forEach(tx.Bucket([]byte(bucketName)), siteID+"\n"+url+"\n", func(sub Subscription) {
+			res = append(res, sub)
+		})
+	})
+	return res, err
+}
+
+// List returns all subscriptions of the user on the site
+func (s *Store) List(siteID, userID string) (res []Subscription, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return forEach(tx.Bucket([]byte(bucketName)), siteID+"\n", func(sub Subscription) {
+			if sub.UserID == userID {
+				res = append(res, sub)
+			}
+		})
+	})
+	return res, err
+}
+
+// DeleteUser removes all subscriptions of the user on the site
+func (s *Store) DeleteUser(siteID, userID string) error {
+	subs, err := s.List(siteID, userID)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, sub := range subs {
+			if e := tx.Bucket([]byte(bucketName)).Delete(key(sub.SiteID, sub.URL, sub.UserID)); e != nil {
+				return fmt.Errorf("can't delete subscription to %s: %w", sub.URL, e)
+			}
+		}
+		return nil
+	})
+}
+
+// Close bolt file
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func key(siteID, url, userID string) []byte {
+	return []byte(siteID + "\n" + url + "\n" + userID)
+}
+
+func put(bkt *bolt.Bucket, sub Subscription) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return fmt.Errorf("can't marshal subscription to %s: %w", sub.URL, err)
+	}
+	if err = bkt.Put(key(sub.SiteID, sub.URL, sub.UserID), data); err != nil {
+		return fmt.Errorf("can't put subscription to %s: %w", sub.URL, err)
+	}
+	return nil
+}
+
+// forEach calls fn for each subscription with key starting with prefix
+func forEach(bkt *bolt.Bucket, prefix string, fn func(sub Subscription)) error {
+	c := bkt.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+		var sub Subscription
+		if err := json.Unmarshal(v, &sub); err != nil {
+			return fmt.Errorf("can't unmarshal subscription %s: %w", string(k), err)
+		}
+		fn(sub)
+	}
+	return nil
+}
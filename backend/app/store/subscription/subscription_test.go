@@ -0,0 +1,96 @@
+package subscription
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore_SubscribeUnsubscribe(t *testing.T) {
+	s := prepStore(t)
+
+	res, err := s.Subscribe(Subscription{SiteID: "site1", URL: "https://example.com/post1", UserID: "u1", Email: "u1@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, "u1@example.com", res.Email)
+	assert.False(t, res.Created.IsZero())
+	res, err = s.Subscribe(Subscription{SiteID: "site1", URL: "https://example.com/post1", UserID: "u1", Telegram: "tg1"})
+	require.NoError(t, err)
+	assert.Equal(t, "u1@example.com", res.Email, "email kept")
+	assert.Equal(t, "tg1", res.Telegram)
+	_, err = s.Subscribe(Subscription{SiteID: "site1", URL: "https://example.com/post1", UserID: "u2", Email: "u2@example.com"})
+	require.NoError(t, err)
+	_, err = s.Subscribe(Subscription{SiteID: "site1", URL: "https://example.com/post10", UserID: "u1", Email: "u1@example.com"})
+	require.NoError(t, err)
+	_, err = s.Subscribe(Subscription{SiteID: "site2", URL: "https://example.com/post1", UserID: "u1", Email: "u1@example.com"})
+	require.NoError(t, err)
+
+	_, err = s.Subscribe(Subscription{SiteID: "site1", URL: "https://example.com/post1", UserID: "u1"})
+	assert.EqualError(t, err, "email or telegram is required")
+	_, err = s.Subscribe(Subscription{SiteID: "site1", UserID: "u1", Email: "u1@example.com"})
+	assert.EqualError(t, err, "site, url and user id are required")
+
+	subs, err := s.Find("site1", "https://example.com/post1")
+	require.NoError(t, err)
+	require.Len(t, subs, 2, "post10 and other site not included")
+	assert.Equal(t, "u1", subs[0].UserID)
+	assert.Equal(t, "u2", subs[1].UserID)
+
+	subs, err = s.List("site1", "u1")
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	assert.Equal(t, "https://example.com/post1", subs[0].URL)
+	assert.Equal(t, "https://example.com/post10", subs[1].URL)
+
+	require.NoError(t, s.Unsubscribe("site1", "https://example.com/post1", "u1", ChannelEmail))
+	assert.ErrorIs(t, s.Unsubscribe("site1", "https://example.com/post1", "u1", ChannelEmail), ErrNotSubscribed)
+	subs, err = s.Find("site1", "https://example.com/post1")
+	require.NoError(t, err)
+	require.Len(t, subs, 2, "telegram subscription left")
+	assert.Equal(t, Subscription{SiteID: "site1", URL: "https://example.com/post1", UserID: "u1", Telegram: "tg1",
+		Created: subs[0].Created}, subs[0])
+
+	require.NoError(t, s.Unsubscribe("site1", "https://example.com/post1", "u1", ChannelTelegram))
+	subs, err = s.Find("site1", "https://example.com/post1")
+	require.NoError(t, err)
+	require.Len(t, subs, 1, "subscription without channels removed")
+	assert.ErrorIs(t, s.Unsubscribe("site1", "https://example.com/post1", "u1", ""), ErrNotSubscribed)
+	require.NoError(t, s.Unsubscribe("site1", "https://example.com/post1", "u2", ""))
+
+	require.NoError(t, s.DeleteUser("site1", "u1"))
+	subs, err = s.List("site1", "u1")
+	require.NoError(t, err)
+	assert.Empty(t, subs)
+	subs, err = s.List("site2", "u1")
+	require.NoError(t, err)
+	assert.Len(t, subs, 1, "other site kept")
+}
+
+func TestStore_Persistence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "subscriptions.db")
+	s, err := NewStore(file, bolt.Options{})
+	require.NoError(t, err)
+	_, err = s.Subscribe(Subscription{SiteID: "site1", URL: "https://example.com/post1", UserID: "u1", Email: "u1@example.com"})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = NewStore(file, bolt.Options{})
+	require.NoError(t, err)
+	defer s.Close()
+	subs, err := s.Find("site1", "https://example.com/post1")
+	require.NoError(t, err)
+	require.Len(t, subs, 1)
+	assert.Equal(t, "u1@example.com", subs[0].Email)
+
+	_, err = NewStore(filepath.Join(t.TempDir(), "no-such-dir", "subscriptions.db"), bolt.Options{})
+	assert.Error(t, err)
+}
+
+func prepStore(t *testing.T) *Store {
+	s, err := NewStore(filepath.Join(t.TempDir(), "subscriptions.db"), bolt.Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
@@ -21,6 +21,7 @@ type User struct {
 	IP                string `json:"ip,omitempty"`
 	Admin             bool   `json:"admin"`
 	Blocked           bool   `json:"block,omitempty"`
+	Shadowed          bool   `json:"shadowed,omitempty"` // shadow-banned, set for admins only
 	Verified          bool   `json:"verified,omitempty"`
 	EmailSubscription bool   `json:"email_subscription,omitempty"`
 	SiteID            string `json:"site_id,omitempty"`
@@ -0,0 +1,167 @@
+// Package stream delivers live comment events to connected clients, i.e. server-sent events subscribers.
+// Events published on one instance are delivered to subscribers of all instances sharing the same event bus.
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-pkgz/lcw/v2/eventbus"
+	log "github.com/go-pkgz/lgr"
+	"github.com/rs/xid"
+
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/admin"
+)
+
+// Event is a single comment change delivered to subscribers
+type Event struct {
+	Type    string        `json:"type"` // create, update, delete or vote
+	Comment store.Comment `json:"comment"`
+}
+
+// Hub keeps subscribers and delivers published events to the ones matching event's locator
+type Hub struct {
+	id             string
+	bus            eventbus.PubSub
+	maxSubscribers int
+
+	lock   sync.Mutex
+	subs   map[*subscriber]struct{}
+	closed bool
+}
+
+type subscriber struct {
+	locator store.Locator
+	ch      chan Event
+}
+
+// ErrTooManySubscribers returned by Subscribe if hub reached max number of subscribers
+var ErrTooManySubscribers = errors.New("too many stream subscribers")
+
+const subscriberBufferSize = 16
+
+// NewHub makes Hub and subscribes it to the event bus. With nil bus events delivered to local subscribers only.
+// maxSubscribers limits number of concurrent subscribers, 0 means unlimited.
+func NewHub(bus eventbus.PubSub, maxSubscribers int) (*Hub, error) {
+	if bus == nil {
+		bus = &eventbus.NopPubSub{}
+	}
+	res := &Hub{id: xid.New().String(), bus: bus, maxSubscribers: maxSubscribers, subs: map[*subscriber]struct{}{}}
+	if err := bus.Subscribe(res.onBusMessage); err != nil {
+		return nil, fmt.Errorf("can't subscribe to stream event bus: %w", err)
+	}
+	log.Printf("[INFO] create stream hub %s, max subscribers=%d", res.id, maxSubscribers)
+	return res, nil
+}
+
+// Publish sends comment event to local subscribers and to other instances via event bus
+func (h *Hub) Publish(et admin.EventType, comment store.Comment) {
+	ev := Event{Type: et.String(), Comment: comment}
+	h.deliver(ev)
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("[WARN] can't marshal stream event for %s, %v", comment.ID, err)
+		return
+	}
+	if err := h.bus.Publish(h.id, string(data)); err != nil {
+		log.Printf("[WARN] can't publish stream event for %s, %v", comment.ID, err)
+	}
+}
+
+// Subscribe returns channel with events for given locator. Empty locator.URL means all posts of the site.
+// Subscription removed and channel closed on ctx cancellation or hub close.
+func (h *Hub) Subscribe(ctx context.Context, locator store.Locator) (<-chan Event, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return nil, errors.New("stream hub closed")
+	}
+	if h.maxSubscribers > 0 && len(h.subs) >= h.maxSubscribers {
+		return nil, ErrTooManySubscribers
+	}
+
+	sub := &subscriber{locator: locator, ch: make(chan Event, subscriberBufferSize)}
+	h.subs[sub] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		h.unsubscribe(sub)
+	}()
+	return sub.ch, nil
+}
+
+// Subscribers returns number of active subscribers
+func (h *Hub) Subscribers() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.subs)
+}
+
+// Close removes all subscribers and closes event bus if it supports closing
+func (h *Hub) Close() error {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return nil
+	}
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+	h.lock.Unlock()
+
+	if closer, ok := h.bus.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (h *Hub) unsubscribe(sub *subscriber) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.subs[sub]; !ok {
+		return // already removed by Close
+	}
+	delete(h.subs, sub)
+	close(sub.ch)
+}
+
+// deliver sends event to all matching subscribers. Never blocks, event dropped for subscribers not keeping up
+func (h *Hub) deliver(ev Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sub := range h.subs {
+		if sub.locator.SiteID != ev.Comment.Locator.SiteID {
+			continue
+		}
+		if sub.locator.URL != "" && sub.locator.URL != ev.Comment.Locator.URL {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			log.Printf("[DEBUG] stream subscriber for %+v is too slow, event %s for %s dropped",
+				sub.locator, ev.Type, ev.Comment.ID)
+		}
+	}
+}
+
+// onBusMessage delivers events published by other instances
+func (h *Hub) onBusMessage(fromID, msg string) {
+	if fromID == h.id {
+		return // own event, already delivered
+	}
+	ev := Event{}
+	if err := json.Unmarshal([]byte(msg), &ev); err != nil {
+		log.Printf("[WARN] can't unmarshal stream event from %s, %v", fromID, err)
+		return
+	}
+	h.deliver(ev)
+}
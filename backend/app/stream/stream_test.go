@@ -0,0 +1,174 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/umputun/remark42/backend/app/store"
+	"github.com/umputun/remark42/backend/app/store/admin"
+)
+
+func TestHub_PublishSubscribe(t *testing.T) {
+	hub, err := NewHub(nil, 0)
+	require.NoError(t, err)
+	defer hub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	postCh, err := hub.Subscribe(ctx, store.Locator{SiteID: "site1", URL: "https://example.com/post1"})
+	require.NoError(t, err)
+	siteCh, err := hub.Subscribe(ctx, store.Locator{SiteID: "site1"})
+	require.NoError(t, err)
+	otherCh, err := hub.Subscribe(ctx, store.Locator{SiteID: "site2"})
+	require.NoError(t, err)
+	assert.Equal(t, 3, hub.Subscribers())
+
+	hub.Publish(admin.EvCreate, store.Comment{ID: "c1", Text: "text 1",
+		Locator: store.Locator{SiteID: "site1", URL: "https://example.com/post1"}})
+	hub.Publish(admin.EvVote, store.Comment{ID: "c2", Text: "text 2",
+		Locator: store.Locator{SiteID: "site1", URL: "https://example.com/post2"}})
+
+	ev := <-postCh
+	assert.Equal(t, "create", ev.Type)
+	assert.Equal(t, "c1", ev.Comment.ID)
+	assert.Empty(t, postCh, "other post's event not delivered")
+
+	ev = <-siteCh
+	assert.Equal(t, "c1", ev.Comment.ID)
+	ev = <-siteCh
+	assert.Equal(t, "vote", ev.Type)
+	assert.Equal(t, "c2", ev.Comment.ID)
+
+	assert.Empty(t, otherCh, "other site's events not delivered")
+}
+
+func TestHub_Unsubscribe(t *testing.T) {
+	hub, err := NewHub(nil, 2)
+	require.NoError(t, err)
+	defer hub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := hub.Subscribe(ctx, store.Locator{SiteID: "site1"})
+	require.NoError(t, err)
+	_, err = hub.Subscribe(context.Background(), store.Locator{SiteID: "site1"})
+	require.NoError(t, err)
+
+	_, err = hub.Subscribe(context.Background(), store.Locator{SiteID: "site1"})
+	assert.ErrorIs(t, err, ErrTooManySubscribers)
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok, "channel closed on context cancellation")
+	assert.Equal(t, 1, hub.Subscribers())
+
+	_, err = hub.Subscribe(context.Background(), store.Locator{SiteID: "site1"})
+	assert.NoError(t, err, "slot released")
+}
+
+func TestHub_SlowSubscriber(t *testing.T) {
+	hub, err := NewHub(nil, 0)
+	require.NoError(t, err)
+	defer hub.Close()
+
+	ch, err := hub.Subscribe(context.Background(), store.Locator{SiteID: "site1"})
+	require.NoError(t, err)
+
+	for range subscriberBufferSize * 2 {
+		hub.Publish(admin.EvUpdate, store.Comment{ID: "c1", Locator: store.Locator{SiteID: "site1"}})
+	}
+	assert.Len(t, ch, subscriberBufferSize, "publish doesn't block, extra events dropped")
+}
+
+func TestHub_Close(t *testing.T) {
+	bus := &memBus{}
+	hub, err := NewHub(bus, 0)
+	require.NoError(t, err)
+
+	ch, err := hub.Subscribe(context.Background(), store.Locator{SiteID: "site1"})
+	require.NoError(t, err)
+
+	require.NoError(t, hub.Close())
+	_, ok := <-ch
+	assert.False(t, ok, "channel closed on hub close")
+	assert.Equal(t, 0, hub.Subscribers())
+	assert.True(t, bus.closed)
+	assert.NoError(t, hub.Close(), "second close is noop")
+
+	_, err = hub.Subscribe(context.Background(), store.Locator{SiteID: "site1"})
+	assert.Error(t, err)
+}
+
+func TestHub_EventBus(t *testing.T) {
+	bus := &memBus{}
+	hub1, err := NewHub(bus, 0)
+	require.NoError(t, err)
+	hub2, err := NewHub(bus, 0)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch1, err := hub1.Subscribe(ctx, store.Locator{SiteID: "site1"})
+	require.NoError(t, err)
+	ch2, err := hub2.Subscribe(ctx, store.Locator{SiteID: "site1", URL: "https://example.com/post1"})
+	require.NoError(t, err)
+
+	hub1.Publish(admin.EvDelete, store.Comment{ID: "c1", Deleted: true, User: store.User{Name: "user1"},
+		Locator: store.Locator{SiteID: "site1", URL: "https://example.com/post1"}})
+
+	select {
+	case ev := <-ch2:
+		assert.Equal(t, "delete", ev.Type)
+		assert.Equal(t, "c1", ev.Comment.ID)
+		assert.True(t, ev.Comment.Deleted)
+		assert.Equal(t, "user1", ev.Comment.User.Name)
+	case <-time.After(time.Second):
+		t.Fatal("event not delivered to other instance")
+	}
+
+	ev := <-ch1
+	assert.Equal(t, "c1", ev.Comment.ID)
+	assert.Empty(t, ch1, "own event from the bus ignored")
+
+	bus.publishRaw("other", "bad json") // not a valid event, ignored
+	assert.Empty(t, ch1)
+	assert.Empty(t, ch2)
+}
+
+// memBus is an in-memory eventbus.PubSub delivering messages to all subscribers, including the sender
+type memBus struct {
+	lock   sync.Mutex
+	subs   []func(fromID, key string)
+	closed bool
+}
+
+func (b *memBus) Publish(fromID, key string) error {
+	b.publishRaw(fromID, key)
+	return nil
+}
+
+func (b *memBus) Subscribe(fn func(fromID, key string)) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subs = append(b.subs, fn)
+	return nil
+}
+
+func (b *memBus) Close() error {
+	b.closed = true
+	return nil
+}
+
+func (b *memBus) publishRaw(fromID, key string) {
+	b.lock.Lock()
+	subs := b.subs
+	b.lock.Unlock()
+	for _, fn := range subs {
+		fn(fromID, key)
+	}
+}